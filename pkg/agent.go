@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const (
+	defaultAgentStaleAfter = 10 * time.Minute
+	defaultAgentOutOfOrder = time.Hour
+)
+
+// Conflict policies of late agent samples.
+const (
+	agentConflictOverwrite = "overwrite"
+	agentConflictKeep      = "keep"
+)
+
+// Outcomes of late agent samples, as counted by agentLateSamples.
+const (
+	lateStored   = "stored"
+	lateTooOld   = "too_old"
+	lateFuture   = "future"
+	lateConflict = "conflict"
+)
+
+var agentLateSamples = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "grafana_plugin",
+		Name:      "agent_late_samples_total",
+		Help:      "Timestamped samples pushed by agents, by whether they were stored or dropped as too old, in the future or conflicting with a stored value.",
+	},
+	[]string{"target", "outcome"},
+)
+
+// maxAgentPush bounds the payload of an agent push.
+const maxAgentPush = 64 << 10
+
+// agentTarget is a target pushed to by a lightweight agent, such as a Termux
+// script reporting the battery, storage and network of an old phone.
+type agentTarget struct {
+	staleAfter time.Duration
+	// outOfOrder is how far behind the newest sample late samples are stored
+	outOfOrder time.Duration
+	// keep keeps stored values late samples conflict with
+	keep bool
+	// token is the token of pushes; without one the agent can't push
+	token string
+}
+
+func newAgentTarget(settings models.AgentSettings, token string) (*agentTarget, error) {
+	a := &agentTarget{staleAfter: defaultAgentStaleAfter, outOfOrder: defaultAgentOutOfOrder, token: token}
+	if settings.StaleSeconds > 0 {
+		a.staleAfter = time.Duration(settings.StaleSeconds) * time.Second
+	}
+	if settings.OutOfOrderSeconds < 0 {
+		return nil, fmt.Errorf("outOfOrderSeconds must not be negative")
+	}
+	if settings.OutOfOrderSeconds > 0 {
+		a.outOfOrder = time.Duration(settings.OutOfOrderSeconds) * time.Second
+	}
+	switch settings.Conflict {
+	case "", agentConflictOverwrite:
+	case agentConflictKeep:
+		a.keep = true
+	default:
+		return nil, fmt.Errorf("unknown conflict policy %q, expected %s or %s", settings.Conflict, agentConflictOverwrite, agentConflictKeep)
+	}
+	return a, nil
+}
+
+// agentPush is a parsed agent push.
+type agentPush struct {
+	// Samples are those without a timestamp, which replace the agent's
+	// current samples
+	Samples []metricSample
+	// Late are the timestamped samples, by their time in Unix milliseconds
+	Late map[int64]*sampleSet
+}
+
+// parseAgentPayload parses an agent push: a sample per line, its name, its
+// value, optionally its timestamp as @ and Unix seconds, and then any
+// labels as label=value, separated by spaces, so that shell scripts can echo
+// them:
+//
+//	battery_percent 83
+//	battery_charging 1
+//	storage_free_bytes 1234567890 mount=/sdcard
+//	battery_percent 85 @1718000000.5
+//
+// Names and label names are sanitized; blank lines and lines starting with
+// # are skipped. The samples without a timestamp are all of the agent's
+// current ones; timestamped ones are those it buffered while offline.
+func parseAgentPayload(body []byte) (agentPush, error) {
+	var samples sampleSet
+	late := map[int64]*sampleSet{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return agentPush{}, fmt.Errorf("line %d: expected name value [label=value...]", n)
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return agentPush{}, fmt.Errorf("line %d: invalid value %q", n, fields[1])
+		}
+		set, rest := &samples, fields[2:]
+		if len(rest) > 0 && strings.HasPrefix(rest[0], "@") {
+			ts, err := strconv.ParseFloat(rest[0][1:], 64)
+			if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+				return agentPush{}, fmt.Errorf("line %d: invalid timestamp %q", n, rest[0])
+			}
+			ms := int64(math.Round(ts * 1000))
+			if late[ms] == nil {
+				late[ms] = &sampleSet{}
+			}
+			set, rest = late[ms], rest[1:]
+		}
+		labels := data.Labels{}
+		for _, pair := range rest {
+			label, v, ok := strings.Cut(pair, "=")
+			if !ok || label == "" {
+				return agentPush{}, fmt.Errorf("line %d: expected label=value, got %q", n, pair)
+			}
+			labels[sanitizeMetricName(label)] = v
+		}
+		set.add(sanitizeMetricName(fields[0]), labels, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return agentPush{}, fmt.Errorf("failed to read push: %w", err)
+	}
+	if len(samples.list()) == 0 && len(late) == 0 {
+		return agentPush{}, fmt.Errorf("push has no samples")
+	}
+	return agentPush{Samples: samples.list(), Late: late}, nil
+}
+
+// storeLate stores the timestamped samples of an agent push in the history
+// of target, oldest first, and returns how many were dropped. Samples older
+// than the target's out-of-order window behind its newest sample, or than
+// its history, are dropped, as are those in the future.
+func storeLate(target *scrapeTarget, late map[int64]*sampleSet, now time.Time) (dropped int) {
+	newest := now
+	if last := target.history.lastScraped(); last != nil {
+		newest = *last
+	}
+	cutoff := newest.Add(-min(target.agent.outOfOrder, target.history.retention))
+	if oldest := now.Add(-target.history.retention); cutoff.Before(oldest) {
+		cutoff = oldest
+	}
+
+	count := func(outcome string, n int) {
+		if n > 0 {
+			agentLateSamples.WithLabelValues(target.Name, outcome).Add(float64(n))
+		}
+	}
+	for _, ms := range slices.Sorted(maps.Keys(late)) {
+		t, samples := time.UnixMilli(ms), late[ms].list()
+		switch {
+		case t.After(now):
+			count(lateFuture, len(samples))
+			dropped += len(samples)
+		case t.Before(cutoff):
+			count(lateTooOld, len(samples))
+			dropped += len(samples)
+		default:
+			samples = calibrate(target.calibrations, samples)
+			stored, conflicts := target.history.insert(t, samples, target.agent.keep)
+			target.highRes.insert(t, samples, target.agent.keep, now)
+			count(lateStored, stored)
+			count(lateConflict, conflicts)
+			dropped += conflicts
+		}
+	}
+	return dropped
+}
+
+// agentTarget returns the agent target name, or nil.
+func (ds *testDataSource) agentTarget(name string) *scrapeTarget {
+	for _, t := range ds.targets {
+		if t.Name == name && t.agent != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// pushToken returns the push token of the agent target of the path, or ""
+// for none.
+func (ds *testDataSource) pushToken(r *http.Request) string {
+	if target := ds.agentTarget(r.PathValue("target")); target != nil {
+		return target.agent.token
+	}
+	return ""
+}
+
+// handleAgentPush replaces the samples of an agent target with those pushed,
+// and stores the late ones it buffered in the target's history. Pushes a
+// schema rejects are answered with why. The metrics server serves it, to
+// pushes with the target's token.
+func (ds *testDataSource) handleAgentPush(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("target")
+	target := ds.agentTarget(name)
+	if target == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no agent target %q", name))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAgentPush+1))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("failed to read push: %w", err))
+		return
+	}
+	if len(body) > maxAgentPush {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("push is larger than %d bytes", maxAgentPush))
+		return
+	}
+	var push agentPush
+	if target.push.schema != nil {
+		// Agents with a schema push a JSON document rather than lines
+		push.Samples, err = target.push.decode(body)
+		if err == nil && len(push.Samples) == 0 {
+			err = fmt.Errorf("push has no samples")
+		}
+	} else {
+		push, err = parseAgentPayload(body)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now()
+	dropped := storeLate(target, push.Late, now)
+	if len(push.Samples) > 0 {
+		target.push.update(func(set *sampleSet) {
+			*set = sampleSet{}
+			for _, s := range push.Samples {
+				set.add(s.Name, s.Labels, s.Value)
+			}
+		})
+	}
+	target.push.connected()
+	target.push.flush(target, now)
+	w.Header().Set("Content-Type", "text/plain")
+	if dropped > 0 {
+		fmt.Fprintf(w, "OK, %d late samples dropped", dropped)
+		return
+	}
+	io.WriteString(w, "OK")
+}
+
+// watchAgent expires the samples of an agent target once it stops pushing,
+// until the instance is disposed of.
+func (ds *testDataSource) watchAgent(ctx context.Context, target *scrapeTarget) {
+	ticker := time.NewTicker(min(target.agent.staleAfter, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			target.push.expire(now, target.agent.staleAfter)
+		}
+	}
+}
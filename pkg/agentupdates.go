@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// platformPattern matches the operating systems and architectures agents
+// report, as Go names them, and keeps them from escaping the binaries dir.
+var platformPattern = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// agentManifest describes the agent binary of a platform. Signature is the
+// Ed25519 signature of signedAgentMessage, which agents verify with the
+// public key they were installed with before replacing themselves.
+type agentManifest struct {
+	Version   string `json:"version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	URL       string `json:"url"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+	PublicKey string `json:"publicKey"`
+}
+
+// signedAgentMessage is what the signature of a manifest covers, so that a
+// binary can't be served as another version or platform.
+func signedAgentMessage(m agentManifest) []byte {
+	return []byte(fmt.Sprintf("homelab-agent %s %s/%s %s", m.Version, m.OS, m.Arch, m.SHA256))
+}
+
+// agentCheckIn is the last update handshake or report of an agent.
+type agentCheckIn struct {
+	Agent   string    `json:"agent"`
+	OS      string    `json:"os"`
+	Arch    string    `json:"arch"`
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+	// Outdated is set when the agent runs another version than the one
+	// published, and Error when it reported a failed update
+	Outdated bool   `json:"outdated"`
+	Error    string `json:"error,omitempty"`
+}
+
+// agentReleases publishes the agent binaries of a version and tracks the
+// agents checking for updates, with their tokens by name.
+type agentReleases struct {
+	dir     string
+	version string
+	key     ed25519.PrivateKey
+	tokens  map[string]string
+
+	mu sync.Mutex
+	// manifests are cached by platform until their binary changes
+	manifests map[string]cachedManifest
+	checkIns  map[string]agentCheckIn
+}
+
+type cachedManifest struct {
+	modTime  time.Time
+	manifest agentManifest
+}
+
+func newAgentReleases(settings models.AgentReleaseSettings, keyPEM string, tokens map[string]string) (*agentReleases, error) {
+	if _, _, ok := parseVersion(settings.Version); !ok {
+		return nil, fmt.Errorf("invalid version %q", settings.Version)
+	}
+	if info, err := os.Stat(settings.Dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", settings.Dir)
+	}
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM signing key in agentSigningKey")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is a %T, not Ed25519", parsed)
+	}
+	return &agentReleases{
+		dir:       settings.Dir,
+		version:   settings.Version,
+		key:       key,
+		tokens:    tokens,
+		manifests: map[string]cachedManifest{},
+		checkIns:  map[string]agentCheckIn{},
+	}, nil
+}
+
+// binaryPath returns the path of the binary of a platform.
+func (a *agentReleases) binaryPath(goos, arch string) string {
+	name := "agent-" + goos + "-" + arch
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return filepath.Join(a.dir, name)
+}
+
+// manifest describes and signs the binary of a platform, or returns
+// os.ErrNotExist when there is none. Its URL is left for the agent asking.
+func (a *agentReleases) manifest(goos, arch string) (agentManifest, error) {
+	path := a.binaryPath(goos, arch)
+	info, err := os.Stat(path)
+	if err != nil {
+		return agentManifest{}, err
+	}
+	key := goos + "/" + arch
+	a.mu.Lock()
+	cached, ok := a.manifests[key]
+	a.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.manifest.Size == info.Size() {
+		return cached.manifest, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return agentManifest{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return agentManifest{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	m := agentManifest{
+		Version:   a.version,
+		OS:        goos,
+		Arch:      arch,
+		Size:      size,
+		SHA256:    hex.EncodeToString(h.Sum(nil)),
+		PublicKey: base64.StdEncoding.EncodeToString(a.key.Public().(ed25519.PublicKey)),
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(a.key, signedAgentMessage(m)))
+
+	a.mu.Lock()
+	a.manifests[key] = cachedManifest{modTime: info.ModTime(), manifest: m}
+	a.mu.Unlock()
+	return m, nil
+}
+
+// checkIn records the handshake or report of an agent. Reports that don't
+// name the platform keep that of the handshake.
+func (a *agentReleases) checkIn(c agentCheckIn) {
+	cmp, ok := compareVersions(c.Version, a.version)
+	c.Outdated = !ok || cmp != 0
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if previous, ok := a.checkIns[c.Agent]; ok && c.OS == "" && c.Arch == "" {
+		c.OS, c.Arch = previous.OS, previous.Arch
+	}
+	a.checkIns[c.Agent] = c
+}
+
+// agentUpdateOffer answers the update handshake of an agent: whether it
+// should update, and to what.
+type agentUpdateOffer struct {
+	Update   bool          `json:"update"`
+	Manifest agentManifest `json:"manifest"`
+}
+
+// platformOf reads and validates the platform of an agent route.
+func platformOf(r *http.Request) (string, string, error) {
+	goos, arch := r.PathValue("os"), r.PathValue("arch")
+	if !platformPattern.MatchString(goos) || !platformPattern.MatchString(arch) {
+		return "", "", fmt.Errorf("invalid platform %s/%s", goos, arch)
+	}
+	return goos, arch, nil
+}
+
+// agentToken returns the token of the agent of the path, or "" for none.
+func (ds *testDataSource) agentToken(r *http.Request) string {
+	if ds.agentReleases == nil {
+		return ""
+	}
+	return ds.agentReleases.tokens[r.PathValue("agent")]
+}
+
+// handleAgentUpdate is the update handshake: an agent names itself and the
+// version it runs, and gets the manifest of its platform. Agents running
+// another version download the binary, verify its checksum and signature,
+// replace themselves, and report how that went. The metrics server serves
+// the agent routes, to agents with their token.
+func (ds *testDataSource) handleAgentUpdate(w http.ResponseWriter, r *http.Request) {
+	if ds.agentReleases == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no agent releases configured"))
+		return
+	}
+	goos, arch, err := platformOf(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	agent, current := r.PathValue("agent"), r.URL.Query().Get("version")
+	if current == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("version is required"))
+		return
+	}
+	m, err := ds.agentReleases.manifest(goos, arch)
+	if os.IsNotExist(err) {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no agent binary for %s/%s", goos, arch))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// Agents fetch the binary from where they asked, with their token
+	m.URL = "/agent-updates/" + url.PathEscape(ds.uid) + "/" + url.PathEscape(agent) + "/" + goos + "/" + arch + "/binary"
+	ds.agentReleases.checkIn(agentCheckIn{Agent: agent, OS: goos, Arch: arch, Version: current, Time: time.Now().UTC()})
+	// Agents ahead of the published version, such as test builds, are
+	// brought back to it too
+	cmp, ok := compareVersions(current, m.Version)
+	writeJSON(w, http.StatusOK, agentUpdateOffer{Update: !ok || cmp != 0, Manifest: m})
+}
+
+// handleAgentBinary serves the agent binary of a platform.
+func (ds *testDataSource) handleAgentBinary(w http.ResponseWriter, r *http.Request) {
+	if ds.agentReleases == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no agent releases configured"))
+		return
+	}
+	goos, arch, err := platformOf(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	f, err := os.Open(ds.agentReleases.binaryPath(goos, arch))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no agent binary for %s/%s", goos, arch))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, filepath.Base(f.Name()), info.ModTime(), f)
+}
+
+// handleAgentReport records the outcome of an update: the version the agent
+// runs after it, and why it failed, if it did. Agents only report for
+// themselves.
+func (ds *testDataSource) handleAgentReport(w http.ResponseWriter, r *http.Request) {
+	if ds.agentReleases == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no agent releases configured"))
+		return
+	}
+	var report agentCheckIn
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&report); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid report: %w", err))
+		return
+	}
+	if report.Version == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("version is required"))
+		return
+	}
+	if agent := r.PathValue("agent"); report.Agent == "" {
+		report.Agent = agent
+	} else if report.Agent != agent {
+		writeJSONError(w, http.StatusForbidden, fmt.Errorf("agent %s can't report for %s", agent, report.Agent))
+		return
+	}
+	report.Time = time.Now().UTC()
+	if report.Error != "" {
+		backend.Logger.Warn("Agent update failed", "agent", report.Agent, "version", report.Version, "error", report.Error)
+	}
+	ds.agentReleases.checkIn(report)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAgentFleet lists the agents that checked for updates, and the
+// version they run.
+func (ds *testDataSource) handleAgentFleet(w http.ResponseWriter, _ *http.Request) {
+	if ds.agentReleases == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no agent releases configured"))
+		return
+	}
+	a := ds.agentReleases
+	a.mu.Lock()
+	agents := make([]agentCheckIn, 0, len(a.checkIns))
+	for _, c := range a.checkIns {
+		agents = append(agents, c)
+	}
+	a.mu.Unlock()
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Agent < agents[j].Agent })
+	writeJSON(w, http.StatusOK, map[string]any{"version": a.version, "agents": agents})
+}
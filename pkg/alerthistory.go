@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeAlertHistory = "alerthistory"
+
+// maxAlertHistory bounds the number of alerts kept in memory.
+const maxAlertHistory = 1000
+
+// maxAlertNotification bounds the body of an Alertmanager notification.
+const maxAlertNotification = 1 << 20
+
+func init() {
+	registerQueryType(queryTypeAlertHistory, queryAlertHistory, alertHistoryQuery{})
+}
+
+type alertHistoryQuery struct {
+	// AlertName and Labels select alerts by their name and label values;
+	// empty means all of them.
+	AlertName string            `json:"alertName"`
+	Labels    map[string]string `json:"labels"`
+	// Status is "firing" or "resolved" to select alerts by it; empty means
+	// both.
+	Status string `json:"status"`
+	// Mode is "table" (default) for a row per alert, or "annotations" for
+	// regions spanning the alerts.
+	Mode string `json:"mode"`
+}
+
+// alertRecord is an alert Alertmanager notified of, from when it started
+// firing until it resolved. An alert that fires again is another record.
+type alertRecord struct {
+	Fingerprint string
+	Status      string
+	Receiver    string
+	Labels      map[string]string
+	Annotations map[string]string
+	StartsAt    time.Time
+	// EndsAt is zero while the alert fires
+	EndsAt time.Time
+	// Updated is when the alert was last notified of
+	Updated time.Time
+}
+
+// text describes the alert in annotations: its summary, or its name.
+func (r alertRecord) text() string {
+	text := r.Annotations["summary"]
+	if text == "" {
+		text = r.Labels["alertname"]
+	}
+	if r.Status == "firing" {
+		return text + " (firing)"
+	}
+	return text
+}
+
+// labelText formats the labels of the alert as Alertmanager shows them.
+func (r alertRecord) labelText() string {
+	keys := make([]string, 0, len(r.Labels))
+	for k := range r.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%q", k, r.Labels[k])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// alertLog keeps the alerts Alertmanager notified of, so that their
+// history can be charted without Grafana's alert state history. Alertmanager
+// notifies of an alert again while it fires, and once when it resolves, so
+// notifications update the record of the alert rather than add to them.
+type alertLog struct {
+	mu      sync.Mutex
+	records []alertRecord
+	// index finds the record of an alert by its fingerprint and start
+	index map[string]int
+}
+
+func newAlertLog() *alertLog {
+	return &alertLog{index: map[string]int{}}
+}
+
+func alertRecordKey(fingerprint string, startsAt time.Time) string {
+	return fingerprint + "\x00" + startsAt.Format(time.RFC3339Nano)
+}
+
+// record records the alerts of a notification received at now.
+func (h *alertLog) record(n alertmanagerWebhook, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, a := range n.Alerts {
+		r := alertRecord{
+			Fingerprint: a.Fingerprint,
+			Status:      a.Status,
+			Receiver:    n.Receiver,
+			Labels:      a.Labels,
+			Annotations: a.Annotations,
+			StartsAt:    a.StartsAt.UTC(),
+			Updated:     now,
+		}
+		// Alertmanager sets the end of firing alerts to when it resolves
+		// them unless they're notified of again, which isn't when they ended
+		if r.Status == "resolved" {
+			r.EndsAt = a.EndsAt.UTC()
+		} else {
+			r.Status = "firing"
+		}
+		if r.Fingerprint == "" {
+			r.Fingerprint = pluginAlert{Labels: r.Labels}.fingerprint()
+		}
+		key := alertRecordKey(r.Fingerprint, r.StartsAt)
+		if i, ok := h.index[key]; ok {
+			h.records[i] = r
+			continue
+		}
+		h.index[key] = len(h.records)
+		h.records = append(h.records, r)
+	}
+
+	if len(h.records) > maxAlertHistory {
+		h.records = h.records[len(h.records)-maxAlertHistory:]
+		h.index = make(map[string]int, len(h.records))
+		for i, r := range h.records {
+			h.index[alertRecordKey(r.Fingerprint, r.StartsAt)] = i
+		}
+	}
+}
+
+// within returns the alerts of q that fired within tr, oldest first. Alerts
+// still firing are taken to fire until now.
+func (h *alertLog) within(tr backend.TimeRange, q alertHistoryQuery, now time.Time) []alertRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var selected []alertRecord
+	for _, r := range h.records {
+		end := r.EndsAt
+		if r.Status == "firing" {
+			end = now
+		}
+		if end.Before(tr.From) || r.StartsAt.After(tr.To) {
+			continue
+		}
+		if (q.AlertName != "" && r.Labels["alertname"] != q.AlertName) || (q.Status != "" && r.Status != q.Status) {
+			continue
+		}
+		matches := true
+		for k, v := range q.Labels {
+			if r.Labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			selected = append(selected, r)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool { return selected[i].StartsAt.Before(selected[j].StartsAt) })
+	return selected
+}
+
+// alertWebhookToken returns the token of Alertmanager webhook
+// notifications, or "" for none.
+func (ds *testDataSource) alertWebhookToken(*http.Request) string {
+	if ds.settings.Secrets == nil {
+		return ""
+	}
+	return ds.settings.Secrets.AlertWebhookToken
+}
+
+// handleAlertmanagerWebhook records a notification of an Alertmanager
+// webhook receiver pointed at /alertmanager/webhook/<data source UID> of the
+// metrics server, whose http_config authorizes it with the
+// alertWebhookToken of secure settings.
+func (ds *testDataSource) handleAlertmanagerWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAlertNotification+1))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("failed to read notification: %w", err))
+		return
+	}
+	if len(body) > maxAlertNotification {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("notification is larger than %d bytes", maxAlertNotification))
+		return
+	}
+	var n alertmanagerWebhook
+	if err := json.Unmarshal(body, &n); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid notification: %w", err))
+		return
+	}
+	if n.Version != "" && n.Version != "4" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("unsupported notification version %q, expected 4", n.Version))
+		return
+	}
+	for _, a := range n.Alerts {
+		if a.StartsAt.IsZero() || len(a.Labels) == 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("alerts need labels and a start time"))
+			return
+		}
+	}
+	ds.alertLog.record(n, time.Now().UTC())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func queryAlertHistory(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q alertHistoryQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	switch q.Status {
+	case "", "firing", "resolved":
+	default:
+		return nil, fmt.Errorf("unknown status %q, expected firing or resolved", q.Status)
+	}
+	now := time.Now().UTC()
+	records := ds.alertLog.within(query.TimeRange, q, now)
+	if q.Mode == "annotations" {
+		return data.Frames{alertAnnotationFrame(records, now)}, nil
+	}
+	return data.Frames{alertHistoryFrame(records, now)}, nil
+}
+
+// alertHistoryFrame returns a row per alert, with how long it fired.
+func alertHistoryFrame(records []alertRecord, now time.Time) *data.Frame {
+	frame := data.NewFrame("alert history",
+		data.NewField("start", nil, []time.Time{}),
+		data.NewField("end", nil, []*time.Time{}),
+		data.NewField("duration", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("status", nil, []string{}),
+		data.NewField("alertname", nil, []string{}),
+		data.NewField("severity", nil, []string{}),
+		data.NewField("summary", nil, []string{}),
+		data.NewField("labels", nil, []string{}),
+		data.NewField("receiver", nil, []string{}),
+	)
+	for _, r := range records {
+		var end *time.Time
+		until := now
+		if r.Status == "resolved" {
+			end = &r.EndsAt
+			until = r.EndsAt
+		}
+		frame.AppendRow(r.StartsAt, end, until.Sub(r.StartsAt).Seconds(), r.Status, r.Labels["alertname"],
+			r.Labels["severity"], r.Annotations["summary"], r.labelText(), r.Receiver)
+	}
+	return frame
+}
+
+// alertAnnotationFrame returns alerts in annotation shape, as regions
+// tagged with their name and severity. Alerts still firing end at now.
+func alertAnnotationFrame(records []alertRecord, now time.Time) *data.Frame {
+	frame := data.NewFrame("alert history",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("timeEnd", nil, []time.Time{}),
+		data.NewField("text", nil, []string{}),
+		data.NewField("tags", nil, []string{}),
+		data.NewField("status", nil, []string{}),
+	)
+	for _, r := range records {
+		end := r.EndsAt
+		if r.Status == "firing" {
+			end = now
+		}
+		tags := []string{"alert", r.Labels["alertname"]}
+		if severity := r.Labels["severity"]; severity != "" {
+			tags = append(tags, severity)
+		}
+		frame.AppendRow(r.StartsAt, end, r.text(), strings.Join(tags, ","), r.Status)
+	}
+	return frame
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const defaultAlertInterval = time.Minute
+
+// alertResendFactor is how many intervals an alert lasts without being sent
+// again, after which Alertmanager resolves it: alerts of an instance that
+// went away don't fire forever.
+const alertResendFactor = 4
+
+const (
+	alertmanagerModeAPI     = "api"
+	alertmanagerModeWebhook = "webhook"
+)
+
+// pluginAlert is a problem the plugin detected itself.
+type pluginAlert struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// fingerprint identifies an alert by its labels.
+func (a pluginAlert) fingerprint() string {
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s\xff%s\xff", k, a.Labels[k])
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// pingAlertNames are the alerts of ping check states, and their severity.
+var pingAlertNames = map[string][2]string{
+	"late":   {"HomelabPingLate", "warning"},
+	"down":   {"HomelabPingDown", "critical"},
+	"failed": {"HomelabPingFailed", "critical"},
+}
+
+// currentAlerts returns the problems of the instance at now: targets whose
+// last scrape failed, other background jobs whose last run failed, and ping
+// checks that are late, down or failed.
+func (ds *testDataSource) currentAlerts(now time.Time) []pluginAlert {
+	var alerts []pluginAlert
+	for _, st := range ds.schedule.statuses("") {
+		if st.State != "failed" {
+			continue
+		}
+		if st.Kind == "scrape" {
+			alerts = append(alerts, pluginAlert{
+				Labels:      map[string]string{"alertname": "HomelabTargetDown", "severity": "critical", "target": st.Subject},
+				Annotations: map[string]string{"summary": fmt.Sprintf("Scraping %s fails", st.Subject), "description": st.LastError},
+			})
+			continue
+		}
+		labels := map[string]string{"alertname": "HomelabJobFailed", "severity": "warning", "job": st.Kind}
+		summary := fmt.Sprintf("The %s job fails", st.Kind)
+		if st.Subject != "" {
+			labels["subject"] = st.Subject
+			summary = fmt.Sprintf("The %s job of %s fails", st.Kind, st.Subject)
+		}
+		alerts = append(alerts, pluginAlert{Labels: labels, Annotations: map[string]string{"summary": summary, "description": st.LastError}})
+	}
+
+	for slug, check := range ds.pingChecks {
+		status := check.status(ds.pings.history(slug), now)
+		name, ok := pingAlertNames[status.State]
+		if !ok {
+			continue
+		}
+		summary := fmt.Sprintf("%s is %s", check.Name, status.State)
+		if check.Name == "" {
+			summary = fmt.Sprintf("%s is %s", slug, status.State)
+		}
+		alerts = append(alerts, pluginAlert{
+			Labels:      map[string]string{"alertname": name[0], "severity": name[1], "check": slug},
+			Annotations: map[string]string{"summary": summary, "description": status.Message},
+		})
+	}
+	return alerts
+}
+
+// alertmanagerAlert is an alert of Alertmanager's v2 API, and of its
+// webhook notifications with Status and Fingerprint.
+type alertmanagerAlert struct {
+	Status       string            `json:"status,omitempty"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint,omitempty"`
+}
+
+// alertmanagerWebhook is a webhook notification of Alertmanager.
+type alertmanagerWebhook struct {
+	Version           string              `json:"version"`
+	GroupKey          string              `json:"groupKey"`
+	TruncatedAlerts   int                 `json:"truncatedAlerts"`
+	Status            string              `json:"status"`
+	Receiver          string              `json:"receiver"`
+	GroupLabels       map[string]string   `json:"groupLabels"`
+	CommonLabels      map[string]string   `json:"commonLabels"`
+	CommonAnnotations map[string]string   `json:"commonAnnotations"`
+	ExternalURL       string              `json:"externalURL"`
+	Alerts            []alertmanagerAlert `json:"alerts"`
+}
+
+// alertForwarder sends the alerts of an instance to Alertmanager, and
+// remembers those firing to resolve them once they're gone.
+type alertForwarder struct {
+	settings models.AlertmanagerSettings
+	token    string
+	interval time.Duration
+	// firing are the start times of the alerts sent as firing, by
+	// fingerprint, with the alerts
+	firing map[string]firingAlert
+}
+
+type firingAlert struct {
+	alert    pluginAlert
+	startsAt time.Time
+}
+
+func newAlertForwarder(settings models.AlertmanagerSettings, token string) (*alertForwarder, error) {
+	if u, err := url.Parse(settings.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", settings.URL)
+	}
+	switch settings.Mode {
+	case "":
+		settings.Mode = alertmanagerModeAPI
+	case alertmanagerModeAPI, alertmanagerModeWebhook:
+	default:
+		return nil, fmt.Errorf("unknown mode %q, expected api or webhook", settings.Mode)
+	}
+	f := &alertForwarder{settings: settings, token: token, interval: defaultAlertInterval, firing: map[string]firingAlert{}}
+	if s := settings.IntervalSeconds; s > 0 {
+		f.interval = time.Duration(s) * time.Second
+	}
+	return f, nil
+}
+
+// payload builds the alerts to send at now: current ones as firing, and
+// those firing before that are gone as resolved.
+func (f *alertForwarder) payload(current []pluginAlert, uid string, now time.Time) ([]alertmanagerAlert, map[string]firingAlert) {
+	firing := map[string]firingAlert{}
+	var alerts []alertmanagerAlert
+	for _, a := range current {
+		a.Labels["datasource"] = uid
+		for k, v := range f.settings.Labels {
+			a.Labels[k] = v
+		}
+		fp := a.fingerprint()
+		startsAt := now
+		if previous, ok := f.firing[fp]; ok {
+			startsAt = previous.startsAt
+		}
+		firing[fp] = firingAlert{alert: a, startsAt: startsAt}
+		alerts = append(alerts, alertmanagerAlert{
+			Status:      "firing",
+			Labels:      a.Labels,
+			Annotations: a.Annotations,
+			StartsAt:    startsAt,
+			EndsAt:      now.Add(alertResendFactor * f.interval),
+			Fingerprint: fp,
+		})
+	}
+	for fp, previous := range f.firing {
+		if _, ok := firing[fp]; ok {
+			continue
+		}
+		alerts = append(alerts, alertmanagerAlert{
+			Status:      "resolved",
+			Labels:      previous.alert.Labels,
+			Annotations: previous.alert.Annotations,
+			StartsAt:    previous.startsAt,
+			EndsAt:      now,
+			Fingerprint: fp,
+		})
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Fingerprint < alerts[j].Fingerprint })
+	return alerts, firing
+}
+
+// send posts alerts to the Alertmanager, or its webhook receiver.
+func (f *alertForwarder) send(ctx context.Context, client *http.Client, uid string, alerts []alertmanagerAlert) error {
+	target := f.settings.URL
+	var body any
+	if f.settings.Mode == alertmanagerModeWebhook {
+		status := "resolved"
+		for _, a := range alerts {
+			if a.Status == "firing" {
+				status = "firing"
+				break
+			}
+		}
+		body = alertmanagerWebhook{
+			Version:           "4",
+			GroupKey:          "{}:{datasource=\"" + uid + "\"}",
+			Status:            status,
+			Receiver:          "homelab",
+			GroupLabels:       map[string]string{"datasource": uid},
+			CommonLabels:      map[string]string{"datasource": uid},
+			CommonAnnotations: map[string]string{},
+			Alerts:            alerts,
+		}
+	} else {
+		u, err := url.Parse(target)
+		if err != nil {
+			return err
+		}
+		target = u.JoinPath("api", "v2", "alerts").String()
+		// The v2 API takes alerts without their status, which their end
+		// time implies
+		posted := make([]alertmanagerAlert, len(alerts))
+		for i, a := range alerts {
+			a.Status, a.Fingerprint = "", ""
+			posted[i] = a
+		}
+		body = posted
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %w", redactURL(target), err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	resp, err := send(client, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// runAlertForwarder sends the alerts of the instance every interval, until
+// it is disposed of, and none during maintenance windows. Alerts that failed
+// to resolve are sent again.
+func (ds *testDataSource) runAlertForwarder(ctx context.Context) {
+	f := ds.alerts
+	job := ds.schedule.add("alertmanager", "", f.interval, time.Now().Add(f.interval))
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := job.run(func() error {
+			now := time.Now().UTC()
+			current := ds.currentAlerts(now)
+			// Alerts are resolved during maintenance, rather than left to
+			// fire once it ends
+			if windows := ds.maintenance.active(time.Now()); len(windows) > 0 {
+				current = nil
+			}
+			alerts, firing := f.payload(current, ds.uid, now)
+			if len(alerts) == 0 {
+				return nil
+			}
+			if err := f.send(ctx, ds.httpClient, ds.uid, alerts); err != nil {
+				return err
+			}
+			f.firing = firing
+			return nil
+		})
+		if err != nil {
+			backend.Logger.Warn("Failed to forward alerts", "error", err)
+		}
+	}
+}
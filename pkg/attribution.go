@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeAttribution = "attribution"
+
+// hostService is the service of a host's power not attributed to any of its
+// containers: its own processes, such as the kubelet and container runtime,
+// and its draw while idle.
+const hostService = "(host)"
+
+func init() {
+	registerQueryType(queryTypeAttribution, queryAttribution, attributionQuery{})
+}
+
+type attributionQuery struct {
+	// Power is a query of power in watts, such as a metric query of smart
+	// plugs, with a series per host. A host with several series, such as
+	// one with two power supplies, draws their sum.
+	Power json.RawMessage `json:"power"`
+	// HostLabel is the label of the power series naming the target of the
+	// host they power, "target" by default.
+	HostLabel string `json:"hostLabel"`
+	// PricePerKWh prices the energy in Currency, an ISO 4217 code.
+	PricePerKWh float64 `json:"pricePerKWh"`
+	Currency    string  `json:"currency"`
+}
+
+// containerService returns the service a cAdvisor series of CPU usage is
+// of: namespace/container for Kubernetes containers, as the kubelet or a
+// standalone cAdvisor labels them, or the name of other containers. It is
+// empty for series that only add up others, such as those of cgroups and
+// pods, or of sandboxes.
+func containerService(labels data.Labels) string {
+	if cpu := labels["cpu"]; cpu != "" && cpu != "total" {
+		return ""
+	}
+	namespace, container := labels["namespace"], labels["container"]
+	if namespace == "" {
+		namespace, container = labels["container_label_io_kubernetes_pod_namespace"], labels["container_label_io_kubernetes_container_name"]
+	}
+	if namespace != "" {
+		if container == "" || container == "POD" {
+			return ""
+		}
+		return namespace + "/" + container
+	}
+	return labels["name"]
+}
+
+// cpuInterval is the CPU time a host and its services used between two
+// scrapes, in seconds. Busy is NaN when the host doesn't expose its CPUs.
+type cpuInterval struct {
+	Start    time.Time
+	End      time.Time
+	Busy     float64
+	Services []float64
+}
+
+// cpuIntervals replays the history of a target within tr for the CPU time
+// used between its scrapes: that of its services, from the cAdvisor series
+// container_cpu_usage_seconds_total, and that of all its CPUs, from
+// node_cpu_seconds_total in modes other than idle and iowait. It also
+// returns the services, which index the CPU times of the intervals.
+func (h *scrapeHistory) cpuIntervals(tr backend.TimeRange) ([]string, []cpuInterval) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var services []string
+	serviceIndex := map[string]int{}
+	// Series of services, with the service they add to, and of busy CPUs
+	var containers, of, busy []int
+	for i, s := range h.series {
+		switch s.Name {
+		case "container_cpu_usage_seconds_total":
+			service := containerService(s.Labels)
+			if service == "" {
+				continue
+			}
+			j, ok := serviceIndex[service]
+			if !ok {
+				j = len(services)
+				serviceIndex[service] = j
+				services = append(services, service)
+			}
+			containers = append(containers, i)
+			of = append(of, j)
+		case "node_cpu_seconds_total":
+			if mode := s.Labels["mode"]; mode != "idle" && mode != "iowait" {
+				busy = append(busy, i)
+			}
+		}
+	}
+	if len(containers) == 0 && len(busy) == 0 {
+		return nil, nil
+	}
+	// used returns how far a counter went up since prev, or zero when it
+	// wasn't there or reset
+	used := func(prev, current float64) float64 {
+		if math.IsNaN(prev) || math.IsNaN(current) || current < prev {
+			return 0
+		}
+		return current - prev
+	}
+
+	var intervals []cpuInterval
+	var prev []float64
+	var prevTime time.Time
+	current := append([]float64(nil), h.base...)
+	for _, s := range h.scrapes {
+		for _, c := range s.Changes {
+			current[c.Series] = c.Value
+		}
+		if s.Time.Before(tr.From) || s.Time.After(tr.To) {
+			continue
+		}
+		if prev != nil {
+			interval := cpuInterval{Start: prevTime, End: s.Time, Busy: math.NaN(), Services: make([]float64, len(services))}
+			for k, i := range containers {
+				interval.Services[of[k]] += used(prev[i], current[i])
+			}
+			if len(busy) > 0 {
+				interval.Busy = 0
+				for _, i := range busy {
+					interval.Busy += used(prev[i], current[i])
+				}
+			}
+			intervals = append(intervals, interval)
+		}
+		prev = append(prev[:0], current...)
+		prevTime = s.Time
+	}
+	return services, intervals
+}
+
+// powerSeries is the power a host draws from one supply, in watts, sorted
+// by time.
+type powerSeries struct {
+	Times []time.Time
+	Watts []float64
+}
+
+// at returns the last power sampled at or before t, or false when there is
+// none.
+func (p powerSeries) at(t time.Time) (float64, bool) {
+	i := sort.Search(len(p.Times), func(i int) bool { return p.Times[i].After(t) }) - 1
+	if i < 0 {
+		return 0, false
+	}
+	return p.Watts[i], true
+}
+
+// hostPower is the power of a host from all its supplies.
+type hostPower []powerSeries
+
+// at returns the sum of the power of the supplies sampled by t, or false
+// when none is.
+func (p hostPower) at(t time.Time) (float64, bool) {
+	var total float64
+	var found bool
+	for _, s := range p {
+		if w, ok := s.at(t); ok {
+			total += w
+			found = true
+		}
+	}
+	return total, found
+}
+
+// powerByHost groups the power series of frames by their hostLabel.
+func powerByHost(frames data.Frames, hostLabel string) (map[string]hostPower, error) {
+	hosts := map[string]hostPower{}
+	for _, frame := range frames {
+		var times *data.Field
+		for _, field := range frame.Fields {
+			if field.Type().Time() {
+				times = field
+				break
+			}
+		}
+		if times == nil {
+			continue
+		}
+		for _, field := range frame.Fields {
+			if !field.Type().Numeric() {
+				continue
+			}
+			host := field.Labels[hostLabel]
+			if host == "" {
+				return nil, fmt.Errorf("power series %s has no %s label", field.Name, hostLabel)
+			}
+			scale, err := wattScale(field)
+			if err != nil {
+				return nil, fmt.Errorf("power series %w", err)
+			}
+			var series powerSeries
+			for row := 0; row < field.Len(); row++ {
+				t, ok := times.ConcreteAt(row)
+				if !ok {
+					continue
+				}
+				watts, err := field.NullableFloatAt(row)
+				if err != nil {
+					return nil, err
+				}
+				if watts != nil && !math.IsNaN(*watts) {
+					series.Times = append(series.Times, t.(time.Time))
+					series.Watts = append(series.Watts, *watts*scale)
+				}
+			}
+			sort.Sort(byTime(series))
+			hosts[host] = append(hosts[host], series)
+		}
+	}
+	return hosts, nil
+}
+
+// byTime sorts the samples of a power series by time.
+type byTime powerSeries
+
+func (s byTime) Len() int           { return len(s.Times) }
+func (s byTime) Less(i, j int) bool { return s.Times[i].Before(s.Times[j]) }
+func (s byTime) Swap(i, j int) {
+	s.Times[i], s.Times[j] = s.Times[j], s.Times[i]
+	s.Watts[i], s.Watts[j] = s.Watts[j], s.Watts[i]
+}
+
+// serviceEnergy is the energy attributed to a service of a host over a
+// period, and the CPU time it used.
+type serviceEnergy struct {
+	Host       string
+	Service    string
+	CPUSeconds float64
+	// Energy is in watt-hours
+	Energy float64
+	// Share is the share of the energy of the host
+	Share float64
+	// Duration is how long the power of the host was known
+	Duration time.Duration
+}
+
+// attributeEnergy splits the energy a host drew over intervals between its
+// services by their share of the CPU time it used. What its services
+// didn't use, and all it drew while its CPUs had nothing to do, goes to
+// hostService. Intervals before the power of the host was first sampled
+// are left out.
+func attributeEnergy(host string, services []string, intervals []cpuInterval, power hostPower) []serviceEnergy {
+	rows := make([]serviceEnergy, len(services)+1)
+	for i, service := range services {
+		rows[i] = serviceEnergy{Host: host, Service: service}
+	}
+	rest := &rows[len(services)]
+	*rest = serviceEnergy{Host: host, Service: hostService}
+
+	var duration time.Duration
+	var total float64
+	for _, interval := range intervals {
+		watts, ok := power.at(interval.End)
+		if !ok {
+			continue
+		}
+		dt := interval.End.Sub(interval.Start)
+		energy := watts * dt.Hours()
+		duration += dt
+		total += energy
+
+		var used float64
+		for _, seconds := range interval.Services {
+			used += seconds
+		}
+		// Without node_exporter, or when counters are out of step, the
+		// host is as busy as its services
+		busy := interval.Busy
+		if math.IsNaN(busy) || busy < used {
+			busy = used
+		}
+		if busy <= 0 {
+			rest.Energy += energy
+			continue
+		}
+		for i, seconds := range interval.Services {
+			rows[i].CPUSeconds += seconds
+			rows[i].Energy += energy * seconds / busy
+		}
+		rest.CPUSeconds += busy - used
+		rest.Energy += energy * (busy - used) / busy
+	}
+	if duration == 0 {
+		return nil
+	}
+	for i := range rows {
+		rows[i].Duration = duration
+		if total > 0 {
+			rows[i].Share = rows[i].Energy / total
+		}
+	}
+	return rows
+}
+
+func queryAttribution(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q attributionQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if len(q.Power) == 0 {
+		return nil, fmt.Errorf("attribution needs a power query")
+	}
+	hostLabel := q.HostLabel
+	if hostLabel == "" {
+		hostLabel = "target"
+	}
+	targets, err := ds.selectTargets(allTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	frames, err := ds.runInnerQuery(ctx, query, q.Power)
+	if err != nil {
+		return nil, fmt.Errorf("power query: %w", err)
+	}
+	power, err := powerByHost(frames, hostLabel)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, 0, len(power))
+	for host := range power {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var rows []serviceEnergy
+	var unknown []string
+	for _, host := range hosts {
+		i := slices.IndexFunc(targets, func(t *scrapeTarget) bool { return t.Name == host })
+		if i < 0 {
+			unknown = append(unknown, host)
+			continue
+		}
+		services, intervals := targets[i].history.cpuIntervals(query.TimeRange)
+		hostRows := attributeEnergy(host, services, intervals, power[host])
+		sort.SliceStable(hostRows, func(i, j int) bool { return hostRows[i].Energy > hostRows[j].Energy })
+		rows = append(rows, hostRows...)
+	}
+
+	frame := attributionFrame(rows, q.PricePerKWh, q.Currency)
+	if len(unknown) > 0 {
+		frame.Meta = &data.FrameMeta{Notices: []data.Notice{{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("No target for the power of %s", strings.Join(unknown, ", ")),
+		}}}
+	}
+	return data.Frames{frame}, nil
+}
+
+// attributionFrame returns a row per service of each host, with its mean
+// CPU usage and power over the period, the energy it drew, and what a month
+// at that power costs.
+func attributionFrame(rows []serviceEnergy, pricePerKWh float64, currency string) *data.Frame {
+	frame := data.NewFrame("attribution",
+		data.NewField("host", nil, []string{}),
+		data.NewField("service", nil, []string{}),
+		data.NewField("cpu", nil, []float64{}),
+		data.NewField("share", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "percentunit", Min: ptrConfFloat64(0), Max: ptrConfFloat64(1)}),
+		data.NewField("watts", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "watt"}),
+		data.NewField("energy", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "kwatth"}),
+		data.NewField("cost_per_month", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: currencyUnit(currency)}),
+	)
+	for _, r := range rows {
+		seconds := r.Duration.Seconds()
+		watts := r.Energy / r.Duration.Hours()
+		var cost *float64
+		if pricePerKWh > 0 {
+			c := watts * 24 * 30 / 1000 * pricePerKWh
+			cost = &c
+		}
+		frame.AppendRow(r.Host, r.Service, r.CPUSeconds/seconds, r.Share, watts, r.Energy/1000, cost)
+	}
+	return frame
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	// maxAuditEntries bounds the audit log kept in memory when no state
+	// directory is configured
+	maxAuditEntries = 1000
+	// redactedSecret stands in for secure settings values in the audit log
+	redactedSecret = "[redacted]"
+)
+
+// Kinds of audited changes.
+const (
+	auditKindSettings = "settings"
+	auditKindBaseline = "baseline"
+	auditKindFaults   = "faults"
+	auditKindHistory  = "history"
+	auditKindRepair   = "repair"
+)
+
+type auditChange struct {
+	// Path is the changed setting, such as "targets[nas].url"; Old is unset
+	// for added settings and New for removed ones
+	Path string `json:"path"`
+	Old  any    `json:"old,omitempty"`
+	New  any    `json:"new,omitempty"`
+}
+
+type auditEntry struct {
+	Seq     int           `json:"seq"`
+	Time    time.Time     `json:"time"`
+	User    string        `json:"user,omitempty"`
+	Kind    string        `json:"kind"`
+	Summary string        `json:"summary"`
+	Changes []auditChange `json:"changes,omitempty"`
+	// Hash covers the entry and PrevHash, the hash of the entry before, so
+	// edited, removed or reordered entries break the chain
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+func (e auditEntry) computeHash() string {
+	e.Hash = ""
+	body, _ := json.Marshal(e)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// settingsSnapshot is what changes to the settings are found against.
+// Secure settings are only known by name once read back from disk, so their
+// changes are only found within a process.
+type settingsSnapshot struct {
+	Updated  time.Time      `json:"updated"`
+	Settings map[string]any `json:"settings"`
+	Secrets  []string       `json:"secrets"`
+
+	secretHashes map[string][sha256.Size]byte
+}
+
+// auditLog is the append-only log of the configuration changes of a data
+// source: its settings, saved in Grafana, and what is changed through the
+// resource API. It is kept in the state directory, one JSON entry per line,
+// or in memory without one. Instances of a data source share its log.
+type auditLog struct {
+	// dir is empty when the log is kept in memory
+	dir string
+
+	mu       sync.Mutex
+	entries  []auditEntry
+	snapshot *settingsSnapshot
+}
+
+var auditLogs = struct {
+	mu   sync.Mutex
+	logs map[string]*auditLog
+}{logs: map[string]*auditLog{}}
+
+// auditLogFor returns the audit log of data source uid, reading it from
+// stateDir on first use.
+func auditLogFor(stateDir, uid string) *auditLog {
+	dir := ""
+	if stateDir != "" {
+		dir = filepath.Join(stateDir, url.PathEscape(uid))
+	}
+	key := dir + "\x00" + uid
+
+	auditLogs.mu.Lock()
+	defer auditLogs.mu.Unlock()
+	if log, ok := auditLogs.logs[key]; ok {
+		return log
+	}
+	log := &auditLog{dir: dir}
+	if dir != "" {
+		log.load()
+	}
+	auditLogs.logs[key] = log
+	return log
+}
+
+func (l *auditLog) load() {
+	file, err := os.Open(filepath.Join(l.dir, "audit.jsonl"))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		backend.Logger.Warn("Failed to read audit log", "error", err)
+	default:
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			var entry auditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				backend.Logger.Warn("Ignoring corrupt audit log entry", "error", err)
+				continue
+			}
+			l.entries = append(l.entries, entry)
+		}
+		if err := scanner.Err(); err != nil {
+			backend.Logger.Warn("Failed to read audit log", "error", err)
+		}
+	}
+
+	body, err := os.ReadFile(filepath.Join(l.dir, "settings.json"))
+	if err == nil {
+		var snapshot settingsSnapshot
+		if err := json.Unmarshal(body, &snapshot); err != nil {
+			backend.Logger.Warn("Ignoring corrupt settings snapshot", "error", err)
+			return
+		}
+		l.snapshot = &snapshot
+	}
+}
+
+// append adds entry to the log, chained to the last entry.
+func (l *auditLog) append(entry auditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := len(l.entries); n > 0 {
+		entry.Seq = l.entries[n-1].Seq + 1
+		entry.PrevHash = l.entries[n-1].Hash
+	} else {
+		entry.Seq = 1
+	}
+	entry.Hash = entry.computeHash()
+
+	if l.dir != "" {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(l.dir, 0o750); err != nil {
+			return fmt.Errorf("failed to create %s: %w", l.dir, err)
+		}
+		file, err := os.OpenFile(filepath.Join(l.dir, "audit.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(append(line, '\n'))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	l.entries = append(l.entries, entry)
+	if l.dir == "" && len(l.entries) > maxAuditEntries {
+		l.entries = l.entries[len(l.entries)-maxAuditEntries:]
+	}
+	return nil
+}
+
+// record appends a change made by the user of ctx. A nil log records
+// nothing.
+func (l *auditLog) record(ctx context.Context, kind, summary string, changes ...auditChange) {
+	if l == nil {
+		return
+	}
+	entry := auditEntry{Time: time.Now().UTC(), User: auditUser(ctx), Kind: kind, Summary: summary, Changes: changes}
+	if err := l.append(entry); err != nil {
+		backend.Logger.Warn("Failed to record configuration change", "kind", kind, "error", err)
+	}
+}
+
+// auditUser returns the login of the user of the request in ctx, if known.
+func auditUser(ctx context.Context) string {
+	if user := backend.PluginConfigFromContext(ctx).User; user != nil {
+		return user.Login
+	}
+	return ""
+}
+
+// recordSettings records the changes of settings since the last instance of
+// the data source. Instances are created on the first request after the
+// settings are saved, usually their test by the user who saved them, who is
+// recorded as the author.
+func (l *auditLog) recordSettings(ctx context.Context, settings backend.DataSourceInstanceSettings) {
+	var jsonData map[string]any
+	if err := json.Unmarshal(settings.JSONData, &jsonData); err != nil {
+		return
+	}
+	current := &settingsSnapshot{Updated: settings.Updated, Settings: jsonData, secretHashes: secretHashes(settings.DecryptedSecureJSONData)}
+	for key := range settings.DecryptedSecureJSONData {
+		current.Secrets = append(current.Secrets, key)
+	}
+	sort.Strings(current.Secrets)
+
+	l.mu.Lock()
+	previous := l.snapshot
+	l.snapshot = current
+	l.mu.Unlock()
+
+	summary := "Settings recorded"
+	var changes []auditChange
+	if previous != nil {
+		diffSettings("", previous.Settings, current.Settings, &changes)
+		changes = append(changes, diffSecrets(previous, current)...)
+		if len(changes) == 0 {
+			return
+		}
+		summary = fmt.Sprintf("Settings changed (%d changes)", len(changes))
+	}
+
+	entry := auditEntry{Time: time.Now().UTC(), User: auditUser(ctx), Kind: auditKindSettings, Summary: summary, Changes: changes}
+	if !settings.Updated.IsZero() {
+		entry.Time = settings.Updated.UTC()
+	}
+	if err := l.append(entry); err != nil {
+		backend.Logger.Warn("Failed to record configuration change", "kind", auditKindSettings, "error", err)
+	}
+	if err := l.saveSnapshot(current); err != nil {
+		backend.Logger.Warn("Failed to store settings snapshot", "error", err)
+	}
+}
+
+func (l *auditLog) saveSnapshot(snapshot *settingsSnapshot) error {
+	if l.dir == "" {
+		return nil
+	}
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create %s: %w", l.dir, err)
+	}
+	tmp, err := os.CreateTemp(l.dir, ".settings-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(l.dir, "settings.json"))
+}
+
+// diffSettings appends the differences between old and current JSON values
+// at path. Arrays of objects with names, such as targets, are compared by
+// name.
+func diffSettings(path string, old, current any, changes *[]auditChange) {
+	oldMap, oldIsMap := old.(map[string]any)
+	currentMap, currentIsMap := current.(map[string]any)
+	if oldIsMap && currentIsMap {
+		keys := map[string]bool{}
+		for k := range oldMap {
+			keys[k] = true
+		}
+		for k := range currentMap {
+			keys[k] = true
+		}
+		for _, k := range sortedKeys(keys) {
+			diffSettings(joinSettingsPath(path, k), oldMap[k], currentMap[k], changes)
+		}
+		return
+	}
+
+	oldNamed, oldOK := namedElements(old)
+	currentNamed, currentOK := namedElements(current)
+	if oldOK && currentOK {
+		names := map[string]bool{}
+		for name := range oldNamed {
+			names[name] = true
+		}
+		for name := range currentNamed {
+			names[name] = true
+		}
+		for _, name := range sortedKeys(names) {
+			diffSettings(path+"["+name+"]", oldNamed[name], currentNamed[name], changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(old, current) {
+		*changes = append(*changes, auditChange{Path: path, Old: old, New: current})
+	}
+}
+
+func joinSettingsPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// namedElements returns the elements of v by name, if v is an array of
+// objects with distinct names.
+func namedElements(v any) (map[string]any, bool) {
+	elements, ok := v.([]any)
+	if !ok || len(elements) == 0 {
+		return nil, false
+	}
+	named := make(map[string]any, len(elements))
+	for _, element := range elements {
+		object, ok := element.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		name, ok := object["name"].(string)
+		if !ok || name == "" || named[name] != nil {
+			return nil, false
+		}
+		named[name] = object
+	}
+	return named, true
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffSecrets returns the secure settings added, removed or, when both
+// snapshots have their hashes, changed, without their values.
+func diffSecrets(old, current *settingsSnapshot) []auditChange {
+	before := map[string]bool{}
+	for _, key := range old.Secrets {
+		before[key] = true
+	}
+	after := map[string]bool{}
+	for _, key := range current.Secrets {
+		after[key] = true
+	}
+
+	changed := map[string]bool{}
+	for key := range before {
+		if !after[key] {
+			changed[key] = true
+		}
+	}
+	for key := range after {
+		if !before[key] {
+			changed[key] = true
+		}
+	}
+	if old.secretHashes != nil {
+		for _, key := range changedSecrets(old.secretHashes, current.secretHashes) {
+			changed[key] = true
+		}
+	}
+
+	var changes []auditChange
+	for _, key := range sortedKeys(changed) {
+		change := auditChange{Path: "secureJsonData." + key}
+		if before[key] {
+			change.Old = redactedSecret
+		}
+		if after[key] {
+			change.New = redactedSecret
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// auditChainBreak returns the index of the first entry that was edited or
+// doesn't follow the one before, or -1 when the chain is intact.
+func auditChainBreak(entries []auditEntry) int {
+	for i, entry := range entries {
+		if entry.Hash != entry.computeHash() || (i > 0 && entry.PrevHash != entries[i-1].Hash) {
+			return i
+		}
+	}
+	return -1
+}
+
+// moveCorruptLines moves the lines of the stored log that are not entries,
+// which load skips, such as one cut short by a crash, to audit.jsonl.corrupt.
+func (l *auditLog) moveCorruptLines() error {
+	if l == nil || l.dir == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	path := filepath.Join(l.dir, "audit.jsonl")
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var kept, corrupt []byte
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if json.Unmarshal(line, &auditEntry{}) != nil {
+			corrupt = append(corrupt, line...)
+			if !bytes.HasSuffix(line, []byte("\n")) {
+				corrupt = append(corrupt, '\n')
+			}
+			continue
+		}
+		kept = append(kept, line...)
+	}
+	if corrupt == nil {
+		return nil
+	}
+	file, err := os.OpenFile(path+corruptSuffix, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(corrupt)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// Written aside and renamed, so a crash never leaves a partial log
+	tmp, err := os.CreateTemp(l.dir, ".audit-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(kept); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// list returns the entries matching kind and user, when set, since since,
+// newest first and at most limit of them, and whether the hash chain of the
+// whole log is intact.
+func (l *auditLog) list(kind, user string, since time.Time, limit int) ([]auditEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	intact := auditChainBreak(l.entries) < 0
+	entries := []auditEntry{}
+	for i := len(l.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		entry := l.entries[i]
+		if (kind != "" && entry.Kind != kind) || (user != "" && entry.User != user) || entry.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, intact
+}
+
+// handleAudit lists configuration changes, filtered by the "kind", "user"
+// and "since" (RFC 3339) query parameters, newest first. The "limit"
+// parameter defaults to 100.
+func (ds *testDataSource) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if ds.audit == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("the audit log is not available"))
+		return
+	}
+	query := r.URL.Query()
+	var since time.Time
+	if s := query.Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid since: %w", err))
+			return
+		}
+	}
+	limit := 100
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", s))
+			return
+		}
+		limit = n
+	}
+
+	entries, intact := ds.audit.list(query.Get("kind"), query.Get("user"), since, limit)
+	writeJSON(w, http.StatusOK, map[string]any{"intact": intact, "entries": entries})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// baselineStore holds the samples of every target at a moment when all was
+// well, for metric queries to compare against.
+type baselineStore struct {
+	mu      sync.Mutex
+	at      time.Time
+	samples map[string][]metricSample
+}
+
+func (b *baselineStore) set(at time.Time, samples map[string][]metricSample) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.at, b.samples = at, samples
+}
+
+// get returns the baseline and the samples in it by target name, or false
+// if none was captured.
+func (b *baselineStore) get() (time.Time, map[string][]metricSample, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.at, b.samples, b.samples != nil
+}
+
+// samplesAt returns the values of the series as of the last scrape at or
+// before t, and the time of that scrape.
+func (h *scrapeHistory) samplesAt(t time.Time) ([]metricSample, time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	current := append([]float64(nil), h.base...)
+	var scrapedAt time.Time
+	for _, s := range h.scrapes {
+		if s.Time.After(t) {
+			break
+		}
+		for _, c := range s.Changes {
+			current[c.Series] = c.Value
+		}
+		scrapedAt = s.Time
+	}
+	if scrapedAt.IsZero() {
+		return nil, scrapedAt, false
+	}
+
+	var samples []metricSample
+	for i, v := range current {
+		if !math.IsNaN(v) {
+			samples = append(samples, metricSample{seriesInfo: h.series[i], Value: v})
+		}
+	}
+	return samples, scrapedAt, true
+}
+
+// captureBaseline makes the scrapes of all targets at at the baseline, and
+// returns the number of series captured.
+func (ds *testDataSource) captureBaseline(at time.Time) (int, error) {
+	samples := map[string][]metricSample{}
+	series := 0
+	for _, target := range ds.targets {
+		if s, _, ok := target.history.samplesAt(at); ok {
+			samples[target.Name] = s
+			series += len(s)
+		}
+	}
+	if series == 0 {
+		return 0, fmt.Errorf("no scrapes at or before %s to capture a baseline from", at.Format(time.RFC3339))
+	}
+	ds.baseline.set(at, samples)
+	backend.Logger.Info("Captured metrics baseline", "at", at, "series", series)
+	return series, nil
+}
+
+// runBaselineCapture captures the baseline at at, waiting for it if it is
+// still to come. A past moment is captured from the scrape history, as far
+// as it goes back.
+func (ds *testDataSource) runBaselineCapture(ctx context.Context, at time.Time) {
+	job := ds.schedule.add("baseline", "", 0, at)
+	if wait := time.Until(at); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+	err := job.run(func() error {
+		_, err := ds.captureBaseline(at)
+		return err
+	})
+	if err != nil {
+		backend.Logger.Warn("Failed to capture metrics baseline", "error", err)
+	}
+}
+
+// baselineValues evaluates a metric query on the baseline: the matching
+// baseline samples go through the same stages, and the result is the value
+// of each resulting series by seriesKey.
+func (ds *testDataSource) baselineValues(targets []*scrapeTarget, selector seriesSelector, stages []pipelineStage, interval time.Duration) (map[string]float64, error) {
+	at, samples, ok := ds.baseline.get()
+	if !ok {
+		return nil, fmt.Errorf("no baseline captured")
+	}
+
+	frames := data.Frames{}
+	for _, target := range targets {
+		var series data.Frames
+		for _, s := range samples[target.Name] {
+			if !selector.matches(s.seriesInfo) {
+				continue
+			}
+			frame := data.NewFrame(s.Name,
+				data.NewField("time", nil, []time.Time{at}),
+				data.NewField(s.Name, s.Labels, []float64{s.Value}),
+			)
+			frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti}
+			series = append(series, frame)
+		}
+		labelTarget(series, target)
+		frames = append(frames, series...)
+	}
+	if len(stages) > 0 {
+		var err error
+		if frames, err = runPipeline(frames, stages, interval); err != nil {
+			return nil, err
+		}
+	}
+
+	values := map[string]float64{}
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			if field.Type().Time() {
+				continue
+			}
+			for i := field.Len() - 1; i >= 0; i-- {
+				if v, err := field.NullableFloatAt(i); err == nil && v != nil {
+					values[seriesKey(field)] = *v
+					break
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+func seriesKey(field *data.Field) string {
+	return field.Name + field.Labels.String()
+}
+
+// compareToBaseline turns the values of frames into their percent deviation
+// from baseline. Series missing from the baseline are dropped, and points
+// are null where the baseline is zero.
+func compareToBaseline(frames data.Frames, baseline map[string]float64) (data.Frames, error) {
+	compared := make(data.Frames, 0, len(frames))
+	for _, frame := range frames {
+		fields := make([]*data.Field, 0, len(frame.Fields))
+		for _, field := range frame.Fields {
+			if field.Type().Time() {
+				fields = append(fields, field)
+				continue
+			}
+			base, ok := baseline[seriesKey(field)]
+			if !ok {
+				continue
+			}
+			values := make([]*float64, field.Len())
+			for i := range values {
+				v, err := field.NullableFloatAt(i)
+				if err != nil {
+					return nil, err
+				}
+				if v != nil && base != 0 {
+					deviation := (*v - base) / math.Abs(base) * 100
+					values[i] = &deviation
+				}
+			}
+			var config data.FieldConfig
+			if field.Config != nil {
+				config = *field.Config
+			}
+			config.Unit = "percent"
+			fields = append(fields, data.NewField(field.Name, field.Labels, values).SetConfig(&config))
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		out := data.NewFrame(frame.Name, fields...)
+		out.Meta = frame.Meta
+		compared = append(compared, out)
+	}
+	if len(compared) == 0 {
+		return nil, fmt.Errorf("no series of the query are in the baseline")
+	}
+	return compared, nil
+}
+
+type baselineInfo struct {
+	CapturedAt *time.Time `json:"capturedAt"`
+	Series     int        `json:"series"`
+}
+
+func (ds *testDataSource) handleGetBaseline(w http.ResponseWriter, _ *http.Request) {
+	at, samples, ok := ds.baseline.get()
+	if !ok {
+		writeJSON(w, http.StatusOK, baselineInfo{})
+		return
+	}
+	series := 0
+	for _, s := range samples {
+		series += len(s)
+	}
+	writeJSON(w, http.StatusOK, baselineInfo{CapturedAt: &at, Series: series})
+}
+
+// handleCaptureBaseline makes the current state of the targets the baseline.
+func (ds *testDataSource) handleCaptureBaseline(w http.ResponseWriter, r *http.Request) {
+	at := time.Now()
+	series, err := ds.captureBaseline(at)
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+	ds.audit.record(r.Context(), auditKindBaseline, fmt.Sprintf("Captured the metrics baseline of %d series", series))
+	writeJSON(w, http.StatusOK, baselineInfo{CapturedAt: &at, Series: series})
+}
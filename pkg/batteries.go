@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeBatteries = "batteries"
+
+const (
+	defaultBatteryMetric      = `.*battery(_level)?(_percent|_ratio)?`
+	defaultLinkQualityMetric  = `.*(linkquality|link_quality|lqi|rssi)(_dbm)?`
+	defaultReplaceSoonPercent = 25.0
+	defaultReplaceNowPercent  = 10.0
+)
+
+// sensorNameLabels are the labels that name sensors, in the order they are
+// preferred, as zigbee2mqtt, Home Assistant and BLE exporters set them.
+var sensorNameLabels = []string{"friendly_name", "device", "entity", "name", "sensor", "mac"}
+
+var batteryStates = stateScale{
+	"ok":            severityOK,
+	"replace soon":  severityWarning,
+	"replace now":   severityCritical,
+	"not reporting": severityCritical,
+}
+
+func init() {
+	registerQueryType(queryTypeBatteries, queryBatteries, batteryQuery{})
+}
+
+type batteryQuery struct {
+	// Target selects targets as in metric queries; empty means all of them.
+	Target string `json:"target"`
+}
+
+// batteryTable finds the batteries and link qualities of wireless sensors.
+type batteryTable struct {
+	battery     *regexp.Regexp
+	linkQuality *regexp.Regexp
+	replaceSoon float64
+	replaceNow  float64
+}
+
+func newBatteryTable(settings models.BatterySettings) (*batteryTable, error) {
+	t := &batteryTable{replaceSoon: settings.ReplaceSoonPercent, replaceNow: settings.ReplaceNowPercent}
+	if t.replaceSoon == 0 {
+		t.replaceSoon = defaultReplaceSoonPercent
+	}
+	if t.replaceNow == 0 {
+		t.replaceNow = defaultReplaceNowPercent
+	}
+	compile := func(name, expr, fallback string) (*regexp.Regexp, error) {
+		if expr == "" {
+			expr = fallback
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", name, expr, err)
+		}
+		return re, nil
+	}
+	var err error
+	if t.battery, err = compile("batteryMetric", settings.BatteryMetric, defaultBatteryMetric); err != nil {
+		return nil, err
+	}
+	if t.linkQuality, err = compile("linkQualityMetric", settings.LinkQualityMetric, defaultLinkQualityMetric); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// seriesLastSeen is the last value of a series and the time of the last
+// scrape it was in.
+type seriesLastSeen struct {
+	seriesInfo
+	Value float64
+	Time  time.Time
+}
+
+// lastSeen returns the series matching match that were in any scrape
+// retained, and the time of the last scrape, so that series no longer
+// reported stand out.
+func (h *scrapeHistory) lastSeen(match func(seriesInfo) bool) ([]seriesLastSeen, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var matches []int
+	for i, s := range h.series {
+		if match(s) {
+			matches = append(matches, i)
+		}
+	}
+	seen := map[int]*seriesLastSeen{}
+	current := append([]float64(nil), h.base...)
+	var last time.Time
+	for _, s := range h.scrapes {
+		for _, c := range s.Changes {
+			current[c.Series] = c.Value
+		}
+		for _, i := range matches {
+			if math.IsNaN(current[i]) {
+				continue
+			}
+			if seen[i] == nil {
+				seen[i] = &seriesLastSeen{seriesInfo: h.series[i]}
+			}
+			seen[i].Value, seen[i].Time = current[i], s.Time
+		}
+		last = s.Time
+	}
+	series := make([]seriesLastSeen, 0, len(seen))
+	for _, s := range seen {
+		series = append(series, *s)
+	}
+	return series, last
+}
+
+// sensorBattery is a row of the battery table. Sensors without a battery
+// or link quality series have nil ones.
+type sensorBattery struct {
+	Target      string
+	Sensor      string
+	Battery     *float64
+	LinkQuality *float64
+	LastSeen    time.Time
+	Status      string
+}
+
+// sensors returns the sensors of target, a sensor being the battery and
+// link quality series with the same labels.
+func (t *batteryTable) sensors(target *scrapeTarget) []*sensorBattery {
+	series, last := target.history.lastSeen(func(s seriesInfo) bool {
+		return t.battery.MatchString(s.Name) || t.linkQuality.MatchString(s.Name)
+	})
+	sensors := map[string]*sensorBattery{}
+	for _, s := range series {
+		key := s.Labels.String()
+		sensor, ok := sensors[key]
+		if !ok {
+			sensor = &sensorBattery{Target: target.Name, Sensor: sensorName(s.Labels)}
+			sensors[key] = sensor
+		}
+		if s.Time.After(sensor.LastSeen) {
+			sensor.LastSeen = s.Time
+		}
+		v := s.Value
+		if t.battery.MatchString(s.Name) {
+			if strings.HasSuffix(s.Name, "_ratio") {
+				v *= 100
+			}
+			sensor.Battery = &v
+		} else {
+			sensor.LinkQuality = &v
+		}
+	}
+
+	result := make([]*sensorBattery, 0, len(sensors))
+	for _, sensor := range sensors {
+		switch {
+		case sensor.LastSeen.Before(last):
+			sensor.Status = "not reporting"
+		case sensor.Battery == nil:
+			sensor.Status = "ok"
+		case *sensor.Battery < t.replaceNow:
+			sensor.Status = "replace now"
+		case *sensor.Battery < t.replaceSoon:
+			sensor.Status = "replace soon"
+		default:
+			sensor.Status = "ok"
+		}
+		result = append(result, sensor)
+	}
+	return result
+}
+
+// sensorName returns the first label naming a sensor, or all of them.
+func sensorName(labels data.Labels) string {
+	for _, name := range sensorNameLabels {
+		if v := labels[name]; v != "" {
+			return v
+		}
+	}
+	return labels.String()
+}
+
+func queryBatteries(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q batteryQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	name := q.Target
+	if name == "" {
+		name = allTargets
+	}
+	targets, err := ds.selectTargets(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var sensors []*sensorBattery
+	for _, target := range targets {
+		sensors = append(sensors, ds.batteries.sensors(target)...)
+	}
+	// The sensors needing attention first, the emptiest batteries first
+	sort.Slice(sensors, func(i, j int) bool {
+		a, b := sensors[i], sensors[j]
+		if sa, sb := batteryStates[a.Status], batteryStates[b.Status]; sa != sb {
+			return sa > sb
+		}
+		if (a.Battery == nil) != (b.Battery == nil) {
+			return a.Battery != nil
+		}
+		if a.Battery != nil && *a.Battery != *b.Battery {
+			return *a.Battery < *b.Battery
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Sensor < b.Sensor
+	})
+
+	statusField, severityField := newStateFields(batteryStates)
+	frame := data.NewFrame("batteries",
+		data.NewField("target", nil, []string{}),
+		data.NewField("sensor", nil, []string{}),
+		data.NewField("battery", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("link_quality", nil, []*float64{}),
+		data.NewField("last_seen", nil, []time.Time{}),
+		statusField,
+		severityField,
+	)
+	for _, s := range sensors {
+		frame.AppendRow(s.Target, s.Sensor, s.Battery, s.LinkQuality, s.LastSeen, s.Status, batteryStates.severity(s.Status))
+	}
+	return data.Frames{frame}, nil
+}
@@ -0,0 +1,385 @@
+//go:build !nobroker
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeBroker = "broker"
+
+// Supported broker kinds.
+const (
+	brokerKindMosquitto = "mosquitto"
+	brokerKindRabbitMQ  = "rabbitmq"
+	brokerKindNATS      = "nats"
+)
+
+// sysCollectWindow is how long to listen for Mosquitto $SYS messages. Most of
+// them are retained, so they arrive right after subscribing.
+const sysCollectWindow = 2 * time.Second
+
+func init() {
+	registerQueryType(queryTypeBroker, queryBroker, brokerQuery{})
+	registerConfiguredCheck(queryTypeBroker, func(ds *testDataSource) bool { return len(ds.settings.Brokers) > 0 })
+}
+
+type brokerQuery struct {
+	// Broker selects a configured broker by name; empty means all of them.
+	Broker string `json:"broker"`
+	// Mode is "brokers" (default) for broker totals or "queues" for
+	// per-queue depths.
+	Mode string `json:"mode"`
+}
+
+// brokerStats is the normalized view of one broker.
+type brokerStats struct {
+	Broker  string
+	Kind    string
+	Clients float64
+	Depth   float64
+	InRate  *float64
+	OutRate *float64
+	Queues  []queueStats
+}
+
+type queueStats struct {
+	Name        string
+	Depth       float64
+	Consumers   float64
+	PublishRate *float64
+	DeliverRate *float64
+}
+
+// counterRates turns cumulative counters into per-second rates between
+// successive observations.
+type counterRates struct {
+	mu   sync.Mutex
+	prev map[string]counterSample
+}
+
+type counterSample struct {
+	Time  time.Time
+	Value float64
+}
+
+func newCounterRates() *counterRates {
+	return &counterRates{prev: map[string]counterSample{}}
+}
+
+// observe records value for key and returns the rate since the previous
+// observation, or nil on first use and after counter resets.
+func (c *counterRates) observe(key string, now time.Time, value float64) *float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prev, ok := c.prev[key]
+	c.prev[key] = counterSample{Time: now, Value: value}
+	if !ok || value < prev.Value {
+		return nil
+	}
+	dt := now.Sub(prev.Time).Seconds()
+	if dt <= 0 {
+		return nil
+	}
+	rate := (value - prev.Value) / dt
+	return &rate
+}
+
+func (ds *testDataSource) brokerPassword(name string) string {
+	if ds.settings.Secrets == nil {
+		return ""
+	}
+	return ds.settings.Secrets.BrokerPasswords[name]
+}
+
+func (ds *testDataSource) collectBroker(ctx context.Context, cfg models.BrokerSettings) (brokerStats, error) {
+	switch cfg.Kind {
+	case brokerKindMosquitto:
+		return collectMosquitto(ctx, cfg, ds.brokerPassword(cfg.Name), ds.egress)
+	case brokerKindRabbitMQ:
+		return ds.collectRabbitMQ(ctx, cfg)
+	case brokerKindNATS:
+		return ds.collectNATS(ctx, cfg)
+	}
+	return brokerStats{}, fmt.Errorf("unknown broker kind %q", cfg.Kind)
+}
+
+func collectMosquitto(ctx context.Context, cfg models.BrokerSettings, password string, egress *egressPolicy) (brokerStats, error) {
+	stats := brokerStats{Broker: cfg.Name, Kind: cfg.Kind}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.URL).
+		SetClientID(fmt.Sprintf("homelab-plugin-%d", time.Now().UnixNano())).
+		SetUsername(cfg.Username).
+		SetPassword(password).
+		SetAutoReconnect(false).
+		SetConnectTimeout(10 * time.Second)
+	if egress != nil {
+		u, err := url.Parse(cfg.URL)
+		if err != nil {
+			return stats, fmt.Errorf("invalid broker URL: %w", err)
+		}
+		if err := egress.checkHost(u.Hostname()); err != nil {
+			return stats, err
+		}
+		// The client dials without a context, so the dialer is told the host
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		egress.guard(dialer, u.Hostname())
+		opts.SetDialer(dialer)
+	}
+	client := mqtt.NewClient(opts)
+
+	if token := client.Connect(); !token.WaitTimeout(15*time.Second) || token.Error() != nil {
+		return stats, fmt.Errorf("failed to connect to %s: %v", cfg.URL, token.Error())
+	}
+	defer client.Disconnect(250)
+
+	var mu sync.Mutex
+	values := map[string]string{}
+	token := client.Subscribe("$SYS/#", 0, func(_ mqtt.Client, m mqtt.Message) {
+		mu.Lock()
+		values[m.Topic()] = string(m.Payload())
+		mu.Unlock()
+	})
+	if !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+		return stats, fmt.Errorf("failed to subscribe to $SYS topics: %v", token.Error())
+	}
+
+	select {
+	case <-ctx.Done():
+		return stats, ctx.Err()
+	case <-time.After(sysCollectWindow):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(values) == 0 {
+		return stats, fmt.Errorf("no $SYS messages received, check the broker's sys_interval and ACLs")
+	}
+
+	if v := parseFloatPtr(values["$SYS/broker/clients/connected"]); v != nil {
+		stats.Clients = *v
+	}
+	if v := parseFloatPtr(values["$SYS/broker/store/messages/count"]); v != nil {
+		stats.Depth = *v
+	}
+	// Load averages are published per minute
+	if v := parseFloatPtr(values["$SYS/broker/load/messages/received/1min"]); v != nil {
+		rate := *v / 60
+		stats.InRate = &rate
+	}
+	if v := parseFloatPtr(values["$SYS/broker/load/messages/sent/1min"]); v != nil {
+		rate := *v / 60
+		stats.OutRate = &rate
+	}
+
+	return stats, nil
+}
+
+// brokerGet fetches a JSON document from a broker's HTTP API.
+func (ds *testDataSource) brokerGet(ctx context.Context, cfg models.BrokerSettings, path string, out any) error {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("invalid broker URL: %w", err)
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+	u = u.JoinPath(ref.Path)
+	u.RawQuery = ref.RawQuery
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if cfg.Username != "" {
+		req.SetBasicAuth(cfg.Username, ds.brokerPassword(cfg.Name))
+	}
+
+	resp, err := ds.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", u.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u.Redacted(), resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type rabbitRate struct {
+	Rate float64 `json:"rate"`
+}
+
+func (ds *testDataSource) collectRabbitMQ(ctx context.Context, cfg models.BrokerSettings) (brokerStats, error) {
+	stats := brokerStats{Broker: cfg.Name, Kind: cfg.Kind}
+
+	var overview struct {
+		ObjectTotals struct {
+			Connections float64 `json:"connections"`
+		} `json:"object_totals"`
+		MessageStats struct {
+			PublishDetails    *rabbitRate `json:"publish_details"`
+			DeliverGetDetails *rabbitRate `json:"deliver_get_details"`
+		} `json:"message_stats"`
+	}
+	if err := ds.brokerGet(ctx, cfg, "/api/overview", &overview); err != nil {
+		return stats, err
+	}
+	stats.Clients = overview.ObjectTotals.Connections
+	if d := overview.MessageStats.PublishDetails; d != nil {
+		stats.InRate = &d.Rate
+	}
+	if d := overview.MessageStats.DeliverGetDetails; d != nil {
+		stats.OutRate = &d.Rate
+	}
+
+	var queues []struct {
+		Name         string  `json:"name"`
+		VHost        string  `json:"vhost"`
+		Messages     float64 `json:"messages"`
+		Consumers    float64 `json:"consumers"`
+		MessageStats struct {
+			PublishDetails    *rabbitRate `json:"publish_details"`
+			DeliverGetDetails *rabbitRate `json:"deliver_get_details"`
+		} `json:"message_stats"`
+	}
+	if err := ds.brokerGet(ctx, cfg, "/api/queues", &queues); err != nil {
+		return stats, err
+	}
+	for _, q := range queues {
+		qs := queueStats{Name: q.VHost + "/" + q.Name, Depth: q.Messages, Consumers: q.Consumers}
+		if d := q.MessageStats.PublishDetails; d != nil {
+			qs.PublishRate = &d.Rate
+		}
+		if d := q.MessageStats.DeliverGetDetails; d != nil {
+			qs.DeliverRate = &d.Rate
+		}
+		stats.Depth += q.Messages
+		stats.Queues = append(stats.Queues, qs)
+	}
+
+	return stats, nil
+}
+
+func (ds *testDataSource) collectNATS(ctx context.Context, cfg models.BrokerSettings) (brokerStats, error) {
+	stats := brokerStats{Broker: cfg.Name, Kind: cfg.Kind}
+
+	var varz struct {
+		Connections float64 `json:"connections"`
+		InMsgs      float64 `json:"in_msgs"`
+		OutMsgs     float64 `json:"out_msgs"`
+	}
+	if err := ds.brokerGet(ctx, cfg, "/varz", &varz); err != nil {
+		return stats, err
+	}
+	now := time.Now()
+	stats.Clients = varz.Connections
+	stats.InRate = ds.brokerRates.observe(cfg.Name+"\x00in", now, varz.InMsgs)
+	stats.OutRate = ds.brokerRates.observe(cfg.Name+"\x00out", now, varz.OutMsgs)
+
+	// JetStream consumers are the closest thing NATS has to queues
+	var jsz struct {
+		AccountDetails []struct {
+			StreamDetail []struct {
+				Name           string `json:"name"`
+				ConsumerDetail []struct {
+					Name       string  `json:"name"`
+					NumPending float64 `json:"num_pending"`
+				} `json:"consumer_detail"`
+			} `json:"stream_detail"`
+		} `json:"account_details"`
+	}
+	if err := ds.brokerGet(ctx, cfg, "/jsz?consumers=true", &jsz); err != nil {
+		backend.Logger.Debug("JetStream stats unavailable", "broker", cfg.Name, "error", err)
+		return stats, nil
+	}
+	for _, account := range jsz.AccountDetails {
+		for _, stream := range account.StreamDetail {
+			for _, consumer := range stream.ConsumerDetail {
+				stats.Depth += consumer.NumPending
+				stats.Queues = append(stats.Queues, queueStats{
+					Name:      stream.Name + "/" + consumer.Name,
+					Depth:     consumer.NumPending,
+					Consumers: 1,
+				})
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+func queryBroker(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q brokerQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if len(ds.settings.Brokers) == 0 {
+		return nil, fmt.Errorf("no message brokers configured")
+	}
+
+	var all []brokerStats
+	for _, cfg := range ds.settings.Brokers {
+		if q.Broker != "" && cfg.Name != q.Broker {
+			continue
+		}
+		stats, err := ds.collectBroker(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.Name, err)
+		}
+		all = append(all, stats)
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("broker %q is not configured", q.Broker)
+	}
+
+	rate := &data.FieldConfig{Unit: "ops"}
+	if q.Mode == "queues" {
+		frame := data.NewFrame("queues",
+			data.NewField("broker", nil, []string{}),
+			data.NewField("queue", nil, []string{}),
+			data.NewField("depth", nil, []float64{}),
+			data.NewField("consumers", nil, []float64{}),
+			data.NewField("publish_rate", nil, []*float64{}).SetConfig(rate),
+			data.NewField("deliver_rate", nil, []*float64{}).SetConfig(rate),
+		)
+		for _, b := range all {
+			for _, qs := range b.Queues {
+				frame.AppendRow(b.Broker, qs.Name, qs.Depth, qs.Consumers, qs.PublishRate, qs.DeliverRate)
+			}
+		}
+		return data.Frames{frame}, nil
+	}
+
+	frame := data.NewFrame("brokers",
+		data.NewField("broker", nil, []string{}),
+		data.NewField("kind", nil, []string{}),
+		data.NewField("clients", nil, []float64{}),
+		data.NewField("depth", nil, []float64{}),
+		data.NewField("messages_in_rate", nil, []*float64{}).SetConfig(rate),
+		data.NewField("messages_out_rate", nil, []*float64{}).SetConfig(rate),
+		data.NewField("queues", nil, []int64{}),
+	)
+	for _, b := range all {
+		frame.AppendRow(b.Broker, b.Kind, b.Clients, b.Depth, b.InRate, b.OutRate, int64(len(b.Queues)))
+	}
+
+	return data.Frames{frame}, nil
+}
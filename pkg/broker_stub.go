@@ -0,0 +1,9 @@
+//go:build nobroker
+
+package main
+
+// counterRates stands in for the broker integration's rate tracker when it
+// is built with the nobroker tag.
+type counterRates struct{}
+
+func newCounterRates() *counterRates { return &counterRates{} }
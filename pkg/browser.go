@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeBrowser = "browser"
+
+const (
+	defaultBrowserInterval = 5 * time.Minute
+	defaultBrowserTimeout  = 30 * time.Second
+)
+
+// maxBrowserResults bounds the results kept per check.
+const maxBrowserResults = 1440
+
+// browserPageScript reads the text of the page and its navigation timing,
+// in milliseconds since the navigation started.
+const browserPageScript = `(() => {
+	const n = performance.getEntriesByType('navigation')[0] || {};
+	return {
+		text: document.body ? document.body.innerText : '',
+		ttfb: n.responseStart || 0,
+		domContentLoaded: n.domContentLoadedEventEnd || 0,
+		load: n.loadEventEnd || 0,
+		status: n.responseStatus || 0,
+	};
+})()`
+
+func init() {
+	registerQueryType(queryTypeBrowser, queryBrowser, browserQuery{})
+	registerConfiguredCheck(queryTypeBrowser, func(ds *testDataSource) bool { return ds.browser != nil })
+}
+
+type browserQuery struct {
+	// Check selects a check by name; empty means all of them.
+	Check string `json:"check"`
+	// Mode is "timeline" (default) for load time and success series per
+	// check, or "summary" for a row per check over the time range.
+	Mode string `json:"mode"`
+}
+
+// browserResult is the outcome of a check: the phases of loading the page,
+// as the browser timed them.
+type browserResult struct {
+	Time             time.Time
+	Check            string
+	OK               bool
+	TTFB             time.Duration
+	DOMContentLoaded time.Duration
+	Load             time.Duration
+	Status           int
+	Error            string
+}
+
+// browserScreenshot is the screenshot of the last run of a check.
+type browserScreenshot struct {
+	Time time.Time
+	PNG  []byte
+}
+
+// browserChecker runs the browser checks and keeps their results and last
+// screenshots.
+type browserChecker struct {
+	url      string
+	token    string
+	interval time.Duration
+	checks   []models.BrowserCheck
+
+	mu          sync.Mutex
+	results     map[string][]browserResult
+	screenshots map[string]browserScreenshot
+}
+
+func newBrowserChecker(settings models.BrowserSettings, token string) (*browserChecker, error) {
+	u, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q", settings.URL)
+	}
+	switch u.Scheme {
+	case "http", "https", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("invalid URL %q, expected a Chrome debugging endpoint or a WebSocket URL", settings.URL)
+	}
+	b := &browserChecker{
+		url:         settings.URL,
+		token:       token,
+		interval:    defaultBrowserInterval,
+		results:     map[string][]browserResult{},
+		screenshots: map[string]browserScreenshot{},
+	}
+	if settings.IntervalSeconds > 0 {
+		b.interval = time.Duration(settings.IntervalSeconds) * time.Second
+	}
+	seen := map[string]bool{}
+	for _, c := range settings.Checks {
+		switch {
+		case c.Name == "":
+			return nil, fmt.Errorf("check of %q has no name", c.URL)
+		case seen[c.Name]:
+			return nil, fmt.Errorf("duplicate check name %q", c.Name)
+		}
+		seen[c.Name] = true
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("check %s has invalid URL %q", c.Name, c.URL)
+		}
+		b.checks = append(b.checks, c)
+	}
+	return b, nil
+}
+
+func (b *browserChecker) record(r browserResult, screenshot []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	history := append(b.results[r.Check], r)
+	if len(history) > maxBrowserResults {
+		history = history[len(history)-maxBrowserResults:]
+	}
+	b.results[r.Check] = history
+	if screenshot != nil {
+		b.screenshots[r.Check] = browserScreenshot{Time: r.Time, PNG: screenshot}
+	}
+}
+
+// window returns the results of check (or all checks if empty) within tr,
+// by check.
+func (b *browserChecker) window(check string, tr backend.TimeRange) map[string][]browserResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	results := map[string][]browserResult{}
+	for name, history := range b.results {
+		if check != "" && name != check {
+			continue
+		}
+		for _, r := range history {
+			if !r.Time.Before(tr.From) && !r.Time.After(tr.To) {
+				results[name] = append(results[name], r)
+			}
+		}
+	}
+	return results
+}
+
+// cdpRequest and cdpMessage are the messages of the Chrome DevTools
+// protocol. Messages with an ID answer requests; others are events.
+type cdpRequest struct {
+	ID        int64  `json:"id"`
+	Method    string `json:"method"`
+	Params    any    `json:"params,omitempty"`
+	SessionID string `json:"sessionId,omitempty"`
+}
+
+type cdpMessage struct {
+	ID        int64           `json:"id"`
+	Method    string          `json:"method"`
+	Params    json.RawMessage `json:"params"`
+	SessionID string          `json:"sessionId"`
+	Result    json.RawMessage `json:"result"`
+	Error     *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// cdpConn is a DevTools protocol connection to a browser. Requests are
+// answered in turn, and events that arrive meanwhile are kept for wait.
+type cdpConn struct {
+	conn   *websocket.Conn
+	nextID int64
+	events []cdpMessage
+}
+
+func (c *cdpConn) read(ctx context.Context) (cdpMessage, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetReadDeadline(deadline)
+	}
+	var msg cdpMessage
+	if err := c.conn.ReadJSON(&msg); err != nil {
+		return msg, fmt.Errorf("failed to read from browser: %w", err)
+	}
+	return msg, nil
+}
+
+// call sends a request within session, empty for the browser itself, and
+// decodes its result into result, if not nil.
+func (c *cdpConn) call(ctx context.Context, session, method string, params, result any) error {
+	c.nextID++
+	id := c.nextID
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	if err := c.conn.WriteJSON(cdpRequest{ID: id, Method: method, Params: params, SessionID: session}); err != nil {
+		return fmt.Errorf("failed to send %s: %w", method, err)
+	}
+	for {
+		msg, err := c.read(ctx)
+		if err != nil {
+			return err
+		}
+		if msg.ID != id {
+			if msg.Method != "" {
+				c.events = append(c.events, msg)
+			}
+			continue
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("%s failed: %s", method, msg.Error.Message)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Result, result)
+	}
+}
+
+// wait returns the first event of method within session.
+func (c *cdpConn) wait(ctx context.Context, session, method string) (cdpMessage, error) {
+	for i, msg := range c.events {
+		if msg.Method == method && msg.SessionID == session {
+			c.events = append(c.events[:i], c.events[i+1:]...)
+			return msg, nil
+		}
+	}
+	for {
+		msg, err := c.read(ctx)
+		if err != nil {
+			return msg, err
+		}
+		if msg.Method == method && msg.SessionID == session {
+			return msg, nil
+		}
+	}
+}
+
+// debuggerURL returns the WebSocket URL of the browser: that of a
+// browserless instance with its token, or the one Chrome's debugging
+// endpoint lists.
+func (ds *testDataSource) debuggerURL(ctx context.Context) (string, error) {
+	u, err := url.Parse(ds.browser.url)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "ws" || u.Scheme == "wss" {
+		if ds.browser.token != "" {
+			q := u.Query()
+			q.Set("token", ds.browser.token)
+			u.RawQuery = q.Encode()
+		}
+		return u.String(), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.JoinPath("json", "version").String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request for %s: %w", redactURL(ds.browser.url), err)
+	}
+	resp, err := send(ds.httpClient, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var version struct {
+		WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", req.URL.Redacted(), err)
+	}
+	if version.WebSocketDebuggerURL == "" {
+		return "", fmt.Errorf("%s lists no WebSocket debugger URL", req.URL.Redacted())
+	}
+	return version.WebSocketDebuggerURL, nil
+}
+
+// runBrowserCheck loads the page of check in a new tab of the browser, and
+// returns how that went, with a screenshot of the page once loaded.
+func (ds *testDataSource) runBrowserCheck(ctx context.Context, check models.BrowserCheck) (browserResult, []byte) {
+	timeout := defaultBrowserTimeout
+	if check.TimeoutSeconds > 0 {
+		timeout = time.Duration(check.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := browserResult{Time: time.Now(), Check: check.Name}
+	fail := func(err error) (browserResult, []byte) {
+		result.Error = err.Error()
+		return result, nil
+	}
+
+	wsURL, err := ds.debuggerURL(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	conn, _, err := ds.wsDialer.DialContext(ctx, wsURL, nil)
+	if err != nil {
+		return fail(fmt.Errorf("failed to connect to the browser: %w", err))
+	}
+	defer conn.Close()
+	c := &cdpConn{conn: conn}
+
+	var target struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := c.call(ctx, "", "Target.createTarget", map[string]any{"url": "about:blank"}, &target); err != nil {
+		return fail(err)
+	}
+	// Tabs are closed even when the check timed out
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.call(closeCtx, "", "Target.closeTarget", map[string]any{"targetId": target.TargetID}, nil)
+	}()
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := c.call(ctx, "", "Target.attachToTarget", map[string]any{"targetId": target.TargetID, "flatten": true}, &attached); err != nil {
+		return fail(err)
+	}
+	session := attached.SessionID
+	if err := c.call(ctx, session, "Page.enable", nil, nil); err != nil {
+		return fail(err)
+	}
+
+	start := time.Now()
+	var navigated struct {
+		ErrorText string `json:"errorText"`
+	}
+	if err := c.call(ctx, session, "Page.navigate", map[string]any{"url": check.URL}, &navigated); err != nil {
+		return fail(err)
+	}
+	if navigated.ErrorText != "" {
+		return fail(fmt.Errorf("failed to load %s: %s", check.URL, navigated.ErrorText))
+	}
+	if _, err := c.wait(ctx, session, "Page.loadEventFired"); err != nil {
+		return fail(fmt.Errorf("page did not load: %w", err))
+	}
+	result.Load = time.Since(start)
+
+	var evaluated struct {
+		Result struct {
+			Value struct {
+				Text             string  `json:"text"`
+				TTFB             float64 `json:"ttfb"`
+				DOMContentLoaded float64 `json:"domContentLoaded"`
+				Load             float64 `json:"load"`
+				Status           int     `json:"status"`
+			} `json:"value"`
+		} `json:"result"`
+	}
+	if err := c.call(ctx, session, "Runtime.evaluate", map[string]any{"expression": browserPageScript, "returnByValue": true}, &evaluated); err != nil {
+		return fail(err)
+	}
+	page := evaluated.Result.Value
+	ms := func(v float64) time.Duration { return time.Duration(v * float64(time.Millisecond)) }
+	result.TTFB, result.DOMContentLoaded, result.Status = ms(page.TTFB), ms(page.DOMContentLoaded), page.Status
+	// The browser's timing leaves out the round trips of the protocol
+	if page.Load > 0 {
+		result.Load = ms(page.Load)
+	}
+
+	var shot struct {
+		Data string `json:"data"`
+	}
+	var screenshot []byte
+	if err := c.call(ctx, session, "Page.captureScreenshot", map[string]any{"format": "png"}, &shot); err == nil {
+		screenshot, _ = base64.StdEncoding.DecodeString(shot.Data)
+	}
+
+	switch {
+	case result.Status >= http.StatusBadRequest:
+		result.Error = fmt.Sprintf("page returned %d", result.Status)
+	case check.ExpectText != "" && !strings.Contains(page.Text, check.ExpectText):
+		result.Error = fmt.Sprintf("page does not contain %q", check.ExpectText)
+	default:
+		result.OK = true
+	}
+	return result, screenshot
+}
+
+// runBrowserChecks runs the browser checks in turn every interval, until the
+// instance is disposed of.
+func (ds *testDataSource) runBrowserChecks(ctx context.Context) {
+	job := ds.schedule.add("browser", "", ds.browser.interval, time.Now())
+	ticker := time.NewTicker(ds.browser.interval)
+	defer ticker.Stop()
+	for {
+		job.run(func() error {
+			failed := 0
+			for _, check := range ds.browser.checks {
+				result, screenshot := ds.runBrowserCheck(ctx, check)
+				ds.browser.record(result, screenshot)
+				if !result.OK {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d browser checks failed", failed, len(ds.browser.checks))
+			}
+			return nil
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleBrowserScreenshot serves the screenshot of the last run of a check.
+func (ds *testDataSource) handleBrowserScreenshot(w http.ResponseWriter, r *http.Request) {
+	if ds.browser == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no browser configured"))
+		return
+	}
+	name := r.PathValue("check")
+	ds.browser.mu.Lock()
+	shot, ok := ds.browser.screenshots[name]
+	ds.browser.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no screenshot of check %q", name))
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Last-Modified", shot.Time.UTC().Format(http.TimeFormat))
+	w.Write(shot.PNG)
+}
+
+func queryBrowser(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q browserQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if ds.browser == nil {
+		return nil, fmt.Errorf("no browser configured")
+	}
+	var checks []string
+	for _, c := range ds.browser.checks {
+		if q.Check == "" || c.Name == q.Check {
+			checks = append(checks, c.Name)
+		}
+	}
+	if len(checks) == 0 {
+		return nil, fmt.Errorf("no browser check %q", q.Check)
+	}
+	results := ds.browser.window(q.Check, query.TimeRange)
+
+	switch q.Mode {
+	case "", "timeline":
+		return browserTimelineFrames(checks, results), nil
+	case "summary":
+		return data.Frames{browserSummaryFrame(checks, results)}, nil
+	}
+	return nil, fmt.Errorf("unknown browser mode %q", q.Mode)
+}
+
+// browserTimelineFrames returns the load phases and success of each run, a
+// frame per check.
+func browserTimelineFrames(checks []string, results map[string][]browserResult) data.Frames {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	frames := make(data.Frames, 0, len(checks))
+	for _, check := range checks {
+		rs := results[check]
+		times := make([]time.Time, len(rs))
+		ttfb := make([]float64, len(rs))
+		dom := make([]float64, len(rs))
+		load := make([]float64, len(rs))
+		success := make([]float64, len(rs))
+		for i, r := range rs {
+			times[i], ttfb[i], dom[i], load[i] = r.Time, ms(r.TTFB), ms(r.DOMContentLoaded), ms(r.Load)
+			if r.OK {
+				success[i] = 1
+			}
+		}
+		labels := data.Labels{"check": check}
+		unit := &data.FieldConfig{Unit: "ms"}
+		frame := data.NewFrame("browser",
+			data.NewField("time", nil, times),
+			data.NewField("ttfb", labels, ttfb).SetConfig(unit),
+			data.NewField("dom_content_loaded", labels, dom).SetConfig(unit),
+			data.NewField("load", labels, load).SetConfig(unit),
+			data.NewField("success", labels, success).SetConfig(upConfig()),
+		)
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// browserSummaryFrame summarizes each check: the share of runs it passed,
+// its mean load time, its last error and where its screenshot is.
+func browserSummaryFrame(checks []string, results map[string][]browserResult) *data.Frame {
+	frame := data.NewFrame("browser_summary",
+		data.NewField("check", nil, []string{}),
+		data.NewField("runs", nil, []int64{}),
+		data.NewField("success", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("load", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("last_error", nil, []string{}),
+		data.NewField("screenshot", nil, []string{}),
+	)
+	for _, check := range checks {
+		rs := results[check]
+		var success, load *float64
+		lastError := ""
+		if len(rs) > 0 {
+			var ok int
+			var sum time.Duration
+			for _, r := range rs {
+				if r.OK {
+					ok++
+				}
+				sum += r.Load
+			}
+			s := float64(ok) / float64(len(rs)) * 100
+			l := float64(sum) / float64(len(rs)) / float64(time.Millisecond)
+			success, load = &s, &l
+			lastError = rs[len(rs)-1].Error
+		}
+		screenshot := resourceAPIPrefix + "/browser/" + url.PathEscape(check) + "/screenshot"
+		frame.AppendRow(check, int64(len(rs)), success, load, lastError, screenshot)
+	}
+	return frame
+}
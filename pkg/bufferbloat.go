@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeBufferbloat = "bufferbloat"
+
+const (
+	defaultBufferbloatDuration = 10 * time.Second
+	defaultBufferbloatInterval = time.Hour
+	// bufferbloatStartDelay delays the first test, so that it doesn't load
+	// the connection while Grafana starts
+	bufferbloatStartDelay = time.Minute
+	// bufferbloatStreams is how many transfers load the connection at once,
+	// as a single TCP stream rarely fills it
+	bufferbloatStreams = 4
+	// bufferbloatPingInterval is how often latency is sampled, idle and
+	// loaded, and bufferbloatIdleSamples how many idle samples are taken
+	bufferbloatPingInterval = 200 * time.Millisecond
+	bufferbloatIdleSamples  = 10
+	bufferbloatPingTimeout  = 2 * time.Second
+)
+
+// maxBufferbloatResults bounds the results kept in memory, a month of hourly
+// tests.
+const maxBufferbloatResults = 720
+
+func init() {
+	registerQueryType(queryTypeBufferbloat, queryBufferbloat, bufferbloatQuery{})
+	registerConfiguredCheck(queryTypeBufferbloat, func(ds *testDataSource) bool { return ds.bufferbloat != nil })
+}
+
+type bufferbloatQuery struct {
+	// Mode is "timeline" (default) for latency, throughput and grade series,
+	// or "summary" for the last test in a row.
+	Mode string `json:"mode"`
+}
+
+// bufferbloatGrades grade the latency a loaded connection adds, as the
+// DSLReports test does: the first grade the increase is below applies.
+var bufferbloatGrades = []struct {
+	name     string
+	below    time.Duration
+	severity int64
+}{
+	{"A+", 5 * time.Millisecond, severityOK},
+	{"A", 30 * time.Millisecond, severityOK},
+	{"B", 60 * time.Millisecond, severityWarning},
+	{"C", 200 * time.Millisecond, severityWarning},
+	{"D", 400 * time.Millisecond, severityCritical},
+	{"F", 0, severityCritical},
+}
+
+// bufferbloatGrade returns the index of the grade of a latency increase.
+func bufferbloatGrade(increase time.Duration) int64 {
+	for i, g := range bufferbloatGrades {
+		if increase < g.below {
+			return int64(i)
+		}
+	}
+	return int64(len(bufferbloatGrades) - 1)
+}
+
+// bufferbloatResult is a test of the connection. Loaded latencies and
+// throughputs are zero for the loads that weren't tested or failed, and the
+// grade is nil without an idle and a loaded latency.
+type bufferbloatResult struct {
+	Time            time.Time
+	Idle            time.Duration
+	DownloadLatency time.Duration
+	UploadLatency   time.Duration
+	DownloadMbps    float64
+	UploadMbps      float64
+	Grade           *int64
+	Error           string
+}
+
+// bufferbloatTest is the configured bufferbloat test, and its results.
+type bufferbloatTest struct {
+	// pingAddr is the host and port latency is timed by connecting to
+	pingAddr    string
+	downloadURL string
+	uploadURL   string
+	duration    time.Duration
+	interval    time.Duration
+
+	mu      sync.Mutex
+	results []bufferbloatResult
+}
+
+func newBufferbloatTest(settings models.BufferbloatSettings) (*bufferbloatTest, error) {
+	u, err := url.Parse(settings.PingURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid pingUrl %q", settings.PingURL)
+	}
+	t := &bufferbloatTest{
+		pingAddr:    u.Host,
+		downloadURL: settings.DownloadURL,
+		uploadURL:   settings.UploadURL,
+		duration:    defaultBufferbloatDuration,
+		interval:    defaultBufferbloatInterval,
+	}
+	switch {
+	case u.Scheme == "tcp" && u.Port() == "":
+		return nil, fmt.Errorf("pingUrl %q has no port", settings.PingURL)
+	case u.Scheme == "tcp", u.Port() != "":
+	case u.Scheme == "http":
+		t.pingAddr = net.JoinHostPort(u.Hostname(), "80")
+	case u.Scheme == "https":
+		t.pingAddr = net.JoinHostPort(u.Hostname(), "443")
+	default:
+		return nil, fmt.Errorf("invalid pingUrl %q, expected an http, https or tcp URL", settings.PingURL)
+	}
+	for name, raw := range map[string]string{"downloadUrl": t.downloadURL, "uploadUrl": t.uploadURL} {
+		if raw == "" {
+			continue
+		}
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid %s %q", name, raw)
+		}
+	}
+	if t.downloadURL == "" && t.uploadURL == "" {
+		return nil, fmt.Errorf("a downloadUrl or an uploadUrl is needed to load the connection")
+	}
+	if settings.DurationSeconds > 0 {
+		t.duration = time.Duration(settings.DurationSeconds) * time.Second
+	}
+	if settings.IntervalMinutes > 0 {
+		t.interval = time.Duration(settings.IntervalMinutes) * time.Minute
+	}
+	if t.duration*3 > t.interval {
+		return nil, fmt.Errorf("durationSeconds is too long for intervalMinutes")
+	}
+	return t, nil
+}
+
+func (t *bufferbloatTest) record(r bufferbloatResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.results = append(t.results, r)
+	if len(t.results) > maxBufferbloatResults {
+		t.results = t.results[len(t.results)-maxBufferbloatResults:]
+	}
+}
+
+// window returns the results within tr, oldest first.
+func (t *bufferbloatTest) window(tr backend.TimeRange) []bufferbloatResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var results []bufferbloatResult
+	for _, r := range t.results {
+		if !r.Time.Before(tr.From) && !r.Time.After(tr.To) {
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+// sampleLatency times connecting to the ping address every ping interval,
+// until ctx is done or it has n samples, if n is positive. It returns the
+// median of the samples.
+func (ds *testDataSource) sampleLatency(ctx context.Context, addr string, n int) (time.Duration, error) {
+	var samples []time.Duration
+	var lastErr error
+	ticker := time.NewTicker(bufferbloatPingInterval)
+	defer ticker.Stop()
+	for done := false; !done && (n <= 0 || len(samples) < n); {
+		pingCtx, cancel := context.WithTimeout(ctx, bufferbloatPingTimeout)
+		start := time.Now()
+		conn, err := ds.egress.dialContext(pingCtx, "tcp", addr)
+		elapsed := time.Since(start)
+		cancel()
+		if err == nil {
+			conn.Close()
+			samples = append(samples, elapsed)
+		} else if ctx.Err() == nil {
+			lastErr = err
+		}
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+		}
+	}
+	if len(samples) == 0 {
+		if lastErr == nil {
+			lastErr = ctx.Err()
+		}
+		return 0, fmt.Errorf("failed to connect to %s: %w", addr, lastErr)
+	}
+	slices.Sort(samples)
+	return samples[len(samples)/2], nil
+}
+
+// zeroReader is an endless upload body of zeros, counting the bytes read.
+type zeroReader struct {
+	sent *atomic.Int64
+}
+
+func (z zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	z.sent.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// loadConnection downloads from or uploads to target with parallel
+// streams until ctx is done, starting transfers again as they complete.
+// It returns the bytes transferred, or the error of a stream that failed.
+func (ds *testDataSource) loadConnection(ctx context.Context, method, target string) (int64, error) {
+	var transferred atomic.Int64
+	var wg sync.WaitGroup
+	errs := make([]error, bufferbloatStreams)
+	for i := range bufferbloatStreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				var body io.Reader
+				if method == http.MethodPost {
+					body = zeroReader{sent: &transferred}
+				}
+				req, err := http.NewRequestWithContext(ctx, method, target, body)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				resp, err := ds.httpClient.Do(req)
+				if err != nil {
+					if ctx.Err() == nil {
+						errs[i] = fmt.Errorf("failed to fetch %s: %w", redactURL(target), err)
+					}
+					return
+				}
+				n, _ := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					errs[i] = fmt.Errorf("%s returned %s", redactURL(target), resp.Status)
+					return
+				}
+				if method == http.MethodGet {
+					transferred.Add(n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// Streams fail alike, so the first error tells
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return transferred.Load(), nil
+}
+
+// loadedLatency samples latency while loading the connection for the
+// test's duration, and returns the median latency and the throughput.
+func (ds *testDataSource) loadedLatency(ctx context.Context, t *bufferbloatTest, method, target string) (time.Duration, float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.duration)
+	defer cancel()
+
+	start := time.Now()
+	var transferred int64
+	var loadErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Streams only stop early when they fail, which ends the sampling
+		defer cancel()
+		transferred, loadErr = ds.loadConnection(ctx, method, target)
+	}()
+	// Latency before the streams ramp up isn't loaded yet
+	select {
+	case <-ctx.Done():
+	case <-time.After(t.duration / 5):
+	}
+	latency, pingErr := ds.sampleLatency(ctx, t.pingAddr, 0)
+	cancel()
+	<-done
+	if loadErr != nil {
+		return 0, 0, loadErr
+	}
+	if pingErr != nil {
+		return 0, 0, pingErr
+	}
+	mbps := float64(transferred) * 8 / time.Since(start).Seconds() / 1e6
+	return latency, mbps, nil
+}
+
+// runBufferbloatTest times latency idle, then while downloading and while
+// uploading, and grades the increase.
+func (ds *testDataSource) runBufferbloatTest(ctx context.Context, t *bufferbloatTest) bufferbloatResult {
+	result := bufferbloatResult{Time: time.Now()}
+	idle, err := ds.sampleLatency(ctx, t.pingAddr, bufferbloatIdleSamples)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Idle = idle
+
+	var errs []string
+	if t.downloadURL != "" {
+		latency, mbps, err := ds.loadedLatency(ctx, t, http.MethodGet, t.downloadURL)
+		if err != nil {
+			errs = append(errs, "download: "+err.Error())
+		}
+		result.DownloadLatency, result.DownloadMbps = latency, mbps
+	}
+	if t.uploadURL != "" {
+		latency, mbps, err := ds.loadedLatency(ctx, t, http.MethodPost, t.uploadURL)
+		if err != nil {
+			errs = append(errs, "upload: "+err.Error())
+		}
+		result.UploadLatency, result.UploadMbps = latency, mbps
+	}
+	result.Error = strings.Join(errs, "; ")
+
+	loaded := max(result.DownloadLatency, result.UploadLatency)
+	if loaded > 0 {
+		grade := bufferbloatGrade(max(loaded-idle, 0))
+		result.Grade = &grade
+	}
+	return result
+}
+
+// runBufferbloatTests runs the bufferbloat test every interval, after a
+// delay, until the instance is disposed of.
+func (ds *testDataSource) runBufferbloatTests(ctx context.Context) {
+	t := ds.bufferbloat
+	job := ds.schedule.add("bufferbloat", "", t.interval, time.Now().Add(bufferbloatStartDelay))
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(bufferbloatStartDelay):
+	}
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		job.run(func() error {
+			result := ds.runBufferbloatTest(ctx, t)
+			t.record(result)
+			if result.Error != "" {
+				return errors.New(result.Error)
+			}
+			return nil
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func queryBufferbloat(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q bufferbloatQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if ds.bufferbloat == nil {
+		return nil, fmt.Errorf("no bufferbloat test configured")
+	}
+	results := ds.bufferbloat.window(query.TimeRange)
+	switch q.Mode {
+	case "", "timeline":
+		frame := bufferbloatFrame("bufferbloat", results)
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+		return data.Frames{frame}, nil
+	case "summary":
+		if len(results) > 0 {
+			results = results[len(results)-1:]
+		}
+		frame := bufferbloatFrame("bufferbloat_summary", results)
+		messages := make([]string, len(results))
+		for i, r := range results {
+			messages[i] = r.Error
+		}
+		frame.Fields = append(frame.Fields, data.NewField("error", nil, messages))
+		return data.Frames{frame}, nil
+	default:
+		return nil, fmt.Errorf("unknown bufferbloat mode %q", q.Mode)
+	}
+}
+
+// gradeConfig maps grade indexes to the names and colors of the grades.
+func gradeConfig() *data.FieldConfig {
+	mapper := data.ValueMapper{}
+	for i, g := range bufferbloatGrades {
+		mapper[strconv.Itoa(i)] = severityDisplay(g.severity, g.name)
+	}
+	return &data.FieldConfig{
+		Min: ptrConfFloat64(0),
+		Max: ptrConfFloat64(float64(len(bufferbloatGrades) - 1)),
+		Mappings: data.ValueMappings{
+			mapper,
+			data.SpecialValueMapper{Match: data.SpecialValueNull, Result: unknownDisplay},
+		},
+	}
+}
+
+// bufferbloatFrame returns a row per test, with null latencies and
+// throughputs for the loads that weren't measured.
+func bufferbloatFrame(name string, results []bufferbloatResult) *data.Frame {
+	frame := data.NewFrame(name,
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("idle_latency", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("download_latency", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("upload_latency", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("download_mbps", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "Mbits"}),
+		data.NewField("upload_mbps", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "Mbits"}),
+		data.NewField("grade", nil, []*int64{}).SetConfig(gradeConfig()),
+	)
+	ms := func(d time.Duration) *float64 {
+		if d <= 0 {
+			return nil
+		}
+		v := float64(d) / float64(time.Millisecond)
+		return &v
+	}
+	mbps := func(v float64, latency time.Duration) *float64 {
+		if latency <= 0 {
+			return nil
+		}
+		return &v
+	}
+	for _, r := range results {
+		frame.AppendRow(r.Time, ms(r.Idle), ms(r.DownloadLatency), ms(r.UploadLatency),
+			mbps(r.DownloadMbps, r.DownloadLatency), mbps(r.UploadMbps, r.UploadLatency), r.Grade)
+	}
+	return frame
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// rawSeriesSuffix names the series keeping the raw values of calibrated
+// series, after their name.
+const rawSeriesSuffix = "_raw"
+
+// calibration corrects the values of the series sel matches.
+type calibration struct {
+	sel     seriesSelector
+	correct func(float64) float64
+}
+
+func newCalibrations(configured []models.Calibration) []calibration {
+	calibrations := make([]calibration, 0, len(configured))
+	for _, c := range configured {
+		cal := calibration{sel: seriesSelector{Metric: c.Metric, Labels: c.Labels}}
+		switch {
+		case len(c.Polynomial) > 0:
+			coefficients := c.Polynomial
+			cal.correct = func(v float64) float64 {
+				// Horner's method, from the highest degree down
+				result := 0.0
+				for i := len(coefficients) - 1; i >= 0; i-- {
+					result = result*v + coefficients[i]
+				}
+				return result
+			}
+		default:
+			scale, offset := 1.0, c.Offset
+			if c.Scale != nil {
+				scale = *c.Scale
+			}
+			cal.correct = func(v float64) float64 { return v*scale + offset }
+		}
+		calibrations = append(calibrations, cal)
+	}
+	return calibrations
+}
+
+// calibrate corrects the samples calibrations match, the first matching
+// calibration applying, and adds their raw values as <name>_raw samples.
+func calibrate(calibrations []calibration, samples []metricSample) []metricSample {
+	if len(calibrations) == 0 {
+		return samples
+	}
+	calibrated := make([]metricSample, 0, len(samples))
+	var raw []metricSample
+	for _, s := range samples {
+		for _, c := range calibrations {
+			if !c.sel.matches(s.seriesInfo) {
+				continue
+			}
+			raw = append(raw, metricSample{
+				seriesInfo: seriesInfo{Family: s.Family + rawSeriesSuffix, Name: s.Name + rawSeriesSuffix, Labels: s.Labels},
+				Value:      s.Value,
+			})
+			s.Value = c.correct(s.Value)
+			break
+		}
+		calibrated = append(calibrated, s)
+	}
+	return append(calibrated, raw...)
+}
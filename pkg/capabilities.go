@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+type queryTypeCapability struct {
+	Name string `json:"name"`
+	// Enabled is false for experimental query types whose feature is off
+	Enabled bool `json:"enabled"`
+	// Configured is false when the settings the query type needs are missing
+	Configured bool   `json:"configured"`
+	Feature    string `json:"feature,omitempty"`
+}
+
+type sourceCapability struct {
+	Name       string `json:"name"`
+	Configured bool   `json:"configured"`
+}
+
+type capabilities struct {
+	QueryTypes []queryTypeCapability `json:"queryTypes"`
+	// Sources are the sources of metric queries
+	Sources []sourceCapability `json:"sources"`
+}
+
+// configuredChecks report whether an instance has the settings a query type
+// needs. Query types without a check need none.
+var configuredChecks = map[string]func(ds *testDataSource) bool{}
+
+// registerConfiguredCheck registers the check of a query type, from the init
+// function of the file registering it.
+func registerConfiguredCheck(queryType string, configured func(ds *testDataSource) bool) {
+	configuredChecks[queryType] = configured
+}
+
+func (ds *testDataSource) queryTypeConfigured(queryType string) bool {
+	configured, ok := configuredChecks[queryType]
+	return !ok || configured(ds)
+}
+
+// handleCapabilities describes the query types compiled into the plugin,
+// which depends on its build tags, and whether this instance can run them,
+// so the query editor only offers the relevant ones.
+func (ds *testDataSource) handleCapabilities(w http.ResponseWriter, _ *http.Request) {
+	caps := capabilities{
+		QueryTypes: make([]queryTypeCapability, 0, len(queryHandlers)),
+		Sources: []sourceCapability{
+			{Name: "metrics", Configured: ds.configErr == nil && len(ds.targets) > 0},
+			{Name: sourceKubernetes, Configured: ds.kubernetes != nil},
+		},
+	}
+	for name := range queryHandlers {
+		caps.QueryTypes = append(caps.QueryTypes, queryTypeCapability{
+			Name:       name,
+			Enabled:    ds.checkQueryTypeEnabled(name) == nil,
+			Configured: ds.queryTypeConfigured(name),
+			Feature:    queryTypeFeatures[name],
+		})
+	}
+	sort.Slice(caps.QueryTypes, func(i, j int) bool { return caps.QueryTypes[i].Name < caps.QueryTypes[j].Name })
+	writeJSON(w, http.StatusOK, caps)
+}
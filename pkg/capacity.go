@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeCapacity = "capacity"
+
+const (
+	defaultCapacityHorizonDays = 30
+	// Default series of the addresses assigned from the pools of a DHCP
+	// server, and their sizes, as the Kea exporter names them
+	defaultPoolUsedMetric = "kea_dhcp4_addresses_assigned_total"
+	defaultPoolSizeMetric = "kea_dhcp4_addresses_total"
+)
+
+const (
+	// capacityRecentSamples are the last samples of a resource its current
+	// usage is the mean of, smoothing out spikes
+	capacityRecentSamples = 5
+	// capacityCritical is the utilization from which a resource is
+	// critical, and capacityCriticalDays how soon it must run out to be
+	capacityCritical     = 0.9
+	capacityCriticalDays = 7
+)
+
+// Resources of capacity reports.
+const (
+	capacityCPU     = "cpu"
+	capacityMemory  = "memory"
+	capacityStorage = "storage"
+	capacityPool    = "ip pool"
+)
+
+// capacityPseudoFilesystems are the types of filesystems that hold no data
+// of their own, and never fill up.
+var capacityPseudoFilesystems = map[string]bool{
+	"tmpfs": true, "devtmpfs": true, "ramfs": true, "overlay": true, "squashfs": true,
+	"nsfs": true, "autofs": true, "proc": true, "sysfs": true, "cgroup2": true,
+}
+
+var capacityStates = stateScale{
+	"ok":       severityOK,
+	"filling":  severityWarning,
+	"critical": severityCritical,
+}
+
+func init() {
+	registerQueryType(queryTypeCapacity, queryCapacity, capacityQuery{})
+}
+
+type capacityQuery struct {
+	// Target selects targets as in metric queries; empty means all of them.
+	Target string `json:"target"`
+	// HorizonDays is how soon a resource must run out for its status to be
+	// a warning, 30 days by default.
+	HorizonDays float64 `json:"horizonDays"`
+	// PoolUsedMetric and PoolSizeMetric name the series of the addresses
+	// used from IP pools and of their sizes, paired by their labels. They
+	// default to those of the Kea exporter.
+	PoolUsedMetric string `json:"poolUsedMetric"`
+	PoolSizeMetric string `json:"poolSizeMetric"`
+}
+
+// capacityResource is the usage of a resource of a target over time, and
+// its capacity, in Unit.
+type capacityResource struct {
+	Target   string
+	Resource string
+	// Instance tells resources of a kind apart, such as the mountpoints of
+	// filesystems
+	Instance string
+	Unit     string
+	Times    []time.Time
+	Used     []float64
+	Capacity []float64
+}
+
+func (r *capacityResource) add(t time.Time, used, capacity float64) {
+	if math.IsNaN(used) || math.IsNaN(capacity) || capacity <= 0 {
+		return
+	}
+	r.Times = append(r.Times, t)
+	r.Used = append(r.Used, used)
+	r.Capacity = append(r.Capacity, capacity)
+}
+
+// capacityPair is a series of usage with the series of its capacity.
+type capacityPair struct {
+	resource       *capacityResource
+	used, capacity int
+}
+
+// capacityResources replays the history of a target within tr for the
+// usage of its resources: its CPUs, from node_cpu_seconds_total in modes
+// other than idle and iowait, its memory, from node_memory_MemTotal_bytes
+// and MemAvailable_bytes, its filesystems, from node_filesystem_size_bytes
+// and avail_bytes, and IP pools, from the series of poolUsed and poolSize.
+func (h *scrapeHistory) capacityResources(target string, tr backend.TimeRange, poolUsed, poolSize string) []*capacityResource {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var resources []*capacityResource
+	resource := func(kind, instance, unit string) *capacityResource {
+		r := &capacityResource{Target: target, Resource: kind, Instance: instance, Unit: unit}
+		resources = append(resources, r)
+		return r
+	}
+
+	var busy []int
+	cpus := map[string]bool{}
+	memTotal, memAvailable := -1, -1
+	// Halves of pairs by kind and labels, completed as the other half comes
+	type half struct{ used, capacity int }
+	halves := map[string]*half{}
+	pairHalf := func(key string) *half {
+		if halves[key] == nil {
+			halves[key] = &half{used: -1, capacity: -1}
+		}
+		return halves[key]
+	}
+	for i, s := range h.series {
+		switch s.Name {
+		case "node_cpu_seconds_total":
+			cpus[s.Labels["cpu"]] = true
+			if mode := s.Labels["mode"]; mode != "idle" && mode != "iowait" {
+				busy = append(busy, i)
+			}
+		case "node_memory_MemTotal_bytes":
+			memTotal = i
+		case "node_memory_MemAvailable_bytes":
+			memAvailable = i
+		case "node_filesystem_size_bytes", "node_filesystem_avail_bytes":
+			if capacityPseudoFilesystems[s.Labels["fstype"]] {
+				continue
+			}
+			p := pairHalf(capacityStorage + "\x00" + s.Labels["mountpoint"])
+			if s.Name == "node_filesystem_size_bytes" {
+				p.capacity = i
+			} else {
+				// Available bytes, turned into used ones as they are read
+				p.used = i
+			}
+		case poolUsed:
+			pairHalf(capacityPool + "\x00" + s.Labels.String()).used = i
+		case poolSize:
+			pairHalf(capacityPool + "\x00" + s.Labels.String()).capacity = i
+		}
+	}
+
+	var cpu, memory *capacityResource
+	if len(busy) > 0 {
+		cpu = resource(capacityCPU, "", "cores")
+	}
+	if memTotal >= 0 && memAvailable >= 0 {
+		memory = resource(capacityMemory, "", "bytes")
+	}
+	keys := make([]string, 0, len(halves))
+	for key := range halves {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []capacityPair
+	for _, key := range keys {
+		p := halves[key]
+		if p.used < 0 || p.capacity < 0 {
+			continue
+		}
+		var r *capacityResource
+		if s := h.series[p.used]; s.Name == poolUsed {
+			r = resource(capacityPool, s.Labels.String(), "addresses")
+		} else {
+			r = resource(capacityStorage, s.Labels["mountpoint"], "bytes")
+		}
+		pairs = append(pairs, capacityPair{resource: r, used: p.used, capacity: p.capacity})
+	}
+	if len(resources) == 0 {
+		return nil
+	}
+
+	// busySeconds adds up the busy counters, NaN when one is missing
+	busySeconds := func(current []float64) float64 {
+		var total float64
+		for _, i := range busy {
+			total += current[i]
+		}
+		return total
+	}
+	var prevBusy float64
+	var prevTime time.Time
+	current := append([]float64(nil), h.base...)
+	for _, s := range h.scrapes {
+		for _, c := range s.Changes {
+			current[c.Series] = c.Value
+		}
+		if s.Time.Before(tr.From) || s.Time.After(tr.To) {
+			continue
+		}
+		if cpu != nil {
+			b := busySeconds(current)
+			// Busy cores over the interval, unless counters reset
+			if !prevTime.IsZero() && b >= prevBusy {
+				cpu.add(s.Time, (b-prevBusy)/s.Time.Sub(prevTime).Seconds(), float64(len(cpus)))
+			}
+			prevBusy, prevTime = b, s.Time
+		}
+		if memory != nil {
+			memory.add(s.Time, current[memTotal]-current[memAvailable], current[memTotal])
+		}
+		for _, p := range pairs {
+			if p.resource.Resource == capacityStorage {
+				// What's left to fill is what's available
+				p.resource.add(s.Time, current[p.capacity]-current[p.used], current[p.capacity])
+			} else {
+				p.resource.add(s.Time, current[p.used], current[p.capacity])
+			}
+		}
+	}
+	return resources
+}
+
+// linearSlope fits a line to values over times by least squares, and
+// returns its slope per second, or false with fewer than two times.
+func linearSlope(times []time.Time, values []float64) (float64, bool) {
+	if len(times) < 2 {
+		return 0, false
+	}
+	origin := times[0]
+	var n, sumT, sumV, sumTT, sumTV float64
+	for i, t := range times {
+		x := t.Sub(origin).Seconds()
+		n++
+		sumT += x
+		sumV += values[i]
+		sumTT += x * x
+		sumTV += x * values[i]
+	}
+	variance := n*sumTT - sumT*sumT
+	if variance <= 0 {
+		return 0, false
+	}
+	return (n*sumTV - sumT*sumV) / variance, true
+}
+
+// capacityForecast is the current usage of a resource, how fast it grows,
+// and when it runs out at that pace.
+type capacityForecast struct {
+	Used     float64
+	Capacity float64
+	// Growth is per day, in Unit, and nil without enough samples
+	Growth *float64
+	// Exhaustion is nil for resources that don't grow
+	Exhaustion *time.Time
+	Status     string
+}
+
+func (r *capacityResource) forecast(now time.Time, horizon time.Duration) capacityForecast {
+	recent := max(len(r.Used)-capacityRecentSamples, 0)
+	var used float64
+	for _, v := range r.Used[recent:] {
+		used += v
+	}
+	f := capacityForecast{Used: used / float64(len(r.Used)-recent), Capacity: r.Capacity[len(r.Capacity)-1]}
+
+	if slope, ok := linearSlope(r.Times, r.Used); ok {
+		perDay := slope * 86400
+		f.Growth = &perDay
+		if slope > 0 {
+			// Beyond what a Duration holds, it never runs out
+			if left := max(f.Capacity-f.Used, 0) / slope; left < math.MaxInt64/float64(time.Second) {
+				t := now.Add(time.Duration(left * float64(time.Second)))
+				f.Exhaustion = &t
+			}
+		}
+	}
+
+	f.Status = "ok"
+	switch {
+	case f.Used/f.Capacity >= capacityCritical,
+		f.Exhaustion != nil && f.Exhaustion.Sub(now) < capacityCriticalDays*24*time.Hour:
+		f.Status = "critical"
+	case f.Exhaustion != nil && f.Exhaustion.Sub(now) < horizon:
+		f.Status = "filling"
+	}
+	return f
+}
+
+func queryCapacity(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q capacityQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	name := q.Target
+	if name == "" {
+		name = allTargets
+	}
+	targets, err := ds.selectTargets(name)
+	if err != nil {
+		return nil, err
+	}
+	horizon := time.Duration(defaultCapacityHorizonDays) * 24 * time.Hour
+	if q.HorizonDays > 0 {
+		horizon = time.Duration(q.HorizonDays * float64(24*time.Hour))
+	}
+	poolUsed, poolSize := q.PoolUsedMetric, q.PoolSizeMetric
+	if poolUsed == "" {
+		poolUsed = defaultPoolUsedMetric
+	}
+	if poolSize == "" {
+		poolSize = defaultPoolSizeMetric
+	}
+
+	var resources []*capacityResource
+	for _, target := range targets {
+		for _, r := range target.history.capacityResources(target.Name, query.TimeRange, poolUsed, poolSize) {
+			if len(r.Times) > 0 {
+				resources = append(resources, r)
+			}
+		}
+	}
+	return data.Frames{capacityFrame(resources, time.Now(), horizon)}, nil
+}
+
+// capacityFrame returns a row per resource with its utilization, growth and
+// projected exhaustion. Used, capacity and growth are in the unit of the
+// row.
+func capacityFrame(resources []*capacityResource, now time.Time, horizon time.Duration) *data.Frame {
+	statusField, severityField := newStateFields(capacityStates)
+	frame := data.NewFrame("capacity",
+		data.NewField("target", nil, []string{}),
+		data.NewField("resource", nil, []string{}),
+		data.NewField("instance", nil, []string{}),
+		data.NewField("used", nil, []float64{}),
+		data.NewField("capacity", nil, []float64{}),
+		data.NewField("unit", nil, []string{}),
+		data.NewField("utilization", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "percentunit", Min: ptrConfFloat64(0), Max: ptrConfFloat64(1)}),
+		data.NewField("growth_per_day", nil, []*float64{}),
+		data.NewField("utilization_growth_per_day", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percentunit"}),
+		data.NewField("exhaustion", nil, []*time.Time{}),
+		data.NewField("days_left", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "d"}),
+		statusField,
+		severityField,
+	)
+	for _, r := range resources {
+		f := r.forecast(now, horizon)
+		var utilizationGrowth, daysLeft *float64
+		if f.Growth != nil {
+			g := *f.Growth / f.Capacity
+			utilizationGrowth = &g
+		}
+		if f.Exhaustion != nil {
+			d := f.Exhaustion.Sub(now).Hours() / 24
+			daysLeft = &d
+		}
+		frame.AppendRow(r.Target, r.Resource, r.Instance, f.Used, f.Capacity, r.Unit, f.Used/f.Capacity,
+			f.Growth, utilizationGrowth, f.Exhaustion, daysLeft, f.Status, capacityStates.severity(f.Status))
+	}
+	return frame
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeCarbon = "carbon"
+
+const defaultCarbonURL = "https://api.electricitymap.org/v3"
+
+// carbonCacheTTL is how long intensities are reused. Electricity Maps
+// updates them hourly, and limits the requests of free API keys.
+const carbonCacheTTL = 15 * time.Minute
+
+// Units of carbon intensities and emission rates, which Grafana has none for.
+const (
+	carbonIntensityUnit = "suffix: gCO₂eq/kWh"
+	carbonEmissionUnit  = "suffix: gCO₂eq/h"
+)
+
+func init() {
+	registerQueryType(queryTypeCarbon, queryCarbon, carbonQuery{})
+	registerConfiguredCheck(queryTypeCarbon, func(ds *testDataSource) bool { return ds.settings.Carbon.Zone != "" })
+}
+
+type carbonQuery struct {
+	// Mode is "intensity" (default) for the carbon intensity of the last 24
+	// hours and its forecast, "emissions" for the emissions of Consumption,
+	// or "cleanest" for the forecast windows with the cleanest electricity.
+	Mode string `json:"mode"`
+	// Consumption is a query of power in watts, such as a metric query of
+	// smart plugs, whose series are turned into emission rates.
+	Consumption json.RawMessage `json:"consumption"`
+	// Hours is how long the job to schedule runs, one hour by default, and
+	// Count how many windows to list, three by default.
+	Hours int `json:"hours"`
+	Count int `json:"count"`
+}
+
+// carbonPoint is the carbon intensity of the grid over the hour from Time,
+// in grams of CO2 equivalent per kWh.
+type carbonPoint struct {
+	Time      time.Time
+	Intensity float64
+}
+
+// carbonCache holds the intensities fetched last, by endpoint.
+type carbonCache struct {
+	mu      sync.Mutex
+	entries map[string]carbonCacheEntry
+}
+
+type carbonCacheEntry struct {
+	at     time.Time
+	points []carbonPoint
+}
+
+// carbonIntensities returns the intensities of the configured zone from
+// endpoint, "history" for the last 24 hours or "forecast", sorted by time.
+func (ds *testDataSource) carbonIntensities(ctx context.Context, endpoint string) ([]carbonPoint, error) {
+	ds.carbon.mu.Lock()
+	entry, ok := ds.carbon.entries[endpoint]
+	ds.carbon.mu.Unlock()
+	if ok && time.Since(entry.at) < carbonCacheTTL {
+		return entry.points, nil
+	}
+
+	base := ds.settings.Carbon.URL
+	if base == "" {
+		base = defaultCarbonURL
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", base, err)
+	}
+	u = u.JoinPath("carbon-intensity", endpoint)
+	u.RawQuery = url.Values{"zone": {ds.settings.Carbon.Zone}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %s: %w", u, err)
+	}
+	if ds.settings.Secrets != nil {
+		req.Header.Set("Auth-Token", ds.settings.Secrets.CarbonAPIKey)
+	}
+	resp, err := send(ds.httpClient, req)
+	body, err := readBody(resp, u.String(), err, ds.maxResponseBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var payload struct {
+		History  []carbonPayloadPoint `json:"history"`
+		Forecast []carbonPayloadPoint `json:"forecast"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, withCode(codeParseError, fmt.Errorf("invalid response from %s: %w", u, err))
+	}
+	var points []carbonPoint
+	for _, p := range append(payload.History, payload.Forecast...) {
+		// Hours the zone has no estimate for come without an intensity
+		if p.CarbonIntensity != nil {
+			points = append(points, carbonPoint{Time: p.Datetime.UTC(), Intensity: *p.CarbonIntensity})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+
+	ds.carbon.mu.Lock()
+	ds.carbon.entries[endpoint] = carbonCacheEntry{at: time.Now(), points: points}
+	ds.carbon.mu.Unlock()
+	return points, nil
+}
+
+type carbonPayloadPoint struct {
+	CarbonIntensity *float64  `json:"carbonIntensity"`
+	Datetime        time.Time `json:"datetime"`
+}
+
+// intensityAt returns the intensity of the hour of points holding t, or
+// false when t is outside of them.
+func intensityAt(points []carbonPoint, t time.Time) (float64, bool) {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Time.After(t) }) - 1
+	if i < 0 || t.Sub(points[i].Time) >= time.Hour {
+		return 0, false
+	}
+	return points[i].Intensity, true
+}
+
+// intensityFrame is a time series of intensities.
+func intensityFrame(name string, points []carbonPoint) *data.Frame {
+	times := make([]time.Time, len(points))
+	values := make([]float64, len(points))
+	for i, p := range points {
+		times[i], values[i] = p.Time, p.Intensity
+	}
+	frame := data.NewFrame(name,
+		data.NewField("time", nil, times),
+		data.NewField(name, nil, values).SetConfig(&data.FieldConfig{Unit: carbonIntensityUnit}),
+	)
+	frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti}
+	return frame
+}
+
+// emissionFrames turns the power series of frames into emission rates, at
+// the intensity of the hour of each sample. Samples outside of the hours
+// of points have no rate.
+func emissionFrames(frames data.Frames, points []carbonPoint) (data.Frames, error) {
+	out := make(data.Frames, 0, len(frames))
+	for _, frame := range frames {
+		var times *data.Field
+		for _, field := range frame.Fields {
+			if field.Type().Time() {
+				times = field
+				break
+			}
+		}
+		if times == nil {
+			continue
+		}
+		for _, field := range frame.Fields {
+			if !field.Type().Numeric() {
+				continue
+			}
+			scale, err := wattScale(field)
+			if err != nil {
+				return nil, fmt.Errorf("consumption series %w", err)
+			}
+			var sampled []time.Time
+			var rates []*float64
+			for row := 0; row < field.Len(); row++ {
+				t, ok := times.ConcreteAt(row)
+				if !ok {
+					continue
+				}
+				watts, err := field.NullableFloatAt(row)
+				if err != nil {
+					return nil, err
+				}
+				var rate *float64
+				if intensity, ok := intensityAt(points, t.(time.Time)); ok && watts != nil {
+					v := *watts * scale / 1000 * intensity
+					rate = &v
+				}
+				sampled = append(sampled, t.(time.Time))
+				rates = append(rates, rate)
+			}
+			emissions := data.NewFrame(field.Name,
+				data.NewField("time", nil, sampled),
+				data.NewField("emissions", field.Labels, rates).SetConfig(&data.FieldConfig{Unit: carbonEmissionUnit}),
+			)
+			emissions.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti}
+			out = append(out, emissions)
+		}
+	}
+	return out, nil
+}
+
+// wattScale returns what values of a power series are multiplied by for
+// watts. Power is taken as watts unless its unit says otherwise.
+func wattScale(field *data.Field) (float64, error) {
+	if field.Config == nil {
+		return 1, nil
+	}
+	switch field.Config.Unit {
+	case "", "watt":
+		return 1, nil
+	case "kwatt":
+		return 1000, nil
+	}
+	return 0, fmt.Errorf("%s is in %s, not watts", field.Name, field.Config.Unit)
+}
+
+// carbonWindow is a run of forecast hours and their mean intensity.
+type carbonWindow struct {
+	Start     time.Time
+	End       time.Time
+	Intensity float64
+}
+
+// cleanestWindows returns up to count windows of hours consecutive forecast
+// hours from now on, with the lowest mean intensity first. The windows
+// don't overlap.
+func cleanestWindows(points []carbonPoint, now time.Time, hours, count int) []carbonWindow {
+	from := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(now.Truncate(time.Hour)) })
+	points = points[from:]
+	var candidates []carbonWindow
+	for i := 0; i+hours <= len(points); i++ {
+		run := points[i : i+hours]
+		if run[hours-1].Time.Sub(run[0].Time) != time.Duration(hours-1)*time.Hour {
+			// A gap in the forecast
+			continue
+		}
+		var sum float64
+		for _, p := range run {
+			sum += p.Intensity
+		}
+		candidates = append(candidates, carbonWindow{Start: run[0].Time, End: run[0].Time.Add(time.Duration(hours) * time.Hour), Intensity: sum / float64(hours)})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Intensity < candidates[j].Intensity })
+
+	var windows []carbonWindow
+	for _, c := range candidates {
+		if len(windows) == count {
+			break
+		}
+		overlaps := false
+		for _, w := range windows {
+			if c.Start.Before(w.End) && w.Start.Before(c.End) {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			windows = append(windows, c)
+		}
+	}
+	return windows
+}
+
+func queryCarbon(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q carbonQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if ds.settings.Carbon.Zone == "" {
+		return nil, fmt.Errorf("no carbon intensity zone configured")
+	}
+
+	switch q.Mode {
+	case "", "intensity":
+		history, err := ds.carbonIntensities(ctx, "history")
+		if err != nil {
+			return nil, err
+		}
+		frames := data.Frames{intensityFrame("intensity", history)}
+		// Forecasts are not part of every plan, so their absence only
+		// warns
+		forecast, err := ds.carbonIntensities(ctx, "forecast")
+		if err != nil {
+			frames[0].Meta.Notices = append(frames[0].Meta.Notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("No forecast: %v", err),
+			})
+			return frames, nil
+		}
+		return append(frames, intensityFrame("forecast", forecast)), nil
+
+	case "emissions":
+		if len(q.Consumption) == 0 {
+			return nil, fmt.Errorf("emissions need a consumption query")
+		}
+		history, err := ds.carbonIntensities(ctx, "history")
+		if err != nil {
+			return nil, err
+		}
+		frames, err := ds.runInnerQuery(ctx, query, q.Consumption)
+		if err != nil {
+			return nil, fmt.Errorf("consumption query: %w", err)
+		}
+		return emissionFrames(frames, history)
+
+	case "cleanest":
+		hours, count := q.Hours, q.Count
+		if hours <= 0 {
+			hours = 1
+		}
+		if count <= 0 {
+			count = 3
+		}
+		forecast, err := ds.carbonIntensities(ctx, "forecast")
+		if err != nil {
+			return nil, err
+		}
+		frame := data.NewFrame("cleanest",
+			data.NewField("start", nil, []time.Time{}),
+			data.NewField("end", nil, []time.Time{}),
+			data.NewField("intensity", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: carbonIntensityUnit}),
+		)
+		for _, w := range cleanestWindows(forecast, time.Now(), hours, count) {
+			frame.AppendRow(w.Start, w.End, math.Round(w.Intensity))
+		}
+		return data.Frames{frame}, nil
+	}
+	return nil, fmt.Errorf("unknown carbon mode %q", q.Mode)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"gopkg.in/yaml.v3"
+)
+
+// cliCommands are the subcommands of the plugin binary, which run the
+// collectors and parsers from a shell, outside Grafana. Grafana starts the
+// binary without arguments.
+var cliCommands = map[string]func(ctx context.Context, args []string, stdout io.Writer) error{
+	"scrape":          cliScrape,
+	"query":           cliQuery,
+	"validate-config": cliValidateConfig,
+	"loadtest":        cliLoadTest,
+}
+
+const cliUsage = `Usage:
+  homelab-plugin scrape [-config file] [-name datasource] <target name or URL>
+  homelab-plugin query [-config file] [-name datasource] [-range 1h] [-max-data-points 100] <query JSON>
+  homelab-plugin validate-config [-name datasource] <file>
+  homelab-plugin loadtest [-duration 10s] [-concurrency 1] [scenario...]
+
+The config file is a Grafana data source provisioning file, or one data
+source of it, in YAML or JSON.
+
+loadtest runs the performance scenarios against synthetic targets and fails
+when one exceeds its budget, scaled by HOMELAB_PLUGIN_PERF_SCALE.
+`
+
+// errCLIUsage is returned for invalid command lines, which exit with 2.
+var errCLIUsage = errors.New("invalid usage")
+
+// runCLI runs the subcommand of args and returns the exit code, or ok false
+// when args are not a subcommand.
+func runCLI(args []string) (code int, ok bool) {
+	command, ok := cliCommands[args[0]]
+	if !ok {
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			fmt.Print(cliUsage)
+			return 0, true
+		}
+		return 0, false
+	}
+	// Subcommands share a process with nothing, so the metrics server
+	// would only take the port of a running plugin
+	if _, set := os.LookupEnv(metricsAddrEnv); !set {
+		os.Setenv(metricsAddrEnv, "")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err := command(ctx, args[1:], os.Stdout)
+	liveInstances.disposeAll()
+	switch {
+	case errors.Is(err, errCLIUsage):
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2, true
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1, true
+	}
+	return 0, true
+}
+
+// cliDataSource is a data source of a provisioning file.
+type cliDataSource struct {
+	Name           string            `yaml:"name"`
+	Type           string            `yaml:"type"`
+	UID            string            `yaml:"uid"`
+	JSONData       map[string]any    `yaml:"jsonData"`
+	SecureJSONData map[string]string `yaml:"secureJsonData"`
+}
+
+// loadCLIConfig reads the data source of this plugin named name, or the
+// first one, from a provisioning file, or a file of a single data source.
+func loadCLIConfig(path, name string) (backend.DataSourceInstanceSettings, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return backend.DataSourceInstanceSettings{}, err
+	}
+	var file struct {
+		Datasources []cliDataSource `yaml:"datasources"`
+	}
+	if err := yaml.Unmarshal(body, &file); err != nil {
+		return backend.DataSourceInstanceSettings{}, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if len(file.Datasources) == 0 {
+		var single cliDataSource
+		if err := yaml.Unmarshal(body, &single); err != nil {
+			return backend.DataSourceInstanceSettings{}, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		file.Datasources = append(file.Datasources, single)
+	}
+	for _, d := range file.Datasources {
+		if (d.Type != "" && d.Type != pluginID) || (name != "" && d.Name != name) {
+			continue
+		}
+		return cliInstanceSettings(d)
+	}
+	if name != "" {
+		return backend.DataSourceInstanceSettings{}, fmt.Errorf("no %s data source named %q in %s", pluginID, name, path)
+	}
+	return backend.DataSourceInstanceSettings{}, fmt.Errorf("no %s data source in %s", pluginID, path)
+}
+
+func cliInstanceSettings(d cliDataSource) (backend.DataSourceInstanceSettings, error) {
+	jsonData, err := json.Marshal(d.JSONData)
+	if err != nil {
+		return backend.DataSourceInstanceSettings{}, fmt.Errorf("invalid jsonData: %w", err)
+	}
+	uid := d.UID
+	if uid == "" {
+		uid = "cli"
+	}
+	return backend.DataSourceInstanceSettings{
+		UID:                     uid,
+		Name:                    d.Name,
+		JSONData:                jsonData,
+		DecryptedSecureJSONData: d.SecureJSONData,
+	}, nil
+}
+
+// newCLIDataSource creates the instance of settings, to be disposed of.
+func newCLIDataSource(ctx context.Context, settings backend.DataSourceInstanceSettings) (*testDataSource, error) {
+	instance, err := newDataSource(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+	ds := instance.(*testDataSource)
+	if ds.configErr != nil {
+		ds.Dispose()
+		return nil, fmt.Errorf("invalid configuration: %w", ds.configErr)
+	}
+	return ds, nil
+}
+
+func cliScrape(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("scrape", flag.ContinueOnError)
+	config := flags.String("config", "", "data source provisioning file")
+	name := flags.String("name", "", "data source name in the config file")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errCLIUsage
+	}
+	target := flags.Arg(0)
+
+	var settings backend.DataSourceInstanceSettings
+	var err error
+	if *config != "" {
+		settings, err = loadCLIConfig(*config, *name)
+	} else {
+		// Without a config file, the target is the metrics URL of a data
+		// source of it
+		u, parseErr := url.Parse(target)
+		if parseErr != nil || u.Host == "" {
+			return fmt.Errorf("invalid target URL %q", target)
+		}
+		metricsPath := u.Path
+		u.Path, u.RawPath = "", ""
+		settings, err = cliInstanceSettings(cliDataSource{
+			JSONData:       map[string]any{"url": u.String(), "metricsPath": metricsPath},
+			SecureJSONData: map[string]string{"apiKey": "cli"},
+		})
+	}
+	if err != nil {
+		return err
+	}
+	ds, err := newCLIDataSource(ctx, settings)
+	if err != nil {
+		return err
+	}
+	defer ds.Dispose()
+
+	var found *scrapeTarget
+	for _, t := range ds.targets {
+		if t.Name == target || t.URL == target || *config == "" {
+			found = t
+			break
+		}
+	}
+	if found == nil {
+		return fmt.Errorf("no target %q in %s", target, *config)
+	}
+	samples, err := ds.scrapeMetrics(ctx, found)
+	if err != nil {
+		return err
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Name != samples[j].Name {
+			return samples[i].Name < samples[j].Name
+		}
+		return samples[i].Labels.String() < samples[j].Labels.String()
+	})
+	// In the text exposition format
+	for _, s := range samples {
+		labels := ""
+		if len(s.Labels) > 0 {
+			names := make([]string, 0, len(s.Labels))
+			for name := range s.Labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			pairs := make([]string, len(names))
+			for i, name := range names {
+				pairs[i] = fmt.Sprintf("%s=%q", name, s.Labels[name])
+			}
+			labels = "{" + strings.Join(pairs, ",") + "}"
+		}
+		fmt.Fprintf(stdout, "%s%s %s\n", s.Name, labels, strconv.FormatFloat(s.Value, 'g', -1, 64))
+	}
+	return nil
+}
+
+func cliQuery(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	config := flags.String("config", "", "data source provisioning file")
+	name := flags.String("name", "", "data source name in the config file")
+	span := flags.Duration("range", time.Hour, "time range ending now")
+	maxDataPoints := flags.Int64("max-data-points", 100, "most points per series")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || *config == "" || *span <= 0 || *maxDataPoints <= 0 {
+		return errCLIUsage
+	}
+	raw := json.RawMessage(flags.Arg(0))
+	var model struct {
+		QueryType string `json:"queryType"`
+	}
+	if err := json.Unmarshal(raw, &model); err != nil {
+		return withCode(codeParseError, fmt.Errorf("invalid query JSON: %w", err))
+	}
+
+	settings, err := loadCLIConfig(*config, *name)
+	if err != nil {
+		return err
+	}
+	ds, err := newCLIDataSource(ctx, settings)
+	if err != nil {
+		return err
+	}
+	defer ds.Dispose()
+
+	// Metric queries need a scrape within the time range, which live
+	// scrapes made while querying would miss
+	for _, t := range ds.targets {
+		if _, err := ds.scrapeMetrics(ctx, t); err != nil {
+			fmt.Fprintf(os.Stderr, "Scraping %s failed: %v\n", t.Name, err)
+		}
+	}
+	now := time.Now()
+	resp, err := ds.QueryData(ctx, &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:         "A",
+			QueryType:     model.QueryType,
+			JSON:          raw,
+			TimeRange:     backend.TimeRange{From: now.Add(-*span), To: now},
+			Interval:      max(*span/time.Duration(*maxDataPoints), time.Second),
+			MaxDataPoints: *maxDataPoints,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	result := resp.Responses["A"]
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, frame := range result.Frames {
+		table, err := frame.StringTable(-1, -1)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, table)
+	}
+	return nil
+}
+
+func cliValidateConfig(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	name := flags.String("name", "", "data source name in the config file")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errCLIUsage
+	}
+	settings, err := loadCLIConfig(flags.Arg(0), *name)
+	if err != nil {
+		return err
+	}
+	ds, err := newCLIDataSource(ctx, settings)
+	if err != nil {
+		return err
+	}
+	ds.Dispose()
+	fmt.Fprintf(stdout, "%s: valid, %d targets\n", flags.Arg(0), len(ds.targets))
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeClimate = "climate"
+
+const (
+	defaultClimateLabel      = "room"
+	defaultTemperatureMetric = `.*temperature_celsius`
+	defaultHumidityMetric    = `.*humidity(_percent|_ratio)?`
+)
+
+// climateStaleIntervals is how many scrape intervals old the readings of a
+// target may be before they are left out of the aggregates.
+const climateStaleIntervals = 3
+
+// Names of the aggregate series, labeled by room and stat.
+const (
+	climateTemperature = "climate_temperature_celsius"
+	climateHumidity    = "climate_humidity_percent"
+)
+
+// Names of the series derived from each pair of temperature and humidity
+// sensors, labeled by target, room and the sensors' labels.
+const (
+	climateDewPoint         = "climate_dew_point_celsius"
+	climateHeatIndex        = "climate_heat_index_celsius"
+	climateAbsoluteHumidity = "climate_absolute_humidity_grams_per_cubic_meter"
+)
+
+// climateMeasures are the series of each measure of climate queries, and
+// climateUnits their units.
+var (
+	climateMeasures = map[string]string{
+		"temperature":      climateTemperature,
+		"humidity":         climateHumidity,
+		"dewPoint":         climateDewPoint,
+		"heatIndex":        climateHeatIndex,
+		"absoluteHumidity": climateAbsoluteHumidity,
+	}
+	climateUnits = map[string]string{
+		climateTemperature:      "celsius",
+		climateHumidity:         "humidity",
+		climateDewPoint:         "celsius",
+		climateHeatIndex:        "celsius",
+		climateAbsoluteHumidity: "congm3",
+	}
+)
+
+func init() {
+	registerQueryType(queryTypeClimate, queryClimate, climateQuery{})
+	registerConfiguredCheck(queryTypeClimate, func(ds *testDataSource) bool { return ds.settings.Climate.Enabled })
+}
+
+type climateQuery struct {
+	// Room keeps only the series of one room; empty means all rooms.
+	Room string `json:"room"`
+	// Measure is "temperature" or "humidity" for the aggregates of rooms,
+	// "dewPoint", "heatIndex" or "absoluteHumidity" for the series derived
+	// from each pair of sensors, or "degreeDays" or "hvacRuntime" for daily
+	// values; empty means the aggregates.
+	Measure string `json:"measure"`
+	// Stat is "min", "avg" or "max"; empty means all three.
+	Stat string `json:"stat"`
+}
+
+// climateAggregator computes the aggregates of the sensors of each room, and
+// the series derived from them, as targets are scraped, keeping them in a
+// history of their own, and the days of the outdoor temperature and HVACs.
+type climateAggregator struct {
+	label       string
+	temperature *regexp.Regexp
+	humidity    *regexp.Regexp
+	history     *scrapeHistory
+
+	outdoorTarget string
+	outdoorMetric string
+	// hvac is nil when no HVAC runtime is tracked
+	hvac *regexp.Regexp
+	days *hvacTracker
+}
+
+func newClimateAggregator(settings models.ClimateSettings, retention time.Duration, stateDir, uid string) (*climateAggregator, error) {
+	c := &climateAggregator{
+		label:         settings.Label,
+		history:       newScrapeHistory(retention),
+		outdoorTarget: settings.OutdoorTarget,
+		outdoorMetric: settings.OutdoorMetric,
+		days:          newHVACTracker(settings.BaseTemperature, stateDir, uid),
+	}
+	if c.label == "" {
+		c.label = defaultClimateLabel
+	}
+	compile := func(name, expr, fallback string) (*regexp.Regexp, error) {
+		if expr == "" {
+			expr = fallback
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", name, expr, err)
+		}
+		return re, nil
+	}
+	var err error
+	if c.temperature, err = compile("temperatureMetric", settings.TemperatureMetric, defaultTemperatureMetric); err != nil {
+		return nil, err
+	}
+	if c.humidity, err = compile("humidityMetric", settings.HumidityMetric, defaultHumidityMetric); err != nil {
+		return nil, err
+	}
+	if settings.HVACMetric != "" {
+		if c.hvac, err = compile("hvacMetric", settings.HVACMetric, ""); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// climateReadings are the latest readings of the sensors of targets.
+type climateReadings struct {
+	rooms map[string]*roomReadings
+	pairs []climatePair
+	// outdoor is nil when the outdoor temperature wasn't read, and running
+	// are the labels of the HVACs running
+	outdoor *float64
+	running []data.Labels
+}
+
+// roomReadings are the latest readings of the sensors of a room.
+type roomReadings struct {
+	temperature []float64
+	humidity    []float64
+}
+
+// climatePair is a temperature and a humidity read by the same sensor,
+// in °C and percent.
+type climatePair struct {
+	labels      data.Labels
+	temperature float64
+	humidity    float64
+}
+
+// readings returns the readings of the sensors of targets, leaving out
+// targets last scraped before stale. Rooms only have the targets with the
+// room label, while pairs are found in all targets: a temperature and a
+// humidity series with the same labels, or the only two of a target.
+func (c *climateAggregator) readings(targets []*scrapeTarget, now, stale time.Time) climateReadings {
+	readings := climateReadings{rooms: map[string]*roomReadings{}}
+	for i, target := range targets {
+		samples, at, ok := target.history.samplesAt(now)
+		if !ok || at.Before(stale) {
+			continue
+		}
+		outdoor := c.outdoorMetric != "" && (target.Name == c.outdoorTarget || c.outdoorTarget == "" && i == 0)
+		var temperatures, humidities []metricSample
+		for _, s := range samples {
+			if math.IsNaN(s.Value) {
+				continue
+			}
+			if outdoor && readings.outdoor == nil && (s.Name == c.outdoorMetric || s.Family == c.outdoorMetric) {
+				v := s.Value
+				readings.outdoor = &v
+			}
+			if c.hvac != nil && s.Value != 0 && c.hvac.MatchString(s.Name) {
+				labels := data.Labels{"target": target.Name}
+				for k, v := range s.Labels {
+					labels[k] = v
+				}
+				readings.running = append(readings.running, labels)
+			}
+			switch {
+			case c.temperature.MatchString(s.Name):
+				temperatures = append(temperatures, s)
+			case c.humidity.MatchString(s.Name):
+				if strings.HasSuffix(s.Name, "_ratio") {
+					s.Value *= 100
+				}
+				humidities = append(humidities, s)
+			}
+		}
+		if len(temperatures) == 0 && len(humidities) == 0 {
+			continue
+		}
+
+		room := target.Labels[c.label]
+		if room != "" {
+			r, ok := readings.rooms[room]
+			if !ok {
+				r = &roomReadings{}
+				readings.rooms[room] = r
+			}
+			for _, s := range temperatures {
+				r.temperature = append(r.temperature, s.Value)
+			}
+			for _, s := range humidities {
+				r.humidity = append(r.humidity, s.Value)
+			}
+		}
+
+		pair := func(t, h metricSample) {
+			labels := data.Labels{"target": target.Name}
+			for k, v := range t.Labels {
+				labels[k] = v
+			}
+			if room != "" {
+				labels[c.label] = room
+			}
+			readings.pairs = append(readings.pairs, climatePair{labels: labels, temperature: t.Value, humidity: h.Value})
+		}
+		if len(temperatures) == 1 && len(humidities) == 1 {
+			pair(temperatures[0], humidities[0])
+			continue
+		}
+		byLabels := map[string]metricSample{}
+		for _, h := range humidities {
+			byLabels[h.Labels.String()] = h
+		}
+		for _, t := range temperatures {
+			if h, ok := byLabels[t.Labels.String()]; ok {
+				pair(t, h)
+			}
+		}
+	}
+	return readings
+}
+
+// aggregate records the min, avg and max of the readings of each room, and
+// the series derived from each pair of sensors.
+func (c *climateAggregator) aggregate(now time.Time, readings climateReadings) {
+	var samples []metricSample
+	add := func(name, room string, values []float64) {
+		if len(values) == 0 {
+			return
+		}
+		lo, hi, sum := values[0], values[0], 0.0
+		for _, v := range values {
+			lo, hi, sum = math.Min(lo, v), math.Max(hi, v), sum+v
+		}
+		for stat, v := range map[string]float64{"min": lo, "avg": sum / float64(len(values)), "max": hi} {
+			labels := data.Labels{c.label: room, "stat": stat}
+			samples = append(samples, metricSample{seriesInfo: seriesInfo{Family: name, Name: name, Labels: labels}, Value: v})
+		}
+	}
+	for room, r := range readings.rooms {
+		add(climateTemperature, room, r.temperature)
+		add(climateHumidity, room, r.humidity)
+	}
+	for _, p := range readings.pairs {
+		// Out of range humidities have no dew point
+		if p.humidity <= 0 || p.humidity > 100 {
+			continue
+		}
+		for name, v := range map[string]float64{
+			climateDewPoint:         dewPoint(p.temperature, p.humidity),
+			climateHeatIndex:        heatIndex(p.temperature, p.humidity),
+			climateAbsoluteHumidity: absoluteHumidity(p.temperature, p.humidity),
+		} {
+			samples = append(samples, metricSample{seriesInfo: seriesInfo{Family: name, Name: name, Labels: p.labels}, Value: v})
+		}
+	}
+	// Series are indexed as they first come, so sort them for stable frames
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Name+samples[i].Labels.String() < samples[j].Name+samples[j].Labels.String()
+	})
+	c.history.record(now, samples)
+}
+
+func (ds *testDataSource) runClimateAggregator(ctx context.Context) {
+	interval := ds.scrapeInterval()
+	stale := climateStaleIntervals * interval
+	ds.climate.days.load()
+	save := func() {
+		if err := ds.climate.days.save(); err != nil {
+			backend.Logger.Warn("Failed to store HVAC history", "error", err)
+		}
+	}
+
+	job := ds.schedule.add("climate", "", interval, time.Now().Add(interval))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			save()
+			return
+		case now := <-ticker.C:
+			job.run(func() error {
+				readings := ds.climate.readings(ds.targets, now, now.Add(-stale))
+				ds.climate.aggregate(now, readings)
+				if ds.climate.days.record(now, stale, readings.outdoor, readings.running) {
+					save()
+				}
+				return nil
+			})
+		}
+	}
+}
+
+func queryClimate(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q climateQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if !ds.settings.Climate.Enabled {
+		return nil, fmt.Errorf("climate aggregation is not enabled")
+	}
+
+	sel := seriesSelector{Labels: map[string]string{}}
+	switch q.Measure {
+	case "degreeDays":
+		return data.Frames{ds.climate.days.degreeDayFrame(query.TimeRange)}, nil
+	case "hvacRuntime":
+		return ds.climate.days.runtimeFrames(query.TimeRange), nil
+	case "":
+		sel.Regex = regexp.MustCompile("^(?:" + climateTemperature + "|" + climateHumidity + ")$")
+	default:
+		if sel.Metric = climateMeasures[q.Measure]; sel.Metric == "" {
+			return nil, fmt.Errorf("unknown measure %q", q.Measure)
+		}
+	}
+	if q.Room != "" {
+		sel.Labels[ds.climate.label] = q.Room
+	}
+	if q.Stat != "" {
+		sel.Labels["stat"] = q.Stat
+	}
+	frames, err := ds.climate.history.seriesFrames(sel, query)
+	if err != nil {
+		return nil, err
+	}
+	for _, frame := range frames {
+		frame.Fields[1].SetConfig(&data.FieldConfig{Unit: climateUnits[frame.Name]})
+	}
+	return frames, nil
+}
+
+// dewPoint returns the dew point in °C with the Magnus formula, using the
+// constants of Alduchov and Eskridge, good to 0.35°C from -45°C to 60°C.
+func dewPoint(celsius, humidity float64) float64 {
+	const a, b = 17.625, 243.04
+	gamma := math.Log(humidity/100) + a*celsius/(b+celsius)
+	return b * gamma / (a - gamma)
+}
+
+// heatIndex returns how hot it feels in °C, per the US National Weather
+// Service: Steadman's simple formula below 80°F, otherwise the Rothfusz
+// regression with its adjustments for low and high humidity.
+func heatIndex(celsius, humidity float64) float64 {
+	t := celsius*9/5 + 32
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + humidity*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*humidity - 0.22475541*t*humidity -
+			0.00683783*t*t - 0.05481717*humidity*humidity + 0.00122874*t*t*humidity +
+			0.00085282*t*humidity*humidity - 0.00000199*t*t*humidity*humidity
+		switch {
+		case humidity < 13 && t >= 80 && t <= 112:
+			hi -= (13 - humidity) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		case humidity > 85 && t >= 80 && t <= 87:
+			hi += (humidity - 85) / 10 * (87 - t) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// absoluteHumidity returns the mass of water vapor in the air in g/m³, from
+// the saturation vapor pressure of the Magnus formula and the ideal gas law.
+func absoluteHumidity(celsius, humidity float64) float64 {
+	saturation := 6.112 * math.Exp(17.67*celsius/(celsius+243.5))
+	return saturation * humidity * 2.1674 / (273.15 + celsius)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// defaultClockSkewThreshold is how far the clock of a target may be off
+// before it is warned about.
+const defaultClockSkewThreshold = 30 * time.Second
+
+var targetClockSkew = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "grafana_plugin",
+		Name:      "target_clock_skew_seconds",
+		Help:      "How far the clock of a target is ahead of the plugin's, negative when behind, from the timestamps of the samples it reports.",
+	},
+	[]string{"target"},
+)
+
+// clockSkew tracks how far the clock of a target is off, from the newest
+// timestamp of the samples it reports: exposition sample timestamps, and
+// those of Graphite and InfluxDB lines. Samples are recorded as they are
+// received, but the timestamps of a skewed device, such as an ESP without
+// NTP, are wrong in whatever else reads them.
+type clockSkew struct {
+	mu       sync.Mutex
+	skew     time.Duration
+	observed bool
+	// skewed is set while the skew exceeds the threshold, which is warned
+	// about once
+	skewed bool
+}
+
+// get returns the last skew observed, false before the target reported a
+// timestamp.
+func (c *clockSkew) get() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.skew, c.observed
+}
+
+// clockSkewThreshold turns the ClockSkewSeconds setting into a threshold:
+// unset means the default, and a negative value disables the warning.
+func clockSkewThreshold(seconds int) time.Duration {
+	switch {
+	case seconds < 0:
+		return 0
+	case seconds == 0:
+		return defaultClockSkewThreshold
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// observeClock records the skew of the clock of target, which reported
+// samples timestamped up to reported that were received at now, and warns
+// when it exceeds the threshold. Targets reporting no timestamp, a zero
+// reported, are left alone.
+func (ds *testDataSource) observeClock(target *scrapeTarget, reported, now time.Time) {
+	if reported.IsZero() {
+		return
+	}
+	skew := reported.Sub(now)
+	targetClockSkew.WithLabelValues(target.Name).Set(skew.Seconds())
+
+	threshold := clockSkewThreshold(ds.settings.ClockSkewSeconds)
+	exceeded := threshold > 0 && (skew > threshold || skew < -threshold)
+	c := &target.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case exceeded && !c.skewed:
+		backend.Logger.Warn("Target clock is skewed, its timestamps are off", "target", target.Name, "skew", skew.Round(time.Millisecond), "threshold", threshold)
+	case !exceeded && c.skewed:
+		backend.Logger.Info("Target clock is back in sync", "target", target.Name, "skew", skew.Round(time.Millisecond))
+	}
+	c.skew, c.observed, c.skewed = skew, true, exceeded
+}
+
+// newestTimestamp returns the newest timestamp of the samples of families,
+// zero when none has one.
+func newestTimestamp(families map[string]*dto.MetricFamily) time.Time {
+	var newest int64
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			newest = max(newest, m.GetTimestampMs())
+		}
+	}
+	if newest <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(newest)
+}
+
+// parseUnixTimestamp parses a Unix timestamp in seconds, milliseconds,
+// microseconds or nanoseconds, told apart by their magnitude, as senders
+// configure the precision of InfluxDB lines. Seconds may be fractional.
+// Timestamps that aren't positive, such as Graphite's -1 for now, are not
+// timestamps.
+func parseUnixTimestamp(raw string) (time.Time, bool) {
+	if !strings.ContainsAny(raw, ".eE") {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			return time.Time{}, false
+		}
+		switch {
+		case n < 1e11:
+			return time.Unix(n, 0), true
+		case n < 1e14:
+			return time.UnixMilli(n), true
+		case n < 1e17:
+			return time.UnixMicro(n), true
+		}
+		return time.Unix(0, n), true
+	}
+	seconds, err := strconv.ParseFloat(raw, 64)
+	if err != nil || seconds <= 0 || math.IsInf(seconds, 0) || seconds >= 1e11 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(int64(math.Round(seconds * 1000))), true
+}
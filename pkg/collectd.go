@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Part types of collectd's binary network protocol.
+const (
+	collectdHost           = 0x0000
+	collectdPlugin         = 0x0002
+	collectdPluginInstance = 0x0003
+	collectdType           = 0x0004
+	collectdTypeInstance   = 0x0005
+	collectdValues         = 0x0006
+	collectdEncryption     = 0x0210
+)
+
+// Value types of collectd values parts.
+const (
+	collectdCounter  = 0
+	collectdGauge    = 1
+	collectdDerive   = 2
+	collectdAbsolute = 3
+)
+
+// collectdDataSources names the values of the common collectd types with
+// several, as types.db does. Values of other types are named by index.
+var collectdDataSources = map[string][]string{
+	"load":           {"shortterm", "midterm", "longterm"},
+	"if_octets":      {"rx", "tx"},
+	"if_packets":     {"rx", "tx"},
+	"if_errors":      {"rx", "tx"},
+	"if_dropped":     {"rx", "tx"},
+	"disk_octets":    {"read", "write"},
+	"disk_ops":       {"read", "write"},
+	"disk_time":      {"read", "write"},
+	"disk_merged":    {"read", "write"},
+	"disk_io_time":   {"io_time", "weighted_io_time"},
+	"ps_cputime":     {"user", "syst"},
+	"ps_disk_octets": {"read", "write"},
+	"ps_disk_ops":    {"read", "write"},
+	"ps_pagefaults":  {"minflt", "majflt"},
+	"ps_count":       {"processes", "threads"},
+	"io_octets":      {"rx", "tx"},
+	"io_packets":     {"rx", "tx"},
+}
+
+// collectdValueList is the identifier the parts of a packet set, which
+// values parts that follow belong to.
+type collectdValueList struct {
+	host, plugin, pluginInstance, typ, typeInstance string
+}
+
+// ingestCollectd applies a packet of collectd's network plugin to samples.
+// Values are named collectd_<plugin>_<type>[_<data source>], with _total for
+// counters, and labeled with the host, the plugin instance as a label named
+// after the plugin, and the type instance as "type", as collectd_exporter
+// does. Signatures are not checked, and encrypted packets are rejected.
+func ingestCollectd(samples *sampleSet, packet []byte) error {
+	var vl collectdValueList
+	for len(packet) > 0 {
+		if len(packet) < 4 {
+			return fmt.Errorf("truncated collectd part header")
+		}
+		partType := binary.BigEndian.Uint16(packet)
+		length := int(binary.BigEndian.Uint16(packet[2:]))
+		if length < 4 || length > len(packet) {
+			return fmt.Errorf("invalid collectd part length %d", length)
+		}
+		payload := packet[4:length]
+		packet = packet[length:]
+
+		switch partType {
+		case collectdHost, collectdPlugin, collectdPluginInstance, collectdType, collectdTypeInstance:
+			s := string(bytes.TrimRight(payload, "\x00"))
+			switch partType {
+			case collectdHost:
+				vl.host = s
+			case collectdPlugin:
+				vl.plugin = s
+			case collectdPluginInstance:
+				vl.pluginInstance = s
+			case collectdType:
+				vl.typ = s
+			case collectdTypeInstance:
+				vl.typeInstance = s
+			}
+		case collectdValues:
+			if err := vl.ingest(samples, payload); err != nil {
+				return fmt.Errorf("%s/%s: %w", vl.plugin, vl.typ, err)
+			}
+		case collectdEncryption:
+			return fmt.Errorf("encrypted collectd packets are not supported")
+		}
+		// Times, intervals, notifications and signatures are skipped
+	}
+	return nil
+}
+
+// ingest applies the values part of vl.
+func (vl collectdValueList) ingest(samples *sampleSet, payload []byte) error {
+	if len(payload) < 2 {
+		return fmt.Errorf("truncated values part")
+	}
+	n := int(binary.BigEndian.Uint16(payload))
+	if len(payload) != 2+9*n {
+		return fmt.Errorf("values part of %d bytes for %d values", len(payload), n)
+	}
+	types, values := payload[2:2+n], payload[2+n:]
+
+	labels := data.Labels{}
+	if vl.host != "" {
+		labels["host"] = vl.host
+	}
+	if vl.pluginInstance != "" {
+		labels[sanitizeMetricName(vl.plugin)] = vl.pluginInstance
+	}
+	if vl.typeInstance != "" {
+		labels["type"] = vl.typeInstance
+	}
+	base := "collectd_" + sanitizeMetricName(vl.plugin)
+	if vl.typ != vl.plugin {
+		base += "_" + sanitizeMetricName(vl.typ)
+	}
+	names := collectdDataSources[vl.typ]
+	for i := 0; i < n; i++ {
+		name := base
+		switch {
+		case i < len(names):
+			name += "_" + names[i]
+		case n > 1:
+			name += "_" + strconv.Itoa(i)
+		}
+		raw := values[8*i : 8*i+8]
+		switch types[i] {
+		case collectdGauge:
+			// Gauges are the one little-endian value
+			samples.add(name, labels, math.Float64frombits(binary.LittleEndian.Uint64(raw)))
+		case collectdCounter:
+			samples.add(name+"_total", labels, float64(binary.BigEndian.Uint64(raw)))
+		case collectdDerive:
+			samples.add(name+"_total", labels, float64(int64(binary.BigEndian.Uint64(raw))))
+		case collectdAbsolute:
+			// Absolute values are counts since the last, so they add up
+			current, _ := samples.value(name+"_total", labels)
+			samples.add(name+"_total", labels, current+float64(binary.BigEndian.Uint64(raw)))
+		default:
+			return fmt.Errorf("unknown value type %d", types[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// minCompressSize is the size from which resource responses are
+// compressed; smaller ones aren't worth it.
+const minCompressSize = 1024
+
+// Content codings of compressed resource responses, by preference.
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+// compressResponses compresses the responses of next with zstd or gzip when
+// the request accepts them, such as exports of months of history pulled
+// over a VPN. Responses under minCompressSize, and those of already
+// compressed content such as images and binaries, are sent as they are.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, status: http.StatusOK}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the coding of an Accept-Encoding header to
+// compress with, zstd over gzip at equal quality, or "" for none.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if coding != encodingZstd && coding != encodingGzip || q <= 0 {
+			continue
+		}
+		if q > bestQ || q == bestQ && coding == encodingZstd {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds a response back until it is known to be large
+// enough, and then compresses it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	// buf holds the response until it reaches minCompressSize
+	buf []byte
+	// enc compresses the rest once started, and plain passes it through
+	enc     io.WriteCloser
+	plain   bool
+	written bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if !cw.written {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	switch {
+	case cw.enc != nil:
+		return cw.enc.Write(p)
+	case cw.plain:
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) < minCompressSize {
+		return len(p), nil
+	}
+	if err := cw.start(true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// start sends the header, compressing what follows when compress is set
+// and the content isn't compressed already, and writes out what was held.
+func (cw *compressWriter) start(compress bool) error {
+	cw.written = true
+	header := cw.ResponseWriter.Header()
+	if compress && header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		var err error
+		if cw.encoding == encodingZstd {
+			cw.enc, err = zstd.NewWriter(cw.ResponseWriter, zstd.WithEncoderConcurrency(1))
+		} else {
+			cw.enc = gzip.NewWriter(cw.ResponseWriter)
+		}
+		if err != nil {
+			return err
+		}
+		cw.ResponseWriter.WriteHeader(cw.status)
+		_, err = cw.enc.Write(cw.buf)
+		cw.buf = nil
+		return err
+	}
+	cw.plain = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+	_, err := cw.ResponseWriter.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// close ends the response, sending small ones as they are.
+func (cw *compressWriter) close() {
+	if !cw.written {
+		cw.start(false)
+		return
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+	}
+}
+
+// compressible reports whether content of contentType is worth
+// compressing: text and JSON are, images, archives and binaries aren't,
+// and neither is content of no declared type.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" ||
+		strings.HasSuffix(mediaType, "+json") || mediaType == "application/xml" || mediaType == "image/svg+xml"
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeConntrack = "conntrack"
+
+const (
+	conntrackCountPath = "/proc/sys/net/netfilter/nf_conntrack_count"
+	conntrackMaxPath   = "/proc/sys/net/netfilter/nf_conntrack_max"
+)
+
+// Default utilization thresholds in percent.
+const (
+	defaultConntrackWarn     = 75
+	defaultConntrackCritical = 90
+)
+
+func init() {
+	registerQueryType(queryTypeConntrack, queryConntrack, conntrackQuery{})
+	registerConfiguredCheck(queryTypeConntrack, func(ds *testDataSource) bool { return len(ds.settings.SSH.AllHosts()) > 0 || ds.openwrt != nil })
+}
+
+type conntrackQuery struct {
+	Host string `json:"host"`
+	// Source is "ssh", "openwrt" or empty for every configured source.
+	Source          string  `json:"source"`
+	WarnPercent     float64 `json:"warnPercent"`
+	CriticalPercent float64 `json:"criticalPercent"`
+}
+
+// conntrackUsage is the connection tracking table usage of one machine.
+type conntrackUsage struct {
+	Source string
+	Count  int64
+	Max    int64
+}
+
+func (u conntrackUsage) utilization() float64 {
+	if u.Max == 0 {
+		return 0
+	}
+	return float64(u.Count) / float64(u.Max) * 100
+}
+
+// parseConntrack parses the count and max values from two lines of output.
+func parseConntrack(source, raw string) (conntrackUsage, error) {
+	fields := strings.Fields(raw)
+	if len(fields) != 2 {
+		return conntrackUsage{}, fmt.Errorf("expected conntrack count and max, got %q", raw)
+	}
+	count, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return conntrackUsage{}, fmt.Errorf("invalid conntrack count %q: %w", fields[0], err)
+	}
+	max, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return conntrackUsage{}, fmt.Errorf("invalid conntrack max %q: %w", fields[1], err)
+	}
+	return conntrackUsage{Source: source, Count: count, Max: max}, nil
+}
+
+func (ds *testDataSource) sshConntrackUsage(ctx context.Context, host string) (conntrackUsage, error) {
+	raw, err := ds.runRemoteCommand(ctx, host, "cat "+conntrackCountPath+" "+conntrackMaxPath)
+	if err != nil {
+		return conntrackUsage{}, fmt.Errorf("failed to read conntrack usage on %s: %w", host, err)
+	}
+	return parseConntrack(host, string(raw))
+}
+
+func (ds *testDataSource) openWrtConntrackUsage(ctx context.Context) (conntrackUsage, error) {
+	var values []string
+	for _, path := range []string{conntrackCountPath, conntrackMaxPath} {
+		raw, err := ds.openwrt.readFile(ctx, path)
+		if err != nil {
+			return conntrackUsage{}, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		values = append(values, raw)
+	}
+	return parseConntrack(ds.openwrt.host(), strings.Join(values, "\n"))
+}
+
+func queryConntrack(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q conntrackQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	var usages []conntrackUsage
+	if (q.Source == "" || q.Source == "ssh") && len(ds.settings.SSH.AllHosts()) > 0 {
+		hosts, err := ds.sshHosts(q.Host)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			u, err := ds.sshConntrackUsage(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			usages = append(usages, u)
+		}
+	}
+	if (q.Source == "" || q.Source == "openwrt") && ds.openwrt != nil {
+		u, err := ds.openWrtConntrackUsage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, u)
+	}
+	if len(usages) == 0 {
+		return nil, fmt.Errorf("no SSH host or OpenWrt router configured")
+	}
+
+	warn, critical := q.WarnPercent, q.CriticalPercent
+	if warn <= 0 {
+		warn = defaultConntrackWarn
+	}
+	if critical <= 0 {
+		critical = defaultConntrackCritical
+	}
+
+	now := time.Now()
+	frames := data.Frames{}
+	for _, u := range usages {
+		frames = append(frames, conntrackFrame(now, u, warn, critical))
+	}
+
+	return frames, nil
+}
+
+// conntrackFrame builds a single-row time series frame per source so alert
+// rules evaluate one dimension per router or host.
+func conntrackFrame(now time.Time, u conntrackUsage, warn, critical float64) *data.Frame {
+	labels := data.Labels{"source": u.Source}
+	return data.NewFrame(u.Source,
+		data.NewField("time", nil, []time.Time{now}),
+		data.NewField("utilization", labels, []float64{u.utilization()}).SetConfig(&data.FieldConfig{
+			Unit: "percent",
+			Min:  ptrConfFloat64(0),
+			Max:  ptrConfFloat64(100),
+			Thresholds: &data.ThresholdsConfig{
+				Mode: data.ThresholdsModeAbsolute,
+				Steps: []data.Threshold{
+					{Value: data.ConfFloat64(math.Inf(-1)), Color: "green"},
+					{Value: data.ConfFloat64(warn), Color: "orange"},
+					{Value: data.ConfFloat64(critical), Color: "red"},
+				},
+			},
+		}),
+		data.NewField("count", labels, []int64{u.Count}),
+		data.NewField("max", labels, []int64{u.Max}),
+	)
+}
+
+func ptrConfFloat64(v float64) *data.ConfFloat64 {
+	f := data.ConfFloat64(v)
+	return &f
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeCost = "cost"
+
+const (
+	costProviderOpenAI    = "openai"
+	costProviderAnthropic = "anthropic"
+	costProviderJSON      = "json"
+)
+
+// defaultCostURLs are the APIs of the providers whose URL is optional.
+var defaultCostURLs = map[string]string{
+	costProviderOpenAI:    "https://api.openai.com/v1",
+	costProviderAnthropic: "https://api.anthropic.com/v1",
+}
+
+// maxCostPages bounds the pages read from a billing API for a query, which a
+// year of daily buckets stays well within.
+const maxCostPages = 20
+
+func init() {
+	registerQueryType(queryTypeCost, queryCost, costQuery{})
+	registerConfiguredCheck(queryTypeCost, func(ds *testDataSource) bool { return len(ds.settings.Costs) > 0 })
+}
+
+type costQuery struct {
+	// Account selects a configured account by name; empty means all of them.
+	Account string `json:"account"`
+	// GroupBy "service" splits the spend of accounts by the providers' line
+	// items, such as a model or storage.
+	GroupBy string `json:"groupBy"`
+	// Usage is a query, such as a metric query of the size of the buckets
+	// backed up, whose daily average the spend is compared with.
+	Usage json.RawMessage `json:"usage"`
+}
+
+// costEntry is the spend of an account on a service over a day.
+type costEntry struct {
+	Account  string
+	Service  string
+	Currency string
+	Start    time.Time
+	Amount   float64
+}
+
+// jsonCosts is the format of the json provider.
+type jsonCosts struct {
+	Costs []struct {
+		// Time is the RFC 3339 start of the day, or of the period, the cost
+		// is for
+		Time     time.Time `json:"time"`
+		Amount   float64   `json:"amount"`
+		Currency string    `json:"currency"`
+		Service  string    `json:"service"`
+	} `json:"costs"`
+}
+
+// validateCostAccounts checks that accounts have unique names, a known
+// provider, and a URL where needed.
+func validateCostAccounts(accounts []models.CostAccount) error {
+	seen := map[string]bool{}
+	for _, a := range accounts {
+		switch {
+		case a.Name == "":
+			return fmt.Errorf("account of provider %q has no name", a.Provider)
+		case seen[a.Name]:
+			return fmt.Errorf("duplicate account name %q", a.Name)
+		}
+		seen[a.Name] = true
+		switch a.Provider {
+		case costProviderOpenAI, costProviderAnthropic:
+			if a.URL == "" {
+				continue
+			}
+		case costProviderJSON:
+			if a.URL == "" {
+				return fmt.Errorf("account %s has no URL", a.Name)
+			}
+		default:
+			return fmt.Errorf("account %s has unknown provider %q", a.Name, a.Provider)
+		}
+		if u, err := url.Parse(a.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("account %s has invalid URL %q", a.Name, a.URL)
+		}
+	}
+	return nil
+}
+
+// fetchCosts reads the daily spend of account over tr from its billing API.
+// Line items are only asked for when grouped by, as they multiply the
+// entries.
+func (ds *testDataSource) fetchCosts(ctx context.Context, account models.CostAccount, tr backend.TimeRange, byService bool) ([]costEntry, error) {
+	var token string
+	if ds.settings.Secrets != nil {
+		token = ds.settings.Secrets.CostTokens[account.Name]
+	}
+	base := account.URL
+	if base == "" {
+		base = defaultCostURLs[account.Provider]
+	}
+	switch account.Provider {
+	case costProviderOpenAI:
+		return ds.fetchOpenAICosts(ctx, account.Name, base, token, tr, byService)
+	case costProviderAnthropic:
+		return ds.fetchAnthropicCosts(ctx, account.Name, base, token, tr, byService)
+	}
+	return ds.fetchJSONCosts(ctx, account.Name, base, token, tr)
+}
+
+// fetchOpenAICosts reads the organization costs API, in daily buckets.
+func (ds *testDataSource) fetchOpenAICosts(ctx context.Context, account, base, token string, tr backend.TimeRange, byService bool) ([]costEntry, error) {
+	var page struct {
+		Data []struct {
+			StartTime int64 `json:"start_time"`
+			Results   []struct {
+				Amount struct {
+					Value    float64 `json:"value"`
+					Currency string  `json:"currency"`
+				} `json:"amount"`
+				LineItem *string `json:"line_item"`
+			} `json:"results"`
+		} `json:"data"`
+		HasMore  bool   `json:"has_more"`
+		NextPage string `json:"next_page"`
+	}
+	params := url.Values{
+		"start_time":   {strconv.FormatInt(tr.From.Unix(), 10)},
+		"end_time":     {strconv.FormatInt(tr.To.Unix(), 10)},
+		"bucket_width": {"1d"},
+		"limit":        {"180"},
+	}
+	if byService {
+		params.Set("group_by", "line_item")
+	}
+
+	var entries []costEntry
+	for i := 0; i < maxCostPages; i++ {
+		req, err := costRequest(ctx, base, "/organization/costs", params)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		page.Data, page.HasMore, page.NextPage = nil, false, ""
+		if err := ds.readCosts(req, &page); err != nil {
+			return nil, err
+		}
+		for _, bucket := range page.Data {
+			for _, r := range bucket.Results {
+				e := costEntry{Account: account, Currency: r.Amount.Currency, Start: time.Unix(bucket.StartTime, 0).UTC(), Amount: r.Amount.Value}
+				if r.LineItem != nil {
+					e.Service = *r.LineItem
+				}
+				entries = append(entries, e)
+			}
+		}
+		if !page.HasMore || page.NextPage == "" {
+			return entries, nil
+		}
+		params.Set("page", page.NextPage)
+	}
+	return entries, nil
+}
+
+// fetchAnthropicCosts reads the organization cost report, in daily
+// buckets. Its amounts are decimal strings in cents.
+func (ds *testDataSource) fetchAnthropicCosts(ctx context.Context, account, base, token string, tr backend.TimeRange, byService bool) ([]costEntry, error) {
+	var page struct {
+		Data []struct {
+			StartingAt time.Time `json:"starting_at"`
+			Results    []struct {
+				Amount      string  `json:"amount"`
+				Currency    string  `json:"currency"`
+				Description *string `json:"description"`
+			} `json:"results"`
+		} `json:"data"`
+		HasMore  bool   `json:"has_more"`
+		NextPage string `json:"next_page"`
+	}
+	params := url.Values{
+		"starting_at":  {tr.From.UTC().Format(time.RFC3339)},
+		"ending_at":    {tr.To.UTC().Format(time.RFC3339)},
+		"bucket_width": {"1d"},
+	}
+	if byService {
+		params.Set("group_by[]", "description")
+	}
+
+	var entries []costEntry
+	for i := 0; i < maxCostPages; i++ {
+		req, err := costRequest(ctx, base, "/organizations/cost_report", params)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Api-Key", token)
+		req.Header.Set("Anthropic-Version", "2023-06-01")
+		page.Data, page.HasMore, page.NextPage = nil, false, ""
+		if err := ds.readCosts(req, &page); err != nil {
+			return nil, err
+		}
+		for _, bucket := range page.Data {
+			for _, r := range bucket.Results {
+				cents, err := strconv.ParseFloat(r.Amount, 64)
+				if err != nil {
+					return nil, withCode(codeParseError, fmt.Errorf("invalid cost amount %q", r.Amount))
+				}
+				e := costEntry{Account: account, Currency: r.Currency, Start: bucket.StartingAt.UTC(), Amount: cents / 100}
+				if r.Description != nil {
+					e.Service = *r.Description
+				}
+				entries = append(entries, e)
+			}
+		}
+		if !page.HasMore || page.NextPage == "" {
+			return entries, nil
+		}
+		params.Set("page", page.NextPage)
+	}
+	return entries, nil
+}
+
+// fetchJSONCosts reads costs in the json provider's format from base, given
+// the time range as from and to RFC 3339 parameters.
+func (ds *testDataSource) fetchJSONCosts(ctx context.Context, account, base, token string, tr backend.TimeRange) ([]costEntry, error) {
+	params := url.Values{
+		"from": {tr.From.UTC().Format(time.RFC3339)},
+		"to":   {tr.To.UTC().Format(time.RFC3339)},
+	}
+	req, err := costRequest(ctx, base, "", params)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	var costs jsonCosts
+	if err := ds.readCosts(req, &costs); err != nil {
+		return nil, err
+	}
+	entries := make([]costEntry, 0, len(costs.Costs))
+	for _, c := range costs.Costs {
+		entries = append(entries, costEntry{Account: account, Service: c.Service, Currency: c.Currency, Start: c.Time.UTC(), Amount: c.Amount})
+	}
+	return entries, nil
+}
+
+func costRequest(ctx context.Context, base, path string, params url.Values) (*http.Request, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", base, err)
+	}
+	if path != "" {
+		u = u.JoinPath(path)
+	}
+	query := u.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %s: %w", u, err)
+	}
+	return req, nil
+}
+
+// readCosts sends req and decodes its JSON response into v.
+func (ds *testDataSource) readCosts(req *http.Request, v any) error {
+	resp, err := send(ds.httpClient, req)
+	body, err := readBody(resp, req.URL.Redacted(), err, ds.maxResponseBytes())
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return withCode(codeParseError, fmt.Errorf("invalid response from %s: %w", req.URL.Redacted(), err))
+	}
+	return nil
+}
+
+// currencyUnit is the Grafana unit of amounts in currency, an ISO 4217
+// code. Currencies Grafana has no unit for are left without one.
+func currencyUnit(currency string) string {
+	switch c := strings.ToUpper(currency); c {
+	case "USD", "EUR", "GBP", "JPY", "CHF", "CAD", "AUD", "SEK", "NOK", "DKK", "PLN", "CZK", "INR", "BRL", "CNY":
+		return "currency" + c
+	}
+	return ""
+}
+
+// costSeries groups entries into a daily time series per account, service
+// and currency.
+func costSeries(entries []costEntry) data.Frames {
+	type key struct{ account, service, currency string }
+	byKey := map[key]map[time.Time]float64{}
+	for _, e := range entries {
+		k := key{e.Account, e.Service, strings.ToUpper(e.Currency)}
+		if byKey[k] == nil {
+			byKey[k] = map[time.Time]float64{}
+		}
+		byKey[k][e.Start] += e.Amount
+	}
+	keys := make([]key, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.account != b.account {
+			return a.account < b.account
+		}
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		return a.currency < b.currency
+	})
+
+	frames := make(data.Frames, 0, len(keys))
+	for _, k := range keys {
+		days := make([]time.Time, 0, len(byKey[k]))
+		for day := range byKey[k] {
+			days = append(days, day)
+		}
+		sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+		amounts := make([]float64, len(days))
+		for i, day := range days {
+			amounts[i] = byKey[k][day]
+		}
+		labels := data.Labels{"account": k.account}
+		if k.service != "" {
+			labels["service"] = k.service
+		}
+		if k.currency != "" {
+			labels["currency"] = k.currency
+		}
+		frame := data.NewFrame("spend",
+			data.NewField("time", nil, days),
+			data.NewField("spend", labels, amounts).SetConfig(&data.FieldConfig{Unit: currencyUnit(k.currency)}),
+		)
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// dailyUsage sums the series of frames and averages the sum over each day,
+// by UTC day as billing APIs bucket them.
+func dailyUsage(frames data.Frames) (map[time.Time]float64, string, error) {
+	sums := map[time.Time]float64{}
+	counts := map[time.Time]map[time.Time]bool{}
+	var unit string
+	for _, frame := range frames {
+		timeIdx := -1
+		for i, field := range frame.Fields {
+			if field.Type().Time() {
+				timeIdx = i
+				break
+			}
+		}
+		if timeIdx < 0 {
+			continue
+		}
+		for _, field := range frame.Fields {
+			if !field.Type().Numeric() {
+				continue
+			}
+			if unit == "" && field.Config != nil {
+				unit = field.Config.Unit
+			}
+			for row := 0; row < field.Len(); row++ {
+				t, ok := frame.Fields[timeIdx].ConcreteAt(row)
+				if !ok {
+					continue
+				}
+				v, err := field.NullableFloatAt(row)
+				if err != nil {
+					return nil, "", err
+				}
+				if v == nil || math.IsNaN(*v) {
+					continue
+				}
+				ts := t.(time.Time).UTC()
+				day := ts.Truncate(24 * time.Hour)
+				sums[day] += *v
+				if counts[day] == nil {
+					counts[day] = map[time.Time]bool{}
+				}
+				counts[day][ts] = true
+			}
+		}
+	}
+	// Sums of the series at each sample time, averaged over the sample
+	// times of the day
+	for day := range sums {
+		sums[day] /= float64(len(counts[day]))
+	}
+	return sums, unit, nil
+}
+
+// costPerUsage compares the total daily spend of entries with the daily
+// usage, in a table of the days with both.
+func costPerUsage(entries []costEntry, usage map[time.Time]float64, usageUnit string) (*data.Frame, error) {
+	spend := map[time.Time]float64{}
+	var currency string
+	for _, e := range entries {
+		c := strings.ToUpper(e.Currency)
+		if currency == "" {
+			currency = c
+		} else if c != currency {
+			return nil, fmt.Errorf("cannot compare the usage with spend in both %s and %s, select one account", currency, c)
+		}
+		spend[e.Start.Truncate(24*time.Hour)] += e.Amount
+	}
+	days := make([]time.Time, 0, len(spend))
+	for day := range spend {
+		if _, ok := usage[day]; ok {
+			days = append(days, day)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	unit := currencyUnit(currency)
+	frame := data.NewFrame("cost_per_usage",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("spend", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: unit}),
+		data.NewField("usage", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: usageUnit}),
+		data.NewField("spend_per_usage", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: unit}),
+	)
+	for _, day := range days {
+		var perUsage *float64
+		if u := usage[day]; u != 0 {
+			v := spend[day] / u
+			perUsage = &v
+		}
+		frame.AppendRow(day, spend[day], usage[day], perUsage)
+	}
+	return frame, nil
+}
+
+func queryCost(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q costQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if len(ds.settings.Costs) == 0 {
+		return nil, fmt.Errorf("no cost accounts configured")
+	}
+	if q.GroupBy != "" && q.GroupBy != "service" {
+		return nil, fmt.Errorf("invalid groupBy %q, expected service", q.GroupBy)
+	}
+
+	// Billing APIs bucket by UTC day, so the range is widened to whole days
+	tr := backend.TimeRange{
+		From: query.TimeRange.From.UTC().Truncate(24 * time.Hour),
+		To:   query.TimeRange.To.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour),
+	}
+	var entries []costEntry
+	found := false
+	for _, account := range ds.settings.Costs {
+		if q.Account != "" && account.Name != q.Account {
+			continue
+		}
+		found = true
+		accountEntries, err := ds.fetchCosts(ctx, account, tr, q.GroupBy == "service")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", account.Name, err)
+		}
+		entries = append(entries, accountEntries...)
+	}
+	if !found {
+		return nil, fmt.Errorf("cost account %q is not configured", q.Account)
+	}
+
+	if len(q.Usage) == 0 {
+		return costSeries(entries), nil
+	}
+	usageFrames, err := ds.runInnerQuery(ctx, query, q.Usage)
+	if err != nil {
+		return nil, fmt.Errorf("usage query: %w", err)
+	}
+	usage, unit, err := dailyUsage(usageFrames)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := costPerUsage(entries, usage, unit)
+	if err != nil {
+		return nil, err
+	}
+	return data.Frames{frame}, nil
+}
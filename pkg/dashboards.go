@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pluginID is the ID of the plugin, which dashboards reference data sources
+// by.
+const pluginID = "homelab-kirill-datasource"
+
+// Layout of generated dashboards, on Grafana's grid of 24 columns.
+const (
+	dashboardWidth       = 24
+	dashboardPanelHeight = 8
+	// dashboardDevicePanels is the most panels a device row has
+	dashboardDevicePanels = 4
+)
+
+// devicePanel is a panel of a device's row, added when the device exposes
+// Metric.
+type devicePanel struct {
+	Title    string
+	Metric   string
+	Function string
+	Unit     string
+}
+
+// devicePanels are the panels of device rows, in order of preference:
+// those of node_exporter, SNMP interfaces and UPSes.
+var devicePanels = []devicePanel{
+	{Title: "CPU", Metric: "node_cpu_seconds_total", Function: "rate", Unit: "percentunit"},
+	{Title: "Memory available", Metric: "node_memory_MemAvailable_bytes", Unit: "bytes"},
+	{Title: "Filesystem space available", Metric: "node_filesystem_avail_bytes", Unit: "bytes"},
+	{Title: "Network received", Metric: "node_network_receive_bytes_total", Function: "rate", Unit: "Bps"},
+	{Title: "Temperatures", Metric: "node_hwmon_temp_celsius", Unit: "celsius"},
+	{Title: "Interface traffic in", Metric: "ifHCInOctets", Function: "rate", Unit: "Bps"},
+	{Title: "Interface traffic out", Metric: "ifHCOutOctets", Function: "rate", Unit: "Bps"},
+	{Title: "UPS load", Metric: "nut_load", Unit: "percentunit"},
+	{Title: "UPS battery charge", Metric: "nut_battery_charge", Unit: "percentunit"},
+}
+
+// dashboard is the JSON model of a Grafana dashboard, as far as generated
+// dashboards use it.
+type dashboard struct {
+	Title         string           `json:"title"`
+	Tags          []string         `json:"tags"`
+	Timezone      string           `json:"timezone"`
+	SchemaVersion int              `json:"schemaVersion"`
+	Time          dashboardTime    `json:"time"`
+	Refresh       string           `json:"refresh"`
+	Panels        []dashboardPanel `json:"panels"`
+}
+
+type dashboardTime struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type dashboardPanel struct {
+	ID          int                 `json:"id"`
+	Type        string              `json:"type"`
+	Title       string              `json:"title"`
+	GridPos     dashboardGridPos    `json:"gridPos"`
+	Collapsed   *bool               `json:"collapsed,omitempty"`
+	Panels      []dashboardPanel    `json:"panels,omitempty"`
+	Datasource  *datasourceRef      `json:"datasource,omitempty"`
+	Targets     []map[string]any    `json:"targets,omitempty"`
+	FieldConfig *dashboardFieldConf `json:"fieldConfig,omitempty"`
+	Options     map[string]any      `json:"options,omitempty"`
+}
+
+type dashboardGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type datasourceRef struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type dashboardFieldConf struct {
+	Defaults  map[string]any `json:"defaults"`
+	Overrides []any          `json:"overrides"`
+}
+
+// dashboardBuilder lays panels out in rows, left to right.
+type dashboardBuilder struct {
+	ds     *datasourceRef
+	panels []dashboardPanel
+	nextID int
+	// y is the top of the row being filled, and x where its next panel goes
+	y, x int
+}
+
+func (b *dashboardBuilder) row(title string) {
+	if b.x > 0 {
+		b.y += dashboardPanelHeight
+		b.x = 0
+	}
+	b.nextID++
+	collapsed := false
+	b.panels = append(b.panels, dashboardPanel{
+		ID: b.nextID, Type: "row", Title: title, Collapsed: &collapsed, Panels: []dashboardPanel{},
+		GridPos: dashboardGridPos{H: 1, W: dashboardWidth, Y: b.y},
+	})
+	b.y++
+}
+
+// panel adds a panel of width w to the current row, wrapping to a new line
+// when it doesn't fit. Queries get their refIds and the data source.
+func (b *dashboardBuilder) panel(kind, title string, w int, unit string, options map[string]any, queries ...map[string]any) {
+	if b.x+w > dashboardWidth {
+		b.y += dashboardPanelHeight
+		b.x = 0
+	}
+	b.nextID++
+	p := dashboardPanel{
+		ID: b.nextID, Type: kind, Title: title, Options: options,
+		GridPos: dashboardGridPos{H: dashboardPanelHeight, W: w, X: b.x, Y: b.y},
+	}
+	if len(queries) > 0 {
+		p.Datasource = b.ds
+		for i, q := range queries {
+			q["refId"] = string(rune('A' + i))
+			q["datasource"] = b.ds
+		}
+		p.Targets = queries
+		defaults := map[string]any{}
+		if unit != "" {
+			defaults["unit"] = unit
+		}
+		p.FieldConfig = &dashboardFieldConf{Defaults: defaults, Overrides: []any{}}
+	}
+	b.panels = append(b.panels, p)
+	b.x += w
+}
+
+// groupDashboard generates a dashboard for the targets whose label has
+// value: an overview row with their health, capacity and alerts, and a row
+// per target with the panels of devicePanels for the metrics it exposes, or
+// of its first gauges.
+func (ds *testDataSource) groupDashboard(label, value string) (dashboard, error) {
+	var members []*scrapeTarget
+	for _, t := range ds.targets {
+		if t.Labels[label] == value {
+			members = append(members, t)
+		}
+	}
+	if len(members) == 0 {
+		return dashboard{}, fmt.Errorf("no target has %s=%q", label, value)
+	}
+	names := make([]string, len(members))
+	quoted := make([]string, len(members))
+	for i, t := range members {
+		names[i] = t.Name
+		quoted[i] = regexp.QuoteMeta(t.Name)
+	}
+	// Targets of queries taking a regex, and of alert label filters
+	pattern := strings.Join(quoted, "|")
+
+	b := &dashboardBuilder{ds: &datasourceRef{Type: pluginID, UID: ds.uid}}
+	b.row("Overview")
+	var health []map[string]any
+	for _, name := range names {
+		health = append(health, map[string]any{"queryType": queryTypeHealthHistory, "target": name})
+	}
+	b.panel("state-timeline", "Health", 12, "", map[string]any{"showValue": "never"}, health...)
+	b.panel("alertlist", "Alerts", 12, "", map[string]any{
+		"viewMode":                 "list",
+		"groupMode":                "default",
+		"maxItems":                 20,
+		"alertInstanceLabelFilter": fmt.Sprintf(`{target=~%s}`, strconv.Quote(pattern)),
+		"stateFilter":              map[string]bool{"firing": true, "pending": true},
+	})
+	b.panel("table", "Capacity", dashboardWidth, "", nil, map[string]any{"queryType": queryTypeCapacity, "target": pattern})
+
+	for _, t := range members {
+		b.row(t.Name)
+		index := t.discovery()
+		if index == nil {
+			index = ds.discoveryStore.get(t.Name)
+		}
+		var exposed []string
+		if index != nil {
+			exposed = index.Names
+		}
+		added := 0
+		width := dashboardWidth / 2
+		for _, p := range devicePanels {
+			if added == dashboardDevicePanels {
+				break
+			}
+			if !containsString(exposed, p.Metric) {
+				continue
+			}
+			q := map[string]any{"metric": p.Metric, "target": t.Name}
+			if p.Function != "" {
+				q["function"] = p.Function
+			}
+			b.panel("timeseries", p.Title, width, p.Unit, nil, q)
+			added++
+		}
+		if added > 0 {
+			continue
+		}
+		// Devices none of the panels fit, such as sensors, get their gauges
+		for _, name := range exposed {
+			if added == dashboardDevicePanels {
+				break
+			}
+			if strings.HasSuffix(name, "_total") || strings.HasSuffix(name, "_bucket") ||
+				strings.HasSuffix(name, "_count") || strings.HasSuffix(name, "_sum") || strings.HasSuffix(name, "_created") {
+				continue
+			}
+			b.panel("timeseries", name, width, ds.units.unit(name, t.declaredUnits()), nil, map[string]any{"metric": name, "target": t.Name})
+			added++
+		}
+	}
+
+	return dashboard{
+		Title:         fmt.Sprintf("%s %s", label, value),
+		Tags:          []string{"homelab", label + ":" + value},
+		Timezone:      "browser",
+		SchemaVersion: 39,
+		Time:          dashboardTime{From: "now-6h", To: "now"},
+		Refresh:       "1m",
+		Panels:        b.panels,
+	}, nil
+}
+
+// handleGroupDashboard generates the dashboard of the targets whose label
+// has the value of the path, ready to import.
+func (ds *testDataSource) handleGroupDashboard(w http.ResponseWriter, r *http.Request) {
+	if ds.configErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid configuration: %w", ds.configErr))
+		return
+	}
+	d, err := ds.groupDashboard(r.PathValue("label"), r.PathValue("value"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
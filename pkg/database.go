@@ -0,0 +1,412 @@
+//go:build !nodatabase
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeDatabase = "database"
+
+// Supported database kinds.
+const (
+	databaseKindPostgres = "postgres"
+	databaseKindMySQL    = "mysql"
+	databaseKindRedis    = "redis"
+)
+
+const defaultSlowQuerySeconds = 5
+
+func init() {
+	registerQueryType(queryTypeDatabase, queryDatabase, databaseQuery{})
+	registerConfiguredCheck(queryTypeDatabase, func(ds *testDataSource) bool { return len(ds.settings.Databases) > 0 })
+}
+
+type databaseQuery struct {
+	// Database selects a configured database by name; empty means all of them.
+	Database string `json:"database"`
+}
+
+// databaseHealth is the normalized health snapshot of one database.
+type databaseHealth struct {
+	Name           string
+	Kind           string
+	Connections    float64
+	MaxConnections *float64
+	ReplicationLag *float64
+	CacheHitRatio  *float64
+	SlowQueries    float64
+}
+
+// sqlPools keeps one connection pool per configured SQL database for the
+// lifetime of the instance.
+type sqlPools struct {
+	mu    sync.Mutex
+	pools map[string]*sql.DB
+
+	// egress, when set, checks the servers connected to, which for MySQL
+	// means dialing through the network registered as mysqlNet
+	egress   *egressPolicy
+	mysqlNet string
+}
+
+func newSQLPools(egress *egressPolicy) *sqlPools {
+	p := &sqlPools{pools: map[string]*sql.DB{}, egress: egress}
+	if egress != nil {
+		p.mysqlNet = fmt.Sprintf("egress-%p", p)
+		mysql.RegisterDialContext(p.mysqlNet, func(ctx context.Context, addr string) (net.Conn, error) {
+			return egress.dialContext(ctx, "tcp", addr)
+		})
+	}
+	return p
+}
+
+func (p *sqlPools) get(name, driver, dsn string) (*sql.DB, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if db, ok := p.pools[name]; ok {
+		return db, nil
+	}
+	db, err := p.open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	db.SetMaxOpenConns(2)
+	p.pools[name] = db
+	return db, nil
+}
+
+// open opens a pool whose connections are checked by the egress policy, if
+// there is one.
+func (p *sqlPools) open(driver, dsn string) (*sql.DB, error) {
+	if p.egress == nil {
+		return sql.Open(driver, dsn)
+	}
+	switch driver {
+	case "postgres":
+		connector, err := pq.NewConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		connector.Dialer(egressSQLDialer{p.egress})
+		return sql.OpenDB(connector), nil
+	case "mysql":
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Net == "tcp" {
+			cfg.Net = p.mysqlNet
+		}
+		connector, err := mysql.NewConnector(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return sql.OpenDB(connector), nil
+	}
+	return sql.Open(driver, dsn)
+}
+
+// egressSQLDialer dials PostgreSQL servers the egress policy allows.
+type egressSQLDialer struct {
+	egress *egressPolicy
+}
+
+func (d egressSQLDialer) Dial(network, address string) (net.Conn, error) {
+	return d.egress.dialContext(context.Background(), network, address)
+}
+
+func (d egressSQLDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.egress.dialContext(ctx, network, address)
+}
+
+func (d egressSQLDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.egress.dialContext(ctx, network, address)
+}
+
+func (p *sqlPools) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name, db := range p.pools {
+		if err := db.Close(); err != nil {
+			backend.Logger.Warn("Failed to close database pool", "database", name, "error", err)
+		}
+	}
+	p.pools = map[string]*sql.DB{}
+	if p.mysqlNet != "" {
+		mysql.DeregisterDialContext(p.mysqlNet)
+	}
+}
+
+// databaseDSN returns the connection string of a database from secure settings.
+func (ds *testDataSource) databaseDSN(name string) (string, error) {
+	if ds.settings.Secrets == nil || ds.settings.Secrets.DatabaseDSNs[name] == "" {
+		return "", fmt.Errorf("no connection string configured for database %s", name)
+	}
+	return ds.settings.Secrets.DatabaseDSNs[name], nil
+}
+
+func (ds *testDataSource) databaseHealth(ctx context.Context, cfg models.DatabaseSettings) (databaseHealth, error) {
+	dsn, err := ds.databaseDSN(cfg.Name)
+	if err != nil {
+		return databaseHealth{}, err
+	}
+
+	slow := cfg.SlowQuerySeconds
+	if slow <= 0 {
+		slow = defaultSlowQuerySeconds
+	}
+
+	switch cfg.Kind {
+	case databaseKindPostgres:
+		db, err := ds.sqlPools.get(cfg.Name, "postgres", dsn)
+		if err != nil {
+			return databaseHealth{}, err
+		}
+		return postgresHealth(ctx, cfg.Name, db, slow)
+	case databaseKindMySQL:
+		db, err := ds.sqlPools.get(cfg.Name, "mysql", dsn)
+		if err != nil {
+			return databaseHealth{}, err
+		}
+		return mysqlHealth(ctx, cfg.Name, db)
+	case databaseKindRedis:
+		return redisHealth(ctx, cfg.Name, dsn, ds.egress)
+	}
+
+	return databaseHealth{}, fmt.Errorf("unknown database kind %q", cfg.Kind)
+}
+
+func postgresHealth(ctx context.Context, name string, db *sql.DB, slowSeconds float64) (databaseHealth, error) {
+	h := databaseHealth{Name: name, Kind: databaseKindPostgres}
+
+	var maxConns float64
+	var lag, hitRatio sql.NullFloat64
+	err := db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT count(*) FROM pg_stat_activity),
+			current_setting('max_connections')::float,
+			CASE WHEN pg_is_in_recovery()
+				THEN EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())
+				ELSE 0 END,
+			(SELECT sum(blks_hit) / nullif(sum(blks_hit) + sum(blks_read), 0) FROM pg_stat_database),
+			(SELECT count(*) FROM pg_stat_activity
+				WHERE state = 'active' AND now() - query_start > make_interval(secs => $1))`,
+		slowSeconds,
+	).Scan(&h.Connections, &maxConns, &lag, &hitRatio, &h.SlowQueries)
+	if err != nil {
+		return h, fmt.Errorf("postgres health query failed: %w", err)
+	}
+
+	h.MaxConnections = &maxConns
+	if lag.Valid {
+		h.ReplicationLag = &lag.Float64
+	}
+	if hitRatio.Valid {
+		ratio := hitRatio.Float64 * 100
+		h.CacheHitRatio = &ratio
+	}
+
+	return h, nil
+}
+
+// queryStringMap collects two-column key/value rows such as SHOW STATUS output.
+func queryStringMap(ctx context.Context, db *sql.DB, query string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := map[string]string{}
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		values[k] = v
+	}
+	return values, rows.Err()
+}
+
+// queryFirstRow returns the first row of a query with dynamic columns, or nil
+// if it returned no rows.
+func queryFirstRow(ctx context.Context, db *sql.DB, query string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	raw := make([]sql.RawBytes, len(cols))
+	dest := make([]any, len(cols))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	row := map[string]string{}
+	for i, col := range cols {
+		row[col] = string(raw[i])
+	}
+	return row, nil
+}
+
+func mysqlHealth(ctx context.Context, name string, db *sql.DB) (databaseHealth, error) {
+	h := databaseHealth{Name: name, Kind: databaseKindMySQL}
+
+	status, err := queryStringMap(ctx, db, "SHOW GLOBAL STATUS")
+	if err != nil {
+		return h, fmt.Errorf("mysql status query failed: %w", err)
+	}
+	variables, err := queryStringMap(ctx, db, "SHOW GLOBAL VARIABLES LIKE 'max_connections'")
+	if err != nil {
+		return h, fmt.Errorf("mysql variables query failed: %w", err)
+	}
+
+	if v := parseFloatPtr(status["Threads_connected"]); v != nil {
+		h.Connections = *v
+	}
+	if v := parseFloatPtr(status["Slow_queries"]); v != nil {
+		h.SlowQueries = *v
+	}
+	h.MaxConnections = parseFloatPtr(variables["max_connections"])
+
+	requests := parseFloatPtr(status["Innodb_buffer_pool_read_requests"])
+	reads := parseFloatPtr(status["Innodb_buffer_pool_reads"])
+	if requests != nil && reads != nil && *requests > 0 {
+		ratio := (1 - *reads / *requests) * 100
+		h.CacheHitRatio = &ratio
+	}
+
+	// SHOW REPLICA STATUS replaced SHOW SLAVE STATUS in MySQL 8.0.22
+	replica, err := queryFirstRow(ctx, db, "SHOW REPLICA STATUS")
+	if err != nil {
+		replica, err = queryFirstRow(ctx, db, "SHOW SLAVE STATUS")
+	}
+	if err != nil {
+		backend.Logger.Debug("Could not read MySQL replication status", "database", name, "error", err)
+	} else if replica != nil {
+		if lag := parseFloatPtr(replica["Seconds_Behind_Source"]); lag != nil {
+			h.ReplicationLag = lag
+		} else {
+			h.ReplicationLag = parseFloatPtr(replica["Seconds_Behind_Master"])
+		}
+	} else {
+		zero := 0.0
+		h.ReplicationLag = &zero
+	}
+
+	return h, nil
+}
+
+func redisHealth(ctx context.Context, name, dsn string, egress *egressPolicy) (databaseHealth, error) {
+	h := databaseHealth{Name: name, Kind: databaseKindRedis}
+
+	conn, err := dialRedis(ctx, dsn, egress)
+	if err != nil {
+		return h, err
+	}
+	defer conn.Close()
+
+	raw, err := conn.do("INFO")
+	if err != nil {
+		return h, fmt.Errorf("redis INFO failed: %w", err)
+	}
+	info := parseRedisInfo(raw)
+
+	if v := parseFloatPtr(info["connected_clients"]); v != nil {
+		h.Connections = *v
+	}
+	h.MaxConnections = parseFloatPtr(info["maxclients"])
+
+	hits, misses := parseFloatPtr(info["keyspace_hits"]), parseFloatPtr(info["keyspace_misses"])
+	if hits != nil && misses != nil && *hits+*misses > 0 {
+		ratio := *hits / (*hits + *misses) * 100
+		h.CacheHitRatio = &ratio
+	}
+
+	if info["role"] == "slave" {
+		h.ReplicationLag = parseFloatPtr(info["master_last_io_seconds_ago"])
+	} else {
+		zero := 0.0
+		h.ReplicationLag = &zero
+	}
+
+	slowlog, err := conn.do("SLOWLOG", "LEN")
+	if err != nil {
+		return h, fmt.Errorf("redis SLOWLOG LEN failed: %w", err)
+	}
+	if v := parseFloatPtr(slowlog); v != nil {
+		h.SlowQueries = *v
+	}
+
+	return h, nil
+}
+
+func queryDatabase(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q databaseQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	if len(ds.settings.Databases) == 0 {
+		return nil, fmt.Errorf("no databases configured")
+	}
+
+	frame := data.NewFrame("database",
+		data.NewField("database", nil, []string{}),
+		data.NewField("kind", nil, []string{}),
+		data.NewField("connections", nil, []float64{}),
+		data.NewField("max_connections", nil, []*float64{}),
+		data.NewField("replication_lag", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("cache_hit_ratio", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("slow_queries", nil, []float64{}),
+	)
+
+	found := false
+	for _, cfg := range ds.settings.Databases {
+		if q.Database != "" && cfg.Name != q.Database {
+			continue
+		}
+		found = true
+
+		h, err := ds.databaseHealth(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.Name, err)
+		}
+		frame.AppendRow(h.Name, h.Kind, h.Connections, h.MaxConnections, h.ReplicationLag, h.CacheHitRatio, h.SlowQueries)
+	}
+	if !found {
+		return nil, fmt.Errorf("database %q is not configured", q.Database)
+	}
+
+	return data.Frames{frame}, nil
+}
@@ -0,0 +1,11 @@
+//go:build nodatabase
+
+package main
+
+// sqlPools stands in for the database integration's connection pools when it
+// is built with the nodatabase tag.
+type sqlPools struct{}
+
+func newSQLPools(*egressPolicy) *sqlPools { return &sqlPools{} }
+
+func (p *sqlPools) Close() {}
@@ -2,23 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
+	"os"
 	"strings"
 	"sync"
-	"io"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/experimental/concurrent"
 	"github.com/kirillyesikov/homelab-plugin/pkg/models"
 )
 
@@ -26,11 +33,168 @@ type testDataSource struct {
 	httpClient *http.Client
 	backend.CallResourceHandler
 	settings *models.PluginSettings
+	wifi     *wifiTracker
+	openwrt  *openWrtClient
+	publicIP *publicIPTracker
+	proxies  *proxyTracker
+	slos     *sloTracker
+	sqlPools *sqlPools
+	// brokerRates turns broker message counters into rates
+	brokerRates *counterRates
+	probes      *probeTracker
+	health      *healthHistory
+	baseline    *baselineStore
+	faults      *faultInjector
+	// confirms are the confirm tokens of dry runs of destructive operations
+	confirms    *confirmTokens
+	slowQueries *slowQueryLog
+	usage       *usageTracker
+	streams     *streamRegistry
+	traceroutes *tracerouteTracker
+	hwEvents    *hardwareEventLog
+	batteries   *batteryTable
+	duplicates  duplicatePolicy
+	personal    personalData
+	units       unitInference
+	macros      map[string]string
+	// savedQueries and pings are shared by the instances of the data source
+	savedQueries *savedQueryLibrary
+	pings        *pingLog
+	pingChecks   map[string]pingCheck
+	carbon       *carbonCache
+	// schedule tracks the runs of the background jobs
+	schedule *jobSchedule
+	version  string
+	// operations are the long-running operations started by resource calls
+	operations *operationTracker
+	// updates is set when update checks are enabled
+	updates *updateChecker
+	// agentReleases is set when agent binaries are published
+	agentReleases *agentReleases
+	webhooks      []*queryWebhook
+	// alerts is set when alerts are forwarded to an Alertmanager
+	alerts *alertForwarder
+	// alertLog keeps the alerts Alertmanager notifies the plugin of
+	alertLog *alertLog
+	// maintenance is set when maintenance windows are configured
+	maintenance *maintenance
+	// transactions are the synthetic transactions, whose results
+	// transactionResults keeps
+	transactions       []*transaction
+	transactionResults *transactionTracker
+	// browser is set when browser checks are configured
+	browser *browserChecker
+	// bufferbloat is set when a bufferbloat test is configured
+	bufferbloat *bufferbloatTest
+	// iperf is set when iperf3 tests between SSH hosts are configured
+	iperf *iperfTests
+	// fio is set when fio benchmarks are configured
+	fio *fioBenchmarks
+	// powerSchedules suspend and wake SSH hosts
+	powerSchedules []*powerSchedule
+	// idle is set when tracking idle services is enabled
+	idle *idleTracker
+	// statusPage is set when the status page has a token
+	statusPage *statusPage
+	// kiosk compiles the summary of kiosk displays
+	kiosk *kiosk
+	// digest is set when the digest is enabled
+	digest *digest
+	// probeClients are the clients of dual-stack probes, by IP family
+	probeClients map[string]*http.Client
+	// smart is set when S.M.A.R.T. failure prediction is enabled
+	smart *smartTracker
+	// climate is set when climate aggregation is enabled
+	climate *climateAggregator
+	// netSamples are the network counters of the SSH hosts read by queries
+	netSamples *netSampleLog
+	// stateFiles is set when a state directory is configured
+	stateFiles *stateFiles
+
+	// uid identifies the instance, and namespaces its Grafana Live channels
+	uid string
+
+	// egress restricts the hosts connected to; nil allows all
+	egress *egressPolicy
+	// tr translates user-facing messages into the configured locale
+	tr localizer
+
+	// kubernetes is set when the Kubernetes integration is enabled
+	kubernetes *kubernetesClient
+
+	// discoveryStore is set when a state directory is configured
+	discoveryStore *discoveryStore
+	// wsDialer connects to WebSocket sources, and grpcConns to gRPC services
+	wsDialer  *websocket.Dialer
+	grpcConns *grpcConns
+	// scripts are the scripted collectors, by name
+	scripts map[string]*scriptCollector
+	// audit records configuration changes, shared with the other instances
+	// of the data source
+	audit *auditLog
+
+	// targets are the metrics endpoints to scrape; configErr is set instead
+	// when they are misconfigured, and reported by CheckHealth and QueryData.
+	targets   []*scrapeTarget
+	configErr error
+	cacheTTL  time.Duration
+
+	// pipelines are the pipeline presets, by name
+	pipelines map[string][]pipelineStage
+
+	// stop cancels background jobs started for this instance, and jobs
+	// tracks them until they return
+	stop        context.CancelFunc
+	jobs        sync.WaitGroup
+	disposeOnce sync.Once
+	// drain stops the scrapers after their scrape in flight, and scrapers
+	// tracks them until they return
+	drain    chan struct{}
+	scrapers sync.WaitGroup
+
+	// clientOpts built httpClient, and secretHashes fingerprint the secure
+	// settings, to tell which changed when credentials rotate
+	clientOpts   httpclient.Options
+	secretHashes map[string][sha256.Size]byte
 }
 
 type Query struct {
+	// Source is "metrics" (default) for the scrape targets or "kubernetes"
+	// for a kubernetesQuery
+	Source string `json:"source"`
 	Metric string `json:"metric"`
-} 
+	// Target names the scrape target; empty means the first one, "*" all and
+	// a regex the targets whose names it matches
+	Target string `json:"target"`
+	// TargetLabels keeps only targets with these label values, or values
+	// matching them as regexes, out of all targets when Target is empty
+	TargetLabels map[string]string `json:"targetLabels"`
+	// Labels keeps only series with these exact label values
+	Labels map[string]string `json:"labels"`
+	// MetricRegex matches the whole series name, like PromQL's __name__=~
+	MetricRegex string `json:"metricRegex"`
+	// Stream makes the panel subscribe to live samples pushed every
+	// StreamIntervalSeconds instead of polling
+	Stream                bool `json:"stream"`
+	StreamIntervalSeconds int  `json:"streamIntervalSeconds"`
+	// StreamDeltas pushes only the values that changed since the last push,
+	// with a keyframe of all values every StreamKeyframeSeconds, for
+	// clients on slow links such as wall-mounted tablets
+	StreamDeltas          bool `json:"streamDeltas"`
+	StreamKeyframeSeconds int  `json:"streamKeyframeSeconds"`
+	// Function is "rate", "delta", "sum", "avg", "min", "max" or "count",
+	// computed from the matching series; the aggregations group by the By
+	// labels, which include target labels, so that e.g. {"function": "avg",
+	// "by": ["room"]} averages across the targets of each room
+	Function string   `json:"function"`
+	By       []string `json:"by"`
+	// BaselineCompare returns the percent deviation of each series from its
+	// value in the baseline
+	BaselineCompare bool `json:"baselineCompare"`
+	// Raw adds the raw values of calibrated series next to their values,
+	// in frames that no longer suit alert rules
+	Raw bool `json:"raw"`
+}
 
 
 var (
@@ -65,7 +229,10 @@ var (
 
 func registerMetrics() {
 	registerMetricsOnce.Do(func() {
-		prometheus.MustRegister(queriesTotal, healthCheckTotal, healthCheckDuration)
+		metricsRegistry.MustRegister(queriesTotal, healthCheckTotal, healthCheckDuration, sloBurnRate, sloViolationsTotal,
+			scrapeCacheHits, scrapeCacheMisses, scrapeDuration, scrapeBytes, scrapeParseDuration, querySeries,
+			smartPredictedFailure, agentLateSamples, targetClockSkew,
+			pushSchemaMessages)
 	})
 }
 
@@ -84,26 +251,365 @@ func newDataSource(ctx context.Context, settings backend.DataSourceInstanceSetti
 		return nil, err
 	}
 
+	pluginSettings, err := models.LoadPluginSettings(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load plugin settings: %w", err)
+	}
+
+	if err := applyClientSettings(&opts, pluginSettings); err != nil {
+		return nil, fmt.Errorf("invalid HTTP client settings: %w", err)
+	}
+	policy, err := newTLSPolicy(pluginSettings.TLSMinVersion, pluginSettings.TLSCipherSuites)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %w", err)
+	}
+	policy.configureTLS(&opts)
+	egress, err := newEgressPolicy(pluginSettings.Egress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress settings: %w", err)
+	}
+	var dns *dnsCache
+	if pluginSettings.HighFrequency {
+		dns = newDNSCache()
+		applyHighFrequency(&opts, dns, egress)
+	} else {
+		egress.configureTransport(&opts)
+	}
 	client, err := httpclient.New(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP client: %w", err)
+	}
+
+	ds := &testDataSource{
+		httpClient:  client,
+		settings:    pluginSettings,
+		wifi:        newWifiTracker(),
+		publicIP:    &publicIPTracker{},
+		proxies:     newProxyTracker(),
+		slos:        newSLOTracker(),
+		sqlPools:    newSQLPools(egress),
+		brokerRates: newCounterRates(),
+		probes:      newProbeTracker(),
+		health:      newHealthHistory(healthHistoryRetention(pluginSettings.HealthHistoryHours)),
+		baseline:    &baselineStore{},
+		faults:      newFaultInjector(),
+		confirms:    newConfirmTokens(),
+		slowQueries: newSlowQueryLog(slowQueryThreshold(pluginSettings.SlowQueryMs)),
+		usage:       newUsageTracker(),
+		streams:     newStreamRegistry(),
+		traceroutes: newTracerouteTracker(),
+		hwEvents:    newHardwareEventLog(),
+		alertLog:    newAlertLog(),
+		uid:         settings.UID,
+		version:     pluginVersion(ctx),
+		egress:      egress,
+		tr:          newLocalizer(pluginSettings.Locale),
+		drain:       make(chan struct{}),
+		clientOpts:  opts,
+	}
+	ds.secretHashes = secretHashes(settings.DecryptedSecureJSONData)
+	if ds.wsDialer, err = newWebSocketDialer(opts, egress); err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %w", err)
+	}
+	if ds.grpcConns, err = newGRPCConns(opts, egress); err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %w", err)
+	}
+
+	// Checked before the stores read them, which skip what they can't
+	if ds.stateFiles = newStateFiles(pluginSettings.StateDir, settings.UID); ds.stateFiles != nil {
+		ds.stateFiles.checkAtStartup()
+	}
+
+	history := defaultHistory
+	if m := pluginSettings.HistoryMinutes; m > 0 {
+		history = time.Duration(m) * time.Minute
+	}
+
+	ds.CallResourceHandler = httpadapter.New(compressResponses(ds.resourceMux()))
+
+	ds.cacheTTL = defaultCacheTTL
+	if ttl := pluginSettings.CacheTTLSeconds; ttl != 0 {
+		ds.cacheTTL = time.Duration(ttl) * time.Second
+	}
+
+	ds.warnUnknownFeatures()
+
+	ds.pipelines, err = parsePipelinePresets(pluginSettings.Pipelines)
 	if err != nil {
 		return nil, err
 	}
 
-	pluginSettings, err := models.LoadPluginSettings(settings)
+	ds.scripts, err = compileScripts(pluginSettings.Scripts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load plugin settings: %w", err)
+		return nil, fmt.Errorf("invalid scripts: %w", err)
 	}
 
-	ds := &testDataSource{
-		httpClient: client,
-		settings:   pluginSettings,
+	if err := validateDependencies(pluginSettings); err != nil {
+		return nil, fmt.Errorf("invalid dependencies: %w", err)
+	}
+
+	var baselineAt time.Time
+	if pluginSettings.BaselineAt != "" {
+		if baselineAt, err = time.Parse(time.RFC3339, pluginSettings.BaselineAt); err != nil {
+			return nil, fmt.Errorf("invalid baselineAt: %w", err)
+		}
+	}
+
+	if err := pluginSettings.ExecChecks.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid execChecks settings: %w", err)
+	}
+	if ds.pingChecks, err = newPingChecks(pluginSettings.Pings, pluginSettings.Secrets.PingTokens); err != nil {
+		return nil, fmt.Errorf("invalid pings settings: %w", err)
+	}
+	if err := validateCostAccounts(pluginSettings.Costs); err != nil {
+		return nil, fmt.Errorf("invalid costs settings: %w", err)
+	}
+	if ds.webhooks, err = newQueryWebhooks(pluginSettings.Webhooks, pluginSettings.Secrets.WebhookTokens); err != nil {
+		return nil, fmt.Errorf("invalid webhooks settings: %w", err)
+	}
+	if pluginSettings.Alertmanager.URL != "" {
+		if ds.alerts, err = newAlertForwarder(pluginSettings.Alertmanager, pluginSettings.Secrets.AlertmanagerToken); err != nil {
+			return nil, fmt.Errorf("invalid alertmanager settings: %w", err)
+		}
+	}
+	if len(pluginSettings.Maintenance.Windows) > 0 || pluginSettings.Maintenance.DetectScrubs {
+		if ds.maintenance, err = newMaintenance(pluginSettings.Maintenance, pluginSettings.Secrets.GrafanaToken); err != nil {
+			return nil, fmt.Errorf("invalid maintenance settings: %w", err)
+		}
+		if pluginSettings.Maintenance.DetectScrubs && len(pluginSettings.SSH.AllHosts()) == 0 {
+			return nil, fmt.Errorf("invalid maintenance settings: detectScrubs needs an SSH host to poll for scrubs")
+		}
+	}
+	if ds.transactions, err = newTransactions(pluginSettings.Transactions, pluginSettings.Secrets.TransactionPasswords); err != nil {
+		return nil, fmt.Errorf("invalid transactions settings: %w", err)
+	}
+	ds.transactionResults = newTransactionTracker()
+	ds.netSamples = newNetSampleLog()
+	if pluginSettings.Probes.DualStack {
+		ds.probeClients = map[string]*http.Client{}
+		for _, f := range probeFamilies {
+			if ds.probeClients[f.name], err = newProbeFamilyClient(opts, egress, f.network); err != nil {
+				return nil, fmt.Errorf("invalid probes settings: %w", err)
+			}
+		}
+	}
+	if pluginSettings.Browser.URL != "" {
+		if ds.browser, err = newBrowserChecker(pluginSettings.Browser, pluginSettings.Secrets.BrowserToken); err != nil {
+			return nil, fmt.Errorf("invalid browser settings: %w", err)
+		}
+	}
+	if pluginSettings.Bufferbloat.PingURL != "" {
+		if ds.bufferbloat, err = newBufferbloatTest(pluginSettings.Bufferbloat); err != nil {
+			return nil, fmt.Errorf("invalid bufferbloat settings: %w", err)
+		}
+	}
+	if len(pluginSettings.Iperf.Pairs) > 0 {
+		if ds.iperf, err = newIperfTests(pluginSettings.Iperf, pluginSettings.SSH.AllHosts()); err != nil {
+			return nil, fmt.Errorf("invalid iperf settings: %w", err)
+		}
+	}
+	if len(pluginSettings.Fio.Targets) > 0 {
+		if ds.fio, err = newFioBenchmarks(pluginSettings.Fio, pluginSettings.SSH.AllHosts()); err != nil {
+			return nil, fmt.Errorf("invalid fio settings: %w", err)
+		}
+	}
+	if ds.powerSchedules, err = newPowerSchedules(pluginSettings.PowerSchedules, pluginSettings.SSH.AllHosts()); err != nil {
+		return nil, fmt.Errorf("invalid powerSchedules settings: %w", err)
+	}
+	if pluginSettings.Idle.Enabled {
+		if ds.idle, err = newIdleTracker(pluginSettings.Idle, pluginSettings.StateDir, settings.UID); err != nil {
+			return nil, fmt.Errorf("invalid idle settings: %w", err)
+		}
+	}
+	if ds.statusPage, err = newStatusPage(pluginSettings.StatusPage, pluginSettings.Secrets.StatusPageToken); err != nil {
+		return nil, fmt.Errorf("invalid statusPage settings: %w", err)
+	}
+	if ds.kiosk, err = newKiosk(pluginSettings.Kiosk); err != nil {
+		return nil, fmt.Errorf("invalid kiosk settings: %w", err)
+	}
+	if pluginSettings.Digest.Enabled {
+		if ds.digest, err = newDigest(pluginSettings.Digest, pluginSettings.Secrets.NotifierToken, pluginSettings.StateDir, settings.UID); err != nil {
+			return nil, fmt.Errorf("invalid digest settings: %w", err)
+		}
+	}
+	if pluginSettings.AgentReleases.Dir != "" {
+		if ds.agentReleases, err = newAgentReleases(pluginSettings.AgentReleases, pluginSettings.Secrets.AgentSigningKey, pluginSettings.Secrets.AgentTokens); err != nil {
+			return nil, fmt.Errorf("invalid agentReleases settings: %w", err)
+		}
+	}
+	ds.carbon = &carbonCache{entries: map[string]carbonCacheEntry{}}
+	if ds.batteries, err = newBatteryTable(pluginSettings.Batteries); err != nil {
+		return nil, fmt.Errorf("invalid battery settings: %w", err)
+	}
+	if pluginSettings.Climate.Enabled {
+		if ds.climate, err = newClimateAggregator(pluginSettings.Climate, history, pluginSettings.StateDir, settings.UID); err != nil {
+			return nil, fmt.Errorf("invalid climate settings: %w", err)
+		}
+	}
+
+	ds.targets, ds.configErr = newScrapeTargets(pluginSettings, history)
+	ds.discoveryStore = newDiscoveryStore(pluginSettings.StateDir, settings.UID)
+	if ds.configErr != nil {
+		backend.Logger.Warn("Invalid scrape target configuration", "error", ds.configErr)
+	}
+	ds.units = unitInference{overrides: pluginSettings.Units}
+	if err := checkMacros(pluginSettings.Macros); err != nil {
+		return nil, fmt.Errorf("invalid macros: %w", err)
+	}
+	ds.macros = pluginSettings.Macros
+	if ds.duplicates, err = newDuplicatePolicy(pluginSettings.DuplicateSeries, ds.targets); err != nil {
+		return nil, fmt.Errorf("invalid duplicateSeries settings: %w", err)
+	}
+	if ds.personal, err = newPersonalData(pluginSettings.PersonalData, ds.targets); err != nil {
+		return nil, fmt.Errorf("invalid personalData settings: %w", err)
+	}
+
+	if pluginSettings.OpenWrt.URL != "" {
+		ds.openwrt, err = newOpenWrtClient(client, pluginSettings.OpenWrt.URL, pluginSettings.OpenWrt.Username, pluginSettings.Secrets.OpenWrtPassword)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if pluginSettings.Kubernetes.Enabled {
+		ds.kubernetes, err = newKubernetesClient(pluginSettings.Kubernetes, pluginSettings.Secrets.Kubeconfig, policy, egress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kubernetes settings: %w", err)
+		}
+	}
+
+	// Background jobs outlive the request context, so they get their own
+	bgCtx, cancel := context.WithCancel(context.Background())
+	ds.stop = cancel
+	ds.schedule = &jobSchedule{}
+	ds.operations = newOperationTracker(bgCtx, settings.UID)
+	if pluginSettings.WarmCache {
+		ds.primeCache(bgCtx)
+	}
+	for _, target := range ds.targets {
+		ds.scrapers.Add(1)
+		ds.startJob(func() {
+			defer ds.scrapers.Done()
+			ds.runScraper(bgCtx, target)
+		})
+		if target.highRes != nil && target.push == nil {
+			ds.startJob(func() { ds.runHighResolution(bgCtx, target) })
+		}
+	}
+	if dns != nil {
+		hosts := targetHosts(ds.targets)
+		job := ds.schedule.add("dns", "", dnsRefreshInterval, time.Now())
+		ds.startJob(func() { dns.run(bgCtx, hosts, job) })
+	}
+	if ds.discoveryStore != nil {
+		ds.startJob(func() { ds.runDiscoverySaver(bgCtx) })
+	}
+	if !baselineAt.IsZero() {
+		ds.startJob(func() { ds.runBaselineCapture(bgCtx, baselineAt) })
+	}
+	if pluginSettings.PublicIP.Enabled {
+		ds.startJob(func() { ds.runPublicIPChecker(bgCtx) })
+	}
+	if len(pluginSettings.Probes.Targets) > 0 {
+		ds.startJob(func() { ds.runProber(bgCtx) })
+	}
+	if len(pluginSettings.Traceroute.Destinations) > 0 {
+		ds.startJob(func() { ds.runTracerouteScheduler(bgCtx) })
+	}
+	if pluginSettings.SMART.Enabled {
+		window := defaultSMARTWindow
+		if d := pluginSettings.SMART.WindowDays; d > 0 {
+			window = time.Duration(d) * 24 * time.Hour
+		}
+		ds.smart = newSMARTTracker(window, pluginSettings.StateDir, settings.UID)
+		ds.startJob(func() { ds.runSMARTAnalyzer(bgCtx) })
+	}
+	if ds.climate != nil {
+		ds.startJob(func() { ds.runClimateAggregator(bgCtx) })
+	}
+	if pluginSettings.UpdateCheck.Enabled {
+		ds.updates = newUpdateChecker(ds.version)
+		ds.startJob(func() { ds.runUpdateChecker(bgCtx) })
+	}
+	if len(ds.webhooks) > 0 {
+		ds.startJob(func() { ds.runWebhooks(bgCtx) })
+	}
+	if ds.alerts != nil {
+		ds.startJob(func() { ds.runAlertForwarder(bgCtx) })
+	}
+	if ds.maintenance != nil && ds.maintenance.grafanaURL != "" {
+		ds.startJob(func() { ds.runMuteTimingSync(bgCtx) })
+	}
+	if ds.maintenance != nil && ds.maintenance.detectScrubs {
+		ds.startJob(func() { ds.runScrubDetector(bgCtx) })
+	}
+	for _, t := range ds.transactions {
+		ds.startJob(func() { ds.runTransactionChecker(bgCtx, t) })
+	}
+	if ds.browser != nil && len(ds.browser.checks) > 0 {
+		ds.startJob(func() { ds.runBrowserChecks(bgCtx) })
+	}
+	if ds.bufferbloat != nil {
+		ds.startJob(func() { ds.runBufferbloatTests(bgCtx) })
+	}
+	if ds.iperf != nil {
+		ds.startJob(func() { ds.runIperfTests(bgCtx) })
+	}
+	if ds.fio != nil {
+		ds.startJob(func() { ds.runFioBenchmarks(bgCtx) })
+	}
+	for _, s := range ds.powerSchedules {
+		ds.startJob(func() { ds.runPowerSchedule(bgCtx, s) })
+	}
+	if ds.idle != nil {
+		ds.startJob(func() { ds.runIdleTracker(bgCtx) })
+	}
+	if ds.digest != nil {
+		ds.startJob(func() { ds.runDigest(bgCtx) })
 	}
 
+	// Released by Dispose, so only instances that are returned may acquire it
+	if err := pluginMetricsServer.acquire(); err != nil {
+		backend.Logger.Error("Failed to start metrics server", "error", err)
+	}
+	ds.audit = auditLogFor(pluginSettings.StateDir, settings.UID)
+	ds.savedQueries = savedQueriesFor(pluginSettings.StateDir, settings.UID)
+	ds.pings = pingLogFor(pluginSettings.StateDir, settings.UID)
+	ds.audit.recordSettings(ctx, settings)
+	if previous := liveInstances.withUID(ds.uid, ds); previous != nil {
+		if changed := changedSecrets(previous.secretHashes, ds.secretHashes); len(changed) > 0 {
+			backend.Logger.Info("Secure settings changed, rotating credentials", "keys", changed)
+		}
+	}
+	liveInstances.add(ds)
+
 	backend.Logger.Info("Data source initialized successfully")
 	return ds, nil
 }
 
-func (ds *testDataSource) Dispose() {}
+// Dispose stops the instance's background jobs, waiting for them to finish
+// what they are doing, and closes its connections. Scrapes in flight finish
+// before the jobs are cancelled, so none is lost when the instance manager
+// replaces the instance, e.g. to rotate credentials. It may be called more
+// than once, by the instance manager and on shutdown.
+func (ds *testDataSource) Dispose() {
+	ds.disposeOnce.Do(func() {
+		if ds.drain != nil {
+			close(ds.drain)
+			if !waitTimeout(&ds.scrapers, disposeTimeout) {
+				backend.Logger.Warn("Scrapes did not finish in time", "timeout", disposeTimeout)
+			}
+		}
+		if ds.stop != nil {
+			ds.stop()
+		}
+		ds.waitForJobs(disposeTimeout)
+		ds.sqlPools.Close()
+		ds.grpcConns.Close()
+		pluginMetricsServer.release()
+		liveInstances.remove(ds)
+	})
+}
 
 func (ds *testDataSource) CheckHealth(ctx context.Context, _ *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	backend.Logger.Info("CheckHealth called")
@@ -118,7 +624,7 @@ func (ds *testDataSource) CheckHealth(ctx context.Context, _ *backend.CheckHealt
 		backend.Logger.Error("CheckHealth failed: Data source settings are nil")
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
-			Message: "Data source settings are not initialized",
+			Message: ds.tr.text(msgSettingsNotInitialized),
 		}, nil
 	}
 
@@ -126,149 +632,434 @@ func (ds *testDataSource) CheckHealth(ctx context.Context, _ *backend.CheckHealt
 		backend.Logger.Error("CheckHealth failed: HTTP client is nil")
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
-			Message: "HTTP client is not initialized",
+			Message: ds.tr.text(msgClientNotInitialized),
 		}, nil
 	}
 
-	testURL := "http://localhost:3000/api/health"
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, testURL, nil)
-	if err != nil {
+	if ds.configErr != nil {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
-			Message: "Failed to create health check request",
-		}, err
+			Message: ds.tr.text(msgInvalidConfiguration, ds.configErr),
+		}, nil
 	}
 
 	if ds.settings.Secrets == nil || ds.settings.Secrets.ApiKey == "" {
 		backend.Logger.Error("CheckHealth failed: Missing API key")
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
-			Message: "Missing API key in plugin settings",
+			Message: ds.tr.text(msgMissingAPIKey),
 		}, nil
 	}
-	req.Header.Set("Authorization", "Bearer "+ds.settings.Secrets.ApiKey)
 
-	resp, err := ds.httpClient.Do(req)
+	var failing []string
+	details := healthDetails{Targets: make([]targetHealth, 0, len(ds.targets))}
+	for _, target := range ds.targets {
+		health := ds.checkTarget(ctx, target)
+		ds.health.recordCheck(health, start)
+		if health.Status != "ok" {
+			backend.Logger.Error("CheckHealth scrape failed", "target", target.Name, "error", health.Error)
+			failing = append(failing, fmt.Sprintf("%s (%s)", target.Name, health.Error))
+		}
+		details.Targets = append(details.Targets, health)
+	}
+	if ds.updates != nil {
+		status, _ := ds.updates.get()
+		details.Update = &status
+	}
+	jsonDetails, err := json.Marshal(details)
 	if err != nil {
-		backend.Logger.Error("CheckHealth request failed", "error", err)
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: fmt.Sprintf("Request error: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to marshal health details: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if len(failing) > 0 {
 		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: fmt.Sprintf("Unexpected response: %s", resp.Status),
+			Status:      backend.HealthStatusError,
+			Message:     ds.tr.text(msgFailingTargets, strings.Join(failing, ", ")),
+			JSONDetails: jsonDetails,
 		}, nil
 	}
-
 	return &backend.CheckHealthResult{
-		Status:  backend.HealthStatusOk,
-		Message: "Datasource is healthy",
+		Status:      backend.HealthStatusOk,
+		Message:     ds.tr.text(msgHealthy, len(ds.targets)),
+		JSONDetails: jsonDetails,
 	}, nil
 }
 
-func startMetricsServer() {
-	go func() {
-		http.Handle("/metrics", promhttp.Handler()) // Serve metrics
-		backend.Logger.Info("Starting metrics server on :2112")
-		if err := http.ListenAndServe(":2112", nil); err != nil {
-			backend.Logger.Error("Metrics server failed", "error", err)
+// healthDetails is the JSONDetails of CheckHealth.
+type healthDetails struct {
+	Targets []targetHealth `json:"targets"`
+	// Update is set when update checks are enabled
+	Update *updateStatus `json:"update,omitempty"`
+}
+
+type targetHealth struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Status is "ok" or "error", with Error saying why
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latencyMs"`
+	Families  int     `json:"families"`
+}
+
+// checkTarget scrapes target, bypassing the cache, and checks that it
+// returns valid exposition format, or the format of its parser. Push
+// sources are healthy once they sent samples.
+func (ds *testDataSource) checkTarget(ctx context.Context, target *scrapeTarget) targetHealth {
+	health := targetHealth{Name: target.Name, URL: target.URL, Status: "error"}
+	if target.push != nil {
+		samples, err := target.push.latest(target.Name)
+		if err != nil {
+			health.Error = err.Error()
+			return health
 		}
-	}()
+		health.Status = "ok"
+		health.Families = sampleFamilies(samples)
+		return health
+	}
+
+	start := time.Now()
+	body, injected, err := ds.faults.inject(ctx, target)
+	if !injected {
+		if target.grpc != nil {
+			body, err = ds.grpcGetTarget(ctx, target)
+		} else {
+			body, err = ds.httpGetTarget(ctx, target)
+		}
+	}
+	health.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+
+	families, err := countFamilies(target, body)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	if families == 0 {
+		health.Error = ds.tr.text(msgNoMetricsExposed)
+		return health
+	}
+
+	health.Status = "ok"
+	health.Families = families
+	return health
+}
+
+// countFamilies parses the response of target and counts its metric
+// families.
+func countFamilies(target *scrapeTarget, body []byte) (int, error) {
+	if target.parser == nil {
+		families, err := parseExposition(body)
+		return len(families), err
+	}
+	samples, err := target.parser(body)
+	if err != nil {
+		return 0, err
+	}
+	return sampleFamilies(samples), nil
+}
+
+// sampleFamilies counts the metric families of samples.
+func sampleFamilies(samples []metricSample) int {
+	families := map[string]bool{}
+	for _, s := range samples {
+		families[s.Family] = true
+	}
+	return len(families)
 }
 
+// maxConcurrentQueries bounds how many queries of one request run at once.
+const maxConcurrentQueries = 10
+
 func (ds *testDataSource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
-	// Initialize an empty metric name variable
-	var metricName string
+	// Grafana evaluates alert rules without a user, and marks their
+	// requests with the FromAlert header; requests of users saying so
+	// remain theirs
+	fromAlert := req.Headers[headerFromAlert] == "true" || req.GetHTTPHeaders().Get(headerFromAlert) == "true"
+	if fromAlert && backend.PluginConfigFromContext(ctx).User == nil {
+		ctx = withAlertEvaluation(ctx)
+	}
+	return concurrent.QueryData(ctx, req, ds.query, maxConcurrentQueries)
+}
+
+// query executes a single query. Errors are reported on its own response so
+// one failing query doesn't fail the others in the request.
+func (ds *testDataSource) query(ctx context.Context, cq concurrent.Query) backend.DataResponse {
+	// Scrapes run for the query become children of its span, and outgoing
+	// requests carry the trace context
+	ctx, span := tracing.DefaultTracer().Start(ctx, "query", oteltrace.WithAttributes(
+		attribute.String("ref_id", cq.DataQuery.RefID),
+		attribute.String("query_type", cq.DataQuery.QueryType),
+	))
+	defer span.End()
+	ctx = withRefID(ctx, cq.DataQuery.RefID)
+	ctx, usage := withQueryUsage(ctx)
+	start := time.Now()
+
+	query, err := ds.resolveSavedQuery(ctx, cq.DataQuery)
+	if err != nil {
+		return ds.tr.errorResponse(err)
+	}
+	query, err = interpolateQuery(query, ds.macros)
+	if err != nil {
+		return ds.tr.errorResponse(err)
+	}
+	opts, err := parseQueryOptions(query)
+	if err != nil {
+		return ds.tr.errorResponse(err)
+	}
+	ctx, cancel, err := opts.withTimeout(ctx)
+	if err != nil {
+		return ds.tr.errorResponse(err)
+	}
+	defer cancel()
+
+	frames, err := ds.queryFrames(ctx, query)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = withCode(codeLimitExceeded, fmt.Errorf("query timed out: %w", err))
+	}
+	var stages []pipelineStage
+	if err == nil && len(opts.Pipeline) > 0 {
+		if stages, err = ds.expandPresets(opts.Pipeline); err == nil {
+			frames, err = runPipeline(frames, stages, query.Interval)
+		}
+	}
+	if err == nil && opts.LegendFormat != "" {
+		applyLegendFormat(frames, opts.LegendFormat)
+	}
+	if err == nil {
+		err = arrangeTables(frames, opts)
+	}
+	if err == nil {
+		frames, err = coarsenFrames(frames, opts)
+	}
+	if err == nil {
+		addTransforms(frames, optionTransforms(opts, stages)...)
+	}
+	took := time.Since(start)
+	ds.slowQueries.observe(query, took, usage, frames, err)
+	ds.usage.record(usageKeyFromHeaders(cq.Headers), took, usage, err)
+	if err != nil {
+		backend.Logger.Warn("Query failed", "refId", query.RefID, "queryType", query.QueryType, "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return ds.tr.errorResponse(err)
+	}
+	return backend.DataResponse{Frames: frames}
+}
 
-	// Loop through the queries in the request
-	for _, query := range req.Queries {
-		// Unmarshal JSON query into a map or struct to access user-defined parameters
-		var q Query
-		if err := json.Unmarshal(query.JSON, &q); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+func (ds *testDataSource) queryFrames(ctx context.Context, query backend.DataQuery) (data.Frames, error) {
+	// Query types with a dedicated collector are handled separately
+	if handler, ok := queryHandlers[query.QueryType]; ok {
+		if err := ds.checkQueryTypeEnabled(query.QueryType); err != nil {
+			return nil, err
+		}
+		queriesTotal.WithLabelValues(query.QueryType).Inc()
+		frames, err := handler(ctx, ds, query)
+		if err != nil {
+			return nil, fmt.Errorf("%s query failed: %w", query.QueryType, err)
 		}
+		now := time.Now()
+		setProvenance(frames, frameProvenance{Collector: query.QueryType, ScrapedAt: &now})
+		return frames, nil
+	}
+	queriesTotal.WithLabelValues("metric").Inc()
+
+	// Unmarshal JSON query into a map or struct to access user-defined parameters
+	var q Query
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
 
-		// If a metric was specified, use it
-		if q.Metric != "" {
-			metricName = q.Metric
-			break
+	switch q.Source {
+	case "", "metrics":
+	case sourceKubernetes:
+		frames, err := ds.queryKubernetes(ctx, query)
+		if err == nil {
+			now := time.Now()
+			setProvenance(frames, frameProvenance{Collector: collectorKubernetes, ScrapedAt: &now})
 		}
+		return frames, err
+	default:
+		return nil, fmt.Errorf("unknown query source %q", q.Source)
 	}
 
 	// If no metric name is provided, return an error
-	if metricName == "" {
+	if q.Metric == "" && q.MetricRegex == "" {
 		return nil, fmt.Errorf("no metric specified in the query")
 	}
-
-	// Fetch the metrics data from the Prometheus endpoint
-	metricsURL := "http://172.18.0.2:2112/metrics"
-	metricsResp, err := ds.httpClient.Get(metricsURL)
+	selector, err := newSeriesSelector(q)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch metrics from endpoint: %w", err)
+		return nil, err
 	}
-	defer metricsResp.Body.Close()
 
-	metricsBody, err := io.ReadAll(metricsResp.Body)
+	targets, err := ds.queryTargets(q)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read metrics response: %w", err)
+		return nil, err
+	}
+
+	var stages []pipelineStage
+	if q.Function != "" {
+		if q.Stream {
+			return nil, fmt.Errorf("functions are not supported on streaming queries")
+		}
+		if stages, err = functionStages(q.Function, q.By); err != nil {
+			return nil, err
+		}
+	}
+	if q.StreamDeltas && !q.Stream {
+		return nil, fmt.Errorf("streamDeltas is only supported on streaming queries")
+	}
+	if q.BaselineCompare && q.Stream {
+		return nil, fmt.Errorf("baseline comparison is not supported on streaming queries")
+	}
+	if q.Raw && (q.Stream || q.Function != "" || q.BaselineCompare) {
+		return nil, fmt.Errorf("raw values are not supported with streaming, functions or baseline comparison")
+	}
+
+	if q.Stream {
+		frames := data.Frames{ds.streamChannelFrame(q, selector)}
+		setProvenance(frames, frameProvenance{Targets: targetNames(targets), Collector: collectorMetrics, Cache: cacheStream})
+		return frames, nil
 	}
 
-	metricsData := string(metricsBody)
-	backend.Logger.Info("Fetched metrics data")
+	var found []targetSeries
+	redacted := 0
+	for _, target := range targets {
+		cache := cacheHistory
+		// Until the background scraper has run, answer from a live scrape
+		if target.history.empty() {
+			if _, err := ds.scrapeMetrics(ctx, target); err != nil {
+				return nil, fmt.Errorf("target %s: %w", target.Name, err)
+			}
+			cache = cacheLive
+		}
+		if target.push != nil {
+			cache = cachePush
+		}
+		history, highRes := target.historyFor(selector, query.TimeRange)
+		if highRes {
+			cache = cacheHighResolution
+		}
 
-	// Parse the Prometheus metrics and search for the user-defined metric
-	var metricValue string
-	lines := strings.Split(metricsData, "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, metricName) { // Look for the user-defined metric
-			parts := strings.Fields(line)
-			if len(parts) == 2 {
-				metricValue = parts[1]
-				break
+		series, err := history.seriesFrames(selector, query)
+		if err != nil {
+			// With several targets, a metric only needs to exist on some
+			if len(targets) > 1 {
+				continue
+			}
+			return nil, err
+		}
+		series, n := ds.personal.redactFrames(ctx, target.Name, history, series)
+		redacted += n
+		querySeries.WithLabelValues(target.Name, query.RefID).Observe(float64(len(series)))
+		// Where the data came from, with the last scrape, shows up in the
+		// query inspector
+		setProvenance(series, frameProvenance{
+			Targets:   []string{target.Name},
+			ScrapedAt: history.lastScraped(),
+			Collector: collectorMetrics,
+			Cache:     cache,
+			Scrape:    target.lastScrape(),
+		})
+		for _, frame := range series {
+			found = append(found, targetSeries{target: target, frame: frame})
+		}
+	}
+	// Series are told apart by their target once labeled, so duplicates
+	// are resolved before
+	if found, err = ds.duplicates.resolve(found, ds.tr); err != nil {
+		return nil, err
+	}
+	frames := make(data.Frames, 0, len(found))
+	for _, s := range found {
+		ds.units.apply(data.Frames{s.frame}, s.target.declaredUnits())
+		labelTarget(data.Frames{s.frame}, s.target)
+		ds.maintenance.tagScrubs(data.Frames{s.frame}, s.target, query.TimeRange)
+		if len(s.merged) > 0 {
+			s.frame.Fields[1].Labels["target"] = strings.Join(s.merged, ",")
+			if p := provenanceOf(s.frame); p != nil {
+				p.Targets = s.merged
+				p.Scrape = nil
 			}
 		}
+		frames = append(frames, s.frame)
+	}
+	if redacted > 0 {
+		// Panels of personal series only show why they are empty
+		if len(frames) == 0 {
+			frames = append(frames, data.NewFrame(selector.String()))
+		}
+		notice(frames[0], data.NoticeSeverityInfo, ds.tr.text(msgPersonalRedacted, redacted))
+		if len(frames) == 1 && len(frames[0].Fields) == 0 {
+			return frames, nil
+		}
+	}
+	if len(frames) == 0 {
+		return nil, withCode(codeMetricNotFound, fmt.Errorf("no series match %s on any target", selector))
 	}
 
-	// If the metric is not found, return an error
-	if metricValue == "" {
-		return nil, fmt.Errorf("metric %s not found", metricName)
+	if len(stages) > 0 {
+		if frames, err = runPipeline(frames, stages, query.Interval); err != nil {
+			return nil, err
+		}
+		addTransforms(frames, "function "+q.Function)
+	}
+	if q.BaselineCompare {
+		baseline, err := ds.baselineValues(targets, selector, stages, query.Interval)
+		if err != nil {
+			return nil, err
+		}
+		if frames, err = compareToBaseline(frames, baseline); err != nil {
+			return nil, err
+		}
+		addTransforms(frames, "baseline comparison")
 	}
 
-	// Create a DataFrame to return the metric
-	frame := data.NewFrame("metrics",
-		data.NewField("metric_name", nil, []string{metricName}),
-		data.NewField("metric_value", nil, []float64{toFloat(metricValue)}),
-	)
+	executed := executedQuery(selector, targets, q.Function, q.By)
+	for _, frame := range frames {
+		frame.Meta.ExecutedQueryString = executed
+	}
+	return frames, nil
+}
 
-	// Return the response with the metric data
-	return &backend.QueryDataResponse{
-		Responses: map[string]backend.DataResponse{
-			"default": {
-				Frames: data.Frames{frame},
-			},
-		},
-	}, nil
+// executedQuery describes what a metric query selected and computed, in a
+// PromQL-like syntax, e.g. "sum by (host) (up) on nas, router".
+func executedQuery(selector seriesSelector, targets []*scrapeTarget, function string, by []string) string {
+	expr := selector.String()
+	switch {
+	case function != "" && len(by) > 0:
+		expr = fmt.Sprintf("%s by (%s) (%s)", function, strings.Join(by, ", "), expr)
+	case function != "":
+		expr = fmt.Sprintf("%s(%s)", function, expr)
+	}
+
+	return expr + " on " + strings.Join(targetNames(targets), ", ")
 }
 
-// Helper function to convert string to float64 safely
-func toFloat(value string) float64 {
-	if f, err := strconv.ParseFloat(value, 64); err == nil {
-		return f
+func targetNames(targets []*scrapeTarget) []string {
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		names[i] = t.Name
 	}
-	return 0
+	return names
 }
 
 
 func main() {
-	startMetricsServer() // Start Prometheus metrics server
-	err := datasource.Manage("homelab-kirill-datasource", newDataSource, datasource.ManageOpts{})
+	if len(os.Args) > 1 {
+		if code, ok := runCLI(os.Args[1:]); ok {
+			os.Exit(code)
+		}
+	}
+	go disposeOnTermination()
+	err := datasource.Manage(pluginID, newDataSource, datasource.ManageOpts{})
 	if err != nil {
 		backend.Logger.Error(err.Error())
 	}
+	liveInstances.disposeAll()
 }
 
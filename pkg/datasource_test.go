@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+var testStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestDataSource returns an instance with two targets, "nas" and
+// "router", each holding ten minutes of scrapes every 15 seconds, so that
+// queries never scrape.
+func newTestDataSource() *testDataSource {
+	ds := &testDataSource{}
+	for i, name := range []string{"nas", "router"} {
+		target := &scrapeTarget{Name: name, history: newScrapeHistory(defaultHistory)}
+		for n := 0; n < 40; n++ {
+			target.history.record(testStart.Add(time.Duration(n)*15*time.Second), []metricSample{
+				{
+					seriesInfo: seriesInfo{
+						Family: "node_network_receive_bytes_total",
+						Name:   "node_network_receive_bytes_total",
+						Labels: data.Labels{"device": "eth0"},
+					},
+					Value: float64(n * 1500 * (i + 1)),
+				},
+				{
+					seriesInfo: seriesInfo{Family: "node_load1", Name: "node_load1", Labels: data.Labels{}},
+					Value:      float64(n%4) / 2,
+				},
+			})
+		}
+		ds.targets = append(ds.targets, target)
+	}
+	return ds
+}
+
+func TestQueryDataGoldenFrames(t *testing.T) {
+	tests := []goldenQuery{
+		{name: "metric", json: `{"metric": "node_load1"}`, interval: 15 * time.Second, maxDataPoints: 1000},
+		{name: "metric_downsampled", json: `{"metric": "node_load1"}`, interval: time.Minute, maxDataPoints: 1000},
+		{name: "metric_max_data_points", json: `{"metric": "node_load1"}`, interval: 15 * time.Second, maxDataPoints: 5},
+		{name: "rate_all_targets", json: `{"metric": "node_network_receive_bytes_total", "target": "*", "function": "rate"}`, interval: time.Minute, maxDataPoints: 1000},
+		{name: "sum_by_device", json: `{"metric": "node_network_receive_bytes_total", "target": "*", "function": "sum", "by": ["device"]}`, interval: time.Minute, maxDataPoints: 1000},
+		{name: "export_coarsened", json: `{"metric": "node_network_receive_bytes_total", "export": {"interval": "5m", "round": 10000}}`, interval: 15 * time.Second, maxDataPoints: 1000},
+		{name: "legend_format", json: `{"metric": "node_network_receive_bytes_total", "target": "*", "legendFormat": "{{target}} {{ device }}"}`, interval: time.Minute, maxDataPoints: 1000},
+		{name: "pipeline_filter_smooth", json: `{"metric": "node_load1", "target": "*", "pipeline": [{"type": "filter", "labels": {"target": "nas"}}, {"type": "smooth", "window": 3}]}`, interval: 15 * time.Second, maxDataPoints: 1000},
+		{name: "pipeline_rate_topk", json: `{"metric": "node_network_receive_bytes_total", "target": "*", "pipeline": [{"type": "rate"}, {"type": "topk", "k": 1}]}`, interval: time.Minute, maxDataPoints: 1000},
+		{name: "pipeline_aggregate_avg", json: `{"metric": "node_load1", "target": "*", "pipeline": [{"type": "aggregate", "op": "avg"}]}`, interval: time.Minute, maxDataPoints: 1000},
+	}
+
+	ds := newTestDataSource()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dr := tt.run(t, ds)
+			for _, frame := range dr.Frames {
+				// Alert rules need one numeric series per frame, next to a time field
+				if frame.Meta == nil || frame.Meta.Type != data.FrameTypeTimeSeriesMulti {
+					t.Errorf("frame %q is not a multi time series frame", frame.Name)
+				}
+				if len(frame.Fields) != 2 || !frame.Fields[0].Type().Time() || !frame.Fields[1].Type().Numeric() {
+					t.Errorf("frame %q does not have a time and a numeric field", frame.Name)
+				}
+			}
+			checkGoldenFrames(t, tt.name, &dr)
+		})
+	}
+}
+
+// TestMetricQueryFunctions checks the functions of metric queries on the
+// counters of newTestDataSource, which grow by 1500 bytes a scrape on nas
+// and 3000 on router.
+func TestMetricQueryFunctions(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		labels   []string
+		last     float64
+		executed string
+		wantErr  string
+	}{
+		{
+			name:     "rate",
+			json:     `{"metric": "node_network_receive_bytes_total", "target": "nas", "function": "rate"}`,
+			labels:   []string{`device=eth0, target=nas`},
+			last:     100,
+			executed: "rate(node_network_receive_bytes_total) on nas",
+		},
+		{
+			name:     "delta",
+			json:     `{"metric": "node_network_receive_bytes_total", "target": "router", "function": "delta"}`,
+			labels:   []string{`device=eth0, target=router`},
+			last:     3000,
+			executed: "delta(node_network_receive_bytes_total) on router",
+		},
+		{
+			name:     "sum by device",
+			json:     `{"metric": "node_network_receive_bytes_total", "target": "*", "function": "sum", "by": ["device"]}`,
+			labels:   []string{`device=eth0`},
+			last:     39 * 4500,
+			executed: "sum by (device) (node_network_receive_bytes_total) on nas, router",
+		},
+		{
+			name:     "max by target",
+			json:     `{"metric": "node_network_receive_bytes_total", "target": "*", "function": "max", "by": ["target"]}`,
+			labels:   []string{`target=nas`, `target=router`},
+			last:     39 * 3000,
+			executed: "max by (target) (node_network_receive_bytes_total) on nas, router",
+		},
+		{
+			name:     "count",
+			json:     `{"metric": "node_load1", "target": "*", "function": "count"}`,
+			labels:   []string{``},
+			last:     2,
+			executed: "count(node_load1) on nas, router",
+		},
+		{name: "unknown function", json: `{"metric": "node_load1", "function": "irate"}`, wantErr: `unknown function "irate"`},
+		{name: "streaming", json: `{"metric": "node_load1", "function": "rate", "stream": true}`, wantErr: "functions are not supported on streaming queries"},
+		{name: "raw", json: `{"metric": "node_load1", "function": "avg", "raw": true}`, wantErr: "raw values are not supported"},
+	}
+
+	ds := newTestDataSource()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{{
+					RefID:         "A",
+					JSON:          []byte(tt.json),
+					Interval:      15 * time.Second,
+					MaxDataPoints: 1000,
+					TimeRange:     backend.TimeRange{From: testStart, To: testStart.Add(10 * time.Minute)},
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dr := resp.Responses["A"]
+			if tt.wantErr != "" {
+				if dr.Error == nil || !strings.Contains(dr.Error.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", dr.Error, tt.wantErr)
+				}
+				return
+			}
+			if dr.Error != nil {
+				t.Fatal(dr.Error)
+			}
+			if len(dr.Frames) != len(tt.labels) {
+				t.Fatalf("got %d frames, want %d", len(dr.Frames), len(tt.labels))
+			}
+			for i, frame := range dr.Frames {
+				values := frame.Fields[1]
+				if got := values.Labels.String(); got != tt.labels[i] {
+					t.Errorf("frame %d has labels %q, want %q", i, got, tt.labels[i])
+				}
+				if frame.Meta.ExecutedQueryString != tt.executed {
+					t.Errorf("frame %d executed %q, want %q", i, frame.Meta.ExecutedQueryString, tt.executed)
+				}
+			}
+			values := dr.Frames[len(dr.Frames)-1].Fields[1]
+			last, _ := values.NullableFloatAt(values.Len() - 1)
+			if last == nil || *last != tt.last {
+				t.Errorf("last value %v, want %v", last, tt.last)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeDependencies = "dependencies"
+
+// Roll-up statuses of dependency nodes.
+const (
+	dependencyOK       = "ok"
+	dependencyUnknown  = "unknown"
+	dependencyDown     = "down"
+	dependencyImpacted = "impacted"
+	dependencyDegraded = "degraded"
+)
+
+// dependencyStates are the severities of roll-up statuses; unknown nodes
+// have none.
+var dependencyStates = stateScale{
+	dependencyOK:       severityOK,
+	dependencyImpacted: severityWarning,
+	dependencyDegraded: severityWarning,
+	dependencyDown:     severityCritical,
+}
+
+func init() {
+	registerQueryType(queryTypeDependencies, queryDependencies, dependencyQuery{})
+	registerConfiguredCheck(queryTypeDependencies, func(ds *testDataSource) bool { return len(ds.settings.Dependencies) > 0 })
+}
+
+type dependencyQuery struct {
+	// Node keeps only one node; empty means all of them.
+	Node string `json:"node"`
+	// RootCauses keeps only nodes that are down for none of their
+	// dependencies being down, so alerts fire once per outage.
+	RootCauses bool `json:"rootCauses"`
+}
+
+// validateDependencies checks that dependency nodes are named uniquely, only
+// refer to configured nodes and targets, and form no cycle.
+func validateDependencies(settings *models.PluginSettings) error {
+	nodes := map[string]models.DependencySettings{}
+	for _, n := range settings.Dependencies {
+		if n.Name == "" {
+			return fmt.Errorf("dependency node without a name")
+		}
+		if _, ok := nodes[n.Name]; ok {
+			return fmt.Errorf("duplicate dependency node %q", n.Name)
+		}
+		nodes[n.Name] = n
+	}
+
+	probes := map[string]bool{}
+	for _, p := range settings.Probes.Targets {
+		probes[p.Name] = true
+	}
+	// Bad targets are reported as a configuration error of their own
+	targets, err := settings.ScrapeTargets()
+	scrapeTargets := map[string]bool{}
+	for _, t := range targets {
+		scrapeTargets[t.Name] = true
+	}
+
+	for _, n := range settings.Dependencies {
+		if n.Target != "" && n.Probe != "" {
+			return fmt.Errorf("dependency node %s: set target or probe, not both", n.Name)
+		}
+		if n.Target != "" && err == nil && !scrapeTargets[n.Target] {
+			return fmt.Errorf("dependency node %s: target %q is not configured", n.Name, n.Target)
+		}
+		if n.Probe != "" && !probes[n.Probe] {
+			return fmt.Errorf("dependency node %s: probe %q is not configured", n.Name, n.Probe)
+		}
+		for _, dep := range n.DependsOn {
+			if _, ok := nodes[dep]; !ok {
+				return fmt.Errorf("dependency node %s: dependency %q is not configured", n.Name, dep)
+			}
+		}
+	}
+
+	// Depth-first search, with nodes on the current path in visiting
+	visiting, done := map[string]bool{}, map[string]bool{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		path = append(path, name)
+		if visiting[name] {
+			return fmt.Errorf("dependency cycle %s", strings.Join(path, " -> "))
+		}
+		if done[name] {
+			return nil
+		}
+		visiting[name] = true
+		for _, dep := range nodes[name].DependsOn {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		done[name] = true
+		return nil
+	}
+	for _, n := range settings.Dependencies {
+		if err := visit(n.Name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeHealth is the health of a dependency node itself. Up is nil when the
+// node has nothing to check or no result yet.
+type nodeHealth struct {
+	Up    *bool
+	Error string
+}
+
+// checkNode returns the health of a node's scrape or probe target. Scrape
+// targets are scraped, through the scrape cache; probes report their last
+// result, preferring that from inside.
+func (ds *testDataSource) checkNode(ctx context.Context, node models.DependencySettings) nodeHealth {
+	up, down := true, false
+	switch {
+	case node.Target != "":
+		targets, err := ds.selectTargets(node.Target)
+		if err == nil {
+			_, err = ds.scrapeMetrics(ctx, targets[0])
+		}
+		if err != nil {
+			return nodeHealth{Up: &down, Error: err.Error()}
+		}
+		return nodeHealth{Up: &up}
+	case node.Probe != "":
+		r, ok := ds.probes.latest(node.Probe)
+		if !ok {
+			return nodeHealth{}
+		}
+		return nodeHealth{Up: &r.Up, Error: r.Error}
+	}
+	return nodeHealth{}
+}
+
+// dependencyRollup is the rolled up health of a node.
+type dependencyRollup struct {
+	Status string
+	// RootCauses are the nodes that are down but not because of their own
+	// dependencies, among the node and its dependencies
+	RootCauses []string
+}
+
+func rollupDependencies(nodes []models.DependencySettings, health map[string]nodeHealth) map[string]dependencyRollup {
+	byName := make(map[string]models.DependencySettings, len(nodes))
+	for _, n := range nodes {
+		byName[n.Name] = n
+	}
+
+	rollups := make(map[string]dependencyRollup, len(nodes))
+	var rollup func(name string) dependencyRollup
+	rollup = func(name string) dependencyRollup {
+		if r, ok := rollups[name]; ok {
+			return r
+		}
+		seen := map[string]bool{}
+		var causes []string
+		for _, dep := range byName[name].DependsOn {
+			for _, c := range rollup(dep).RootCauses {
+				if !seen[c] {
+					seen[c] = true
+					causes = append(causes, c)
+				}
+			}
+		}
+
+		own := health[name].Up
+		r := dependencyRollup{Status: dependencyOK, RootCauses: causes}
+		switch {
+		case own != nil && !*own && len(causes) == 0:
+			r = dependencyRollup{Status: dependencyDown, RootCauses: []string{name}}
+		case own != nil && !*own:
+			r.Status = dependencyImpacted
+		case len(causes) > 0:
+			r.Status = dependencyDegraded
+		case own == nil && len(byName[name].DependsOn) == 0:
+			r.Status = dependencyUnknown
+		}
+		rollups[name] = r
+		return r
+	}
+	for _, n := range nodes {
+		rollup(n.Name)
+	}
+	return rollups
+}
+
+// queryDependencies returns a row per dependency node with its own health
+// and its rolled up status: down when it is a root cause, impacted when it
+// is down along with a dependency and degraded when it is up but a
+// dependency is down. Root causes count the other nodes they take down.
+func queryDependencies(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q dependencyQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	nodes := ds.settings.Dependencies
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no dependencies configured")
+	}
+
+	health := make(map[string]nodeHealth, len(nodes))
+	found := q.Node == ""
+	for _, n := range nodes {
+		health[n.Name] = ds.checkNode(ctx, n)
+		found = found || n.Name == q.Node
+	}
+	if !found {
+		return nil, fmt.Errorf("dependency node %q is not configured", q.Node)
+	}
+	rollups := rollupDependencies(nodes, health)
+
+	impacted := map[string]float64{}
+	for name, r := range rollups {
+		for _, c := range r.RootCauses {
+			if c != name {
+				impacted[c]++
+			}
+		}
+	}
+
+	statusField, severityField := newStateFields(dependencyStates)
+	frame := data.NewFrame("dependencies",
+		data.NewField("node", nil, []string{}),
+		data.NewField("up", nil, []*bool{}).SetConfig(upConfig()),
+		statusField,
+		severityField,
+		data.NewField("root_causes", nil, []string{}),
+		data.NewField("impacted", nil, []float64{}),
+		data.NewField("error", nil, []string{}),
+	)
+	for _, n := range nodes {
+		r := rollups[n.Name]
+		if q.Node != "" && n.Name != q.Node {
+			continue
+		}
+		if q.RootCauses && r.Status != dependencyDown {
+			continue
+		}
+		frame.AppendRow(n.Name, health[n.Name].Up, r.Status, dependencyStates.severity(r.Status), strings.Join(r.RootCauses, ", "), impacted[n.Name], health[n.Name].Error)
+	}
+	return data.Frames{frame}, nil
+}
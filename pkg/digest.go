@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const (
+	defaultDigestSchedule       = "0 8 * * *"
+	defaultWeeklyDigestSchedule = "0 8 * * 1"
+	defaultDigestDeviceLabel    = "mac"
+	// digestQueryTimeout bounds the power and devices queries of a digest
+	digestQueryTimeout = time.Minute
+)
+
+// digestPeriods are the periods digests cover, by name.
+var digestPeriods = map[string]time.Duration{
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+// digest is the configured digest, with the devices earlier digests saw.
+type digest struct {
+	models.DigestSettings
+	period      time.Duration
+	schedule    cronSchedule
+	notifier    *notifier
+	deviceLabel string
+	// path is where seen devices are stored, empty without a state
+	// directory
+	path string
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// newDigest validates the digest settings, with the notifier token.
+func newDigest(settings models.DigestSettings, token, stateDir, uid string) (*digest, error) {
+	d := &digest{DigestSettings: settings, seen: map[string]time.Time{}, deviceLabel: settings.DeviceLabel}
+	if d.Period == "" {
+		d.Period = "day"
+	}
+	var ok bool
+	if d.period, ok = digestPeriods[d.Period]; !ok {
+		return nil, fmt.Errorf("unknown digest period %q, expected day or week", d.Period)
+	}
+	schedule := settings.Schedule
+	if schedule == "" {
+		schedule = defaultDigestSchedule
+		if d.Period == "week" {
+			schedule = defaultWeeklyDigestSchedule
+		}
+	}
+	var err error
+	if d.schedule, err = parseCron(schedule); err != nil {
+		return nil, err
+	}
+	if d.notifier, err = newNotifier(settings.Notifier, token); err != nil {
+		return nil, err
+	}
+	if d.deviceLabel == "" {
+		d.deviceLabel = defaultDigestDeviceLabel
+	}
+	if stateDir != "" {
+		d.path = filepath.Join(stateDir, url.PathEscape(uid), "digest.json")
+	}
+	return d, nil
+}
+
+// load reads the devices seen by earlier digests.
+func (d *digest) load() {
+	if d.path == "" {
+		return
+	}
+	body, err := os.ReadFile(d.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		backend.Logger.Warn("Failed to read stored digest devices", "error", err)
+		return
+	}
+	var seen map[string]time.Time
+	if err := json.Unmarshal(body, &seen); err != nil {
+		backend.Logger.Warn("Ignoring corrupt stored digest devices", "error", err)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seen = seen
+}
+
+// save writes the seen devices aside and renames them, so a crash never
+// leaves a partial file.
+func (d *digest) save() error {
+	if d.path == "" {
+		return nil
+	}
+	d.mu.Lock()
+	body, err := json.Marshal(d.seen)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(d.path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, ".digest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path)
+}
+
+// see records devices seen at now, and returns those never seen before,
+// sorted. With commit false, as for previews, nothing is recorded. The
+// first digest only records devices, as all of them would be new.
+func (d *digest) see(devices []string, now time.Time, commit bool) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	first := len(d.seen) == 0
+	var fresh []string
+	for _, device := range devices {
+		if _, ok := d.seen[device]; ok {
+			continue
+		}
+		if !first {
+			fresh = append(fresh, device)
+		}
+		if commit {
+			d.seen[device] = now
+		}
+	}
+	sort.Strings(fresh)
+	return fresh
+}
+
+// digestReport is what a digest reports of its period.
+type digestReport struct {
+	Period string    `json:"period"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	// Uptime is the share of the period targets were up, worst first, for
+	// those with health checks or probes in it
+	Uptime      []digestUptime `json:"uptime"`
+	AlertsFired int            `json:"alertsFired"`
+	// Alerts counts the alerts that fired by name, most frequent first
+	Alerts    []digestAlert `json:"alerts"`
+	EnergyKWh *float64      `json:"energyKWh,omitempty"`
+	// Devices is how many devices were seen, nil without a devices query
+	Devices    *int     `json:"devices,omitempty"`
+	NewDevices []string `json:"newDevices,omitempty"`
+	// Errors are the parts of the digest that failed
+	Errors []string `json:"errors,omitempty"`
+}
+
+type digestUptime struct {
+	Target string  `json:"target"`
+	Uptime float64 `json:"uptime"`
+}
+
+type digestAlert struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// compileDigest compiles the digest of the period ending at now. New
+// devices are only recorded as seen with commit.
+func (ds *testDataSource) compileDigest(ctx context.Context, d *digest, now time.Time, commit bool) digestReport {
+	tr := backend.TimeRange{From: now.Add(-d.period), To: now}
+	report := digestReport{Period: d.Period, From: tr.From.UTC(), To: tr.To.UTC(), Uptime: []digestUptime{}, Alerts: []digestAlert{}}
+
+	keys, events := ds.health.window(healthHistoryQuery{}, tr)
+	for _, key := range keys {
+		share, ok := uptimeShare(events[key], tr)
+		if !ok {
+			continue
+		}
+		name := key.Target
+		if key.Vantage != "" {
+			name += " from " + key.Vantage
+		}
+		report.Uptime = append(report.Uptime, digestUptime{Target: name, Uptime: share})
+	}
+	sort.SliceStable(report.Uptime, func(i, j int) bool { return report.Uptime[i].Uptime < report.Uptime[j].Uptime })
+
+	counts := map[string]int{}
+	for _, r := range ds.alertLog.within(tr, alertHistoryQuery{}, now) {
+		if r.StartsAt.Before(tr.From) {
+			continue
+		}
+		report.AlertsFired++
+		counts[r.Labels["alertname"]]++
+	}
+	for name, count := range counts {
+		report.Alerts = append(report.Alerts, digestAlert{Name: name, Count: count})
+	}
+	sort.Slice(report.Alerts, func(i, j int) bool {
+		a, b := report.Alerts[i], report.Alerts[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Name < b.Name
+	})
+
+	query := backend.DataQuery{
+		RefID:         "A",
+		TimeRange:     tr,
+		Interval:      max(d.period/1000, time.Second),
+		MaxDataPoints: 1000,
+	}
+	if len(d.PowerQuery) > 0 {
+		energy, err := ds.digestEnergy(ctx, query, d.PowerQuery)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("energy: %v", err))
+		} else {
+			report.EnergyKWh = &energy
+		}
+	}
+	if len(d.DevicesQuery) > 0 {
+		devices, err := ds.digestDevices(ctx, query, d.DevicesQuery, d.deviceLabel)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("devices: %v", err))
+		} else {
+			count := len(devices)
+			report.Devices = &count
+			report.NewDevices = d.see(devices, now, commit)
+		}
+	}
+	return report
+}
+
+// uptimeShare returns the share of tr the events say their target was up,
+// out of the part of tr they cover, or false when they cover none of it.
+// Each event holds until the next one, the last until the end of tr.
+func uptimeShare(events []healthEvent, tr backend.TimeRange) (float64, bool) {
+	var up, covered time.Duration
+	for i, e := range events {
+		start := e.Time
+		if start.Before(tr.From) {
+			start = tr.From
+		}
+		end := tr.To
+		if i+1 < len(events) && events[i+1].Time.Before(end) {
+			end = events[i+1].Time
+		}
+		if !end.After(start) {
+			continue
+		}
+		covered += end.Sub(start)
+		if e.Up {
+			up += end.Sub(start)
+		}
+	}
+	if covered == 0 {
+		return 0, false
+	}
+	return float64(up) / float64(covered), true
+}
+
+// digestEnergy runs a power query and returns the energy of its series in
+// kWh, from the area under their points.
+func (ds *testDataSource) digestEnergy(ctx context.Context, query backend.DataQuery, inner json.RawMessage) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, digestQueryTimeout)
+	defer cancel()
+	frames, err := ds.runInnerQuery(ctx, query, inner)
+	if err != nil {
+		return 0, err
+	}
+	var wattHours float64
+	for _, frame := range frames {
+		var times *data.Field
+		for _, field := range frame.Fields {
+			if field.Type().Time() {
+				times = field
+				break
+			}
+		}
+		if times == nil {
+			return 0, fmt.Errorf("frame %q is not a time series", frame.Name)
+		}
+		for _, field := range frame.Fields {
+			if !field.Type().Numeric() {
+				continue
+			}
+			scale, err := wattScale(field)
+			if err != nil {
+				return 0, err
+			}
+			var prevTime time.Time
+			var prev *float64
+			for row := 0; row < field.Len(); row++ {
+				v, err := field.NullableFloatAt(row)
+				if err != nil {
+					return 0, err
+				}
+				t, ok := times.ConcreteAt(row)
+				if v == nil || !ok {
+					prev = nil
+					continue
+				}
+				at := t.(time.Time)
+				if prev != nil {
+					wattHours += (*prev + *v) / 2 * scale * at.Sub(prevTime).Hours()
+				}
+				prev, prevTime = v, at
+			}
+		}
+	}
+	return wattHours / 1000, nil
+}
+
+// digestDevices runs a devices query and returns the distinct values of
+// label: on its series, or in a string field of that name of its tables.
+func (ds *testDataSource) digestDevices(ctx context.Context, query backend.DataQuery, inner json.RawMessage, label string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, digestQueryTimeout)
+	defer cancel()
+	frames, err := ds.runInnerQuery(ctx, query, inner)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			if v := field.Labels[label]; v != "" {
+				set[v] = true
+			}
+			if field.Name != label {
+				continue
+			}
+			for row := 0; row < field.Len(); row++ {
+				if v, ok := field.ConcreteAt(row); ok {
+					if s, ok := v.(string); ok && s != "" {
+						set[s] = true
+					}
+				}
+			}
+		}
+	}
+	devices := make([]string, 0, len(set))
+	for device := range set {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+// message formats the report as a notification.
+func (r digestReport) message() notification {
+	title := "Homelab daily digest"
+	if r.Period == "week" {
+		title = "Homelab weekly digest"
+	}
+	const stamp = "Mon Jan 2 15:04"
+	lines := []string{fmt.Sprintf("%s – %s", r.From.Local().Format(stamp), r.To.Local().Format(stamp))}
+
+	if len(r.Uptime) > 0 {
+		parts := make([]string, len(r.Uptime))
+		for i, u := range r.Uptime {
+			parts[i] = fmt.Sprintf("%s %s%%", u.Target, formatPercent(u.Uptime))
+		}
+		lines = append(lines, "Uptime: "+strings.Join(parts, ", "))
+	}
+	alerts := "Alerts fired: none"
+	if r.AlertsFired > 0 {
+		parts := make([]string, len(r.Alerts))
+		for i, a := range r.Alerts {
+			parts[i] = fmt.Sprintf("%s ×%d", a.Name, a.Count)
+		}
+		alerts = fmt.Sprintf("Alerts fired: %d (%s)", r.AlertsFired, strings.Join(parts, ", "))
+	}
+	lines = append(lines, alerts)
+	if r.EnergyKWh != nil {
+		lines = append(lines, fmt.Sprintf("Energy used: %.2f kWh", *r.EnergyKWh))
+	}
+	if r.Devices != nil {
+		devices := fmt.Sprintf("New devices: none (%d seen)", *r.Devices)
+		if len(r.NewDevices) > 0 {
+			devices = fmt.Sprintf("New devices: %s (%d seen)", strings.Join(r.NewDevices, ", "), *r.Devices)
+		}
+		lines = append(lines, devices)
+	}
+	for _, e := range r.Errors {
+		lines = append(lines, "Failed: "+e)
+	}
+	return notification{Title: title, Text: strings.Join(lines, "\n"), Data: r}
+}
+
+// formatPercent formats a share as a percentage with up to two decimals,
+// so that short outages still show.
+func formatPercent(share float64) string {
+	s := fmt.Sprintf("%.2f", share*100)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	return s
+}
+
+// sendDigest compiles the digest of the period ending at now and sends it.
+func (ds *testDataSource) sendDigest(ctx context.Context, now time.Time) error {
+	d := ds.digest
+	report := ds.compileDigest(ctx, d, now, true)
+	if err := ds.notify(ctx, d.notifier, report.message()); err != nil {
+		return err
+	}
+	if err := d.save(); err != nil {
+		backend.Logger.Warn("Failed to store digest devices", "error", err)
+	}
+	return nil
+}
+
+// runDigest sends the digest on its schedule, until the instance is
+// disposed of.
+func (ds *testDataSource) runDigest(ctx context.Context) {
+	ds.digest.load()
+	next := ds.digest.schedule.next(time.Now())
+	if next.IsZero() {
+		backend.Logger.Warn("Digest schedule never runs", "schedule", ds.digest.Schedule)
+		return
+	}
+	job := ds.schedule.add("digest", "", 0, next)
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		now := time.Now()
+		if err := job.run(func() error { return ds.sendDigest(ctx, now) }); err != nil {
+			backend.Logger.Warn("Digest failed", "error", err)
+		}
+		next = ds.digest.schedule.next(time.Now())
+		job.plan(next)
+	}
+}
+
+// handleDigest compiles the digest of the period ending now, as it would be
+// sent, without sending it or recording the devices it sees.
+func (ds *testDataSource) handleDigest(w http.ResponseWriter, r *http.Request) {
+	if ds.digest == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("the digest is not enabled"))
+		return
+	}
+	report := ds.compileDigest(r.Context(), ds.digest, time.Now(), false)
+	writeJSON(w, http.StatusOK, report.message())
+}
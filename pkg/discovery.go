@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// warmCacheTimeout bounds how long priming the cache holds up instance
+// creation; slower scrapes finish in the background.
+const warmCacheTimeout = 10 * time.Second
+
+// discoveryIndex is what the query editor completes metric names and labels
+// from, built from a scrape of a target.
+type discoveryIndex struct {
+	ScrapedAt time.Time `json:"scrapedAt"`
+	// Names are the sorted names usable as a query's metric: metric families
+	// and their _bucket, _sum and _count series
+	Names []string `json:"names"`
+	// Labels are the sorted values of each label, by metric name
+	Labels map[string]map[string][]string `json:"labels"`
+}
+
+func newDiscoveryIndex(scrapedAt time.Time, samples []metricSample) *discoveryIndex {
+	values := map[string]map[string]map[string]bool{}
+	for _, s := range samples {
+		for _, name := range []string{s.Family, s.Name} {
+			if values[name] == nil {
+				values[name] = map[string]map[string]bool{}
+			}
+			for k, v := range s.Labels {
+				if values[name][k] == nil {
+					values[name][k] = map[string]bool{}
+				}
+				values[name][k][v] = true
+			}
+		}
+	}
+
+	index := &discoveryIndex{ScrapedAt: scrapedAt, Names: make([]string, 0, len(values)), Labels: sortedLabelValues(values)}
+	for name := range values {
+		index.Names = append(index.Names, name)
+	}
+	sort.Strings(index.Names)
+	return index
+}
+
+// sortedLabelValues turns sets of label values by metric name and label into
+// sorted lists.
+func sortedLabelValues(values map[string]map[string]map[string]bool) map[string]map[string][]string {
+	sorted := make(map[string]map[string][]string, len(values))
+	for name, labels := range values {
+		sorted[name] = make(map[string][]string, len(labels))
+		for k, set := range labels {
+			for v := range set {
+				sorted[name][k] = append(sorted[name][k], v)
+			}
+			sort.Strings(sorted[name][k])
+		}
+	}
+	return sorted
+}
+
+// discovery returns the discovery index of the last scrape of t, building it
+// on first use, or nil before the first scrape.
+func (t *scrapeTarget) discovery() *discoveryIndex {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.samples == nil {
+		return nil
+	}
+	if t.index == nil || !t.index.ScrapedAt.Equal(t.cachedAt) {
+		t.index = newDiscoveryIndex(t.cachedAt, t.samples)
+	}
+	return t.index
+}
+
+// mergeDiscovery merges the indexes of several targets.
+func mergeDiscovery(indexes []*discoveryIndex) *discoveryIndex {
+	if len(indexes) == 1 {
+		return indexes[0]
+	}
+	names := map[string]bool{}
+	values := map[string]map[string]map[string]bool{}
+	for _, index := range indexes {
+		for _, name := range index.Names {
+			names[name] = true
+		}
+		for name, labels := range index.Labels {
+			if values[name] == nil {
+				values[name] = map[string]map[string]bool{}
+			}
+			for k, vs := range labels {
+				if values[name][k] == nil {
+					values[name][k] = map[string]bool{}
+				}
+				for _, v := range vs {
+					values[name][k][v] = true
+				}
+			}
+		}
+	}
+
+	merged := &discoveryIndex{Names: make([]string, 0, len(names)), Labels: sortedLabelValues(values)}
+	for name := range names {
+		merged.Names = append(merged.Names, name)
+	}
+	sort.Strings(merged.Names)
+	return merged
+}
+
+// primeCache scrapes all targets at once and builds their discovery indexes,
+// so the first dashboard load after a restart finds them ready. It waits up
+// to warmCacheTimeout; queries of targets still being scraped then join
+// their scrape rather than starting another.
+func (ds *testDataSource) primeCache(ctx context.Context) {
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, target := range ds.targets {
+		wg.Add(1)
+		ds.startJob(func() {
+			defer wg.Done()
+			if _, err := ds.scrapeMetrics(ctx, target); err != nil {
+				backend.Logger.Warn("Failed to prime scrape cache", "target", target.Name, "error", err)
+				return
+			}
+			target.discovery()
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(warmCacheTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		backend.Logger.Info("Primed scrape cache", "targets", len(ds.targets), "duration", time.Since(start))
+	case <-timer.C:
+		backend.Logger.Warn("Scrape cache still priming, continuing in the background", "timeout", warmCacheTimeout)
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// discoverySaveInterval is how often changed discovery indexes are saved.
+const discoverySaveInterval = 5 * time.Minute
+
+// discoveryStore keeps the discovery indexes of an instance's targets in a
+// directory, so metric completion works right after a restart, before slow
+// targets are first scraped. Loaded indexes are kept in memory.
+type discoveryStore struct {
+	dir string
+
+	mu     sync.Mutex
+	loaded map[string]*discoveryIndex
+	// saved is when the index saved for each target was scraped
+	saved map[string]time.Time
+}
+
+// newDiscoveryStore returns the store of instance uid under stateDir, or nil
+// when stateDir is not set.
+func newDiscoveryStore(stateDir, uid string) *discoveryStore {
+	if stateDir == "" {
+		return nil
+	}
+	return &discoveryStore{
+		dir:    filepath.Join(stateDir, url.PathEscape(uid), "discovery"),
+		loaded: map[string]*discoveryIndex{},
+		saved:  map[string]time.Time{},
+	}
+}
+
+func (s *discoveryStore) path(target string) string {
+	return filepath.Join(s.dir, url.PathEscape(target)+".json")
+}
+
+// get returns the stored index of target, reading it on first use, or nil
+// if there is none. A nil store has none.
+func (s *discoveryStore) get(target string) *discoveryIndex {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if index, ok := s.loaded[target]; ok {
+		return index
+	}
+
+	var index *discoveryIndex
+	body, err := os.ReadFile(s.path(target))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		backend.Logger.Warn("Failed to read stored discovery index", "target", target, "error", err)
+	default:
+		if err := json.Unmarshal(body, &index); err != nil {
+			backend.Logger.Warn("Ignoring corrupt stored discovery index", "target", target, "error", err)
+			index = nil
+		}
+	}
+	s.loaded[target] = index
+	if index != nil {
+		s.saved[target] = index.ScrapedAt
+	}
+	return index
+}
+
+// save stores index as that of target, unless it is already stored.
+func (s *discoveryStore) save(target string, index *discoveryIndex) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.saved[target].Equal(index.ScrapedAt) {
+		return nil
+	}
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create %s: %w", s.dir, err)
+	}
+	// Written aside and renamed, so a crash never leaves a partial index
+	tmp, err := os.CreateTemp(s.dir, ".discovery-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(target)); err != nil {
+		return err
+	}
+	s.loaded[target] = index
+	s.saved[target] = index.ScrapedAt
+	return nil
+}
+
+// saveAll saves the discovery indexes of targets that changed since they
+// were last saved.
+func (s *discoveryStore) saveAll(targets []*scrapeTarget) {
+	for _, target := range targets {
+		index := target.discovery()
+		if index == nil {
+			continue
+		}
+		if err := s.save(target.Name, index); err != nil {
+			backend.Logger.Warn("Failed to store discovery index", "target", target.Name, "error", err)
+		}
+	}
+}
+
+// runDiscoverySaver saves the discovery indexes every discoverySaveInterval,
+// and a last time when the instance is disposed.
+func (ds *testDataSource) runDiscoverySaver(ctx context.Context) {
+	job := ds.schedule.add("discovery", "", discoverySaveInterval, time.Now().Add(discoverySaveInterval))
+	ticker := time.NewTicker(discoverySaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ds.discoveryStore.saveAll(ds.targets)
+			return
+		case <-ticker.C:
+			job.run(func() error {
+				ds.discoveryStore.saveAll(ds.targets)
+				return nil
+			})
+		}
+	}
+}
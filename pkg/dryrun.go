@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// confirmTTL is how long the confirm token of a dry run can be redeemed.
+const confirmTTL = 5 * time.Minute
+
+// confirmTokens are the tokens handed out by dry runs of destructive
+// operations, which their real runs must present: a dry run tells exactly
+// what an operation would remove, and the real run only goes ahead if it
+// still removes exactly that.
+type confirmTokens struct {
+	mu      sync.Mutex
+	pending map[string]pendingRemoval
+}
+
+// pendingRemoval is a dry run whose token hasn't been redeemed.
+type pendingRemoval struct {
+	// digest is of the operation, its user and what it would remove
+	digest  string
+	expires time.Time
+}
+
+func newConfirmTokens() *confirmTokens {
+	return &confirmTokens{pending: map[string]pendingRemoval{}}
+}
+
+// issue returns a token for a dry run of digest.
+func (c *confirmTokens) issue(digest string, now time.Time) (string, time.Time) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	expires := now.Add(confirmTTL)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for t, p := range c.pending {
+		if now.After(p.expires) {
+			delete(c.pending, t)
+		}
+	}
+	c.pending[token] = pendingRemoval{digest: digest, expires: expires}
+	return token, expires
+}
+
+// redeem uses up token, and returns why it doesn't confirm digest, with
+// the status to answer, or nil.
+func (c *confirmTokens) redeem(token, digest string, now time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pending[token]
+	delete(c.pending, token)
+	switch {
+	case token == "":
+		return http.StatusPreconditionRequired, fmt.Errorf("destructive operation: run it with dryRun=true first, and again with confirm set to the token it returns")
+	case !ok || now.After(p.expires):
+		return http.StatusPreconditionRequired, fmt.Errorf("unknown or expired confirm token, dry run the operation again")
+	case p.digest != digest:
+		return http.StatusConflict, fmt.Errorf("what the operation removes changed since its dry run, dry run it again")
+	}
+	return 0, nil
+}
+
+// removal is what a destructive operation removed, or would remove on a
+// dry run, with the token confirming it.
+type removal struct {
+	DryRun    bool     `json:"dryRun"`
+	Operation string   `json:"operation"`
+	Removes   []string `json:"removes"`
+	// ConfirmToken, of dry runs, confirms the real run until ExpiresAt
+	ConfirmToken string     `json:"confirmToken,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+}
+
+// destructive runs a destructive resource operation. With dryRun=true, it
+// answers what plan says the operation would remove, and a confirm token.
+// Otherwise the request must set confirm to the token of a dry run of the
+// same operation, by the same user, that would have removed the same, and
+// apply carries the operation out. plan returns the status to answer with
+// its error.
+func (ds *testDataSource) destructive(w http.ResponseWriter, r *http.Request, plan func() ([]string, int, error), apply func() error) {
+	query := r.URL.Query()
+	dryRun, err := parseDryRun(query.Get("dryRun"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	removes, status, err := plan()
+	if err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+	if removes == nil {
+		removes = []string{}
+	}
+	sort.Strings(removes)
+	op := operationName(r)
+	digest := removalDigest(op, auditUser(r.Context()), removes)
+	result := removal{DryRun: dryRun, Operation: op, Removes: removes}
+	now := time.Now()
+	if dryRun {
+		token, expires := ds.confirms.issue(digest, now)
+		result.ConfirmToken, result.ExpiresAt = token, &expires
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	if status, err := ds.confirms.redeem(query.Get("confirm"), digest, now); err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+	if err := apply(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func parseDryRun(raw string) (bool, error) {
+	if raw == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid dryRun %q", raw)
+	}
+	return dryRun, nil
+}
+
+// operationName names the operation of r by its method, path and query,
+// without dryRun and confirm, e.g. "DELETE /debug/faults?target=nas".
+func operationName(r *http.Request) string {
+	query := url.Values{}
+	for k, v := range r.URL.Query() {
+		if k != "dryRun" && k != "confirm" {
+			query[k] = v
+		}
+	}
+	op := r.Method + " " + strings.TrimPrefix(r.URL.Path, resourceAPIPrefix)
+	if len(query) > 0 {
+		op += "?" + query.Encode()
+	}
+	return op
+}
+
+func removalDigest(op, user string, removes []string) string {
+	h := sha256.New()
+	for _, s := range append([]string{op, user}, removes...) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
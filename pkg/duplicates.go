@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// Policies for series that several targets report.
+const (
+	duplicatesWarn   = "warn"
+	duplicatesPrefer = "prefer"
+	duplicatesMerge  = "merge"
+	duplicatesError  = "error"
+)
+
+// duplicatePolicy resolves the series that several of the targets scraping
+// the same devices report, with the same name and labels.
+type duplicatePolicy struct {
+	policy string
+	// rank orders those targets by preference, the lowest first
+	rank map[string]int
+}
+
+func newDuplicatePolicy(settings models.DuplicateSeriesSettings, targets []*scrapeTarget) (duplicatePolicy, error) {
+	p := duplicatePolicy{policy: settings.Policy, rank: map[string]int{}}
+	switch p.policy {
+	case "":
+		p.policy = duplicatesWarn
+	case duplicatesWarn, duplicatesPrefer, duplicatesMerge, duplicatesError:
+	default:
+		return p, fmt.Errorf("unknown policy %q", p.policy)
+	}
+	configured := map[string]bool{}
+	for _, t := range targets {
+		configured[t.Name] = true
+	}
+	for i, name := range settings.Targets {
+		if !configured[name] {
+			return p, fmt.Errorf("target %q is not configured", name)
+		}
+		if _, ok := p.rank[name]; ok {
+			return p, fmt.Errorf("target %q is listed twice", name)
+		}
+		p.rank[name] = i
+	}
+	return p, nil
+}
+
+// targetSeries is a series frame of a metric query and the target it came
+// from. Merged series list the targets they came from.
+type targetSeries struct {
+	target *scrapeTarget
+	frame  *data.Frame
+	merged []string
+}
+
+// resolve applies the policy to the series that several targets report,
+// which must not be labeled with their target yet.
+func (p duplicatePolicy) resolve(found []targetSeries, tr localizer) ([]targetSeries, error) {
+	if len(p.rank) < 2 {
+		return found, nil
+	}
+	groups := map[string][]targetSeries{}
+	var keys []string
+	for i, s := range found {
+		key := seriesKey(s.frame.Fields[1])
+		// Series of other targets are never duplicates
+		if _, ok := p.rank[s.target.Name]; !ok {
+			key = strconv.Itoa(i) + "\x00" + key
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], s)
+	}
+	if len(keys) == len(found) {
+		return found, nil
+	}
+
+	resolved := make([]targetSeries, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) == 1 {
+			resolved = append(resolved, group[0])
+			continue
+		}
+		sort.SliceStable(group, func(i, j int) bool { return p.rank[group[i].target.Name] < p.rank[group[j].target.Name] })
+		names := make([]string, len(group))
+		for i, s := range group {
+			names[i] = s.target.Name
+		}
+		field := group[0].frame.Fields[1]
+		series, reporters := displaySeries(field.Name, field.Labels), strings.Join(names, ", ")
+
+		switch p.policy {
+		case duplicatesError:
+			return nil, fmt.Errorf("%s is reported by targets %s", series, reporters)
+		case duplicatesPrefer:
+			notice(group[0].frame, data.NoticeSeverityInfo, tr.text(msgDuplicateSeriesPreferred, series, reporters, names[0]))
+			resolved = append(resolved, group[0])
+		case duplicatesMerge:
+			merged, err := mergeSeries(group)
+			if err != nil {
+				return nil, err
+			}
+			notice(merged.frame, data.NoticeSeverityInfo, tr.text(msgDuplicateSeriesMerged, series, reporters))
+			resolved = append(resolved, merged)
+		default:
+			for _, s := range group {
+				notice(s.frame, data.NoticeSeverityWarning, tr.text(msgDuplicateSeries, series, reporters))
+			}
+			resolved = append(resolved, group...)
+		}
+	}
+	return resolved, nil
+}
+
+func notice(frame *data.Frame, severity data.NoticeSeverity, text string) {
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.Notices = append(frame.Meta.Notices, data.Notice{Severity: severity, Text: text})
+}
+
+// mergeSeries merges the points of group into one series, taking the value
+// of the most preferred target where several have a point at a time.
+func mergeSeries(group []targetSeries) (targetSeries, error) {
+	type point struct {
+		time  time.Time
+		value *float64
+	}
+	points := map[int64]point{}
+	for _, s := range group {
+		times, values := s.frame.Fields[0], s.frame.Fields[1]
+		for i := 0; i < times.Len(); i++ {
+			t, ok := times.ConcreteAt(i)
+			if !ok {
+				continue
+			}
+			key := t.(time.Time).UnixNano()
+			if _, ok := points[key]; ok {
+				continue
+			}
+			v, err := values.NullableFloatAt(i)
+			if err != nil {
+				return targetSeries{}, err
+			}
+			points[key] = point{t.(time.Time), v}
+		}
+	}
+	sorted := make([]point, 0, len(points))
+	for _, p := range points {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].time.Before(sorted[j].time) })
+	times := make([]time.Time, len(sorted))
+	values := make([]*float64, len(sorted))
+	for i, p := range sorted {
+		times[i], values[i] = p.time, p.value
+	}
+
+	first := group[0]
+	field := first.frame.Fields[1]
+	frame := data.NewFrame(first.frame.Name,
+		data.NewField("time", nil, times),
+		data.NewField(field.Name, field.Labels, values).SetConfig(field.Config),
+	)
+	if first.frame.Meta != nil {
+		meta := *first.frame.Meta
+		frame.Meta = &meta
+	}
+	merged := make([]string, len(group))
+	for i, s := range group {
+		merged[i] = s.target.Name
+	}
+	return targetSeries{target: first.target, frame: frame, merged: merged}, nil
+}
+
+// displaySeries returns a series as its name followed by its labels, such as
+// node_load1{instance=nas}.
+func displaySeries(name string, labels data.Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return name + "{" + labels.String() + "}"
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// egressPolicy restricts the hosts the plugin connects to, so that a query
+// can't make it probe arbitrary internal endpoints. Addresses are checked as
+// they are dialed, after resolution, so a name resolving to a denied address
+// is denied too.
+type egressPolicy struct {
+	allow, deny egressRules
+}
+
+// egressRules are networks, exact host names, and domains whose subdomains
+// match.
+type egressRules struct {
+	nets    []*net.IPNet
+	hosts   map[string]bool
+	domains []string
+}
+
+func (r egressRules) empty() bool {
+	return len(r.nets) == 0 && len(r.hosts) == 0 && len(r.domains) == 0
+}
+
+func parseEgressRules(entries []string) (egressRules, error) {
+	rules := egressRules{hosts: map[string]bool{}}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(entry), "."))
+		switch {
+		case entry == "":
+			return egressRules{}, fmt.Errorf("empty egress rule")
+		case strings.Contains(entry, "/"):
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return egressRules{}, fmt.Errorf("invalid egress rule %q: %w", entry, err)
+			}
+			rules.nets = append(rules.nets, network)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			rules.nets = append(rules.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case strings.HasPrefix(entry, "*."):
+			rules.domains = append(rules.domains, entry[1:])
+		default:
+			rules.hosts[entry] = true
+		}
+	}
+	return rules, nil
+}
+
+// matches reports whether host, if known, or ip, if known, match the rules.
+func (r egressRules) matches(host string, ip net.IP) bool {
+	if host != "" {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if r.hosts[host] {
+			return true
+		}
+		for _, domain := range r.domains {
+			if strings.HasSuffix(host, domain) {
+				return true
+			}
+		}
+	}
+	if ip != nil {
+		for _, network := range r.nets {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newEgressPolicy returns the policy of settings, or nil when they allow
+// everything.
+func newEgressPolicy(settings models.EgressSettings) (*egressPolicy, error) {
+	allow, err := parseEgressRules(settings.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseEgressRules(settings.Deny)
+	if err != nil {
+		return nil, err
+	}
+	if allow.empty() && deny.empty() {
+		return nil, nil
+	}
+	return &egressPolicy{allow: allow, deny: deny}, nil
+}
+
+// check returns an error unless connecting to ip, named host if known, is
+// allowed. Denying takes precedence; with allow rules, one of them must
+// match either the name or the address. A nil policy allows everything.
+func (p *egressPolicy) check(host string, ip net.IP) error {
+	if p == nil {
+		return nil
+	}
+	name := host
+	switch {
+	case name == "":
+		name = ip.String()
+	case ip != nil && name != ip.String():
+		name += " (" + ip.String() + ")"
+	}
+	if p.deny.matches(host, ip) || (!p.allow.empty() && !p.allow.matches(host, ip)) {
+		return withCode(codeEgressDenied, fmt.Errorf("connecting to %s is not allowed by the egress settings", name))
+	}
+	return nil
+}
+
+// checkHost checks what can be told from host alone, before it is resolved:
+// denied names and addresses.
+func (p *egressPolicy) checkHost(host string) error {
+	if p == nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.check("", ip)
+	}
+	if p.deny.matches(host, nil) {
+		return withCode(codeEgressDenied, fmt.Errorf("connecting to %s is not allowed by the egress settings", host))
+	}
+	return nil
+}
+
+// checkResolved resolves host and checks all its addresses, for connections
+// not dialed by the plugin itself.
+func (p *egressPolicy) checkResolved(ctx context.Context, host string) error {
+	if p == nil {
+		return nil
+	}
+	if err := p.checkHost(host); err != nil || net.ParseIP(host) != nil {
+		return err
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	for _, ip := range ips {
+		if err := p.check(host, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// egressHostKey carries the name of the host being dialed to the dialer's
+// control function, which only sees the address.
+type egressHostKey struct{}
+
+// guard makes d check each address it connects to, named host, or else the
+// host in the context of the dial.
+func (p *egressPolicy) guard(d *net.Dialer, host string) {
+	if p == nil {
+		return
+	}
+	d.ControlContext = func(ctx context.Context, network, address string, _ syscall.RawConn) error {
+		name := host
+		if name == "" {
+			name, _ = ctx.Value(egressHostKey{}).(string)
+		}
+		ipString, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		return p.check(name, net.ParseIP(ipString))
+	}
+}
+
+// guardDial wraps dial, with a guarded dialer, to check the host of the
+// address dialed and tell it to the dialer. Unix sockets are not checked.
+func (p *egressPolicy) guardDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if p == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(network, "unix") {
+			return dial(ctx, network, addr)
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.checkHost(host); err != nil {
+			return nil, err
+		}
+		return dial(context.WithValue(ctx, egressHostKey{}, host), network, addr)
+	}
+}
+
+// dialContext dials addr if the policy allows it.
+func (p *egressPolicy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{}
+	p.guard(d, "")
+	return p.guardDial(d.DialContext)(ctx, network, addr)
+}
+
+// configureTransport makes clients built from opts check the hosts they
+// connect to.
+func (p *egressPolicy) configureTransport(opts *httpclient.Options) {
+	if p == nil {
+		return
+	}
+	timeouts := httpclient.DefaultTimeoutOptions
+	if opts.Timeouts != nil {
+		timeouts = *opts.Timeouts
+	}
+	dialer := &net.Dialer{Timeout: timeouts.DialTimeout, KeepAlive: timeouts.KeepAlive}
+	p.guard(dialer, "")
+	opts.ConfigureTransport = func(_ httpclient.Options, transport *http.Transport) {
+		transport.DialContext = p.guardDial(dialer.DialContext)
+		p.guardProxy(transport)
+	}
+}
+
+// guardProxy makes transport check the hosts of requests it sends through a
+// proxy by name, as the proxy resolves them. The proxy is checked as it is
+// dialed.
+func (p *egressPolicy) guardProxy(transport *http.Transport) {
+	if p == nil || transport.Proxy == nil {
+		return
+	}
+	proxy := transport.Proxy
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+		host := req.URL.Hostname()
+		if err := p.check(host, net.ParseIP(host)); err != nil {
+			return nil, err
+		}
+		return proxyURL, nil
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// errorCode classifies errors for the frontend and automation, which get it
+// as the prefix of query errors and the "code" of resource errors.
+type errorCode string
+
+const (
+	codeAuthFailed        errorCode = "AUTH_FAILED"
+	codeTargetUnreachable errorCode = "TARGET_UNREACHABLE"
+	codeMetricNotFound    errorCode = "METRIC_NOT_FOUND"
+	codeParseError        errorCode = "PARSE_ERROR"
+	codeLimitExceeded     errorCode = "LIMIT_EXCEEDED"
+	codeEgressDenied      errorCode = "EGRESS_DENIED"
+)
+
+// status is the response status matching the code.
+func (c errorCode) status() backend.Status {
+	switch c {
+	case codeAuthFailed:
+		return backend.StatusUnauthorized
+	case codeTargetUnreachable:
+		return backend.StatusBadGateway
+	case codeMetricNotFound:
+		return backend.StatusNotFound
+	case codeParseError:
+		return backend.StatusBadRequest
+	case codeLimitExceeded:
+		return backend.StatusTimeout
+	case codeEgressDenied:
+		return backend.StatusForbidden
+	}
+	return backend.StatusInternal
+}
+
+// codedError is an error with a code. Wrapping keeps the code, unless the
+// wrapping error has a code of its own.
+type codedError struct {
+	code errorCode
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// withCode attaches code to err.
+func withCode(code errorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+// codeOf returns the outermost code of err, or "" if it has none.
+func codeOf(err error) errorCode {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return ""
+}
+
+// errorResponse is the DataResponse of a failed query. Coded errors get
+// their code as a message prefix and a matching status.
+func errorResponse(err error) backend.DataResponse {
+	code := codeOf(err)
+	if code == "" {
+		return backend.DataResponse{Error: err}
+	}
+	return backend.DataResponse{
+		Error:  fmt.Errorf("%s: %w", code, err),
+		Status: code.status(),
+	}
+}
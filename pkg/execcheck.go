@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeExecCheck = "execcheck"
+
+// defaultExecCheckTimeout bounds a check run by the agent.
+const defaultExecCheckTimeout = 30 * time.Second
+
+// Nagios plugin exit codes.
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+)
+
+// execCheckStates are the states of checks. Unknown, for any other exit
+// code, is left out so it shows as unknown.
+var execCheckStates = stateScale{
+	"ok":       severityOK,
+	"warning":  severityWarning,
+	"critical": severityCritical,
+}
+
+// perfdataUnits are the Grafana units of Nagios performance data units of
+// measure.
+var perfdataUnits = map[string]string{
+	"s":  "s",
+	"ms": "ms",
+	"us": "µs",
+	"%":  "percent",
+	"B":  "bytes",
+	"KB": "kbytes",
+	"MB": "mbytes",
+	"GB": "gbytes",
+	"TB": "tbytes",
+}
+
+func init() {
+	registerQueryType(queryTypeExecCheck, queryExecCheck, execCheckQuery{})
+	registerConfiguredCheck(queryTypeExecCheck, func(ds *testDataSource) bool { return len(ds.settings.ExecChecks.Checks) > 0 })
+}
+
+type execCheckQuery struct {
+	// Check selects a configured check by name; empty means all of them.
+	Check string `json:"check"`
+	// Mode is "state" (default) for a table of the checks' states and
+	// output, or "perfdata" for their performance data as time series.
+	Mode string `json:"mode"`
+}
+
+// execCheckResult is the outcome of a check run, parsed from its exit code
+// and output the way Nagios does.
+type execCheckResult struct {
+	Name     string
+	ExitCode int
+	// Output is the first line of the output, LongOutput the lines after it
+	Output     string
+	LongOutput string
+	Perfdata   []perfdatum
+	Duration   time.Duration
+	Error      string
+}
+
+// state returns the textual state of the result.
+func (r execCheckResult) state() string {
+	if r.Error != "" {
+		return "unknown"
+	}
+	switch r.ExitCode {
+	case nagiosOK:
+		return "ok"
+	case nagiosWarning:
+		return "warning"
+	case nagiosCritical:
+		return "critical"
+	}
+	return "unknown"
+}
+
+// perfdatum is a value of the performance data of a check, with the
+// thresholds and bounds it reports.
+type perfdatum struct {
+	Label    string
+	Value    float64
+	Unit     string
+	Warn     string
+	Crit     string
+	Min, Max *float64
+}
+
+// parseCheckOutput splits the output of a Nagios plugin into its text and
+// performance data. Performance data follows a | on the first line and on
+// any line of the long output, e.g.
+//
+//	DISK OK - free space: / 3326 MB (56%) | /=2643MB;5948;5958;0;5968
+func parseCheckOutput(output string) (string, string, []perfdatum) {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	var perfdata []string
+	first, perf, _ := strings.Cut(lines[0], "|")
+	perfdata = append(perfdata, perf)
+
+	var long []string
+	inPerfdata := false
+	for _, line := range lines[1:] {
+		if inPerfdata {
+			perfdata = append(perfdata, line)
+			continue
+		}
+		text, perf, found := strings.Cut(line, "|")
+		long = append(long, text)
+		if found {
+			perfdata = append(perfdata, perf)
+			inPerfdata = true
+		}
+	}
+	return strings.TrimSpace(first), strings.TrimSpace(strings.Join(long, "\n")), parsePerfdata(strings.Join(perfdata, " "))
+}
+
+// parsePerfdata parses 'label'=value[UOM];[warn];[crit];[min];[max] items
+// separated by spaces. Labels may be quoted to hold spaces; malformed items
+// are skipped, as Nagios does.
+func parsePerfdata(s string) []perfdatum {
+	var result []perfdatum
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		var label string
+		if s[0] == '\'' {
+			end := strings.Index(s[1:], "'=")
+			if end < 0 {
+				break
+			}
+			label, s = strings.ReplaceAll(s[1:end+1], "''", "'"), s[end+2:]
+		} else {
+			eq := strings.IndexByte(s, '=')
+			if eq < 0 {
+				break
+			}
+			label, s = s[:eq], s[eq:]
+		}
+		s = strings.TrimPrefix(s, "=")
+		item, rest, _ := strings.Cut(s, " ")
+		s = rest
+
+		parts := strings.Split(item, ";")
+		number := strings.TrimRight(parts[0], "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ%µ")
+		value, err := strconv.ParseFloat(strings.Replace(number, ",", ".", 1), 64)
+		if err != nil || label == "" {
+			continue
+		}
+		d := perfdatum{Label: label, Value: value, Unit: parts[0][len(number):]}
+		field := func(i int) string {
+			if i < len(parts) {
+				return parts[i]
+			}
+			return ""
+		}
+		d.Warn, d.Crit = field(1), field(2)
+		d.Min, d.Max = parseFloatPtr(field(3)), parseFloatPtr(field(4))
+		result = append(result, d)
+	}
+	return result
+}
+
+// runExecChecks asks the agent to run the checks. The agent accepts a POST
+// of {"checks":[{"name","command","args","timeoutSeconds"}]} and answers
+// with {"results":[{"name","exitCode","output","durationMs","error"}]}.
+func (ds *testDataSource) runExecChecks(ctx context.Context, checks []models.ExecCheck) ([]execCheckResult, error) {
+	type agentCheck struct {
+		Name           string   `json:"name"`
+		Command        string   `json:"command"`
+		Args           []string `json:"args"`
+		TimeoutSeconds float64  `json:"timeoutSeconds"`
+	}
+	request := make([]agentCheck, len(checks))
+	timeout := time.Duration(0)
+	for i, c := range checks {
+		checkTimeout := defaultExecCheckTimeout
+		if c.TimeoutSeconds > 0 {
+			checkTimeout = time.Duration(c.TimeoutSeconds * float64(time.Second))
+		}
+		timeout = max(timeout, checkTimeout)
+		request[i] = agentCheck{Name: c.Name, Command: c.Command, Args: c.Args, TimeoutSeconds: checkTimeout.Seconds()}
+	}
+	body, err := json.Marshal(map[string]any{"checks": request})
+	if err != nil {
+		return nil, err
+	}
+	// The agent may run the checks one after the other
+	ctx, cancel := context.WithTimeout(ctx, timeout*time.Duration(len(checks)))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ds.settings.ExecChecks.AgentURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid check agent URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ds.settings.Secrets != nil && ds.settings.Secrets.ExecAgentToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ds.settings.Secrets.ExecAgentToken)
+	}
+	resp, err := send(ds.httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("check agent request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var answer struct {
+		Results []struct {
+			Name       string  `json:"name"`
+			ExitCode   int     `json:"exitCode"`
+			Output     string  `json:"output"`
+			DurationMs float64 `json:"durationMs"`
+			Error      string  `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, withCode(codeParseError, fmt.Errorf("failed to decode check agent response: %w", err))
+	}
+	byName := map[string]execCheckResult{}
+	for _, r := range answer.Results {
+		result := execCheckResult{
+			Name:     r.Name,
+			ExitCode: r.ExitCode,
+			Duration: time.Duration(r.DurationMs * float64(time.Millisecond)),
+			Error:    r.Error,
+		}
+		result.Output, result.LongOutput, result.Perfdata = parseCheckOutput(r.Output)
+		byName[r.Name] = result
+	}
+	results := make([]execCheckResult, len(checks))
+	for i, c := range checks {
+		result, ok := byName[c.Name]
+		if !ok {
+			result = execCheckResult{Name: c.Name, Error: "the agent returned no result"}
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+func queryExecCheck(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q execCheckQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	checks := ds.settings.ExecChecks.Checks
+	if len(checks) == 0 {
+		return nil, fmt.Errorf("no checks configured")
+	}
+	if q.Check != "" {
+		var selected []models.ExecCheck
+		for _, c := range checks {
+			if c.Name == q.Check {
+				selected = append(selected, c)
+			}
+		}
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("check %q is not configured", q.Check)
+		}
+		checks = selected
+	}
+
+	results, err := ds.runExecChecks(ctx, checks)
+	if err != nil {
+		return nil, err
+	}
+	switch q.Mode {
+	case "", "state":
+		return data.Frames{execCheckStateFrame(results)}, nil
+	case "perfdata":
+		return execCheckPerfdataFrames(results, time.Now()), nil
+	}
+	return nil, fmt.Errorf("unknown mode %q", q.Mode)
+}
+
+// execCheckStateFrame is the table of the checks' states, the failing ones
+// first.
+func execCheckStateFrame(results []execCheckResult) *data.Frame {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := execCheckStates.severity(results[i].state()), execCheckStates.severity(results[j].state())
+		// Unknown states rank between warnings and criticals, as in Nagios
+		rank := func(s *int64) float64 {
+			if s == nil {
+				return 1.5
+			}
+			return float64(*s)
+		}
+		return rank(a) > rank(b)
+	})
+	statusField, severityField := newStateFields(execCheckStates)
+	frame := data.NewFrame("execcheck",
+		data.NewField("check", nil, []string{}),
+		statusField,
+		severityField,
+		data.NewField("exit_code", nil, []int64{}),
+		data.NewField("output", nil, []string{}),
+		data.NewField("long_output", nil, []string{}),
+		data.NewField("duration", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "s"}),
+	)
+	for _, r := range results {
+		output := r.Output
+		if r.Error != "" {
+			output = r.Error
+		}
+		state := r.state()
+		frame.AppendRow(r.Name, state, execCheckStates.severity(state), int64(r.ExitCode), output, r.LongOutput, r.Duration.Seconds())
+	}
+	return frame
+}
+
+// execCheckPerfdataFrames returns a frame per performance data value of the
+// checks, at now, labeled with its check.
+func execCheckPerfdataFrames(results []execCheckResult, now time.Time) data.Frames {
+	var frames data.Frames
+	for _, r := range results {
+		for _, d := range r.Perfdata {
+			config := &data.FieldConfig{Unit: perfdataUnits[d.Unit]}
+			if d.Min != nil {
+				config.Min = ptrConfFloat64(*d.Min)
+			}
+			if d.Max != nil {
+				config.Max = ptrConfFloat64(*d.Max)
+			}
+			// Only plain thresholds, alerting above them, map to Grafana's;
+			// ranges such as 10:20 or @5:10 are left out
+			warn, crit := parseFloatPtr(d.Warn), parseFloatPtr(d.Crit)
+			if warn != nil || crit != nil {
+				steps := []data.Threshold{{Value: data.ConfFloat64(math.Inf(-1)), Color: "green"}}
+				if warn != nil {
+					steps = append(steps, data.Threshold{Value: data.ConfFloat64(*warn), Color: "orange"})
+				}
+				if crit != nil {
+					steps = append(steps, data.Threshold{Value: data.ConfFloat64(*crit), Color: "red"})
+				}
+				config.Thresholds = &data.ThresholdsConfig{Mode: data.ThresholdsModeAbsolute, Steps: steps}
+			}
+			frame := data.NewFrame(d.Label,
+				data.NewField("time", nil, []time.Time{now}),
+				data.NewField(d.Label, data.Labels{"check": r.Name}, []float64{d.Value}).SetConfig(config),
+			)
+			frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti}
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// queryExplain is how a query would resolve: what it selects, at which
+// resolution, what runs on the result and roughly what it costs.
+type queryExplain struct {
+	// QueryType is "metric" for metric queries
+	QueryType string `json:"queryType"`
+	// Note says what could not be explained, e.g. for collector queries
+	Note          string          `json:"note,omitempty"`
+	ExecutedQuery string          `json:"executedQuery,omitempty"`
+	Targets       []explainTarget `json:"targets"`
+	Series        int             `json:"series"`
+	Resolution    explainRes      `json:"resolution"`
+	Transforms    []string        `json:"transforms"`
+	Pipeline      []pipelineStage `json:"pipeline,omitempty"`
+	Cost          explainCost     `json:"cost"`
+	Warnings      []lintWarning   `json:"warnings"`
+	Timeout       string          `json:"timeout,omitempty"`
+	Export        *exportOptions  `json:"export,omitempty"`
+}
+
+// explainTarget is what a query selects on one target.
+type explainTarget struct {
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+	Points int    `json:"points"`
+	// LiveScrape is set for targets without history yet, which the query
+	// would scrape first
+	LiveScrape bool `json:"liveScrape,omitempty"`
+	// HighResolution is set for targets whose series would be read from
+	// their high-resolution buffer
+	HighResolution bool `json:"highResolution,omitempty"`
+}
+
+// explainRes is the resolution of a query's time series.
+type explainRes struct {
+	IntervalMs    int64 `json:"intervalMs"`
+	MaxDataPoints int64 `json:"maxDataPoints"`
+	// BucketMs is the width points are downsampled to, zero when the
+	// series are returned at full resolution
+	BucketMs int64 `json:"bucketMs"`
+	// PointsPerSeries is the most points a series would have
+	PointsPerSeries int `json:"pointsPerSeries"`
+}
+
+// explainCost estimates the work a query takes.
+type explainCost struct {
+	// SamplesScanned are the points replayed from history
+	SamplesScanned int `json:"samplesScanned"`
+	// PointsReturned are the points after downsampling
+	PointsReturned int `json:"pointsReturned"`
+	LiveScrapes    int `json:"liveScrapes"`
+}
+
+// handleExplainQuery explains how the query in the request body resolves,
+// without scraping targets or building its frames.
+func (ds *testDataSource) handleExplainQuery(w http.ResponseWriter, r *http.Request) {
+	if ds.configErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid configuration: %w", ds.configErr))
+		return
+	}
+	var req diffSide
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, withCode(codeParseError, fmt.Errorf("invalid explain request: %w", err)))
+		return
+	}
+	query, err := req.dataQuery("A")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	explain, err := ds.explainQuery(r.Context(), query)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, explain)
+}
+
+// explainQuery resolves query as ds.query does, up to fetching its data.
+func (ds *testDataSource) explainQuery(ctx context.Context, query backend.DataQuery) (queryExplain, error) {
+	query, err := ds.resolveSavedQuery(ctx, query)
+	if err != nil {
+		return queryExplain{}, err
+	}
+	if query, err = interpolateQuery(query, ds.macros); err != nil {
+		return queryExplain{}, err
+	}
+	opts, err := parseQueryOptions(query)
+	if err != nil {
+		return queryExplain{}, err
+	}
+	e := queryExplain{
+		QueryType:  query.QueryType,
+		Targets:    []explainTarget{},
+		Transforms: []string{},
+		Resolution: explainRes{IntervalMs: query.Interval.Milliseconds(), MaxDataPoints: query.MaxDataPoints},
+		Timeout:    opts.Timeout,
+		Export:     opts.Export,
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(query.JSON, &raw); err != nil {
+		return queryExplain{}, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	e.Warnings = ds.lintQuery(raw)
+
+	if _, ok := queryHandlers[query.QueryType]; ok {
+		e.Note = fmt.Sprintf("%s queries run their own collector, which is not explained", query.QueryType)
+	} else if err := ds.explainMetricQuery(query, &e); err != nil {
+		return queryExplain{}, err
+	}
+
+	if len(opts.Pipeline) > 0 {
+		if e.Pipeline, err = ds.expandPresets(opts.Pipeline); err != nil {
+			return queryExplain{}, err
+		}
+	}
+	e.Transforms = append(e.Transforms, optionTransforms(opts, e.Pipeline)...)
+	return e, nil
+}
+
+// explainMetricQuery fills e with the targets and series a metric query
+// selects, and the functions applied to them.
+func (ds *testDataSource) explainMetricQuery(query backend.DataQuery, e *queryExplain) error {
+	e.QueryType = "metric"
+	var q Query
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	switch q.Source {
+	case "", "metrics":
+	case sourceKubernetes:
+		e.QueryType = sourceKubernetes
+		e.Note = "kubernetes queries read the API server, which is not explained"
+		return nil
+	default:
+		return fmt.Errorf("unknown query source %q", q.Source)
+	}
+	if q.Metric == "" && q.MetricRegex == "" {
+		return fmt.Errorf("no metric specified in the query")
+	}
+	selector, err := newSeriesSelector(q)
+	if err != nil {
+		return err
+	}
+	targets, err := ds.queryTargets(q)
+	if err != nil {
+		return err
+	}
+	e.ExecutedQuery = executedQuery(selector, targets, q.Function, q.By)
+
+	if q.Stream {
+		e.Transforms = append(e.Transforms, "stream")
+	}
+	if q.Raw {
+		e.Transforms = append(e.Transforms, "raw values")
+	}
+	if q.Function != "" {
+		if _, err := functionStages(q.Function, q.By); err != nil {
+			return err
+		}
+		e.Transforms = append(e.Transforms, "function "+q.Function)
+	}
+	if q.BaselineCompare {
+		e.Transforms = append(e.Transforms, "baseline comparison")
+	}
+
+	var bucket time.Duration
+	for _, target := range targets {
+		t := explainTarget{Name: target.Name}
+		if target.history.empty() {
+			t.LiveScrape = true
+			e.Cost.LiveScrapes++
+			e.Targets = append(e.Targets, t)
+			continue
+		}
+		history, highRes := target.historyFor(selector, query.TimeRange)
+		t.HighResolution = highRes
+		for _, points := range history.seriesPoints(selector, query.TimeRange) {
+			d := newDownsampler(query.TimeRange, points, query.MaxDataPoints, query.Interval)
+			returned := points
+			if d.width > 0 {
+				returned = min(points, int(math.Ceil(float64(query.TimeRange.Duration())/float64(d.width)))+1)
+			}
+			bucket = max(bucket, d.width)
+			t.Series++
+			t.Points += points
+			e.Cost.PointsReturned += returned
+			e.Resolution.PointsPerSeries = max(e.Resolution.PointsPerSeries, returned)
+		}
+		e.Series += t.Series
+		e.Cost.SamplesScanned += t.Points
+		e.Targets = append(e.Targets, t)
+	}
+	e.Resolution.BucketMs = bucket.Milliseconds()
+	return nil
+}
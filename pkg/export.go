@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// exportOptions coarsen the results of a query so they can be published
+// without revealing precise usage, such as when someone is home.
+type exportOptions struct {
+	// Interval, e.g. "1h", averages time series over buckets of that
+	// length and truncates the times of tables to it.
+	Interval string `json:"interval"`
+	// Round rounds numbers to multiples of it, e.g. 10 or 0.5.
+	Round float64 `json:"round"`
+}
+
+// parse validates the options, returning the interval, zero when unset.
+func (e exportOptions) parse() (time.Duration, error) {
+	if e.Round < 0 || math.IsNaN(e.Round) || math.IsInf(e.Round, 0) {
+		return 0, fmt.Errorf("invalid export round %v, expected a positive number", e.Round)
+	}
+	if e.Interval == "" {
+		if e.Round == 0 {
+			return 0, fmt.Errorf("export needs an interval, a round, or both")
+		}
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(e.Interval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid export interval %q", e.Interval)
+	}
+	return interval, nil
+}
+
+// coarsenFrames applies opts.Export to frames. Time series are downsampled,
+// tables have their times truncated, and numbers are rounded in both; other
+// fields are left as they are.
+func coarsenFrames(frames data.Frames, opts queryOptions) (data.Frames, error) {
+	if opts.Export == nil {
+		return frames, nil
+	}
+	interval, err := opts.Export.parse()
+	if err != nil {
+		return nil, err
+	}
+	for i, frame := range frames {
+		if interval > 0 && !isTable(frame) {
+			if frame, err = downsampleFrame(frame, interval); err != nil {
+				return nil, err
+			}
+			frames[i] = frame
+		}
+		for j, field := range frame.Fields {
+			if field.Type().Time() && interval > 0 {
+				frame.Fields[j] = truncateTimes(field, interval)
+			} else if field.Type().Numeric() && opts.Export.Round > 0 {
+				if frame.Fields[j], err = roundValues(field, opts.Export.Round); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return frames, nil
+}
+
+// downsampleFrame averages the numeric fields of a time series frame over
+// buckets of interval, timestamped with the start of the bucket. Frames
+// without a time field are returned as they are.
+func downsampleFrame(frame *data.Frame, interval time.Duration) (*data.Frame, error) {
+	timeIdx := -1
+	for i, field := range frame.Fields {
+		if field.Type().Time() {
+			timeIdx = i
+			break
+		}
+	}
+	if timeIdx < 0 {
+		return frame, nil
+	}
+
+	var buckets []time.Time
+	bucketOf := make([]int, frame.Rows())
+	index := map[time.Time]int{}
+	for row := range bucketOf {
+		t, ok := frame.Fields[timeIdx].ConcreteAt(row)
+		if !ok {
+			bucketOf[row] = -1
+			continue
+		}
+		start := t.(time.Time).Truncate(interval)
+		b, ok := index[start]
+		if !ok {
+			b = len(buckets)
+			index[start] = b
+			buckets = append(buckets, start)
+		}
+		bucketOf[row] = b
+	}
+
+	out := data.NewFrame(frame.Name)
+	out.Meta = frame.Meta
+	for i, field := range frame.Fields {
+		switch {
+		case i == timeIdx:
+			times := data.NewField(field.Name, field.Labels, buckets)
+			times.Config = field.Config
+			out.Fields = append(out.Fields, times)
+		case field.Type().Numeric():
+			sums := make([]float64, len(buckets))
+			counts := make([]int, len(buckets))
+			for row, b := range bucketOf {
+				if b < 0 {
+					continue
+				}
+				v, err := field.NullableFloatAt(row)
+				if err != nil {
+					return nil, err
+				}
+				if v != nil && !math.IsNaN(*v) {
+					sums[b] += *v
+					counts[b]++
+				}
+			}
+			values := make([]*float64, len(buckets))
+			for b := range values {
+				if counts[b] > 0 {
+					mean := sums[b] / float64(counts[b])
+					values[b] = &mean
+				}
+			}
+			averaged := data.NewField(field.Name, field.Labels, values)
+			averaged.Config = field.Config
+			out.Fields = append(out.Fields, averaged)
+		default:
+			// Other values, such as states, keep the last of each bucket
+			last := data.NewFieldFromFieldType(field.Type(), len(buckets))
+			last.Name, last.Labels, last.Config = field.Name, field.Labels, field.Config
+			for row, b := range bucketOf {
+				if b >= 0 {
+					last.Set(b, field.At(row))
+				}
+			}
+			out.Fields = append(out.Fields, last)
+		}
+	}
+	return out, nil
+}
+
+// truncateTimes truncates the times of field to multiples of interval.
+func truncateTimes(field *data.Field, interval time.Duration) *data.Field {
+	out := data.NewFieldFromFieldType(field.Type(), field.Len())
+	out.Name, out.Labels, out.Config = field.Name, field.Labels, field.Config
+	for i := 0; i < field.Len(); i++ {
+		if t, ok := field.ConcreteAt(i); ok {
+			out.SetConcrete(i, t.(time.Time).Truncate(interval))
+		}
+	}
+	return out
+}
+
+// roundValues rounds the numbers of field to multiples of step, as nullable
+// floats since rounding to a fraction makes integers floats.
+func roundValues(field *data.Field, step float64) (*data.Field, error) {
+	values := make([]*float64, field.Len())
+	for i := range values {
+		v, err := field.NullableFloatAt(i)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			rounded := math.Round(*v/step) * step
+			values[i] = &rounded
+		}
+	}
+	out := data.NewField(field.Name, field.Labels, values)
+	out.Config = field.Config
+	return out, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// parseExposition parses a Prometheus text exposition body into metric
+// families keyed by name.
+func parseExposition(body []byte) (map[string]*dto.MetricFamily, error) {
+	return parseExpositionWith(&expfmt.TextParser{}, body)
+}
+
+// parseExpositionWith is parseExposition reusing parser, which must not be
+// used concurrently.
+func parseExpositionWith(parser *expfmt.TextParser, body []byte) (families map[string]*dto.MetricFamily, err error) {
+	// The parser panics on some malformed input, such as a comment followed
+	// by a line starting with a brace, which must fail the scrape rather
+	// than crash the plugin
+	defer func() {
+		if r := recover(); r != nil {
+			families, err = nil, withCode(codeParseError, fmt.Errorf("failed to parse metrics: %v", r))
+		}
+	}()
+	families, err = parser.TextToMetricFamilies(bytes.NewReader(body))
+	if err != nil {
+		return nil, withCode(codeParseError, fmt.Errorf("failed to parse metrics: %w", err))
+	}
+	return families, nil
+}
+
+// labelValue returns the value of the named label on m, or "".
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// sampleValue returns the scalar value of a counter, gauge or untyped metric.
+func sampleValue(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.GetCounter().GetValue()
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	case m.Untyped != nil:
+		return m.GetUntyped().GetValue()
+	case m.Histogram != nil:
+		return float64(m.GetHistogram().GetSampleCount())
+	case m.Summary != nil:
+		return float64(m.GetSummary().GetSampleCount())
+	}
+	return 0
+}
+
+// parseFloatPtr parses a number reported as text, or returns nil.
+func parseFloatPtr(s string) *float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
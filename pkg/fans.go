@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeFans = "fans"
+
+const (
+	defaultFanDeviation = 25
+	// fanRecentSamples are the last samples of a fan its status is judged
+	// by; the curve is fitted to those before them
+	fanRecentSamples = 5
+)
+
+var fanStates = stateScale{
+	"ok":           severityOK,
+	"running slow": severityWarning,
+	"running fast": severityWarning,
+	"stopped":      severityCritical,
+	"no data":      severityWarning,
+}
+
+func init() {
+	registerQueryType(queryTypeFans, queryFans, fanQuery{})
+}
+
+type fanQuery struct {
+	// Target selects targets as in metric queries; empty means all of them.
+	Target string `json:"target"`
+	// Deviation is how far in percent a fan may run from its curve before
+	// its status is a warning, 25 by default.
+	Deviation float64 `json:"deviation"`
+	// Mode is "series" (default) for the speed of each fan with the speed
+	// its curve expects, "curve" for the fitted curves, speed against
+	// temperature, or "status" for a row per fan flagging those that run
+	// off their curve.
+	Mode string `json:"mode"`
+}
+
+// fanSample is the speed of a fan at the hottest temperature of its target.
+// Temperature is NaN when the target exposes none.
+type fanSample struct {
+	Time        time.Time
+	Temperature float64
+	RPM         float64
+}
+
+// fanCurve is a fan's speed against temperature, fitted by least squares.
+type fanCurve struct {
+	Intercept float64
+	Slope     float64
+}
+
+func (c fanCurve) at(temperature float64) float64 {
+	return math.Max(c.Intercept+c.Slope*temperature, 0)
+}
+
+// fitFanCurve fits a curve to samples, and reports whether they had any
+// temperatures to fit it to.
+func fitFanCurve(samples []fanSample) (fanCurve, bool) {
+	var n, sumT, sumR, sumTT, sumTR float64
+	for _, s := range samples {
+		if math.IsNaN(s.Temperature) || math.IsNaN(s.RPM) {
+			continue
+		}
+		n++
+		sumT += s.Temperature
+		sumR += s.RPM
+		sumTT += s.Temperature * s.Temperature
+		sumTR += s.Temperature * s.RPM
+	}
+	if n == 0 {
+		return fanCurve{}, false
+	}
+	// A fan only seen at one temperature runs at its mean speed
+	variance := n*sumTT - sumT*sumT
+	if variance <= 0 {
+		return fanCurve{Intercept: sumR / n}, true
+	}
+	slope := (n*sumTR - sumT*sumR) / variance
+	return fanCurve{Intercept: (sumR - slope*sumT) / n, Slope: slope}, true
+}
+
+// fan is a fan of a target, and its samples.
+type fan struct {
+	Target  string
+	Name    string
+	Samples []fanSample
+}
+
+// curve fits the curve of the fan to its samples before the recent ones,
+// or to all of them when there are few.
+func (f fan) curve() (fanCurve, bool) {
+	samples := f.Samples
+	if len(samples) >= 2*fanRecentSamples {
+		samples = samples[:len(samples)-fanRecentSamples]
+	}
+	return fitFanCurve(samples)
+}
+
+// fanSamples replays the history of a target within tr for the speeds of
+// its fans, from node_hwmon_fan_rpm, and its hottest temperature, from
+// node_hwmon_temp_celsius and node_thermal_zone_temp.
+func (h *scrapeHistory) fanSamples(target string, tr backend.TimeRange) []fan {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var fans []fan
+	var series, temperatures []int
+	for i, s := range h.series {
+		switch s.Name {
+		case "node_hwmon_fan_rpm":
+			name := s.Labels["sensor"]
+			if chip := s.Labels["chip"]; chip != "" {
+				name = chip + "/" + name
+			}
+			fans = append(fans, fan{Target: target, Name: name})
+			series = append(series, i)
+		case "node_hwmon_temp_celsius", "node_thermal_zone_temp":
+			temperatures = append(temperatures, i)
+		}
+	}
+	if len(fans) == 0 {
+		return nil
+	}
+
+	current := append([]float64(nil), h.base...)
+	for _, s := range h.scrapes {
+		for _, c := range s.Changes {
+			current[c.Series] = c.Value
+		}
+		if s.Time.Before(tr.From) || s.Time.After(tr.To) {
+			continue
+		}
+		temperature := math.NaN()
+		for _, i := range temperatures {
+			if v := current[i]; !math.IsNaN(v) && (math.IsNaN(temperature) || v > temperature) {
+				temperature = v
+			}
+		}
+		for j, i := range series {
+			if rpm := current[i]; !math.IsNaN(rpm) {
+				fans[j].Samples = append(fans[j].Samples, fanSample{Time: s.Time, Temperature: temperature, RPM: rpm})
+			}
+		}
+	}
+	return fans
+}
+
+func queryFans(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q fanQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	name := q.Target
+	if name == "" {
+		name = allTargets
+	}
+	targets, err := ds.selectTargets(name)
+	if err != nil {
+		return nil, err
+	}
+	deviation := q.Deviation
+	if deviation <= 0 {
+		deviation = defaultFanDeviation
+	}
+
+	var fans []fan
+	for _, target := range targets {
+		fans = append(fans, target.history.fanSamples(target.Name, query.TimeRange)...)
+	}
+	sort.Slice(fans, func(i, j int) bool {
+		if fans[i].Target != fans[j].Target {
+			return fans[i].Target < fans[j].Target
+		}
+		return fans[i].Name < fans[j].Name
+	})
+
+	switch q.Mode {
+	case "", "series":
+		frames := make(data.Frames, 0, len(fans))
+		for _, f := range fans {
+			frames = append(frames, fanSeriesFrame(f))
+		}
+		return frames, nil
+	case "curve":
+		var frames data.Frames
+		for _, f := range fans {
+			if curve, ok := f.curve(); ok {
+				frames = append(frames, fanCurveFrame(f, curve))
+			}
+		}
+		return frames, nil
+	case "status":
+		return data.Frames{fanStatusFrame(fans, deviation)}, nil
+	default:
+		return nil, fmt.Errorf("unknown fans mode %q", q.Mode)
+	}
+}
+
+// fanSeriesFrame returns the speed of a fan with the speed its curve
+// expects at the temperature of the time, and how far it is off in percent.
+func fanSeriesFrame(f fan) *data.Frame {
+	labels := data.Labels{"target": f.Target, "fan": f.Name}
+	frame := data.NewFrame("fans",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("rpm", labels, []float64{}).SetConfig(&data.FieldConfig{Unit: "rpm"}),
+		data.NewField("expected", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "rpm"}),
+		data.NewField("deviation", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+	)
+	curve, fitted := f.curve()
+	for _, s := range f.Samples {
+		var expected, deviation *float64
+		if fitted && !math.IsNaN(s.Temperature) {
+			e := curve.at(s.Temperature)
+			expected = &e
+			if e > 0 {
+				d := (s.RPM - e) / e * 100
+				deviation = &d
+			}
+		}
+		frame.AppendRow(s.Time, s.RPM, expected, deviation)
+	}
+	frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+	return frame
+}
+
+// fanCurveFrame returns the mean speed a fan was seen at per degree, with
+// its fitted curve over them.
+func fanCurveFrame(f fan, curve fanCurve) *data.Frame {
+	labels := data.Labels{"target": f.Target, "fan": f.Name}
+	frame := data.NewFrame("fan curve",
+		data.NewField("temperature", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "celsius"}),
+		data.NewField("rpm", labels, []float64{}).SetConfig(&data.FieldConfig{Unit: "rpm"}),
+		data.NewField("fitted", labels, []float64{}).SetConfig(&data.FieldConfig{Unit: "rpm"}),
+	)
+	type bin struct {
+		sum float64
+		n   int
+	}
+	bins := map[float64]*bin{}
+	for _, s := range f.Samples {
+		if math.IsNaN(s.Temperature) {
+			continue
+		}
+		t := math.Round(s.Temperature)
+		if bins[t] == nil {
+			bins[t] = &bin{}
+		}
+		bins[t].sum += s.RPM
+		bins[t].n++
+	}
+	temperatures := make([]float64, 0, len(bins))
+	for t := range bins {
+		temperatures = append(temperatures, t)
+	}
+	sort.Float64s(temperatures)
+	for _, t := range temperatures {
+		frame.AppendRow(t, bins[t].sum/float64(bins[t].n), curve.at(t))
+	}
+	return frame
+}
+
+// fanStatusFrame returns a row per fan, judging its recent samples against
+// its curve: fans that stopped while their curve expects them to spin, and
+// fans running more than deviation percent off it, slower as they fail or
+// faster as dust builds up, are flagged.
+func fanStatusFrame(fans []fan, deviation float64) *data.Frame {
+	statusField, severityField := newStateFields(fanStates)
+	frame := data.NewFrame("fans",
+		data.NewField("target", nil, []string{}),
+		data.NewField("fan", nil, []string{}),
+		data.NewField("rpm", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "rpm"}),
+		data.NewField("expected", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "rpm"}),
+		data.NewField("deviation", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("slope", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "rpm/°C"}),
+		statusField,
+		severityField,
+	)
+	for _, f := range fans {
+		var rpm, expected, off, slope *float64
+		status := "no data"
+		curve, fitted := f.curve()
+		recent := f.Samples[max(len(f.Samples)-fanRecentSamples, 0):]
+		if len(recent) > 0 {
+			var sumRPM, sumExpected float64
+			var n int
+			for _, s := range recent {
+				if !math.IsNaN(s.Temperature) {
+					sumRPM += s.RPM
+					sumExpected += curve.at(s.Temperature)
+					n++
+				}
+			}
+			last := recent[len(recent)-1].RPM
+			rpm = &last
+			if fitted && n > 0 {
+				e, r := sumExpected/float64(n), sumRPM/float64(n)
+				s := curve.Slope
+				expected, slope = &e, &s
+				status = "ok"
+				if e > 0 {
+					d := (r - e) / e * 100
+					off = &d
+					switch {
+					case r == 0:
+						status = "stopped"
+					case d < -deviation:
+						status = "running slow"
+					case d > deviation:
+						status = "running fast"
+					}
+				}
+			}
+		}
+		frame.AppendRow(f.Target, f.Name, rpm, expected, off, slope, status, fanStates.severity(status))
+	}
+	return frame
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// featureFaultInjection enables the debug routes injecting scrape failures.
+const featureFaultInjection = "faultInjection"
+
+// Kinds of injected faults.
+const (
+	faultTimeout = "timeout"
+	faultError   = "error"
+	faultAuth    = "auth"
+	faultGarbage = "garbage"
+)
+
+const (
+	defaultFaultDuration = 5 * time.Minute
+	// faultTimeoutLimit bounds how long a timeout fault hangs a scrape whose
+	// context has no deadline
+	faultTimeoutLimit = 30 * time.Second
+)
+
+func init() {
+	registerFeature(featureFaultInjection, "Debug routes, for Grafana admins, that make scrapes of chosen targets fail, for testing alert rules and dashboards.")
+}
+
+type fault struct {
+	Target string    `json:"target"`
+	Kind   string    `json:"kind"`
+	Until  time.Time `json:"until"`
+}
+
+// faultInjector holds the faults injected into scrapes, by target name.
+// Faults expire, so a forgotten one does not break a target for good.
+type faultInjector struct {
+	mu     sync.Mutex
+	faults map[string]fault
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{faults: map[string]fault{}}
+}
+
+// active returns the unexpired fault of target. A nil injector has none.
+func (f *faultInjector) active(target string) (fault, bool) {
+	if f == nil {
+		return fault{}, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	flt, ok := f.faults[target]
+	if ok && time.Now().After(flt.Until) {
+		delete(f.faults, target)
+		return fault{}, false
+	}
+	return flt, ok
+}
+
+// list returns the unexpired faults, sorted by target.
+func (f *faultInjector) list() []fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	faults := make([]fault, 0, len(f.faults))
+	for target, flt := range f.faults {
+		if now.After(flt.Until) {
+			delete(f.faults, target)
+			continue
+		}
+		faults = append(faults, flt)
+	}
+	sort.Slice(faults, func(i, j int) bool { return faults[i].Target < faults[j].Target })
+	return faults
+}
+
+// inject fails a scrape of target as its fault says. It returns false when
+// the target has no fault, and the body to parse for garbage faults.
+func (f *faultInjector) inject(ctx context.Context, target *scrapeTarget) ([]byte, bool, error) {
+	flt, ok := f.active(target.Name)
+	if !ok {
+		return nil, false, nil
+	}
+	switch flt.Kind {
+	case faultTimeout:
+		select {
+		case <-ctx.Done():
+		case <-time.After(faultTimeoutLimit):
+		}
+		return nil, true, withCode(codeTargetUnreachable, fmt.Errorf("failed to fetch %s: injected timeout", target.URL))
+	case faultAuth:
+		return nil, true, withCode(codeAuthFailed, fmt.Errorf("%s returned 401 Unauthorized (injected)", target.URL))
+	case faultGarbage:
+		return []byte("\x00garbage {{ not metrics\n"), true, nil
+	}
+	return nil, true, withCode(codeTargetUnreachable, fmt.Errorf("%s returned 500 Internal Server Error (injected)", target.URL))
+}
+
+// requireFaultInjection writes an error and returns false unless the
+// instance enables fault injection.
+func (ds *testDataSource) requireFaultInjection(w http.ResponseWriter) bool {
+	if ds.featureEnabled(featureFaultInjection) {
+		return true
+	}
+	writeJSONError(w, http.StatusForbidden, fmt.Errorf("fault injection is disabled, enable the %s feature toggle to use it", featureFaultInjection))
+	return false
+}
+
+func (ds *testDataSource) handleListFaults(w http.ResponseWriter, _ *http.Request) {
+	if !ds.requireFaultInjection(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, ds.faults.list())
+}
+
+// handleInjectFault injects a fault described by a JSON body of
+// {"target", "kind", "durationSeconds"}, replacing any fault of the target.
+// Kinds are "timeout", "error" (a 500 response), "auth" (a 401 response)
+// and "garbage" (an unparsable body).
+func (ds *testDataSource) handleInjectFault(w http.ResponseWriter, r *http.Request) {
+	if !ds.requireFaultInjection(w) {
+		return
+	}
+	var req struct {
+		Target          string `json:"target"`
+		Kind            string `json:"kind"`
+		DurationSeconds int    `json:"durationSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("failed to decode fault: %w", err))
+		return
+	}
+	switch req.Kind {
+	case faultTimeout, faultError, faultAuth, faultGarbage:
+	default:
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("unknown fault kind %q", req.Kind))
+		return
+	}
+	targets, err := ds.selectTargets(req.Target)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	duration := defaultFaultDuration
+	if req.DurationSeconds > 0 {
+		duration = time.Duration(req.DurationSeconds) * time.Second
+	}
+
+	ds.faults.mu.Lock()
+	injected := make([]fault, 0, len(targets))
+	for _, t := range targets {
+		flt := fault{Target: t.Name, Kind: req.Kind, Until: time.Now().Add(duration)}
+		ds.faults.faults[t.Name] = flt
+		injected = append(injected, flt)
+	}
+	ds.faults.mu.Unlock()
+	changes := make([]auditChange, 0, len(injected))
+	for _, flt := range injected {
+		changes = append(changes, auditChange{Path: "faults[" + flt.Target + "]", New: flt})
+	}
+	ds.audit.record(r.Context(), auditKindFaults, fmt.Sprintf("Injected %s faults for %s", req.Kind, duration), changes...)
+	writeJSON(w, http.StatusOK, injected)
+}
+
+// handleClearFaults removes the fault of the "target" query parameter, or all
+// faults without one.
+func (ds *testDataSource) handleClearFaults(w http.ResponseWriter, r *http.Request) {
+	if !ds.requireFaultInjection(w) {
+		return
+	}
+	target := r.URL.Query().Get("target")
+	plan := func() ([]string, int, error) {
+		var removes []string
+		for _, flt := range ds.faults.list() {
+			if target == "" || flt.Target == target {
+				removes = append(removes, fmt.Sprintf("%s fault of %s", flt.Kind, flt.Target))
+			}
+		}
+		return removes, 0, nil
+	}
+	ds.destructive(w, r, plan, func() error {
+		ds.faults.mu.Lock()
+		if target == "" {
+			ds.faults.faults = map[string]fault{}
+		} else {
+			delete(ds.faults.faults, target)
+		}
+		ds.faults.mu.Unlock()
+		summary := "Cleared all faults"
+		if target != "" {
+			summary = "Cleared the fault of " + target
+		}
+		ds.audit.record(r.Context(), auditKindFaults, summary)
+		return nil
+	})
+}
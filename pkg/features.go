@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// experimentalFeatures maps the names of experimental features to their
+// descriptions. They are disabled unless enabled by the featureToggles
+// setting of an instance.
+var experimentalFeatures = map[string]string{}
+
+// queryTypeFeatures maps experimental query types to the feature gating them.
+var queryTypeFeatures = map[string]string{}
+
+func registerFeature(name, description string) {
+	experimentalFeatures[name] = description
+}
+
+// registerExperimentalQueryType registers a query type that only runs on
+// instances enabling feature.
+func registerExperimentalQueryType(name, feature string, handler queryHandler, model any) {
+	if _, ok := experimentalFeatures[feature]; !ok {
+		panic(fmt.Sprintf("query type %s requires unknown feature %s", name, feature))
+	}
+	registerQueryType(name, handler, model)
+	queryTypeFeatures[name] = feature
+}
+
+func (ds *testDataSource) featureEnabled(name string) bool {
+	return ds.settings.FeatureToggles[name]
+}
+
+// checkQueryTypeEnabled fails for experimental query types whose feature
+// the instance does not enable.
+func (ds *testDataSource) checkQueryTypeEnabled(queryType string) error {
+	feature, ok := queryTypeFeatures[queryType]
+	if !ok || ds.featureEnabled(feature) {
+		return nil
+	}
+	return fmt.Errorf("query type %s is experimental, enable the %s feature toggle to use it", queryType, feature)
+}
+
+// warnUnknownFeatures logs toggles that name no feature, which are most
+// likely typos.
+func (ds *testDataSource) warnUnknownFeatures() {
+	for name := range ds.settings.FeatureToggles {
+		if _, ok := experimentalFeatures[name]; !ok {
+			backend.Logger.Warn("Unknown feature toggle", "feature", name)
+		}
+	}
+}
+
+type featureInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// handleFeatures lists the experimental features and whether they are
+// enabled, so the query editor can hide disabled ones.
+func (ds *testDataSource) handleFeatures(w http.ResponseWriter, _ *http.Request) {
+	features := make([]featureInfo, 0, len(experimentalFeatures))
+	for name, description := range experimentalFeatures {
+		features = append(features, featureInfo{Name: name, Description: description, Enabled: ds.featureEnabled(name)})
+	}
+	sort.Slice(features, func(i, j int) bool { return features[i].Name < features[j].Name })
+	writeJSON(w, http.StatusOK, features)
+}
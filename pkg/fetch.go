@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// defaultMaxResponseMB bounds the responses read from targets and APIs
+// when MaxResponseMB is not set.
+const defaultMaxResponseMB = 64
+
+// applyClientSettings adds the instance's TLS, basic auth and custom header
+// settings to opts, on top of those Grafana configured.
+func applyClientSettings(opts *httpclient.Options, settings *models.PluginSettings) error {
+	secrets := settings.Secrets
+	if (secrets.TLSClientCert == "") != (secrets.TLSClientKey == "") {
+		return fmt.Errorf("tlsClientCert and tlsClientKey must be set together")
+	}
+
+	if settings.TLSSkipVerify || secrets.TLSCACert != "" || secrets.TLSClientCert != "" {
+		if opts.TLS == nil {
+			opts.TLS = &httpclient.TLSOptions{}
+		}
+		opts.TLS.InsecureSkipVerify = opts.TLS.InsecureSkipVerify || settings.TLSSkipVerify
+		if secrets.TLSCACert != "" {
+			opts.TLS.CACertificate = secrets.TLSCACert
+		}
+		if secrets.TLSClientCert != "" {
+			opts.TLS.ClientCertificate = secrets.TLSClientCert
+			opts.TLS.ClientKey = secrets.TLSClientKey
+		}
+	}
+
+	// Requests that set Authorization themselves, e.g. with a bearer token,
+	// keep it; basic auth only fills in for the others
+	if settings.BasicAuthUser != "" {
+		opts.BasicAuth = &httpclient.BasicAuthOptions{
+			User:     settings.BasicAuthUser,
+			Password: secrets.BasicAuthPassword,
+		}
+	}
+
+	if len(settings.Headers) > 0 {
+		if opts.Header == nil {
+			opts.Header = http.Header{}
+		}
+		for name, value := range settings.Headers {
+			opts.Header.Set(name, value)
+		}
+	}
+	return nil
+}
+
+// httpGet fetches url with the instance HTTP client and returns the body.
+func (ds *testDataSource) httpGet(ctx context.Context, url string) ([]byte, error) {
+	return ds.httpGetBearer(ctx, url, "")
+}
+
+// httpGetBearer is httpGet with a bearer token, which is omitted when empty.
+func (ds *testDataSource) httpGetBearer(ctx context.Context, url, token string) ([]byte, error) {
+	resp, err := ds.getBearer(ctx, url, token)
+	return readBody(resp, url, err, ds.maxResponseBytes())
+}
+
+// httpGetTarget is httpGetBearer for a scrape target, with its bearer token
+// or a token from its OAuth2 provider.
+func (ds *testDataSource) httpGetTarget(ctx context.Context, target *scrapeTarget) ([]byte, error) {
+	resp, err := ds.getTarget(ctx, target)
+	return readBody(resp, target.URL, err, ds.maxResponseBytes())
+}
+
+// maxResponseBytes returns the size of the largest response the instance
+// reads.
+func (ds *testDataSource) maxResponseBytes() int64 {
+	if ds.settings != nil && ds.settings.MaxResponseMB > 0 {
+		return int64(ds.settings.MaxResponseMB) << 20
+	}
+	return defaultMaxResponseMB << 20
+}
+
+// readBody reads and closes the body of resp, unless err is set. Bodies
+// larger than maxBytes fail rather than fill the memory of the plugin.
+func readBody(resp *http.Response, url string, err error, maxBytes int64) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %w", url, err)
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, withCode(codeLimitExceeded, fmt.Errorf("response from %s is larger than %d MB", url, maxBytes>>20))
+	}
+
+	return body, nil
+}
+
+// getBearer sends the request of httpGetBearer and checks the status of the
+// response, whose body the caller must close.
+func (ds *testDataSource) getBearer(ctx context.Context, url, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %s: %w", url, err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return send(ds.httpClient, req)
+}
+
+// send sends req with client and checks the status of the response, as
+// getBearer does.
+func send(client *http.Client, req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	resp, err := client.Do(req)
+	if codeOf(err) == codeEgressDenied {
+		return nil, fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	if err != nil {
+		return nil, withCode(codeTargetUnreachable, fmt.Errorf("failed to fetch %s: %w", url, err))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		resp.Body.Close()
+		return nil, withCode(codeAuthFailed, fmt.Errorf("%s returned %s", url, resp.Status))
+	default:
+		resp.Body.Close()
+		return nil, withCode(codeTargetUnreachable, fmt.Errorf("%s returned %s", url, resp.Status))
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadBodyLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		limited bool
+	}{
+		{name: "empty", size: 0},
+		{name: "at the limit", size: 1 << 20},
+		{name: "over the limit", size: 1<<20 + 1, limited: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Body: io.NopCloser(strings.NewReader(strings.Repeat("x", tt.size)))}
+			body, err := readBody(resp, "http://nas.lan:9100/metrics", nil, 1<<20)
+			var coded *codedError
+			switch {
+			case tt.limited && (!errors.As(err, &coded) || coded.code != codeLimitExceeded):
+				t.Errorf("got %v, want a %s error", err, codeLimitExceeded)
+			case !tt.limited && (err != nil || len(body) != tt.size):
+				t.Errorf("got %d bytes, %v, want %d", len(body), err, tt.size)
+			}
+		})
+	}
+}
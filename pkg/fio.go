@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeFio = "fio"
+
+const (
+	defaultFioSchedule = "30 4 * * *"
+	defaultFioSizeMB   = 64
+	defaultFioRuntime  = 10 * time.Second
+	// maxFioSizeMB and maxFioRuntime are the guardrails of benchmarks, so
+	// that they neither fill a disk nor wear an SSD out
+	maxFioSizeMB  = 1024
+	maxFioRuntime = time.Minute
+)
+
+// maxFioResults bounds the results kept per target.
+const maxFioResults = 1000
+
+// validFioPath keeps benchmark directories absolute, and without the
+// colons fio separates directories with or control characters. They are
+// quoted for the remote shell.
+var validFioPath = regexp.MustCompile(`^/[^:\x00-\x1f\x7f]*$`)
+
+// fioForbiddenPaths are where a benchmark file would write to a device or
+// to the kernel rather than to a filesystem.
+var fioForbiddenPaths = []string{"/dev", "/proc", "/sys"}
+
+func init() {
+	registerQueryType(queryTypeFio, queryFio, fioQuery{})
+	registerConfiguredCheck(queryTypeFio, func(ds *testDataSource) bool { return ds.fio != nil })
+}
+
+type fioQuery struct {
+	// Host selects the targets of a host; empty means all of them.
+	Host string `json:"host"`
+	// Mode is "timeline" (default) for IOPS and latency series per target,
+	// or "summary" for a row per target comparing its last benchmark with
+	// its median over the time range.
+	Mode string `json:"mode"`
+}
+
+type fioTarget struct {
+	host string
+	path string
+}
+
+func (t fioTarget) key() string {
+	return t.host + "\x00" + t.path
+}
+
+// fioBenchmarks are the configured fio benchmarks, and their results.
+type fioBenchmarks struct {
+	schedule cronSchedule
+	targets  []fioTarget
+	sizeMB   int
+	runtime  time.Duration
+
+	mu      sync.Mutex
+	results map[string][]fioResult
+}
+
+// fioResult is a benchmark of a target. Read and Write are nil when it
+// failed or was skipped.
+type fioResult struct {
+	Time  time.Time
+	Read  *fioStats
+	Write *fioStats
+	Error string
+}
+
+// fioStats are the IOPS and completion latencies of a direction.
+type fioStats struct {
+	IOPS   float64
+	MeanMs float64
+	P99Ms  float64
+}
+
+func newFioBenchmarks(settings models.FioSettings, sshHosts []string) (*fioBenchmarks, error) {
+	spec := settings.Schedule
+	if spec == "" {
+		spec = defaultFioSchedule
+	}
+	schedule, err := parseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	b := &fioBenchmarks{
+		schedule: schedule,
+		sizeMB:   defaultFioSizeMB,
+		runtime:  defaultFioRuntime,
+		results:  map[string][]fioResult{},
+	}
+	if settings.SizeMB > 0 {
+		if settings.SizeMB > maxFioSizeMB {
+			return nil, fmt.Errorf("sizeMb %d is over the limit of %d", settings.SizeMB, maxFioSizeMB)
+		}
+		b.sizeMB = settings.SizeMB
+	}
+	if settings.RuntimeSeconds > 0 {
+		b.runtime = time.Duration(settings.RuntimeSeconds) * time.Second
+		if b.runtime > maxFioRuntime {
+			return nil, fmt.Errorf("runtimeSeconds %d is over the limit of %d", settings.RuntimeSeconds, int(maxFioRuntime/time.Second))
+		}
+	}
+	seen := map[string]bool{}
+	for _, t := range settings.Targets {
+		target := fioTarget{host: t.Host, path: t.Path}
+		if len(target.path) > 1 {
+			target.path = strings.TrimSuffix(target.path, "/")
+		}
+		if !slices.Contains(sshHosts, t.Host) {
+			return nil, fmt.Errorf("SSH host %q is not configured", t.Host)
+		}
+		if !validFioPath.MatchString(t.Path) || strings.Contains(t.Path, "..") {
+			return nil, fmt.Errorf("invalid path %q, expected an absolute directory", t.Path)
+		}
+		for _, forbidden := range fioForbiddenPaths {
+			if target.path == forbidden || strings.HasPrefix(target.path, forbidden+"/") {
+				return nil, fmt.Errorf("path %q is not on a filesystem", t.Path)
+			}
+		}
+		if seen[target.key()] {
+			return nil, fmt.Errorf("duplicate target %s on %s", t.Path, t.Host)
+		}
+		seen[target.key()] = true
+		b.targets = append(b.targets, target)
+	}
+	return b, nil
+}
+
+func (b *fioBenchmarks) record(target fioTarget, r fioResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	history := append(b.results[target.key()], r)
+	if len(history) > maxFioResults {
+		history = history[len(history)-maxFioResults:]
+	}
+	b.results[target.key()] = history
+}
+
+// window returns the results of the targets of host (or all hosts if empty)
+// within tr, by target.
+func (b *fioBenchmarks) window(tr backend.TimeRange, host string) map[fioTarget][]fioResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	results := map[fioTarget][]fioResult{}
+	for _, target := range b.targets {
+		if host != "" && target.host != host {
+			continue
+		}
+		var rs []fioResult
+		for _, r := range b.results[target.key()] {
+			if !r.Time.Before(tr.From) && !r.Time.After(tr.To) {
+				rs = append(rs, r)
+			}
+		}
+		results[target] = rs
+	}
+	return results
+}
+
+// fioReport is the part of fio's JSON output the benchmarks read.
+type fioReport struct {
+	Jobs []struct {
+		Error int            `json:"error"`
+		Read  fioReportStats `json:"read"`
+		Write fioReportStats `json:"write"`
+	} `json:"jobs"`
+}
+
+type fioReportStats struct {
+	IOPS float64 `json:"iops"`
+	Clat struct {
+		Mean       float64            `json:"mean"`
+		Percentile map[string]float64 `json:"percentile"`
+	} `json:"clat_ns"`
+}
+
+func (s fioReportStats) stats() *fioStats {
+	return &fioStats{
+		IOPS:   s.IOPS,
+		MeanMs: s.Clat.Mean / 1e6,
+		P99Ms:  s.Clat.Percentile["99.000000"] / 1e6,
+	}
+}
+
+func parseFioReport(raw []byte) (*fioStats, *fioStats, error) {
+	// fio prints notices before the report on some versions
+	if i := strings.IndexByte(string(raw), '{'); i > 0 {
+		raw = raw[i:]
+	}
+	var report fioReport
+	if err := json.Unmarshal(raw, &report); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse fio report: %w", err)
+	}
+	if len(report.Jobs) == 0 {
+		return nil, nil, fmt.Errorf("fio report has no jobs")
+	}
+	job := report.Jobs[0]
+	if job.Error != 0 {
+		return nil, nil, fmt.Errorf("fio job failed with error %d", job.Error)
+	}
+	return job.Read.stats(), job.Write.stats(), nil
+}
+
+// freeKB parses the space available of the output of df -Pk.
+func freeKB(raw []byte) (int64, error) {
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("unexpected df output")
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output")
+	}
+	return strconv.ParseInt(fields[3], 10, 64)
+}
+
+// runFio benchmarks a target, unless its filesystem lacks twice the size of
+// the benchmark file free.
+func (ds *testDataSource) runFio(ctx context.Context, b *fioBenchmarks, target fioTarget) fioResult {
+	result := fioResult{Time: time.Now()}
+	raw, err := ds.runRemoteCommand(ctx, target.host, "df -Pk "+shellQuote(target.path))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	free, err := freeKB(raw)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if free < int64(b.sizeMB)*2*1024 {
+		result.Error = fmt.Sprintf("skipped: %s has %d MiB free, less than twice the %d MiB of the benchmark", target.path, free/1024, b.sizeMB)
+		return result
+	}
+
+	args := []string{
+		"fio", "--name=homelab-benchmark", shellQuote("--directory=" + target.path),
+		"--rw=randrw", "--bs=4k", "--direct=1", "--ioengine=psync",
+		"--size=" + strconv.Itoa(b.sizeMB) + "m",
+		"--runtime=" + strconv.Itoa(int(b.runtime/time.Second)), "--time_based",
+		"--unlink=1", "--output-format=json",
+	}
+	raw, err = ds.runRemoteCommand(ctx, target.host, strings.Join(args, " "))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if result.Read, result.Write, err = parseFioReport(raw); err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// runFioBenchmarks benchmarks the targets in turn on the schedule, until
+// the instance is disposed of.
+func (ds *testDataSource) runFioBenchmarks(ctx context.Context) {
+	b := ds.fio
+	next := b.schedule.next(time.Now())
+	if next.IsZero() {
+		backend.Logger.Warn("fio schedule never runs")
+		return
+	}
+	job := ds.schedule.add("fio", "", 0, next)
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		job.run(func() error { return ds.fioRound(ctx, func(int, int, string) {}) })
+		next = b.schedule.next(time.Now())
+		job.plan(next)
+	}
+}
+
+// fioRound benchmarks the targets in turn, reporting progress by target.
+func (ds *testDataSource) fioRound(ctx context.Context, progress operationProgress) error {
+	b := ds.fio
+	failed := 0
+	for i, target := range b.targets {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		progress(i, len(b.targets), fmt.Sprintf("benchmarking %s on %s", target.path, target.host))
+		result := ds.runFio(ctx, b, target)
+		b.record(target, result)
+		if result.Error != "" {
+			backend.Logger.Warn("fio benchmark failed", "host", target.host, "path", target.path, "error", result.Error)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d fio benchmarks failed", failed, len(b.targets))
+	}
+	return nil
+}
+
+func queryFio(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q fioQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if ds.fio == nil {
+		return nil, fmt.Errorf("no fio benchmarks configured")
+	}
+	results := ds.fio.window(query.TimeRange, q.Host)
+	targets := make([]fioTarget, 0, len(results))
+	for target := range results {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].key() < targets[j].key() })
+	switch q.Mode {
+	case "", "timeline":
+		return fioTimelineFrames(targets, results), nil
+	case "summary":
+		return data.Frames{fioSummaryFrame(targets, results)}, nil
+	default:
+		return nil, fmt.Errorf("unknown fio mode %q", q.Mode)
+	}
+}
+
+// fioTimelineFrames returns the benchmarks of each target, a frame per
+// target.
+func fioTimelineFrames(targets []fioTarget, results map[fioTarget][]fioResult) data.Frames {
+	frames := make(data.Frames, 0, len(targets))
+	for _, target := range targets {
+		labels := data.Labels{"host": target.host, "path": target.path}
+		frame := data.NewFrame("fio",
+			data.NewField("time", nil, []time.Time{}),
+			data.NewField("read_iops", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "iops"}),
+			data.NewField("write_iops", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "iops"}),
+			data.NewField("read_latency", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+			data.NewField("write_latency", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+			data.NewField("read_p99", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+			data.NewField("write_p99", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		)
+		for _, r := range results[target] {
+			var readIOPS, writeIOPS, readMean, writeMean, readP99, writeP99 *float64
+			if r.Read != nil && r.Write != nil {
+				readIOPS, readMean, readP99 = &r.Read.IOPS, &r.Read.MeanMs, &r.Read.P99Ms
+				writeIOPS, writeMean, writeP99 = &r.Write.IOPS, &r.Write.MeanMs, &r.Write.P99Ms
+			}
+			frame.AppendRow(r.Time, readIOPS, writeIOPS, readMean, writeMean, readP99, writeP99)
+		}
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// fioSummaryFrame compares the last write IOPS and p99 write latency of
+// each target with their medians over the range, so that an SSD whose
+// writes slow down stands out before S.M.A.R.T. reports it.
+func fioSummaryFrame(targets []fioTarget, results map[fioTarget][]fioResult) *data.Frame {
+	frame := data.NewFrame("fio_summary",
+		data.NewField("host", nil, []string{}),
+		data.NewField("path", nil, []string{}),
+		data.NewField("benchmarks", nil, []int64{}),
+		data.NewField("write_iops", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "iops"}),
+		data.NewField("iops_change", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("write_p99", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("latency_change", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("last_error", nil, []string{}),
+	)
+	// change returns the change of last from the median of values, in percent
+	change := func(values []float64, last float64) *float64 {
+		slices.Sort(values)
+		median := values[len(values)/2]
+		if median == 0 {
+			return nil
+		}
+		c := (last - median) / median * 100
+		return &c
+	}
+	for _, target := range targets {
+		rs := results[target]
+		var iops, p99s []float64
+		var last *fioStats
+		for _, r := range rs {
+			if r.Write != nil {
+				iops = append(iops, r.Write.IOPS)
+				p99s = append(p99s, r.Write.P99Ms)
+				last = r.Write
+			}
+		}
+		var lastIOPS, iopsChange, lastP99, latencyChange *float64
+		if last != nil {
+			lastIOPS, lastP99 = &last.IOPS, &last.P99Ms
+			iopsChange, latencyChange = change(iops, last.IOPS), change(p99s, last.P99Ms)
+		}
+		lastError := ""
+		if len(rs) > 0 {
+			lastError = rs[len(rs)-1].Error
+		}
+		frame.AppendRow(target.host, target.path, int64(len(rs)), lastIOPS, iopsChange, lastP99, latencyChange, lastError)
+	}
+	return frame
+}
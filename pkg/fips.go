@@ -0,0 +1,7 @@
+//go:build fips
+
+package main
+
+// fipsMode restricts TLS to what FIPS 140 approves of, in the plugin built
+// with the fips tag.
+const fipsMode = true
@@ -0,0 +1,6 @@
+//go:build !fips
+
+package main
+
+// fipsMode is off unless the plugin is built with the fips tag.
+const fipsMode = false
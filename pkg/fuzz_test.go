@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/experimental/concurrent"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// The fuzz targets feed the plugin malformed device output and crafted
+// query JSON, which must neither crash nor hang it. Their seeds run with
+// the other tests; to fuzz one, such as the exposition parser:
+//
+//	go test ./pkg -run '^$' -fuzz FuzzParseExposition -fuzztime 1m
+//
+// Inputs that fail are written to testdata/fuzz and run as seeds from then
+// on.
+
+// fuzzQueryTimeout is how long a fuzzed query may take before it counts
+// as a hang; queries get a shorter deadline, which they must honour.
+const fuzzQueryTimeout = 5 * time.Second
+
+func FuzzParseExposition(f *testing.F) {
+	f.Add([]byte(benchmarkExposition()))
+	f.Add([]byte("# HELP temp Temperature.\n# TYPE temp gauge\n# UNIT temp celsius\ntemp{room=\"attic\"} 21.5 1700000000000\n"))
+	f.Add([]byte("# TYPE rtt histogram\nrtt_bucket{le=\"0.1\"} 3\nrtt_bucket{le=\"+Inf\"} 5\nrtt_sum 0.7\nrtt_count 5\n"))
+	f.Add([]byte("# TYPE rpc summary\nrpc{quantile=\"0.5\"} NaN\nrpc_sum 1e308\nrpc_count -Inf\n"))
+	f.Add([]byte("up{a=\"\\\"\\n\\\\\"} 1\n"))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		families, err := parseExposition(body)
+		parseUnitLines(body)
+		if err != nil {
+			return
+		}
+		for _, s := range metricSamples(families) {
+			if _, ok := families[s.Family]; !ok {
+				t.Errorf("sample %s of no parsed family", displaySeries(s.Name, s.Labels))
+			}
+		}
+		newestTimestamp(families)
+	})
+}
+
+func FuzzFieldMapper(f *testing.F) {
+	f.Add("params.*.temperature.tC", 1, `{"method": "NotifyStatus", "params": {"ts": 1, "temperature:0": {"tC": 21.5}}}`)
+	f.Add("inverters.*.strings.*.power", 2, `{"inverters": [{"strings": [{"power": "410"}, {"power": true}]}]}`)
+	f.Add("value", 0, `{"value": 1e400}`)
+	f.Add("*", 1, `[[[]], {}, null, "1"]`)
+	f.Fuzz(func(t *testing.T, path string, wildcards int, msg string) {
+		if wildcards < 0 || wildcards > 8 {
+			return
+		}
+		keyLabels := make([]string, wildcards)
+		for i := range keyLabels {
+			keyLabels[i] = "key" + string(rune('a'+i))
+		}
+		source, err := newPushSource([]models.FieldMapping{{
+			Metric:    "fuzz_value",
+			Path:      path,
+			KeyLabels: keyLabels,
+			Labels:    map[string]string{"device": "device.id"},
+			Match:     map[string]string{"method": "NotifyStatus"},
+		}, {
+			Metric:    "fuzz_unmatched",
+			Path:      path,
+			KeyLabels: keyLabels,
+		}})
+		if err != nil {
+			return
+		}
+		samples, err := source.decode([]byte(msg))
+		if err != nil {
+			return
+		}
+		for _, s := range samples {
+			for _, label := range keyLabels {
+				if _, ok := s.Labels[label]; !ok {
+					t.Errorf("sample %s has no label %s", displaySeries(s.Name, s.Labels), label)
+				}
+			}
+		}
+	})
+}
+
+// fuzzQueryTypes are the query types FuzzQueryJSON runs, those running
+// against the histories of newTestDataSource without collectors.
+var fuzzQueryTypes = []string{"", queryTypeCapacity, queryTypeQuality, queryTypeVariable, queryTypePower}
+
+func FuzzQueryJSON(f *testing.F) {
+	f.Add(uint8(0), `{"metric": "node_load1"}`)
+	f.Add(uint8(0), `{"metric": "node_network_receive_bytes_total", "target": "*", "function": "sum", "by": ["device"]}`)
+	f.Add(uint8(0), `{"metric": "node_load1", "target": "*", "pipeline": [{"type": "smooth", "window": -1}, {"type": "topk", "k": 1e9}]}`)
+	f.Add(uint8(0), `{"metric": "node_load1", "timeout": "1ns", "legendFormat": "{{", "orderBy": "x desc desc"}`)
+	f.Add(uint8(0), `{"metric": "node_network_receive_bytes_total", "export": {"interval": "0s", "round": -1}}`)
+	for i, q := range goldenQueries {
+		f.Add(uint8(i+1), q.json)
+	}
+	f.Fuzz(func(t *testing.T, kind uint8, query string) {
+		ds := newTestDataSource()
+		ds.settings = &models.PluginSettings{}
+		// Queries scraping live, such as those of variables, fail rather
+		// than reach out
+		ds.httpClient = &http.Client{Transport: httpclient.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("fuzzed queries have no network")
+		})}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		start := time.Now()
+		// Unlike QueryData, query doesn't turn panics into errors
+		ds.query(ctx, concurrent.Query{DataQuery: backend.DataQuery{
+			RefID:         "A",
+			QueryType:     fuzzQueryTypes[int(kind)%len(fuzzQueryTypes)],
+			JSON:          []byte(query),
+			Interval:      15 * time.Second,
+			MaxDataPoints: 1000,
+			TimeRange:     backend.TimeRange{From: testStart, To: testStart.Add(10 * time.Minute)},
+		}})
+		if elapsed := time.Since(start); elapsed > fuzzQueryTimeout {
+			t.Errorf("query took %s", elapsed)
+		}
+	})
+}
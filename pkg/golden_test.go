@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/experimental"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// Golden frame tests record the frames of queries in testdata, as JSON in
+// <name>.jsonc and as the Arrow Grafana receives in <name>.arrow.txt, and
+// compare those of later runs with them. After an intended change of
+// results, rewrite them and review the diff of the JSON:
+//
+//	go test ./pkg -run Golden -update
+var updateGoldenFiles = flag.Bool("update", false, "rewrite the golden files of testdata from the current output")
+
+// goldenQuery is a query whose frames are recorded in testdata under its
+// name.
+type goldenQuery struct {
+	name          string
+	queryType     string
+	json          string
+	interval      time.Duration
+	maxDataPoints int64
+}
+
+// run runs q over the ten minutes of newTestDataSource, failing t on
+// errors.
+func (q goldenQuery) run(t *testing.T, ds *testDataSource) backend.DataResponse {
+	t.Helper()
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:         "A",
+			QueryType:     q.queryType,
+			JSON:          []byte(q.json),
+			Interval:      q.interval,
+			MaxDataPoints: q.maxDataPoints,
+			TimeRange:     backend.TimeRange{From: testStart, To: testStart.Add(10 * time.Minute)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dr := resp.Responses["A"]
+	if dr.Error != nil {
+		t.Fatal(dr.Error)
+	}
+	return dr
+}
+
+// checkGoldenFrames compares the frames of dr with the golden files of
+// name, or rewrites them with -update. Collector queries record the time
+// they ran at, which changes with every run, so it is set to testStart
+// first.
+func checkGoldenFrames(t *testing.T, name string, dr *backend.DataResponse) {
+	t.Helper()
+	for _, frame := range dr.Frames {
+		if p := provenanceOf(frame); p != nil && p.ScrapedAt != nil && p.Collector != collectorMetrics {
+			scrapedAt := testStart
+			p.ScrapedAt = &scrapedAt
+		}
+	}
+	experimental.CheckGoldenJSONResponse(t, "testdata", name, dr, *updateGoldenFiles)
+	checkGoldenArrow(t, name, dr.Frames)
+}
+
+// checkGoldenArrow compares the Arrow encoding of frames with
+// testdata/<name>.arrow.txt, a frame per line in base64, which the JSON
+// golden file can't tell apart, such as field types of the same JSON.
+func checkGoldenArrow(t *testing.T, name string, frames data.Frames) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".arrow.txt")
+	var lines []string
+	for _, frame := range frames {
+		b, err := frame.MarshalArrow()
+		if err != nil {
+			t.Fatalf("frame %q: %v", frame.Name, err)
+		}
+		lines = append(lines, base64.StdEncoding.EncodeToString(b))
+	}
+	if *updateGoldenFiles {
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("no golden Arrow file, rewrite the golden files with -update: %v", err)
+	}
+	golden := strings.Fields(string(raw))
+	if len(golden) != len(lines) {
+		t.Fatalf("%s: got %d frames, want %d", path, len(lines), len(golden))
+	}
+	for i, line := range lines {
+		if line == golden[i] {
+			continue
+		}
+		got, _ := frames[i].StringTable(-1, -1)
+		want := "(undecodable)"
+		if b, err := base64.StdEncoding.DecodeString(golden[i]); err == nil {
+			if frame, err := data.UnmarshalArrowFrame(b); err == nil {
+				want, _ = frame.StringTable(-1, -1)
+			}
+		}
+		t.Errorf("%s: frame %d differs\ngot:\n%s\nwant:\n%s", path, i, got, want)
+	}
+}
+
+// goldenQueries are the golden queries of query types other than metric
+// queries, which TestQueryDataGoldenFrames covers.
+var goldenQueries = []goldenQuery{
+	{name: "capacity", queryType: queryTypeCapacity, json: `{}`, interval: time.Minute, maxDataPoints: 1000},
+	{name: "quality", queryType: queryTypeQuality, json: `{}`, interval: time.Minute, maxDataPoints: 1000},
+	{name: "variable_targets", queryType: queryTypeVariable, json: `{"query": "targets()"}`, interval: time.Minute, maxDataPoints: 1000},
+	{name: "power_events", queryType: queryTypePower, json: `{}`, interval: time.Minute, maxDataPoints: 1000},
+}
+
+// goldenCollectorQueryTypes are the query types collecting from hosts,
+// devices and services, or from state built up while the plugin runs,
+// which golden tests don't set up. Their frames are built by the same
+// helpers as those of the others. They are named rather than referred to
+// by their constants, some of which build tags leave out.
+var goldenCollectorQueryTypes = []string{
+	"alerthistory", "attribution", "batteries", "broker", "browser",
+	"bufferbloat", "carbon", "climate", "conntrack", "cost", "database",
+	"dependencies", "execcheck", "fans", "fio", "healthhistory", "hwevents",
+	"idle", "iperf", "jobs", "macos", "mail", "mdstat", "minio", "neterrors",
+	"nextcloud", "openwrt", "ping", "powerschedule", "probe", "proxy", "publicip",
+	"raspberrypi", "script", "selftest", "slo", "slowqueries", "smart", "sql",
+	"throttling", "traceroute", "transaction", "usage", "wifi", "windows",
+}
+
+func TestQueryTypeGoldenFrames(t *testing.T) {
+	ds := newTestDataSource()
+	ds.settings = &models.PluginSettings{}
+	for _, q := range goldenQueries {
+		t.Run(q.name, func(t *testing.T) {
+			dr := q.run(t, ds)
+			checkGoldenFrames(t, q.name, &dr)
+		})
+	}
+}
+
+// TestGoldenQueryTypes fails for query types added with neither a golden
+// query nor a place among the collector query types.
+func TestGoldenQueryTypes(t *testing.T) {
+	for name := range queryHandlers {
+		covered := slices.ContainsFunc(goldenQueries, func(q goldenQuery) bool { return q.queryType == name })
+		if !covered && !slices.Contains(goldenCollectorQueryTypes, name) {
+			t.Errorf("query type %s has no golden query", name)
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// grpcResponseJSON is how responses are mapped to samples: with fields named
+// as in the .proto file, and enums as numbers so that they can be values.
+var grpcResponseJSON = protojson.MarshalOptions{UseProtoNames: true, UseEnumNumbers: true}
+
+// grpcSource is what is scraped from a gRPC service. Scrapes gather its
+// health and the responses of its methods in a JSON document, which parse
+// maps to samples, so that gRPC services are cached, recorded and checked
+// like other targets.
+type grpcSource struct {
+	health  []string
+	methods []grpcMethod
+	// files are the configured descriptors; without them, methods are
+	// looked up through server reflection
+	files *protoregistry.Files
+
+	mu       sync.Mutex
+	resolved map[string]protoreflect.MethodDescriptor
+}
+
+type grpcMethod struct {
+	// name is the full name of the method, as <service>/<method>
+	name    string
+	request []byte
+	mapper  fieldMapper
+}
+
+// grpcScrape is the document of a gRPC scrape: the health status of each
+// service, and the response of each method as JSON.
+type grpcScrape struct {
+	Health    map[string]string          `json:"health"`
+	Responses map[string]json.RawMessage `json:"responses"`
+}
+
+func newGRPCSource(settings models.GRPCSettings) (*grpcSource, error) {
+	s := &grpcSource{health: settings.Health, resolved: map[string]protoreflect.MethodDescriptor{}}
+	for _, m := range settings.Methods {
+		mapper, err := newFieldMapper(m.Samples)
+		if err != nil {
+			return nil, fmt.Errorf("method %s: %w", m.Method, err)
+		}
+		s.methods = append(s.methods, grpcMethod{name: m.Method, request: []byte(m.Request), mapper: mapper})
+	}
+	if settings.DescriptorSet == "" {
+		return s, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(settings.DescriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set is not base64: %w", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+	if s.files, err = protodesc.NewFiles(&set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+	// Methods are checked now, rather than on the first scrape
+	for _, m := range s.methods {
+		desc, err := findMethod(s.files, m.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.decodeRequest(desc, dynamicpb.NewMessage(desc.Input())); err != nil {
+			return nil, err
+		}
+		s.resolved[m.name] = desc
+	}
+	return s, nil
+}
+
+func (m grpcMethod) decodeRequest(desc protoreflect.MethodDescriptor, req *dynamicpb.Message) error {
+	if len(m.request) == 0 {
+		return nil
+	}
+	if err := protojson.Unmarshal(m.request, req); err != nil {
+		return fmt.Errorf("method %s: invalid request for %s: %w", m.name, desc.Input().FullName(), err)
+	}
+	return nil
+}
+
+// method returns the descriptor of the named method, looking it up through
+// server reflection the first time when no descriptors are configured.
+func (s *grpcSource) method(ctx context.Context, conn *grpc.ClientConn, name string) (protoreflect.MethodDescriptor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if desc, ok := s.resolved[name]; ok {
+		return desc, nil
+	}
+	files := s.files
+	if files == nil {
+		service, _, _ := strings.Cut(name, "/")
+		var err error
+		if files, err = reflectFiles(ctx, conn, service); err != nil {
+			return nil, err
+		}
+	}
+	desc, err := findMethod(files, name)
+	if err != nil {
+		return nil, err
+	}
+	s.resolved[name] = desc
+	return desc, nil
+}
+
+// findMethod returns the descriptor of a unary method named
+// <service>/<method>.
+func findMethod(files *protoregistry.Files, name string) (protoreflect.MethodDescriptor, error) {
+	service, method, _ := strings.Cut(name, "/")
+	d, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, fmt.Errorf("service %s not found: %w", service, err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", service)
+	}
+	desc := sd.Methods().ByName(protoreflect.Name(method))
+	if desc == nil {
+		return nil, fmt.Errorf("service %s has no method %s", service, method)
+	}
+	if desc.IsStreamingClient() || desc.IsStreamingServer() {
+		return nil, fmt.Errorf("method %s is streaming, only unary methods can be scraped", name)
+	}
+	return desc, nil
+}
+
+// reflectFiles gets the descriptors of the file defining symbol, and of its
+// dependencies, through server reflection.
+func reflectFiles(ctx context.Context, conn *grpc.ClientConn, symbol string) (*protoregistry.Files, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, grpcError("server reflection", err)
+	}
+	defer func() { _ = stream.CloseSend() }()
+
+	protos := map[string]*descriptorpb.FileDescriptorProto{}
+	request := func(req *reflectionpb.ServerReflectionRequest) error {
+		if err := stream.Send(req); err != nil {
+			return grpcError("server reflection", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return grpcError("server reflection", err)
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return fmt.Errorf("server reflection failed: %s", e.GetErrorMessage())
+		}
+		for _, raw := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fd := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(raw, fd); err != nil {
+				return fmt.Errorf("server reflection sent an invalid descriptor: %w", err)
+			}
+			protos[fd.GetName()] = fd
+		}
+		return nil
+	}
+	if err := request(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+	}); err != nil {
+		return nil, err
+	}
+
+	// Servers may leave out dependencies, such as those they sent before
+	// on the stream. Well-known types are linked in the plugin.
+	checked := map[string]bool{}
+	for {
+		var missing []string
+		for name, fd := range protos {
+			if checked[name] {
+				continue
+			}
+			checked[name] = true
+			for _, dep := range fd.GetDependency() {
+				if protos[dep] == nil {
+					missing = append(missing, dep)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+		for _, dep := range missing {
+			if protos[dep] != nil {
+				continue
+			}
+			if strings.HasPrefix(dep, "google/protobuf/") {
+				if fd, err := protoregistry.GlobalFiles.FindFileByPath(dep); err == nil {
+					protos[dep] = protodesc.ToFileDescriptorProto(fd)
+					continue
+				}
+			}
+			if err := request(&reflectionpb.ServerReflectionRequest{
+				MessageRequest: &reflectionpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+			}); err != nil {
+				return nil, err
+			}
+			if protos[dep] == nil {
+				return nil, fmt.Errorf("server reflection did not send %s", dep)
+			}
+		}
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range protos {
+		set.File = append(set.File, fd)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("server reflection sent invalid descriptors: %w", err)
+	}
+	return files, nil
+}
+
+// grpcError describes a failed call, with codeTargetUnreachable when the
+// service could not be reached.
+func grpcError(what string, err error) error {
+	err = fmt.Errorf("%s failed: %w", what, err)
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return withCode(codeTargetUnreachable, err)
+	}
+	return err
+}
+
+// grpcGetTarget scrapes a gRPC service, returning the JSON document of its
+// health and responses.
+func (ds *testDataSource) grpcGetTarget(ctx context.Context, target *scrapeTarget) ([]byte, error) {
+	conn, err := ds.grpcConns.get(target)
+	if err != nil {
+		return nil, err
+	}
+	if target.Token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+target.Token)
+	}
+
+	scrape := grpcScrape{Health: map[string]string{}, Responses: map[string]json.RawMessage{}}
+	health := grpc_health_v1.NewHealthClient(conn)
+	for _, service := range target.grpc.health {
+		resp, err := health.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+		switch {
+		case status.Code(err) == codes.NotFound:
+			scrape.Health[service] = grpc_health_v1.HealthCheckResponse_SERVICE_UNKNOWN.String()
+		case err != nil:
+			return nil, grpcError(fmt.Sprintf("health check of %q", service), err)
+		default:
+			scrape.Health[service] = resp.GetStatus().String()
+		}
+	}
+
+	for _, m := range target.grpc.methods {
+		desc, err := target.grpc.method(ctx, conn, m.name)
+		if err != nil {
+			return nil, err
+		}
+		req := dynamicpb.NewMessage(desc.Input())
+		if err := m.decodeRequest(desc, req); err != nil {
+			return nil, err
+		}
+		resp := dynamicpb.NewMessage(desc.Output())
+		if err := conn.Invoke(ctx, "/"+m.name, req, resp); err != nil {
+			return nil, grpcError(m.name, err)
+		}
+		out, err := grpcResponseJSON.Marshal(resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode response of %s: %w", m.name, err)
+		}
+		scrape.Responses[m.name] = out
+	}
+	return json.Marshal(scrape)
+}
+
+// parse maps the document of a scrape to samples: grpc_health_serving, 1
+// while a service is serving, labeled with the service, and the samples
+// mapped from each method's response.
+func (s *grpcSource) parse(body []byte) ([]metricSample, error) {
+	var scrape grpcScrape
+	if err := json.Unmarshal(body, &scrape); err != nil {
+		return nil, withCode(codeParseError, fmt.Errorf("invalid gRPC scrape: %w", err))
+	}
+
+	var samples sampleSet
+	services := make([]string, 0, len(scrape.Health))
+	for service := range scrape.Health {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		serving := 0.0
+		if scrape.Health[service] == grpc_health_v1.HealthCheckResponse_SERVING.String() {
+			serving = 1
+		}
+		samples.add("grpc_health_serving", data.Labels{"service": service}, serving)
+	}
+	for _, m := range s.methods {
+		raw, ok := scrape.Responses[m.name]
+		if !ok {
+			continue
+		}
+		var v any
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, withCode(codeParseError, fmt.Errorf("invalid response of %s: %w", m.name, err))
+		}
+		for _, sample := range m.mapper.apply(v) {
+			samples.add(sample.Name, sample.Labels, sample.Value)
+		}
+	}
+	return samples.list(), nil
+}
+
+// grpcConns keeps one connection per gRPC target for the lifetime of the
+// instance.
+type grpcConns struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+
+	tlsConfig *tls.Config
+	egress    *egressPolicy
+}
+
+// newGRPCConns returns the connections of gRPC targets, with the TLS
+// settings of clients built from opts and the egress policy.
+func newGRPCConns(opts httpclient.Options, egress *egressPolicy) (*grpcConns, error) {
+	tlsConfig, err := clientTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcConns{conns: map[string]*grpc.ClientConn{}, tlsConfig: tlsConfig, egress: egress}, nil
+}
+
+// get returns the connection of target. Connections are established on
+// their first call, and reestablished as needed.
+func (p *grpcConns) get(target *scrapeTarget) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if conn, ok := p.conns[target.Name]; ok {
+		return conn, nil
+	}
+	u, err := url.Parse(target.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", redactURL(target.URL), err)
+	}
+	creds := insecure.NewCredentials()
+	if u.Scheme == "grpcs" {
+		creds = credentials.NewTLS(p.tlsConfig.Clone())
+	}
+	// The host is resolved as it is dialed, so that the egress policy
+	// checks it by name
+	conn, err := grpc.NewClient("passthrough:///"+u.Host,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return p.egress.dialContext(ctx, "tcp", addr)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", redactURL(target.URL), err)
+	}
+	p.conns[target.Name] = conn
+	return conn, nil
+}
+
+func (p *grpcConns) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name, conn := range p.conns {
+		if err := conn.Close(); err != nil {
+			backend.Logger.Warn("Failed to close gRPC connection", "target", name, "error", err)
+		}
+	}
+	p.conns = map[string]*grpc.ClientConn{}
+}
+
+// grpcServices lists the services of a gRPC target and their methods.
+type grpcServices struct {
+	Target   string        `json:"target"`
+	Services []grpcService `json:"services,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type grpcService struct {
+	Name    string           `json:"name"`
+	Methods []grpcMethodInfo `json:"methods"`
+}
+
+type grpcMethodInfo struct {
+	Name   string `json:"name"`
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	// Streaming methods can't be scraped
+	Streaming bool `json:"streaming,omitempty"`
+}
+
+// handleGRPCServices lists the services of the selected gRPC targets, from
+// their descriptors or through server reflection, to help configure their
+// methods.
+func (ds *testDataSource) handleGRPCServices(w http.ResponseWriter, r *http.Request) {
+	targets, err := ds.selectTargets(r.URL.Query().Get("target"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	results := []grpcServices{}
+	for _, target := range targets {
+		if target.grpc == nil {
+			continue
+		}
+		result := grpcServices{Target: target.Name}
+		if result.Services, err = ds.listGRPCServices(r.Context(), target); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (ds *testDataSource) listGRPCServices(ctx context.Context, target *scrapeTarget) ([]grpcService, error) {
+	files := target.grpc.files
+	var names []string
+	if files != nil {
+		files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+			for i := 0; i < fd.Services().Len(); i++ {
+				names = append(names, string(fd.Services().Get(i).FullName()))
+			}
+			return true
+		})
+	} else {
+		conn, err := ds.grpcConns.get(target)
+		if err != nil {
+			return nil, err
+		}
+		if target.Token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+target.Token)
+		}
+		if names, err = reflectServices(ctx, conn); err != nil {
+			return nil, err
+		}
+		// Each service is looked up on its own, as servers only send the
+		// files asked for and their dependencies
+		reflected := &protoregistry.Files{}
+		for _, name := range names {
+			serviceFiles, err := reflectFiles(ctx, conn, name)
+			if err != nil {
+				return nil, err
+			}
+			serviceFiles.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+				if _, err := reflected.FindFileByPath(fd.Path()); errors.Is(err, protoregistry.NotFound) {
+					_ = reflected.RegisterFile(fd)
+				}
+				return true
+			})
+		}
+		files = reflected
+	}
+	sort.Strings(names)
+
+	var services []grpcService
+	for _, name := range names {
+		d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			continue
+		}
+		sd, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+		service := grpcService{Name: name, Methods: []grpcMethodInfo{}}
+		for i := 0; i < sd.Methods().Len(); i++ {
+			m := sd.Methods().Get(i)
+			service.Methods = append(service.Methods, grpcMethodInfo{
+				Name:      name + "/" + string(m.Name()),
+				Input:     string(m.Input().FullName()),
+				Output:    string(m.Output().FullName()),
+				Streaming: m.IsStreamingClient() || m.IsStreamingServer(),
+			})
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// reflectServices lists the services of a server through server reflection,
+// but for the reflection service itself.
+func reflectServices(ctx context.Context, conn *grpc.ClientConn) ([]string, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, grpcError("server reflection", err)
+	}
+	defer func() { _ = stream.CloseSend() }()
+	if err := stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+	}); err != nil {
+		return nil, grpcError("server reflection", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, grpcError("server reflection", err)
+	}
+	if e := resp.GetErrorResponse(); e != nil {
+		return nil, fmt.Errorf("server reflection failed: %s", e.GetErrorMessage())
+	}
+	var names []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		if !strings.HasPrefix(s.GetName(), "grpc.reflection.") {
+			names = append(names, s.GetName())
+		}
+	}
+	return names, nil
+}
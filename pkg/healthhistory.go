@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeHealthHistory = "healthhistory"
+
+const defaultHealthHistoryRetention = 7 * 24 * time.Hour
+
+// maxHealthEvents bounds the events kept per target and source, whatever the
+// retention.
+const maxHealthEvents = 20000
+
+// Sources of health events.
+const (
+	healthSourceCheck = "check"
+	healthSourceProbe = "probe"
+)
+
+func init() {
+	registerQueryType(queryTypeHealthHistory, queryHealthHistory, healthHistoryQuery{})
+}
+
+type healthHistoryQuery struct {
+	// Target selects events by target name; empty means all targets.
+	Target string `json:"target"`
+	// Source is "check" for health checks or "probe" for probes; empty means
+	// both.
+	Source string `json:"source"`
+}
+
+type healthEvent struct {
+	Time    time.Time
+	Up      bool
+	Latency time.Duration
+	Error   string
+}
+
+// healthKey identifies a timeline. Vantage is only set for probes.
+type healthKey struct {
+	Target  string
+	Source  string
+	Vantage string
+}
+
+// healthHistory keeps health check and probe results per target, so outages
+// can be looked up after the fact.
+type healthHistory struct {
+	retention time.Duration
+
+	mu     sync.Mutex
+	events map[healthKey][]healthEvent
+}
+
+func newHealthHistory(retention time.Duration) *healthHistory {
+	return &healthHistory{retention: retention, events: map[healthKey][]healthEvent{}}
+}
+
+func (h *healthHistory) record(key healthKey, event healthEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := append(h.events[key], event)
+	cutoff := event.Time.Add(-h.retention)
+	drop := sort.Search(len(events), func(i int) bool { return !events[i].Time.Before(cutoff) })
+	if len(events)-drop > maxHealthEvents {
+		drop = len(events) - maxHealthEvents
+	}
+	h.events[key] = events[drop:]
+}
+
+func (h *healthHistory) recordCheck(health targetHealth, at time.Time) {
+	h.record(healthKey{Target: health.Name, Source: healthSourceCheck}, healthEvent{
+		Time:    at,
+		Up:      health.Status == "ok",
+		Latency: time.Duration(health.LatencyMs * float64(time.Millisecond)),
+		Error:   health.Error,
+	})
+}
+
+func (h *healthHistory) recordProbes(results []probeResult) {
+	for _, r := range results {
+		h.record(healthKey{Target: r.Target, Source: healthSourceProbe, Vantage: r.Vantage}, healthEvent{
+			Time:    r.Time,
+			Up:      r.Up,
+			Latency: r.Latency,
+			Error:   r.Error,
+		})
+	}
+}
+
+// window returns the events matching q within tr, along with the last event
+// before tr so the timeline starts in the right state. Keys are sorted.
+func (h *healthHistory) window(q healthHistoryQuery, tr backend.TimeRange) ([]healthKey, map[healthKey][]healthEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var keys []healthKey
+	events := map[healthKey][]healthEvent{}
+	for key, history := range h.events {
+		if (q.Target != "" && key.Target != q.Target) || (q.Source != "" && key.Source != q.Source) {
+			continue
+		}
+		start := sort.Search(len(history), func(i int) bool { return !history[i].Time.Before(tr.From) })
+		end := sort.Search(len(history), func(i int) bool { return history[i].Time.After(tr.To) })
+		if start > 0 {
+			start--
+		}
+		if start >= end {
+			continue
+		}
+		keys = append(keys, key)
+		events[key] = append([]healthEvent(nil), history[start:end]...)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Vantage < b.Vantage
+	})
+	return keys, events
+}
+
+func healthHistoryRetention(hours int) time.Duration {
+	if hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return defaultHealthHistoryRetention
+}
+
+func queryHealthHistory(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q healthHistoryQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	switch q.Source {
+	case "", healthSourceCheck, healthSourceProbe:
+	default:
+		return nil, fmt.Errorf("unknown health history source %q", q.Source)
+	}
+
+	keys, events := ds.health.window(q, query.TimeRange)
+	frames := make(data.Frames, 0, len(keys))
+	for _, key := range keys {
+		frames = append(frames, healthTimelineFrame(key, events[key], query.TimeRange))
+	}
+	return frames, nil
+}
+
+// healthTimelineFrame turns events into state changes, for the state timeline
+// panel: a row where the target went up or down, with the error that took
+// it down, and a closing row at the last event. The state before the time
+// range is carried over to its start.
+func healthTimelineFrame(key healthKey, events []healthEvent, tr backend.TimeRange) *data.Frame {
+	labels := data.Labels{"target": key.Target, "source": key.Source}
+	if key.Vantage != "" {
+		labels["vantage"] = key.Vantage
+	}
+	frame := data.NewFrame("health_history",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("up", labels, []float64{}).SetConfig(upConfig()),
+		data.NewField("error", nil, []string{}),
+	)
+
+	for i, e := range events {
+		t := e.Time
+		if t.Before(tr.From) {
+			t = tr.From
+		}
+		changed := i == 0 || e.Up != events[i-1].Up || (!e.Up && e.Error != events[i-1].Error)
+		if !changed && i < len(events)-1 {
+			continue
+		}
+		var up float64
+		if e.Up {
+			up = 1
+		}
+		frame.AppendRow(t, up, e.Error)
+	}
+	frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+	return frame
+}
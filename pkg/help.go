@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// builtinMacros are the variables every query can use, besides dashboard
+// variables and the user macros.
+var builtinMacros = []string{"__interval", "__interval_ms", "__range", "__range_s", "__range_ms", "__from", "__to"}
+
+// helpContent is what the query editor shows to help write queries on an
+// instance: its metrics and examples built from its real targets.
+type helpContent struct {
+	GeneratedAt  time.Time       `json:"generatedAt"`
+	Targets      []helpTarget    `json:"targets"`
+	Metrics      []helpMetric    `json:"metrics"`
+	QueryTypes   []helpQueryType `json:"queryTypes"`
+	Examples     []helpExample   `json:"examples"`
+	Functions    []string        `json:"functions"`
+	Macros       []string        `json:"macros"`
+	SavedQueries []string        `json:"savedQueries"`
+}
+
+type helpTarget struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Scraped is false for targets not scraped since the plugin started,
+	// whose metrics are missing unless they were stored
+	Scraped bool `json:"scraped"`
+}
+
+type helpMetric struct {
+	Name    string   `json:"name"`
+	Unit    string   `json:"unit,omitempty"`
+	Labels  []string `json:"labels"`
+	Targets []string `json:"targets"`
+}
+
+// helpQueryType describes an enabled query type. Those not configured
+// return no data until they are.
+type helpQueryType struct {
+	Name       string   `json:"name"`
+	Configured bool     `json:"configured"`
+	Fields     []string `json:"fields"`
+}
+
+// helpExample is a query the editor can insert as it is.
+type helpExample struct {
+	Title string         `json:"title"`
+	Query map[string]any `json:"query"`
+}
+
+// helpContent builds the help of the instance from the metrics its targets
+// reported last. It never scrapes, so it is cheap to load with the editor.
+func (ds *testDataSource) helpContent(user string) helpContent {
+	help := helpContent{
+		GeneratedAt:  time.Now().UTC(),
+		Targets:      []helpTarget{},
+		Metrics:      []helpMetric{},
+		Examples:     []helpExample{},
+		Functions:    []string{"rate", "delta", "sum", "avg", "min", "max", "count"},
+		Macros:       append([]string(nil), builtinMacros...),
+		SavedQueries: []string{},
+	}
+
+	metrics := map[string]*helpMetric{}
+	for _, target := range ds.targets {
+		index := target.discovery()
+		scraped := index != nil
+		if index == nil {
+			index = ds.discoveryStore.get(target.Name)
+		}
+		help.Targets = append(help.Targets, helpTarget{Name: target.Name, Labels: target.Labels, Scraped: scraped})
+		if index == nil {
+			continue
+		}
+		for _, name := range index.Names {
+			m, ok := metrics[name]
+			if !ok {
+				m = &helpMetric{Name: name, Unit: ds.units.unit(name, target.declaredUnits()), Labels: []string{}}
+				metrics[name] = m
+			}
+			m.Targets = append(m.Targets, target.Name)
+			for label := range index.Labels[name] {
+				if !containsString(m.Labels, label) {
+					m.Labels = append(m.Labels, label)
+				}
+			}
+		}
+	}
+	for _, m := range metrics {
+		sort.Strings(m.Labels)
+		help.Metrics = append(help.Metrics, *m)
+	}
+	sort.Slice(help.Metrics, func(i, j int) bool { return help.Metrics[i].Name < help.Metrics[j].Name })
+
+	for name, model := range queryModels {
+		if ds.checkQueryTypeEnabled(name) != nil {
+			continue
+		}
+		help.QueryTypes = append(help.QueryTypes, helpQueryType{
+			Name:       name,
+			Configured: ds.queryTypeConfigured(name),
+			Fields:     jsonFieldNames(reflect.TypeOf(model)),
+		})
+	}
+	sort.Slice(help.QueryTypes, func(i, j int) bool { return help.QueryTypes[i].Name < help.QueryTypes[j].Name })
+
+	help.Examples = ds.helpExamples(help.Metrics, help.QueryTypes)
+	for name := range ds.macros {
+		help.Macros = append(help.Macros, name)
+	}
+	sort.Strings(help.Macros[len(builtinMacros):])
+	if ds.savedQueries != nil {
+		for _, q := range ds.savedQueries.list(user) {
+			help.SavedQueries = append(help.SavedQueries, q.Name)
+		}
+	}
+	return help
+}
+
+// helpExamples returns example metric queries on real metrics, a gauge and
+// a counter when there are some, and an example of each configured query
+// type taking a target.
+func (ds *testDataSource) helpExamples(metrics []helpMetric, queryTypes []helpQueryType) []helpExample {
+	var examples []helpExample
+	var gauge, counter *helpMetric
+	for i := range metrics {
+		m := &metrics[i]
+		switch {
+		case counter == nil && strings.HasSuffix(m.Name, "_total"):
+			counter = m
+		case gauge == nil && !strings.HasSuffix(m.Name, "_total") && !strings.HasSuffix(m.Name, "_bucket") &&
+			!strings.HasSuffix(m.Name, "_count") && !strings.HasSuffix(m.Name, "_sum") && len(m.Labels) > 0:
+			gauge = m
+		}
+	}
+	if gauge != nil {
+		label := gauge.Labels[0]
+		examples = append(examples,
+			helpExample{
+				Title: "Plot " + gauge.Name + " of " + gauge.Targets[0],
+				Query: map[string]any{"metric": gauge.Name, "target": gauge.Targets[0], "legendFormat": "{{" + label + "}}"},
+			},
+			helpExample{
+				Title: "Average " + gauge.Name + " by " + label + " over all targets",
+				Query: map[string]any{"metric": gauge.Name, "target": allTargets, "function": "avg", "by": []string{label}},
+			},
+		)
+	}
+	if counter != nil {
+		examples = append(examples, helpExample{
+			Title: "Per-second rate of " + counter.Name,
+			Query: map[string]any{"metric": counter.Name, "target": counter.Targets[0], "function": "rate"},
+		})
+	}
+
+	if len(ds.targets) == 0 {
+		return examples
+	}
+	target := ds.targets[0].Name
+	for _, qt := range queryTypes {
+		if !qt.Configured || !containsString(qt.Fields, "target") {
+			continue
+		}
+		examples = append(examples, helpExample{
+			Title: "Run a " + qt.Name + " query on " + target,
+			Query: map[string]any{"queryType": qt.Name, "target": target},
+		})
+	}
+	return examples
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHelp serves the help of the instance, for the query editor to show
+// examples on the user's own targets and metrics.
+func (ds *testDataSource) handleHelp(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ds.helpContent(auditUser(r.Context())))
+}
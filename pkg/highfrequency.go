@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+// High-frequency mode is meant for scraping a handful of targets every
+// second. It keeps the overhead of each scrape down by reusing connections,
+// read buffers and parsers, and by resolving target hosts ahead of time
+// rather than for every new connection.
+
+const (
+	highFrequencyScrapeInterval = time.Second
+	dnsRefreshInterval          = time.Minute
+	// highFrequencyIdleTimeout keeps connections open well past the scrape
+	// interval, so each scrape reuses the previous one's connection
+	highFrequencyIdleTimeout = 5 * time.Minute
+)
+
+// scrapeScratch is what a high-frequency target reuses between scrapes.
+// Scrapes of a target never overlap, as they all go through its flight
+// group.
+type scrapeScratch struct {
+	body   bytes.Buffer
+	parser expfmt.TextParser
+}
+
+// applyHighFrequency makes clients built from opts keep connections open and
+// dial the addresses in dns, which egress allows.
+func applyHighFrequency(opts *httpclient.Options, dns *dnsCache, egress *egressPolicy) {
+	timeouts := httpclient.DefaultTimeoutOptions
+	if opts.Timeouts != nil {
+		timeouts = *opts.Timeouts
+	}
+	timeouts.IdleConnTimeout = highFrequencyIdleTimeout
+	opts.Timeouts = &timeouts
+
+	dialer := &net.Dialer{Timeout: timeouts.DialTimeout, KeepAlive: timeouts.KeepAlive}
+	egress.guard(dialer, "")
+	opts.ConfigureTransport = func(_ httpclient.Options, transport *http.Transport) {
+		transport.DialContext = egress.guardDial(dns.dialContext(dialer))
+		egress.guardProxy(transport)
+	}
+}
+
+// fetchBody fetches a target's metrics, into its scratch buffer in
+// high-frequency mode. The body is only valid until the next scrape.
+func (ds *testDataSource) fetchBody(ctx context.Context, target *scrapeTarget) ([]byte, error) {
+	if body, injected, err := ds.faults.inject(ctx, target); injected {
+		return body, err
+	}
+	if target.grpc != nil {
+		return ds.grpcGetTarget(ctx, target)
+	}
+	if target.scratch == nil {
+		return ds.httpGetTarget(ctx, target)
+	}
+
+	resp, err := ds.getTarget(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	target.scratch.body.Reset()
+	if _, err := target.scratch.body.ReadFrom(resp.Body); err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %w", target.URL, err)
+	}
+	return target.scratch.body.Bytes(), nil
+}
+
+// dnsCache resolves hosts ahead of connecting to them, and refreshes them in
+// the background.
+type dnsCache struct {
+	resolver *net.Resolver
+
+	mu    sync.RWMutex
+	addrs map[string][]string
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{resolver: net.DefaultResolver, addrs: map[string][]string{}}
+}
+
+// resolve returns the cached addresses of host, looking it up on a miss.
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]string, error) {
+	c.mu.RLock()
+	addrs, ok := c.addrs[host]
+	c.mu.RUnlock()
+	if ok {
+		return addrs, nil
+	}
+	return c.lookup(ctx, host)
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.addrs[host] = addrs
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// run resolves hosts right away and then every dnsRefreshInterval, as runs
+// of job. Failed lookups keep the previous addresses.
+func (c *dnsCache) run(ctx context.Context, hosts []string, job *scheduledJob) {
+	ticker := time.NewTicker(dnsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		job.run(func() error {
+			var failed error
+			for _, host := range hosts {
+				if _, err := c.lookup(ctx, host); err != nil && ctx.Err() == nil {
+					backend.Logger.Warn("Failed to resolve target host", "host", host, "error", err)
+					failed = err
+				}
+			}
+			return failed
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dialContext dials the cached addresses of a host in turn.
+func (c *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		addrs, err := c.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// targetHosts returns the distinct hosts of targets.
+func targetHosts(targets []*scrapeTarget) []string {
+	seen := map[string]bool{}
+	var hosts []string
+	for _, target := range targets {
+		u, err := url.Parse(target.URL)
+		if err != nil || u.Hostname() == "" || net.ParseIP(u.Hostname()) != nil || seen[u.Hostname()] {
+			continue
+		}
+		seen[u.Hostname()] = true
+		hosts = append(hosts, u.Hostname())
+	}
+	return hosts
+}
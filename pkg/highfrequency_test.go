@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// benchmarkExposition is a node exporter sized response: 50 families of 4
+// series each.
+func benchmarkExposition() string {
+	var b strings.Builder
+	for f := 0; f < 50; f++ {
+		fmt.Fprintf(&b, "# HELP node_metric_%d A metric.\n# TYPE node_metric_%d gauge\n", f, f)
+		for s := 0; s < 4; s++ {
+			fmt.Fprintf(&b, "node_metric_%d{device=\"eth%d\",mode=\"idle\"} %d.5\n", f, s, f*s)
+		}
+	}
+	return b.String()
+}
+
+func benchmarkFetchMetrics(b *testing.B, highFrequency bool) {
+	body := benchmarkExposition()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	settings := &models.PluginSettings{
+		URL:           server.URL,
+		HighFrequency: highFrequency,
+		Secrets:       &models.SecretPluginSettings{},
+	}
+	opts := httpclient.Options{}
+	if highFrequency {
+		applyHighFrequency(&opts, newDNSCache(), nil)
+	}
+	client, err := httpclient.New(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	targets, err := newScrapeTargets(settings, defaultHistory)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ds := &testDataSource{httpClient: client, settings: settings}
+
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ds.fetchMetrics(ctx, targets[0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFetchMetrics(b *testing.B) {
+	benchmarkFetchMetrics(b, false)
+}
+
+func BenchmarkFetchMetricsHighFrequency(b *testing.B) {
+	benchmarkFetchMetrics(b, true)
+}
+
+func BenchmarkParseExposition(b *testing.B) {
+	body := []byte(benchmarkExposition())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseExposition(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseExpositionReusingParser(b *testing.B) {
+	body := []byte(benchmarkExposition())
+	var scratch scrapeScratch
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseExpositionWith(&scratch.parser, body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const (
+	defaultHighResolutionInterval  = 250 * time.Millisecond
+	minHighResolutionInterval      = 50 * time.Millisecond
+	defaultHighResolutionRetention = 10 * time.Minute
+)
+
+// highResolution keeps the series of a target sampled more than once a
+// second, such as the power of an appliance as it starts, in a short buffer
+// of their own. The target's history and its other series keep their
+// resolution, and queries within the buffer read it instead of the history.
+type highResolution struct {
+	metrics      map[string]bool
+	interval     time.Duration
+	retention    time.Duration
+	calibrations []calibration
+	history      *scrapeHistory
+}
+
+func newHighResolution(settings models.HighResolutionSettings, calibrations []calibration) (*highResolution, error) {
+	if len(settings.Metrics) == 0 {
+		return nil, fmt.Errorf("no metrics to sample")
+	}
+	r := &highResolution{
+		metrics:      map[string]bool{},
+		interval:     defaultHighResolutionInterval,
+		retention:    defaultHighResolutionRetention,
+		calibrations: calibrations,
+	}
+	for _, m := range settings.Metrics {
+		if !metricNameRe.MatchString(m) {
+			return nil, fmt.Errorf("invalid metric name %q", m)
+		}
+		r.metrics[m] = true
+	}
+	if settings.IntervalMs != 0 {
+		r.interval = time.Duration(settings.IntervalMs) * time.Millisecond
+		if r.interval < minHighResolutionInterval {
+			return nil, fmt.Errorf("intervalMs must be at least %d", minHighResolutionInterval.Milliseconds())
+		}
+	}
+	if settings.RetentionSeconds < 0 {
+		return nil, fmt.Errorf("retentionSeconds must not be negative")
+	}
+	if settings.RetentionSeconds > 0 {
+		r.retention = time.Duration(settings.RetentionSeconds) * time.Second
+	}
+	r.history = newScrapeHistory(r.retention)
+	return r, nil
+}
+
+// filter returns the sampled series among samples.
+func (r *highResolution) filter(samples []metricSample) []metricSample {
+	var sampled []metricSample
+	for _, s := range samples {
+		if r.metrics[s.Family] || r.metrics[s.Name] {
+			sampled = append(sampled, s)
+		}
+	}
+	return sampled
+}
+
+// record records the sampled series among samples, which are not
+// calibrated yet, as taken at now, to the millisecond. A nil buffer
+// records nothing.
+func (r *highResolution) record(samples []metricSample, now time.Time) {
+	if r == nil {
+		return
+	}
+	if sampled := r.filter(samples); len(sampled) > 0 {
+		r.history.record(now.Truncate(time.Millisecond), calibrate(r.calibrations, sampled))
+	}
+}
+
+// insert stores the sampled series among late samples taken at t, already
+// calibrated, if t is still within the buffer at now.
+func (r *highResolution) insert(t time.Time, samples []metricSample, keep bool, now time.Time) {
+	if r == nil || t.Before(now.Add(-r.retention)) {
+		return
+	}
+	if sampled := r.filter(samples); len(sampled) > 0 {
+		r.history.insert(t, sampled, keep)
+	}
+}
+
+// historyFor returns the history queries of sel over tr read: the
+// high-resolution buffer when it samples the metric sel names and holds the
+// whole of tr, and the target's history otherwise.
+func (t *scrapeTarget) historyFor(sel seriesSelector, tr backend.TimeRange) (*scrapeHistory, bool) {
+	r := t.highRes
+	if r == nil || !r.metrics[sel.Metric] || r.history.empty() || tr.From.Before(time.Now().Add(-r.retention)) {
+		return t.history, false
+	}
+	return r.history, true
+}
+
+// runHighResolution samples the high-resolution series of a scraped target
+// until the instance is disposed of. Samples are fetched apart from the
+// scrapes of the target, which keep their interval and cache.
+func (ds *testDataSource) runHighResolution(ctx context.Context, target *scrapeTarget) {
+	r := target.highRes
+	job := ds.schedule.add("high-resolution", target.Name, r.interval, time.Now())
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		err := job.run(func() error { return ds.sampleHighResolution(ctx, target) })
+		// Samples come several times a second, so failures are logged as
+		// they start and end rather than each time
+		switch {
+		case err != nil && !failing:
+			backend.Logger.Warn("High-resolution sampling failed", "target", target.Name, "error", err)
+		case err == nil && failing:
+			backend.Logger.Info("High-resolution sampling recovered", "target", target.Name)
+		}
+		failing = err != nil
+		select {
+		case <-ctx.Done():
+			return
+		case <-ds.drain:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sampleHighResolution fetches a target once and records its
+// high-resolution series. The body is parsed without the target's scratch
+// parser, which its scrapes may be using.
+func (ds *testDataSource) sampleHighResolution(ctx context.Context, target *scrapeTarget) error {
+	var body []byte
+	var err error
+	if target.grpc != nil {
+		body, err = ds.grpcGetTarget(ctx, target)
+	} else {
+		body, err = ds.httpGetTarget(ctx, target)
+	}
+	fetched := time.Now()
+	if err != nil {
+		return err
+	}
+	if target.parser != nil {
+		samples, err := target.parser(body)
+		if err != nil {
+			return err
+		}
+		target.highRes.record(samples, fetched)
+		return nil
+	}
+	families, err := parseExposition(body)
+	if err != nil {
+		return err
+	}
+	target.highRes.record(metricSamples(families), fetched)
+	return nil
+}
@@ -0,0 +1,901 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	defaultScrapeInterval = 15 * time.Second
+	defaultScrapeTimeout  = 10 * time.Second
+	defaultHistory        = 6 * time.Hour
+	defaultCacheTTL       = 5 * time.Second
+)
+
+var (
+	scrapeCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "grafana_plugin",
+			Name:      "scrape_cache_hits_total",
+			Help:      "Scrapes answered from the scrape cache.",
+		},
+	)
+
+	scrapeCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "grafana_plugin",
+			Name:      "scrape_cache_misses_total",
+			Help:      "Scrapes that had to fetch the target.",
+		},
+	)
+)
+
+// scrapeHistory keeps successive scrapes of the metrics endpoint so queries
+// can return time series instead of a single value. Series are interned and
+// each scrape only stores the values that changed since the previous one,
+// which keeps mostly static exporters cheap. A NaN value marks a series
+// missing from a scrape.
+type scrapeHistory struct {
+	mu        sync.Mutex
+	retention time.Duration
+	series    []seriesInfo
+	index     map[string]int
+	// base holds the values of the series just before the oldest scrape
+	// kept, and last those after the newest, both indexed by series
+	base    []float64
+	last    []float64
+	scrapes []scrape
+}
+
+type scrape struct {
+	Time    time.Time
+	Changes []seriesValue
+}
+
+// seriesValue is a value of the series at index Series.
+type seriesValue struct {
+	Series int
+	Value  float64
+}
+
+// seriesInfo identifies one series. Family is the metric family it came from,
+// which differs from Name for histogram and summary _bucket, _sum and _count
+// series.
+type seriesInfo struct {
+	Family string
+	Name   string
+	Labels data.Labels
+}
+
+// metricSample is one series and its value in a scrape.
+type metricSample struct {
+	seriesInfo
+	Value float64
+}
+
+func newScrapeHistory(retention time.Duration) *scrapeHistory {
+	return &scrapeHistory{retention: retention, index: map[string]int{}}
+}
+
+func (h *scrapeHistory) record(now time.Time, samples []metricSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seen := make([]bool, len(h.series), len(h.series)+len(samples))
+	var changes []seriesValue
+	for _, s := range samples {
+		key := s.Name + s.Labels.String()
+		i, ok := h.index[key]
+		if !ok {
+			i = len(h.series)
+			h.index[key] = i
+			h.series = append(h.series, s.seriesInfo)
+			h.base = append(h.base, math.NaN())
+			h.last = append(h.last, math.NaN())
+			seen = append(seen, false)
+		}
+		seen[i] = true
+		if h.last[i] != s.Value {
+			changes = append(changes, seriesValue{Series: i, Value: s.Value})
+			h.last[i] = s.Value
+		}
+	}
+	for i, ok := range seen {
+		if !ok && !math.IsNaN(h.last[i]) {
+			changes = append(changes, seriesValue{Series: i, Value: math.NaN()})
+			h.last[i] = math.NaN()
+		}
+	}
+	h.scrapes = append(h.scrapes, scrape{Time: now, Changes: changes})
+
+	cutoff := now.Add(-h.retention)
+	drop := 0
+	for drop < len(h.scrapes) && h.scrapes[drop].Time.Before(cutoff) {
+		for _, c := range h.scrapes[drop].Changes {
+			h.base[c.Series] = c.Value
+		}
+		drop++
+	}
+	h.scrapes = h.scrapes[drop:]
+}
+
+// insert stores samples taken at t, which is at most the time of the last
+// scrape, such as those an agent buffered while offline. The values of other
+// series at t are left as they were, and those of the samples' series after
+// t too. A series already holding a value at t keeps it if keep is set, and
+// takes the sample's otherwise. It returns how many samples were stored and
+// how many were kept out by a value already there.
+func (h *scrapeHistory) insert(t time.Time, samples []metricSample, keep bool) (stored, conflicts int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pos := sort.Search(len(h.scrapes), func(i int) bool { return !h.scrapes[i].Time.Before(t) })
+	exists := pos < len(h.scrapes) && h.scrapes[pos].Time.Equal(t)
+	if !exists {
+		h.scrapes = slices.Insert(h.scrapes, pos, scrape{Time: t})
+	}
+	// The values of the series just before t
+	before := append([]float64(nil), h.base...)
+	for _, sc := range h.scrapes[:pos] {
+		for _, c := range sc.Changes {
+			before[c.Series] = c.Value
+		}
+	}
+
+	at := &h.scrapes[pos]
+	for _, s := range samples {
+		key := s.Name + s.Labels.String()
+		i, ok := h.index[key]
+		if !ok {
+			i = len(h.series)
+			h.index[key] = i
+			h.series = append(h.series, s.seriesInfo)
+			h.base = append(h.base, math.NaN())
+			h.last = append(h.last, math.NaN())
+			before = append(before, math.NaN())
+		}
+		old, j := before[i], changeIndex(at.Changes, i)
+		if j >= 0 {
+			old = at.Changes[j].Value
+		}
+		if exists && !math.IsNaN(old) && keep {
+			conflicts++
+			continue
+		}
+		if j >= 0 {
+			at.Changes[j].Value = s.Value
+		} else {
+			at.Changes = append(at.Changes, seriesValue{Series: i, Value: s.Value})
+		}
+		stored++
+		// The series takes its old value back after t, unless it changes
+		// anyway
+		if pos == len(h.scrapes)-1 {
+			h.last[i] = s.Value
+			continue
+		}
+		next := &h.scrapes[pos+1]
+		if changeIndex(next.Changes, i) < 0 && old != s.Value {
+			next.Changes = append(next.Changes, seriesValue{Series: i, Value: old})
+		}
+	}
+	return stored, conflicts
+}
+
+// changeIndex returns the index of the change to series i in changes, or -1.
+func changeIndex(changes []seriesValue, i int) int {
+	for j, c := range changes {
+		if c.Series == i {
+			return j
+		}
+	}
+	return -1
+}
+
+// empty reports whether nothing has been scraped yet.
+func (h *scrapeHistory) empty() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.scrapes) == 0
+}
+
+// lastScraped returns the time of the last scrape, nil before the first.
+func (h *scrapeHistory) lastScraped() *time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.scrapes) == 0 {
+		return nil
+	}
+	t := h.scrapes[len(h.scrapes)-1].Time
+	return &t
+}
+
+// within reports whether t is within from and to, either of which may be
+// zero for no bound.
+func within(t, from, to time.Time) bool {
+	return !t.Before(from) && (to.IsZero() || !t.After(to))
+}
+
+// matching returns the series matching sel that have values between from
+// and to, as displaySeries formats them. Zero bounds are open.
+func (h *scrapeHistory) matching(sel seriesSelector, from, to time.Time) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	found := make([]bool, len(h.series))
+	current := append([]float64(nil), h.base...)
+	for _, sc := range h.scrapes {
+		for _, c := range sc.Changes {
+			current[c.Series] = c.Value
+		}
+		if !within(sc.Time, from, to) {
+			continue
+		}
+		for i, v := range current {
+			found[i] = found[i] || !math.IsNaN(v)
+		}
+	}
+	var names []string
+	for i, s := range h.series {
+		if found[i] && sel.matches(s) {
+			names = append(names, displaySeries(s.Name, s.Labels))
+		}
+	}
+	return names
+}
+
+// seriesMatching returns the series matching sel, with values or not.
+func (h *scrapeHistory) seriesMatching(sel seriesSelector) []seriesInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []seriesInfo
+	for _, s := range h.series {
+		if sel.matches(s) {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// purge deletes the values of the series matching sel between from and
+// to, and the series themselves without bounds. Scrapes are kept, as the
+// other series still have values at their times; compact frees what the
+// deleted values leave behind.
+func (h *scrapeHistory) purge(sel seriesSelector, from, to time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	matched := make([]bool, len(h.series))
+	for i, s := range h.series {
+		matched[i] = sel.matches(s)
+	}
+	if from.IsZero() && to.IsZero() {
+		h.dropSeries(func(i int) bool { return matched[i] })
+		return
+	}
+
+	// The series go missing at the first scrape within the range, and take
+	// the value they had at its end back at the first scrape after it
+	current := append([]float64(nil), h.base...)
+	entered, left := false, false
+	for j := range h.scrapes {
+		sc := &h.scrapes[j]
+		changed := make(map[int]bool, len(sc.Changes))
+		for _, c := range sc.Changes {
+			current[c.Series] = c.Value
+			changed[c.Series] = true
+		}
+		switch {
+		case within(sc.Time, from, to):
+			changes := sc.Changes[:0]
+			for _, c := range sc.Changes {
+				if !matched[c.Series] {
+					changes = append(changes, c)
+				}
+			}
+			if !entered {
+				for i := range matched {
+					if matched[i] {
+						changes = append(changes, seriesValue{Series: i, Value: math.NaN()})
+					}
+				}
+				entered = true
+			}
+			sc.Changes = changes
+		case entered && !left:
+			for i := range matched {
+				if matched[i] && !changed[i] {
+					sc.Changes = append(sc.Changes, seriesValue{Series: i, Value: current[i]})
+				}
+			}
+			left = true
+		}
+	}
+	if entered && !left {
+		for i := range matched {
+			if matched[i] {
+				h.last[i] = math.NaN()
+			}
+		}
+	}
+}
+
+// compact frees what deleted values leave behind: changes to the value a
+// series already has, the series without any value left, and the spare
+// capacity of the changes of scrapes. It returns how many changes and
+// series it freed.
+func (h *scrapeHistory) compact() (changes, series int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	valued := make([]bool, len(h.series))
+	current := append([]float64(nil), h.base...)
+	for i, v := range current {
+		valued[i] = !math.IsNaN(v)
+	}
+	for j := range h.scrapes {
+		sc := &h.scrapes[j]
+		kept := make([]seriesValue, 0, len(sc.Changes))
+		for _, c := range sc.Changes {
+			old := current[c.Series]
+			if old == c.Value || math.IsNaN(old) && math.IsNaN(c.Value) {
+				changes++
+				continue
+			}
+			current[c.Series] = c.Value
+			valued[c.Series] = valued[c.Series] || !math.IsNaN(c.Value)
+			kept = append(kept, c)
+		}
+		if len(kept) == 0 {
+			kept = nil
+		}
+		sc.Changes = kept
+	}
+	series = h.dropSeries(func(i int) bool { return !valued[i] })
+	return changes, series
+}
+
+// dropSeries deletes the series drop reports, with their values in all
+// scrapes, and returns how many there were. h.mu must be held.
+func (h *scrapeHistory) dropSeries(drop func(i int) bool) int {
+	// renumber maps the series kept to their new index, and the others to -1
+	renumber := make([]int, len(h.series))
+	kept := 0
+	for i, s := range h.series {
+		if drop(i) {
+			renumber[i] = -1
+			continue
+		}
+		renumber[i] = kept
+		h.series[kept], h.base[kept], h.last[kept] = s, h.base[i], h.last[i]
+		kept++
+	}
+	dropped := len(h.series) - kept
+	if dropped == 0 {
+		return 0
+	}
+	h.series = slices.Clip(h.series[:kept])
+	h.base, h.last = slices.Clip(h.base[:kept]), slices.Clip(h.last[:kept])
+	h.index = make(map[string]int, kept)
+	for i, s := range h.series {
+		h.index[s.Name+s.Labels.String()] = i
+	}
+	for j := range h.scrapes {
+		changes := h.scrapes[j].Changes[:0]
+		for _, c := range h.scrapes[j].Changes {
+			if i := renumber[c.Series]; i >= 0 {
+				changes = append(changes, seriesValue{Series: i, Value: c.Value})
+			}
+		}
+		h.scrapes[j].Changes = changes
+	}
+	return dropped
+}
+
+// seriesSelector picks series by metric name, name regex and label values.
+// All given conditions must match.
+type seriesSelector struct {
+	// Metric names either a metric family or a single _bucket, _sum or
+	// _count series of one.
+	Metric string
+	Regex  *regexp.Regexp
+	Labels map[string]string
+	// Raw adds the raw values of calibrated series to their frames, in a
+	// raw field
+	Raw bool
+}
+
+func newSeriesSelector(q Query) (seriesSelector, error) {
+	sel := seriesSelector{Metric: q.Metric, Labels: q.Labels, Raw: q.Raw}
+	if q.MetricRegex != "" {
+		re, err := regexp.Compile("^(?:" + q.MetricRegex + ")$")
+		if err != nil {
+			return sel, fmt.Errorf("invalid metricRegex %q: %w", q.MetricRegex, err)
+		}
+		sel.Regex = re
+	}
+	return sel, nil
+}
+
+func (sel seriesSelector) matches(s seriesInfo) bool {
+	if sel.Metric != "" && s.Family != sel.Metric && s.Name != sel.Metric {
+		return false
+	}
+	if sel.Regex != nil && !sel.Regex.MatchString(s.Name) {
+		return false
+	}
+	for k, v := range sel.Labels {
+		if s.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (sel seriesSelector) String() string {
+	name := sel.Metric
+	if sel.Regex != nil {
+		name += "~" + sel.Regex.String()
+	}
+	if len(sel.Labels) > 0 {
+		name += data.Labels(sel.Labels).String()
+	}
+	return name
+}
+
+// seriesFrames returns one time series frame per series matching sel within
+// the query's time range, each reduced to one point per query interval and at
+// most MaxDataPoints points by keeping the last value of each time bucket.
+// Labels are attached to the value field.
+func (h *scrapeHistory) seriesFrames(sel seriesSelector, query backend.DataQuery) (data.Frames, error) {
+	tr := query.TimeRange
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var matches []int
+	for i, s := range h.series {
+		if sel.matches(s) {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, withCode(codeMetricNotFound, fmt.Errorf("no series match %s", sel))
+	}
+
+	// The raw series of calibrated series go along with them rather than in
+	// frames of their own. With sel.Raw, they are replayed after the
+	// matches, raw[j] being the position of the raw series of match j
+	primaries := len(matches)
+	raw := map[int]int{}
+	if companions := h.rawSeries(matches); len(companions) > 0 {
+		isRaw := map[int]bool{}
+		for _, k := range companions {
+			isRaw[k] = true
+		}
+		kept := make([]int, 0, len(matches))
+		for _, i := range matches {
+			if !isRaw[i] {
+				kept = append(kept, i)
+			}
+		}
+		matches, primaries = kept, len(kept)
+		for j := 0; sel.Raw && j < primaries; j++ {
+			if k, ok := companions[matches[j]]; ok {
+				raw[j] = len(matches)
+				matches = append(matches, k)
+			}
+		}
+	}
+
+	// Replay the changes from base, tracking the matching series only. The
+	// first pass counts the points of each series, for the second to
+	// downsample them as they come, so that long time ranges are never held
+	// at full resolution
+	pos := make(map[int]int, len(matches))
+	current := make([]float64, len(matches))
+	replay := func(point func(j int, t time.Time, v float64)) {
+		for j, i := range matches {
+			pos[i] = j
+			current[j] = h.base[i]
+		}
+		for _, s := range h.scrapes {
+			for _, c := range s.Changes {
+				if j, ok := pos[c.Series]; ok {
+					current[j] = c.Value
+				}
+			}
+			if s.Time.Before(tr.From) || s.Time.After(tr.To) {
+				continue
+			}
+			for j, v := range current {
+				if !math.IsNaN(v) {
+					point(j, s.Time, v)
+				}
+			}
+		}
+	}
+
+	counts := make([]int, len(matches))
+	replay(func(j int, _ time.Time, _ float64) { counts[j]++ })
+	downsamplers := make([]*downsampler, len(matches))
+	for j, n := range counts {
+		downsamplers[j] = newDownsampler(tr, n, query.MaxDataPoints, query.Interval)
+	}
+	replay(func(j int, t time.Time, v float64) { downsamplers[j].add(t, v) })
+
+	frames := make(data.Frames, 0, primaries)
+	for j, i := range matches[:primaries] {
+		times, values := downsamplers[j].result()
+
+		info := h.series[i]
+		frame := data.NewFrame(info.Name,
+			data.NewField("time", nil, times),
+			data.NewField(info.Name, info.Labels, values),
+		)
+		// Raw values are recorded along with the calibrated ones, so they
+		// downsample to the same times
+		if k, ok := raw[j]; ok {
+			if rawTimes, rawValues := downsamplers[k].result(); len(rawTimes) == len(times) {
+				frame.Fields = append(frame.Fields, data.NewField("raw", info.Labels, rawValues))
+			}
+		}
+		// One series per frame, the shape alert rules expect
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// rawSeries returns the raw series of the calibrated series in matches, by
+// the index of the calibrated series. h.mu must be held.
+func (h *scrapeHistory) rawSeries(matches []int) map[int]int {
+	companions := map[int]int{}
+	for _, i := range matches {
+		s := h.series[i]
+		if k, ok := h.index[s.Name+rawSeriesSuffix+s.Labels.String()]; ok {
+			companions[i] = k
+		}
+	}
+	return companions
+}
+
+// seriesPoints counts the points within tr of each series matching sel, as
+// seriesFrames would return them before downsampling. Raw series of
+// calibrated series are left out.
+func (h *scrapeHistory) seriesPoints(sel seriesSelector, tr backend.TimeRange) []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var matches []int
+	for i, s := range h.series {
+		if sel.matches(s) {
+			matches = append(matches, i)
+		}
+	}
+	isRaw := map[int]bool{}
+	for _, k := range h.rawSeries(matches) {
+		isRaw[k] = true
+	}
+	pos := map[int]int{}
+	current := []float64{}
+	for _, i := range matches {
+		if !isRaw[i] {
+			pos[i] = len(current)
+			current = append(current, h.base[i])
+		}
+	}
+	counts := make([]int, len(current))
+	for _, s := range h.scrapes {
+		for _, c := range s.Changes {
+			if j, ok := pos[c.Series]; ok {
+				current[j] = c.Value
+			}
+		}
+		if s.Time.Before(tr.From) || s.Time.After(tr.To) {
+			continue
+		}
+		for j, v := range current {
+			if !math.IsNaN(v) {
+				counts[j]++
+			}
+		}
+	}
+	return counts
+}
+
+// downsampler reduces a series of points to one per bucket as they come.
+// Buckets split the time range by interval, widened to have at most
+// maxPoints of them, and keep their last point, which is correct for both
+// gauges and counters.
+type downsampler struct {
+	from   time.Time
+	width  time.Duration
+	times  []time.Time
+	values []float64
+
+	// the last point seen, kept until a point of another bucket comes
+	pending bool
+	bucket  time.Duration
+	time    time.Time
+	value   float64
+}
+
+// newDownsampler returns a downsampler for a series of points within tr.
+func newDownsampler(tr backend.TimeRange, points int, maxPoints int64, interval time.Duration) *downsampler {
+	width := interval
+	if maxPoints > 0 && int64(points) > maxPoints {
+		width = max(width, tr.Duration()/time.Duration(maxPoints))
+	}
+	return &downsampler{from: tr.From, width: width}
+}
+
+func (d *downsampler) add(t time.Time, v float64) {
+	if d.width <= 0 {
+		d.times = append(d.times, t)
+		d.values = append(d.values, v)
+		return
+	}
+	bucket := t.Sub(d.from) / d.width
+	if d.pending && bucket != d.bucket {
+		d.times = append(d.times, d.time)
+		d.values = append(d.values, d.value)
+	}
+	d.pending, d.bucket, d.time, d.value = true, bucket, t, v
+}
+
+func (d *downsampler) result() ([]time.Time, []float64) {
+	if d.pending {
+		d.times = append(d.times, d.time)
+		d.values = append(d.values, d.value)
+		d.pending = false
+	}
+	return d.times, d.values
+}
+
+// metricSamples flattens parsed metric families into samples. Histograms
+// become _bucket (with an "le" label), _sum and _count series, and summaries
+// become one series per quantile plus _sum and _count.
+func metricSamples(families map[string]*dto.MetricFamily) []metricSample {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var samples []metricSample
+	for _, family := range names {
+		for _, m := range families[family].GetMetric() {
+			labels := data.Labels{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			add := func(name string, extra data.Labels, value float64) {
+				sampleLabels := labels
+				if len(extra) > 0 {
+					sampleLabels = labels.Copy()
+					for k, v := range extra {
+						sampleLabels[k] = v
+					}
+				}
+				samples = append(samples, metricSample{
+					seriesInfo: seriesInfo{Family: family, Name: name, Labels: sampleLabels},
+					Value:      value,
+				})
+			}
+
+			switch {
+			case m.Histogram != nil:
+				hist := m.GetHistogram()
+				hasInf := false
+				for _, b := range hist.GetBucket() {
+					hasInf = hasInf || math.IsInf(b.GetUpperBound(), 1)
+					add(family+"_bucket", data.Labels{"le": formatBound(b.GetUpperBound())}, float64(b.GetCumulativeCount()))
+				}
+				if !hasInf {
+					add(family+"_bucket", data.Labels{"le": "+Inf"}, float64(hist.GetSampleCount()))
+				}
+				add(family+"_sum", nil, hist.GetSampleSum())
+				add(family+"_count", nil, float64(hist.GetSampleCount()))
+			case m.Summary != nil:
+				summary := m.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					add(family, data.Labels{"quantile": formatBound(q.GetQuantile())}, q.GetValue())
+				}
+				add(family+"_sum", nil, summary.GetSampleSum())
+				add(family+"_count", nil, float64(summary.GetSampleCount()))
+			default:
+				add(family, nil, sampleValue(m))
+			}
+		}
+	}
+	return samples
+}
+
+// formatBound formats a bucket bound or quantile the way Prometheus does.
+func formatBound(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// scrapeMetrics returns the current samples of a target. Scrapes younger than
+// the cache TTL are reused, and concurrent callers share a single scrape,
+// which runs until the target's scrape timeout whichever of them gives up.
+func (ds *testDataSource) scrapeMetrics(ctx context.Context, target *scrapeTarget) ([]metricSample, error) {
+	if target.push != nil {
+		samples, err := target.push.latest(target.Name)
+		if err != nil {
+			return nil, err
+		}
+		return calibrate(target.calibrations, samples), nil
+	}
+	if samples, ok := target.cachedSamples(ds.cacheTTL); ok {
+		scrapeCacheHits.Inc()
+		if usage := queryUsageFromContext(ctx); usage != nil {
+			usage.cacheHits.Add(1)
+		}
+		return samples, nil
+	}
+	scrapeCacheMisses.Inc()
+
+	scraped := target.flight.DoChan("scrape", func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), target.scrapeTimeout())
+		defer cancel()
+		return ds.fetchMetrics(ctx, target)
+	})
+	select {
+	case res := <-scraped:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]metricSample), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchMetrics scrapes a target's metrics endpoint once and records the
+// result in its history and cache.
+func (ds *testDataSource) fetchMetrics(ctx context.Context, target *scrapeTarget) ([]metricSample, error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "scrape", oteltrace.WithAttributes(
+		attribute.String("target", target.Name),
+		attribute.String("url", redactURL(target.URL)),
+	))
+	defer span.End()
+	labels := prometheus.Labels{"target": target.Name, "ref_id": refIDFromContext(ctx)}
+
+	start := time.Now()
+	body, err := ds.fetchBody(ctx, target)
+	fetched := time.Now()
+	scrapeDuration.With(labels).Observe(fetched.Sub(start).Seconds())
+	if usage := queryUsageFromContext(ctx); usage != nil {
+		usage.scraped(target.Name, len(body))
+	}
+	if err != nil {
+		return nil, tracing.Error(span, fmt.Errorf("failed to fetch metrics from endpoint: %w", err))
+	}
+	scrapeBytes.With(labels).Observe(float64(len(body)))
+
+	samples, reported, err := parseTargetBody(target, body)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+	ds.observeClock(target, reported, fetched)
+	samples = calibrate(target.calibrations, samples)
+	parsed := time.Now()
+	scrapeParseDuration.With(labels).Observe(parsed.Sub(fetched).Seconds())
+	span.SetAttributes(attribute.Int("bytes", len(body)), attribute.Int("series", len(samples)))
+
+	target.history.record(fetched, samples)
+	target.cache(fetched, samples, scrapeStats{
+		Target:          target.Name,
+		URL:             redactURL(target.URL),
+		ScrapedAt:       fetched,
+		DurationMs:      milliseconds(fetched.Sub(start)),
+		Bytes:           len(body),
+		ParseDurationMs: milliseconds(parsed.Sub(fetched)),
+		Series:          len(samples),
+	})
+	return samples, nil
+}
+
+// parseTargetBody parses the response of a target, with its parser or as
+// Prometheus metrics, and returns the newest timestamp of its samples, zero
+// when they have none.
+func parseTargetBody(target *scrapeTarget, body []byte) ([]metricSample, time.Time, error) {
+	if target.parser != nil {
+		samples, err := target.parser(body)
+		return samples, time.Time{}, err
+	}
+	var families map[string]*dto.MetricFamily
+	var err error
+	if target.scratch != nil {
+		families, err = parseExpositionWith(&target.scratch.parser, body)
+	} else {
+		families, err = parseExposition(body)
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	target.setDeclaredUnits(parseUnitLines(body))
+	return metricSamples(families), newestTimestamp(families), nil
+}
+
+// scrapeAll scrapes targets, or takes their cached scrapes, and returns the
+// samples of all of them.
+func (ds *testDataSource) scrapeAll(ctx context.Context, targets []*scrapeTarget) ([]metricSample, error) {
+	var samples []metricSample
+	for _, target := range targets {
+		scraped, err := ds.scrapeMetrics(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target.Name, err)
+		}
+		samples = append(samples, scraped...)
+	}
+	return samples, nil
+}
+
+// scrapeInterval is how often targets are scraped.
+func (ds *testDataSource) scrapeInterval() time.Duration {
+	interval := defaultScrapeInterval
+	if ds.settings.HighFrequency {
+		interval = highFrequencyScrapeInterval
+	}
+	if s := ds.settings.ScrapeIntervalSeconds; s > 0 {
+		interval = time.Duration(s) * time.Second
+	}
+	return interval
+}
+
+func (ds *testDataSource) runScraper(ctx context.Context, target *scrapeTarget) {
+	switch {
+	case target.sse != nil:
+		ds.runPush(ctx, target, "SSE", ds.streamSSE)
+		return
+	case target.agent != nil:
+		ds.watchAgent(ctx, target)
+		return
+	case target.listener != nil:
+		ds.runPush(ctx, target, target.listener.kind, ds.listen)
+		return
+	case target.push != nil:
+		ds.runPush(ctx, target, "WebSocket", ds.streamWebSocket)
+		return
+	}
+	job := ds.schedule.add("scrape", target.Name, ds.scrapeInterval(), time.Now())
+	ticker := time.NewTicker(ds.scrapeInterval())
+	defer ticker.Stop()
+	for {
+		err := job.run(func() error {
+			_, err := ds.scrapeMetrics(ctx, target)
+			return err
+		})
+		if err != nil {
+			backend.Logger.Warn("Scrape failed", "target", target.Name, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ds.drain:
+			return
+		case <-ticker.C:
+		}
+	}
+}
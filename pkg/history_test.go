@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// TestScrapeMetricsCancelledCaller checks that a query giving up on a shared
+// scrape leaves it to the others waiting for it.
+func TestScrapeMetricsCancelledCaller(t *testing.T) {
+	ds := newTestDataSource()
+	ds.settings = &models.PluginSettings{}
+	started, release := make(chan struct{}), make(chan struct{})
+	var requests atomic.Int32
+	ds.httpClient = &http.Client{Transport: httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if requests.Add(1) == 1 {
+			close(started)
+		}
+		select {
+		case <-release:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("node_load1 0.5\n"))}, nil
+	})}
+	target := &scrapeTarget{Name: "nas", URL: "http://nas.lan:9100/metrics", history: newScrapeHistory(defaultHistory)}
+
+	first, cancel := context.WithCancel(context.Background())
+	var firstErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, firstErr = ds.scrapeMetrics(first, target)
+	}()
+	<-started
+
+	const others = 3
+	results := make([]error, others)
+	counts := make([]int, others)
+	for i := range others {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			samples, err := ds.scrapeMetrics(context.Background(), target)
+			results[i], counts[i] = err, len(samples)
+		}()
+	}
+	// Give the others time to join the scrape before the first gives up
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if !errors.Is(firstErr, context.Canceled) {
+		t.Errorf("cancelled caller got %v, want context.Canceled", firstErr)
+	}
+	for i, err := range results {
+		if err != nil {
+			t.Errorf("caller %d failed with the cancelled one: %v", i, err)
+		} else if counts[i] != 1 {
+			t.Errorf("caller %d got %d samples, want 1", i, counts[i])
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("target was scraped %d times, want once", n)
+	}
+}
+
+// testSamples returns samples of unlabeled series by name, leaving out NaN
+// values.
+func testSamples(values map[string]float64) []metricSample {
+	var samples []metricSample
+	for name, v := range values {
+		if !math.IsNaN(v) {
+			samples = append(samples, metricSample{seriesInfo: seriesInfo{Family: name, Name: name, Labels: data.Labels{}}, Value: v})
+		}
+	}
+	return samples
+}
+
+// historyPoints returns the points of metric in h over the hour from
+// testStart, as offset=value after the labels of their series, if any.
+func historyPoints(t *testing.T, h *scrapeHistory, metric string) []string {
+	t.Helper()
+	frames, err := h.seriesFrames(seriesSelector{Metric: metric}, backend.DataQuery{
+		TimeRange:     backend.TimeRange{From: testStart, To: testStart.Add(time.Hour)},
+		Interval:      time.Second,
+		MaxDataPoints: 10000,
+	})
+	if err != nil {
+		return nil
+	}
+	points := []string{}
+	for _, frame := range frames {
+		prefix := ""
+		if labels := frame.Fields[1].Labels; len(labels) > 0 {
+			prefix = labels.String() + " "
+		}
+		for i := range frame.Rows() {
+			at := frame.Fields[0].At(i).(time.Time)
+			v, _ := frame.Fields[1].FloatAt(i)
+			points = append(points, fmt.Sprintf("%s%s=%g", prefix, at.Sub(testStart), v))
+		}
+	}
+	return points
+}
+
+// TestScrapeHistoryChanges checks that scrapes only store the values that
+// changed, and that queries replay them into every point.
+func TestScrapeHistoryChanges(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name      string
+		retention time.Duration
+		scrapes   []map[string]float64
+		// changes stored by each scrape kept
+		changes []int
+		points  map[string][]string
+	}{
+		{
+			name:    "static series",
+			scrapes: []map[string]float64{{"info": 1, "load": 0.5}, {"info": 1, "load": 0.5}, {"info": 1, "load": 0.75}},
+			changes: []int{2, 0, 1},
+			points: map[string][]string{
+				"info": {"0s=1", "15s=1", "30s=1"},
+				"load": {"0s=0.5", "15s=0.5", "30s=0.75"},
+			},
+		},
+		{
+			name:    "series missing from a scrape",
+			scrapes: []map[string]float64{{"info": 1, "load": 0.5}, {"info": 1, "load": nan}, {"info": 1, "load": 0.5}},
+			changes: []int{2, 1, 1},
+			points: map[string][]string{
+				"info": {"0s=1", "15s=1", "30s=1"},
+				"load": {"0s=0.5", "30s=0.5"},
+			},
+		},
+		{
+			name:    "series appearing later",
+			scrapes: []map[string]float64{{"info": 1}, {"info": 1, "load": 2}},
+			changes: []int{1, 1},
+			points: map[string][]string{
+				"info": {"0s=1", "15s=1"},
+				"load": {"15s=2"},
+			},
+		},
+		{
+			// The value of info is only stored by the first scrape, which
+			// expires: it carries on from the base
+			name:      "expired changes",
+			retention: 30 * time.Second,
+			scrapes:   []map[string]float64{{"info": 1, "load": 1}, {"info": 1, "load": 2}, {"info": 1, "load": 3}, {"info": 1, "load": 4}},
+			changes:   []int{1, 1, 1},
+			points: map[string][]string{
+				"info": {"15s=1", "30s=1", "45s=1"},
+				"load": {"15s=2", "30s=3", "45s=4"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retention := tt.retention
+			if retention == 0 {
+				retention = time.Hour
+			}
+			h := newScrapeHistory(retention)
+			for i, values := range tt.scrapes {
+				h.record(testStart.Add(time.Duration(i)*15*time.Second), testSamples(values))
+			}
+			var changes []int
+			for _, sc := range h.scrapes {
+				changes = append(changes, len(sc.Changes))
+			}
+			if !slices.Equal(changes, tt.changes) {
+				t.Errorf("scrapes store %v changes, want %v", changes, tt.changes)
+			}
+			for metric, want := range tt.points {
+				if got := historyPoints(t, h, metric); !slices.Equal(got, want) {
+					t.Errorf("%s: got %v, want %v", metric, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestScrapeHistoryPurge purges series, or their values within a time
+// range, and compacts the history after.
+func TestScrapeHistoryPurge(t *testing.T) {
+	at := func(d time.Duration) time.Time { return testStart.Add(d) }
+	tests := []struct {
+		name     string
+		sel      seriesSelector
+		from, to time.Time
+		points   map[string][]string
+		// changes and series freed by the compaction after
+		changes, series int
+	}{
+		{
+			name: "series",
+			sel:  seriesSelector{Metric: "info"},
+			points: map[string][]string{
+				"info": nil,
+				"load": {"host=nas 0s=0", "host=nas 15s=1", "host=nas 30s=2", "host=nas 45s=3", "host=nas 1m0s=4", "host=nas 1m15s=5",
+					"host=router 0s=10", "host=router 15s=11", "host=router 30s=12", "host=router 45s=13", "host=router 1m0s=14", "host=router 1m15s=15"},
+			},
+		},
+		{
+			name: "series by label",
+			sel:  seriesSelector{Metric: "load", Labels: map[string]string{"host": "nas"}},
+			points: map[string][]string{
+				"info": {"0s=1", "15s=1", "30s=1", "45s=1", "1m0s=1", "1m15s=1"},
+				"load": {"host=router 0s=10", "host=router 15s=11", "host=router 30s=12", "host=router 45s=13", "host=router 1m0s=14", "host=router 1m15s=15"},
+			},
+		},
+		{
+			// info is only stored by the first scrape: it takes its value
+			// back after the range
+			name:   "range",
+			sel:    seriesSelector{Metric: "info"},
+			from:   at(15 * time.Second),
+			to:     at(45 * time.Second),
+			points: map[string][]string{"info": {"0s=1", "1m0s=1", "1m15s=1"}},
+		},
+		{
+			name:   "from on",
+			sel:    seriesSelector{Metric: "load", Labels: map[string]string{"host": "router"}},
+			from:   at(45 * time.Second),
+			points: map[string][]string{"load": {"host=nas 0s=0", "host=nas 15s=1", "host=nas 30s=2", "host=nas 45s=3", "host=nas 1m0s=4", "host=nas 1m15s=5", "host=router 0s=10", "host=router 15s=11", "host=router 30s=12"}},
+		},
+		{
+			name:    "every value",
+			sel:     seriesSelector{Metric: "info"},
+			from:    at(0),
+			to:      at(time.Hour),
+			points:  map[string][]string{"info": nil},
+			changes: 1,
+			series:  1,
+		},
+		{
+			// late has no value to delete, but goes missing at the start of
+			// the range and back at its end all the same
+			name:    "range without values",
+			sel:     seriesSelector{Metric: "late"},
+			from:    at(0),
+			to:      at(30 * time.Second),
+			points:  map[string][]string{"late": {"1m0s=7", "1m15s=7"}},
+			changes: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newScrapeHistory(time.Hour)
+			for i := range 6 {
+				samples := []metricSample{
+					{seriesInfo: seriesInfo{Family: "info", Name: "info", Labels: data.Labels{}}, Value: 1},
+					{seriesInfo: seriesInfo{Family: "load", Name: "load", Labels: data.Labels{"host": "nas"}}, Value: float64(i)},
+					{seriesInfo: seriesInfo{Family: "load", Name: "load", Labels: data.Labels{"host": "router"}}, Value: float64(10 + i)},
+				}
+				if i >= 4 {
+					samples = append(samples, metricSample{seriesInfo: seriesInfo{Family: "late", Name: "late", Labels: data.Labels{}}, Value: 7})
+				}
+				h.record(at(time.Duration(i)*15*time.Second), samples)
+			}
+
+			h.purge(tt.sel, tt.from, tt.to)
+			check := func(when string) {
+				for metric, want := range tt.points {
+					if got := historyPoints(t, h, metric); !slices.Equal(got, want) && len(got)+len(want) > 0 {
+						t.Errorf("%s %s: got %v, want %v", metric, when, got, want)
+					}
+				}
+			}
+			check("after purge")
+			changes, series := h.compact()
+			if changes != tt.changes || series != tt.series {
+				t.Errorf("compaction freed %d changes and %d series, want %d and %d", changes, series, tt.changes, tt.series)
+			}
+			check("after compaction")
+			if changes, series := h.compact(); changes != 0 || series != 0 {
+				t.Errorf("second compaction freed %d changes and %d series, want none", changes, series)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// defaultBaseTemperature is the usual base of degree days in °C.
+const defaultBaseTemperature = 18.0
+
+// hvacHistoryDays is how many days of degree days and runtimes are kept.
+const hvacHistoryDays = 400
+
+// hvacSaveInterval is how often the days are written to the state directory.
+const hvacSaveInterval = 5 * time.Minute
+
+// hvacDay is what the outdoor temperature and the HVACs did on a day, in
+// local time.
+type hvacDay struct {
+	Date string `json:"date"`
+	// HeatingDegreeSeconds and CoolingDegreeSeconds integrate how far the
+	// outdoor temperature was below and above the base over OutdoorSeconds,
+	// the time it was read
+	HeatingDegreeSeconds float64 `json:"heatingDegreeSeconds"`
+	CoolingDegreeSeconds float64 `json:"coolingDegreeSeconds"`
+	OutdoorSeconds       float64 `json:"outdoorSeconds"`
+	// Runtimes are how long each HVAC ran, by the labels of its series
+	Runtimes map[string]*hvacRuntime `json:"runtimes"`
+}
+
+type hvacRuntime struct {
+	Labels  data.Labels `json:"labels"`
+	Seconds float64     `json:"seconds"`
+}
+
+// degreeDays returns the heating and cooling degree days, the mean deficit
+// and excess of the outdoor temperature over the time it was read, so that
+// gaps in readings don't lower them.
+func (d *hvacDay) degreeDays() (float64, float64) {
+	if d.OutdoorSeconds == 0 {
+		return math.NaN(), math.NaN()
+	}
+	return d.HeatingDegreeSeconds / d.OutdoorSeconds, d.CoolingDegreeSeconds / d.OutdoorSeconds
+}
+
+// hvacTracker keeps the days, in a file of the state directory when there
+// is one, so that they survive restarts.
+type hvacTracker struct {
+	base float64
+	path string
+
+	mu   sync.Mutex
+	days map[string]*hvacDay
+	// last is when readings were last recorded, and saved when days were
+	// last written
+	last  time.Time
+	saved time.Time
+}
+
+func newHVACTracker(base float64, stateDir, uid string) *hvacTracker {
+	if base == 0 {
+		base = defaultBaseTemperature
+	}
+	t := &hvacTracker{base: base, days: map[string]*hvacDay{}}
+	if stateDir != "" {
+		t.path = filepath.Join(stateDir, url.PathEscape(uid), "hvac.json")
+	}
+	return t
+}
+
+// load reads the stored days, if any.
+func (t *hvacTracker) load() {
+	if t.path == "" {
+		return
+	}
+	body, err := os.ReadFile(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		backend.Logger.Warn("Failed to read stored HVAC history", "error", err)
+		return
+	}
+	var days []*hvacDay
+	if err := json.Unmarshal(body, &days); err != nil {
+		backend.Logger.Warn("Ignoring corrupt stored HVAC history", "error", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, d := range days {
+		t.days[d.Date] = d
+	}
+}
+
+// save writes the days aside and renames them, so a crash never leaves a
+// partial file.
+func (t *hvacTracker) save() error {
+	if t.path == "" {
+		return nil
+	}
+	t.mu.Lock()
+	body, err := json.Marshal(t.sortedDays())
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(t.path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, ".hvac-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
+
+// record adds the time since the last readings to the day of now, for the
+// outdoor temperature, if read, and the HVACs running. Readings further
+// apart than stale leave the time between them out. It reports whether the
+// days are due to be saved.
+func (t *hvacTracker) record(now time.Time, stale time.Duration, outdoor *float64, running []data.Labels) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elapsed := now.Sub(t.last)
+	t.last = now
+	if elapsed <= 0 || elapsed > stale {
+		return false
+	}
+	seconds := elapsed.Seconds()
+
+	date := now.Format(time.DateOnly)
+	d, ok := t.days[date]
+	if !ok {
+		d = &hvacDay{Date: date, Runtimes: map[string]*hvacRuntime{}}
+		t.days[date] = d
+		cutoff := now.AddDate(0, 0, -hvacHistoryDays).Format(time.DateOnly)
+		for date := range t.days {
+			if date < cutoff {
+				delete(t.days, date)
+			}
+		}
+	}
+	if outdoor != nil {
+		d.HeatingDegreeSeconds += math.Max(0, t.base-*outdoor) * seconds
+		d.CoolingDegreeSeconds += math.Max(0, *outdoor-t.base) * seconds
+		d.OutdoorSeconds += seconds
+	}
+	for _, labels := range running {
+		key := labels.String()
+		r, ok := d.Runtimes[key]
+		if !ok {
+			r = &hvacRuntime{Labels: labels}
+			d.Runtimes[key] = r
+		}
+		r.Seconds += seconds
+	}
+
+	if now.Sub(t.saved) < hvacSaveInterval {
+		return false
+	}
+	t.saved = now
+	return true
+}
+
+// sortedDays returns the days in order. t.mu must be held.
+func (t *hvacTracker) sortedDays() []*hvacDay {
+	days := make([]*hvacDay, 0, len(t.days))
+	for _, d := range t.days {
+		days = append(days, d)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return days
+}
+
+// daysWithin returns the days overlapping tr, with their start.
+func (t *hvacTracker) daysWithin(tr backend.TimeRange) ([]time.Time, []*hvacDay) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var starts []time.Time
+	var days []*hvacDay
+	for _, d := range t.sortedDays() {
+		start, err := time.ParseInLocation(time.DateOnly, d.Date, time.Local)
+		if err != nil || start.After(tr.To) || !start.AddDate(0, 0, 1).After(tr.From) {
+			continue
+		}
+		// Copied, as recording goes on
+		day := *d
+		day.Runtimes = make(map[string]*hvacRuntime, len(d.Runtimes))
+		for key, r := range d.Runtimes {
+			copied := *r
+			day.Runtimes[key] = &copied
+		}
+		starts = append(starts, start)
+		days = append(days, &day)
+	}
+	return starts, days
+}
+
+// degreeDayFrame returns the heating and cooling degree days of each day in
+// tr. Days without outdoor readings have none.
+func (t *hvacTracker) degreeDayFrame(tr backend.TimeRange) *data.Frame {
+	starts, days := t.daysWithin(tr)
+	heating := make([]*float64, len(days))
+	cooling := make([]*float64, len(days))
+	for i, d := range days {
+		if h, c := d.degreeDays(); !math.IsNaN(h) {
+			heating[i], cooling[i] = &h, &c
+		}
+	}
+	return data.NewFrame("degree days",
+		data.NewField("time", nil, starts),
+		data.NewField("heating_degree_days", nil, heating),
+		data.NewField("cooling_degree_days", nil, cooling),
+	)
+}
+
+// runtimeFrames returns a frame per HVAC with its runtime on each day in
+// tr, zero on days it didn't run.
+func (t *hvacTracker) runtimeFrames(tr backend.TimeRange) data.Frames {
+	starts, days := t.daysWithin(tr)
+	hvacs := map[string]data.Labels{}
+	for _, d := range days {
+		for key, r := range d.Runtimes {
+			hvacs[key] = r.Labels
+		}
+	}
+	keys := make([]string, 0, len(hvacs))
+	for key := range hvacs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	frames := make(data.Frames, 0, len(keys))
+	for _, key := range keys {
+		runtimes := make([]float64, len(days))
+		for i, d := range days {
+			if r, ok := d.Runtimes[key]; ok {
+				runtimes[i] = r.Seconds
+			}
+		}
+		frame := data.NewFrame("hvac runtime",
+			data.NewField("time", nil, starts),
+			data.NewField("runtime", hvacs[key], runtimes).SetConfig(&data.FieldConfig{Unit: "s"}),
+		)
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti}
+		frames = append(frames, frame)
+	}
+	return frames
+}
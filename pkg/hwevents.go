@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeHardwareEvents = "hwevents"
+
+// hardwareEventsCmd lists the IPMI System Event Log and the hardware errors
+// the kernel logged in the last day: machine checks, EDAC memory errors and
+// PCIe AER errors. Either may be missing, e.g. on hosts without a BMC.
+const hardwareEventsCmd = `echo '# sel'; ipmitool sel elist 2>/dev/null; ` +
+	`echo '# kernel'; journalctl -k -o short-iso --no-pager --since=-1d 2>/dev/null | grep -E 'mce:|EDAC|AER:|[Hh]ardware [Ee]rror|Machine check'`
+
+// Sources of hardware events.
+const (
+	hardwareSourceSEL    = "sel"
+	hardwareSourceKernel = "kernel"
+)
+
+// maxHardwareEvents bounds the number of hardware events kept in memory.
+const maxHardwareEvents = 1000
+
+// hardwareRepeatWindow is how long after an event the same event on the
+// same host is counted as a repeat of it, rather than a new event, so that
+// a flapping sensor or a stream of corrected errors is a single annotation.
+const hardwareRepeatWindow = 10 * time.Minute
+
+func init() {
+	registerQueryType(queryTypeHardwareEvents, queryHardwareEvents, hardwareEventQuery{})
+	registerConfiguredCheck(queryTypeHardwareEvents, func(ds *testDataSource) bool { return len(ds.settings.SSH.AllHosts()) > 0 })
+}
+
+type hardwareEventQuery struct {
+	Host string `json:"host"`
+	// Mode is "annotations" (default) for annotations tagged with their
+	// source, severity and host, or "logs" for log lines with a level.
+	Mode string `json:"mode"`
+	// MinSeverity leaves out events below it: "ok" (default), "warning" or
+	// "critical".
+	MinSeverity string `json:"minSeverity"`
+}
+
+// hardwareEvent is an entry of the SEL or a hardware error of the kernel
+// log, and how often it repeated within hardwareRepeatWindow.
+type hardwareEvent struct {
+	Time     time.Time
+	Host     string
+	Source   string
+	Sensor   string
+	Message  string
+	Severity int64
+	Count    int64
+	// Last is when the event last repeated
+	Last time.Time
+}
+
+// text describes the event in annotations and log lines.
+func (e hardwareEvent) text() string {
+	text := e.Message
+	if e.Sensor != "" {
+		text = e.Sensor + ": " + e.Message
+	}
+	if e.Count > 1 {
+		text += fmt.Sprintf(" (%d times)", e.Count)
+	}
+	return text
+}
+
+// hardwareEventLog keeps the hardware events of hosts, each once: the SEL
+// and the kernel log are listed whole on every query, so entries already
+// seen are skipped.
+type hardwareEventLog struct {
+	mu     sync.Mutex
+	events []hardwareEvent
+	// seen are the keys of the entries recorded, with their times
+	seen map[string]time.Time
+}
+
+func newHardwareEventLog() *hardwareEventLog {
+	return &hardwareEventLog{seen: map[string]time.Time{}}
+}
+
+// key identifies an entry. SEL record IDs are left out, as they start
+// over when the SEL is cleared.
+func (e hardwareEvent) key() string {
+	return strings.Join([]string{e.Host, e.Source, e.Time.Format(time.RFC3339Nano), e.Sensor, e.Message}, "\x00")
+}
+
+func (l *hardwareEventLog) record(events []hardwareEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	for _, e := range events {
+		key := e.key()
+		if _, ok := l.seen[key]; ok {
+			continue
+		}
+		l.seen[key] = e.Time
+		if l.repeat(e) {
+			continue
+		}
+		e.Count, e.Last = 1, e.Time
+		l.events = append(l.events, e)
+	}
+
+	if len(l.events) > maxHardwareEvents {
+		l.events = l.events[len(l.events)-maxHardwareEvents:]
+		// Entries older than those kept would only be recorded again if the
+		// host still lists them, so their keys go when the oldest kept does
+		oldest := l.events[0].Time
+		for key, t := range l.seen {
+			if t.Before(oldest) {
+				delete(l.seen, key)
+			}
+		}
+	}
+}
+
+// repeat counts e as a repeat of the same event recorded shortly before it,
+// if there is one.
+func (l *hardwareEventLog) repeat(e hardwareEvent) bool {
+	for i := len(l.events) - 1; i >= 0; i-- {
+		prev := &l.events[i]
+		if e.Time.Before(prev.Last) || e.Time.Sub(prev.Last) > hardwareRepeatWindow {
+			continue
+		}
+		if prev.Host == e.Host && prev.Source == e.Source && prev.Sensor == e.Sensor && prev.Message == e.Message {
+			prev.Count++
+			prev.Last = e.Time
+			return true
+		}
+	}
+	return false
+}
+
+// within returns the events of hosts that started within tr, at least as
+// severe as minSeverity.
+func (l *hardwareEventLog) within(tr backend.TimeRange, hosts []string, minSeverity int64) []hardwareEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	selected := map[string]bool{}
+	for _, h := range hosts {
+		selected[h] = true
+	}
+	var events []hardwareEvent
+	for _, e := range l.events {
+		if !selected[e.Host] || e.Severity < minSeverity || e.Time.Before(tr.From) || e.Time.After(tr.To) {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// hardwareSeverityWords classify events by the words of their description,
+// in order, so that "non-critical" is a warning and "uncorrectable" is not
+// mistaken for "correctable". EDAC reports memory errors as CE (corrected)
+// or UE (uncorrected).
+var hardwareSeverityWords = []struct {
+	word     string
+	severity int64
+}{
+	{"non-critical", severityWarning},
+	{"non-recoverable", severityCritical},
+	{"critical", severityCritical},
+	{"uncorrectable", severityCritical},
+	{"uncorrected", severityCritical},
+	{"fatal", severityCritical},
+	{"failure", severityCritical},
+	{"fault", severityCritical},
+	{"lost", severityCritical},
+	{"machine check", severityCritical},
+	{" ue ", severityCritical},
+	{" ce ", severityWarning},
+	{"correctable", severityWarning},
+	{"corrected", severityWarning},
+	{"predictive", severityWarning},
+	{"degraded", severityWarning},
+	{"error", severityWarning},
+}
+
+// classifyHardwareEvent returns the severity of an event. Deasserted SEL
+// events are sensors going back to normal.
+func classifyHardwareEvent(text string, deasserted bool) int64 {
+	if deasserted {
+		return severityOK
+	}
+	text = strings.ToLower(text)
+	for _, w := range hardwareSeverityWords {
+		if strings.Contains(text, w.word) {
+			return w.severity
+		}
+	}
+	return severityOK
+}
+
+// selTimeLayout is the time of SEL entries as listed by ipmitool.
+const selTimeLayout = "01/02/2006 15:04:05"
+
+// parseHardwareEvents parses the output of hardwareEventsCmd run on host.
+// SEL entries look like
+//
+//	1a | 04/15/2024 | 10:00:00 | Power Supply PS1 | Power Supply AC lost | Asserted
+//
+// and are taken to be in UTC, like BMC clocks usually are. Entries logged
+// before the BMC knew the time are skipped.
+func parseHardwareEvents(host string, raw []byte) []hardwareEvent {
+	var events []hardwareEvent
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if name, ok := strings.CutPrefix(line, "# "); ok {
+			section = name
+			continue
+		}
+		if line == "" {
+			continue
+		}
+
+		switch section {
+		case hardwareSourceSEL:
+			fields := strings.Split(line, "|")
+			if len(fields) < 5 {
+				continue
+			}
+			for i := range fields {
+				fields[i] = strings.TrimSpace(fields[i])
+			}
+			t, err := time.Parse(selTimeLayout, fields[1]+" "+fields[2])
+			if err != nil {
+				continue
+			}
+			message := fields[4]
+			deasserted := false
+			if len(fields) > 5 && fields[5] != "" {
+				deasserted = fields[5] == "Deasserted"
+				message += " " + strings.ToLower(fields[5])
+			}
+			events = append(events, hardwareEvent{
+				Time:     t,
+				Host:     host,
+				Source:   hardwareSourceSEL,
+				Sensor:   fields[3],
+				Message:  message,
+				Severity: classifyHardwareEvent(fields[4], deasserted),
+			})
+		case hardwareSourceKernel:
+			// 2024-04-15T10:00:00+0000 host kernel: mce: [Hardware Error]: ...
+			stamp, rest, ok := strings.Cut(line, " ")
+			if !ok {
+				continue
+			}
+			t, err := time.Parse("2006-01-02T15:04:05-0700", stamp)
+			if err != nil {
+				continue
+			}
+			if _, message, ok := strings.Cut(rest, "kernel: "); ok {
+				rest = message
+			}
+			events = append(events, hardwareEvent{
+				Time:     t,
+				Host:     host,
+				Source:   hardwareSourceKernel,
+				Message:  rest,
+				Severity: classifyHardwareEvent(rest, false),
+			})
+		}
+	}
+	return events
+}
+
+// hardwareSeverityNames name severities in queries, tags and log levels.
+var hardwareSeverityNames = map[int64]string{
+	severityOK:       "ok",
+	severityWarning:  "warning",
+	severityCritical: "critical",
+}
+
+// hardwareLogLevels are the log levels of severities that Grafana colors.
+var hardwareLogLevels = map[int64]string{
+	severityOK:       "info",
+	severityWarning:  "warning",
+	severityCritical: "critical",
+}
+
+func queryHardwareEvents(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q hardwareEventQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	minSeverity := severityOK
+	if q.MinSeverity != "" {
+		found := false
+		for severity, name := range hardwareSeverityNames {
+			if name == q.MinSeverity {
+				minSeverity, found = severity, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown severity %q, expected ok, warning or critical", q.MinSeverity)
+		}
+	}
+
+	hosts, err := ds.sshHosts(q.Host)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		raw, err := ds.runRemoteCommand(ctx, host, hardwareEventsCmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list hardware events on %s: %w", host, err)
+		}
+		ds.hwEvents.record(parseHardwareEvents(host, raw))
+	}
+
+	events := ds.hwEvents.within(query.TimeRange, hosts, minSeverity)
+	if q.Mode == "logs" {
+		return data.Frames{hardwareLogFrame(events)}, nil
+	}
+	return data.Frames{hardwareAnnotationFrame(events)}, nil
+}
+
+// hardwareAnnotationFrame returns events in annotation shape, with tags
+// Grafana splits at commas, and regions for repeated events.
+func hardwareAnnotationFrame(events []hardwareEvent) *data.Frame {
+	frame := data.NewFrame("hardware events",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("timeEnd", nil, []time.Time{}),
+		data.NewField("text", nil, []string{}),
+		data.NewField("tags", nil, []string{}),
+		data.NewField("host", nil, []string{}),
+		data.NewField("source", nil, []string{}),
+		data.NewField("severity", nil, []*int64{}).SetConfig(severityConfig()),
+		data.NewField("count", nil, []int64{}),
+	)
+	for _, e := range events {
+		severity := e.Severity
+		tags := strings.Join([]string{e.Source, hardwareSeverityNames[e.Severity], e.Host}, ",")
+		frame.AppendRow(e.Time, e.Last, e.text(), tags, e.Host, e.Source, &severity, e.Count)
+	}
+	return frame
+}
+
+// hardwareLogFrame returns events as log lines, with the level of their
+// severity.
+func hardwareLogFrame(events []hardwareEvent) *data.Frame {
+	frame := data.NewFrame("hardware events",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("body", nil, []string{}),
+		data.NewField("level", nil, []string{}),
+		data.NewField("host", nil, []string{}),
+		data.NewField("source", nil, []string{}),
+	)
+	frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeLogs}
+	for _, e := range events {
+		frame.AppendRow(e.Time, e.text(), hardwareLogLevels[e.Severity], e.Host, e.Source)
+	}
+	return frame
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// message is a user-facing message: a format string in English, which is
+// also its key in the catalogs of other languages.
+type message string
+
+// Health check results.
+const (
+	msgSettingsNotInitialized message = "Data source settings are not initialized"
+	msgClientNotInitialized   message = "HTTP client is not initialized"
+	msgInvalidConfiguration   message = "Invalid configuration: %v"
+	msgMissingAPIKey          message = "Missing API key in plugin settings"
+	msgFailingTargets         message = "Failing targets: %s"
+	msgHealthy                message = "Datasource is healthy (%d targets)"
+	msgNoMetricsExposed       message = "no metrics exposed"
+)
+
+// Notices.
+const (
+	msgRAIDDegraded message = "RAID array %s on %s is degraded (%d/%d disks active)"
+	msgSLOViolated  message = "SLO %s is violated (burn rate %.2f)"
+
+	msgDuplicateSeries          message = "%s is reported by targets %s"
+	msgDuplicateSeriesPreferred message = "%s is reported by targets %s, keeping %s"
+	msgDuplicateSeriesMerged    message = "%s is reported by targets %s, merged"
+
+	msgPersonalRedacted message = "%d personal series redacted"
+
+	msgNetRatesPending message = "Error rates of %s are computed from counters read by earlier queries, from the next one on"
+)
+
+// Error code descriptions.
+const (
+	msgAuthFailed        message = "authentication failed"
+	msgTargetUnreachable message = "target unreachable"
+	msgMetricNotFound    message = "metric not found"
+	msgParseError        message = "invalid metrics"
+	msgLimitExceeded     message = "limit exceeded"
+	msgEgressDenied      message = "connection not allowed"
+)
+
+// codeMessages describe error codes, which prefix query errors, in other
+// languages than English.
+var codeMessages = map[errorCode]message{
+	codeAuthFailed:        msgAuthFailed,
+	codeTargetUnreachable: msgTargetUnreachable,
+	codeMetricNotFound:    msgMetricNotFound,
+	codeParseError:        msgParseError,
+	codeLimitExceeded:     msgLimitExceeded,
+	codeEgressDenied:      msgEgressDenied,
+}
+
+// messageCatalogs translate messages, by language.
+var messageCatalogs = map[string]map[message]string{
+	"de": {
+		msgSettingsNotInitialized:   "Die Einstellungen der Datenquelle sind nicht initialisiert",
+		msgClientNotInitialized:     "Der HTTP-Client ist nicht initialisiert",
+		msgInvalidConfiguration:     "Ungültige Konfiguration: %v",
+		msgMissingAPIKey:            "In den Plugin-Einstellungen fehlt der API-Schlüssel",
+		msgFailingTargets:           "Fehlerhafte Ziele: %s",
+		msgHealthy:                  "Die Datenquelle funktioniert (%d Ziele)",
+		msgNoMetricsExposed:         "keine Metriken vorhanden",
+		msgRAIDDegraded:             "RAID-Verbund %s auf %s ist beeinträchtigt (%d/%d Festplatten aktiv)",
+		msgSLOViolated:              "SLO %s ist verletzt (Burn-Rate %.2f)",
+		msgDuplicateSeries:          "%s wird von den Zielen %s gemeldet",
+		msgDuplicateSeriesPreferred: "%s wird von den Zielen %s gemeldet, %s wird beibehalten",
+		msgDuplicateSeriesMerged:    "%s wird von den Zielen %s gemeldet, zusammengeführt",
+		msgPersonalRedacted:         "%d personenbezogene Serien ausgeblendet",
+		msgNetRatesPending:          "Fehlerraten von %s werden aus Zählerständen früherer Abfragen berechnet, ab der nächsten",
+		msgAuthFailed:               "Anmeldung fehlgeschlagen",
+		msgTargetUnreachable:        "Ziel nicht erreichbar",
+		msgMetricNotFound:           "Metrik nicht gefunden",
+		msgParseError:               "ungültige Metriken",
+		msgLimitExceeded:            "Grenze überschritten",
+		msgEgressDenied:             "Verbindung nicht erlaubt",
+	},
+	"fr": {
+		msgSettingsNotInitialized:   "Les paramètres de la source de données ne sont pas initialisés",
+		msgClientNotInitialized:     "Le client HTTP n'est pas initialisé",
+		msgInvalidConfiguration:     "Configuration invalide : %v",
+		msgMissingAPIKey:            "Clé d'API manquante dans les paramètres du plugin",
+		msgFailingTargets:           "Cibles en échec : %s",
+		msgHealthy:                  "La source de données fonctionne (%d cibles)",
+		msgNoMetricsExposed:         "aucune métrique exposée",
+		msgRAIDDegraded:             "La grappe RAID %s sur %s est dégradée (%d/%d disques actifs)",
+		msgSLOViolated:              "Le SLO %s n'est pas respecté (taux de consommation %.2f)",
+		msgDuplicateSeries:          "%s est remontée par les cibles %s",
+		msgDuplicateSeriesPreferred: "%s est remontée par les cibles %s, %s est conservée",
+		msgDuplicateSeriesMerged:    "%s est remontée par les cibles %s, fusionnée",
+		msgPersonalRedacted:         "%d séries personnelles masquées",
+		msgNetRatesPending:          "Les taux d'erreur de %s sont calculés à partir des compteurs lus par les requêtes précédentes, dès la prochaine",
+		msgAuthFailed:               "échec de l'authentification",
+		msgTargetUnreachable:        "cible injoignable",
+		msgMetricNotFound:           "métrique introuvable",
+		msgParseError:               "métriques invalides",
+		msgLimitExceeded:            "limite dépassée",
+		msgEgressDenied:             "connexion non autorisée",
+	},
+	"es": {
+		msgSettingsNotInitialized:   "La configuración de la fuente de datos no está inicializada",
+		msgClientNotInitialized:     "El cliente HTTP no está inicializado",
+		msgInvalidConfiguration:     "Configuración no válida: %v",
+		msgMissingAPIKey:            "Falta la clave de API en la configuración del plugin",
+		msgFailingTargets:           "Destinos con errores: %s",
+		msgHealthy:                  "La fuente de datos funciona correctamente (%d destinos)",
+		msgNoMetricsExposed:         "no se exponen métricas",
+		msgRAIDDegraded:             "El arreglo RAID %s en %s está degradado (%d/%d discos activos)",
+		msgSLOViolated:              "El SLO %s no se cumple (tasa de consumo %.2f)",
+		msgDuplicateSeries:          "%s es notificada por los destinos %s",
+		msgDuplicateSeriesPreferred: "%s es notificada por los destinos %s, se conserva %s",
+		msgDuplicateSeriesMerged:    "%s es notificada por los destinos %s, fusionada",
+		msgPersonalRedacted:         "%d series personales ocultadas",
+		msgNetRatesPending:          "Las tasas de error de %s se calculan con los contadores leídos por consultas anteriores, a partir de la siguiente",
+		msgAuthFailed:               "error de autenticación",
+		msgTargetUnreachable:        "destino inaccesible",
+		msgMetricNotFound:           "métrica no encontrada",
+		msgParseError:               "métricas no válidas",
+		msgLimitExceeded:            "límite superado",
+		msgEgressDenied:             "conexión no permitida",
+	},
+}
+
+// localizer translates messages into the language of a data source. The
+// zero localizer leaves them in English.
+type localizer struct {
+	catalog map[message]string
+}
+
+// newLocalizer returns the localizer of locale, such as "de" or "fr-CA",
+// falling back to English for languages without a catalog.
+func newLocalizer(locale string) localizer {
+	if locale == "" {
+		return localizer{}
+	}
+	lang := strings.ToLower(strings.SplitN(strings.ReplaceAll(locale, "_", "-"), "-", 2)[0])
+	catalog, ok := messageCatalogs[lang]
+	if !ok && lang != "en" {
+		backend.Logger.Warn("No messages for locale, using English", "locale", locale)
+	}
+	return localizer{catalog: catalog}
+}
+
+// text formats m, translated when the catalog has it.
+func (l localizer) text(m message, args ...any) string {
+	format := string(m)
+	if translated, ok := l.catalog[m]; ok {
+		format = translated
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// errorResponse is the DataResponse of a failed query, whose code is
+// followed by its description outside English.
+func (l localizer) errorResponse(err error) backend.DataResponse {
+	resp := errorResponse(err)
+	code := codeOf(err)
+	if l.catalog == nil || code == "" {
+		return resp
+	}
+	resp.Error = fmt.Errorf("%s: %s: %w", code, l.text(codeMessages[code]), err)
+	return resp
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeIdle = "idle"
+
+const (
+	defaultIdleInterval      = time.Hour
+	defaultIdleWindowDays    = 28
+	defaultIdleRequestMetric = `http_requests_total|http_server_requests_seconds_count|.*_http_requests_total`
+	// idleBackfillWindow is the longest gap in the records of a target
+	// whose usage is spread over the days of the gap once it is back, and
+	// how long the counters of series gone are kept for it
+	idleBackfillWindow = 3 * 24 * time.Hour
+)
+
+// Below these, on average over a day, a service did nothing that day.
+// Health checks and keepalives keep most services above zero.
+const (
+	defaultIdleCPU            = 0.01
+	defaultIdleNetwork        = 1024
+	defaultIdleRequestsPerDay = 100
+	// defaultIdleMinDays is how many days a service is watched before it
+	// can be idle
+	defaultIdleMinDays = 7
+)
+
+// Kinds of tracked services.
+const (
+	idleContainer = "container"
+	idleTarget    = "target"
+)
+
+// podSuffix is the suffix Kubernetes adds to the names of the pods of a
+// workload: the hash of a ReplicaSet's template and a random string, both
+// of consonants and digits, or the ordinal of a StatefulSet's pod.
+var podSuffix = regexp.MustCompile(`(-[bcdfghjklmnpqrstvwxz2456789]{6,10})?-[bcdfghjklmnpqrstvwxz2456789]{5}$|-[0-9]+$`)
+
+var idleStates = stateScale{
+	"active":    severityOK,
+	"observing": severityOK,
+	"idle":      severityWarning,
+}
+
+func init() {
+	registerQueryType(queryTypeIdle, queryIdle, idleQuery{})
+	registerConfiguredCheck(queryTypeIdle, func(ds *testDataSource) bool { return ds.settings.Idle.Enabled })
+}
+
+type idleQuery struct {
+	// Target keeps only the services of one target; empty means all.
+	Target string `json:"target"`
+	// CPU, in cores, NetworkBytesPerSecond and RequestsPerDay are the usage
+	// below which a day counts as idle, 0.01 cores, 1 KiB/s and 100
+	// requests by default.
+	CPU                   float64 `json:"cpu"`
+	NetworkBytesPerSecond float64 `json:"networkBytesPerSecond"`
+	RequestsPerDay        float64 `json:"requestsPerDay"`
+	// MinDays is how many days of usage a service needs before it can be
+	// idle, seven by default.
+	MinDays int `json:"minDays"`
+	// All lists every service rather than only the idle ones.
+	All bool `json:"all"`
+}
+
+// idleThresholds are the daily usage below which a service did nothing.
+type idleThresholds struct {
+	CPU            float64
+	Network        float64
+	RequestsPerDay float64
+}
+
+// idleDay is what a service used on a day, in local time, over Seconds it
+// was watched.
+type idleDay struct {
+	Date         string  `json:"date"`
+	Seconds      float64 `json:"seconds"`
+	CPUSeconds   float64 `json:"cpuSeconds"`
+	NetworkBytes float64 `json:"networkBytes"`
+	Requests     float64 `json:"requests"`
+}
+
+// active reports whether the service used as much as any of thresholds
+// over the day on average. Requests only count for services that have
+// request counters.
+func (d *idleDay) active(t idleThresholds, hasRequests bool) bool {
+	if d.Seconds == 0 {
+		return false
+	}
+	return d.CPUSeconds/d.Seconds >= t.CPU || d.NetworkBytes/d.Seconds >= t.Network ||
+		hasRequests && d.Requests/d.Seconds*86400 >= t.RequestsPerDay
+}
+
+// trackedService is a container on a target, by namespace/workload for
+// Kubernetes and by name otherwise, or a target itself, and its days.
+type trackedService struct {
+	Target  string `json:"target"`
+	Kind    string `json:"kind"`
+	Service string `json:"service"`
+	// HasRequests is set once request counters were seen, and Seen is
+	// when the service was last seen
+	HasRequests bool       `json:"hasRequests"`
+	Seen        time.Time  `json:"seen"`
+	Days        []*idleDay `json:"days"`
+}
+
+func trackedServiceKey(target, kind, service string) string {
+	return target + "\x00" + kind + "\x00" + service
+}
+
+// day returns the day of date, adding it in order when it is new.
+func (s *trackedService) day(date string) *idleDay {
+	if n := len(s.Days); n > 0 && s.Days[n-1].Date == date {
+		return s.Days[n-1]
+	}
+	i := sort.Search(len(s.Days), func(i int) bool { return s.Days[i].Date >= date })
+	if i < len(s.Days) && s.Days[i].Date == date {
+		return s.Days[i]
+	}
+	d := &idleDay{Date: date}
+	s.Days = slices.Insert(s.Days, i, d)
+	return d
+}
+
+// add adds share of u to the day.
+func (d *idleDay) add(u idleUsage, share float64) {
+	d.CPUSeconds += share * u.CPUSeconds
+	d.NetworkBytes += share * u.NetworkBytes
+	d.Requests += share * u.Requests
+}
+
+// spreadOverDays calls fn with each date from from to to, in the location
+// of to, and the share of the time between them it covers.
+func spreadOverDays(from, to time.Time, fn func(date string, share float64)) {
+	from = from.In(to.Location())
+	total := to.Sub(from)
+	for start := from; start.Before(to); {
+		y, m, d := start.Date()
+		end := time.Date(y, m, d+1, 0, 0, 0, 0, start.Location())
+		if end.After(to) {
+			end = to
+		}
+		fn(start.Format(time.DateOnly), float64(end.Sub(start))/float64(total))
+		start = end
+	}
+}
+
+// idleReading is a counter of a service's usage.
+type idleReading struct {
+	Kind    string
+	Service string
+	// Metric is "cpu", "network" or "requests"
+	Metric string
+}
+
+// idleReadings classifies samples as counters of the usage of services: the
+// CPU and network of containers in cAdvisor series, and the requests of a
+// target itself, with its process CPU when it has requests. Samples that
+// aren't are left out.
+func idleReadings(target string, samples []metricSample, requests *regexp.Regexp) map[int]idleReading {
+	readings := map[int]idleReading{}
+	hasRequests := false
+	for i, s := range samples {
+		if requests.MatchString(s.Name) {
+			readings[i] = idleReading{Kind: idleTarget, Service: target, Metric: "requests"}
+			hasRequests = true
+			continue
+		}
+		var metric string
+		switch s.Name {
+		case "container_cpu_usage_seconds_total":
+			// Per-CPU series add up to the total, and those of pods and
+			// sandboxes to their containers
+			if cpu := s.Labels["cpu"]; cpu != "" && cpu != "total" {
+				continue
+			}
+			if c := s.Labels["container"]; s.Labels["pod"] != "" && (c == "" || c == "POD") {
+				continue
+			}
+			metric = "cpu"
+		case "container_network_receive_bytes_total", "container_network_transmit_bytes_total":
+			if s.Labels["interface"] == "lo" {
+				continue
+			}
+			metric = "network"
+		default:
+			continue
+		}
+		if service := idleContainerService(s.Labels); service != "" {
+			readings[i] = idleReading{Kind: idleContainer, Service: service, Metric: metric}
+		}
+	}
+	if hasRequests {
+		for i, s := range samples {
+			if s.Name == "process_cpu_seconds_total" {
+				readings[i] = idleReading{Kind: idleTarget, Service: target, Metric: "cpu"}
+			}
+		}
+	}
+	return readings
+}
+
+// idleContainerService returns the service of a cAdvisor series: the
+// namespace and workload of Kubernetes pods, as the kubelet or a standalone
+// cAdvisor labels them, or the name of other containers. It is empty for
+// series of cgroups that aren't containers.
+func idleContainerService(labels data.Labels) string {
+	namespace, pod := labels["namespace"], labels["pod"]
+	if namespace == "" {
+		namespace, pod = labels["container_label_io_kubernetes_pod_namespace"], labels["container_label_io_kubernetes_pod_name"]
+	}
+	if namespace != "" && pod != "" {
+		return namespace + "/" + podSuffix.ReplaceAllString(pod, "")
+	}
+	return labels["name"]
+}
+
+// idleCounter is the last value of a counter, and when it was read.
+type idleCounter struct {
+	Time  time.Time
+	Value float64
+}
+
+// idleTracker keeps the daily usage of services, in a file of the state
+// directory when there is one, so that weeks of it survive restarts.
+type idleTracker struct {
+	windowDays int
+	requests   *regexp.Regexp
+	path       string
+
+	mu       sync.Mutex
+	services map[string]*trackedService
+	// counters are the last values of counters, by target and series, and
+	// recorded when each target was last recorded
+	counters map[string]idleCounter
+	recorded map[string]time.Time
+}
+
+func newIdleTracker(settings models.IdleSettings, stateDir, uid string) (*idleTracker, error) {
+	t := &idleTracker{
+		windowDays: settings.WindowDays,
+		services:   map[string]*trackedService{},
+		counters:   map[string]idleCounter{},
+		recorded:   map[string]time.Time{},
+	}
+	if t.windowDays <= 0 {
+		t.windowDays = defaultIdleWindowDays
+	}
+	expr := settings.RequestMetric
+	if expr == "" {
+		expr = defaultIdleRequestMetric
+	}
+	var err error
+	if t.requests, err = regexp.Compile("^(?:" + expr + ")$"); err != nil {
+		return nil, fmt.Errorf("invalid requestMetric %q: %w", expr, err)
+	}
+	if stateDir != "" {
+		t.path = filepath.Join(stateDir, url.PathEscape(uid), "idle.json")
+	}
+	return t, nil
+}
+
+// load reads the stored days, if any.
+func (t *idleTracker) load() {
+	if t.path == "" {
+		return
+	}
+	body, err := os.ReadFile(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		backend.Logger.Warn("Failed to read stored service usage", "error", err)
+		return
+	}
+	var services []*trackedService
+	if err := json.Unmarshal(body, &services); err != nil {
+		backend.Logger.Warn("Ignoring corrupt stored service usage", "error", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range services {
+		t.services[trackedServiceKey(s.Target, s.Kind, s.Service)] = s
+	}
+}
+
+// save writes the days aside and renames them, so a crash never leaves a
+// partial file.
+func (t *idleTracker) save() error {
+	if t.path == "" {
+		return nil
+	}
+	t.mu.Lock()
+	body, err := json.Marshal(t.sortedServices())
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(t.path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, ".idle-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
+
+// idleUsage is what a service used between two records.
+type idleUsage struct {
+	CPUSeconds, NetworkBytes, Requests float64
+	// Continued is set when a counter of the service went on from the
+	// previous record, so the service ran in between
+	Continued bool
+}
+
+// record adds what the services of target used since it was last
+// recorded, from how far their counters went up, to the day of now.
+// Counters that reset are left out. After a gap longer than stale, such as
+// a target offline for a while, what services whose counters went on used
+// is spread over the days of the gap, which would otherwise keep totals
+// short for good, for gaps of up to idleBackfillWindow; the others are left
+// out. Days older than the window are
+// dropped.
+func (t *idleTracker) record(now time.Time, stale time.Duration, target string, samples []metricSample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	readings := idleReadings(target, samples, t.requests)
+	last, ok := t.recorded[target]
+	t.recorded[target] = now
+	elapsed := now.Sub(last)
+	valid := ok && elapsed > 0 && elapsed <= stale
+	late := ok && elapsed > stale && elapsed <= idleBackfillWindow
+
+	usage := map[*trackedService]*idleUsage{}
+	for i, r := range readings {
+		s := samples[i]
+		key := trackedServiceKey(target, r.Kind, r.Service)
+		service, ok := t.services[key]
+		if !ok {
+			service = &trackedService{Target: target, Kind: r.Kind, Service: r.Service}
+			t.services[key] = service
+		}
+		service.HasRequests = service.HasRequests || r.Metric == "requests"
+		service.Seen = now
+
+		counterKey := target + "\x00" + s.Name + s.Labels.String()
+		prev, known := t.counters[counterKey]
+		t.counters[counterKey] = idleCounter{Time: now, Value: s.Value}
+		u := usage[service]
+		if u == nil {
+			u = &idleUsage{}
+			usage[service] = u
+		}
+		if !known || !prev.Time.Equal(last) || s.Value < prev.Value {
+			continue
+		}
+		u.Continued = true
+		switch delta := s.Value - prev.Value; r.Metric {
+		case "cpu":
+			u.CPUSeconds += delta
+		case "network":
+			u.NetworkBytes += delta
+		case "requests":
+			u.Requests += delta
+		}
+	}
+	for service, u := range usage {
+		switch {
+		case valid:
+			day := service.day(now.Format(time.DateOnly))
+			day.Seconds += elapsed.Seconds()
+			day.add(*u, 1)
+		case late && u.Continued:
+			spreadOverDays(last, now, func(date string, share float64) {
+				day := service.day(date)
+				day.Seconds += share * elapsed.Seconds()
+				day.add(*u, share)
+			})
+		}
+	}
+
+	// Counters of series gone, such as those of replaced pods
+	for key, c := range t.counters {
+		if now.Sub(c.Time) > max(2*stale, idleBackfillWindow) {
+			delete(t.counters, key)
+		}
+	}
+	cutoff := now.AddDate(0, 0, -t.windowDays).Format(time.DateOnly)
+	for key, s := range t.services {
+		drop := 0
+		for drop < len(s.Days) && s.Days[drop].Date < cutoff {
+			drop++
+		}
+		s.Days = s.Days[drop:]
+		if len(s.Days) == 0 {
+			delete(t.services, key)
+		}
+	}
+}
+
+// sortedServices returns the services by target, kind and name. t.mu must
+// be held.
+func (t *idleTracker) sortedServices() []*trackedService {
+	services := make([]*trackedService, 0, len(t.services))
+	for _, s := range t.services {
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		a, b := services[i], services[j]
+		return trackedServiceKey(a.Target, a.Kind, a.Service) < trackedServiceKey(b.Target, b.Kind, b.Service)
+	})
+	return services
+}
+
+// idleReport is the usage of a service over the window.
+type idleReport struct {
+	Target      string
+	Kind        string
+	Service     string
+	HasRequests bool
+	// Observed is how long the service was watched, and CPU, Network and
+	// RequestsPerDay its mean usage over it
+	Observed       time.Duration
+	CPU            float64
+	Network        float64
+	RequestsPerDay float64
+	// LastActive is the start of the last day it was active, zero when it
+	// wasn't within the window
+	LastActive time.Time
+	Status     string
+}
+
+// report returns the usage of the services of target, or of all services
+// when target is empty, judged against thresholds. Services gone from the
+// last record of their target, such as removed containers, are left out.
+func (t *idleTracker) report(target string, thresholds idleThresholds, minDays int) []idleReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var reports []idleReport
+	for _, s := range t.sortedServices() {
+		if target != "" && s.Target != target {
+			continue
+		}
+		if recorded, ok := t.recorded[s.Target]; ok && s.Seen.Before(recorded) {
+			continue
+		}
+		r := idleReport{Target: s.Target, Kind: s.Kind, Service: s.Service, HasRequests: s.HasRequests}
+		var seconds, cpu, network, requests float64
+		var days int
+		for _, d := range s.Days {
+			seconds += d.Seconds
+			cpu += d.CPUSeconds
+			network += d.NetworkBytes
+			requests += d.Requests
+			if d.Seconds > 0 {
+				days++
+			}
+			if d.active(thresholds, s.HasRequests) {
+				if start, err := time.ParseInLocation(time.DateOnly, d.Date, time.Local); err == nil {
+					r.LastActive = start
+				}
+			}
+		}
+		if seconds == 0 {
+			continue
+		}
+		r.Observed = time.Duration(seconds * float64(time.Second))
+		r.CPU, r.Network, r.RequestsPerDay = cpu/seconds, network/seconds, requests/seconds*86400
+		switch {
+		case !r.LastActive.IsZero():
+			r.Status = "active"
+		case days < minDays:
+			r.Status = "observing"
+		default:
+			r.Status = "idle"
+		}
+		reports = append(reports, r)
+	}
+	return reports
+}
+
+// runIdleTracker samples the usage of the targets' services every interval,
+// through the scrape cache.
+func (ds *testDataSource) runIdleTracker(ctx context.Context) {
+	interval := defaultIdleInterval
+	if m := ds.settings.Idle.IntervalMinutes; m > 0 {
+		interval = time.Duration(m) * time.Minute
+	}
+	ds.idle.load()
+
+	job := ds.schedule.add("idle", "", interval, time.Now())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job.run(func() error {
+			now := time.Now()
+			for _, target := range ds.targets {
+				samples, err := ds.scrapeMetrics(ctx, target)
+				if err != nil {
+					backend.Logger.Debug("Skipping service usage sample", "target", target.Name, "error", err)
+					continue
+				}
+				ds.idle.record(now, 2*interval, target.Name, samples)
+			}
+			if err := ds.idle.save(); err != nil {
+				backend.Logger.Warn("Failed to store service usage", "error", err)
+			}
+			return nil
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func queryIdle(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q idleQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if ds.idle == nil {
+		return nil, fmt.Errorf("idle service tracking is not enabled")
+	}
+	thresholds := idleThresholds{CPU: q.CPU, Network: q.NetworkBytesPerSecond, RequestsPerDay: q.RequestsPerDay}
+	if thresholds.CPU <= 0 {
+		thresholds.CPU = defaultIdleCPU
+	}
+	if thresholds.Network <= 0 {
+		thresholds.Network = defaultIdleNetwork
+	}
+	if thresholds.RequestsPerDay <= 0 {
+		thresholds.RequestsPerDay = defaultIdleRequestsPerDay
+	}
+	minDays := q.MinDays
+	if minDays <= 0 {
+		minDays = defaultIdleMinDays
+	}
+
+	var reports []idleReport
+	for _, r := range ds.idle.report(q.Target, thresholds, minDays) {
+		if q.All || r.Status == "idle" {
+			reports = append(reports, r)
+		}
+	}
+	return data.Frames{idleFrame(reports)}, nil
+}
+
+// idleFrame returns a row per service with its mean usage over the window
+// and the last day it was active.
+func idleFrame(reports []idleReport) *data.Frame {
+	statusField, severityField := newStateFields(idleStates)
+	frame := data.NewFrame("idle services",
+		data.NewField("target", nil, []string{}),
+		data.NewField("kind", nil, []string{}),
+		data.NewField("service", nil, []string{}),
+		data.NewField("observed", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("cpu", nil, []float64{}),
+		data.NewField("network", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "Bps"}),
+		data.NewField("requests_per_day", nil, []*float64{}),
+		data.NewField("last_active", nil, []*time.Time{}),
+		statusField,
+		severityField,
+	)
+	for _, r := range reports {
+		var requests *float64
+		if r.HasRequests {
+			v := r.RequestsPerDay
+			requests = &v
+		}
+		var lastActive *time.Time
+		if !r.LastActive.IsZero() {
+			t := r.LastActive
+			lastActive = &t
+		}
+		frame.AppendRow(r.Target, r.Kind, r.Service, r.Observed.Seconds(), r.CPU, r.Network, requests, lastActive, r.Status, idleStates.severity(r.Status))
+	}
+	return frame
+}
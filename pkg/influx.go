@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// ingestInflux sets samples from a line of the InfluxDB line protocol,
+// measurement[,tag=value...] field=value[,field=value...] [timestamp], as
+// Telegraf's socket_writer output sends. Each numeric or boolean field is
+// a series named <measurement>_<field> labeled with the tags, as Telegraf's
+// Prometheus output names them; string fields are skipped. Samples are
+// recorded as they come, as for other push sources; the timestamp is only
+// returned, for clock skew detection.
+func ingestInflux(samples *sampleSet, line string) (time.Time, error) {
+	parts := splitInflux(line, ' ')
+	if len(parts) < 2 || len(parts) > 3 {
+		return time.Time{}, fmt.Errorf("expected measurement[,tags] fields [timestamp]")
+	}
+	series := splitInflux(parts[0], ',')
+	measurement := sanitizeMetricName(unescapeInflux(series[0]))
+	if measurement == "" {
+		return time.Time{}, fmt.Errorf("no measurement")
+	}
+	labels := data.Labels{}
+	for _, tag := range series[1:] {
+		kv := splitInflux(tag, '=')
+		if len(kv) != 2 {
+			return time.Time{}, fmt.Errorf("invalid tag %q", tag)
+		}
+		labels[sanitizeMetricName(unescapeInflux(kv[0]))] = unescapeInflux(kv[1])
+	}
+
+	for _, field := range splitInflux(parts[1], ',') {
+		kv := splitInflux(field, '=')
+		if len(kv) != 2 || kv[0] == "" {
+			return time.Time{}, fmt.Errorf("invalid field %q", field)
+		}
+		value, ok, err := influxValue(kv[1])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("field %s: %w", kv[0], err)
+		}
+		if ok {
+			samples.add(measurement+"_"+sanitizeMetricName(unescapeInflux(kv[0])), labels, value)
+		}
+	}
+	var reported time.Time
+	if len(parts) == 3 {
+		reported, _ = parseUnixTimestamp(parts[2])
+	}
+	return reported, nil
+}
+
+// influxValue parses a field value: a float, an integer suffixed with i or
+// u, or a boolean. Strings are not numbers, and return false.
+func influxValue(raw string) (float64, bool, error) {
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	if strings.HasPrefix(raw, `"`) {
+		return 0, false, nil
+	}
+	if strings.HasSuffix(raw, "i") || strings.HasSuffix(raw, "u") {
+		raw = raw[:len(raw)-1]
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid value %q", raw)
+	}
+	return v, true, nil
+}
+
+// splitInflux splits s at the occurrences of sep that are neither escaped
+// nor within a quoted string.
+func splitInflux(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeInflux removes the escapes of commas, equals signs and spaces in
+// measurements, tags and field keys.
+func unescapeInflux(s string) string {
+	return strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ").Replace(s)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Scrape and query instrumentation, labelled by target and by the RefID of
+// the query that caused the scrape; background scrapes have an empty RefID.
+var (
+	scrapeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "grafana_plugin",
+			Name:      "scrape_duration_seconds",
+			Help:      "Duration of scrape requests.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"target", "ref_id"},
+	)
+
+	scrapeBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "grafana_plugin",
+			Name:      "scrape_response_bytes",
+			Help:      "Size of scrape responses.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+		},
+		[]string{"target", "ref_id"},
+	)
+
+	scrapeParseDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "grafana_plugin",
+			Name:      "scrape_parse_duration_seconds",
+			Help:      "Time spent parsing scrape responses.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"target", "ref_id"},
+	)
+
+	querySeries = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "grafana_plugin",
+			Name:      "query_series",
+			Help:      "Number of series a metric query returned per target.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+		},
+		[]string{"target", "ref_id"},
+	)
+)
+
+type refIDKey struct{}
+
+// withRefID tags ctx with the RefID of the query it runs.
+func withRefID(ctx context.Context, refID string) context.Context {
+	return context.WithValue(ctx, refIDKey{}, refID)
+}
+
+func refIDFromContext(ctx context.Context) string {
+	refID, _ := ctx.Value(refIDKey{}).(string)
+	return refID
+}
+
+// queryUsage counts the scrape load a query causes. Scrapes shared through a
+// target's flight group count for the query that started them.
+type queryUsage struct {
+	scrapes   atomic.Int64
+	cacheHits atomic.Int64
+	bytes     atomic.Int64
+
+	mu sync.Mutex
+	// targetScrapes counts scrapes by target name
+	targetScrapes map[string]int64
+}
+
+func (u *queryUsage) scraped(target string, bytes int) {
+	u.scrapes.Add(1)
+	u.bytes.Add(int64(bytes))
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.targetScrapes == nil {
+		u.targetScrapes = map[string]int64{}
+	}
+	u.targetScrapes[target]++
+}
+
+type queryUsageKey struct{}
+
+// withQueryUsage tags ctx with a queryUsage counting the scrapes run with it.
+func withQueryUsage(ctx context.Context) (context.Context, *queryUsage) {
+	usage := &queryUsage{}
+	return context.WithValue(ctx, queryUsageKey{}, usage), usage
+}
+
+// queryUsageFromContext returns the usage of the query ctx runs, or nil
+// outside of queries.
+func queryUsageFromContext(ctx context.Context) *queryUsage {
+	usage, _ := ctx.Value(queryUsageKey{}).(*queryUsage)
+	return usage
+}
+
+// scrapeStats describes the last scrape of a target. It is attached to the
+// provenance of metric query frames, which shows in the query inspector.
+type scrapeStats struct {
+	Target          string    `json:"target"`
+	URL             string    `json:"url"`
+	ScrapedAt       time.Time `json:"scrapedAt"`
+	DurationMs      float64   `json:"durationMs"`
+	Bytes           int       `json:"bytes"`
+	ParseDurationMs float64   `json:"parseDurationMs"`
+	Series          int       `json:"series"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// redactURL hides the password of URLs with credentials.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
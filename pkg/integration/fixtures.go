@@ -0,0 +1,227 @@
+// Package integration runs the containerized fixtures of the plugin's
+// end-to-end tests: a mock exporter, an MQTT broker and an SNMP simulator,
+// started with the docker CLI. Tests using them are built with the
+// integration tag, and skip when docker isn't available:
+//
+//	go test -tags integration ./pkg/...
+//
+// A new integration adds its fixture here, next to the others, and its
+// tests to pkg/integration_test.go.
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// readyTimeout is how long a fixture has to become ready once started.
+const readyTimeout = 60 * time.Second
+
+// Fixture is a container a test runs against.
+type Fixture struct {
+	Name  string
+	Image string
+	// Port is the port the fixture serves on in the container, such as
+	// "9100/tcp", published on a free port of the host
+	Port string
+	// Mounts are host paths, relative to the package directory of the
+	// test, mounted read-only at container paths
+	Mounts map[string]string
+	Env    map[string]string
+	// Command overrides the command of the image
+	Command []string
+	// Ready reports whether the fixture serving at addr, a host:port, is
+	// ready; it is retried until readyTimeout. Without it, the fixture is
+	// ready once the port accepts connections, which UDP ports always do.
+	Ready func(ctx context.Context, addr string) error
+}
+
+// MockExporter serves testdata/fixtures/exporter/metrics, an exposition
+// whose values never change, at http://addr/metrics.
+var MockExporter = Fixture{
+	Name:    "exporter",
+	Image:   "busybox:1.36",
+	Port:    "9100/tcp",
+	Mounts:  map[string]string{"testdata/fixtures/exporter": "/www"},
+	Command: []string{"httpd", "-f", "-p", "9100", "-h", "/www"},
+	Ready: func(ctx context.Context, addr string) error {
+		return httpReady(ctx, "http://"+addr+"/metrics")
+	},
+}
+
+// MQTTBroker is a Mosquitto broker accepting anonymous clients at
+// tcp://addr, publishing its $SYS topics.
+var MQTTBroker = Fixture{
+	Name:    "mqtt",
+	Image:   "eclipse-mosquitto:2",
+	Port:    "1883/tcp",
+	Command: []string{"mosquitto", "-c", "/mosquitto-no-auth.conf"},
+}
+
+// SNMPSimulator answers SNMP v1 and v2c requests at udp://addr with the
+// recorded agents of snmpsim, such as the community "public".
+var SNMPSimulator = Fixture{
+	Name:  "snmp",
+	Image: "tandrup/snmpsim:v0.4",
+	Port:  "161/udp",
+}
+
+// Container is a started fixture.
+type Container struct {
+	ID string
+	// Addr is the host:port the fixture's port is published on
+	Addr string
+}
+
+// Available reports whether fixtures can be started: whether the docker
+// CLI is installed and its daemon reachable.
+func Available() bool {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return false
+	}
+	return exec.Command("docker", "info", "--format", "{{.ServerVersion}}").Run() == nil
+}
+
+// Start starts f for the duration of t, skipping t when docker isn't
+// available, and waits for it to be ready.
+func Start(t testing.TB, f Fixture) *Container {
+	t.Helper()
+	if !Available() {
+		t.Skip("docker is not available")
+	}
+	args := []string{"run", "-d", "--rm", "--label", "homelab-plugin-fixture=" + f.Name, "-p", "127.0.0.1::" + f.Port}
+	for host, path := range f.Mounts {
+		abs, err := filepath.Abs(host)
+		if err != nil {
+			t.Fatalf("fixture %s: %v", f.Name, err)
+		}
+		args = append(args, "-v", abs+":"+path+":ro")
+	}
+	for k, v := range f.Env {
+		args = append(args, "-e", k+"="+v)
+	}
+	args = append(args, f.Image)
+	args = append(args, f.Command...)
+	id, err := docker(args...)
+	if err != nil {
+		t.Fatalf("fixture %s: failed to start: %v", f.Name, err)
+	}
+	t.Cleanup(func() {
+		if _, err := docker("rm", "-f", id); err != nil {
+			t.Logf("fixture %s: failed to remove container %s: %v", f.Name, id, err)
+		}
+	})
+
+	binding, err := docker("port", id, f.Port)
+	if err != nil {
+		t.Fatalf("fixture %s: %v", f.Name, err)
+	}
+	// One binding per line, the IPv4 one first
+	c := &Container{ID: id, Addr: strings.SplitN(binding, "\n", 2)[0]}
+
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+	ready := f.Ready
+	if ready == nil {
+		ready = func(ctx context.Context, addr string) error {
+			if strings.HasSuffix(f.Port, "/udp") {
+				return nil
+			}
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+	}
+	for {
+		err := ready(ctx, c.Addr)
+		if err == nil {
+			return c
+		}
+		select {
+		case <-ctx.Done():
+			logs, _ := docker("logs", "--tail", "20", id)
+			t.Fatalf("fixture %s: not ready after %s: %v\n%s", f.Name, readyTimeout, err, logs)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func docker(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("docker %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func httpReady(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Settings returns the instance settings of a data source configured with
+// jsonData, marshalled as JSON, and secure settings, with an API key so
+// that its health check passes.
+func Settings(t testing.TB, jsonData any, secure map[string]string) backend.DataSourceInstanceSettings {
+	t.Helper()
+	raw, err := json.Marshal(jsonData)
+	if err != nil {
+		t.Fatalf("invalid settings: %v", err)
+	}
+	decrypted := map[string]string{"apiKey": "integration"}
+	for k, v := range secure {
+		decrypted[k] = v
+	}
+	return backend.DataSourceInstanceSettings{
+		UID:                     "integration-" + strings.ReplaceAll(t.Name(), "/", "-"),
+		Name:                    "integration",
+		JSONData:                raw,
+		DecryptedSecureJSONData: decrypted,
+		Updated:                 time.Now(),
+	}
+}
+
+// StreamSender collects the frames a stream sends, for tests to read.
+type StreamSender struct {
+	Packets chan json.RawMessage
+}
+
+// NewStreamSender returns a sender buffering up to n packets; further
+// packets block until read.
+func NewStreamSender(n int) (*StreamSender, *backend.StreamSender) {
+	s := &StreamSender{Packets: make(chan json.RawMessage, n)}
+	return s, backend.NewStreamSender(s)
+}
+
+// Send implements backend.StreamPacketSender.
+func (s *StreamSender) Send(packet *backend.StreamPacket) error {
+	s.Packets <- packet.Data
+	return nil
+}
@@ -0,0 +1,130 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+	"github.com/kirillyesikov/homelab-plugin/pkg/integration"
+)
+
+// startIntegrationDataSource creates an instance with the settings of
+// jsonData, disposed of when t ends.
+func startIntegrationDataSource(t *testing.T, jsonData map[string]any) *testDataSource {
+	t.Helper()
+	inst, err := newDataSource(context.Background(), integration.Settings(t, jsonData, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := inst.(*testDataSource)
+	t.Cleanup(ds.Dispose)
+	return ds
+}
+
+// queryIntegration runs query over the last five minutes, failing t on
+// errors. The range ends a minute ahead, for the live scrape of a target
+// not scraped yet to fall within it.
+func queryIntegration(t *testing.T, ds *testDataSource, query string) data.Frames {
+	t.Helper()
+	now := time.Now()
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:         "A",
+			JSON:          []byte(query),
+			Interval:      time.Second,
+			MaxDataPoints: 100,
+			TimeRange:     backend.TimeRange{From: now.Add(-5 * time.Minute), To: now.Add(time.Minute)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dr := resp.Responses["A"]
+	if dr.Error != nil {
+		t.Fatalf("query %s: %v", query, dr.Error)
+	}
+	return dr.Frames
+}
+
+func TestIntegrationExporter(t *testing.T) {
+	exporter := integration.Start(t, integration.MockExporter)
+	ds := startIntegrationDataSource(t, map[string]any{"url": "http://" + exporter.Addr})
+
+	t.Run("health", func(t *testing.T) {
+		result, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != backend.HealthStatusOk {
+			t.Fatalf("health %v: %s", result.Status, result.Message)
+		}
+	})
+
+	t.Run("query", func(t *testing.T) {
+		frames := queryIntegration(t, ds, `{"metric": "homelab_fixture_temperature_celsius", "labels": {"room": "attic"}}`)
+		if len(frames) != 1 {
+			t.Fatalf("got %d frames, want 1", len(frames))
+		}
+		values := frames[0].Fields[1]
+		if n := values.Len(); n == 0 || values.At(n-1).(float64) != 21.5 {
+			t.Errorf("last value of %s is not 21.5", displaySeries(values.Name, values.Labels))
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		frames := queryIntegration(t, ds, `{"metric": "homelab_fixture_requests_total", "stream": true, "streamIntervalSeconds": 1}`)
+		if len(frames) != 1 || frames[0].Meta == nil || frames[0].Meta.Channel == "" {
+			t.Fatal("streaming query returned no channel")
+		}
+		channel, err := live.ParseChannel(frames[0].Meta.Channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: channel.Path})
+		if err != nil || sub.Status != backend.SubscribeStreamStatusOK {
+			t.Fatalf("subscribe: %v, %v", sub, err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		packets, sender := integration.NewStreamSender(4)
+		go ds.RunStream(ctx, &backend.RunStreamRequest{Path: channel.Path}, sender)
+		select {
+		case packet := <-packets.Packets:
+			var frame data.Frame
+			if err := json.Unmarshal(packet, &frame); err != nil {
+				t.Fatal(err)
+			}
+			// The time field and the two series
+			if len(frame.Fields) != 3 {
+				t.Errorf("stream frame has %d fields, want 3", len(frame.Fields))
+			}
+		case <-ctx.Done():
+			t.Fatal("stream sent no frame")
+		}
+	})
+}
+
+func TestIntegrationMQTTBroker(t *testing.T) {
+	exporter := integration.Start(t, integration.MockExporter)
+	broker := integration.Start(t, integration.MQTTBroker)
+	ds := startIntegrationDataSource(t, map[string]any{
+		"url":     "http://" + exporter.Addr,
+		"brokers": []map[string]string{{"name": "mosquitto", "kind": "mosquitto", "url": "tcp://" + broker.Addr}},
+	})
+
+	frames := queryIntegration(t, ds, `{"queryType": "broker"}`)
+	if len(frames) != 1 || frames[0].Rows() != 1 {
+		t.Fatalf("got %d frames, want one with a row for the broker", len(frames))
+	}
+	if kind := frames[0].Fields[1].At(0).(string); !strings.EqualFold(kind, "mosquitto") {
+		t.Errorf("broker kind is %q, want mosquitto", kind)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeIperf = "iperf"
+
+const (
+	defaultIperfSchedule     = "0 3 * * *"
+	defaultIperfDuration     = 10 * time.Second
+	defaultIperfUDPBandwidth = 100
+	defaultIperfPort         = 5201
+	// iperfServerStartup is how long a server started as a daemon is given
+	// to listen before its client connects
+	iperfServerStartup = time.Second
+)
+
+// maxIperfResults bounds the results kept per pair.
+const maxIperfResults = 1000
+
+func init() {
+	registerQueryType(queryTypeIperf, queryIperf, iperfQuery{})
+	registerConfiguredCheck(queryTypeIperf, func(ds *testDataSource) bool { return ds.iperf != nil })
+}
+
+type iperfQuery struct {
+	// Client and Server select pairs by their hosts; empty means all of them.
+	Client string `json:"client"`
+	Server string `json:"server"`
+	// Mode is "timeline" (default) for throughput, retransmit, jitter and
+	// loss series per pair, or "summary" for a row per pair comparing its
+	// last test with its median over the time range.
+	Mode string `json:"mode"`
+}
+
+// iperfPair is a pair of hosts tested, with the address the client
+// connects to.
+type iperfPair struct {
+	client  string
+	server  string
+	address string
+}
+
+func (p iperfPair) key() string {
+	return p.client + "\x00" + p.server
+}
+
+// iperfTests are the configured iperf3 tests, and their results.
+type iperfTests struct {
+	schedule     cronSchedule
+	pairs        []iperfPair
+	duration     time.Duration
+	udpBandwidth int
+	port         int
+
+	mu      sync.Mutex
+	results map[string][]iperfResult
+}
+
+// iperfResult is a test of a pair. TCP and UDP are nil when their run
+// failed.
+type iperfResult struct {
+	Time   time.Time
+	Client string
+	Server string
+	TCP    *iperfTCP
+	UDP    *iperfUDP
+	Error  string
+}
+
+type iperfTCP struct {
+	Mbps        float64
+	Retransmits int64
+}
+
+type iperfUDP struct {
+	Mbps        float64
+	JitterMs    float64
+	LossPercent float64
+}
+
+func newIperfTests(settings models.IperfSettings, sshHosts []string) (*iperfTests, error) {
+	spec := settings.Schedule
+	if spec == "" {
+		spec = defaultIperfSchedule
+	}
+	schedule, err := parseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	t := &iperfTests{
+		schedule:     schedule,
+		duration:     defaultIperfDuration,
+		udpBandwidth: defaultIperfUDPBandwidth,
+		port:         defaultIperfPort,
+		results:      map[string][]iperfResult{},
+	}
+	if settings.DurationSeconds > 0 {
+		t.duration = time.Duration(settings.DurationSeconds) * time.Second
+	}
+	if settings.UDPBandwidthMbps > 0 {
+		t.udpBandwidth = settings.UDPBandwidthMbps
+	}
+	if settings.Port > 0 {
+		if settings.Port > 65535 {
+			return nil, fmt.Errorf("invalid port %d", settings.Port)
+		}
+		t.port = settings.Port
+	}
+	seen := map[string]bool{}
+	for _, p := range settings.Pairs {
+		pair := iperfPair{client: p.Client, server: p.Server, address: p.ServerAddress}
+		for _, host := range []string{p.Client, p.Server} {
+			if !slices.Contains(sshHosts, host) {
+				return nil, fmt.Errorf("SSH host %q is not configured", host)
+			}
+		}
+		switch {
+		case p.Client == p.Server:
+			return nil, fmt.Errorf("pair of %s has the same client and server", p.Client)
+		case seen[pair.key()]:
+			return nil, fmt.Errorf("duplicate pair from %s to %s", p.Client, p.Server)
+		}
+		seen[pair.key()] = true
+		if pair.address == "" {
+			pair.address = p.Server
+			if host, _, err := net.SplitHostPort(p.Server); err == nil {
+				pair.address = host
+			}
+		}
+		if !validDestination.MatchString(pair.address) {
+			return nil, fmt.Errorf("invalid server address %q", pair.address)
+		}
+		t.pairs = append(t.pairs, pair)
+	}
+	return t, nil
+}
+
+func (t *iperfTests) record(pair iperfPair, r iperfResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history := append(t.results[pair.key()], r)
+	if len(history) > maxIperfResults {
+		history = history[len(history)-maxIperfResults:]
+	}
+	t.results[pair.key()] = history
+}
+
+// window returns the results of the pairs q selects within tr, by pair.
+func (t *iperfTests) window(tr backend.TimeRange, q iperfQuery) map[iperfPair][]iperfResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	results := map[iperfPair][]iperfResult{}
+	for _, pair := range t.pairs {
+		if (q.Client != "" && pair.client != q.Client) || (q.Server != "" && pair.server != q.Server) {
+			continue
+		}
+		var rs []iperfResult
+		for _, r := range t.results[pair.key()] {
+			if !r.Time.Before(tr.From) && !r.Time.After(tr.To) {
+				rs = append(rs, r)
+			}
+		}
+		results[pair] = rs
+	}
+	return results
+}
+
+// iperfReport is the part of iperf3's JSON report the tests read.
+type iperfReport struct {
+	End struct {
+		SumSent struct {
+			BitsPerSecond float64 `json:"bits_per_second"`
+			Retransmits   int64   `json:"retransmits"`
+		} `json:"sum_sent"`
+		SumReceived struct {
+			BitsPerSecond float64 `json:"bits_per_second"`
+		} `json:"sum_received"`
+		// Sum summarizes UDP tests, as the server received them
+		Sum struct {
+			BitsPerSecond float64 `json:"bits_per_second"`
+			JitterMs      float64 `json:"jitter_ms"`
+			LostPercent   float64 `json:"lost_percent"`
+		} `json:"sum"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+func parseIperfReport(raw []byte) (iperfReport, error) {
+	var report iperfReport
+	if err := json.Unmarshal(raw, &report); err != nil {
+		return report, fmt.Errorf("failed to parse iperf3 report: %w", err)
+	}
+	if report.Error != "" {
+		return report, fmt.Errorf("iperf3: %s", report.Error)
+	}
+	return report, nil
+}
+
+// runIperf starts a one-off iperf3 server on the server of pair, and runs
+// the client against it with args, returning the client's report.
+func (ds *testDataSource) runIperf(ctx context.Context, t *iperfTests, pair iperfPair, args ...string) (iperfReport, error) {
+	port := strconv.Itoa(t.port)
+	if _, err := ds.runRemoteCommand(ctx, pair.server, shellCommand("iperf3", "-s", "-1", "-D", "-p", port)); err != nil {
+		return iperfReport{}, err
+	}
+	select {
+	case <-ctx.Done():
+		return iperfReport{}, ctx.Err()
+	case <-time.After(iperfServerStartup):
+	}
+	seconds := strconv.Itoa(int(t.duration / time.Second))
+	client := append([]string{"iperf3", "-J", "-c", pair.address, "-p", port, "-t", seconds}, args...)
+	raw, err := ds.runRemoteCommand(ctx, pair.client, shellCommand(client...))
+	if err != nil {
+		return iperfReport{}, err
+	}
+	return parseIperfReport(raw)
+}
+
+// runIperfPair tests the throughput of a pair over TCP, then its jitter and
+// loss over UDP.
+func (ds *testDataSource) runIperfPair(ctx context.Context, t *iperfTests, pair iperfPair) iperfResult {
+	result := iperfResult{Time: time.Now(), Client: pair.client, Server: pair.server}
+	report, err := ds.runIperf(ctx, t, pair)
+	if err != nil {
+		result.Error = "tcp: " + err.Error()
+		return result
+	}
+	result.TCP = &iperfTCP{Mbps: report.End.SumReceived.BitsPerSecond / 1e6, Retransmits: report.End.SumSent.Retransmits}
+
+	report, err = ds.runIperf(ctx, t, pair, "-u", "-b", strconv.Itoa(t.udpBandwidth)+"M")
+	if err != nil {
+		result.Error = "udp: " + err.Error()
+		return result
+	}
+	result.UDP = &iperfUDP{Mbps: report.End.Sum.BitsPerSecond / 1e6, JitterMs: report.End.Sum.JitterMs, LossPercent: report.End.Sum.LostPercent}
+	return result
+}
+
+// runIperfTests tests the pairs in turn on the schedule, until the instance
+// is disposed of.
+func (ds *testDataSource) runIperfTests(ctx context.Context) {
+	t := ds.iperf
+	next := t.schedule.next(time.Now())
+	if next.IsZero() {
+		backend.Logger.Warn("iperf3 schedule never runs")
+		return
+	}
+	job := ds.schedule.add("iperf", "", 0, next)
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		job.run(func() error { return ds.iperfRound(ctx, func(int, int, string) {}) })
+		next = t.schedule.next(time.Now())
+		job.plan(next)
+	}
+}
+
+// iperfRound tests the pairs in turn, reporting progress by pair.
+func (ds *testDataSource) iperfRound(ctx context.Context, progress operationProgress) error {
+	t := ds.iperf
+	failed := 0
+	for i, pair := range t.pairs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		progress(i, len(t.pairs), fmt.Sprintf("testing %s to %s", pair.client, pair.server))
+		result := ds.runIperfPair(ctx, t, pair)
+		t.record(pair, result)
+		if result.Error != "" {
+			backend.Logger.Warn("iperf3 test failed", "client", pair.client, "server", pair.server, "error", result.Error)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d iperf3 tests failed", failed, len(t.pairs))
+	}
+	return nil
+}
+
+func queryIperf(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q iperfQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if ds.iperf == nil {
+		return nil, fmt.Errorf("no iperf3 tests configured")
+	}
+	results := ds.iperf.window(query.TimeRange, q)
+	pairs := make([]iperfPair, 0, len(results))
+	for pair := range results {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].key() < pairs[j].key() })
+	switch q.Mode {
+	case "", "timeline":
+		return iperfTimelineFrames(pairs, results), nil
+	case "summary":
+		return data.Frames{iperfSummaryFrame(pairs, results)}, nil
+	default:
+		return nil, fmt.Errorf("unknown iperf mode %q", q.Mode)
+	}
+}
+
+// iperfTimelineFrames returns the tests of each pair, a frame per pair.
+func iperfTimelineFrames(pairs []iperfPair, results map[iperfPair][]iperfResult) data.Frames {
+	frames := make(data.Frames, 0, len(pairs))
+	for _, pair := range pairs {
+		labels := data.Labels{"client": pair.client, "server": pair.server}
+		frame := data.NewFrame("iperf",
+			data.NewField("time", nil, []time.Time{}),
+			data.NewField("throughput", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "Mbits"}),
+			data.NewField("retransmits", labels, []*int64{}),
+			data.NewField("udp_throughput", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "Mbits"}),
+			data.NewField("jitter", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+			data.NewField("loss", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		)
+		for _, r := range results[pair] {
+			var throughput, udpThroughput, jitter, loss *float64
+			var retransmits *int64
+			if r.TCP != nil {
+				throughput, retransmits = &r.TCP.Mbps, &r.TCP.Retransmits
+			}
+			if r.UDP != nil {
+				udpThroughput, jitter, loss = &r.UDP.Mbps, &r.UDP.JitterMs, &r.UDP.LossPercent
+			}
+			frame.AppendRow(r.Time, throughput, retransmits, udpThroughput, jitter, loss)
+		}
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// iperfSummaryFrame compares the last throughput of each pair with its
+// median over the range, so that a port or NIC that degraded stands out by
+// its change.
+func iperfSummaryFrame(pairs []iperfPair, results map[iperfPair][]iperfResult) *data.Frame {
+	frame := data.NewFrame("iperf_summary",
+		data.NewField("client", nil, []string{}),
+		data.NewField("server", nil, []string{}),
+		data.NewField("tests", nil, []int64{}),
+		data.NewField("throughput", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "Mbits"}),
+		data.NewField("median_throughput", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "Mbits"}),
+		data.NewField("change", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("jitter", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("loss", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("last_error", nil, []string{}),
+	)
+	for _, pair := range pairs {
+		rs := results[pair]
+		var throughputs []float64
+		var last, median, change, jitter, loss *float64
+		for _, r := range rs {
+			if r.TCP != nil {
+				throughputs = append(throughputs, r.TCP.Mbps)
+				last = &r.TCP.Mbps
+			}
+			if r.UDP != nil {
+				jitter, loss = &r.UDP.JitterMs, &r.UDP.LossPercent
+			}
+		}
+		if len(throughputs) > 0 {
+			slices.Sort(throughputs)
+			m := throughputs[len(throughputs)/2]
+			median = &m
+			if m > 0 {
+				c := (*last - m) / m * 100
+				change = &c
+			}
+		}
+		lastError := ""
+		if len(rs) > 0 {
+			lastError = rs[len(rs)-1].Error
+		}
+		frame.AppendRow(pair.client, pair.server, int64(len(rs)), last, median, change, jitter, loss, lastError)
+	}
+	return frame
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeJobs = "jobs"
+
+// jobStates are the states of background jobs. Jobs that haven't run yet
+// are "pending", and unknown.
+var jobStates = stateScale{
+	"ok":      severityOK,
+	"running": severityOK,
+	"failed":  severityCritical,
+}
+
+func init() {
+	registerQueryType(queryTypeJobs, queryJobs, jobsQuery{})
+}
+
+type jobsQuery struct {
+	// Kind selects the jobs of a kind, such as "scrape" or "probe"; empty
+	// means all of them.
+	Kind string `json:"kind"`
+}
+
+// jobSchedule tracks the background jobs of an instance: when they last ran,
+// how that went, and when they run next. A nil schedule tracks nothing.
+type jobSchedule struct {
+	mu   sync.Mutex
+	jobs []*scheduledJob
+}
+
+// scheduledJob is a background job, of a kind and on a subject such as a
+// target, run every interval. Jobs without an interval run once.
+type scheduledJob struct {
+	schedule *jobSchedule
+	kind     string
+	subject  string
+	interval time.Duration
+
+	// Guarded by the schedule's mutex
+	next      time.Time
+	lastStart time.Time
+	lastEnd   time.Time
+	running   bool
+	lastErr   error
+	runs      int
+	failures  int
+}
+
+// add registers a job first running at first.
+func (s *jobSchedule) add(kind, subject string, interval time.Duration, first time.Time) *scheduledJob {
+	if s == nil {
+		return nil
+	}
+	job := &scheduledJob{schedule: s, kind: kind, subject: subject, interval: interval, next: first}
+	s.mu.Lock()
+	s.jobs = append(s.jobs, job)
+	s.mu.Unlock()
+	return job
+}
+
+// run runs fn as a run of j, and returns its error.
+func (j *scheduledJob) run(fn func() error) error {
+	if j == nil {
+		return fn()
+	}
+	s := j.schedule
+	s.mu.Lock()
+	j.lastStart, j.running = time.Now(), true
+	s.mu.Unlock()
+
+	err := fn()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.lastEnd, j.running, j.lastErr = time.Now(), false, err
+	j.runs++
+	if err != nil {
+		j.failures++
+	}
+	// Tickers fire an interval after the previous tick, however long
+	// the run took
+	j.next = time.Time{}
+	if j.interval > 0 {
+		j.next = j.lastStart.Add(j.interval)
+	}
+	return err
+}
+
+// plan sets when j runs next, for jobs without a fixed interval.
+func (j *scheduledJob) plan(next time.Time) {
+	if j == nil {
+		return
+	}
+	j.schedule.mu.Lock()
+	defer j.schedule.mu.Unlock()
+	j.next = next
+}
+
+// jobStatus is a copy of the state of a job.
+type jobStatus struct {
+	Kind      string
+	Subject   string
+	Interval  time.Duration
+	State     string
+	LastRun   *time.Time
+	Duration  *float64
+	NextRun   *time.Time
+	Runs      int
+	Failures  int
+	LastError string
+}
+
+func (s *jobSchedule) statuses(kind string) []jobStatus {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]jobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		if kind != "" && j.kind != kind {
+			continue
+		}
+		st := jobStatus{Kind: j.kind, Subject: j.subject, Interval: j.interval, State: "pending", Runs: j.runs, Failures: j.failures}
+		if !j.next.IsZero() {
+			next := j.next
+			st.NextRun = &next
+		}
+		if !j.lastStart.IsZero() {
+			last := j.lastStart
+			st.LastRun = &last
+		}
+		switch {
+		case j.running:
+			st.State = "running"
+		case j.runs == 0:
+		case j.lastErr != nil:
+			st.State = "failed"
+			st.LastError = j.lastErr.Error()
+		default:
+			st.State = "ok"
+		}
+		if j.runs > 0 {
+			ms := float64(j.lastEnd.Sub(j.lastStart).Microseconds()) / 1000
+			st.Duration = &ms
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Kind != statuses[j].Kind {
+			return statuses[i].Kind < statuses[j].Kind
+		}
+		return statuses[i].Subject < statuses[j].Subject
+	})
+	return statuses
+}
+
+func queryJobs(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q jobsQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	statusField, severityField := newStateFields(jobStates)
+	frame := data.NewFrame("jobs",
+		data.NewField("kind", nil, []string{}),
+		data.NewField("job", nil, []string{}),
+		statusField,
+		severityField,
+		data.NewField("interval", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("last_run", nil, []*time.Time{}),
+		data.NewField("duration", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("next_run", nil, []*time.Time{}),
+		data.NewField("runs", nil, []int64{}),
+		data.NewField("failures", nil, []int64{}),
+		data.NewField("last_error", nil, []string{}),
+	)
+	for _, st := range ds.schedule.statuses(q.Kind) {
+		var interval *float64
+		if st.Interval > 0 {
+			s := st.Interval.Seconds()
+			interval = &s
+		}
+		frame.AppendRow(st.Kind, st.Subject, st.State, jobStates.severity(st.State), interval,
+			st.LastRun, st.Duration, st.NextRun, int64(st.Runs), int64(st.Failures), st.LastError)
+	}
+	return data.Frames{frame}, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const (
+	defaultKioskAlerts = 5
+	defaultKioskRange  = 5 * time.Minute
+	// kioskTTL is how long a summary is served before it is compiled
+	// again, however many displays poll it
+	kioskTTL = 30 * time.Second
+)
+
+// Reductions of kiosk stats.
+const (
+	kioskReduceLast = "last"
+	kioskReduceSum  = "sum"
+	kioskReduceAvg  = "avg"
+	kioskReduceMin  = "min"
+	kioskReduceMax  = "max"
+)
+
+// alertSeverityRank orders the severities of alerts, the most severe
+// first; others come after them.
+var alertSeverityRank = map[string]int{"critical": 0, "warning": 1, "info": 2}
+
+// kiosk compiles the summary of kiosk displays.
+type kiosk struct {
+	stats     []models.KioskStat
+	maxAlerts int
+
+	mu      sync.Mutex
+	summary *kioskSummary
+}
+
+// kioskSummary is the payload of kiosk displays: few, short fields,
+// formatted already, for microcontrollers to show as they are.
+type kioskSummary struct {
+	// Time is when the summary was compiled, in Unix seconds
+	Time int64 `json:"t"`
+	// Status is that of the status page when there is one, and otherwise
+	// down with critical alerts, degraded with others, and up
+	Status string       `json:"status"`
+	Alerts []kioskAlert `json:"alerts"`
+	// More is how many alerts were left out past the maximum
+	More  int         `json:"more,omitempty"`
+	Stats []kioskStat `json:"stats"`
+}
+
+type kioskAlert struct {
+	Severity string `json:"sev"`
+	Text     string `json:"text"`
+}
+
+type kioskStat struct {
+	Name string `json:"name"`
+	// Value is null when the query failed or returned nothing, and Text
+	// is then "-"
+	Value *float64 `json:"value"`
+	Text  string   `json:"text"`
+}
+
+func newKiosk(settings models.KioskSettings) (*kiosk, error) {
+	k := &kiosk{stats: settings.Stats, maxAlerts: defaultKioskAlerts}
+	if settings.MaxAlerts < 0 {
+		return nil, fmt.Errorf("maxAlerts must not be negative")
+	}
+	if settings.MaxAlerts > 0 {
+		k.maxAlerts = settings.MaxAlerts
+	}
+	for _, s := range settings.Stats {
+		switch {
+		case s.Name == "":
+			return nil, fmt.Errorf("kiosk stat has no name")
+		case len(s.Query) == 0:
+			return nil, fmt.Errorf("kiosk stat %s has no query", s.Name)
+		case s.RangeSeconds < 0:
+			return nil, fmt.Errorf("kiosk stat %s has a negative rangeSeconds", s.Name)
+		case s.Decimals < 0:
+			return nil, fmt.Errorf("kiosk stat %s has negative decimals", s.Name)
+		}
+		switch s.Reduce {
+		case "", kioskReduceLast, kioskReduceSum, kioskReduceAvg, kioskReduceMin, kioskReduceMax:
+		default:
+			return nil, fmt.Errorf("kiosk stat %s: unknown reduce %q", s.Name, s.Reduce)
+		}
+	}
+	return k, nil
+}
+
+// current returns the summary of the last kioskTTL, compiling a new one
+// when it is older.
+func (k *kiosk) current(ctx context.Context, ds *testDataSource) kioskSummary {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	if k.summary != nil && now.Sub(time.Unix(k.summary.Time, 0)) < kioskTTL {
+		return *k.summary
+	}
+	summary := kioskSummary{Time: now.Unix(), Alerts: []kioskAlert{}, Stats: []kioskStat{}}
+
+	alerts := ds.kioskAlerts(now)
+	sort.SliceStable(alerts, func(i, j int) bool { return severityRank(alerts[i].Severity) < severityRank(alerts[j].Severity) })
+	summary.Status = statusUp
+	if ds.statusPage != nil {
+		summary.Status = ds.statusPage.current(ctx, ds).Status
+	} else if len(alerts) > 0 {
+		summary.Status = statusDegraded
+		if alerts[0].Severity == "critical" {
+			summary.Status = statusDown
+		}
+	}
+	if len(alerts) > k.maxAlerts {
+		summary.More = len(alerts) - k.maxAlerts
+		alerts = alerts[:k.maxAlerts]
+	}
+	summary.Alerts = append(summary.Alerts, alerts...)
+
+	for _, s := range k.stats {
+		stat := kioskStat{Name: s.Name, Text: "-"}
+		if v, err := ds.kioskStat(ctx, s, now); err != nil {
+			backend.Logger.Warn("Kiosk stat failed", "stat", s.Name, "error", err)
+		} else if v != nil {
+			stat.Value = v
+			stat.Text = strconv.FormatFloat(*v, 'f', s.Decimals, 64)
+			if s.Unit != "" {
+				stat.Text += " " + s.Unit
+			}
+		}
+		summary.Stats = append(summary.Stats, stat)
+	}
+	k.summary = &summary
+	return summary
+}
+
+func severityRank(severity string) int {
+	if rank, ok := alertSeverityRank[severity]; ok {
+		return rank
+	}
+	return len(alertSeverityRank)
+}
+
+// kioskAlerts returns the alerts firing at now: the problems the plugin
+// detected itself, and the alerts Alertmanager notified it of.
+func (ds *testDataSource) kioskAlerts(now time.Time) []kioskAlert {
+	var alerts []kioskAlert
+	for _, a := range ds.currentAlerts(now) {
+		alerts = append(alerts, kioskAlert{Severity: a.Labels["severity"], Text: a.Annotations["summary"]})
+	}
+	if ds.alertLog != nil {
+		firing := ds.alertLog.within(backend.TimeRange{From: now, To: now}, alertHistoryQuery{Status: "firing"}, now)
+		for _, r := range firing {
+			text := r.Annotations["summary"]
+			if text == "" {
+				text = r.Labels["alertname"]
+			}
+			alerts = append(alerts, kioskAlert{Severity: r.Labels["severity"], Text: text})
+		}
+	}
+	return alerts
+}
+
+// kioskStat runs the query of s over the range ending at now and reduces
+// the last values of its series to one, nil when there are none.
+func (ds *testDataSource) kioskStat(ctx context.Context, s models.KioskStat, now time.Time) (*float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, statusCheckTimeout)
+	defer cancel()
+	span := defaultKioskRange
+	if s.RangeSeconds > 0 {
+		span = time.Duration(s.RangeSeconds) * time.Second
+	}
+	query := backend.DataQuery{
+		RefID:         "A",
+		TimeRange:     backend.TimeRange{From: now.Add(-span), To: now},
+		Interval:      max(span/100, time.Second),
+		MaxDataPoints: 100,
+	}
+	frames, err := ds.runInnerQuery(ctx, query, s.Query)
+	if err != nil {
+		return nil, err
+	}
+	series, err := lastValues(frames)
+	if err != nil {
+		return nil, err
+	}
+	var values []float64
+	for _, last := range series {
+		if last.Value != nil && !math.IsNaN(*last.Value) {
+			values = append(values, *last.Value)
+		}
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	v := values[0]
+	switch s.Reduce {
+	case kioskReduceSum, kioskReduceAvg:
+		v = 0
+		for _, x := range values {
+			v += x
+		}
+		if s.Reduce == kioskReduceAvg {
+			v /= float64(len(values))
+		}
+	case kioskReduceMin:
+		for _, x := range values {
+			v = math.Min(v, x)
+		}
+	case kioskReduceMax:
+		for _, x := range values {
+			v = math.Max(v, x)
+		}
+	}
+	return &v, nil
+}
+
+// text formats the summary as plain text lines, for displays without a
+// JSON parser: the status, an alert per line prefixed with its severity,
+// and a stat per line as its name and text.
+func (s kioskSummary) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", s.Status)
+	for _, a := range s.Alerts {
+		fmt.Fprintf(&b, "%s: %s\n", a.Severity, a.Text)
+	}
+	if s.More > 0 {
+		fmt.Fprintf(&b, "+%d more\n", s.More)
+	}
+	for _, st := range s.Stats {
+		fmt.Fprintf(&b, "%s: %s\n", st.Name, st.Text)
+	}
+	return b.String()
+}
+
+// handleKioskSummary serves the kiosk summary as JSON, or as plain text
+// with format=text.
+func (ds *testDataSource) handleKioskSummary(w http.ResponseWriter, r *http.Request) {
+	if ds.configErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid configuration: %w", ds.configErr))
+		return
+	}
+	if ds.kiosk == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("the kiosk summary is not available"))
+		return
+	}
+	summary := ds.kiosk.current(r.Context(), ds)
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, http.StatusOK, summary)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, summary.text())
+	default:
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q, expected json or text", format))
+	}
+}
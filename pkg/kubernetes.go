@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const sourceKubernetes = "kubernetes"
+
+// serviceAccountDir holds the credentials mounted into every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+const metricsAPIPath = "/apis/metrics.k8s.io/v1beta1"
+
+// kubernetesQuery is a metric query with source "kubernetes".
+type kubernetesQuery struct {
+	Source string `json:"source"`
+	// Resource is "pods" (default) or "nodes".
+	Resource string `json:"resource"`
+	// Namespace restricts pods to a namespace; empty means all of them.
+	Namespace string `json:"namespace"`
+}
+
+// kubernetesClient calls the API server of a cluster.
+type kubernetesClient struct {
+	httpClient *http.Client
+	server     string
+	token      string
+}
+
+// kubeconfig is the part of a kubeconfig file needed to reach a cluster.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// newKubernetesClient builds a client from the kubeconfig secret or, with
+// InCluster, from the pod's service account.
+func newKubernetesClient(settings models.KubernetesSettings, kubeconfigYAML string, policy tlsPolicy, egress *egressPolicy) (*kubernetesClient, error) {
+	if settings.InCluster {
+		return inClusterClient(policy, egress)
+	}
+	if kubeconfigYAML == "" {
+		return nil, fmt.Errorf("kubeconfig is not configured")
+	}
+
+	var cfg kubeconfig
+	if err := yaml.Unmarshal([]byte(kubeconfigYAML), &cfg); err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig: %w", err)
+	}
+
+	contextName := settings.Context
+	if contextName == "" {
+		contextName = cfg.CurrentContext
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range cfg.Contexts {
+		if c.Name == contextName {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("kubeconfig context %q not found", contextName)
+	}
+
+	tlsConfig := &tls.Config{}
+	policy.apply(tlsConfig)
+	client := &kubernetesClient{}
+	for _, c := range cfg.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		client.server = c.Cluster.Server
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := kubeconfigData(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate authority of cluster %s: %w", clusterName, err)
+		}
+		if ca != nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("invalid certificate authority of cluster %s", clusterName)
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+	if client.server == "" {
+		return nil, fmt.Errorf("kubeconfig cluster %q not found", clusterName)
+	}
+
+	for _, u := range cfg.Users {
+		if u.Name != userName {
+			continue
+		}
+		client.token = u.User.Token
+		cert, err := kubeconfigData(u.User.ClientCertificateData, u.User.ClientCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate of user %s: %w", userName, err)
+		}
+		key, err := kubeconfigData(u.User.ClientKeyData, u.User.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client key of user %s: %w", userName, err)
+		}
+		if cert != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client certificate of user %s: %w", userName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	client.httpClient = newKubernetesHTTPClient(tlsConfig, egress)
+	return client, nil
+}
+
+// kubeconfigData returns inline base64 data, or else the contents of path.
+// Both being empty returns nil.
+func kubeconfigData(inline, path string) ([]byte, error) {
+	if inline != "" {
+		return base64.StdEncoding.DecodeString(inline)
+	}
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	return nil, nil
+}
+
+func inClusterClient(policy tlsPolicy, egress *egressPolicy) (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account CA")
+	}
+
+	tlsConfig := &tls.Config{RootCAs: pool}
+	policy.apply(tlsConfig)
+	return &kubernetesClient{
+		httpClient: newKubernetesHTTPClient(tlsConfig, egress),
+		server:     "https://" + net.JoinHostPort(host, port),
+		token:      strings.TrimSpace(string(token)),
+	}, nil
+}
+
+func newKubernetesHTTPClient(tlsConfig *tls.Config, egress *egressPolicy) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if egress != nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		egress.guard(dialer, "")
+		transport.DialContext = egress.guardDial(dialer.DialContext)
+		egress.guardProxy(transport)
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}
+}
+
+func (c *kubernetesClient) get(ctx context.Context, path string, v any) error {
+	u, err := url.JoinPath(c.server, path)
+	if err != nil {
+		return fmt.Errorf("invalid API server URL: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %w", path, err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return withCode(codeTargetUnreachable, fmt.Errorf("failed to fetch %s: %w", path, err))
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return withCode(codeAuthFailed, fmt.Errorf("%s returned %s", path, resp.Status))
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return nil
+}
+
+type resourceUsage struct {
+	CPU    string `json:"cpu"`
+	Memory string `json:"memory"`
+}
+
+type metricsMetadata struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type nodeMetricsList struct {
+	Items []struct {
+		Metadata  metricsMetadata `json:"metadata"`
+		Timestamp time.Time       `json:"timestamp"`
+		Usage     resourceUsage   `json:"usage"`
+	} `json:"items"`
+}
+
+type podMetricsList struct {
+	Items []struct {
+		Metadata   metricsMetadata `json:"metadata"`
+		Timestamp  time.Time       `json:"timestamp"`
+		Containers []struct {
+			Name  string        `json:"name"`
+			Usage resourceUsage `json:"usage"`
+		} `json:"containers"`
+	} `json:"items"`
+}
+
+// quantitySuffixes are the multipliers of Kubernetes quantity suffixes.
+var quantitySuffixes = map[string]float64{
+	"n": 1e-9, "u": 1e-6, "m": 1e-3,
+	"k": 1e3, "M": 1e6, "G": 1e9, "T": 1e12, "P": 1e15, "E": 1e18,
+	"Ki": 1 << 10, "Mi": 1 << 20, "Gi": 1 << 30, "Ti": 1 << 40, "Pi": 1 << 50, "Ei": 1 << 60,
+}
+
+// parseQuantity parses a Kubernetes quantity such as "250m", "1.5" or
+// "512Mi".
+func parseQuantity(s string) (float64, error) {
+	number := strings.TrimRight(s, "numkKMGTPEi")
+	multiplier := 1.0
+	if suffix := s[len(number):]; suffix != "" {
+		m, ok := quantitySuffixes[suffix]
+		if !ok {
+			return 0, fmt.Errorf("invalid quantity %q", s)
+		}
+		multiplier = m
+	}
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil || math.IsNaN(v) {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+	return v * multiplier, nil
+}
+
+// queryKubernetes returns the CPU (in cores) and memory (in bytes) usage of
+// pods or nodes as reported by the metrics API.
+func (ds *testDataSource) queryKubernetes(ctx context.Context, query backend.DataQuery) (data.Frames, error) {
+	var q kubernetesQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if ds.kubernetes == nil {
+		return nil, fmt.Errorf("kubernetes is not configured")
+	}
+
+	switch q.Resource {
+	case "nodes":
+		return ds.kubernetesNodes(ctx)
+	case "", "pods":
+		return ds.kubernetesPods(ctx, q.Namespace)
+	}
+	return nil, fmt.Errorf("unknown kubernetes resource %q", q.Resource)
+}
+
+func (ds *testDataSource) kubernetesNodes(ctx context.Context) (data.Frames, error) {
+	var list nodeMetricsList
+	if err := ds.kubernetes.get(ctx, metricsAPIPath+"/nodes", &list); err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Metadata.Name < list.Items[j].Metadata.Name })
+
+	frame := data.NewFrame("nodes",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("node", nil, []string{}),
+		data.NewField("cpu", nil, []float64{}),
+		data.NewField("memory", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+	)
+	for _, item := range list.Items {
+		cpu, err := parseQuantity(item.Usage.CPU)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", item.Metadata.Name, err)
+		}
+		memory, err := parseQuantity(item.Usage.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", item.Metadata.Name, err)
+		}
+		frame.AppendRow(item.Timestamp, item.Metadata.Name, cpu, memory)
+	}
+	return data.Frames{frame}, nil
+}
+
+func (ds *testDataSource) kubernetesPods(ctx context.Context, namespace string) (data.Frames, error) {
+	path := metricsAPIPath + "/pods"
+	if namespace != "" {
+		path = metricsAPIPath + "/namespaces/" + url.PathEscape(namespace) + "/pods"
+	}
+	var list podMetricsList
+	if err := ds.kubernetes.get(ctx, path, &list); err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		a, b := list.Items[i].Metadata, list.Items[j].Metadata
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+
+	frame := data.NewFrame("pods",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("namespace", nil, []string{}),
+		data.NewField("pod", nil, []string{}),
+		data.NewField("cpu", nil, []float64{}),
+		data.NewField("memory", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+	)
+	for _, item := range list.Items {
+		// A pod uses what its containers use
+		var cpu, memory float64
+		for _, c := range item.Containers {
+			v, err := parseQuantity(c.Usage.CPU)
+			if err != nil {
+				return nil, fmt.Errorf("pod %s/%s: %w", item.Metadata.Namespace, item.Metadata.Name, err)
+			}
+			cpu += v
+			if v, err = parseQuantity(c.Usage.Memory); err != nil {
+				return nil, fmt.Errorf("pod %s/%s: %w", item.Metadata.Namespace, item.Metadata.Name, err)
+			}
+			memory += v
+		}
+		frame.AppendRow(item.Timestamp, item.Metadata.Namespace, item.Metadata.Name, cpu, memory)
+	}
+	return data.Frames{frame}, nil
+}
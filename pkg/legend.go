@@ -0,0 +1,37 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// legendLabelPattern matches the {{label}} placeholders of a legend format.
+var legendLabelPattern = regexp.MustCompile(`\{\{\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*\}\}`)
+
+// applyLegendFormat names the value fields of frames by format, in which
+// {{label}} stands for the value of a label of the field, or nothing if it
+// has no such label, and {{__name__}} for the name of the field.
+func applyLegendFormat(frames data.Frames, format string) {
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			if field.Type().Time() {
+				continue
+			}
+			name := legendLabelPattern.ReplaceAllStringFunc(format, func(placeholder string) string {
+				label := legendLabelPattern.FindStringSubmatch(placeholder)[1]
+				if label == "__name__" {
+					return field.Name
+				}
+				return field.Labels[label]
+			})
+			// Configs may be shared between series, so never modify them in place
+			var config data.FieldConfig
+			if field.Config != nil {
+				config = *field.Config
+			}
+			config.DisplayNameFromDS = name
+			field.Config = &config
+		}
+	}
+}
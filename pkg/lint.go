@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// grafanaQueryFields are set by Grafana on every query, whatever its type.
+var grafanaQueryFields = []string{
+	"refId", "datasource", "datasourceId", "hide", "key", "queryType",
+	"intervalMs", "maxDataPoints", "scopedVars",
+}
+
+// lintWarning is a problem found in a query. Field is empty for problems
+// with the query as a whole.
+type lintWarning struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// handleLintQuery statically checks the query JSON in the request body, so
+// provisioning pipelines can catch broken panels before they are deployed.
+func (ds *testDataSource) handleLintQuery(w http.ResponseWriter, r *http.Request) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		writeJSONError(w, http.StatusBadRequest, withCode(codeParseError, fmt.Errorf("invalid query JSON: %w", err)))
+		return
+	}
+
+	warnings := ds.lintQuery(raw)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"valid":    len(warnings) == 0,
+		"warnings": warnings,
+	})
+}
+
+func (ds *testDataSource) lintQuery(raw map[string]json.RawMessage) []lintWarning {
+	warnings := []lintWarning{}
+	warn := func(field, format string, args ...any) {
+		warnings = append(warnings, lintWarning{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var queryType string
+	if v, ok := raw["queryType"]; ok {
+		if err := json.Unmarshal(v, &queryType); err != nil {
+			warn("queryType", "must be a string")
+		}
+	}
+	model, ok := queryModels[queryType]
+	if !ok {
+		if queryType != "" {
+			warn("queryType", "unknown query type %q", queryType)
+			return warnings
+		}
+		model = Query{}
+		if source, ok := raw["source"]; ok && string(source) == `"`+sourceKubernetes+`"` {
+			model = kubernetesQuery{}
+		}
+	}
+
+	if err := ds.checkQueryTypeEnabled(queryType); err != nil {
+		warn("queryType", "%v", err)
+	}
+
+	known := map[string]bool{}
+	for _, name := range grafanaQueryFields {
+		known[name] = true
+	}
+	for _, m := range []any{queryOptions{}, model} {
+		for _, name := range jsonFieldNames(reflect.TypeOf(m)) {
+			known[name] = true
+		}
+	}
+	var unknown []string
+	for name := range raw {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		warn(name, "unknown field")
+	}
+
+	body, _ := json.Marshal(raw)
+	var opts queryOptions
+	if err := json.Unmarshal(body, &opts); err != nil {
+		warn("", "%v", err)
+		return warnings
+	}
+	if _, err := opts.timeout(); err != nil {
+		warn("timeout", "%v", err)
+	}
+	if _, _, err := opts.order(); err != nil {
+		warn("orderBy", "%v", err)
+	}
+	if stages, err := ds.expandPresets(opts.Pipeline); err != nil {
+		warn("pipeline", "%v", err)
+	} else if _, err := runPipeline(nil, stages, 0); err != nil {
+		// Stages check their parameters whether or not there is data
+		warn("pipeline", "%v", err)
+	}
+
+	if _, ok := model.(Query); !ok {
+		if err := json.Unmarshal(body, reflect.New(reflect.TypeOf(model)).Interface()); err != nil {
+			warn("", "%v", err)
+		}
+		return warnings
+	}
+
+	var q Query
+	if err := json.Unmarshal(body, &q); err != nil {
+		warn("", "%v", err)
+		return warnings
+	}
+	if q.Metric == "" && q.MetricRegex == "" {
+		warn("metric", "no metric specified in the query")
+	}
+	if q.MetricRegex != "" {
+		if _, err := regexp.Compile(q.MetricRegex); err != nil {
+			warn("metricRegex", "invalid regex: %v", err)
+		}
+	}
+	if (q.Target != "" || len(q.TargetLabels) > 0) && !strings.ContainsAny(q.Target, "$[") {
+		if _, err := ds.queryTargets(q); err != nil {
+			warn("target", "%v", err)
+		}
+	}
+	if q.Function != "" {
+		if _, err := functionStages(q.Function, q.By); err != nil {
+			warn("function", "%v", err)
+		}
+		if q.Stream {
+			warn("function", "functions are not supported on streaming queries")
+		}
+	}
+	return warnings
+}
+
+// jsonFieldNames returns the JSON names of the fields of struct type t,
+// including those of embedded structs.
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			names = append(names, jsonFieldNames(f.Type)...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// maxDatagram is the largest datagram read; UDP datagrams can't be larger.
+const maxDatagram = 64 << 10
+
+// metricListener is a target receiving StatsD metrics over UDP, or Graphite
+// plaintext metrics over TCP, from scripts and apps that can't be scraped,
+// or the metrics of collectd and Telegraf agents. Its samples are kept by
+// the target's push source.
+type metricListener struct {
+	// kind is "StatsD", "Graphite", "collectd" or "Telegraf"
+	kind    string
+	network string
+	addr    string
+	mapper  nameMapper
+}
+
+func newMetricListener(t models.Target) (*metricListener, error) {
+	l := &metricListener{kind: "StatsD"}
+	settings := t.StatsD
+	switch {
+	case t.Graphite != nil:
+		l.kind, settings = "Graphite", t.Graphite
+	case t.Collectd != nil:
+		l.kind, settings = "collectd", t.Collectd
+	case t.Telegraf != nil:
+		l.kind, settings = "Telegraf", t.Telegraf
+	}
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", t.URL, err)
+	}
+	l.network, l.addr = u.Scheme, u.Host
+	if l.mapper, err = newNameMapper(settings.Mappings); err != nil {
+		return nil, fmt.Errorf("%s: %w", strings.ToLower(l.kind), err)
+	}
+	return l, nil
+}
+
+// nameMapper maps dotted metric names to metric names and labels.
+type nameMapper []nameMapping
+
+type nameMapping struct {
+	match  []string
+	name   string
+	labels map[string]string
+}
+
+var captureRe = regexp.MustCompile(`\$(\d+)`)
+
+func newNameMapper(mappings []models.NameMapping) (nameMapper, error) {
+	mapper := make(nameMapper, 0, len(mappings))
+	for _, m := range mappings {
+		match := strings.Split(m.Match, ".")
+		wildcards := strings.Count(m.Match, "*")
+		for _, s := range append([]string{m.Name}, mapValues(m.Labels)...) {
+			for _, ref := range captureRe.FindAllStringSubmatch(s, -1) {
+				if n, _ := strconv.Atoi(ref[1]); n < 1 || n > wildcards {
+					return nil, fmt.Errorf("%s: %s refers to no component of %s", m.Name, ref[0], m.Match)
+				}
+			}
+		}
+		for label := range m.Labels {
+			if !metricNameRe.MatchString(label) {
+				return nil, fmt.Errorf("%s: invalid label name %q", m.Name, label)
+			}
+		}
+		mapper = append(mapper, nameMapping{match: match, name: m.Name, labels: m.Labels})
+	}
+	return mapper, nil
+}
+
+func mapValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// apply returns the metric name and labels of a dotted name: those of the
+// first mapping matching it, or else the name with its dots replaced.
+func (m nameMapper) apply(dotted string) (string, data.Labels) {
+	parts := strings.Split(dotted, ".")
+	for _, mapping := range m {
+		captures, ok := mapping.matches(parts)
+		if !ok {
+			continue
+		}
+		expand := func(s string) string {
+			return captureRe.ReplaceAllStringFunc(s, func(ref string) string {
+				n, _ := strconv.Atoi(ref[1:])
+				return captures[n-1]
+			})
+		}
+		labels := data.Labels{}
+		for label, value := range mapping.labels {
+			labels[label] = expand(value)
+		}
+		return sanitizeMetricName(expand(mapping.name)), labels
+	}
+	return sanitizeMetricName(dotted), data.Labels{}
+}
+
+// matches returns the components the wildcards of m matched in parts.
+func (m nameMapping) matches(parts []string) ([]string, bool) {
+	if len(parts) != len(m.match) {
+		return nil, false
+	}
+	var captures []string
+	for i, want := range m.match {
+		switch {
+		case want == "*":
+			captures = append(captures, parts[i])
+		case want != parts[i]:
+			return nil, false
+		}
+	}
+	return captures, true
+}
+
+// ingest applies a collectd datagram, or the lines of a datagram or line
+// of the other kinds, to samples, returning the newest timestamp of the
+// lines, zero when none has one, and the error of the first line that
+// didn't parse.
+func (l *metricListener) ingest(samples *sampleSet, text string) (time.Time, error) {
+	if l.kind == "collectd" {
+		if err := ingestCollectd(samples, []byte(text)); err != nil {
+			return time.Time{}, withCode(codeParseError, err)
+		}
+		return time.Time{}, nil
+	}
+	var newest time.Time
+	var firstErr error
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var reported time.Time
+		var err error
+		switch l.kind {
+		case "Graphite":
+			reported, err = l.ingestGraphite(samples, line)
+		case "Telegraf":
+			reported, err = ingestInflux(samples, line)
+		default:
+			err = l.ingestStatsD(samples, line)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = withCode(codeParseError, fmt.Errorf("%q: %w", line, err))
+		}
+		if reported.After(newest) {
+			newest = reported
+		}
+	}
+	return newest, firstErr
+}
+
+// ingestStatsD applies a StatsD line, name:value|type[|@rate][|#tag:value,...],
+// to samples. Counters (c) add up in <name>_total, divided by their sample
+// rate. Gauges (g) are set, or changed by values with a sign. Timers (ms)
+// add seconds to <name>_sum and one to <name>_count, and histograms and
+// distributions (h, d) add their value. Sets are not supported.
+func (l *metricListener) ingestStatsD(samples *sampleSet, line string) error {
+	dotted, rest, ok := strings.Cut(line, ":")
+	if !ok || dotted == "" {
+		return fmt.Errorf("expected name:value|type")
+	}
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return fmt.Errorf("expected name:value|type")
+	}
+	name, labels := l.mapper.apply(dotted)
+	rate := 1.0
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			r, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("invalid sample rate %q", f)
+			}
+			rate = r
+		case strings.HasPrefix(f, "#"):
+			// DogStatsD tags; those set by mappings take precedence
+			for _, tag := range strings.Split(f[1:], ",") {
+				key, value, ok := strings.Cut(tag, ":")
+				if key = sanitizeMetricName(key); ok && key != "" {
+					if _, mapped := labels[key]; !mapped {
+						labels[key] = value
+					}
+				}
+			}
+		}
+	}
+
+	raw, kind := fields[0], fields[1]
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %q", raw)
+	}
+	switch kind {
+	case "c":
+		name = strings.TrimSuffix(name, "_total") + "_total"
+		current, _ := samples.value(name, labels)
+		samples.add(name, labels, current+value/rate)
+	case "g":
+		if raw[0] == '+' || raw[0] == '-' {
+			current, _ := samples.value(name, labels)
+			value += current
+		}
+		samples.add(name, labels, value)
+	case "ms", "h", "d":
+		if kind == "ms" {
+			value /= 1000
+		}
+		sum, _ := samples.value(name+"_sum", labels)
+		count, _ := samples.value(name+"_count", labels)
+		samples.add(name+"_sum", labels, sum+value/rate)
+		samples.add(name+"_count", labels, count+1/rate)
+	case "s":
+		return fmt.Errorf("sets are not supported")
+	default:
+		return fmt.Errorf("unknown metric type %q", kind)
+	}
+	return nil
+}
+
+// ingestGraphite sets a sample from a Graphite plaintext line, path value
+// [timestamp], whose path may be tagged as path;tag=value;... Samples are
+// recorded as they come, like those of other push sources; the timestamp
+// is only returned, for clock skew detection.
+func (l *metricListener) ingestGraphite(samples *sampleSet, line string) (time.Time, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return time.Time{}, fmt.Errorf("expected path value [timestamp]")
+	}
+	path, tags, _ := strings.Cut(fields[0], ";")
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid value %q", fields[1])
+	}
+	name, labels := l.mapper.apply(path)
+	if tags != "" {
+		for _, tag := range strings.Split(tags, ";") {
+			key, value, ok := strings.Cut(tag, "=")
+			if key = sanitizeMetricName(key); ok && key != "" {
+				if _, mapped := labels[key]; !mapped {
+					labels[key] = value
+				}
+			}
+		}
+	}
+	samples.add(name, labels, value)
+	var reported time.Time
+	if len(fields) == 3 {
+		reported, _ = parseUnixTimestamp(fields[2])
+	}
+	return reported, nil
+}
+
+// listen receives the metrics of a listener target until the listener
+// fails, returning why, or the instance is disposed of.
+func (ds *testDataSource) listen(ctx context.Context, target *scrapeTarget) error {
+	l := target.listener
+	// Datagrams and lines are read apart, until the listener is closed
+	received := make(chan string)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	deliver := func(text string) bool {
+		select {
+		case received <- text:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	if l.network == "udp" {
+		conn, err := net.ListenPacket("udp", l.addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", l.addr, err)
+		}
+		defer conn.Close()
+		go func() {
+			buf := make([]byte, maxDatagram)
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					readErr <- err
+					return
+				}
+				if !deliver(string(buf[:n])) {
+					return
+				}
+			}
+		}()
+	} else {
+		ln, err := net.Listen("tcp", l.addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", l.addr, err)
+		}
+		defer ln.Close()
+		var mu sync.Mutex
+		conns := map[net.Conn]bool{}
+		defer func() {
+			mu.Lock()
+			defer mu.Unlock()
+			for conn := range conns {
+				conn.Close()
+			}
+		}()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					readErr <- err
+					return
+				}
+				mu.Lock()
+				conns[conn] = true
+				mu.Unlock()
+				go func() {
+					defer func() {
+						mu.Lock()
+						delete(conns, conn)
+						mu.Unlock()
+						conn.Close()
+					}()
+					scanner := bufio.NewScanner(conn)
+					for scanner.Scan() {
+						if !deliver(scanner.Text()) {
+							return
+						}
+					}
+				}()
+			}
+		}()
+	}
+	target.push.connected()
+	backend.Logger.Info(l.kind+" listener started", "target", target.Name, "address", l.addr)
+
+	ticker := time.NewTicker(pushRecordInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ds.drain:
+			return nil
+		case err := <-readErr:
+			return err
+		case text := <-received:
+			var reported time.Time
+			var err error
+			target.push.update(func(samples *sampleSet) { reported, err = l.ingest(samples, text) })
+			if err != nil {
+				backend.Logger.Debug("Ignoring "+l.kind+" metric", "target", target.Name, "error", err)
+			}
+			ds.observeClock(target, reported, time.Now())
+		case now := <-ticker.C:
+			target.push.flush(target, now)
+		}
+	}
+}
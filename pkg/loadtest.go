@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// perfScaleEnv scales the performance budgets for hosts slower than the
+// reference hardware, e.g. 2 for twice as long.
+const perfScaleEnv = "HOMELAB_PLUGIN_PERF_SCALE"
+
+// The synthetic load: targets of series each, scraped every interval over
+// the span queries cover, 1000 series of 240 points in all.
+const (
+	loadTargets         = 10
+	loadSeriesPerTarget = 100
+	loadSpan            = time.Hour
+	loadScrapeInterval  = 15 * time.Second
+	loadMetric          = "homelab_load_bytes_total"
+)
+
+// errPerfBudget is returned by the loadtest subcommand when a scenario
+// exceeds its budget.
+var errPerfBudget = errors.New("performance budget exceeded")
+
+// perfScenario is a workload with its performance budget: how long a run
+// may take at the 95th percentile, one run at a time, on the reference
+// hardware, a single core of a current x86-64 CPU, about what the plugin
+// gets of a small homelab host next to Grafana. TestPerfBudgets fails when
+// a budget is exceeded.
+type perfScenario struct {
+	name   string
+	budget time.Duration
+	run    func(ctx context.Context, env *loadEnv) error
+}
+
+var perfScenarios = []perfScenario{
+	{
+		name:   "query-1000-series",
+		budget: 100 * time.Millisecond,
+		run: func(ctx context.Context, env *loadEnv) error {
+			return env.query(ctx, `{"metric": "`+loadMetric+`", "target": "*"}`)
+		},
+	},
+	{
+		name:   "query-1000-series-sum-by",
+		budget: 250 * time.Millisecond,
+		run: func(ctx context.Context, env *loadEnv) error {
+			return env.query(ctx, `{"metric": "`+loadMetric+`", "target": "*", "function": "sum", "by": ["device"]}`)
+		},
+	},
+	{
+		name:   "query-1000-series-pipeline",
+		budget: 250 * time.Millisecond,
+		run: func(ctx context.Context, env *loadEnv) error {
+			return env.query(ctx, `{"metric": "`+loadMetric+`", "target": "*", "pipeline": [{"type": "rate"}, {"type": "topk", "k": 10}]}`)
+		},
+	},
+	{
+		name:   "scrape-100-series",
+		budget: 20 * time.Millisecond,
+		run: func(ctx context.Context, env *loadEnv) error {
+			_, err := env.ds.fetchMetrics(ctx, env.ds.targets[0])
+			return err
+		},
+	},
+}
+
+// perfBudgetScale returns the factor of perfScaleEnv, 1 when unset.
+func perfBudgetScale() (float64, error) {
+	v, ok := os.LookupEnv(perfScaleEnv)
+	if !ok || v == "" {
+		return 1, nil
+	}
+	scale, err := strconv.ParseFloat(v, 64)
+	if err != nil || scale <= 0 || math.IsInf(scale, 0) {
+		return 0, fmt.Errorf("invalid %s %q, expected a positive factor", perfScaleEnv, v)
+	}
+	return scale, nil
+}
+
+// loadEnv is an instance with the synthetic load: its targets are served
+// by a local server, and hold loadSpan of scrapes ending at now.
+type loadEnv struct {
+	ds       *testDataSource
+	server   *http.Server
+	listener net.Listener
+	now      time.Time
+}
+
+func newLoadEnv(ctx context.Context) (*loadEnv, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	env := &loadEnv{listener: listener, now: time.Now()}
+	var scrapes atomic.Int64
+	env.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		io.WriteString(w, loadExposition(int(scrapes.Add(1))))
+	})}
+	go env.server.Serve(listener)
+
+	targets := make([]map[string]any, loadTargets)
+	for i := range targets {
+		targets[i] = map[string]any{"name": fmt.Sprintf("load%d", i), "url": fmt.Sprintf("http://%s/metrics", listener.Addr())}
+	}
+	settings, err := cliInstanceSettings(cliDataSource{
+		UID:            "loadtest",
+		JSONData:       map[string]any{"targets": targets},
+		SecureJSONData: map[string]string{"apiKey": "loadtest"},
+	})
+	if err != nil {
+		env.server.Close()
+		return nil, err
+	}
+	if env.ds, err = newCLIDataSource(ctx, settings); err != nil {
+		env.server.Close()
+		return nil, err
+	}
+
+	steps := int(loadSpan / loadScrapeInterval)
+	for _, target := range env.ds.targets {
+		for step := 0; step < steps; step++ {
+			target.history.record(env.now.Add(-time.Duration(steps-1-step)*loadScrapeInterval), loadSamples(step))
+		}
+	}
+	return env, nil
+}
+
+func (env *loadEnv) close() {
+	env.ds.Dispose()
+	env.server.Close()
+}
+
+// loadSamples are the samples of a target at its step-th scrape, counters
+// each growing at its own rate.
+func loadSamples(step int) []metricSample {
+	samples := make([]metricSample, loadSeriesPerTarget)
+	for i := range samples {
+		samples[i] = metricSample{
+			seriesInfo: seriesInfo{Family: loadMetric, Name: loadMetric, Labels: data.Labels{"device": fmt.Sprintf("dev%d", i)}},
+			Value:      float64(step * (i + 1) * 1500),
+		}
+	}
+	return samples
+}
+
+// loadExposition is loadSamples in the text exposition format.
+func loadExposition(step int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# TYPE %s counter\n", loadMetric)
+	for _, s := range loadSamples(step) {
+		fmt.Fprintf(&b, "%s{device=%q} %s\n", s.Name, s.Labels["device"], strconv.FormatFloat(s.Value, 'g', -1, 64))
+	}
+	return b.String()
+}
+
+// query runs a query over loadSpan ending at now, at the resolution of
+// the scrapes.
+func (env *loadEnv) query(ctx context.Context, query string) error {
+	resp, err := env.ds.QueryData(ctx, &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:         "A",
+			JSON:          []byte(query),
+			Interval:      loadScrapeInterval,
+			MaxDataPoints: int64(loadSpan / loadScrapeInterval),
+			TimeRange:     backend.TimeRange{From: env.now.Add(-loadSpan), To: env.now},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Responses["A"].Error
+}
+
+// loadResult is how runs of a scenario went.
+type loadResult struct {
+	scenario      string
+	runs, errors  int
+	err           error
+	p50, p95, p99 time.Duration
+	budget        time.Duration
+}
+
+// withinBudget reports whether the runs succeeded within the budget,
+// scaled by scale.
+func (r loadResult) withinBudget(scale float64) bool {
+	return r.errors == 0 && float64(r.p95) <= float64(r.budget)*scale
+}
+
+// runLoad runs s in a loop on concurrency workers for duration, and at
+// least once on each.
+func runLoad(ctx context.Context, env *loadEnv, s perfScenario, concurrency int, duration time.Duration) loadResult {
+	result := loadResult{scenario: s.name, budget: s.budget}
+	deadline := time.Now().Add(duration)
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var own []time.Duration
+			errs := 0
+			var lastErr error
+			for len(own) == 0 || time.Now().Before(deadline) && ctx.Err() == nil {
+				start := time.Now()
+				if err := s.run(ctx, env); err != nil {
+					errs++
+					lastErr = err
+				}
+				own = append(own, time.Since(start))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			latencies = append(latencies, own...)
+			result.errors += errs
+			if lastErr != nil {
+				result.err = lastErr
+			}
+		}()
+	}
+	wg.Wait()
+
+	slices.Sort(latencies)
+	percentile := func(p float64) time.Duration {
+		return latencies[max(0, int(math.Ceil(p*float64(len(latencies))))-1)]
+	}
+	result.runs = len(latencies)
+	result.p50, result.p95, result.p99 = percentile(0.5), percentile(0.95), percentile(0.99)
+	return result
+}
+
+func cliLoadTest(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	duration := flags.Duration("duration", 10*time.Second, "how long each scenario runs")
+	concurrency := flags.Int("concurrency", 1, "runs of a scenario at a time")
+	if err := flags.Parse(args); err != nil || *duration <= 0 || *concurrency <= 0 {
+		return errCLIUsage
+	}
+	scenarios := perfScenarios
+	if flags.NArg() > 0 {
+		scenarios = nil
+		for _, name := range flags.Args() {
+			i := slices.IndexFunc(perfScenarios, func(s perfScenario) bool { return s.name == name })
+			if i < 0 {
+				return fmt.Errorf("unknown scenario %q", name)
+			}
+			scenarios = append(scenarios, perfScenarios[i])
+		}
+	}
+	scale, err := perfBudgetScale()
+	if err != nil {
+		return err
+	}
+
+	env, err := newLoadEnv(ctx)
+	if err != nil {
+		return err
+	}
+	defer env.close()
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCENARIO\tRUNS\tERRORS\tP50\tP95\tP99\tBUDGET\t")
+	failed := 0
+	for _, s := range scenarios {
+		r := runLoad(ctx, env, s, *concurrency, *duration)
+		verdict := "ok"
+		if !r.withinBudget(scale) {
+			verdict = "over budget"
+			failed++
+		}
+		budget := time.Duration(float64(r.budget) * scale)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", r.scenario, r.runs, r.errors,
+			r.p50.Round(time.Microsecond), r.p95.Round(time.Microsecond), r.p99.Round(time.Microsecond), budget, verdict)
+		if r.err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", r.scenario, r.err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d scenarios", errPerfBudget, failed, len(scenarios))
+	}
+	return nil
+}
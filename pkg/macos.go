@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeMacOS = "macos"
+
+// macOSCommands read each kind. iostat's first report averages since boot,
+// so two are taken a second apart; powermetrics and system daemons need
+// root, and launchctl falls back to the user's agents without it.
+var macOSCommands = map[string]string{
+	"cpu":      "iostat -n 0 -c 2 -w 1",
+	"power":    "sudo -n powermetrics --samplers cpu_power -i 1000 -n 1",
+	"services": "sudo -n launchctl list 2>/dev/null || launchctl list",
+}
+
+func init() {
+	registerQueryType(queryTypeMacOS, queryMacOS, macOSQuery{})
+	registerConfiguredCheck(queryTypeMacOS, func(ds *testDataSource) bool { return len(ds.settings.SSH.MacOS) > 0 })
+}
+
+type macOSQuery struct {
+	Host string `json:"host"`
+	// Kind is "cpu", "power" or "services".
+	Kind string `json:"kind"`
+	// Services are the labels of the launchd services to list; empty means
+	// those not shipped by Apple.
+	Services []string `json:"services"`
+}
+
+// launchdStates are the severities of launchd service states: services
+// that exited with an error are failed, others not running are inactive.
+var launchdStates = stateScale{"running": severityOK, "inactive": severityOK, "failed": severityCritical}
+
+// macCPU is the last iostat report of CPU usage and load.
+type macCPU struct {
+	User, System, Idle   float64
+	Load1, Load5, Load15 float64
+}
+
+// parseIostat parses the output of iostat -n 0, taking its last report.
+func parseIostat(raw []byte) (macCPU, error) {
+	var cpu macCPU
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 {
+			continue
+		}
+		values := make([]float64, 6)
+		numeric := true
+		for i, f := range fields {
+			v, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				// The header lines
+				numeric = false
+				break
+			}
+			values[i] = v
+		}
+		if numeric {
+			cpu = macCPU{values[0], values[1], values[2], values[3], values[4], values[5]}
+			found = true
+		}
+	}
+	if !found {
+		return cpu, fmt.Errorf("no CPU report in iostat output")
+	}
+	return cpu, scanner.Err()
+}
+
+// macPower is a power reading of powermetrics, in watts.
+type macPower struct {
+	Component string
+	Watts     float64
+}
+
+// powerLineRe matches the power readings of powermetrics: "CPU Power: 412 mW"
+// and "Combined Power (CPU + GPU + ANE): 520 mW" on Apple silicon, or
+// "Intel energy model derived package power (CPUs+GT+SA): 2.61W" on Intel.
+var powerLineRe = regexp.MustCompile(`^(.+?) [Pp]ower(?: \(.*\))?: ([\d.]+) ?(mW|W)$`)
+
+// parsePowermetrics parses the output of powermetrics' cpu_power sampler.
+func parsePowermetrics(raw []byte) ([]macPower, error) {
+	var readings []macPower
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		m := powerLineRe.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if m == nil {
+			continue
+		}
+		v, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid power %q", m[2])
+		}
+		if m[3] == "mW" {
+			v /= 1000
+		}
+		component := strings.ToLower(m[1])
+		if strings.HasPrefix(component, "intel energy model derived package") {
+			component = "package"
+		}
+		readings = append(readings, macPower{Component: component, Watts: v})
+	}
+	if len(readings) == 0 {
+		return nil, fmt.Errorf("no power readings in powermetrics output")
+	}
+	return readings, scanner.Err()
+}
+
+// launchdService is a line of launchctl list.
+type launchdService struct {
+	Label string
+	// PID is nil for services not running, and LastExit the status of
+	// their last exit
+	PID      *int64
+	LastExit int64
+}
+
+func (s launchdService) state() string {
+	switch {
+	case s.PID != nil:
+		return "running"
+	case s.LastExit != 0:
+		return "failed"
+	}
+	return "inactive"
+}
+
+// parseLaunchctlList parses launchctl list: a PID or "-", the last exit
+// status, and the label of each service.
+func parseLaunchctlList(raw []byte) ([]launchdService, error) {
+	var services []launchdService
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] == "PID" {
+			continue
+		}
+		s := launchdService{Label: fields[2]}
+		if fields[0] != "-" {
+			pid, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PID %q of %s", fields[0], s.Label)
+			}
+			s.PID = &pid
+		}
+		// Services killed by a signal have a negative status
+		status, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q of %s", fields[1], s.Label)
+		}
+		s.LastExit = status
+		services = append(services, s)
+	}
+	return services, scanner.Err()
+}
+
+func queryMacOS(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q macOSQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if q.Kind == "" {
+		q.Kind = "cpu"
+	}
+	cmd, ok := macOSCommands[q.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown macOS kind %q", q.Kind)
+	}
+	hosts, err := listedHosts("macOS", ds.settings.SSH.MacOS, q.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	percent := &data.FieldConfig{Unit: "percent"}
+	var frame *data.Frame
+	switch q.Kind {
+	case "cpu":
+		frame = data.NewFrame("macos_cpu",
+			data.NewField("host", nil, []string{}),
+			data.NewField("user", nil, []float64{}).SetConfig(percent),
+			data.NewField("system", nil, []float64{}).SetConfig(percent),
+			data.NewField("idle", nil, []float64{}).SetConfig(percent),
+			data.NewField("load1", nil, []float64{}),
+			data.NewField("load5", nil, []float64{}),
+			data.NewField("load15", nil, []float64{}),
+		)
+	case "power":
+		frame = data.NewFrame("macos_power",
+			data.NewField("host", nil, []string{}),
+			data.NewField("component", nil, []string{}),
+			data.NewField("power", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "watt"}),
+		)
+	case "services":
+		statusField, severityField := newStateFields(launchdStates)
+		frame = data.NewFrame("macos_services",
+			data.NewField("host", nil, []string{}),
+			data.NewField("service", nil, []string{}),
+			data.NewField("pid", nil, []*int64{}),
+			data.NewField("last_exit", nil, []int64{}),
+			statusField,
+			severityField,
+		)
+	}
+
+	for _, host := range hosts {
+		raw, err := ds.runRemoteCommand(ctx, host, cmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s on %s: %w", q.Kind, host, err)
+		}
+		switch q.Kind {
+		case "cpu":
+			cpu, err := parseIostat(raw)
+			if err != nil {
+				return nil, withCode(codeParseError, fmt.Errorf("%s: %w", host, err))
+			}
+			frame.AppendRow(host, cpu.User, cpu.System, cpu.Idle, cpu.Load1, cpu.Load5, cpu.Load15)
+		case "power":
+			readings, err := parsePowermetrics(raw)
+			if err != nil {
+				return nil, withCode(codeParseError, fmt.Errorf("%s: %w", host, err))
+			}
+			for _, r := range readings {
+				frame.AppendRow(host, r.Component, r.Watts)
+			}
+		case "services":
+			services, err := parseLaunchctlList(raw)
+			if err != nil {
+				return nil, withCode(codeParseError, fmt.Errorf("%s: %w", host, err))
+			}
+			for _, s := range services {
+				if len(q.Services) > 0 && !slices.Contains(q.Services, s.Label) {
+					continue
+				}
+				if len(q.Services) == 0 && strings.HasPrefix(s.Label, "com.apple.") {
+					continue
+				}
+				frame.AppendRow(host, s.Label, s.PID, s.LastExit, s.state(), launchdStates.severity(s.state()))
+			}
+		}
+	}
+	return data.Frames{frame}, nil
+}
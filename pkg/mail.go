@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeMail = "mail"
+
+// postfixQueues lists Postfix's queues in the order messages move through them.
+var postfixQueues = []string{"maildrop", "incoming", "active", "deferred", "hold"}
+
+func init() {
+	registerQueryType(queryTypeMail, queryMail, mailQuery{})
+	registerConfiguredCheck(queryTypeMail, func(ds *testDataSource) bool {
+		m := ds.settings.Mail
+		return m.PostfixHost != "" || m.RspamdURL != "" || m.Domain != ""
+	})
+}
+
+type mailQuery struct {
+	// Section is one of "postfix", "rspamd" or "dns".
+	Section string `json:"section"`
+}
+
+// postfixQueueStats summarizes one Postfix queue.
+type postfixQueueStats struct {
+	Messages  int64
+	Bytes     int64
+	OldestAge *float64
+}
+
+// parsePostfixQueue parses `postqueue -j` output, one JSON object per message.
+func parsePostfixQueue(raw []byte, now time.Time) (map[string]*postfixQueueStats, error) {
+	queues := map[string]*postfixQueueStats{}
+	for _, name := range postfixQueues {
+		queues[name] = &postfixQueueStats{}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var msg struct {
+			QueueName   string `json:"queue_name"`
+			ArrivalTime int64  `json:"arrival_time"`
+			MessageSize int64  `json:"message_size"`
+		}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return nil, fmt.Errorf("failed to parse postqueue output: %w", err)
+		}
+
+		q, ok := queues[msg.QueueName]
+		if !ok {
+			q = &postfixQueueStats{}
+			queues[msg.QueueName] = q
+		}
+		q.Messages++
+		q.Bytes += msg.MessageSize
+		if msg.ArrivalTime > 0 {
+			age := now.Sub(time.Unix(msg.ArrivalTime, 0)).Seconds()
+			if q.OldestAge == nil || age > *q.OldestAge {
+				q.OldestAge = &age
+			}
+		}
+	}
+	return queues, scanner.Err()
+}
+
+func queryMail(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q mailQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	var frame *data.Frame
+	var err error
+	switch q.Section {
+	case "", "postfix":
+		frame, err = ds.postfixQueueFrame(ctx)
+	case "rspamd":
+		frame, err = ds.rspamdFrame(ctx)
+	case "dns":
+		frame, err = ds.mailDNSFrame(ctx)
+	default:
+		return nil, fmt.Errorf("unknown mail section %q", q.Section)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return data.Frames{frame}, nil
+}
+
+func (ds *testDataSource) postfixQueueFrame(ctx context.Context) (*data.Frame, error) {
+	host := ds.settings.Mail.PostfixHost
+	if host == "" {
+		return nil, fmt.Errorf("Postfix host is not configured")
+	}
+	if _, err := ds.sshHosts(host); err != nil {
+		return nil, err
+	}
+
+	raw, err := ds.runRemoteCommand(ctx, host, "postqueue -j")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Postfix queue on %s: %w", host, err)
+	}
+	queues, err := parsePostfixQueue(raw, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", host, err)
+	}
+
+	frame := data.NewFrame("postfix",
+		data.NewField("host", nil, []string{}),
+		data.NewField("queue", nil, []string{}),
+		data.NewField("messages", nil, []int64{}),
+		data.NewField("size", nil, []int64{}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+		data.NewField("oldest_age", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "s"}),
+	)
+	for _, name := range postfixQueues {
+		q := queues[name]
+		frame.AppendRow(host, name, q.Messages, q.Bytes, q.OldestAge)
+	}
+	return frame, nil
+}
+
+func (ds *testDataSource) rspamdFrame(ctx context.Context) (*data.Frame, error) {
+	if ds.settings.Mail.RspamdURL == "" {
+		return nil, fmt.Errorf("rspamd URL is not configured")
+	}
+	u, err := url.Parse(ds.settings.Mail.RspamdURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rspamd URL: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.JoinPath("/stat").String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if ds.settings.Secrets != nil && ds.settings.Secrets.RspamdPassword != "" {
+		req.Header.Set("Password", ds.settings.Secrets.RspamdPassword)
+	}
+
+	resp, err := ds.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("rspamd request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd returned %s", resp.Status)
+	}
+
+	var stat struct {
+		Scanned     float64            `json:"scanned"`
+		Learned     float64            `json:"learned"`
+		SpamCount   float64            `json:"spam_count"`
+		HamCount    float64            `json:"ham_count"`
+		Connections float64            `json:"connections"`
+		Actions     map[string]float64 `json:"actions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stat); err != nil {
+		return nil, fmt.Errorf("failed to decode rspamd stats: %w", err)
+	}
+
+	var spamRatio *float64
+	if stat.Scanned > 0 {
+		ratio := stat.SpamCount / stat.Scanned * 100
+		spamRatio = &ratio
+	}
+
+	return data.NewFrame("rspamd",
+		data.NewField("scanned", nil, []float64{stat.Scanned}),
+		data.NewField("learned", nil, []float64{stat.Learned}),
+		data.NewField("spam", nil, []float64{stat.SpamCount}),
+		data.NewField("ham", nil, []float64{stat.HamCount}),
+		data.NewField("spam_ratio", nil, []*float64{spamRatio}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("rejected", nil, []float64{stat.Actions["reject"]}),
+		data.NewField("soft_rejected", nil, []float64{stat.Actions["soft reject"]}),
+		data.NewField("greylisted", nil, []float64{stat.Actions["greylist"]}),
+		data.NewField("header_added", nil, []float64{stat.Actions["add header"]}),
+		data.NewField("subject_rewritten", nil, []float64{stat.Actions["rewrite subject"]}),
+		data.NewField("connections", nil, []float64{stat.Connections}),
+	), nil
+}
+
+// txtRecords returns the TXT records of name starting with prefix, treating
+// a missing name as no records.
+func txtRecords(ctx context.Context, name, prefix string) ([]string, error) {
+	records, err := net.DefaultResolver.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var matching []string
+	for _, r := range records {
+		if strings.HasPrefix(strings.ToLower(r), strings.ToLower(prefix)) {
+			matching = append(matching, r)
+		}
+	}
+	return matching, nil
+}
+
+// tagValue returns the value of a tag in a DKIM or DMARC record, e.g. "p".
+func tagValue(record, tag string) (string, bool) {
+	for _, part := range strings.Split(record, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(k), tag) {
+			return strings.TrimSpace(v), true
+		}
+	}
+	return "", false
+}
+
+// mailDNSFrame checks the domain's SPF, DMARC and DKIM records. Status is
+// "ok", "missing", "multiple" (SPF and DMARC allow only one record) or
+// "revoked" (DKIM key with an empty p= tag).
+// mailDNSStates are the severities of mail DNS check statuses. Several SPF
+// or DMARC records are as invalid as none.
+var mailDNSStates = stateScale{"ok": severityOK, "missing": severityCritical, "multiple": severityCritical, "revoked": severityWarning}
+
+func (ds *testDataSource) mailDNSFrame(ctx context.Context) (*data.Frame, error) {
+	domain := ds.settings.Mail.Domain
+	if domain == "" {
+		return nil, fmt.Errorf("mail domain is not configured")
+	}
+
+	statusField, severityField := newStateFields(mailDNSStates)
+	frame := data.NewFrame("mail_dns",
+		data.NewField("check", nil, []string{}),
+		data.NewField("name", nil, []string{}),
+		statusField,
+		severityField,
+		data.NewField("record", nil, []string{}),
+	)
+
+	single := func(check, name, prefix string) error {
+		records, err := txtRecords(ctx, name, prefix)
+		if err != nil {
+			return fmt.Errorf("%s lookup for %s failed: %w", check, name, err)
+		}
+		switch len(records) {
+		case 0:
+			frame.AppendRow(check, name, "missing", mailDNSStates.severity("missing"), "")
+		case 1:
+			frame.AppendRow(check, name, "ok", mailDNSStates.severity("ok"), records[0])
+		default:
+			frame.AppendRow(check, name, "multiple", mailDNSStates.severity("multiple"), strings.Join(records, " | "))
+		}
+		return nil
+	}
+	if err := single("spf", domain, "v=spf1"); err != nil {
+		return nil, err
+	}
+	if err := single("dmarc", "_dmarc."+domain, "v=DMARC1"); err != nil {
+		return nil, err
+	}
+
+	for _, selector := range ds.settings.Mail.DKIMSelectors {
+		name := selector + "._domainkey." + domain
+		records, err := txtRecords(ctx, name, "")
+		if err != nil {
+			return nil, fmt.Errorf("dkim lookup for %s failed: %w", name, err)
+		}
+
+		status, record := "missing", ""
+		for _, r := range records {
+			key, ok := tagValue(r, "p")
+			if !ok {
+				continue
+			}
+			record = r
+			if key == "" {
+				status = "revoked"
+			} else {
+				status = "ok"
+			}
+			break
+		}
+		frame.AppendRow("dkim", name, status, mailDNSStates.severity(status), record)
+	}
+
+	return frame, nil
+}
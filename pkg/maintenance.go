@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const defaultMuteTimingPrefix = "homelab-"
+
+// muteTimingSyncInterval is how often mute timings are synced with the
+// maintenance windows. Windows start and end on minutes.
+const muteTimingSyncInterval = time.Minute
+
+// scrubPollInterval is how often the SSH hosts are checked for scrubs when
+// they are detected.
+const scrubPollInterval = time.Minute
+
+// scrubRetention is how long scrubs are kept after they ended, so that the
+// series of queries over the time they ran are still tagged.
+const scrubRetention = 24 * time.Hour
+
+// scrubActions are the sync actions of /proc/mdstat that read or rewrite
+// whole arrays: resyncs and recoveries, the resilvers of md, checks and
+// repairs, its scrubs, and reshapes. Pending ones don't count until they
+// run. The scans of ZFS pools, scrubs and resilvers, all count.
+var scrubActions = map[string]bool{"resync": true, "recovery": true, "check": true, "repair": true, "reshape": true}
+
+// scrubRun is a run of scrubs of the arrays and pools of a host, from the
+// first poll finding one to the first finding none. Its end is zero while it
+// runs.
+type scrubRun struct {
+	start, end time.Time
+	arrays     []string
+}
+
+// scrubWindowName is the name of the window of scrubs on an SSH host.
+func scrubWindowName(host string) string {
+	return "scrub-" + sshHostname(host)
+}
+
+// maintenanceWindow is a configured maintenance window, parsed.
+type maintenanceWindow struct {
+	name     string
+	schedule cronSchedule
+	duration time.Duration
+}
+
+// activeAt returns the start and end of the run of the window that now falls
+// in, if any. Of overlapping runs, the earliest counts.
+func (w maintenanceWindow) activeAt(now time.Time) (time.Time, time.Time, bool) {
+	start := w.schedule.next(now.Add(-w.duration))
+	if start.IsZero() || start.After(now) {
+		return time.Time{}, time.Time{}, false
+	}
+	return start, start.Add(w.duration), true
+}
+
+// maintenance is the maintenance windows of the instance, and the Grafana
+// they're exported to as mute timings, if any.
+type maintenance struct {
+	windows    []maintenanceWindow
+	grafanaURL string
+	token      string
+	prefix     string
+	// exported are the starts of the runs exported as mute timings, by
+	// window name. Zero starts are mute timings that may be left over from
+	// another instance, until removed.
+	exported map[string]time.Time
+
+	// detectScrubs opens a window for an SSH host while its arrays are
+	// scrubbed, from the runs in scrubs by host
+	detectScrubs bool
+	mu           sync.Mutex
+	scrubs       map[string][]scrubRun
+}
+
+func newMaintenance(settings models.MaintenanceSettings, token string) (*maintenance, error) {
+	m := &maintenance{
+		grafanaURL:   settings.GrafanaURL,
+		token:        token,
+		prefix:       settings.MuteTimingPrefix,
+		exported:     map[string]time.Time{},
+		detectScrubs: settings.DetectScrubs,
+		scrubs:       map[string][]scrubRun{},
+	}
+	if m.prefix == "" {
+		m.prefix = defaultMuteTimingPrefix
+	}
+	seen := map[string]bool{}
+	for _, w := range settings.Windows {
+		switch {
+		case w.Name == "":
+			return nil, fmt.Errorf("window on %q has no name", w.Schedule)
+		case seen[w.Name]:
+			return nil, fmt.Errorf("duplicate window name %q", w.Name)
+		case w.DurationMinutes <= 0:
+			return nil, fmt.Errorf("window %s has no duration", w.Name)
+		}
+		if settings.DetectScrubs && strings.HasPrefix(w.Name, "scrub-") {
+			return nil, fmt.Errorf("window name %q is reserved for detected scrubs", w.Name)
+		}
+		seen[w.Name] = true
+		schedule, err := parseCron(w.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("window %s: %w", w.Name, err)
+		}
+		m.windows = append(m.windows, maintenanceWindow{name: w.Name, schedule: schedule, duration: time.Duration(w.DurationMinutes) * time.Minute})
+	}
+	if m.grafanaURL != "" {
+		if u, err := url.Parse(m.grafanaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid grafanaUrl %q", m.grafanaURL)
+		}
+		if token == "" {
+			return nil, fmt.Errorf("grafanaUrl needs a service account token in grafanaToken")
+		}
+		for _, w := range m.windows {
+			m.exported[w.name] = time.Time{}
+		}
+	}
+	return m, nil
+}
+
+// active returns the names of the windows active at now, those of
+// detected scrubs last. It is safe to call on a nil maintenance, which has
+// none.
+func (m *maintenance) active(now time.Time) []string {
+	if m == nil {
+		return nil
+	}
+	var names []string
+	for _, w := range m.windows {
+		if _, _, ok := w.activeAt(now); ok {
+			names = append(names, w.name)
+		}
+	}
+	scrubs := m.runningScrubs()
+	for _, name := range slices.Sorted(maps.Keys(scrubs)) {
+		names = append(names, name)
+	}
+	return names
+}
+
+// observeScrubs records the arrays and pools of host as polled at now,
+// opening the host's window when a scrub starts and closing it when the
+// last one ends.
+func (m *maintenance) observeScrubs(host string, arrays []mdArray, pools []zfsPool, now time.Time) {
+	if m == nil || !m.detectScrubs {
+		return
+	}
+	var scrubbed []string
+	for _, a := range arrays {
+		if scrubActions[a.SyncAction] {
+			scrubbed = append(scrubbed, a.Name)
+		}
+	}
+	for _, p := range pools {
+		if p.ScanAction != "" {
+			scrubbed = append(scrubbed, p.Name)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	runs := m.scrubs[host]
+	running := len(runs) > 0 && runs[len(runs)-1].end.IsZero()
+	switch {
+	case len(scrubbed) > 0 && running:
+		runs[len(runs)-1].arrays = scrubbed
+	case len(scrubbed) > 0:
+		backend.Logger.Info("Scrub started, opening maintenance window", "host", host, "arrays", scrubbed)
+		runs = append(runs, scrubRun{start: now, arrays: scrubbed})
+	case running:
+		backend.Logger.Info("Scrub ended, closing maintenance window", "host", host)
+		runs[len(runs)-1].end = now
+	}
+	m.scrubs[host] = slices.DeleteFunc(runs, func(r scrubRun) bool {
+		return !r.end.IsZero() && now.Sub(r.end) > scrubRetention
+	})
+}
+
+// runningScrubs returns the starts of the running scrubs by window name.
+func (m *maintenance) runningScrubs() map[string]time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	running := map[string]time.Time{}
+	for host, runs := range m.scrubs {
+		if len(runs) > 0 && runs[len(runs)-1].end.IsZero() {
+			running[scrubWindowName(host)] = runs[len(runs)-1].start
+		}
+	}
+	return running
+}
+
+// tagScrubs adds a "maintenance" label, the name of the window, to the
+// value fields of frames of a target on an SSH host that was scrubbed
+// during tr, so that alert rules and notification policies can leave out
+// the I/O degradation the scrub causes. It is safe to call on a nil
+// maintenance.
+func (m *maintenance) tagScrubs(frames data.Frames, target *scrapeTarget, tr backend.TimeRange) {
+	if m == nil || !m.detectScrubs {
+		return
+	}
+	u, err := url.Parse(target.URL)
+	if err != nil || u.Hostname() == "" {
+		return
+	}
+	window := ""
+	m.mu.Lock()
+	for host, runs := range m.scrubs {
+		if !strings.EqualFold(sshHostname(host), u.Hostname()) {
+			continue
+		}
+		for _, r := range runs {
+			if !r.start.After(tr.To) && (r.end.IsZero() || !r.end.Before(tr.From)) {
+				window = scrubWindowName(host)
+			}
+		}
+	}
+	m.mu.Unlock()
+	if window == "" {
+		return
+	}
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			if field.Type().Time() {
+				continue
+			}
+			labels := field.Labels.Copy()
+			if labels == nil {
+				labels = data.Labels{}
+			}
+			labels["maintenance"] = window
+			field.Labels = labels
+		}
+	}
+}
+
+// muteTiming is a mute timing of Grafana's alerting provisioning API.
+type muteTiming struct {
+	Name          string             `json:"name"`
+	TimeIntervals []muteTimeInterval `json:"time_intervals"`
+}
+
+type muteTimeInterval struct {
+	Times       []muteTimeRange `json:"times"`
+	DaysOfMonth []string        `json:"days_of_month"`
+	Months      []string        `json:"months"`
+	Years       []string        `json:"years"`
+	Location    string          `json:"location"`
+}
+
+type muteTimeRange struct {
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+}
+
+// muteTimeIntervals returns the intervals of a mute timing covering start
+// to end, an interval per day pinned to its date, so that a mute timing
+// left behind doesn't mute anything after end.
+func muteTimeIntervals(start, end time.Time) []muteTimeInterval {
+	start, end = start.UTC(), end.UTC()
+	var intervals []muteTimeInterval
+	for day := start; day.Before(end); {
+		midnight := time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, time.UTC)
+		until, endTime := end, end.Format("15:04")
+		if !end.Before(midnight) {
+			until, endTime = midnight, "24:00"
+		}
+		intervals = append(intervals, muteTimeInterval{
+			Times:       []muteTimeRange{{StartTime: day.Format("15:04"), EndTime: endTime}},
+			DaysOfMonth: []string{strconv.Itoa(day.Day())},
+			Months:      []string{strconv.Itoa(int(day.Month()))},
+			Years:       []string{strconv.Itoa(day.Year())},
+			Location:    "UTC",
+		})
+		day = until
+	}
+	return intervals
+}
+
+// grafanaRequest calls the Grafana API with the service account token, and
+// returns the status of the response.
+func (m *maintenance) grafanaRequest(ctx context.Context, client *http.Client, method, path string, body any) (int, error) {
+	u, err := url.Parse(m.grafanaURL)
+	if err != nil {
+		return 0, err
+	}
+	target := u.JoinPath(path).String()
+	var payload []byte
+	if body != nil {
+		if payload, err = json.Marshal(body); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request for %s: %w", redactURL(target), err)
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// Mute timings provisioned without provenance stay editable in the UI
+	req.Header.Set("X-Disable-Provenance", "true")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, withCode(codeTargetUnreachable, fmt.Errorf("failed to fetch %s: %w", redactURL(target), err))
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return resp.StatusCode, withCode(codeAuthFailed, fmt.Errorf("%s returned %s", redactURL(target), resp.Status))
+	}
+	return resp.StatusCode, nil
+}
+
+// exportWindow creates or updates the mute timing of a window's run.
+func (m *maintenance) exportWindow(ctx context.Context, client *http.Client, name string, start, end time.Time) error {
+	timing := muteTiming{Name: m.prefix + name, TimeIntervals: muteTimeIntervals(start, end)}
+	status, err := m.grafanaRequest(ctx, client, http.MethodPut, "api/v1/provisioning/mute-timings/"+timing.Name, timing)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		if status, err = m.grafanaRequest(ctx, client, http.MethodPost, "api/v1/provisioning/mute-timings", timing); err != nil {
+			return err
+		}
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("failed to export mute timing %s: Grafana returned %d", timing.Name, status)
+	}
+	return nil
+}
+
+// removeWindow removes the mute timing of a window. Grafana refuses to
+// remove mute timings that notification policies reference, which is
+// fine: their intervals are past.
+func (m *maintenance) removeWindow(ctx context.Context, client *http.Client, name string) error {
+	status, err := m.grafanaRequest(ctx, client, http.MethodDelete, "api/v1/provisioning/mute-timings/"+m.prefix+name, nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status >= 200 && status <= 299, status == http.StatusNotFound:
+	case status == http.StatusConflict:
+		backend.Logger.Debug("Mute timing is in use, keeping it", "muteTiming", m.prefix+name)
+	default:
+		return fmt.Errorf("failed to remove mute timing %s: Grafana returned %d", m.prefix+name, status)
+	}
+	return nil
+}
+
+// sync exports the mute timings of the windows active at now, and removes
+// those of windows that ended. Scrubs have no end until they're done, so
+// their mute timings last until shortly after the next sync, extended by
+// each. It returns the first error, after trying every window.
+func (m *maintenance) sync(ctx context.Context, client *http.Client, now time.Time) error {
+	var firstErr error
+	scrubs := m.runningScrubs()
+	for name, start := range scrubs {
+		if err := m.exportWindow(ctx, client, name, start, now.Add(2*muteTimingSyncInterval)); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		m.exported[name] = start
+	}
+	for name := range m.exported {
+		if _, running := scrubs[name]; running || !strings.HasPrefix(name, "scrub-") || !m.detectScrubs {
+			continue
+		}
+		if err := m.removeWindow(ctx, client, name); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		delete(m.exported, name)
+	}
+	for _, w := range m.windows {
+		start, end, active := w.activeAt(now)
+		exportedStart, exported := m.exported[w.name]
+		switch {
+		case active && (!exported || !exportedStart.Equal(start)):
+			if err := m.exportWindow(ctx, client, w.name, start, end); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			m.exported[w.name] = start
+		case !active && exported:
+			if err := m.removeWindow(ctx, client, w.name); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			delete(m.exported, w.name)
+		}
+	}
+	return firstErr
+}
+
+// runMuteTimingSync keeps the mute timings of Grafana in sync with the
+// maintenance windows, until the instance is disposed of.
+func (ds *testDataSource) runMuteTimingSync(ctx context.Context) {
+	job := ds.schedule.add("mutetimings", "", muteTimingSyncInterval, time.Now())
+	ticker := time.NewTicker(muteTimingSyncInterval)
+	defer ticker.Stop()
+	for {
+		err := job.run(func() error { return ds.maintenance.sync(ctx, ds.httpClient, time.Now()) })
+		if err != nil {
+			backend.Logger.Warn("Failed to sync mute timings", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runScrubDetector polls /proc/mdstat and zpool status of the SSH hosts
+// for scrubs, until the instance is disposed of.
+func (ds *testDataSource) runScrubDetector(ctx context.Context) {
+	job := ds.schedule.add("scrubs", "", scrubPollInterval, time.Now())
+	ticker := time.NewTicker(scrubPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := job.run(func() error { return ds.detectScrubs(ctx) }); err != nil {
+			backend.Logger.Warn("Failed to detect scrubs", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrubStatusCommand prints /proc/mdstat and zpool status, after
+// zpoolStatusMarker, in a single session. Either is empty on hosts without
+// md arrays or without ZFS.
+const (
+	zpoolStatusMarker  = "--- zpool status ---"
+	scrubStatusCommand = "cat /proc/mdstat 2>/dev/null; echo '" + zpoolStatusMarker + "'; zpool status 2>/dev/null; true"
+)
+
+// parseScrubStatus parses the output of scrubStatusCommand.
+func parseScrubStatus(raw []byte) ([]mdArray, []zfsPool, error) {
+	mdstat, zpool, found := bytes.Cut(raw, []byte(zpoolStatusMarker+"\n"))
+	if !found {
+		return nil, nil, fmt.Errorf("no zpool status in the output")
+	}
+	arrays, err := parseMdstat(mdstat)
+	if err != nil {
+		return nil, nil, err
+	}
+	pools, err := parseZpoolStatus(zpool)
+	if err != nil {
+		return nil, nil, err
+	}
+	return arrays, pools, nil
+}
+
+// detectScrubs polls each SSH host once. Hosts that can't be read keep
+// their windows as they are. It returns the first error, after trying
+// every host.
+func (ds *testDataSource) detectScrubs(ctx context.Context) error {
+	var firstErr error
+	for _, host := range ds.settings.SSH.AllHosts() {
+		raw, err := ds.runRemoteCommand(ctx, host, scrubStatusCommand)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to read the scrub status of %s: %w", host, err)
+			}
+			continue
+		}
+		arrays, pools, err := parseScrubStatus(raw)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", host, err)
+			}
+			continue
+		}
+		ds.maintenance.observeScrubs(host, arrays, pools, time.Now())
+	}
+	return firstErr
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const mdstatChecking = `Personalities : [raid1]
+md0 : active raid1 sdb1[1] sda1[0]
+      976630464 blocks super 1.2 [2/2] [UU]
+      [==>..................]  check = 12.6% (123064320/976630464) finish=90.1min speed=157772K/sec
+
+unused devices: <none>
+`
+
+const mdstatIdle = `Personalities : [raid1]
+md0 : active raid1 sdb1[1] sda1[0]
+      976630464 blocks super 1.2 [2/2] [UU]
+
+unused devices: <none>
+`
+
+func TestScrubWindows(t *testing.T) {
+	m, err := newMaintenance(models.MaintenanceSettings{DetectScrubs: true}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	observe := func(mdstat, zpool string, at time.Time) {
+		arrays, pools, err := parseScrubStatus([]byte(mdstat + zpoolStatusMarker + "\n" + zpool))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.observeScrubs("nas:2222", arrays, pools, at)
+	}
+	tagged := func(target string, from, to time.Time) string {
+		frame := data.NewFrame("load",
+			data.NewField("time", nil, []time.Time{}),
+			data.NewField("value", data.Labels{"device": "sda"}, []float64{}),
+		)
+		m.tagScrubs(data.Frames{frame}, &scrapeTarget{URL: target}, backend.TimeRange{From: from, To: to})
+		return frame.Fields[1].Labels["maintenance"]
+	}
+
+	observe(mdstatChecking, "", testStart)
+	observe(mdstatChecking, zpoolScrubbed, testStart.Add(time.Hour))
+	if got := m.active(testStart.Add(time.Hour)); !slices.Equal(got, []string{"scrub-nas"}) {
+		t.Errorf("active during check = %v, want [scrub-nas]", got)
+	}
+	if got := tagged("http://nas:9100/metrics", testStart.Add(30*time.Minute), testStart.Add(time.Hour)); got != "scrub-nas" {
+		t.Errorf("series of nas during check tagged %q, want scrub-nas", got)
+	}
+	if got := tagged("http://router:9100/metrics", testStart, testStart.Add(time.Hour)); got != "" {
+		t.Errorf("series of router tagged %q, want none", got)
+	}
+
+	observe(mdstatIdle, zpoolScrubbed, testStart.Add(2*time.Hour))
+	if got := m.active(testStart.Add(2 * time.Hour)); len(got) != 0 {
+		t.Errorf("active after check = %v, want none", got)
+	}
+	if got := tagged("http://nas:9100/metrics", testStart.Add(90*time.Minute), testStart.Add(3*time.Hour)); got != "scrub-nas" {
+		t.Errorf("series of nas over the end of the check tagged %q, want scrub-nas", got)
+	}
+	if got := tagged("http://nas:9100/metrics", testStart.Add(3*time.Hour), testStart.Add(4*time.Hour)); got != "" {
+		t.Errorf("series of nas after the check tagged %q, want none", got)
+	}
+
+	// A resilver of a pool opens the window as a check of an array does
+	observe(mdstatIdle, zpoolResilvering, testStart.Add(5*time.Hour))
+	if got := m.active(testStart.Add(5 * time.Hour)); !slices.Equal(got, []string{"scrub-nas"}) {
+		t.Errorf("active during resilver = %v, want [scrub-nas]", got)
+	}
+	observe(mdstatIdle, zpoolScrubbed, testStart.Add(6*time.Hour))
+	if got := m.active(testStart.Add(6 * time.Hour)); len(got) != 0 {
+		t.Errorf("active after resilver = %v, want none", got)
+	}
+	if got := tagged("http://nas:9100/metrics", testStart.Add(5*time.Hour), testStart.Add(6*time.Hour)); got != "scrub-nas" {
+		t.Errorf("series of nas during resilver tagged %q, want scrub-nas", got)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeMdstat = "mdstat"
+
+func init() {
+	registerQueryType(queryTypeMdstat, queryMdstat, hostQuery{})
+	registerConfiguredCheck(queryTypeMdstat, func(ds *testDataSource) bool { return len(ds.settings.SSH.AllHosts()) > 0 })
+}
+
+// mdArray is the state of a single software RAID array from /proc/mdstat.
+type mdArray struct {
+	Name          string
+	State         string
+	Level         string
+	DisksRequired int64
+	DisksActive   int64
+	FailedDevices int64
+	SpareDevices  int64
+	SyncAction    string
+	SyncProgress  float64
+}
+
+func (a mdArray) degraded() bool {
+	return a.FailedDevices > 0 || a.DisksActive < a.DisksRequired
+}
+
+var (
+	mdDiskStatusRe = regexp.MustCompile(`\[(\d+)/(\d+)\]\s+\[[U_]+\]`)
+	mdSyncRe       = regexp.MustCompile(`(resync|recovery|check|reshape|repair)\s*=\s*([0-9.]+)%`)
+	mdPendingRe    = regexp.MustCompile(`(resync|recovery|check|reshape|repair)\s*=\s*(DELAYED|PENDING)`)
+)
+
+// parseMdstat parses the contents of /proc/mdstat.
+func parseMdstat(raw []byte) ([]mdArray, error) {
+	var arrays []mdArray
+	var current *mdArray
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "md") && strings.Contains(line, " : ") {
+			arrays = append(arrays, mdArray{})
+			current = &arrays[len(arrays)-1]
+
+			name, rest, _ := strings.Cut(line, " : ")
+			current.Name = strings.TrimSpace(name)
+			fields := strings.Fields(rest)
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("malformed mdstat line %q", line)
+			}
+			current.State = fields[0]
+			for _, field := range fields[1:] {
+				switch {
+				case strings.HasPrefix(field, "("):
+					// (auto-read-only), (read-only)
+					current.State += " " + field
+				case strings.HasPrefix(field, "raid") || field == "linear" || field == "multipath":
+					current.Level = field
+				case strings.Contains(field, "["):
+					if strings.HasSuffix(field, "(F)") {
+						current.FailedDevices++
+					} else if strings.HasSuffix(field, "(S)") {
+						current.SpareDevices++
+					}
+				}
+			}
+			continue
+		}
+
+		if current == nil || trimmed == "" {
+			continue
+		}
+
+		if m := mdDiskStatusRe.FindStringSubmatch(trimmed); m != nil {
+			current.DisksRequired, _ = strconv.ParseInt(m[1], 10, 64)
+			current.DisksActive, _ = strconv.ParseInt(m[2], 10, 64)
+		}
+		if m := mdSyncRe.FindStringSubmatch(trimmed); m != nil {
+			current.SyncAction = m[1]
+			current.SyncProgress, _ = strconv.ParseFloat(m[2], 64)
+		} else if m := mdPendingRe.FindStringSubmatch(trimmed); m != nil {
+			current.SyncAction = m[1] + " " + strings.ToLower(m[2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mdstat: %w", err)
+	}
+
+	return arrays, nil
+}
+
+func queryMdstat(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q hostQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	hosts, err := ds.sshHosts(q.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	arraysByHost := map[string][]mdArray{}
+	for _, host := range hosts {
+		raw, err := ds.runRemoteCommand(ctx, host, "cat /proc/mdstat")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read /proc/mdstat on %s: %w", host, err)
+		}
+
+		arrays, err := parseMdstat(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		arraysByHost[host] = arrays
+	}
+
+	return data.Frames{mdstatFrame(hosts, arraysByHost, ds.tr)}, nil
+}
+
+// mdstatStates are the severities of array statuses: degraded arrays are
+// critical and arrays syncing are at risk until they are done.
+var mdstatStates = stateScale{"ok": severityOK, "syncing": severityWarning, "degraded": severityCritical}
+
+func mdstatFrame(hosts []string, arraysByHost map[string][]mdArray, tr localizer) *data.Frame {
+	statusField, severityField := newStateFields(mdstatStates)
+	frame := data.NewFrame("mdstat",
+		data.NewField("host", nil, []string{}),
+		data.NewField("array", nil, []string{}),
+		data.NewField("state", nil, []string{}),
+		data.NewField("level", nil, []string{}),
+		data.NewField("disks_required", nil, []int64{}),
+		data.NewField("disks_active", nil, []int64{}),
+		data.NewField("failed_devices", nil, []int64{}),
+		data.NewField("spare_devices", nil, []int64{}),
+		data.NewField("degraded", nil, []int64{}),
+		data.NewField("sync_action", nil, []string{}),
+		data.NewField("sync_progress", nil, []float64{}),
+		statusField,
+		severityField,
+	)
+	frame.Fields[10].Config = &data.FieldConfig{Unit: "percent"}
+	frame.Meta = &data.FrameMeta{}
+
+	for _, host := range hosts {
+		for _, a := range arraysByHost[host] {
+			var degraded int64
+			status := "ok"
+			if a.SyncAction != "" {
+				status = "syncing"
+			}
+			if a.degraded() {
+				degraded, status = 1, "degraded"
+				// Surface degraded arrays in the panel even if no alert rule is set up
+				frame.Meta.Notices = append(frame.Meta.Notices, data.Notice{
+					Severity: data.NoticeSeverityWarning,
+					Text:     tr.text(msgRAIDDegraded, a.Name, host, a.DisksActive, a.DisksRequired),
+				})
+			}
+			frame.AppendRow(host, a.Name, a.State, a.Level, a.DisksRequired, a.DisksActive,
+				a.FailedDevices, a.SpareDevices, degraded, a.SyncAction, a.SyncProgress, status, mdstatStates.severity(status))
+		}
+	}
+
+	return frame
+}
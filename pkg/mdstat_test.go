@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseMdstat(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		want     []mdArray
+		degraded []bool
+	}{
+		{
+			name:     "idle",
+			raw:      mdstatIdle,
+			want:     []mdArray{{Name: "md0", State: "active", Level: "raid1", DisksRequired: 2, DisksActive: 2}},
+			degraded: []bool{false},
+		},
+		{
+			name:     "checking",
+			raw:      mdstatChecking,
+			want:     []mdArray{{Name: "md0", State: "active", Level: "raid1", DisksRequired: 2, DisksActive: 2, SyncAction: "check", SyncProgress: 12.6}},
+			degraded: []bool{false},
+		},
+		{
+			name: "failed disk and spare, recovering",
+			raw: `Personalities : [raid1] [raid6] [raid5] [raid4]
+md1 : active raid5 sde1[4](S) sdd1[3] sdc1[2](F) sdb1[1] sda1[0]
+      2929890816 blocks super 1.2 level 5, 512k chunk, algorithm 2 [4/3] [UU_U]
+      [=====>...............]  recovery = 28.4% (277461376/976630272) finish=70.7min speed=164813K/sec
+      bitmap: 1/8 pages [4KB], 65536KB chunk
+
+md0 : active (auto-read-only) raid1 sdg1[1] sdf1[0]
+      976630464 blocks super 1.2 [2/2] [UU]
+        resync=PENDING
+
+unused devices: <none>
+`,
+			want: []mdArray{
+				{Name: "md1", State: "active", Level: "raid5", DisksRequired: 4, DisksActive: 3, FailedDevices: 1, SpareDevices: 1, SyncAction: "recovery", SyncProgress: 28.4},
+				{Name: "md0", State: "active (auto-read-only)", Level: "raid1", DisksRequired: 2, DisksActive: 2, SyncAction: "resync pending"},
+			},
+			degraded: []bool{true, false},
+		},
+		{
+			name: "inactive",
+			raw: `Personalities :
+md127 : inactive sdb[1](S) sda[0](S)
+      1953263024 blocks super 1.2
+
+unused devices: <none>
+`,
+			want:     []mdArray{{Name: "md127", State: "inactive", SpareDevices: 2}},
+			degraded: []bool{false},
+		},
+		{name: "no arrays", raw: "Personalities :\nunused devices: <none>\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arrays, err := parseMdstat([]byte(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(arrays) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", arrays, tt.want)
+			}
+			for i, a := range arrays {
+				if a != tt.want[i] {
+					t.Errorf("array %d: got %+v, want %+v", i, a, tt.want[i])
+				}
+				if a.degraded() != tt.degraded[i] {
+					t.Errorf("array %s degraded %v, want %v", a.Name, a.degraded(), tt.degraded[i])
+				}
+			}
+		})
+	}
+
+	if _, err := parseMdstat([]byte("md0 : \n")); err == nil {
+		t.Error("array line without state parsed")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// metricsAddrEnv overrides the address of the plugin's own metrics server.
+// Setting it to the empty string disables the server.
+const metricsAddrEnv = "HOMELAB_PLUGIN_METRICS_ADDR"
+
+const defaultMetricsAddr = ":2112"
+
+// The metrics server serves HTTPS with the certificate and key files in
+// these variables, restricted to the minimum TLS version, e.g. "1.3", and
+// the comma separated cipher suites in the others.
+const (
+	metricsTLSCertEnv         = "HOMELAB_PLUGIN_METRICS_TLS_CERT"
+	metricsTLSKeyEnv          = "HOMELAB_PLUGIN_METRICS_TLS_KEY"
+	metricsTLSMinVersionEnv   = "HOMELAB_PLUGIN_METRICS_TLS_MIN_VERSION"
+	metricsTLSCipherSuitesEnv = "HOMELAB_PLUGIN_METRICS_TLS_CIPHER_SUITES"
+)
+
+// metricsShutdownTimeout bounds how long in-flight scrapes of the metrics
+// server may take once it is stopped.
+const metricsShutdownTimeout = 5 * time.Second
+
+// metricsRegistry holds the plugin's own metrics. It is private so that
+// nothing else in the process can register colliding collectors.
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// metricsServer serves metricsRegistry, the status pages of instances and
+// the routes of instanceRoute, while at least one instance is alive: the first instance starts it and
+// disposing of the last one shuts it down.
+type metricsServer struct {
+	mu     sync.Mutex
+	users  int
+	server *http.Server
+	// addr is where the server can be reached, and cert the certificate it
+	// serves, if any, for the self-test to scrape it
+	addr string
+	cert []byte
+}
+
+var pluginMetricsServer = &metricsServer{}
+
+func metricsAddr() string {
+	if addr, ok := os.LookupEnv(metricsAddrEnv); ok {
+		return addr
+	}
+	return defaultMetricsAddr
+}
+
+// metricsTLSConfig returns the TLS configuration of the metrics server, or
+// nil when it serves plain HTTP.
+func metricsTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv(metricsTLSCertEnv), os.Getenv(metricsTLSKeyEnv)
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("%s and %s must be set together", metricsTLSCertEnv, metricsTLSKeyEnv)
+	}
+	var suites []string
+	if env := os.Getenv(metricsTLSCipherSuitesEnv); env != "" {
+		for _, name := range strings.Split(env, ",") {
+			suites = append(suites, strings.TrimSpace(name))
+		}
+	}
+	policy, err := newTLSPolicy(os.Getenv(metricsTLSMinVersionEnv), suites)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metrics server certificate: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	policy.apply(cfg)
+	return cfg, nil
+}
+
+// acquire registers an instance using the server, starting it if needed.
+// Failing to listen is returned, but the instance still counts as a user.
+func (m *metricsServer) acquire() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users++
+	if m.server != nil {
+		return nil
+	}
+	addr := metricsAddr()
+	if addr == "" {
+		return nil
+	}
+
+	tlsConfig, err := metricsTLSConfig()
+	if err != nil {
+		return err
+	}
+	// Listen here rather than in the goroutine, so a taken port is reported
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	tcpAddr := listener.Addr().(*net.TCPAddr)
+	ip := tcpAddr.IP
+	if ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	m.addr, m.cert = net.JoinHostPort(ip.String(), strconv.Itoa(tcpAddr.Port)), nil
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		m.cert = tlsConfig.Certificates[0].Certificate[0]
+	}
+	m.server = &http.Server{Handler: metricsMux(), ReadHeaderTimeout: 10 * time.Second}
+
+	backend.Logger.Info("Starting metrics server", "addr", listener.Addr().String(), "tls", tlsConfig != nil)
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			backend.Logger.Error("Metrics server failed", "error", err)
+		}
+	}(m.server)
+	return nil
+}
+
+// metricsMux routes the requests of the metrics server.
+func metricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /status/{uid}", serveStatusPage)
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		mux.HandleFunc(method+" /ping/{uid}/{slug}", instanceRoute((*testDataSource).pingToken, (*testDataSource).handlePing))
+		mux.HandleFunc(method+" /ping/{uid}/{slug}/{signal}", instanceRoute((*testDataSource).pingToken, (*testDataSource).handlePing))
+	}
+	mux.HandleFunc("GET /agent-updates/{uid}/{agent}/{os}/{arch}", instanceRoute((*testDataSource).agentToken, (*testDataSource).handleAgentUpdate))
+	mux.HandleFunc("GET /agent-updates/{uid}/{agent}/{os}/{arch}/binary", instanceRoute((*testDataSource).agentToken, (*testDataSource).handleAgentBinary))
+	mux.HandleFunc("POST /agent-updates/{uid}/{agent}/report", instanceRoute((*testDataSource).agentToken, (*testDataSource).handleAgentReport))
+	mux.HandleFunc("POST /agent/{uid}/{target}", instanceRoute((*testDataSource).pushToken, (*testDataSource).handleAgentPush))
+	mux.HandleFunc("POST /alertmanager/webhook/{uid}", instanceRoute((*testDataSource).alertWebhookToken, (*testDataSource).handleAlertmanagerWebhook))
+	return mux
+}
+
+// instanceRoute serves handler for the instance whose UID is in the path, to
+// requests carrying the token token returns for them, as a bearer token or
+// the token parameter. Requests token returns no token for are not found.
+// It is for routes called by jobs and devices without a Grafana account,
+// which can't reach the instance's resources.
+func instanceRoute(token func(ds *testDataSource, r *http.Request) string, handler func(ds *testDataSource, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ds := liveInstances.withUID(r.PathValue("uid"), nil)
+		if ds == nil {
+			http.NotFound(w, r)
+			return
+		}
+		want := token(ds, r)
+		if want == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !hasToken(r, want) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		handler(ds, w, r)
+	}
+}
+
+// hasToken reports whether r carries token, as a bearer token or the token
+// parameter.
+func hasToken(r *http.Request, token string) bool {
+	got := r.URL.Query().Get("token")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		got = bearer
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// self returns the URL of the metrics endpoint, over loopback when the
+// server listens on all addresses, and the certificate served there, if any,
+// or ok false when the server is not running.
+func (m *metricsServer) self() (metricsURL string, cert []byte, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.server == nil {
+		return "", nil, false
+	}
+	scheme := "http"
+	if m.cert != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + m.addr + "/metrics", m.cert, true
+}
+
+// release unregisters an instance, shutting the server down after the last.
+func (m *metricsServer) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users--
+	if m.users > 0 || m.server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+	if err := m.server.Shutdown(ctx); err != nil {
+		backend.Logger.Warn("Metrics server shutdown failed", "error", err)
+	}
+	m.server = nil
+}
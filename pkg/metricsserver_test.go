@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// TestInstanceRoutes checks that the routes of instances on the metrics
+// server only serve requests with their token.
+func TestInstanceRoutes(t *testing.T) {
+	ds := newTestDataSource()
+	ds.uid = "homelab-routes"
+	var err error
+	ds.pingChecks, err = newPingChecks([]models.PingCheck{{Slug: "backup"}, {Slug: "unguarded"}}, map[string]string{"backup": "ping-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.pings = pingLogFor("", ds.uid)
+	ds.agentReleases = newTestAgentReleases(t, map[string]string{"pi": "pi-secret", "nas": "nas-secret"})
+	ds.settings = &models.PluginSettings{
+		Targets: []models.Target{{Name: "phone", Agent: &models.AgentSettings{}}, {Name: "watch", Agent: &models.AgentSettings{}}},
+		Secrets: &models.SecretPluginSettings{
+			AlertWebhookToken: "alert-secret",
+			PushTokens:        map[string]string{"phone": "phone-secret"},
+		},
+	}
+	agents, err := newScrapeTargets(ds.settings, defaultHistory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.targets = append(ds.targets, agents...)
+	ds.alertLog = newAlertLog()
+	const notification = `{"version": "4", "status": "firing", "receiver": "homelab", "alerts": [{"status": "firing", "labels": {"alertname": "DiskFull"}, "startsAt": "2024-01-01T00:00:00Z"}]}`
+	liveInstances.add(ds)
+	defer liveInstances.remove(ds)
+	mux := metricsMux()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		bearer string
+		body   string
+		want   int
+	}{
+		{"ping", http.MethodGet, "/ping/homelab-routes/backup?token=ping-secret", "", "", http.StatusOK},
+		{"ping with bearer", http.MethodPost, "/ping/homelab-routes/backup/fail", "ping-secret", "disk full", http.StatusOK},
+		{"ping without token", http.MethodPost, "/ping/homelab-routes/backup", "", "", http.StatusUnauthorized},
+		{"ping with wrong token", http.MethodPost, "/ping/homelab-routes/backup/start", "guess", "", http.StatusUnauthorized},
+		{"ping of check without token", http.MethodPost, "/ping/homelab-routes/unguarded", "", "", http.StatusNotFound},
+		{"ping of unknown check", http.MethodPost, "/ping/homelab-routes/restore?token=ping-secret", "", "", http.StatusNotFound},
+		{"ping of unknown instance", http.MethodPost, "/ping/other/backup?token=ping-secret", "", "", http.StatusNotFound},
+		{"update check", http.MethodGet, "/agent-updates/homelab-routes/pi/linux/arm64?version=1.1.0", "pi-secret", "", http.StatusOK},
+		{"update check without token", http.MethodGet, "/agent-updates/homelab-routes/pi/linux/arm64?version=1.1.0", "", "", http.StatusUnauthorized},
+		{"update check as another agent", http.MethodGet, "/agent-updates/homelab-routes/pi/linux/arm64?version=1.1.0", "nas-secret", "", http.StatusUnauthorized},
+		{"update check of agent without token", http.MethodGet, "/agent-updates/homelab-routes/tv/linux/arm64?version=1.1.0", "", "", http.StatusNotFound},
+		{"binary", http.MethodGet, "/agent-updates/homelab-routes/pi/linux/arm64/binary", "pi-secret", "", http.StatusOK},
+		{"binary without token", http.MethodGet, "/agent-updates/homelab-routes/pi/linux/arm64/binary", "", "", http.StatusUnauthorized},
+		{"report", http.MethodPost, "/agent-updates/homelab-routes/pi/report", "pi-secret", `{"version": "1.2.0"}`, http.StatusNoContent},
+		{"report for another agent", http.MethodPost, "/agent-updates/homelab-routes/pi/report", "pi-secret", `{"agent": "nas", "version": "0.1.0"}`, http.StatusForbidden},
+		{"report without token", http.MethodPost, "/agent-updates/homelab-routes/nas/report", "", `{"version": "0.1.0"}`, http.StatusUnauthorized},
+		{"push", http.MethodPost, "/agent/homelab-routes/phone", "phone-secret", "battery_percent 80\n", http.StatusOK},
+		{"push without token", http.MethodPost, "/agent/homelab-routes/phone", "", "battery_percent 1\n", http.StatusUnauthorized},
+		{"push with another token", http.MethodPost, "/agent/homelab-routes/phone", "pi-secret", "battery_percent 1\n", http.StatusUnauthorized},
+		{"push to agent without token", http.MethodPost, "/agent/homelab-routes/watch", "", "battery_percent 1\n", http.StatusNotFound},
+		{"push to scraped target", http.MethodPost, "/agent/homelab-routes/nas?token=phone-secret", "", "node_load1 9\n", http.StatusNotFound},
+		{"alert notification", http.MethodPost, "/alertmanager/webhook/homelab-routes", "alert-secret", notification, http.StatusNoContent},
+		{"alert notification without token", http.MethodPost, "/alertmanager/webhook/homelab-routes", "", notification, http.StatusUnauthorized},
+		{"alert notification with wrong token", http.MethodPost, "/alertmanager/webhook/homelab-routes", "pi-secret", notification, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.bearer)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.name == "update check" {
+			var offer agentUpdateOffer
+			if err := json.Unmarshal(w.Body.Bytes(), &offer); err != nil || offer.Manifest.URL != "/agent-updates/homelab-routes/pi/linux/arm64/binary" {
+				t.Errorf("update check offered %s, want the binary URL of pi", w.Body)
+			}
+		}
+	}
+
+	events := ds.pings.events["backup"]
+	if len(events) != 2 || events[0].Kind != pingKindSuccess || events[1].Kind != pingKindFail || events[1].Message != "disk full" {
+		t.Errorf("recorded pings %+v, want a success and a failure", events)
+	}
+
+	checkIns := ds.agentReleases.checkIns
+	if len(checkIns) != 1 || checkIns["pi"].Version != "1.2.0" || checkIns["pi"].Outdated {
+		t.Errorf("fleet %+v, want pi up to date", checkIns)
+	}
+	if samples, err := agents[0].push.latest("phone"); err != nil || len(samples) != 1 || samples[0].Value != 80 {
+		t.Errorf("phone pushed %+v, %v, want the battery at 80", samples, err)
+	}
+	if alerts := ds.alertLog.records; len(alerts) != 1 {
+		t.Errorf("recorded alerts %+v, want the one notified with the token", alerts)
+	}
+}
+
+// newTestAgentReleases publishes version 1.2.0 of a linux/arm64 agent, for
+// agents with tokens.
+func newTestAgentReleases(t *testing.T, tokens map[string]string) *agentReleases {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "agent-linux-arm64"), []byte("agent"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	releases, err := newAgentReleases(models.AgentReleaseSettings{Dir: dir, Version: "1.2.0"}, string(keyPEM), tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return releases
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeMinIO = "minio"
+
+// MinIO serves per-bucket metrics on their own endpoint since early 2023;
+// older releases include them in the cluster endpoint.
+const (
+	minioBucketMetricsPath  = "/minio/v2/metrics/bucket"
+	minioClusterMetricsPath = "/minio/v2/metrics/cluster"
+)
+
+func init() {
+	registerQueryType(queryTypeMinIO, queryMinIO, minioQuery{})
+	registerConfiguredCheck(queryTypeMinIO, func(ds *testDataSource) bool { return len(ds.settings.MinIO) > 0 })
+}
+
+type minioQuery struct {
+	// Server selects a configured MinIO server by name; empty means all of them.
+	Server string `json:"server"`
+}
+
+// bucketStats is the usage and replication state of one bucket.
+type bucketStats struct {
+	Server                string
+	Bucket                string
+	SizeBytes             float64
+	Objects               float64
+	Quota                 *float64
+	ReplicationSentBytes  float64
+	ReplicationFailed     float64
+	ReplicationFailedSize float64
+}
+
+func (ds *testDataSource) minioMetrics(ctx context.Context, cfg models.MinIOSettings) (map[string]*dto.MetricFamily, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", cfg.URL, err)
+	}
+	var token string
+	if ds.settings.Secrets != nil {
+		token = ds.settings.Secrets.MinIOTokens[cfg.Name]
+	}
+
+	body, err := ds.httpGetBearer(ctx, base.JoinPath(minioBucketMetricsPath).String(), token)
+	if err != nil {
+		backend.Logger.Debug("MinIO bucket metrics unavailable, using cluster metrics", "server", cfg.Name, "error", err)
+		body, err = ds.httpGetBearer(ctx, base.JoinPath(minioClusterMetricsPath).String(), token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parseExposition(body)
+}
+
+// minioBuckets groups MinIO's bucket metrics by bucket. Replication metrics
+// carry a target label and are summed over targets.
+func minioBuckets(server string, families map[string]*dto.MetricFamily) []bucketStats {
+	byBucket := map[string]*bucketStats{}
+	get := func(m *dto.Metric) *bucketStats {
+		name := labelValue(m, "bucket")
+		b, ok := byBucket[name]
+		if !ok {
+			b = &bucketStats{Server: server, Bucket: name}
+			byBucket[name] = b
+		}
+		return b
+	}
+
+	each := func(family string, fn func(b *bucketStats, v float64)) {
+		if f, ok := families[family]; ok {
+			for _, m := range f.GetMetric() {
+				fn(get(m), sampleValue(m))
+			}
+		}
+	}
+	each("minio_bucket_usage_total_bytes", func(b *bucketStats, v float64) { b.SizeBytes = v })
+	each("minio_bucket_usage_object_total", func(b *bucketStats, v float64) { b.Objects = v })
+	each("minio_bucket_quota_total_bytes", func(b *bucketStats, v float64) {
+		if v > 0 {
+			b.Quota = &v
+		}
+	})
+	each("minio_bucket_replication_sent_bytes", func(b *bucketStats, v float64) { b.ReplicationSentBytes += v })
+	each("minio_bucket_replication_total_failed_count", func(b *bucketStats, v float64) { b.ReplicationFailed += v })
+	each("minio_bucket_replication_failed_bytes", func(b *bucketStats, v float64) { b.ReplicationFailedSize += v })
+
+	buckets := make([]bucketStats, 0, len(byBucket))
+	for _, b := range byBucket {
+		if b.Bucket != "" {
+			buckets = append(buckets, *b)
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Bucket < buckets[j].Bucket })
+	return buckets
+}
+
+func queryMinIO(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q minioQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if len(ds.settings.MinIO) == 0 {
+		return nil, fmt.Errorf("no MinIO servers configured")
+	}
+
+	frame := data.NewFrame("buckets",
+		data.NewField("server", nil, []string{}),
+		data.NewField("bucket", nil, []string{}),
+		data.NewField("size", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+		data.NewField("objects", nil, []float64{}),
+		data.NewField("quota", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+		data.NewField("replication_sent", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+		data.NewField("replication_failed", nil, []float64{}),
+		data.NewField("replication_failed_size", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+	)
+
+	found := false
+	for _, cfg := range ds.settings.MinIO {
+		if q.Server != "" && cfg.Name != q.Server {
+			continue
+		}
+		found = true
+
+		families, err := ds.minioMetrics(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.Name, err)
+		}
+		for _, b := range minioBuckets(cfg.Name, families) {
+			frame.AppendRow(b.Server, b.Bucket, b.SizeBytes, b.Objects, b.Quota,
+				b.ReplicationSentBytes, b.ReplicationFailed, b.ReplicationFailedSize)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("MinIO server %q is not configured", q.Server)
+	}
+
+	return data.Frames{frame}, nil
+}
@@ -3,17 +3,1448 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 )
 
 type PluginSettings struct {
-	Path    string                `json:"path"`
-	Secrets *SecretPluginSettings `json:"-"`
+	Path           string                 `json:"path"`
+	URL            string                 `json:"url"`
+	MetricsPath    string                 `json:"metricsPath"`
+	SSH            SSHSettings            `json:"ssh"`
+	OpenWrt        OpenWrtSettings        `json:"openwrt"`
+	PublicIP       PublicIPSettings       `json:"publicIp"`
+	ReverseProxies []ReverseProxySettings `json:"reverseProxies"`
+	SLOs           []SLOSettings          `json:"slos"`
+	Databases      []DatabaseSettings     `json:"databases"`
+	Brokers        []BrokerSettings       `json:"brokers"`
+	MinIO          []MinIOSettings        `json:"minio"`
+	Nextcloud      NextcloudSettings      `json:"nextcloud"`
+	Mail           MailSettings           `json:"mail"`
+	Probes         ProbeSettings          `json:"probes"`
+	Targets        []Target               `json:"targets"`
+	Schemas        []PushSchema           `json:"schemas"`
+	Traceroute     TracerouteSettings     `json:"traceroute"`
+	Kubernetes     KubernetesSettings     `json:"kubernetes"`
+	Dependencies   []DependencySettings   `json:"dependencies"`
+	Egress         EgressSettings         `json:"egress"`
+	Scripts        []ScriptSettings       `json:"scripts"`
+	SMART          SMARTSettings          `json:"smart"`
+	Climate        ClimateSettings        `json:"climate"`
+	Batteries      BatterySettings        `json:"batteries"`
+	ExecChecks     ExecCheckSettings      `json:"execChecks"`
+	Pings          []PingCheck            `json:"pings"`
+	Costs          []CostAccount          `json:"costs"`
+	Carbon         CarbonSettings         `json:"carbon"`
+	UpdateCheck    UpdateCheckSettings    `json:"updateCheck"`
+	AgentReleases  AgentReleaseSettings   `json:"agentReleases"`
+	Webhooks       []QueryWebhook         `json:"webhooks"`
+	Alertmanager   AlertmanagerSettings   `json:"alertmanager"`
+	Maintenance    MaintenanceSettings    `json:"maintenance"`
+	Transactions   []TransactionSettings  `json:"transactions"`
+	Browser        BrowserSettings        `json:"browser"`
+	Bufferbloat    BufferbloatSettings    `json:"bufferbloat"`
+	Iperf          IperfSettings          `json:"iperf"`
+	Fio            FioSettings            `json:"fio"`
+	PowerSchedules []PowerSchedule        `json:"powerSchedules"`
+	Idle           IdleSettings           `json:"idle"`
+	StatusPage     StatusPageSettings     `json:"statusPage"`
+	Digest         DigestSettings         `json:"digest"`
+	PersonalData   PersonalDataSettings   `json:"personalData"`
+	Kiosk          KioskSettings          `json:"kiosk"`
+	Secrets        *SecretPluginSettings  `json:"-"`
+
+	// DuplicateSeries is what metric queries do with a series that several
+	// targets scraping the same devices report, such as a device scraped
+	// both directly and through a gateway.
+	DuplicateSeries DuplicateSeriesSettings `json:"duplicateSeries"`
+	// Units overrides the units of series by metric name, as Grafana units
+	// such as "bytes" or "celsius"; "none" leaves a metric without one.
+	// Units are otherwise taken from the OpenMetrics UNIT lines of targets,
+	// or from name suffixes such as _bytes and _seconds.
+	Units map[string]string `json:"units"`
+	// Macros are expanded in queries like template variables, e.g. a macro
+	// critical_hosts of "nas|router" for $critical_hosts. Their values may
+	// use the built-in macros, such as $__interval.
+	Macros map[string]string `json:"macros"`
+
+	// ScrapeIntervalSeconds and HistoryMinutes control how often the metrics
+	// endpoint is sampled and how long samples are kept for time series.
+	ScrapeIntervalSeconds int `json:"scrapeIntervalSeconds"`
+	HistoryMinutes        int `json:"historyMinutes"`
+	// HighFrequency tunes scraping for a handful of targets scraped every
+	// second, which becomes the default scrape interval.
+	HighFrequency bool `json:"highFrequency"`
+	// CacheTTLSeconds is how long a scrape is reused by other queries; a
+	// negative value disables the cache.
+	CacheTTLSeconds int `json:"cacheTTLSeconds"`
+	// MaxResponseMB is the size of the largest response read from a target
+	// or an API, 64 MB by default; larger ones fail the query.
+	MaxResponseMB int `json:"maxResponseMB"`
+	// WarmCache scrapes all targets as soon as the instance is created, so
+	// the first dashboard load after a restart finds their metrics cached.
+	WarmCache bool `json:"warmCache"`
+	// StateDir is a directory where the instance keeps state across
+	// restarts, such as the metric names and labels of targets for
+	// completion. Nothing is kept when it is not set. Its files are checked
+	// for damage left by crashes when the instance starts, and repaired
+	// with POST /admin/repair.
+	StateDir string `json:"stateDir"`
+	// HealthHistoryHours is how long health check and probe results are kept
+	// for the health history query.
+	HealthHistoryHours int `json:"healthHistoryHours"`
+	// SlowQueryMs is how long a query runs before it is logged as slow;
+	// negative disables the slow query log.
+	SlowQueryMs int `json:"slowQueryMs"`
+	// ClockSkewSeconds is how far the clock of a target, as told by the
+	// timestamps of its samples, may be off before a warning is logged, 30
+	// seconds by default; negative disables the warning.
+	ClockSkewSeconds int `json:"clockSkewSeconds"`
+	// AdminURL is the web UI of the device behind URL, which its series link
+	// to.
+	AdminURL string `json:"adminUrl"`
+	// BaselineAt, an RFC 3339 time, is when the metrics baseline is
+	// captured: a moment when everything was fine, within the history or to
+	// come.
+	BaselineAt string `json:"baselineAt"`
+
+	// TLSSkipVerify, BasicAuthUser and Headers configure the HTTP client for
+	// targets behind a reverse proxy. The CA and client certificates and the
+	// basic auth password are secrets.
+	TLSSkipVerify bool              `json:"tlsSkipVerify"`
+	BasicAuthUser string            `json:"basicAuthUser"`
+	Headers       map[string]string `json:"headers"`
+	// TLSMinVersion, e.g. "1.3", and TLSCipherSuites, named as in Go's
+	// crypto/tls, restrict the TLS of all outbound clients. TLS 1.2 is the
+	// minimum by default.
+	TLSMinVersion   string   `json:"tlsMinVersion"`
+	TLSCipherSuites []string `json:"tlsCipherSuites"`
+
+	// Pipelines are named pipelines, each an array of stages as in a query's
+	// pipeline, which queries can include with a "preset" stage.
+	Pipelines map[string]json.RawMessage `json:"pipelines"`
+
+	// Locale, such as "de" or "fr-CA", is the language of health check
+	// results, notices and query error descriptions; English by default.
+	Locale string `json:"locale"`
+
+	// FeatureToggles enables experimental features by name; they are all
+	// disabled by default.
+	FeatureToggles map[string]bool `json:"featureToggles"`
+}
+
+// DefaultMetricsPath is used when MetricsPath is not set.
+const DefaultMetricsPath = "/metrics"
+
+// DefaultTargetName names the scrape target built from URL and MetricsPath.
+// Like other targets, its optional bearer token lives in secure settings,
+// under "targetToken_default".
+const DefaultTargetName = "default"
+
+// Target is an additional metrics endpoint to scrape. Its optional bearer
+// token lives in secure settings under "targetToken_<name>".
+type Target struct {
+	Name string `json:"name"`
+	// URL is the full URL of the metrics endpoint, e.g. http://nas.lan:9100/metrics.
+	URL string `json:"url"`
+	// Labels describe the target, e.g. {"room": "attic", "group": "cluster"}.
+	// They are added to its series, and queries select and aggregate
+	// targets by them.
+	Labels map[string]string `json:"labels"`
+	// OAuth2 gets the target's bearer tokens from an OAuth2 provider, for
+	// targets behind an identity-aware proxy.
+	OAuth2 *OAuth2Settings `json:"oauth2"`
+	// Session logs in to the target's web UI and scrapes with the session,
+	// for appliances whose APIs hide behind a login form.
+	Session *SessionSettings `json:"session"`
+	// Format is the format of the target's response: "prometheus", the
+	// default, or that of a parser for devices emitting plain text, such as
+	// "keyvalue" for KEY=VALUE dumps or "nut" for Network UPS Tools.
+	Format string `json:"format"`
+	// WebSocket makes the target a WebSocket source: the plugin stays
+	// connected to URL, a ws:// or wss:// URL, and maps the JSON messages it
+	// receives to samples, instead of scraping it.
+	WebSocket *WebSocketSettings `json:"websocket"`
+	// SSE makes the target a server-sent events source: the plugin stays
+	// subscribed to URL, an http:// or https:// event stream, and maps the
+	// JSON data of its events to samples, instead of scraping it.
+	SSE *SSESettings `json:"sse"`
+	// GRPC makes the target a gRPC service: URL is grpc://host:port, or
+	// grpcs://host:port over TLS, and scrapes check its health and call
+	// methods whose responses map to samples.
+	GRPC *GRPCSettings `json:"grpc"`
+	// StatsD makes the target a StatsD listener: URL is udp://host:port,
+	// such as udp://:8125, and the metrics scripts send there become the
+	// target's series. Graphite makes it a Graphite plaintext listener on
+	// tcp://host:port, such as tcp://:2003.
+	StatsD   *ListenerSettings `json:"statsd"`
+	Graphite *ListenerSettings `json:"graphite"`
+	// Collectd makes the target a listener for collectd's network plugin,
+	// on udp://host:port such as udp://:25826, and Telegraf one for the
+	// InfluxDB line protocol Telegraf's socket_writer output sends, on
+	// tcp:// or udp://host:port. Neither takes mappings.
+	Collectd *ListenerSettings `json:"collectd"`
+	Telegraf *ListenerSettings `json:"telegraf"`
+	// Agent makes the target a lightweight agent, such as a shell script
+	// on an old phone, pushing its samples to /agent/<data source UID>/<name>
+	// of the plugin's metrics server, with the push token in secure settings
+	// under "pushToken_<name>". Agents have no URL.
+	Agent *AgentSettings `json:"agent"`
+	// AdminURL is the device's own web UI, which the target's series link
+	// to. Grafana expands data link variables in it, such as
+	// ${__field.labels.device}.
+	AdminURL string `json:"adminUrl"`
+	// Calibrations correct the values of the target's sensors as they are
+	// scraped.
+	Calibrations []Calibration `json:"calibrations"`
+	// HighResolution samples some of the target's series more than once a
+	// second, such as the power of an appliance as it starts.
+	HighResolution *HighResolutionSettings `json:"highResolution"`
+	// ScrapeTimeoutSeconds bounds a scrape of the target, 10 seconds by
+	// default. Queries giving up sooner leave it to the others waiting.
+	ScrapeTimeoutSeconds float64 `json:"scrapeTimeoutSeconds"`
+}
+
+// HighResolutionSettings picks the series of a target sampled at sub-second
+// resolution, which are kept in a short buffer of their own.
+type HighResolutionSettings struct {
+	// Metrics are the metric names sampled, families or single series of
+	// them.
+	Metrics []string `json:"metrics"`
+	// IntervalMs is how often a scraped target is sampled, every 250
+	// milliseconds by default and at most every 50. Push targets are
+	// sampled as they push.
+	IntervalMs int `json:"intervalMs"`
+	// RetentionSeconds is how long samples are kept, 10 minutes by
+	// default. Queries of longer time ranges read the target's history.
+	RetentionSeconds int `json:"retentionSeconds"`
+}
+
+// Calibration corrects the series of a sensor, e.g. a thermometer that reads
+// 2°C high. Values become Polynomial of the raw value when it is set, and
+// otherwise the raw value times Scale plus Offset. The raw values are kept
+// in a <metric>_raw series.
+type Calibration struct {
+	Metric string `json:"metric"`
+	// Labels keeps only series with these exact label values.
+	Labels map[string]string `json:"labels"`
+	Offset float64           `json:"offset"`
+	Scale  *float64          `json:"scale"`
+	// Polynomial are the coefficients from the constant term up, e.g.
+	// [-0.5, 1.02] for 1.02x - 0.5.
+	Polynomial []float64 `json:"polynomial"`
+}
+
+func (c Calibration) validate() error {
+	if c.Metric == "" {
+		return fmt.Errorf("no metric to calibrate")
+	}
+	if len(c.Polynomial) > 0 && (c.Offset != 0 || c.Scale != nil) {
+		return fmt.Errorf("%s: set a polynomial or an offset and scale, not both", c.Metric)
+	}
+	return nil
+}
+
+// WebSocketSettings describes what a WebSocket source sends and how its
+// messages map to samples. The target's bearer token, if any, is sent when
+// connecting.
+type WebSocketSettings struct {
+	// Subscribe are messages sent after connecting, such as the
+	// subscription requests of JSON-RPC APIs.
+	Subscribe []string `json:"subscribe"`
+	// Samples map fields of the messages to samples.
+	Samples []FieldMapping `json:"samples"`
+	// Schema names the push schema the messages must conform to, which
+	// maps them to samples instead of Samples.
+	Schema string `json:"schema"`
+}
+
+// SSESettings describes what a server-sent events source sends and how its
+// events map to samples. The target's bearer token, if any, is sent with
+// each request, and the stream resumes from the last event ID it received.
+type SSESettings struct {
+	// Events are the event types mapped to samples; empty means those
+	// without a type, which is "message".
+	Events []string `json:"events"`
+	// Samples map fields of the events' data to samples.
+	Samples []FieldMapping `json:"samples"`
+	// Schema names the push schema the events' data must conform to, which
+	// maps it to samples instead of Samples.
+	Schema string `json:"schema"`
+}
+
+// GRPCSettings describes what is scraped from a gRPC service. The target's
+// bearer token, if any, is sent as authorization metadata.
+type GRPCSettings struct {
+	// Health are the services whose grpc.health.v1 status is scraped, ""
+	// being the server as a whole.
+	Health []string `json:"health"`
+	// Methods are unary methods called on each scrape.
+	Methods []GRPCMethod `json:"methods"`
+	// DescriptorSet is a base64 encoded FileDescriptorSet of the methods'
+	// services, as written by protoc --descriptor_set_out --include_imports.
+	// Without one, methods are looked up through server reflection.
+	DescriptorSet string `json:"descriptorSet"`
+}
+
+// GRPCMethod is a method scraped from a gRPC service. Its response maps to
+// samples as JSON, with fields named as in the .proto file and enums as
+// numbers.
+type GRPCMethod struct {
+	// Method is the full name of the method, e.g.
+	// "inverter.v1.InverterService/GetStatus".
+	Method string `json:"method"`
+	// Request is the request message as JSON; empty means an empty message.
+	Request string `json:"request"`
+	// Samples map fields of the response to samples.
+	Samples []FieldMapping `json:"samples"`
+}
+
+// AgentSettings configures a target pushed to by a lightweight agent.
+type AgentSettings struct {
+	// StaleSeconds is how long the samples of the last push are served, 10
+	// minutes by default, so that agents that went away show as down.
+	StaleSeconds int `json:"staleSeconds"`
+	// OutOfOrderSeconds is how far behind the newest sample a timestamped
+	// sample is still stored, for agents that buffer samples while offline
+	// and push them later. An hour by default, and never more than the
+	// target's history.
+	OutOfOrderSeconds int `json:"outOfOrderSeconds"`
+	// Conflict is what a late sample does to a value already stored for its
+	// series at its time: "overwrite" it, the default, or "keep" it.
+	Conflict string `json:"conflict"`
+	// Schema names a push schema, for agents pushing JSON documents
+	// conforming to it rather than lines of samples.
+	Schema string `json:"schema"`
+}
+
+// ListenerSettings describes how the dotted metric names a StatsD or
+// Graphite listener receives map to series. Names no mapping matches have
+// their dots replaced with underscores.
+type ListenerSettings struct {
+	Mappings []NameMapping `json:"mappings"`
+}
+
+// NameMapping maps the dotted names matching Match, in which * matches one
+// component, e.g. "servers.*.cpu.*", to the metric Name with Labels. Name
+// and the label values may refer to the matched components as $1, $2...
+type NameMapping struct {
+	Match  string            `json:"match"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+}
+
+// PushSchema describes the JSON messages of push sources: the fields mapped
+// to samples, their types and those every message must have. Messages that
+// don't conform are rejected whole, rather than turned into whatever series
+// their fields happen to map to.
+type PushSchema struct {
+	Name   string        `json:"name"`
+	Fields []SchemaField `json:"fields"`
+}
+
+// SchemaField is a field of a push schema, mapped to a sample like the
+// samples of push sources.
+type SchemaField struct {
+	FieldMapping
+	// Type is the JSON type of the value: "number", "integer" or
+	// "boolean", or "numeric", the default, for any of them and numeric
+	// strings.
+	Type string `json:"type"`
+	// Required rejects the messages without the field, or without any
+	// field its wildcards match. Fields with Match conditions are only
+	// required of the messages matching them.
+	Required bool `json:"required"`
+}
+
+// FieldMapping maps a field of JSON messages to a sample. Paths are dot
+// separated keys and array indexes, e.g. "params.0.extruder.temperature",
+// in which * matches every key or index.
+type FieldMapping struct {
+	Metric string `json:"metric"`
+	// Path is the path of the value: a number, a numeric string, or a
+	// boolean counting as 1 or 0.
+	Path string `json:"path"`
+	// KeyLabels name labels set to the keys or indexes matched by the
+	// wildcards of Path, in order.
+	KeyLabels []string `json:"keyLabels"`
+	// Labels are set to the values at paths, e.g. {"inverter": "serial"}.
+	Labels map[string]string `json:"labels"`
+	// Match only maps messages with these values at paths, e.g.
+	// {"method": "notify_status_update"}.
+	Match map[string]string `json:"match"`
+}
+
+func (w *WebSocketSettings) validate(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("URL %q must use ws or wss", rawURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("URL %q has no host", rawURL)
+	}
+	return validateSampleSource(w.Samples, w.Schema)
+}
+
+func (e *SSESettings) validate(rawURL string) error {
+	if _, err := parseHTTPURL(rawURL); err != nil {
+		return err
+	}
+	for _, event := range e.Events {
+		if event == "" || strings.ContainsAny(event, "\r\n") {
+			return fmt.Errorf("invalid event type %q", event)
+		}
+	}
+	return validateSampleSource(e.Samples, e.Schema)
+}
+
+// validateSampleSource checks that a push source maps its messages with
+// either samples or a schema.
+func validateSampleSource(samples []FieldMapping, schema string) error {
+	if schema == "" {
+		return validateMappings(samples)
+	}
+	if len(samples) > 0 {
+		return fmt.Errorf("set samples or schema, not both")
+	}
+	return nil
+}
+
+func (g *GRPCSettings) validate(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+	if u.Scheme != "grpc" && u.Scheme != "grpcs" {
+		return fmt.Errorf("URL %q must use grpc or grpcs", rawURL)
+	}
+	if u.Host == "" || u.Port() == "" {
+		return fmt.Errorf("URL %q has no host and port", rawURL)
+	}
+	if len(g.Health) == 0 && len(g.Methods) == 0 {
+		return fmt.Errorf("no health checks or methods")
+	}
+	for _, m := range g.Methods {
+		service, method, ok := strings.Cut(m.Method, "/")
+		if !ok || service == "" || method == "" {
+			return fmt.Errorf("method %q is not <service>/<method>", m.Method)
+		}
+		if err := validateMappings(m.Samples); err != nil {
+			return fmt.Errorf("method %s: %w", m.Method, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the listener address, rawURL, is one of the schemes, and
+// that mappings are only set for listeners of dotted names.
+func (l *ListenerSettings) validate(rawURL string, dotted bool, schemes ...string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+	if !slices.Contains(schemes, u.Scheme) || u.Port() == "" || u.Path != "" {
+		return fmt.Errorf("URL %q is not %s://host:port", rawURL, strings.Join(schemes, " or "))
+	}
+	if !dotted && len(l.Mappings) > 0 {
+		return fmt.Errorf("mappings only apply to statsd and graphite")
+	}
+	for _, m := range l.Mappings {
+		if m.Match == "" || m.Name == "" {
+			return fmt.Errorf("mapping %q: set match and name", m.Match)
+		}
+		if strings.Contains(m.Match, "..") || strings.HasPrefix(m.Match, ".") || strings.HasSuffix(m.Match, ".") {
+			return fmt.Errorf("mapping %q has an empty component", m.Match)
+		}
+	}
+	return nil
+}
+
+func validateMappings(mappings []FieldMapping) error {
+	if len(mappings) == 0 {
+		return fmt.Errorf("no samples mapped")
+	}
+	for i, m := range mappings {
+		if m.Metric == "" || m.Path == "" {
+			return fmt.Errorf("sample %d: set metric and path", i)
+		}
+	}
+	return nil
+}
+
+// SessionSettings describes a web UI login flow. The password lives in
+// secure settings under "sessionPassword_<target name>".
+type SessionSettings struct {
+	// LoginURL is where the login form is posted.
+	LoginURL string `json:"loginUrl"`
+	// Fields are the other fields of the login form, e.g. {"username": "admin"}.
+	Fields map[string]string `json:"fields"`
+	// PasswordField names the password field; "password" by default.
+	PasswordField string `json:"passwordField"`
+	// JSON posts the fields as a JSON object rather than a form.
+	JSON bool `json:"json"`
+
+	// CSRFPage, when set, is fetched before logging in for a CSRF token,
+	// taken from the CSRFCookie cookie it sets or the first group of
+	// CSRFRegex in its body.
+	CSRFPage   string `json:"csrfPage"`
+	CSRFCookie string `json:"csrfCookie"`
+	CSRFRegex  string `json:"csrfRegex"`
+	// CSRFField and CSRFHeader send the token in the login form and as a
+	// header of every request, respectively.
+	CSRFField  string `json:"csrfField"`
+	CSRFHeader string `json:"csrfHeader"`
+}
+
+// OAuth2Settings configures the OAuth2 client credentials grant. The client
+// secret lives in secure settings under "oauth2ClientSecret_<target name>".
+type OAuth2Settings struct {
+	TokenURL string   `json:"tokenUrl"`
+	ClientID string   `json:"clientId"`
+	Scopes   []string `json:"scopes"`
+	// Audience is sent to providers that need one to issue the token.
+	Audience string `json:"audience"`
+}
+
+// MetricsURL validates URL (the base URL of the scrape target, e.g.
+// http://nas.lan:9100) and returns the full URL of the metrics endpoint.
+func (s *PluginSettings) MetricsURL() (string, error) {
+	if s.URL == "" {
+		return "", fmt.Errorf("URL is not configured")
+	}
+	u, err := parseHTTPURL(s.URL)
+	if err != nil {
+		return "", err
+	}
+
+	metricsPath := s.MetricsPath
+	if metricsPath == "" {
+		metricsPath = DefaultMetricsPath
+	}
+	return u.JoinPath(metricsPath).String(), nil
+}
+
+// ScrapeTargets returns the target built from URL and MetricsPath, when URL
+// is set, followed by Targets. It fails if there are none, if one is invalid
+// or if two share a name.
+func (s *PluginSettings) ScrapeTargets() ([]Target, error) {
+	var targets []Target
+	if s.URL != "" {
+		metricsURL, err := s.MetricsURL()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, Target{Name: DefaultTargetName, URL: metricsURL, AdminURL: s.AdminURL})
+	}
+
+	seen := map[string]bool{DefaultTargetName: s.URL != ""}
+	for _, t := range s.Targets {
+		if t.Name == "" {
+			return nil, fmt.Errorf("target %q has no name", t.URL)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		seen[t.Name] = true
+		sources := 0
+		for _, set := range []bool{t.WebSocket != nil, t.SSE != nil, t.GRPC != nil, t.StatsD != nil, t.Graphite != nil, t.Collectd != nil, t.Telegraf != nil, t.Agent != nil} {
+			if set {
+				sources++
+			}
+		}
+		if sources > 0 && (t.OAuth2 != nil || t.Session != nil || t.Format != "") {
+			return nil, fmt.Errorf("target %s: oauth2, session and format only apply to HTTP targets", t.Name)
+		}
+		switch {
+		case sources > 1:
+			return nil, fmt.Errorf("target %s: set only one of websocket, sse, grpc, statsd, graphite, collectd, telegraf and agent", t.Name)
+		case t.WebSocket != nil:
+			if err := t.WebSocket.validate(t.URL); err != nil {
+				return nil, fmt.Errorf("target %s: websocket: %w", t.Name, err)
+			}
+		case t.SSE != nil:
+			if err := t.SSE.validate(t.URL); err != nil {
+				return nil, fmt.Errorf("target %s: sse: %w", t.Name, err)
+			}
+		case t.GRPC != nil:
+			if err := t.GRPC.validate(t.URL); err != nil {
+				return nil, fmt.Errorf("target %s: grpc: %w", t.Name, err)
+			}
+		case t.StatsD != nil:
+			if err := t.StatsD.validate(t.URL, true, "udp"); err != nil {
+				return nil, fmt.Errorf("target %s: statsd: %w", t.Name, err)
+			}
+		case t.Graphite != nil:
+			if err := t.Graphite.validate(t.URL, true, "tcp"); err != nil {
+				return nil, fmt.Errorf("target %s: graphite: %w", t.Name, err)
+			}
+		case t.Collectd != nil:
+			if err := t.Collectd.validate(t.URL, false, "udp"); err != nil {
+				return nil, fmt.Errorf("target %s: collectd: %w", t.Name, err)
+			}
+		case t.Telegraf != nil:
+			if err := t.Telegraf.validate(t.URL, false, "tcp", "udp"); err != nil {
+				return nil, fmt.Errorf("target %s: telegraf: %w", t.Name, err)
+			}
+		case t.Agent != nil:
+			if t.URL != "" {
+				return nil, fmt.Errorf("target %s: agents push their samples, and have no URL", t.Name)
+			}
+		default:
+			if _, err := parseHTTPURL(t.URL); err != nil {
+				return nil, fmt.Errorf("target %s: %w", t.Name, err)
+			}
+		}
+		if t.OAuth2 != nil {
+			if t.OAuth2.ClientID == "" {
+				return nil, fmt.Errorf("target %s: oauth2 has no client ID", t.Name)
+			}
+			if _, err := parseHTTPURL(t.OAuth2.TokenURL); err != nil {
+				return nil, fmt.Errorf("target %s: oauth2 token URL: %w", t.Name, err)
+			}
+		}
+		if t.Session != nil {
+			if t.OAuth2 != nil {
+				return nil, fmt.Errorf("target %s: set oauth2 or session, not both", t.Name)
+			}
+			if err := t.Session.validate(); err != nil {
+				return nil, fmt.Errorf("target %s: session: %w", t.Name, err)
+			}
+		}
+		if t.AdminURL != "" {
+			if _, err := parseHTTPURL(t.AdminURL); err != nil {
+				return nil, fmt.Errorf("target %s: admin URL: %w", t.Name, err)
+			}
+		}
+		if _, ok := t.Labels["target"]; ok {
+			return nil, fmt.Errorf("target %s: the target label is reserved for the target name", t.Name)
+		}
+		if t.ScrapeTimeoutSeconds < 0 {
+			return nil, fmt.Errorf("target %s: scrape timeout must not be negative", t.Name)
+		}
+		for _, c := range t.Calibrations {
+			if err := c.validate(); err != nil {
+				return nil, fmt.Errorf("target %s: calibration: %w", t.Name, err)
+			}
+		}
+		targets = append(targets, t)
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no scrape target configured: set URL or targets")
+	}
+	return targets, nil
+}
+
+func (s *SessionSettings) validate() error {
+	if _, err := parseHTTPURL(s.LoginURL); err != nil {
+		return fmt.Errorf("login URL: %w", err)
+	}
+	if s.CSRFPage == "" {
+		return nil
+	}
+	if _, err := parseHTTPURL(s.CSRFPage); err != nil {
+		return fmt.Errorf("CSRF page: %w", err)
+	}
+	if (s.CSRFCookie == "") == (s.CSRFRegex == "") {
+		return fmt.Errorf("set csrfCookie or csrfRegex to take the CSRF token from")
+	}
+	if s.CSRFRegex != "" {
+		re, err := regexp.Compile(s.CSRFRegex)
+		if err != nil {
+			return fmt.Errorf("invalid csrfRegex: %w", err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("csrfRegex has no group to take the token from")
+		}
+	}
+	if s.CSRFField == "" && s.CSRFHeader == "" {
+		return fmt.Errorf("set csrfField or csrfHeader to send the CSRF token in")
+	}
+	return nil
+}
+
+// parseHTTPURL parses raw and checks that it is an http(s) URL with a host.
+func parseHTTPURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("URL %q must use http or https", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("URL %q has no host", raw)
+	}
+	return u, nil
+}
+
+// SSHSettings describes the hosts used by collectors that need to read files
+// or run commands on a remote machine (e.g. /proc/mdstat). Hosts are
+// "name", "name:port" or IP addresses, IPv6 ones bare or as "[addr]:port",
+// on port 22 by default. Connections are refused unless the host's key, in
+// authorized_keys format, verifies it: HostKeys maps hosts, as configured
+// or without their port, to their keys, and HostKey is the key of Host.
+// InsecureSkipHostKeyVerification connects to hosts without a key anyway,
+// which leaves them open to being intercepted.
+type SSHSettings struct {
+	Host                            string            `json:"host"`
+	Hosts                           []string          `json:"hosts"`
+	User                            string            `json:"user"`
+	HostKey                         string            `json:"hostKey"`
+	HostKeys                        map[string]string `json:"hostKeys"`
+	InsecureSkipHostKeyVerification bool              `json:"insecureSkipHostKeyVerification"`
+	// Windows lists the hosts running Windows with OpenSSH, reached with the
+	// same user and credentials. They are queried by the windows collector
+	// only, not by those reading Linux files.
+	Windows []string `json:"windows"`
+	// MacOS lists the macOS hosts, for the macos collector alike. Power
+	// readings and system services need passwordless sudo.
+	MacOS []string `json:"macos"`
+}
+
+// AllHosts returns Host followed by Hosts, without duplicates or empty entries.
+func (s SSHSettings) AllHosts() []string {
+	seen := map[string]bool{}
+	var hosts []string
+	for _, h := range append([]string{s.Host}, s.Hosts...) {
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+// OpenWrtSettings configures access to an OpenWrt router's ubus JSON-RPC API.
+type OpenWrtSettings struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+}
+
+// PublicIPSettings configures the public IP and DDNS checker.
+type PublicIPSettings struct {
+	Enabled bool `json:"enabled"`
+	// EchoURLs are services returning the caller's IP as plain text, tried in order.
+	EchoURLs        []string `json:"echoUrls"`
+	DDNSHostnames   []string `json:"ddnsHostnames"`
+	DNSServer       string   `json:"dnsServer"`
+	IntervalSeconds int      `json:"intervalSeconds"`
+}
+
+// UpdateCheckSettings enable checking the plugin's releases for a newer
+// version, every IntervalHours, daily by default. FeedURL overrides the
+// GitHub releases API of the plugin, for a mirror serving the same JSON.
+type UpdateCheckSettings struct {
+	Enabled       bool   `json:"enabled"`
+	FeedURL       string `json:"feedUrl"`
+	IntervalHours int    `json:"intervalHours"`
 }
 
+// AgentReleaseSettings publish the binaries of the remote agents, so that
+// they update themselves. Dir holds the binaries of Version, named
+// agent-<os>-<arch> such as agent-linux-arm64, with .exe on Windows. They
+// are signed with the Ed25519 key in secure settings under
+// "agentSigningKey", as PEM encoded PKCS #8. Agents check for updates at
+// /agent-updates/<data source UID>/<agent> of the plugin's metrics server,
+// with their token in secure settings under "agentToken_<agent>".
+type AgentReleaseSettings struct {
+	Dir     string `json:"dir"`
+	Version string `json:"version"`
+}
+
+// SMARTSettings enable failure prediction over the S.M.A.R.T. attributes
+// that targets expose, as smartctl_exporter or node_exporter's smartmon
+// textfile collector do.
+type SMARTSettings struct {
+	Enabled bool `json:"enabled"`
+	// IntervalMinutes is how often attributes are sampled, hourly by default.
+	IntervalMinutes int `json:"intervalMinutes"`
+	// WindowDays is how far back trends are analyzed, two weeks by default.
+	WindowDays int `json:"windowDays"`
+}
+
+// ClimateSettings enable per-room aggregates of the temperature and
+// humidity sensors of targets, grouped by a target label, and the dew point,
+// heat index and absolute humidity of each sensor.
+type ClimateSettings struct {
+	Enabled bool `json:"enabled"`
+	// Label groups targets into rooms, "room" by default.
+	Label string `json:"label"`
+	// TemperatureMetric and HumidityMetric are regexes matching the names
+	// of the sensors' series. Humidity series ending in _ratio are scaled to
+	// percent.
+	TemperatureMetric string `json:"temperatureMetric"`
+	HumidityMetric    string `json:"humidityMetric"`
+	// OutdoorTarget and OutdoorMetric name the series of the outdoor
+	// temperature, in °C, that daily degree days are computed from. An empty
+	// OutdoorTarget means the first target.
+	OutdoorTarget string `json:"outdoorTarget"`
+	OutdoorMetric string `json:"outdoorMetric"`
+	// BaseTemperature is the outdoor temperature below which buildings need
+	// heating and above which they need cooling, 18°C by default.
+	BaseTemperature float64 `json:"baseTemperature"`
+	// HVACMetric is a regex matching the names of thermostat state series,
+	// which are non-zero while the HVAC runs, for its daily runtime.
+	HVACMetric string `json:"hvacMetric"`
+}
+
+// BatterySettings tune the battery table of wireless sensors, which finds
+// their battery level and link quality series in all targets.
+type BatterySettings struct {
+	// BatteryMetric and LinkQualityMetric are regexes matching the names of
+	// the series. Battery series ending in _ratio are scaled to percent.
+	BatteryMetric     string `json:"batteryMetric"`
+	LinkQualityMetric string `json:"linkQualityMetric"`
+	// ReplaceSoonPercent and ReplaceNowPercent are the battery levels below
+	// which batteries need replacing, 25 and 10 by default.
+	ReplaceSoonPercent float64 `json:"replaceSoonPercent"`
+	ReplaceNowPercent  float64 `json:"replaceNowPercent"`
+}
+
+// DuplicateSeriesSettings set the policy for series with the same name and
+// labels on several of Targets. Series of other targets are told apart by
+// their target label, as when hosts run the same exporter.
+type DuplicateSeriesSettings struct {
+	// Targets are the names of the targets that may report the same series,
+	// from the most preferred.
+	Targets []string `json:"targets"`
+	// Policy is "warn" (default) to keep them all with a notice, "prefer" to
+	// keep the one of the most preferred target, "merge" to merge them into
+	// one series, or "error" to fail the query.
+	Policy string `json:"policy"`
+}
+
+// ReverseProxySettings points at a reverse proxy's metrics or status endpoint.
+type ReverseProxySettings struct {
+	Name string `json:"name"`
+	// Kind is "traefik", "caddy" or "nginx" (stub_status).
+	Kind string `json:"kind"`
+	URL  string `json:"url"`
+}
+
+// SLOSettings declares availability and latency objectives for a service
+// routed through one of the configured reverse proxies.
+type SLOSettings struct {
+	Name    string `json:"name"`
+	Proxy   string `json:"proxy"`
+	Service string `json:"service"`
+	// AvailabilityTarget is the percentage of non-5xx responses, e.g. 99.9.
+	AvailabilityTarget float64 `json:"availabilityTarget"`
+	// LatencyTarget is the percentage of requests that must complete within
+	// LatencyThresholdSeconds.
+	LatencyThresholdSeconds float64 `json:"latencyThresholdSeconds"`
+	LatencyTarget           float64 `json:"latencyTarget"`
+}
+
+// DatabaseSettings describes a database whose health is monitored. Its
+// connection string lives in secure settings under "dsn_<name>".
+type DatabaseSettings struct {
+	Name string `json:"name"`
+	// Kind is "postgres", "mysql" or "redis".
+	Kind string `json:"kind"`
+	// SlowQuerySeconds is how long a running Postgres query may take before
+	// it counts as slow.
+	SlowQuerySeconds float64 `json:"slowQuerySeconds"`
+	// AllowedStatements are regular expressions a `sql` query must match.
+	AllowedStatements []string `json:"allowedStatements"`
+	MaxRows           int64    `json:"maxRows"`
+}
+
+// BrokerSettings describes a message broker whose queue depths are monitored.
+// Its password lives in secure settings under "brokerPassword_<name>".
+type BrokerSettings struct {
+	Name string `json:"name"`
+	// Kind is "mosquitto", "rabbitmq" or "nats".
+	Kind string `json:"kind"`
+	// URL is the MQTT broker URL (tcp://host:1883) for Mosquitto, the
+	// management API for RabbitMQ and the monitoring endpoint for NATS.
+	URL      string `json:"url"`
+	Username string `json:"username"`
+}
+
+// MinIOSettings points at a MinIO server. Its Prometheus bearer token (from
+// `mc admin prometheus generate`) lives in secure settings under
+// "minioToken_<name>"; leave it unset with MINIO_PROMETHEUS_AUTH_TYPE=public.
+type MinIOSettings struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// NextcloudSettings configures access to a Nextcloud server's serverinfo API.
+// Username must be an admin; use an app password as nextcloudPassword.
+type NextcloudSettings struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+}
+
+// MailSettings configures mail server monitoring. PostfixHost must be one of
+// the SSH hosts; the rspamd controller password is rspamdPassword.
+type MailSettings struct {
+	PostfixHost string `json:"postfixHost"`
+	RspamdURL   string `json:"rspamdUrl"`
+	// Domain and DKIMSelectors are checked for SPF, DKIM and DMARC records.
+	Domain        string   `json:"domain"`
+	DKIMSelectors []string `json:"dkimSelectors"`
+}
+
+// ProbeSettings configures availability probes of exposed services, run both
+// from the plugin ("inside") and, when AgentURL is set, from a remote probe
+// agent outside the home network ("outside"). The agent's bearer token is
+// probeAgentToken.
+type ProbeSettings struct {
+	Targets         []ProbeTarget `json:"targets"`
+	AgentURL        string        `json:"agentUrl"`
+	IntervalSeconds int           `json:"intervalSeconds"`
+	// DualStack also probes targets from inside over IPv4 and IPv6 apart,
+	// so that a broken IPv6 path shows rather than being hidden by falling
+	// back to IPv4.
+	DualStack bool `json:"dualStack"`
+}
+
+// ExecCheckSettings configures Nagios-style check plugins, run by the agent
+// at AgentURL on the hosts they check. The agent's bearer token is
+// execAgentToken.
+type ExecCheckSettings struct {
+	AgentURL string      `json:"agentUrl"`
+	Checks   []ExecCheck `json:"checks"`
+}
+
+// ExecCheck is a check plugin and its arguments, e.g. Command
+// /usr/lib/nagios/plugins/check_disk and Args ["-w", "20%", "-p", "/"].
+// TimeoutSeconds bounds its run, 30 seconds by default.
+type ExecCheck struct {
+	Name           string   `json:"name"`
+	Command        string   `json:"command"`
+	Args           []string `json:"args"`
+	TimeoutSeconds float64  `json:"timeoutSeconds"`
+}
+
+// Validate checks that the checks have unique names and commands, and an
+// agent to run them.
+func (s *ExecCheckSettings) Validate() error {
+	if len(s.Checks) == 0 {
+		return nil
+	}
+	if _, err := parseHTTPURL(s.AgentURL); err != nil {
+		return fmt.Errorf("agent URL: %w", err)
+	}
+	seen := map[string]bool{}
+	for _, c := range s.Checks {
+		switch {
+		case c.Name == "":
+			return fmt.Errorf("check %q has no name", c.Command)
+		case seen[c.Name]:
+			return fmt.Errorf("duplicate check name %q", c.Name)
+		case c.Command == "":
+			return fmt.Errorf("check %s has no command", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return nil
+}
+
+// PingCheck is a job, such as a cron job or a backup script, that checks in
+// at /ping/<data source UID>/<slug> of the plugin's metrics server when it
+// succeeds, the way Healthchecks.io takes pings: /start when it starts, /fail
+// when it fails, or /{exit code}. Pings carry the check's token, kept in
+// secure settings under "pingToken_<slug>", as a bearer token or the token
+// parameter; a check without a token can't be pinged.
+type PingCheck struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+	// PeriodSeconds is how often the job runs, and GraceSeconds how late a
+	// success may be before the check is down: a day and an hour by default.
+	PeriodSeconds int `json:"periodSeconds"`
+	GraceSeconds  int `json:"graceSeconds"`
+}
+
+// CostAccount is a cloud account whose spend the cost query reads from its
+// billing API. Provider is "openai" or "anthropic", read with an admin API
+// key, or "json" for a URL serving costs in the plugin's own format, such as
+// a script exporting an S3 or Backblaze bill. URL overrides the API of the
+// first two. The key or bearer token lives in secure settings under
+// "costToken_<name>".
+type CostAccount struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	URL      string `json:"url"`
+}
+
+// QueryWebhook posts the result of Query, a query as panels send them, to
+// URL on Schedule, a cron expression such as "*/15 * * * *" in the server's
+// time zone, so automations such as Home Assistant or n8n get metrics
+// without polling. The query covers the last RangeSeconds, an hour by
+// default. Template, a Go text/template over the result, makes the body,
+// of ContentType; without one the body is the result as JSON. A bearer
+// token for URL lives in secure settings under "webhookToken_<name>".
+type QueryWebhook struct {
+	Name         string          `json:"name"`
+	Schedule     string          `json:"schedule"`
+	Query        json.RawMessage `json:"query"`
+	RangeSeconds int             `json:"rangeSeconds"`
+	URL          string          `json:"url"`
+	Template     string          `json:"template"`
+	ContentType  string          `json:"contentType"`
+}
+
+// AlertmanagerSettings forward the problems the plugin detects itself,
+// failing scrapes and background jobs and late or failed ping checks, as
+// alerts to the v2 API of the Alertmanager at URL. With Mode "webhook" they
+// are posted to URL as Alertmanager webhook notifications instead, as Grafana
+// OnCall's Alertmanager integration takes them. Alerts are sent every
+// IntervalSeconds, a minute by default, with Labels added to them. A bearer
+// token lives in secure settings as alertmanagerToken.
+type AlertmanagerSettings struct {
+	URL             string            `json:"url"`
+	Mode            string            `json:"mode"`
+	IntervalSeconds int               `json:"intervalSeconds"`
+	Labels          map[string]string `json:"labels"`
+}
+
+// MaintenanceSettings declare planned blackouts, during which no alerts are
+// forwarded to the Alertmanager. Each window starts on Schedule, a cron
+// expression in the server's time zone, and lasts DurationMinutes. With
+// GrafanaURL set, active windows are exported as Grafana alerting mute
+// timings named MuteTimingPrefix ("homelab-" by default) and the window
+// name, created with the service account token grafanaToken from secure
+// settings and removed once the window ends. Notification policies mute
+// Grafana's own alerts during a window by referencing its mute timing.
+//
+// With DetectScrubs, the SSH hosts' /proc/mdstat and zpool status are
+// polled every minute, and a window named "scrub-" and the host opens while
+// md arrays resync, recover, reshape or are checked or repaired, or ZFS
+// pools are scrubbed or resilvered, until they're done. Series
+// of targets on the host get a "maintenance" label with the window name
+// for queries over the time it ran, which alert rules can leave out.
+type MaintenanceSettings struct {
+	Windows          []MaintenanceWindow `json:"windows"`
+	GrafanaURL       string              `json:"grafanaUrl"`
+	MuteTimingPrefix string              `json:"muteTimingPrefix"`
+	DetectScrubs     bool                `json:"detectScrubs"`
+}
+
+type MaintenanceWindow struct {
+	Name            string `json:"name"`
+	Schedule        string `json:"schedule"`
+	DurationMinutes int    `json:"durationMinutes"`
+}
+
+// TransactionSettings is a synthetic transaction, such as logging in to
+// Nextcloud or Gitea and opening a page: Steps run in order every
+// IntervalSeconds, five minutes by default, sharing cookies, and stop at the
+// first failing step. A password for the steps lives in secure settings under
+// "transactionPassword_<name>".
+type TransactionSettings struct {
+	Name            string            `json:"name"`
+	IntervalSeconds int               `json:"intervalSeconds"`
+	Steps           []TransactionStep `json:"steps"`
+}
+
+// TransactionStep is a request of a transaction, GET unless Method says
+// otherwise. URL, Headers and Body may reference the password as
+// ${password}, and the values earlier steps extracted by their name, as
+// ${name}. Extract maps names to regular expressions whose first group is
+// taken from the response body. A step passes when it returns ExpectStatus,
+// or any status below 400 without one, and its body matches ExpectBody, a
+// regular expression, if set.
+type TransactionStep struct {
+	Name         string            `json:"name"`
+	Method       string            `json:"method"`
+	URL          string            `json:"url"`
+	Headers      map[string]string `json:"headers"`
+	Body         string            `json:"body"`
+	ExpectStatus int               `json:"expectStatus"`
+	ExpectBody   string            `json:"expectBody"`
+	Extract      map[string]string `json:"extract"`
+}
+
+// BrowserSettings run Checks in a headless Chrome the plugin connects to,
+// for self-hosted UIs that render with JavaScript. URL is the remote
+// debugging endpoint of Chrome, such as http://chrome:9222, or the WebSocket
+// URL of a browserless instance, such as ws://browserless:3000, whose token
+// lives in secure settings as browserToken. Checks run every
+// IntervalSeconds, five minutes by default.
+type BrowserSettings struct {
+	URL             string         `json:"url"`
+	IntervalSeconds int            `json:"intervalSeconds"`
+	Checks          []BrowserCheck `json:"checks"`
+}
+
+// BrowserCheck loads URL and, with ExpectText set, fails unless the text of
+// the page contains it once loaded. A screenshot of the page is kept.
+type BrowserCheck struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	ExpectText string `json:"expectText"`
+	// TimeoutSeconds bounds loading the page, 30 seconds by default
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+// BufferbloatSettings schedule a loaded latency test of the internet
+// connection, every IntervalMinutes, an hour by default. Latency is timed by
+// connecting to PingURL, an http(s) or tcp://host:port URL, first idle, then
+// while downloading DownloadURL and while posting to UploadURL, each for
+// DurationSeconds, ten by default. Either load is left out without its URL.
+type BufferbloatSettings struct {
+	PingURL         string `json:"pingUrl"`
+	DownloadURL     string `json:"downloadUrl"`
+	UploadURL       string `json:"uploadUrl"`
+	DurationSeconds int    `json:"durationSeconds"`
+	IntervalMinutes int    `json:"intervalMinutes"`
+}
+
+// IperfSettings schedule iperf3 throughput tests between pairs of the SSH
+// hosts on Schedule, a cron expression in the server's time zone, "0 3 * * *"
+// by default. Pairs run in turn: iperf3 is started as a one-off server on
+// Server, then Client sends to it for DurationSeconds, ten by default, over
+// TCP for throughput and retransmits and then over UDP at UDPBandwidthMbps,
+// 100 by default, for jitter and loss. Client connects to ServerAddress, or
+// the host of Server, on Port, 5201 by default. Both need iperf3 installed.
+type IperfSettings struct {
+	Schedule         string      `json:"schedule"`
+	Pairs            []IperfPair `json:"pairs"`
+	DurationSeconds  int         `json:"durationSeconds"`
+	UDPBandwidthMbps int         `json:"udpBandwidthMbps"`
+	Port             int         `json:"port"`
+}
+
+type IperfPair struct {
+	Client        string `json:"client"`
+	Server        string `json:"server"`
+	ServerAddress string `json:"serverAddress"`
+}
+
+// FioSettings schedule fio benchmarks of Targets, directories on the SSH
+// hosts, on Schedule, a cron expression in the server's time zone,
+// "30 4 * * *" by default. Each target runs in turn a 4 KiB random read and
+// write job on a file of SizeMB, 64 by default and 1024 at most, for
+// RuntimeSeconds, ten by default and 60 at most. The file is removed after
+// the run, and the run is skipped unless the directory has twice its size
+// free. Hosts need fio installed.
+type FioSettings struct {
+	Schedule       string      `json:"schedule"`
+	Targets        []FioTarget `json:"targets"`
+	SizeMB         int         `json:"sizeMb"`
+	RuntimeSeconds int         `json:"runtimeSeconds"`
+}
+
+type FioTarget struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+}
+
+// PowerSchedule suspends Host, one of the SSH hosts, on Suspend and wakes it
+// on Wake, cron expressions in the server's time zone, such as at night and
+// again for the backups. WakeMethod is "rtcwake" (default), which sets the
+// host's RTC alarm before it suspends, or "wol", a Wake-on-LAN packet to MAC
+// sent to Broadcast, 255.255.255.255:9 by default. The host needs
+// passwordless sudo for rtcwake and systemd-run. Suspending waits while any
+// of GuardProcesses, such as a backup or a media transcoder, runs on the
+// host. Savings are estimated from AwakeWatts and AsleepWatts at PricePerKWh
+// in Currency.
+type PowerSchedule struct {
+	Name           string   `json:"name"`
+	Host           string   `json:"host"`
+	Suspend        string   `json:"suspend"`
+	Wake           string   `json:"wake"`
+	WakeMethod     string   `json:"wakeMethod"`
+	MAC            string   `json:"mac"`
+	Broadcast      string   `json:"broadcast"`
+	GuardProcesses []string `json:"guardProcesses"`
+	AwakeWatts     float64  `json:"awakeWatts"`
+	AsleepWatts    float64  `json:"asleepWatts"`
+	PricePerKWh    float64  `json:"pricePerKWh"`
+	Currency       string   `json:"currency"`
+}
+
+// IdleSettings enable tracking the daily usage of services, to report those
+// that go unused for weeks: containers, by their CPU and network in the
+// cAdvisor series of targets, and targets exposing request counters.
+type IdleSettings struct {
+	Enabled bool `json:"enabled"`
+	// IntervalMinutes is how often usage is sampled, hourly by default.
+	IntervalMinutes int `json:"intervalMinutes"`
+	// WindowDays is how many days of usage are kept, four weeks by default.
+	WindowDays int `json:"windowDays"`
+	// RequestMetric is a regex matching the names of request counters,
+	// http_requests_total and the like by default.
+	RequestMetric string `json:"requestMetric"`
+}
+
+// StatusPageSettings configure a read-only status page of Checks, for
+// household members without Grafana accounts. The plugin's metrics server
+// serves it at /status/<data source UID> to requests carrying the
+// statusPageToken of secure settings, as a bearer token or the token
+// parameter; without a token there is no status page.
+type StatusPageSettings struct {
+	// Title heads the page, "Homelab status" by default.
+	Title  string        `json:"title"`
+	Checks []StatusCheck `json:"checks"`
+}
+
+// StatusCheck is up while Query, run over the last RangeSeconds (five
+// minutes by default), succeeds with the last value of each of its series
+// within Min and Max, when set. The states of state tables count instead,
+// warnings making the check degraded and critical states making it down.
+type StatusCheck struct {
+	Name         string          `json:"name"`
+	Query        json.RawMessage `json:"query"`
+	RangeSeconds int             `json:"rangeSeconds"`
+	Min          *float64        `json:"min"`
+	Max          *float64        `json:"max"`
+}
+
+// KioskSettings configure the summary served at /api/v1/kiosk/summary, a
+// compact payload of the alerts firing and key stats for e-ink displays and
+// kiosk scripts that can't run Grafana panels.
+type KioskSettings struct {
+	Stats []KioskStat `json:"stats"`
+	// MaxAlerts is how many alerts the summary lists, the most severe
+	// first; 5 by default.
+	MaxAlerts int `json:"maxAlerts"`
+}
+
+// KioskStat is a key stat of the kiosk summary: the last values of the
+// series of Query, run over the last RangeSeconds (five minutes by
+// default), reduced to one by Reduce and rounded to Decimals. Reduce is
+// "last", the value of the first series and the default, or "sum", "avg",
+// "min" or "max" of all series. Unit, such as "W", follows the value in
+// its text.
+type KioskStat struct {
+	Name         string          `json:"name"`
+	Query        json.RawMessage `json:"query"`
+	RangeSeconds int             `json:"rangeSeconds"`
+	Reduce       string          `json:"reduce"`
+	Decimals     int             `json:"decimals"`
+	Unit         string          `json:"unit"`
+}
+
+// DigestSettings enable a digest of the last day or week, sent as one
+// message to Notifier on Schedule: the uptime of targets, the alerts that
+// fired, the energy used and the devices seen for the first time.
+type DigestSettings struct {
+	Enabled bool `json:"enabled"`
+	// Period is "day" (default) or "week".
+	Period string `json:"period"`
+	// Schedule is a cron schedule, at 8:00 by default, on Mondays for
+	// weekly digests.
+	Schedule string           `json:"schedule"`
+	Notifier NotifierSettings `json:"notifier"`
+	// PowerQuery is a query of power series, in watts, whose energy over
+	// the period is reported. Without it, energy is left out.
+	PowerQuery json.RawMessage `json:"powerQuery"`
+	// DevicesQuery is a query whose series are devices, told apart by
+	// DeviceLabel, "mac" by default. Devices it returns that no earlier
+	// digest saw are reported as new. Without it, devices are left out.
+	DevicesQuery json.RawMessage `json:"devicesQuery"`
+	DeviceLabel  string          `json:"deviceLabel"`
+}
+
+// PersonalDataSettings tag the series that are about people, such as the
+// presence or phone battery of a member of a shared household, which they
+// can export and delete.
+type PersonalDataSettings struct {
+	Series []PersonalSeries `json:"series"`
+	// Redact hides personal series from the metric queries of other users
+	// than their person and Grafana admins, and of webhooks, digests and
+	// other queries run without a user, but for alert rules.
+	Redact bool `json:"redact"`
+}
+
+// PersonalSeries tags the series whose name or family is Metric and that
+// have Labels, of Target or of all targets, as about Person, the Grafana
+// login of the person they are about.
+type PersonalSeries struct {
+	Person string            `json:"person"`
+	Target string            `json:"target"`
+	Metric string            `json:"metric"`
+	Labels map[string]string `json:"labels"`
+}
+
+// NotifierSettings configure where messages are sent. Kind is "webhook",
+// which posts the message as JSON to URL, "ntfy" for the topic URL,
+// "gotify" for the server URL, "telegram" for ChatID, "slack" or
+// "discord" for an incoming webhook URL. The bearer token, Gotify
+// application token or Telegram bot token lives in secure settings as
+// notifierToken.
+type NotifierSettings struct {
+	Kind   string `json:"kind"`
+	URL    string `json:"url"`
+	ChatID string `json:"chatId"`
+}
+
+// CarbonSettings configures the carbon intensity of the grid of Zone, such
+// as "DE" or "US-CAL-CISO", from Electricity Maps (formerly CO2 Signal). Its
+// API key is carbonApiKey; URL overrides the API.
+type CarbonSettings struct {
+	Zone string `json:"zone"`
+	URL  string `json:"url"`
+}
+
+// ProbeTarget is an http(s) URL, or tcp://host:port for a plain TCP connect.
+type ProbeTarget struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// DependencySettings declares a service or host and what it depends on, e.g.
+// an app on its database, the database on its host and the host on a UPS.
+// Its own health is that of the scrape target named by Target or the probe
+// target named by Probe; with neither, it only rolls up its dependencies.
+type DependencySettings struct {
+	Name      string   `json:"name"`
+	Target    string   `json:"target"`
+	Probe     string   `json:"probe"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// TracerouteSettings schedules traceroutes to Destinations. They run on Host,
+// one of the SSH hosts, or on the Grafana server when Host is empty.
+type TracerouteSettings struct {
+	Destinations    []string `json:"destinations"`
+	Host            string   `json:"host"`
+	IntervalSeconds int      `json:"intervalSeconds"`
+}
+
+// KubernetesSettings enables pod and node CPU and memory stats from the
+// metrics.k8s.io API of a cluster, e.g. k3s with its bundled metrics-server.
+// The cluster is read from the kubeconfig secret or, with InCluster, from the
+// service account of the pod Grafana runs in.
+type KubernetesSettings struct {
+	Enabled   bool `json:"enabled"`
+	InCluster bool `json:"inCluster"`
+	// Context selects a kubeconfig context; empty means the current one.
+	Context string `json:"context"`
+}
+
+// ScriptSettings is a collector written in Starlark, for devices without a
+// native integration. Scripts fetch URLs, parse their bodies and emit
+// samples, which the script query type returns.
+type ScriptSettings struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	// MaxSteps bounds the computation of a run in Starlark execution steps,
+	// MaxMemoryMB the memory it allocates and TimeoutSeconds its duration:
+	// 1,000,000 steps, 64 MB and 10 seconds by default.
+	MaxSteps       uint64  `json:"maxSteps"`
+	MaxMemoryMB    int     `json:"maxMemoryMB"`
+	TimeoutSeconds float64 `json:"timeoutSeconds"`
+}
+
+// EgressSettings restrict the hosts the plugin connects to. Entries are
+// CIDRs, such as 192.168.1.0/24, addresses, host names, or domains such as
+// *.lan matching their subdomains. Deny takes precedence over Allow, which,
+// when set, must match every host connected to.
+type EgressSettings struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// databaseDSNPrefix prefixes secure settings keys holding connection strings.
+const databaseDSNPrefix = "dsn_"
+
+// brokerPasswordPrefix prefixes secure settings keys holding broker passwords.
+const brokerPasswordPrefix = "brokerPassword_"
+
+// targetTokenPrefix prefixes secure settings keys holding scrape target
+// bearer tokens.
+const targetTokenPrefix = "targetToken_"
+
+// oauth2ClientSecretPrefix prefixes secure settings keys holding the OAuth2
+// client secrets of scrape targets.
+const oauth2ClientSecretPrefix = "oauth2ClientSecret_"
+
+// transactionPasswordPrefix prefixes secure settings keys holding the
+// passwords of synthetic transactions.
+const transactionPasswordPrefix = "transactionPassword_"
+
+// sessionPasswordPrefix prefixes secure settings keys holding the web UI
+// passwords of scrape targets.
+const sessionPasswordPrefix = "sessionPassword_"
+
+// minioTokenPrefix prefixes secure settings keys holding MinIO bearer tokens.
+const minioTokenPrefix = "minioToken_"
+
+// costTokenPrefix prefixes secure settings keys holding billing API keys.
+const costTokenPrefix = "costToken_"
+
+// webhookTokenPrefix prefixes secure settings keys holding the bearer
+// tokens of query webhooks.
+const webhookTokenPrefix = "webhookToken_"
+
+// pingTokenPrefix prefixes secure settings keys holding the tokens of ping
+// checks.
+const pingTokenPrefix = "pingToken_"
+
+// agentTokenPrefix prefixes secure settings keys holding the tokens agents
+// check for updates with.
+const agentTokenPrefix = "agentToken_"
+
+// pushTokenPrefix prefixes secure settings keys holding the tokens agent
+// targets push with.
+const pushTokenPrefix = "pushToken_"
+
 type SecretPluginSettings struct {
-	ApiKey string `json:"apiKey"`
+	ApiKey          string `json:"apiKey"`
+	SSHPassword     string `json:"sshPassword"`
+	SSHPrivateKey   string `json:"sshPrivateKey"`
+	OpenWrtPassword string `json:"openwrtPassword"`
+	// NextcloudPassword is an app password, NextcloudToken the serverinfo
+	// token (NC-Token header) which is enough for the serverinfo section
+	NextcloudPassword string `json:"nextcloudPassword"`
+	NextcloudToken    string `json:"nextcloudToken"`
+	RspamdPassword    string `json:"rspamdPassword"`
+	ProbeAgentToken   string `json:"probeAgentToken"`
+	ExecAgentToken    string `json:"execAgentToken"`
+	CarbonAPIKey      string `json:"carbonApiKey"`
+	AgentSigningKey   string `json:"agentSigningKey"`
+	AlertmanagerToken string `json:"alertmanagerToken"`
+	// AlertWebhookToken is the bearer token of the notifications of
+	// Alertmanager webhook receivers; without it there are none
+	AlertWebhookToken string `json:"alertWebhookToken"`
+	GrafanaToken      string `json:"grafanaToken"`
+	BrowserToken      string `json:"browserToken"`
+	StatusPageToken   string `json:"statusPageToken"`
+	NotifierToken     string `json:"notifierToken"`
+	// TLSCACert, TLSClientCert and TLSClientKey are PEM encoded
+	TLSCACert         string `json:"tlsCACert"`
+	TLSClientCert     string `json:"tlsClientCert"`
+	TLSClientKey      string `json:"tlsClientKey"`
+	BasicAuthPassword string `json:"basicAuthPassword"`
+	Kubeconfig        string `json:"kubeconfig"`
+	// DatabaseDSNs maps database names to connection strings
+	DatabaseDSNs map[string]string `json:"-"`
+	// BrokerPasswords maps broker names to passwords
+	BrokerPasswords map[string]string `json:"-"`
+	// TargetTokens maps scrape target names to bearer tokens
+	TargetTokens map[string]string `json:"-"`
+	// OAuth2ClientSecrets maps scrape target names to OAuth2 client secrets
+	OAuth2ClientSecrets map[string]string `json:"-"`
+	// SessionPasswords maps scrape target names to web UI passwords
+	SessionPasswords map[string]string `json:"-"`
+	// MinIOTokens maps MinIO server names to Prometheus bearer tokens
+	MinIOTokens map[string]string `json:"-"`
+	// CostTokens maps cost account names to billing API keys
+	CostTokens map[string]string `json:"-"`
+	// WebhookTokens maps query webhook names to bearer tokens
+	WebhookTokens map[string]string `json:"-"`
+	// PingTokens maps ping check slugs to the tokens of their pings
+	PingTokens map[string]string `json:"-"`
+	// AgentTokens maps agent names to the tokens of their update checks
+	AgentTokens map[string]string `json:"-"`
+	// PushTokens maps agent target names to the tokens of their pushes
+	PushTokens map[string]string `json:"-"`
+	// TransactionPasswords maps synthetic transaction names to passwords
+	TransactionPasswords map[string]string `json:"-"`
 }
 
 func LoadPluginSettings(source backend.DataSourceInstanceSettings) (*PluginSettings, error) {
@@ -39,6 +1470,51 @@ func loadSecretPluginSettings(source map[string]string) (*SecretPluginSettings,
 	}
 
 	return &SecretPluginSettings{
-		ApiKey: apiKey,
+		ApiKey:               apiKey,
+		SSHPassword:          source["sshPassword"],
+		SSHPrivateKey:        source["sshPrivateKey"],
+		OpenWrtPassword:      source["openwrtPassword"],
+		NextcloudPassword:    source["nextcloudPassword"],
+		NextcloudToken:       source["nextcloudToken"],
+		RspamdPassword:       source["rspamdPassword"],
+		ProbeAgentToken:      source["probeAgentToken"],
+		ExecAgentToken:       source["execAgentToken"],
+		CarbonAPIKey:         source["carbonApiKey"],
+		AgentSigningKey:      source["agentSigningKey"],
+		AlertmanagerToken:    source["alertmanagerToken"],
+		AlertWebhookToken:    source["alertWebhookToken"],
+		GrafanaToken:         source["grafanaToken"],
+		BrowserToken:         source["browserToken"],
+		StatusPageToken:      source["statusPageToken"],
+		NotifierToken:        source["notifierToken"],
+		TLSCACert:            source["tlsCACert"],
+		TLSClientCert:        source["tlsClientCert"],
+		TLSClientKey:         source["tlsClientKey"],
+		BasicAuthPassword:    source["basicAuthPassword"],
+		Kubeconfig:           source["kubeconfig"],
+		DatabaseDSNs:         prefixedSecrets(source, databaseDSNPrefix),
+		BrokerPasswords:      prefixedSecrets(source, brokerPasswordPrefix),
+		TargetTokens:         prefixedSecrets(source, targetTokenPrefix),
+		MinIOTokens:          prefixedSecrets(source, minioTokenPrefix),
+		CostTokens:           prefixedSecrets(source, costTokenPrefix),
+		WebhookTokens:        prefixedSecrets(source, webhookTokenPrefix),
+		PingTokens:           prefixedSecrets(source, pingTokenPrefix),
+		AgentTokens:          prefixedSecrets(source, agentTokenPrefix),
+		PushTokens:           prefixedSecrets(source, pushTokenPrefix),
+		TransactionPasswords: prefixedSecrets(source, transactionPasswordPrefix),
+		OAuth2ClientSecrets:  prefixedSecrets(source, oauth2ClientSecretPrefix),
+		SessionPasswords:     prefixedSecrets(source, sessionPasswordPrefix),
 	}, nil
 }
+
+// prefixedSecrets collects the non-empty secure settings whose key starts with
+// prefix, keyed by the rest of the key.
+func prefixedSecrets(source map[string]string, prefix string) map[string]string {
+	values := map[string]string{}
+	for key, value := range source {
+		if name, ok := strings.CutPrefix(key, prefix); ok && value != "" {
+			values[name] = value
+		}
+	}
+	return values
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeNetErrors = "neterrors"
+
+// netSeparator splits the /proc/net/dev and /proc/net/snmp output of a single
+// SSH round trip.
+const netSeparator = "--- snmp ---"
+
+// netSampleSpacing is how far apart the network counters kept for error
+// rates are, and netSampleRetention how long they are kept.
+const (
+	netSampleSpacing   = time.Minute
+	netSampleRetention = 24 * time.Hour
+)
+
+func init() {
+	registerQueryType(queryTypeNetErrors, queryNetErrors, hostQuery{})
+	registerConfiguredCheck(queryTypeNetErrors, func(ds *testDataSource) bool { return len(ds.settings.SSH.AllHosts()) > 0 })
+}
+
+// netInterface holds the cumulative counters of one interface in /proc/net/dev.
+type netInterface struct {
+	Name      string
+	RxPackets uint64
+	RxErrors  uint64
+	RxDrops   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDrops   uint64
+}
+
+// tcpStats holds the TCP segment counters from /proc/net/snmp.
+type tcpStats struct {
+	OutSegs     uint64
+	RetransSegs uint64
+}
+
+// parseNetDev parses /proc/net/dev.
+func parseNetDev(raw []byte) ([]netInterface, error) {
+	var ifaces []netInterface
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			// Header lines use "|" separators and have no colon
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 12 {
+			return nil, fmt.Errorf("malformed /proc/net/dev line for %s", strings.TrimSpace(name))
+		}
+
+		values := make([]uint64, 12)
+		for i := range values {
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid counter %q for %s: %w", fields[i], strings.TrimSpace(name), err)
+			}
+			values[i] = v
+		}
+
+		ifaces = append(ifaces, netInterface{
+			Name:      strings.TrimSpace(name),
+			RxPackets: values[1],
+			RxErrors:  values[2],
+			RxDrops:   values[3],
+			TxPackets: values[9],
+			TxErrors:  values[10],
+			TxDrops:   values[11],
+		})
+	}
+
+	return ifaces, scanner.Err()
+}
+
+// parseNetSnmp extracts the TCP counters from /proc/net/snmp, which lists each
+// protocol as a header line followed by a value line.
+func parseNetSnmp(raw []byte) (tcpStats, error) {
+	var header []string
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "Tcp:" {
+			continue
+		}
+		if header == nil {
+			header = fields
+			continue
+		}
+
+		var stats tcpStats
+		for i := 1; i < len(fields) && i < len(header); i++ {
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch header[i] {
+			case "OutSegs":
+				stats.OutSegs = v
+			case "RetransSegs":
+				stats.RetransSegs = v
+			}
+		}
+		return stats, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return tcpStats{}, err
+	}
+
+	return tcpStats{}, fmt.Errorf("no Tcp section found in /proc/net/snmp")
+}
+
+// ratioPercent returns part/total as a percentage, or nil when total is 0:
+// without traffic there is no error rate.
+func ratioPercent(part, total uint64) *float64 {
+	if total == 0 {
+		return nil
+	}
+	ratio := float64(part) / float64(total) * 100
+	return &ratio
+}
+
+// since returns how far the counters of i went up since prev. Counters
+// below those of prev were reset, by a reboot or the interface coming back,
+// and all of them went up from zero since.
+func (i netInterface) since(prev netInterface) netInterface {
+	if i.RxPackets < prev.RxPackets || i.RxErrors < prev.RxErrors || i.RxDrops < prev.RxDrops ||
+		i.TxPackets < prev.TxPackets || i.TxErrors < prev.TxErrors || i.TxDrops < prev.TxDrops {
+		return i
+	}
+	return netInterface{
+		Name:      i.Name,
+		RxPackets: i.RxPackets - prev.RxPackets,
+		RxErrors:  i.RxErrors - prev.RxErrors,
+		RxDrops:   i.RxDrops - prev.RxDrops,
+		TxPackets: i.TxPackets - prev.TxPackets,
+		TxErrors:  i.TxErrors - prev.TxErrors,
+		TxDrops:   i.TxDrops - prev.TxDrops,
+	}
+}
+
+// since returns how far the counters of s went up since prev, from zero
+// if they were reset by a reboot.
+func (s tcpStats) since(prev tcpStats) tcpStats {
+	if s.OutSegs < prev.OutSegs || s.RetransSegs < prev.RetransSegs {
+		return s
+	}
+	return tcpStats{OutSegs: s.OutSegs - prev.OutSegs, RetransSegs: s.RetransSegs - prev.RetransSegs}
+}
+
+// netSample is the network counters of a host, read at a point in time.
+type netSample struct {
+	at     time.Time
+	ifaces []netInterface
+	tcp    tcpStats
+}
+
+// netSampleLog keeps the network counters of each SSH host read by
+// neterrors queries, a sample every netSampleSpacing, for the error rates of
+// later queries over their time range.
+type netSampleLog struct {
+	mu      sync.Mutex
+	samples map[string][]netSample
+}
+
+func newNetSampleLog() *netSampleLog {
+	return &netSampleLog{samples: map[string][]netSample{}}
+}
+
+// baseline returns the sample of host the error rates of a query starting at
+// from are computed against: the last one read by then, or the first one
+// read since if there is none.
+func (l *netSampleLog) baseline(host string, from time.Time) (netSample, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	samples := l.samples[host]
+	if len(samples) == 0 {
+		return netSample{}, false
+	}
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].at.After(from) })
+	if i == 0 {
+		return samples[0], true
+	}
+	return samples[i-1], true
+}
+
+// record keeps s as a sample of host, unless the last one kept is younger
+// than netSampleSpacing, and drops those older than netSampleRetention.
+func (l *netSampleLog) record(host string, s netSample) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	samples := l.samples[host]
+	if n := len(samples); n > 0 && s.at.Sub(samples[n-1].at) < netSampleSpacing {
+		return
+	}
+	cutoff := s.at.Add(-netSampleRetention)
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].at.After(cutoff) })
+	l.samples[host] = append(samples[i:], s)
+}
+
+func queryNetErrors(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q hostQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	hosts, err := ds.sshHosts(q.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := data.Frames{}
+	for _, host := range hosts {
+		raw, err := ds.runRemoteCommand(ctx, host, "cat /proc/net/dev; echo '"+netSeparator+"'; cat /proc/net/snmp")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read network counters on %s: %w", host, err)
+		}
+
+		devRaw, snmpRaw, _ := bytes.Cut(raw, []byte(netSeparator))
+		ifaces, err := parseNetDev(devRaw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		tcp, err := parseNetSnmp(snmpRaw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+
+		current := netSample{at: time.Now(), ifaces: ifaces, tcp: tcp}
+		var prev *netSample
+		if s, ok := ds.netSamples.baseline(host, query.TimeRange.From); ok {
+			prev = &s
+		}
+		ds.netSamples.record(host, current)
+		frames = append(frames, netErrorsFrame(host, current, prev, ds.tr))
+	}
+
+	return frames, nil
+}
+
+// netErrorsFrame builds a per-host table of interface counters and error
+// rates. The counters are those since boot, and the rates those since prev,
+// the sample at the start of the query's time range; without one, for
+// interfaces it doesn't have, or without traffic since, they are null. The
+// TCP retransmit ratio is host-wide and repeated on every row so it can be
+// charted alongside the interfaces.
+func netErrorsFrame(host string, current netSample, prev *netSample, tr localizer) *data.Frame {
+	percent := &data.FieldConfig{Unit: "percent"}
+	frame := data.NewFrame(host,
+		data.NewField("interface", nil, []string{}),
+		data.NewField("rx_packets", nil, []uint64{}),
+		data.NewField("rx_errors", nil, []uint64{}),
+		data.NewField("rx_drops", nil, []uint64{}),
+		data.NewField("tx_packets", nil, []uint64{}),
+		data.NewField("tx_errors", nil, []uint64{}),
+		data.NewField("tx_drops", nil, []uint64{}),
+		data.NewField("rx_error_rate", nil, []*float64{}).SetConfig(percent),
+		data.NewField("tx_error_rate", nil, []*float64{}).SetConfig(percent),
+		data.NewField("tcp_retransmit_ratio", nil, []*float64{}).SetConfig(percent),
+	)
+
+	var retransmitRatio *float64
+	prevIfaces := map[string]netInterface{}
+	if prev != nil {
+		tcp := current.tcp.since(prev.tcp)
+		retransmitRatio = ratioPercent(tcp.RetransSegs, tcp.OutSegs)
+		for _, iface := range prev.ifaces {
+			prevIfaces[iface.Name] = iface
+		}
+	} else {
+		notice(frame, data.NoticeSeverityInfo, tr.text(msgNetRatesPending, host))
+	}
+	for _, iface := range current.ifaces {
+		var rxRate, txRate *float64
+		if p, ok := prevIfaces[iface.Name]; ok {
+			delta := iface.since(p)
+			rxRate = ratioPercent(delta.RxErrors, delta.RxPackets)
+			txRate = ratioPercent(delta.TxErrors, delta.TxPackets)
+		}
+		frame.AppendRow(iface.Name,
+			iface.RxPackets, iface.RxErrors, iface.RxDrops,
+			iface.TxPackets, iface.TxErrors, iface.TxDrops,
+			rxRate, txRate, retransmitRatio,
+		)
+	}
+
+	return frame
+}
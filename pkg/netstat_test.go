@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNetErrorsFrameRates(t *testing.T) {
+	// Years of clean traffic since boot, then a burst of errors on eth0,
+	// wlan0 reset by its driver coming back, and lo idle
+	first := netSample{
+		ifaces: []netInterface{
+			{Name: "eth0", RxPackets: 1_000_000_000, RxErrors: 10, TxPackets: 500_000_000},
+			{Name: "wlan0", RxPackets: 80_000, RxErrors: 4, TxPackets: 60_000, TxErrors: 2},
+			{Name: "lo", RxPackets: 70, TxPackets: 70},
+		},
+		tcp: tcpStats{OutSegs: 2_000_000_000, RetransSegs: 1000},
+	}
+	second := netSample{
+		ifaces: []netInterface{
+			{Name: "eth0", RxPackets: 1_000_001_000, RxErrors: 60, TxPackets: 500_000_400, TxErrors: 4},
+			{Name: "wlan0", RxPackets: 200, RxErrors: 10, TxPackets: 100},
+			{Name: "wg0", RxPackets: 50, TxPackets: 50},
+			{Name: "lo", RxPackets: 70, TxPackets: 70},
+		},
+		tcp: tcpStats{OutSegs: 2_000_000_200, RetransSegs: 1010},
+	}
+
+	frame := netErrorsFrame("nas", first, nil, localizer{})
+	if v, _ := frame.FieldByName("rx_error_rate"); v.At(0).(*float64) != nil {
+		t.Errorf("first sample has rates %v, want null until a second", *v.At(0).(*float64))
+	}
+	if frame.Meta == nil || len(frame.Meta.Notices) != 1 {
+		t.Error("first sample has no notice that rates need a second")
+	}
+
+	frame = netErrorsFrame("nas", second, &first, localizer{})
+	want := map[string][3]*float64{
+		"eth0":  {floatPtr(5.0), floatPtr(1.0), floatPtr(5.0)},
+		"wlan0": {floatPtr(5.0), floatPtr(0.0), floatPtr(5.0)},
+		"wg0":   {nil, nil, floatPtr(5.0)},
+		// No traffic, so no error rate rather than none of it in error
+		"lo": {nil, nil, floatPtr(5.0)},
+	}
+	iface, _ := frame.FieldByName("interface")
+	for row := 0; row < frame.Rows(); row++ {
+		name := iface.At(row).(string)
+		for i, field := range []string{"rx_error_rate", "tx_error_rate", "tcp_retransmit_ratio"} {
+			f, _ := frame.FieldByName(field)
+			got, expected := f.At(row).(*float64), want[name][i]
+			switch {
+			case got == nil && expected == nil:
+			case got == nil || expected == nil || *got != *expected:
+				t.Errorf("%s %s = %s, want %s", name, field, formatRate(got), formatRate(expected))
+			}
+		}
+	}
+}
+
+// TestNetSampleLogBaseline checks that the rates of a query are taken over
+// its time range, whatever other queries read in between.
+func TestNetSampleLogBaseline(t *testing.T) {
+	log := newNetSampleLog()
+	if _, ok := log.baseline("nas", testStart); ok {
+		t.Fatal("a host never read has a baseline")
+	}
+	// A dashboard refreshing every 10 seconds for an hour
+	for s := 0; s <= 3600; s += 10 {
+		at := testStart.Add(time.Duration(s) * time.Second)
+		log.record("nas", netSample{at: at, tcp: tcpStats{OutSegs: uint64(s)}})
+	}
+
+	tests := []struct {
+		from time.Time
+		want time.Duration
+	}{
+		{testStart.Add(-time.Hour), 0},
+		{testStart, 0},
+		{testStart.Add(30 * time.Minute), 30 * time.Minute},
+		{testStart.Add(30*time.Minute + 30*time.Second), 30 * time.Minute},
+		{testStart.Add(2 * time.Hour), time.Hour},
+	}
+	for _, tt := range tests {
+		got, ok := log.baseline("nas", tt.from)
+		if !ok || got.at != testStart.Add(tt.want) {
+			t.Errorf("baseline from %v = %v, want %v", tt.from, got.at, testStart.Add(tt.want))
+		}
+	}
+	if _, ok := log.baseline("router", testStart); ok {
+		t.Error("router has the baseline of nas")
+	}
+
+	log.record("nas", netSample{at: testStart.Add(netSampleRetention + time.Hour)})
+	if got, _ := log.baseline("nas", testStart); got.at.Before(testStart.Add(time.Hour)) {
+		t.Errorf("sample of %v outlived the retention", got.at)
+	}
+}
+
+func floatPtr(v float64) *float64 { return &v }
+
+func formatRate(v *float64) string {
+	if v == nil {
+		return "null"
+	}
+	return strconv.FormatFloat(*v, 'g', -1, 64)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeNextcloud = "nextcloud"
+
+const (
+	nextcloudServerInfoPath = "/ocs/v2.php/apps/serverinfo/api/v1/info"
+	nextcloudAppConfigPath  = "/ocs/v2.php/apps/provisioning_api/api/v1/config/apps/core/"
+)
+
+// nextcloudCronStaleAfter matches the admin overview, which warns when
+// background jobs haven't run for an hour.
+const nextcloudCronStaleAfter = time.Hour
+
+func init() {
+	registerQueryType(queryTypeNextcloud, queryNextcloud, nextcloudQuery{})
+	registerConfiguredCheck(queryTypeNextcloud, func(ds *testDataSource) bool { return ds.settings.Nextcloud.URL != "" })
+}
+
+type nextcloudQuery struct {
+	// Section is one of "overview", "opcache" or "cron".
+	Section string `json:"section"`
+}
+
+type nextcloudServerInfo struct {
+	Nextcloud struct {
+		System struct {
+			Version   string  `json:"version"`
+			FreeSpace float64 `json:"freespace"`
+			MemTotal  float64 `json:"mem_total"`
+			MemFree   float64 `json:"mem_free"`
+		} `json:"system"`
+		Storage struct {
+			NumUsers float64 `json:"num_users"`
+			NumFiles float64 `json:"num_files"`
+		} `json:"storage"`
+		Shares struct {
+			NumShares float64 `json:"num_shares"`
+		} `json:"shares"`
+	} `json:"nextcloud"`
+	Server struct {
+		PHP struct {
+			Version string `json:"version"`
+			// OPcache is an empty array rather than an object when disabled
+			OPcache json.RawMessage `json:"opcache"`
+		} `json:"php"`
+	} `json:"server"`
+	ActiveUsers struct {
+		Last5Minutes float64 `json:"last5minutes"`
+		Last1Hour    float64 `json:"last1hour"`
+		Last24Hours  float64 `json:"last24hours"`
+	} `json:"activeUsers"`
+}
+
+type nextcloudOPcache struct {
+	MemoryUsage struct {
+		UsedMemory   float64 `json:"used_memory"`
+		FreeMemory   float64 `json:"free_memory"`
+		WastedMemory float64 `json:"wasted_memory"`
+	} `json:"memory_usage"`
+	Statistics struct {
+		CachedScripts float64 `json:"num_cached_scripts"`
+		Hits          float64 `json:"hits"`
+		Misses        float64 `json:"misses"`
+		HitRate       float64 `json:"opcache_hit_rate"`
+	} `json:"opcache_statistics"`
+}
+
+// nextcloudGet calls an OCS endpoint and decodes the "data" member of its
+// envelope into out.
+func (ds *testDataSource) nextcloudGet(ctx context.Context, path string, out any) error {
+	cfg := ds.settings.Nextcloud
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("invalid Nextcloud URL: %w", err)
+	}
+	u = u.JoinPath(path)
+	u.RawQuery = "format=json"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("OCS-APIRequest", "true")
+	req.Header.Set("Accept", "application/json")
+	if secrets := ds.settings.Secrets; secrets != nil {
+		if secrets.NextcloudPassword != "" {
+			req.SetBasicAuth(cfg.Username, secrets.NextcloudPassword)
+		}
+		if secrets.NextcloudToken != "" {
+			req.Header.Set("NC-Token", secrets.NextcloudToken)
+		}
+	}
+
+	resp, err := ds.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", u.Path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u.Path, resp.Status)
+	}
+
+	var envelope struct {
+		OCS struct {
+			Meta struct {
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			} `json:"meta"`
+			Data json.RawMessage `json:"data"`
+		} `json:"ocs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", u.Path, err)
+	}
+	if envelope.OCS.Meta.Status != "ok" {
+		return fmt.Errorf("%s failed: %s", u.Path, envelope.OCS.Meta.Message)
+	}
+	return json.Unmarshal(envelope.OCS.Data, out)
+}
+
+func (ds *testDataSource) nextcloudAppConfig(ctx context.Context, key string) (string, error) {
+	var value struct {
+		Data string `json:"data"`
+	}
+	if err := ds.nextcloudGet(ctx, nextcloudAppConfigPath+key, &value); err != nil {
+		return "", err
+	}
+	return value.Data, nil
+}
+
+func queryNextcloud(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	if ds.settings.Nextcloud.URL == "" {
+		return nil, fmt.Errorf("Nextcloud URL is not configured")
+	}
+
+	var q nextcloudQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	var frame *data.Frame
+	var err error
+	switch q.Section {
+	case "", "overview":
+		frame, err = ds.nextcloudOverview(ctx)
+	case "opcache":
+		frame, err = ds.nextcloudOPcache(ctx)
+	case "cron":
+		frame, err = ds.nextcloudCron(ctx)
+	default:
+		return nil, fmt.Errorf("unknown Nextcloud section %q", q.Section)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return data.Frames{frame}, nil
+}
+
+func (ds *testDataSource) nextcloudOverview(ctx context.Context) (*data.Frame, error) {
+	var info nextcloudServerInfo
+	if err := ds.nextcloudGet(ctx, nextcloudServerInfoPath, &info); err != nil {
+		return nil, err
+	}
+	nc := info.Nextcloud
+
+	return data.NewFrame("nextcloud",
+		data.NewField("version", nil, []string{nc.System.Version}),
+		data.NewField("php_version", nil, []string{info.Server.PHP.Version}),
+		data.NewField("active_users_5m", nil, []float64{info.ActiveUsers.Last5Minutes}),
+		data.NewField("active_users_1h", nil, []float64{info.ActiveUsers.Last1Hour}),
+		data.NewField("active_users_24h", nil, []float64{info.ActiveUsers.Last24Hours}),
+		data.NewField("users", nil, []float64{nc.Storage.NumUsers}),
+		data.NewField("files", nil, []float64{nc.Storage.NumFiles}),
+		data.NewField("shares", nil, []float64{nc.Shares.NumShares}),
+		data.NewField("free_space", nil, []float64{nc.System.FreeSpace}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+		// serverinfo reports memory in KiB
+		data.NewField("mem_total", nil, []float64{nc.System.MemTotal * 1024}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+		data.NewField("mem_free", nil, []float64{nc.System.MemFree * 1024}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+	), nil
+}
+
+func (ds *testDataSource) nextcloudOPcache(ctx context.Context) (*data.Frame, error) {
+	var info nextcloudServerInfo
+	if err := ds.nextcloudGet(ctx, nextcloudServerInfoPath, &info); err != nil {
+		return nil, err
+	}
+
+	raw := bytes.TrimSpace(info.Server.PHP.OPcache)
+	if len(raw) == 0 || raw[0] != '{' {
+		return nil, fmt.Errorf("OPcache is disabled or not reported by serverinfo")
+	}
+	var oc nextcloudOPcache
+	if err := json.Unmarshal(raw, &oc); err != nil {
+		return nil, fmt.Errorf("failed to decode OPcache stats: %w", err)
+	}
+
+	bytesUnit := &data.FieldConfig{Unit: "bytes"}
+	return data.NewFrame("opcache",
+		data.NewField("used_memory", nil, []float64{oc.MemoryUsage.UsedMemory}).SetConfig(bytesUnit),
+		data.NewField("free_memory", nil, []float64{oc.MemoryUsage.FreeMemory}).SetConfig(bytesUnit),
+		data.NewField("wasted_memory", nil, []float64{oc.MemoryUsage.WastedMemory}).SetConfig(bytesUnit),
+		data.NewField("cached_scripts", nil, []float64{oc.Statistics.CachedScripts}),
+		data.NewField("hits", nil, []float64{oc.Statistics.Hits}),
+		data.NewField("misses", nil, []float64{oc.Statistics.Misses}),
+		data.NewField("hit_rate", nil, []float64{oc.Statistics.HitRate}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+	), nil
+}
+
+// nextcloudCron reports when background jobs last ran. The serverinfo API
+// doesn't include this, so it's read from the core app config, which needs an
+// admin app password rather than the serverinfo token.
+// cronStates are the severities of cron statuses.
+var cronStates = stateScale{"ok": severityOK, "late": severityWarning, "never": severityCritical}
+
+func (ds *testDataSource) nextcloudCron(ctx context.Context) (*data.Frame, error) {
+	lastCron, err := ds.nextcloudAppConfig(ctx, "lastcron")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read last cron run: %w", err)
+	}
+	mode, err := ds.nextcloudAppConfig(ctx, "backgroundjobs_mode")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read background jobs mode: %w", err)
+	}
+	if mode == "" {
+		mode = "ajax" // Nextcloud's default
+	}
+
+	status := "ok"
+	var lastRun *time.Time
+	var age *float64
+	if ts, err := strconv.ParseInt(lastCron, 10, 64); err == nil && ts > 0 {
+		t := time.Unix(ts, 0)
+		seconds := time.Since(t).Seconds()
+		lastRun, age = &t, &seconds
+		if time.Since(t) > nextcloudCronStaleAfter {
+			status = "late"
+		}
+	} else {
+		status = "never"
+	}
+
+	statusField, severityField := newStateFields(cronStates)
+	frame := data.NewFrame("cron",
+		data.NewField("mode", nil, []string{mode}),
+		data.NewField("last_run", nil, []*time.Time{lastRun}),
+		data.NewField("age", nil, []*float64{age}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		statusField,
+		severityField,
+	)
+	frame.AppendRow(mode, lastRun, age, status, cronStates.severity(status))
+	return frame, nil
+}
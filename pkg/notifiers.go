@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const defaultTelegramURL = "https://api.telegram.org"
+
+// notification is a message to send, with the data it was made of for
+// notifiers taking JSON.
+type notification struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	Data  any    `json:"data,omitempty"`
+}
+
+// notifier sends notifications to a service of its kind.
+type notifier struct {
+	models.NotifierSettings
+	token string
+}
+
+// notifierRequests build the request sending a notification, by notifier
+// kind. Supporting another service takes an entry here.
+var notifierRequests = map[string]func(ctx context.Context, n *notifier, msg notification) (*http.Request, error){
+	"webhook": func(ctx context.Context, n *notifier, msg notification) (*http.Request, error) {
+		req, err := jsonRequest(ctx, n.URL, msg)
+		if err == nil && n.token != "" {
+			req.Header.Set("Authorization", "Bearer "+n.token)
+		}
+		return req, err
+	},
+	"ntfy": func(ctx context.Context, n *notifier, msg notification) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, strings.NewReader(msg.Text))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Title", msg.Title)
+		if n.token != "" {
+			req.Header.Set("Authorization", "Bearer "+n.token)
+		}
+		return req, nil
+	},
+	"gotify": func(ctx context.Context, n *notifier, msg notification) (*http.Request, error) {
+		req, err := jsonRequest(ctx, strings.TrimSuffix(n.URL, "/")+"/message", map[string]any{
+			"title": msg.Title, "message": msg.Text, "priority": 5,
+		})
+		if err == nil {
+			req.Header.Set("X-Gotify-Key", n.token)
+		}
+		return req, err
+	},
+	"telegram": func(ctx context.Context, n *notifier, msg notification) (*http.Request, error) {
+		base := n.URL
+		if base == "" {
+			base = defaultTelegramURL
+		}
+		return jsonRequest(ctx, strings.TrimSuffix(base, "/")+"/bot"+n.token+"/sendMessage", map[string]string{
+			"chat_id": n.ChatID, "text": msg.Title + "\n\n" + msg.Text,
+		})
+	},
+	"slack": func(ctx context.Context, n *notifier, msg notification) (*http.Request, error) {
+		return jsonRequest(ctx, n.URL, map[string]string{"text": "*" + msg.Title + "*\n" + msg.Text})
+	},
+	"discord": func(ctx context.Context, n *notifier, msg notification) (*http.Request, error) {
+		return jsonRequest(ctx, n.URL, map[string]string{"content": "**" + msg.Title + "**\n" + msg.Text})
+	},
+}
+
+func jsonRequest(ctx context.Context, target string, body any) (*http.Request, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// newNotifier validates notifier settings, with the token of secure settings.
+func newNotifier(settings models.NotifierSettings, token string) (*notifier, error) {
+	if _, ok := notifierRequests[settings.Kind]; !ok {
+		kinds := make([]string, 0, len(notifierRequests))
+		for kind := range notifierRequests {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		return nil, fmt.Errorf("unknown notifier kind %q, expected one of %s", settings.Kind, strings.Join(kinds, ", "))
+	}
+	switch settings.Kind {
+	case "telegram":
+		if settings.ChatID == "" || token == "" {
+			return nil, fmt.Errorf("telegram notifiers need a chatId and a bot token")
+		}
+		if settings.URL == "" {
+			return &notifier{NotifierSettings: settings, token: token}, nil
+		}
+	case "gotify":
+		if token == "" {
+			return nil, fmt.Errorf("gotify notifiers need an application token")
+		}
+	}
+	if u, err := url.Parse(settings.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%s notifier has invalid URL %q", settings.Kind, settings.URL)
+	}
+	return &notifier{NotifierSettings: settings, token: token}, nil
+}
+
+// notify sends msg. Errors name the notifier by kind, as URLs may carry
+// tokens.
+func (ds *testDataSource) notify(ctx context.Context, n *notifier, msg notification) error {
+	req, err := notifierRequests[n.Kind](ctx, n, msg)
+	if err != nil {
+		return fmt.Errorf("failed to create %s notification: %w", n.Kind, err)
+	}
+	resp, err := ds.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send %s notification: %w", n.Kind, redactError(err, n.token))
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s notifier returned %s", n.Kind, resp.Status)
+	}
+	return nil
+}
+
+// redactError hides secret in the message of err, as errors of the HTTP
+// client include the URL.
+func redactError(err error, secret string) error {
+	if secret == "" || !strings.Contains(err.Error(), secret) {
+		return err
+	}
+	return fmt.Errorf("%s", strings.ReplaceAll(err.Error(), secret, "xxxxx"))
+}
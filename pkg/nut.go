@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func init() {
+	registerParser("nut", parseNUT)
+}
+
+// nutStatusVar holds the status flags of a UPS, such as "OL CHRG".
+const nutStatusVar = "ups.status"
+
+// parseNUT parses the variables of Network UPS Tools UPSes, as listed by
+// upsc ("battery.charge: 100") or by the upsd protocol's LIST VAR
+// ("VAR myups battery.charge "100""), the latter labeled with the UPS name.
+// Variables become nut_ samples as in the keyvalue format, except
+// ups.status, whose flags each become a nut_ups_status sample of 1 with a
+// "flag" label.
+func parseNUT(body []byte) ([]metricSample, error) {
+	var samples sampleSet
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "BEGIN ") || strings.HasPrefix(line, "END ") {
+			continue
+		}
+
+		var labels data.Labels
+		var name, value string
+		if rest, ok := strings.CutPrefix(line, "VAR "); ok {
+			fields := strings.SplitN(rest, " ", 3)
+			if len(fields) != 3 {
+				return nil, withCode(codeParseError, fmt.Errorf("line %d: expected VAR <ups> <name> \"<value>\", got %q", n, line))
+			}
+			labels = data.Labels{"ups": fields[0]}
+			name, value = fields[1], fields[2]
+		} else {
+			var ok bool
+			if name, value, ok = strings.Cut(line, ":"); !ok {
+				return nil, withCode(codeParseError, fmt.Errorf("line %d: expected <name>: <value>, got %q", n, line))
+			}
+		}
+
+		name = strings.TrimSpace(name)
+		if name == nutStatusVar {
+			for _, flag := range strings.Fields(strings.Trim(strings.TrimSpace(value), `"`)) {
+				flagLabels := data.Labels{"flag": flag}
+				for k, v := range labels {
+					flagLabels[k] = v
+				}
+				samples.add("nut_ups_status", flagLabels, 1)
+			}
+			continue
+		}
+		samples.addValue("nut_"+sanitizeMetricName(name), labels, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, withCode(codeParseError, fmt.Errorf("failed to read NUT variables: %w", err))
+	}
+	return samples.list(), nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const (
+	// oauth2ExpiryDelta renews tokens this long before they expire, so none
+	// expires on its way to the target
+	oauth2ExpiryDelta = 30 * time.Second
+	// maxTokenResponseBytes bounds the token responses read
+	maxTokenResponseBytes = 1 << 20
+)
+
+// oauth2Source gets a target's bearer tokens with the OAuth2 client
+// credentials grant, without pulling in a full OAuth2 library. Tokens are
+// cached until they expire, and renewed with the refresh token when the
+// provider issued one.
+type oauth2Source struct {
+	settings     models.OAuth2Settings
+	clientSecret string
+
+	// mu is held while fetching tokens, so concurrent scrapes wait for the
+	// same token rather than each fetching one
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	expiry       time.Time
+}
+
+func newOAuth2Source(settings models.OAuth2Settings, clientSecret string) *oauth2Source {
+	return &oauth2Source{settings: settings, clientSecret: clientSecret}
+}
+
+// token returns the cached token, fetching a new one when there is none or
+// it is about to expire.
+func (s *oauth2Source) token(ctx context.Context, client *http.Client) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessToken != "" && (s.expiry.IsZero() || time.Now().Before(s.expiry.Add(-oauth2ExpiryDelta))) {
+		return s.accessToken, nil
+	}
+
+	if s.refreshToken != "" {
+		err := s.fetch(ctx, client, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {s.refreshToken}})
+		if err == nil {
+			return s.accessToken, nil
+		}
+		backend.Logger.Warn("Failed to refresh OAuth2 token, requesting a new one", "tokenUrl", s.settings.TokenURL, "error", err)
+		s.refreshToken = ""
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.settings.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.settings.Scopes, " "))
+	}
+	if s.settings.Audience != "" {
+		form.Set("audience", s.settings.Audience)
+	}
+	if err := s.fetch(ctx, client, form); err != nil {
+		return "", err
+	}
+	return s.accessToken, nil
+}
+
+// invalidate drops token, which the target rejected, unless it was already
+// replaced.
+func (s *oauth2Source) invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessToken == token {
+		s.accessToken = ""
+	}
+}
+
+// fetch requests a token from the token endpoint, authenticating with the
+// client ID and secret as HTTP basic auth.
+func (s *oauth2Source) fetch(ctx context.Context, client *http.Client, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.settings.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// RFC 6749 form-encodes the credentials before basic auth encodes them
+	req.SetBasicAuth(url.QueryEscape(s.settings.ClientID), url.QueryEscape(s.clientSecret))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request token from %s: %w", s.settings.TokenURL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseBytes))
+	if err != nil {
+		return fmt.Errorf("failed to read token response: %w", err)
+	}
+
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	jsonErr := json.Unmarshal(body, &token)
+	if resp.StatusCode != http.StatusOK {
+		if token.Error != "" {
+			return fmt.Errorf("%s returned %s: %s %s", s.settings.TokenURL, resp.Status, token.Error, token.ErrorDescription)
+		}
+		return fmt.Errorf("%s returned %s", s.settings.TokenURL, resp.Status)
+	}
+	if jsonErr != nil {
+		return fmt.Errorf("failed to decode token response: %w", jsonErr)
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("token response from %s has no access token", s.settings.TokenURL)
+	}
+
+	s.accessToken = token.AccessToken
+	s.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		s.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	// Refreshes may not come with a new refresh token
+	if token.RefreshToken != "" {
+		s.refreshToken = token.RefreshToken
+	}
+	return nil
+}
+
+// getTarget sends a scrape request to target, with its bearer token, a
+// token from its OAuth2 provider or its web session. A token or session the
+// target rejects is dropped and the request is retried once with a new one.
+func (ds *testDataSource) getTarget(ctx context.Context, target *scrapeTarget) (*http.Response, error) {
+	if target.session != nil {
+		return target.session.get(ctx, ds.httpClient, target.URL)
+	}
+	if target.oauth2 == nil {
+		return ds.getBearer(ctx, target.URL, target.Token)
+	}
+	token, err := target.oauth2.token(ctx, ds.httpClient)
+	if err != nil {
+		return nil, withCode(codeAuthFailed, err)
+	}
+	resp, err := ds.getBearer(ctx, target.URL, token)
+	if codeOf(err) != codeAuthFailed {
+		return resp, err
+	}
+
+	target.oauth2.invalidate(token)
+	if token, err = target.oauth2.token(ctx, ds.httpClient); err != nil {
+		return nil, withCode(codeAuthFailed, err)
+	}
+	return ds.getBearer(ctx, target.URL, token)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// pathParamPattern matches the wildcards of ServeMux patterns.
+var pathParamPattern = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+// openAPIDocument describes routes as an OpenAPI 3 document. Responses are
+// JSON; errors are objects with an "error" message and an optional "code".
+func openAPIDocument(routes []resourceRoute) map[string]any {
+	paths := map[string]map[string]any{}
+	for _, route := range routes {
+		params := []map[string]any{}
+		for _, m := range pathParamPattern.FindAllStringSubmatch(route.Path, -1) {
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+			})
+		}
+		for _, name := range route.Query {
+			params = append(params, map[string]any{
+				"name": name, "in": "query", "required": false, "schema": map[string]string{"type": "string"},
+			})
+		}
+
+		operation := map[string]any{
+			"summary":    route.Summary,
+			"parameters": params,
+			"responses": map[string]any{
+				"200":     jsonResponse("Success", map[string]any{}),
+				"default": jsonResponse("Error", map[string]any{"$ref": "#/components/schemas/Error"}),
+			},
+		}
+		if route.Admin {
+			operation["description"] = "For Grafana admins only."
+			operation["responses"].(map[string]any)["403"] = jsonResponse("Not a Grafana admin", map[string]any{"$ref": "#/components/schemas/Error"})
+		}
+		if route.Body {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": map[string]any{}}},
+			}
+		}
+
+		// OpenAPI has no {name...} wildcards
+		path := resourceAPIPrefix + pathParamPattern.ReplaceAllString(route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Homelab data source resource API",
+			"version": strings.TrimPrefix(resourceAPIPrefix, "/api/"),
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": map[string]any{
+				"Error": map[string]any{
+					"type":     "object",
+					"required": []string{"error"},
+					"properties": map[string]any{
+						"error": map[string]string{"type": "string"},
+						"code":  map[string]string{"type": "string"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func jsonResponse(description string, schema map[string]any) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
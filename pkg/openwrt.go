@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeOpenWrt = "openwrt"
+
+// ubusNullSession is the anonymous session used to call session.login.
+const ubusNullSession = "00000000000000000000000000000000"
+
+// ubusStatusPermissionDenied is returned by ubus when the session expired.
+const ubusStatusPermissionDenied = 6
+
+// ubusRPCAccessDenied is the JSON-RPC error code rpcd uses for unknown sessions.
+const ubusRPCAccessDenied = -32002
+
+func init() {
+	registerQueryType(queryTypeOpenWrt, queryOpenWrt, openWrtQuery{})
+	registerConfiguredCheck(queryTypeOpenWrt, func(ds *testDataSource) bool { return ds.openwrt != nil })
+}
+
+type openWrtQuery struct {
+	// Section is one of "system", "conntrack", "wireless" or "sqm".
+	Section string `json:"section"`
+}
+
+// openWrtClient talks to rpcd's ubus JSON-RPC endpoint, logging in lazily and
+// re-using the session until the router rejects it.
+type openWrtClient struct {
+	httpClient *http.Client
+	endpoint   string
+	username   string
+	password   string
+
+	mu      sync.Mutex
+	session string
+}
+
+func newOpenWrtClient(httpClient *http.Client, baseURL, username, password string) (*openWrtClient, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenWrt URL: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ubus"
+
+	return &openWrtClient{
+		httpClient: httpClient,
+		endpoint:   u.String(),
+		username:   username,
+		password:   password,
+	}, nil
+}
+
+// host returns the router's hostname, used to label its series.
+func (c *openWrtClient) host() string {
+	if u, err := url.Parse(c.endpoint); err == nil {
+		return u.Hostname()
+	}
+	return c.endpoint
+}
+
+type ubusRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type ubusResponse struct {
+	Result []json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// errUbusSession signals that the session is no longer valid.
+var errUbusSession = fmt.Errorf("ubus session rejected")
+
+func (c *openWrtClient) rawCall(ctx context.Context, session, object, method string, args any, out any) error {
+	if args == nil {
+		args = map[string]any{}
+	}
+	body, err := json.Marshal(ubusRequest{
+		JSONRPC: "2.0",
+		ID:      1,
+		Method:  "call",
+		Params:  []any{session, object, method, args},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("ubus request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ubus returned %s", resp.Status)
+	}
+
+	var res ubusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("failed to decode ubus response: %w", err)
+	}
+	if res.Error != nil {
+		if res.Error.Code == ubusRPCAccessDenied {
+			return errUbusSession
+		}
+		return fmt.Errorf("ubus %s.%s: %s", object, method, res.Error.Message)
+	}
+	if len(res.Result) == 0 {
+		return fmt.Errorf("ubus %s.%s: empty result", object, method)
+	}
+
+	var status int
+	if err := json.Unmarshal(res.Result[0], &status); err != nil {
+		return fmt.Errorf("ubus %s.%s: invalid status: %w", object, method, err)
+	}
+	if status == ubusStatusPermissionDenied {
+		return errUbusSession
+	}
+	if status != 0 {
+		return fmt.Errorf("ubus %s.%s returned status %d", object, method, status)
+	}
+	if out != nil && len(res.Result) > 1 {
+		if err := json.Unmarshal(res.Result[1], out); err != nil {
+			return fmt.Errorf("ubus %s.%s: failed to decode result: %w", object, method, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *openWrtClient) login(ctx context.Context) (string, error) {
+	var res struct {
+		Session string `json:"ubus_rpc_session"`
+	}
+	err := c.rawCall(ctx, ubusNullSession, "session", "login", map[string]string{
+		"username": c.username,
+		"password": c.password,
+	}, &res)
+	if err != nil {
+		return "", fmt.Errorf("OpenWrt login failed: %w", err)
+	}
+	if res.Session == "" {
+		return "", fmt.Errorf("OpenWrt login returned no session")
+	}
+	return res.Session, nil
+}
+
+// call invokes object.method, logging in again once if the session expired.
+func (c *openWrtClient) call(ctx context.Context, object, method string, args any, out any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if c.session == "" {
+			session, err := c.login(ctx)
+			if err != nil {
+				return err
+			}
+			c.session = session
+		}
+
+		err := c.rawCall(ctx, c.session, object, method, args, out)
+		if err == errUbusSession {
+			c.session = ""
+			continue
+		}
+		return err
+	}
+
+	return fmt.Errorf("ubus %s.%s: permission denied", object, method)
+}
+
+func (c *openWrtClient) readFile(ctx context.Context, path string) (string, error) {
+	var res struct {
+		Data string `json:"data"`
+	}
+	if err := c.call(ctx, "file", "read", map[string]string{"path": path}, &res); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(res.Data), nil
+}
+
+func queryOpenWrt(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	if ds.openwrt == nil {
+		return nil, fmt.Errorf("OpenWrt URL is not configured")
+	}
+
+	var q openWrtQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	var frame *data.Frame
+	var err error
+	switch q.Section {
+	case "", "system":
+		frame, err = ds.openWrtSystem(ctx)
+	case "conntrack":
+		frame, err = ds.openWrtConntrack(ctx)
+	case "wireless":
+		frame, err = ds.openWrtWireless(ctx)
+	case "sqm":
+		frame, err = ds.openWrtSQM(ctx)
+	default:
+		return nil, fmt.Errorf("unknown OpenWrt section %q", q.Section)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return data.Frames{frame}, nil
+}
+
+func (ds *testDataSource) openWrtSystem(ctx context.Context) (*data.Frame, error) {
+	var info struct {
+		Uptime int64     `json:"uptime"`
+		Load   []float64 `json:"load"`
+		Memory struct {
+			Total     int64 `json:"total"`
+			Free      int64 `json:"free"`
+			Available int64 `json:"available"`
+		} `json:"memory"`
+	}
+	if err := ds.openwrt.call(ctx, "system", "info", nil, &info); err != nil {
+		return nil, err
+	}
+
+	// ubus reports load averages as fixed point values scaled by 65536
+	load := make([]float64, 3)
+	for i := 0; i < len(load) && i < len(info.Load); i++ {
+		load[i] = info.Load[i] / 65536
+	}
+
+	bytesConfig := &data.FieldConfig{Unit: "bytes"}
+	return data.NewFrame("system",
+		data.NewField("uptime", nil, []int64{info.Uptime}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("load1", nil, []float64{load[0]}),
+		data.NewField("load5", nil, []float64{load[1]}),
+		data.NewField("load15", nil, []float64{load[2]}),
+		data.NewField("memory_total", nil, []int64{info.Memory.Total}).SetConfig(bytesConfig),
+		data.NewField("memory_free", nil, []int64{info.Memory.Free}).SetConfig(bytesConfig),
+		data.NewField("memory_available", nil, []int64{info.Memory.Available}).SetConfig(bytesConfig),
+	), nil
+}
+
+func (ds *testDataSource) openWrtConntrack(ctx context.Context) (*data.Frame, error) {
+	u, err := ds.openWrtConntrackUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conntrackFrame(time.Now(), u, defaultConntrackWarn, defaultConntrackCritical), nil
+}
+
+func (ds *testDataSource) openWrtWireless(ctx context.Context) (*data.Frame, error) {
+	var devices struct {
+		Devices []string `json:"devices"`
+	}
+	if err := ds.openwrt.call(ctx, "iwinfo", "devices", nil, &devices); err != nil {
+		return nil, err
+	}
+
+	ap := ds.openwrt.host()
+
+	var stations []wifiStation
+	for _, device := range devices.Devices {
+		var assoc struct {
+			Results []struct {
+				MAC    string  `json:"mac"`
+				Signal float64 `json:"signal"`
+				Noise  float64 `json:"noise"`
+			} `json:"results"`
+		}
+		if err := ds.openwrt.call(ctx, "iwinfo", "assoclist", map[string]string{"device": device}, &assoc); err != nil {
+			return nil, fmt.Errorf("failed to list clients on %s: %w", device, err)
+		}
+		for _, r := range assoc.Results {
+			stations = append(stations, wifiStation{
+				MAC:       strings.ToLower(r.MAC),
+				AP:        ap,
+				Interface: device,
+				Signal:    r.Signal,
+				Noise:     r.Noise,
+				HasNoise:  r.Noise != 0,
+			})
+		}
+	}
+
+	// Feed the wifi tracker so OpenWrt clients show up in wifi queries too
+	ds.wifi.record(time.Now(), stations)
+
+	frame := data.NewFrame("wireless",
+		data.NewField("device", nil, []string{}),
+		data.NewField("client", nil, []string{}),
+		data.NewField("signal", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "dBm"}),
+		data.NewField("noise", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "dBm"}),
+		data.NewField("snr", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "dB"}),
+	)
+	for _, s := range stations {
+		var snr *float64
+		if v, ok := s.snr(); ok {
+			snr = &v
+		}
+		frame.AppendRow(s.Interface, s.MAC, s.Signal, s.Noise, snr)
+	}
+
+	return frame, nil
+}
+
+// qdiscStats are the counters of one qdisc from `tc -s qdisc`.
+type qdiscStats struct {
+	Kind       string
+	Handle     string
+	Device     string
+	SentBytes  int64
+	SentPkts   int64
+	Dropped    int64
+	Overlimits int64
+}
+
+func (ds *testDataSource) openWrtSQM(ctx context.Context) (*data.Frame, error) {
+	var res struct {
+		Code   int    `json:"code"`
+		Stdout string `json:"stdout"`
+		Stderr string `json:"stderr"`
+	}
+	err := ds.openwrt.call(ctx, "file", "exec", map[string]any{
+		"command": "/sbin/tc",
+		"params":  []string{"-s", "qdisc"},
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	if res.Code != 0 {
+		return nil, fmt.Errorf("tc exited with code %d: %s", res.Code, strings.TrimSpace(res.Stderr))
+	}
+
+	frame := data.NewFrame("sqm",
+		data.NewField("device", nil, []string{}),
+		data.NewField("kind", nil, []string{}),
+		data.NewField("handle", nil, []string{}),
+		data.NewField("sent_bytes", nil, []int64{}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+		data.NewField("sent_packets", nil, []int64{}),
+		data.NewField("dropped", nil, []int64{}),
+		data.NewField("overlimits", nil, []int64{}),
+	)
+	for _, q := range parseTCQdiscs(res.Stdout) {
+		frame.AppendRow(q.Device, q.Kind, q.Handle, q.SentBytes, q.SentPkts, q.Dropped, q.Overlimits)
+	}
+
+	return frame, nil
+}
+
+// parseTCQdiscs parses `tc -s qdisc` output such as:
+//
+//	qdisc cake 8001: dev eth1 root refcnt 2 bandwidth 95Mbit ...
+//	 Sent 123456 bytes 789 pkt (dropped 12, overlimits 34 requeues 0)
+func parseTCQdiscs(out string) []qdiscStats {
+	var qdiscs []qdiscStats
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ", ",", " ").Replace(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "qdisc" && len(fields) >= 3 {
+			q := qdiscStats{Kind: fields[1], Handle: fields[2]}
+			for i := 3; i+1 < len(fields); i++ {
+				if fields[i] == "dev" {
+					q.Device = fields[i+1]
+					break
+				}
+			}
+			qdiscs = append(qdiscs, q)
+			continue
+		}
+
+		if fields[0] == "Sent" && len(qdiscs) > 0 {
+			q := &qdiscs[len(qdiscs)-1]
+			for i := 0; i+1 < len(fields); i++ {
+				v, err := strconv.ParseInt(fields[i+1], 10, 64)
+				switch {
+				case fields[i] == "Sent" && err == nil:
+					q.SentBytes = v
+				case fields[i+1] == "pkt":
+					q.SentPkts, _ = strconv.ParseInt(fields[i], 10, 64)
+				case fields[i] == "dropped" && err == nil:
+					q.Dropped = v
+				case fields[i] == "overlimits" && err == nil:
+					q.Overlimits = v
+				}
+			}
+		}
+	}
+
+	return qdiscs
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+)
+
+// States of operations.
+const (
+	operationRunning   = "running"
+	operationSucceeded = "succeeded"
+	operationFailed    = "failed"
+	operationCancelled = "cancelled"
+)
+
+// maxOperations is how many finished operations are kept.
+const maxOperations = 50
+
+const operationPathPrefix = "operation/"
+
+// errOperationRunning is returned when an operation of the same kind and
+// subject is running already.
+var errOperationRunning = errors.New("an operation of the same kind is running already")
+
+// operationProgress reports that an operation is done with done of total
+// steps, and what it is doing.
+type operationProgress func(done, total int, message string)
+
+// operation is a long-running task started by a resource call, such as a
+// compaction or a benchmark, which runs in the background while its
+// progress is polled or streamed.
+type operation struct {
+	ID        string     `json:"id"`
+	Kind      string     `json:"kind"`
+	Subject   string     `json:"subject,omitempty"`
+	User      string     `json:"user,omitempty"`
+	State     string     `json:"state"`
+	Progress  float64    `json:"progress"`
+	Message   string     `json:"message,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+	// Channel is the Grafana Live channel streaming its progress
+	Channel string `json:"channel"`
+
+	cancel context.CancelFunc
+	// changed is closed and replaced whenever the operation changes
+	changed chan struct{}
+}
+
+// operationTracker runs the operations of an instance and keeps them for
+// their progress to be read, the finished ones until maxOperations newer
+// ones finished.
+type operationTracker struct {
+	// ctx is cancelled when the instance is disposed of, cancelling the
+	// operations still running
+	ctx context.Context
+	uid string
+
+	mu    sync.Mutex
+	ops   map[string]*operation
+	order []string
+}
+
+func newOperationTracker(ctx context.Context, uid string) *operationTracker {
+	return &operationTracker{ctx: ctx, uid: uid, ops: map[string]*operation{}}
+}
+
+// startOperation runs op in the background as an operation of kind on
+// subject, started by the user of ctx, and returns a snapshot of it. Only
+// one operation of a kind and subject runs at a time.
+func (ds *testDataSource) startOperation(ctx context.Context, kind, subject string, op func(ctx context.Context, progress operationProgress) error) (operation, error) {
+	t := ds.operations
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	opCtx, cancel := context.WithCancel(t.ctx)
+	o := &operation{
+		ID:        id,
+		Kind:      kind,
+		Subject:   subject,
+		User:      auditUser(ctx),
+		State:     operationRunning,
+		StartedAt: time.Now().UTC(),
+		Channel:   live.Channel{Scope: live.ScopeDatasource, Namespace: t.uid, Path: operationPathPrefix + id}.String(),
+		cancel:    cancel,
+		changed:   make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	for _, other := range t.ops {
+		if other.State == operationRunning && other.Kind == kind && other.Subject == subject {
+			t.mu.Unlock()
+			cancel()
+			return operation{}, fmt.Errorf("%w: %s", errOperationRunning, other.ID)
+		}
+	}
+	t.ops[id] = o
+	t.order = append(t.order, id)
+	snapshot := *o
+	t.mu.Unlock()
+
+	ds.startJob(func() {
+		defer cancel()
+		err := op(opCtx, func(done, total int, message string) {
+			t.update(o, func() {
+				if total > 0 {
+					o.Progress = min(100, 100*float64(done)/float64(total))
+				}
+				o.Message = message
+			})
+		})
+		t.update(o, func() {
+			ended := time.Now().UTC()
+			o.EndedAt = &ended
+			switch {
+			case opCtx.Err() != nil:
+				o.State = operationCancelled
+			case err != nil:
+				o.State, o.Error = operationFailed, err.Error()
+			default:
+				o.State, o.Progress = operationSucceeded, 100
+			}
+		})
+		if err != nil && opCtx.Err() == nil {
+			backend.Logger.Warn("Operation failed", "kind", kind, "subject", subject, "id", id, "error", err)
+		}
+		t.prune()
+	})
+	return snapshot, nil
+}
+
+// update changes o with change, and wakes those waiting for it to change.
+func (t *operationTracker) update(o *operation, change func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	change()
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
+
+// prune drops the oldest finished operations past maxOperations.
+func (t *operationTracker) prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	finished := 0
+	for _, id := range t.order {
+		if t.ops[id].State != operationRunning {
+			finished++
+		}
+	}
+	t.order = slices.DeleteFunc(t.order, func(id string) bool {
+		if finished <= maxOperations || t.ops[id].State == operationRunning {
+			return false
+		}
+		finished--
+		delete(t.ops, id)
+		return true
+	})
+}
+
+// get returns a snapshot of the operation id, and a channel closed when it
+// changes next.
+func (t *operationTracker) get(id string) (operation, <-chan struct{}, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o, ok := t.ops[id]
+	if !ok {
+		return operation{}, nil, false
+	}
+	return *o, o.changed, true
+}
+
+// list returns snapshots of the operations, the newest first.
+func (t *operationTracker) list() []operation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ops := make([]operation, 0, len(t.order))
+	for i := len(t.order) - 1; i >= 0; i-- {
+		ops = append(ops, *t.ops[t.order[i]])
+	}
+	return ops
+}
+
+// cancel cancels the operation id, and reports whether it exists.
+func (t *operationTracker) cancel(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o, ok := t.ops[id]
+	if ok {
+		o.cancel()
+	}
+	return ok
+}
+
+// operationFrame is the frame of the progress of o streamed over Grafana
+// Live.
+func operationFrame(o operation) *data.Frame {
+	return data.NewFrame("operation",
+		data.NewField("time", nil, []time.Time{time.Now()}),
+		data.NewField("progress", nil, []float64{o.Progress}),
+		data.NewField("state", nil, []string{o.State}),
+		data.NewField("message", nil, []string{o.Message}),
+		data.NewField("error", nil, []string{o.Error}),
+	)
+}
+
+// runOperationStream streams the progress of the operation of path, a
+// frame whenever it changes, until it ends.
+func (ds *testDataSource) runOperationStream(ctx context.Context, path string, sender *backend.StreamSender) error {
+	id := strings.TrimPrefix(path, operationPathPrefix)
+	for {
+		o, changed, ok := ds.operations.get(id)
+		if !ok {
+			return fmt.Errorf("unknown operation %s", id)
+		}
+		if err := sender.SendFrame(operationFrame(o), data.IncludeAll); err != nil {
+			return fmt.Errorf("failed to send operation frame: %w", err)
+		}
+		if o.State != operationRunning {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// handleListOperations lists the operations running and finished, the
+// newest first.
+func (ds *testDataSource) handleListOperations(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, ds.operations.list())
+}
+
+func (ds *testDataSource) handleGetOperation(w http.ResponseWriter, r *http.Request) {
+	o, _, ok := ds.operations.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no operation %q", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, o)
+}
+
+// handleCancelOperation cancels a running operation, which ends as
+// cancelled once it notices.
+func (ds *testDataSource) handleCancelOperation(w http.ResponseWriter, r *http.Request) {
+	if !ds.operations.cancel(r.PathValue("id")) {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no operation %q", r.PathValue("id")))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeOperation answers the start of an operation: 202 with the
+// operation, or 409 when one of its kind is running already.
+func writeOperation(w http.ResponseWriter, o operation, err error) {
+	switch {
+	case errors.Is(err, errOperationRunning):
+		writeJSONError(w, http.StatusConflict, err)
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusAccepted, o)
+	}
+}
+
+// handleCompactOperation compacts the histories of the targets selected
+// by the target parameter, all of them by default.
+func (ds *testDataSource) handleCompactOperation(w http.ResponseWriter, r *http.Request) {
+	targets, err := ds.selectTargets(r.URL.Query().Get("target"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	o, err := ds.startOperation(r.Context(), "compact", r.URL.Query().Get("target"), func(ctx context.Context, progress operationProgress) error {
+		ds.compactHistories(ctx, targets, progress)
+		return nil
+	})
+	writeOperation(w, o, err)
+}
+
+// compactHistories compacts the history and high-resolution buffer of
+// targets in turn, reporting progress by target.
+func (ds *testDataSource) compactHistories(ctx context.Context, targets []*scrapeTarget, progress operationProgress) {
+	for i, target := range targets {
+		if ctx.Err() != nil {
+			return
+		}
+		progress(i, len(targets), "compacting "+target.Name)
+		histories := []*scrapeHistory{target.history}
+		if target.highRes != nil {
+			histories = append(histories, target.highRes.history)
+		}
+		for _, h := range histories {
+			changes, series := h.compact()
+			backend.Logger.Debug("Compacted history", "target", target.Name, "changes", changes, "series", series)
+		}
+	}
+	progress(len(targets), len(targets), "")
+}
+
+// compactAfterPurge compacts the histories of targets after values were
+// purged from them, as an operation.
+func (ds *testDataSource) compactAfterPurge(ctx context.Context, targets []*scrapeTarget) {
+	subject := strings.Join(targetNames(targets), ",")
+	_, err := ds.startOperation(ctx, "compact", subject, func(ctx context.Context, progress operationProgress) error {
+		ds.compactHistories(ctx, targets, progress)
+		return nil
+	})
+	// A compaction running already frees some of it, and the next one the
+	// rest
+	if err != nil {
+		backend.Logger.Debug("History not compacted after purge", "targets", subject, "error", err)
+	}
+}
+
+// handleFioOperation runs the fio benchmarks now, rather than at their
+// next scheduled run.
+func (ds *testDataSource) handleFioOperation(w http.ResponseWriter, r *http.Request) {
+	if ds.fio == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("fio benchmarks are not configured"))
+		return
+	}
+	o, err := ds.startOperation(r.Context(), "fio", "", ds.fioRound)
+	writeOperation(w, o, err)
+}
+
+// handleIperfOperation runs the iperf3 tests now, rather than at their
+// next scheduled run.
+func (ds *testDataSource) handleIperfOperation(w http.ResponseWriter, r *http.Request) {
+	if ds.iperf == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("iperf3 tests are not configured"))
+		return
+	}
+	o, err := ds.startOperation(r.Context(), "iperf", "", ds.iperfRound)
+	writeOperation(w, o, err)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// newOperationsDataSource returns an instance running operations until ctx
+// is done.
+func newOperationsDataSource(ctx context.Context) *testDataSource {
+	ds := newTestDataSource()
+	ds.uid = "homelab"
+	ds.operations = newOperationTracker(ctx, ds.uid)
+	return ds
+}
+
+// waitOperation waits for the operation id to end, and returns it.
+func waitOperation(t *testing.T, ds *testDataSource, id string) operation {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		o, changed, ok := ds.operations.get(id)
+		if !ok {
+			t.Fatalf("no operation %s", id)
+		}
+		if o.State != operationRunning {
+			return o
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("operation %s still running: %+v", id, o)
+		}
+	}
+}
+
+func TestOperationOutcomes(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(ctx context.Context, progress operationProgress) error
+		// cancel cancels the operation once it started, by its id or by
+		// disposing of the instance
+		cancel    string
+		wantState string
+		wantError string
+	}{
+		{
+			name: "succeeded",
+			op: func(_ context.Context, progress operationProgress) error {
+				progress(1, 2, "halfway")
+				return nil
+			},
+			wantState: operationSucceeded,
+		},
+		{
+			name:      "failed",
+			op:        func(context.Context, operationProgress) error { return errors.New("disk full") },
+			wantState: operationFailed,
+			wantError: "disk full",
+		},
+		{
+			name: "cancelled",
+			op: func(ctx context.Context, _ operationProgress) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			cancel:    "id",
+			wantState: operationCancelled,
+		},
+		{
+			name: "instance disposed of",
+			op: func(ctx context.Context, _ operationProgress) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			cancel:    "instance",
+			wantState: operationCancelled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance, dispose := context.WithCancel(context.Background())
+			defer dispose()
+			ds := newOperationsDataSource(instance)
+			user := backend.WithPluginContext(context.Background(), backend.PluginContext{User: &backend.User{Login: "admin"}})
+			o, err := ds.startOperation(user, "compact", "nas", tt.op)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o.State != operationRunning || o.User != "admin" || o.Channel != "ds/homelab/operation/"+o.ID {
+				t.Errorf("started %+v, want running for admin on its channel", o)
+			}
+			switch tt.cancel {
+			case "id":
+				ds.operations.cancel(o.ID)
+			case "instance":
+				dispose()
+			}
+			o = waitOperation(t, ds, o.ID)
+			if o.State != tt.wantState || o.Error != tt.wantError || o.EndedAt == nil {
+				t.Errorf("ended %+v, want %s with error %q", o, tt.wantState, tt.wantError)
+			}
+			if tt.wantState == operationSucceeded && o.Progress != 100 {
+				t.Errorf("succeeded at %v%%, want 100", o.Progress)
+			}
+		})
+	}
+}
+
+func TestOperationProgress(t *testing.T) {
+	ds := newOperationsDataSource(context.Background())
+	step, release := make(chan struct{}), make(chan struct{})
+	o, err := ds.startOperation(context.Background(), "compact", "", func(_ context.Context, progress operationProgress) error {
+		progress(1, 4, "compacting nas")
+		close(step)
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-step
+	got, _, _ := ds.operations.get(o.ID)
+	if got.Progress != 25 || got.Message != "compacting nas" {
+		t.Errorf("progress %v%% %q, want 25%% compacting nas", got.Progress, got.Message)
+	}
+
+	// One operation of a kind and subject at a time
+	w := httptest.NewRecorder()
+	second, err := ds.startOperation(context.Background(), "compact", "", func(context.Context, operationProgress) error { return nil })
+	writeOperation(w, second, err)
+	if w.Code != http.StatusConflict {
+		t.Errorf("second compaction: got %d, want 409", w.Code)
+	}
+	other, err := ds.startOperation(context.Background(), "compact", "router", func(context.Context, operationProgress) error { return nil })
+	if err != nil {
+		t.Errorf("compaction of another subject: %v", err)
+	}
+	waitOperation(t, ds, other.ID)
+
+	// Progress is streamed until the operation ends
+	frames := make(frameSender, 4)
+	done := make(chan error, 1)
+	go func() {
+		done <- ds.runOperationStream(context.Background(), operationPathPrefix+o.ID, backend.NewStreamSender(frames))
+	}()
+	<-frames
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	var last data.Frame
+	for len(frames) > 0 {
+		if err := json.Unmarshal(<-frames, &last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if state, _ := last.Fields[2].ConcreteAt(0); state != operationSucceeded {
+		t.Errorf("last frame streamed has state %v, want %s", state, operationSucceeded)
+	}
+
+	r := resourceRequest(resourceRoute{Method: http.MethodGet, Path: "/operations/" + o.ID}, nil)
+	w = httptest.NewRecorder()
+	ds.resourceMux().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /operations/%s: got %d", o.ID, w.Code)
+	}
+}
+
+func TestOperationPrune(t *testing.T) {
+	ds := newOperationsDataSource(context.Background())
+	for range maxOperations + 5 {
+		o, err := ds.startOperation(context.Background(), "compact", "", func(context.Context, operationProgress) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitOperation(t, ds, o.ID)
+	}
+	ds.jobs.Wait()
+	if n := len(ds.operations.list()); n != maxOperations {
+		t.Errorf("kept %d finished operations, want %d", n, maxOperations)
+	}
+}
+
+// frameSender receives the frames of a stream.
+type frameSender chan json.RawMessage
+
+func (s frameSender) Send(packet *backend.StreamPacket) error {
+	s <- packet.Data
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// formatPrometheus is the format of targets that don't set one: the
+// Prometheus text exposition format.
+const formatPrometheus = "prometheus"
+
+// sampleParser parses the response of a target into samples, for devices
+// that don't speak the Prometheus format. It must not keep body, which may
+// be reused for the next scrape.
+type sampleParser func(body []byte) ([]metricSample, error)
+
+// sampleParsers are the parsers of target formats other than Prometheus, by
+// format name.
+var sampleParsers = map[string]sampleParser{}
+
+// registerParser makes targets with the given format parsed by parser.
+func registerParser(format string, parser sampleParser) {
+	sampleParsers[format] = parser
+}
+
+// parserFor returns the parser of format, or nil for the Prometheus format.
+func parserFor(format string) (sampleParser, error) {
+	if format == "" || format == formatPrometheus {
+		return nil, nil
+	}
+	parser, ok := sampleParsers[format]
+	if !ok {
+		formats := []string{formatPrometheus}
+		for name := range sampleParsers {
+			formats = append(formats, name)
+		}
+		sort.Strings(formats[1:])
+		return nil, fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(formats, ", "))
+	}
+	return parser, nil
+}
+
+func init() {
+	registerParser("keyvalue", parseKeyValue)
+}
+
+// parseKeyValue parses KEY=VALUE or KEY: VALUE lines, such as the status
+// dumps of UPSes and appliances. Blank lines and lines starting with # are
+// skipped. Numeric values, possibly followed by a unit, become samples named
+// after their sanitized key; other values become an <key>_info sample of 1
+// with the value as its "value" label. A key seen twice keeps its last value.
+func parseKeyValue(body []byte) ([]metricSample, error) {
+	var samples sampleSet
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if i <= 0 {
+			return nil, withCode(codeParseError, fmt.Errorf("line %d: expected KEY=VALUE or KEY: VALUE, got %q", n, line))
+		}
+		samples.addValue(sanitizeMetricName(line[:i]), nil, line[i+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, withCode(codeParseError, fmt.Errorf("failed to read key-value metrics: %w", err))
+	}
+	return samples.list(), nil
+}
+
+// sampleSet collects samples of text formats, keeping the last value of
+// each series in the order series first appear.
+type sampleSet struct {
+	samples []metricSample
+	index   map[string]int
+}
+
+func (s *sampleSet) add(name string, labels data.Labels, value float64) {
+	if s.index == nil {
+		s.index = map[string]int{}
+	}
+	key := name + "{" + labels.String() + "}"
+	if i, ok := s.index[key]; ok {
+		s.samples[i].Value = value
+		return
+	}
+	if labels == nil {
+		labels = data.Labels{}
+	}
+	s.index[key] = len(s.samples)
+	s.samples = append(s.samples, metricSample{
+		seriesInfo: seriesInfo{Family: name, Name: name, Labels: labels},
+		Value:      value,
+	})
+}
+
+// value returns the value of a series, if the set has it.
+func (s *sampleSet) value(name string, labels data.Labels) (float64, bool) {
+	i, ok := s.index[name+"{"+labels.String()+"}"]
+	if !ok {
+		return 0, false
+	}
+	return s.samples[i].Value, true
+}
+
+// addValue adds a value as text: a number, possibly followed by a unit, or
+// else an info sample.
+func (s *sampleSet) addValue(name string, labels data.Labels, text string) {
+	text = strings.Trim(strings.TrimSpace(text), `"'`)
+	if fields := strings.Fields(text); len(fields) > 0 {
+		if v, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			s.add(name, labels, v)
+			return
+		}
+	}
+	info := data.Labels{"value": text}
+	for k, v := range labels {
+		info[k] = v
+	}
+	s.add(name+"_info", info, 1)
+}
+
+func (s *sampleSet) list() []metricSample {
+	return s.samples
+}
+
+// sanitizeMetricName makes key a valid metric name: lower case, with
+// characters other than letters, digits and underscores replaced.
+func sanitizeMetricName(key string) string {
+	var b strings.Builder
+	for i, r := range strings.ToLower(strings.TrimSpace(key)) {
+		switch {
+		case r >= 'a' && r <= 'z', r == '_', r >= '0' && r <= '9' && i > 0:
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			b.WriteByte('_')
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
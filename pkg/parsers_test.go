@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// sampleLines returns samples as name{labels} value lines, in order.
+func sampleLines(samples []metricSample) []string {
+	lines := make([]string, len(samples))
+	for i, s := range samples {
+		lines[i] = fmt.Sprintf("%s{%s} %g", s.Name, s.Labels, s.Value)
+	}
+	return lines
+}
+
+func TestSampleParsers(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		body   string
+		want   []string
+		// wantErr is the start of the error, a parse error
+		wantErr string
+	}{
+		{
+			name:   "keyvalue",
+			format: "keyvalue",
+			body:   "# status dump\nTemperature=41.5 C\nfan speed: 1200 rpm\nMode = \"eco\"\n\n2G.clients=3\ntemperature=42\n",
+			want: []string{
+				"temperature{} 42",
+				"fan_speed{} 1200",
+				`mode_info{value=eco} 1`,
+				"_2g_clients{} 3",
+			},
+		},
+		{name: "keyvalue without separator", format: "keyvalue", body: "uptime=12\nrebooting\n", wantErr: "line 2: expected KEY=VALUE"},
+		{
+			name:   "nut upsc",
+			format: "nut",
+			body:   "battery.charge: 100\nbattery.runtime: 1860\nups.status: OL CHRG\nups.model: Back-UPS ES 700\n",
+			want: []string{
+				"nut_battery_charge{} 100",
+				"nut_battery_runtime{} 1860",
+				"nut_ups_status{flag=OL} 1",
+				"nut_ups_status{flag=CHRG} 1",
+				"nut_ups_model_info{value=Back-UPS ES 700} 1",
+			},
+		},
+		{
+			name:   "nut protocol",
+			format: "nut",
+			body:   "BEGIN LIST VAR rack\nVAR rack battery.charge \"87\"\nVAR rack ups.status \"OB LB\"\nEND LIST VAR rack\n",
+			want: []string{
+				"nut_battery_charge{ups=rack} 87",
+				"nut_ups_status{flag=OB, ups=rack} 1",
+				"nut_ups_status{flag=LB, ups=rack} 1",
+			},
+		},
+		{name: "nut truncated var", format: "nut", body: "VAR rack battery.charge\n", wantErr: "line 1: expected VAR <ups> <name>"},
+		{name: "nut without colon", format: "nut", body: "battery.charge 100\n", wantErr: "line 1: expected <name>: <value>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser, err := parserFor(tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			samples, err := parser([]byte(tt.body))
+			if tt.wantErr != "" {
+				var coded *codedError
+				if !errors.As(err, &coded) || coded.code != codeParseError || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want a parse error starting with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sampleLines(samples); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParserFor(t *testing.T) {
+	for _, format := range []string{"", formatPrometheus} {
+		if parser, err := parserFor(format); parser != nil || err != nil {
+			t.Errorf("format %q: got a parser, %v, want the Prometheus format", format, err)
+		}
+	}
+	_, err := parserFor("csv")
+	if err == nil || !strings.Contains(err.Error(), "expected one of prometheus, keyvalue, nut") {
+		t.Errorf("unknown format: got %v, want the formats listed", err)
+	}
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	tests := map[string]string{
+		"battery.charge": "battery_charge",
+		" Fan Speed ":    "fan_speed",
+		"2G.clients":     "_2g_clients",
+		"cpu0-temp":      "cpu0_temp",
+		"ÜBER":           "_ber",
+	}
+	for key, want := range tests {
+		if got := sanitizeMetricName(key); got != want {
+			t.Errorf("sanitizeMetricName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
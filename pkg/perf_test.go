@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// raceEnabled is set when the race detector, which slows everything down
+// several times over, is on.
+var raceEnabled bool
+
+// perfTestDuration is how long TestPerfBudgets runs each scenario.
+const perfTestDuration = time.Second
+
+// TestPerfBudgets fails when a scenario exceeds its budget. On hosts slower
+// than the reference hardware, scale the budgets with
+// HOMELAB_PLUGIN_PERF_SCALE rather than loosening them here.
+func TestPerfBudgets(t *testing.T) {
+	if testing.Short() || raceEnabled {
+		t.Skip("performance budgets are not checked in short mode or with the race detector")
+	}
+	scale, err := perfBudgetScale()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	env, err := newLoadEnv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.close()
+
+	for _, s := range perfScenarios {
+		t.Run(s.name, func(t *testing.T) {
+			r := runLoad(ctx, env, s, 1, perfTestDuration)
+			if r.err != nil {
+				t.Fatalf("%d of %d runs failed: %v", r.errors, r.runs, r.err)
+			}
+			if !r.withinBudget(scale) {
+				t.Errorf("p95 of %s over %d runs exceeds the budget of %s", r.p95, r.runs, time.Duration(float64(r.budget)*scale))
+			}
+		})
+	}
+}
+
+func BenchmarkPerfScenarios(b *testing.B) {
+	ctx := context.Background()
+	env, err := newLoadEnv(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer env.close()
+
+	for _, s := range perfScenarios {
+		b.Run(s.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := s.run(ctx, env); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
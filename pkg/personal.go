@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// auditKindPersonalData is the kind of audited exports and deletions of
+// personal series.
+const auditKindPersonalData = "personalData"
+
+// grafanaAdminRole is the organization role of Grafana admins.
+const grafanaAdminRole = "Admin"
+
+// personalData is the series tagged as about people, such as the presence
+// or phone battery of a member of a shared household. A person and Grafana
+// admins can export and delete that person's series. With redaction, only
+// they see them in metric queries, and the others get a notice of what was
+// left out. Queries without a user, such as those of webhooks and digests
+// sent elsewhere, see none of them, except those of alert rules, which see
+// them all.
+type personalData struct {
+	series []personalSeries
+	redact bool
+}
+
+type personalSeries struct {
+	person string
+	// target is empty for the series of all targets
+	target string
+	sel    seriesSelector
+}
+
+func newPersonalData(settings models.PersonalDataSettings, targets []*scrapeTarget) (personalData, error) {
+	p := personalData{redact: settings.Redact}
+	configured := map[string]bool{}
+	for _, t := range targets {
+		configured[t.Name] = true
+	}
+	for i, s := range settings.Series {
+		switch {
+		case s.Person == "":
+			return p, fmt.Errorf("series %d: person is not set", i)
+		case s.Metric == "" && len(s.Labels) == 0:
+			return p, fmt.Errorf("series %d: set metric, labels or both", i)
+		case s.Target != "" && !configured[s.Target]:
+			return p, fmt.Errorf("series %d: target %q is not configured", i, s.Target)
+		}
+		p.series = append(p.series, personalSeries{
+			person: s.Person,
+			target: s.Target,
+			sel:    seriesSelector{Metric: s.Metric, Labels: s.Labels},
+		})
+	}
+	return p, nil
+}
+
+// selectors returns the selectors of the series of person on target.
+func (p personalData) selectors(person string, target *scrapeTarget) []seriesSelector {
+	var sels []seriesSelector
+	for _, s := range p.series {
+		if s.person == person && (s.target == "" || s.target == target.Name) {
+			sels = append(sels, s.sel)
+		}
+	}
+	return sels
+}
+
+// persons returns the people series are tagged as about, in the order
+// they are first tagged.
+func (p personalData) persons() []string {
+	var persons []string
+	for _, s := range p.series {
+		if !slices.Contains(persons, s.person) {
+			persons = append(persons, s.person)
+		}
+	}
+	return persons
+}
+
+// isPersonal reports whether s, a series of target, is about anyone.
+func (p personalData) isPersonal(target string, s seriesInfo) bool {
+	return slices.ContainsFunc(p.series, func(ps personalSeries) bool {
+		return (ps.target == "" || ps.target == target) && ps.sel.matches(s)
+	})
+}
+
+type alertEvaluationKey struct{}
+
+// withAlertEvaluation tags ctx as running the query of an alert rule.
+func withAlertEvaluation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, alertEvaluationKey{}, true)
+}
+
+// isAlertEvaluation reports whether ctx runs the query of an alert rule.
+func isAlertEvaluation(ctx context.Context) bool {
+	evaluating, _ := ctx.Value(alertEvaluationKey{}).(bool)
+	return evaluating
+}
+
+// redactFrames removes from frames, series of history of target, those the
+// user of ctx may not read, and returns how many it removed. Without a
+// user, that is every personal series, unless ctx evaluates an alert rule.
+func (p personalData) redactFrames(ctx context.Context, target string, history *scrapeHistory, frames data.Frames) (data.Frames, int) {
+	if !p.redact || isAlertEvaluation(ctx) {
+		return frames, 0
+	}
+	login := ""
+	if user := backend.PluginConfigFromContext(ctx).User; user != nil {
+		if user.Role == grafanaAdminRole {
+			return frames, 0
+		}
+		login = user.Login
+	}
+	hidden := map[string]bool{}
+	for _, ps := range p.series {
+		if login != "" && ps.person == login || ps.target != "" && ps.target != target {
+			continue
+		}
+		for _, s := range history.seriesMatching(ps.sel) {
+			hidden[s.Name+s.Labels.String()] = true
+		}
+	}
+	if len(hidden) == 0 {
+		return frames, 0
+	}
+	n := len(frames)
+	frames = slices.DeleteFunc(frames, func(f *data.Frame) bool { return hidden[seriesKey(f.Fields[1])] })
+	return frames, n - len(frames)
+}
+
+// mayAccessPersonal reports whether the user of ctx may export and delete
+// the series of person: only person and Grafana admins may.
+func mayAccessPersonal(ctx context.Context, person string) bool {
+	user := backend.PluginConfigFromContext(ctx).User
+	return user != nil && (user.Login == person || user.Role == grafanaAdminRole)
+}
+
+// personalInfo lists the series tagged as about a person.
+type personalInfo struct {
+	Person string                  `json:"person"`
+	Series []models.PersonalSeries `json:"series"`
+}
+
+// handleListPersonal lists the people series are tagged as about, and the
+// tags of their series: all of them for Grafana admins, and their own for
+// others.
+func (ds *testDataSource) handleListPersonal(w http.ResponseWriter, r *http.Request) {
+	if ds.configErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid configuration: %w", ds.configErr))
+		return
+	}
+	persons := []personalInfo{}
+	for _, person := range ds.personal.persons() {
+		if !mayAccessPersonal(r.Context(), person) {
+			continue
+		}
+		info := personalInfo{Person: person}
+		for _, s := range ds.settings.PersonalData.Series {
+			if s.Person == person {
+				info.Series = append(info.Series, s)
+			}
+		}
+		persons = append(persons, info)
+	}
+	writeJSON(w, http.StatusOK, persons)
+}
+
+// personalExport is the export of the series of a person, at the
+// resolution they are kept at.
+type personalExport struct {
+	Person     string           `json:"person"`
+	ExportedAt time.Time        `json:"exportedAt"`
+	Series     []exportedSeries `json:"series"`
+}
+
+type exportedSeries struct {
+	Target string            `json:"target"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	// HighResolution is set for the series of high-resolution buffers
+	HighResolution bool            `json:"highResolution,omitempty"`
+	Points         []exportedPoint `json:"points"`
+}
+
+type exportedPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// accessPerson returns the person of the path of r, writing an error
+// response and returning false when the user may not access their series.
+func (ds *testDataSource) accessPerson(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if ds.configErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid configuration: %w", ds.configErr))
+		return "", false
+	}
+	person := r.PathValue("person")
+	if !mayAccessPersonal(r.Context(), person) {
+		writeJSONError(w, http.StatusForbidden, fmt.Errorf("only %s and admins can access the personal series of %s", person, person))
+		return "", false
+	}
+	if !slices.Contains(ds.personal.persons(), person) {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no series are tagged as about %q", person))
+		return "", false
+	}
+	return person, true
+}
+
+// handleExportPersonal exports all the values kept of the series of the
+// person of the path, from the history and high-resolution buffer of each
+// target.
+func (ds *testDataSource) handleExportPersonal(w http.ResponseWriter, r *http.Request) {
+	person, ok := ds.accessPerson(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	export := personalExport{Person: person, ExportedAt: now.UTC(), Series: []exportedSeries{}}
+	query := backend.DataQuery{TimeRange: backend.TimeRange{To: now}}
+	for _, target := range ds.targets {
+		for _, sel := range ds.personal.selectors(person, target) {
+			export.Series = append(export.Series, exportSeries(target.Name, target.history, sel, query, false)...)
+			if target.highRes != nil {
+				export.Series = append(export.Series, exportSeries(target.Name, target.highRes.history, sel, query, true)...)
+			}
+		}
+	}
+	ds.audit.record(r.Context(), auditKindPersonalData, fmt.Sprintf("Exported the personal series of %s", person))
+	writeJSON(w, http.StatusOK, export)
+}
+
+// exportSeries returns the series of history matching sel, over the time
+// range of query.
+func exportSeries(target string, history *scrapeHistory, sel seriesSelector, query backend.DataQuery, highRes bool) []exportedSeries {
+	frames, err := history.seriesFrames(sel, query)
+	if err != nil {
+		return nil
+	}
+	series := make([]exportedSeries, 0, len(frames))
+	for _, frame := range frames {
+		times, values := frame.Fields[0], frame.Fields[1]
+		s := exportedSeries{
+			Target:         target,
+			Name:           values.Name,
+			Labels:         values.Labels,
+			HighResolution: highRes,
+			Points:         make([]exportedPoint, values.Len()),
+		}
+		for i := range s.Points {
+			s.Points[i] = exportedPoint{Time: times.At(i).(time.Time), Value: values.At(i).(float64)}
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+// handleDeletePersonal deletes the series of the person of the path from
+// the history and high-resolution buffer of each target, which are
+// compacted by an operation after.
+func (ds *testDataSource) handleDeletePersonal(w http.ResponseWriter, r *http.Request) {
+	person, ok := ds.accessPerson(w, r)
+	if !ok {
+		return
+	}
+	type purge struct {
+		target    *scrapeTarget
+		histories []*scrapeHistory
+		sels      []seriesSelector
+	}
+	var purges []purge
+	for _, target := range ds.targets {
+		p := purge{target: target, histories: []*scrapeHistory{target.history}, sels: ds.personal.selectors(person, target)}
+		if target.highRes != nil {
+			p.histories = append(p.histories, target.highRes.history)
+		}
+		if len(p.sels) > 0 {
+			purges = append(purges, p)
+		}
+	}
+	plan := func() ([]string, int, error) {
+		var removes []string
+		for _, p := range purges {
+			for i, h := range p.histories {
+				for _, sel := range p.sels {
+					for _, s := range h.matching(sel, time.Time{}, time.Time{}) {
+						if i > 0 {
+							s = "high-resolution " + s
+						}
+						removes = append(removes, p.target.Name+" "+s)
+					}
+				}
+			}
+		}
+		return removes, 0, nil
+	}
+	ds.destructive(w, r, plan, func() error {
+		for _, p := range purges {
+			for _, h := range p.histories {
+				for _, sel := range p.sels {
+					h.purge(sel, time.Time{}, time.Time{})
+				}
+			}
+		}
+		ds.audit.record(r.Context(), auditKindPersonalData, fmt.Sprintf("Deleted the personal series of %s", person))
+		targets := make([]*scrapeTarget, len(purges))
+		for i, p := range purges {
+			targets[i] = p.target
+		}
+		ds.compactAfterPurge(r.Context(), targets)
+		return nil
+	})
+}
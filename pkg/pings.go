@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypePing = "ping"
+
+const (
+	defaultPingPeriod = 24 * time.Hour
+	defaultPingGrace  = time.Hour
+)
+
+// maxPingEvents bounds the pings kept per check.
+const maxPingEvents = 1000
+
+// maxPingBody bounds the part of a ping's body kept as its message, such as
+// the tail of a backup log.
+const maxPingBody = 10 << 10
+
+// Kinds of pings, as in the URLs Healthchecks.io takes.
+const (
+	pingKindSuccess = "success"
+	pingKindStart   = "start"
+	pingKindFail    = "fail"
+	pingKindLog     = "log"
+)
+
+var pingSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// pingStates are the states of checks: "late" once a success is overdue
+// and "down" after the grace time, or when the last run failed. Checks
+// never pinged are "new", and unknown.
+var pingStates = stateScale{
+	"up":     severityOK,
+	"late":   severityWarning,
+	"down":   severityCritical,
+	"failed": severityCritical,
+}
+
+func init() {
+	registerQueryType(queryTypePing, queryPing, pingQuery{})
+	registerConfiguredCheck(queryTypePing, func(ds *testDataSource) bool { return len(ds.settings.Pings) > 0 })
+}
+
+type pingQuery struct {
+	// Slug selects a check; empty means all of them.
+	Slug string `json:"slug"`
+	// Mode is "status" (default) for a table of the checks' states, or
+	// "freshness" for the time since their last success over the time range.
+	Mode string `json:"mode"`
+}
+
+// pingEvent is a ping received from a job.
+type pingEvent struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// ExitCode is set for pings reporting the exit code of the job
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// pingCheck is a configured check, with its period and grace time, and the
+// token of its pings.
+type pingCheck struct {
+	models.PingCheck
+	period time.Duration
+	grace  time.Duration
+	token  string
+}
+
+// newPingChecks validates the configured checks, by slug, with their tokens
+// by slug.
+func newPingChecks(configured []models.PingCheck, tokens map[string]string) (map[string]pingCheck, error) {
+	checks := make(map[string]pingCheck, len(configured))
+	for _, c := range configured {
+		if !pingSlugPattern.MatchString(c.Slug) {
+			return nil, fmt.Errorf("invalid slug %q, use lowercase letters, digits, - and _", c.Slug)
+		}
+		if _, ok := checks[c.Slug]; ok {
+			return nil, fmt.Errorf("duplicate slug %q", c.Slug)
+		}
+		check := pingCheck{PingCheck: c, period: defaultPingPeriod, grace: defaultPingGrace, token: tokens[c.Slug]}
+		if c.PeriodSeconds > 0 {
+			check.period = time.Duration(c.PeriodSeconds) * time.Second
+		}
+		if c.GraceSeconds > 0 {
+			check.grace = time.Duration(c.GraceSeconds) * time.Second
+		}
+		checks[c.Slug] = check
+	}
+	return checks, nil
+}
+
+// pingLog keeps the pings of the checks of a data source, in a file of the
+// state directory or in memory without one. Instances of a data source
+// share its log, so pings survive changes to the settings.
+type pingLog struct {
+	// path is empty when the pings are kept in memory
+	path string
+
+	mu     sync.Mutex
+	events map[string][]pingEvent
+}
+
+var pingLogs = struct {
+	mu   sync.Mutex
+	logs map[string]*pingLog
+}{logs: map[string]*pingLog{}}
+
+// pingLogFor returns the ping log of data source uid, reading it from
+// stateDir on first use.
+func pingLogFor(stateDir, uid string) *pingLog {
+	path := ""
+	if stateDir != "" {
+		path = filepath.Join(stateDir, url.PathEscape(uid), "pings.json")
+	}
+	key := path + "\x00" + uid
+
+	pingLogs.mu.Lock()
+	defer pingLogs.mu.Unlock()
+	if l, ok := pingLogs.logs[key]; ok {
+		return l
+	}
+	l := &pingLog{path: path, events: map[string][]pingEvent{}}
+	if path != "" {
+		l.load()
+	}
+	pingLogs.logs[key] = l
+	return l
+}
+
+func (l *pingLog) load() {
+	body, err := os.ReadFile(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		backend.Logger.Warn("Failed to read stored pings", "error", err)
+		return
+	}
+	if err := json.Unmarshal(body, &l.events); err != nil {
+		backend.Logger.Warn("Ignoring corrupt stored pings", "error", err)
+		l.events = map[string][]pingEvent{}
+	}
+}
+
+// save writes the pings aside and renames them, so a crash never leaves a
+// partial file. l.mu must be held.
+func (l *pingLog) save() error {
+	if l.path == "" {
+		return nil
+	}
+	body, err := json.Marshal(l.events)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(l.path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, ".pings-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
+
+func (l *pingLog) record(slug string, event pingEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := append(l.events[slug], event)
+	if len(events) > maxPingEvents {
+		events = events[len(events)-maxPingEvents:]
+	}
+	l.events[slug] = events
+	if err := l.save(); err != nil {
+		backend.Logger.Warn("Failed to store pings", "error", err)
+	}
+}
+
+// history returns the pings of a check, oldest first.
+func (l *pingLog) history(slug string) []pingEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]pingEvent(nil), l.events[slug]...)
+}
+
+// pingStatus is the state of a check at a time, from its pings.
+type pingStatus struct {
+	State       string
+	LastPing    *time.Time
+	LastSuccess *time.Time
+	// Duration is the time from the last start to the success or failure
+	// after it
+	Duration *time.Duration
+	// Due is when the next success is expected
+	Due     *time.Time
+	Message string
+}
+
+// status returns the state of check at now, given its pings.
+func (c pingCheck) status(events []pingEvent, now time.Time) pingStatus {
+	s := pingStatus{State: "new"}
+	var lastStart, lastFinish *pingEvent
+	for i := range events {
+		e := &events[i]
+		if e.Time.After(now) {
+			break
+		}
+		s.LastPing = &e.Time
+		switch e.Kind {
+		case pingKindStart:
+			lastStart = e
+		case pingKindSuccess, pingKindFail:
+			lastFinish = e
+			s.Message = e.Message
+			if e.Kind == pingKindSuccess {
+				s.LastSuccess = &e.Time
+			}
+		}
+	}
+	if lastFinish == nil {
+		return s
+	}
+	if lastStart != nil && !lastStart.Time.After(lastFinish.Time) {
+		d := lastFinish.Time.Sub(lastStart.Time)
+		s.Duration = &d
+	}
+	if lastFinish.Kind == pingKindFail {
+		s.State = "failed"
+		return s
+	}
+	due := s.LastSuccess.Add(c.period)
+	s.Due = &due
+	switch {
+	case now.Before(due):
+		s.State = "up"
+	case now.Before(due.Add(c.grace)):
+		s.State = "late"
+	default:
+		s.State = "down"
+	}
+	return s
+}
+
+// parsePingKind returns the kind of a ping from the last segment of its
+// URL: start, fail, log, or an exit code, zero meaning success.
+func parsePingKind(signal string) (string, *int, error) {
+	switch signal {
+	case "":
+		return pingKindSuccess, nil, nil
+	case pingKindStart, pingKindFail, pingKindLog:
+		return signal, nil, nil
+	}
+	code, err := strconv.Atoi(signal)
+	if err != nil || code < 0 || code > 255 {
+		return "", nil, fmt.Errorf("unknown ping %q", signal)
+	}
+	if code == 0 {
+		return pingKindSuccess, &code, nil
+	}
+	return pingKindFail, &code, nil
+}
+
+// pingToken returns the token of the pings of the check of the path, or ""
+// for none.
+func (ds *testDataSource) pingToken(r *http.Request) string {
+	return ds.pingChecks[r.PathValue("slug")].token
+}
+
+// handlePing records a ping of a check: a success, or the start, failure,
+// exit code or log line given after the slug. The request body, if any, is
+// kept as the ping's message. The metrics server serves it, to pings with
+// the check's token.
+func (ds *testDataSource) handlePing(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	if _, ok := ds.pingChecks[slug]; !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no check with slug %q", slug))
+		return
+	}
+	kind, code, err := parsePingKind(r.PathValue("signal"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPingBody))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("failed to read ping body: %w", err))
+		return
+	}
+	ds.pings.record(slug, pingEvent{Time: time.Now().UTC(), Kind: kind, ExitCode: code, Message: string(body)})
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "OK")
+}
+
+// selectPingChecks returns the check slug, or all of them, by slug.
+func (ds *testDataSource) selectPingChecks(slug string) ([]pingCheck, error) {
+	if len(ds.pingChecks) == 0 {
+		return nil, fmt.Errorf("no ping checks configured")
+	}
+	if slug != "" {
+		check, ok := ds.pingChecks[slug]
+		if !ok {
+			return nil, fmt.Errorf("no check with slug %q", slug)
+		}
+		return []pingCheck{check}, nil
+	}
+	checks := make([]pingCheck, 0, len(ds.pingChecks))
+	for _, c := range ds.pingChecks {
+		checks = append(checks, c)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Slug < checks[j].Slug })
+	return checks, nil
+}
+
+func queryPing(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q pingQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	checks, err := ds.selectPingChecks(q.Slug)
+	if err != nil {
+		return nil, err
+	}
+	switch q.Mode {
+	case "", "status":
+		return data.Frames{ds.pingStatusFrame(checks, time.Now())}, nil
+	case "freshness":
+		return ds.pingFreshnessFrames(checks, query.TimeRange, query.Interval), nil
+	}
+	return nil, fmt.Errorf("unknown mode %q", q.Mode)
+}
+
+// pingStatusFrame is the table of the checks' states at now, those needing
+// attention first.
+func (ds *testDataSource) pingStatusFrame(checks []pingCheck, now time.Time) *data.Frame {
+	type row struct {
+		check  pingCheck
+		status pingStatus
+	}
+	rows := make([]row, len(checks))
+	for i, c := range checks {
+		rows[i] = row{c, c.status(ds.pings.history(c.Slug), now)}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := pingStates.severity(rows[i].status.State), pingStates.severity(rows[j].status.State)
+		return a != nil && (b == nil || *a > *b)
+	})
+
+	statusField, severityField := newStateFields(pingStates)
+	frame := data.NewFrame("pings",
+		data.NewField("slug", nil, []string{}),
+		data.NewField("name", nil, []string{}),
+		statusField,
+		severityField,
+		data.NewField("last_ping", nil, []*time.Time{}),
+		data.NewField("last_success", nil, []*time.Time{}),
+		data.NewField("due", nil, []*time.Time{}),
+		data.NewField("duration", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("message", nil, []string{}),
+	)
+	for _, r := range rows {
+		var duration *float64
+		if r.status.Duration != nil {
+			seconds := r.status.Duration.Seconds()
+			duration = &seconds
+		}
+		frame.AppendRow(r.check.Slug, r.check.Name, r.status.State, pingStates.severity(r.status.State),
+			r.status.LastPing, r.status.LastSuccess, r.status.Due, duration, r.status.Message)
+	}
+	return frame
+}
+
+// maxFreshnessPoints bounds the points of a freshness series.
+const maxFreshnessPoints = 1000
+
+// pingFreshnessFrames returns a frame per check with the time since its last
+// success at steps of interval within tr, empty before its first success.
+func (ds *testDataSource) pingFreshnessFrames(checks []pingCheck, tr backend.TimeRange, interval time.Duration) data.Frames {
+	step := max(interval, tr.Duration()/maxFreshnessPoints, time.Second)
+	frames := make(data.Frames, 0, len(checks))
+	for _, c := range checks {
+		events := ds.pings.history(c.Slug)
+		var times []time.Time
+		var ages []*float64
+		var last *time.Time
+		next := 0
+		for t := tr.From; !t.After(tr.To); t = t.Add(step) {
+			for ; next < len(events) && !events[next].Time.After(t); next++ {
+				if events[next].Kind == pingKindSuccess {
+					last = &events[next].Time
+				}
+			}
+			times = append(times, t)
+			if last == nil {
+				ages = append(ages, nil)
+				continue
+			}
+			age := math.Max(0, t.Sub(*last).Seconds())
+			ages = append(ages, &age)
+		}
+		frame := data.NewFrame(c.Slug,
+			data.NewField("time", nil, times),
+			data.NewField("since_success", data.Labels{"slug": c.Slug}, ages).SetConfig(&data.FieldConfig{
+				Unit: "s",
+				Thresholds: &data.ThresholdsConfig{
+					Mode: data.ThresholdsModeAbsolute,
+					Steps: []data.Threshold{
+						{Value: data.ConfFloat64(math.Inf(-1)), Color: "green"},
+						{Value: data.ConfFloat64(c.period.Seconds()), Color: "orange"},
+						{Value: data.ConfFloat64((c.period + c.grace).Seconds()), Color: "red"},
+					},
+				},
+			}),
+		)
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti}
+		frames = append(frames, frame)
+	}
+	return frames
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// pipelineStage is one step of a query's post-processing pipeline. Stages
+// run in the order given, each on the series the previous one returned.
+type pipelineStage struct {
+	// Type is "filter", "rate", "delta", "aggregate", "smooth", "topk" or
+	// "preset".
+	Type string `json:"type"`
+	// Name (preset) is the pipeline preset whose stages run in its place.
+	Name string `json:"name"`
+	// Labels (filter) keeps series whose labels fully match these regexes.
+	// A missing label matches as the empty string.
+	Labels map[string]string `json:"labels"`
+	// Op (aggregate) is "sum" (default), "avg", "min", "max" or "count" over
+	// the series sharing the By labels; no By labels aggregates everything.
+	Op string   `json:"op"`
+	By []string `json:"by"`
+	// Window (smooth) is the number of points in the moving average.
+	Window int `json:"window"`
+	// K and Reducer (topk) keep the K series with the highest "last"
+	// (default), "avg" or "max" value.
+	K       int    `json:"k"`
+	Reducer string `json:"reducer"`
+}
+
+// pipelineSeries is a single time series as seen by pipeline stages. Nil
+// values are gaps.
+type pipelineSeries struct {
+	Frame string
+	// Executed is the frame's executed query string
+	Executed string
+	// Custom is the frame's custom metadata. Aggregation merges their
+	// provenance and drops anything else
+	Custom any
+	Name   string
+	Labels data.Labels
+	Config *data.FieldConfig
+	Times  []time.Time
+	Values []*float64
+}
+
+// parsePipelinePresets parses the pipeline presets of an instance. Presets
+// cannot include other presets.
+func parsePipelinePresets(raw map[string]json.RawMessage) (map[string][]pipelineStage, error) {
+	presets := make(map[string][]pipelineStage, len(raw))
+	for name, msg := range raw {
+		var stages []pipelineStage
+		if err := json.Unmarshal(msg, &stages); err != nil {
+			return nil, fmt.Errorf("invalid pipeline preset %q: %w", name, err)
+		}
+		for _, stage := range stages {
+			if stage.Type == "preset" {
+				return nil, fmt.Errorf("pipeline preset %q includes preset %q", name, stage.Name)
+			}
+		}
+		presets[name] = stages
+	}
+	return presets, nil
+}
+
+// expandPresets replaces the preset stages of a query's pipeline with the
+// stages of the presets they name.
+func (ds *testDataSource) expandPresets(stages []pipelineStage) ([]pipelineStage, error) {
+	expanded := make([]pipelineStage, 0, len(stages))
+	for _, stage := range stages {
+		if stage.Type != "preset" {
+			expanded = append(expanded, stage)
+			continue
+		}
+		preset, ok := ds.pipelines[stage.Name]
+		if !ok {
+			return nil, fmt.Errorf("pipeline preset %q is not configured", stage.Name)
+		}
+		expanded = append(expanded, preset...)
+	}
+	return expanded, nil
+}
+
+// runPipeline applies stages to the time series in frames. interval is the
+// query interval, which aggregate uses to align the series' timestamps.
+func runPipeline(frames data.Frames, stages []pipelineStage, interval time.Duration) (data.Frames, error) {
+	series, err := pipelineSeriesFromFrames(frames)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, stage := range stages {
+		switch stage.Type {
+		case "filter":
+			series, err = filterSeries(series, stage.Labels)
+		case "rate":
+			series = rateSeries(series)
+		case "delta":
+			series = deltaSeries(series)
+		case "aggregate":
+			series, err = aggregateSeries(series, stage.Op, stage.By, interval)
+		case "smooth":
+			series, err = smoothSeries(series, stage.Window)
+		case "topk":
+			series, err = topKSeries(series, stage.K, stage.Reducer)
+		default:
+			err = fmt.Errorf("unknown stage type %q", stage.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("pipeline stage %d: %w", i+1, err)
+		}
+	}
+
+	out := make(data.Frames, 0, len(series))
+	for _, s := range series {
+		out = append(out, s.frame())
+	}
+	return out, nil
+}
+
+// pipelineSeriesFromFrames splits frames into series, one per numeric field.
+// Every frame must have a time field.
+func pipelineSeriesFromFrames(frames data.Frames) ([]pipelineSeries, error) {
+	var series []pipelineSeries
+	for _, frame := range frames {
+		timeIndex := -1
+		for i, field := range frame.Fields {
+			if field.Type().Time() {
+				timeIndex = i
+				break
+			}
+		}
+		if timeIndex < 0 {
+			return nil, fmt.Errorf("pipeline needs time series, frame %q has no time field", frame.Name)
+		}
+
+		timeField := frame.Fields[timeIndex]
+		times := make([]time.Time, timeField.Len())
+		for i := range times {
+			t, ok := timeField.ConcreteAt(i)
+			if !ok {
+				return nil, fmt.Errorf("frame %q has a null time", frame.Name)
+			}
+			times[i] = t.(time.Time)
+		}
+
+		for _, field := range frame.Fields {
+			if !field.Type().Numeric() {
+				continue
+			}
+			values := make([]*float64, field.Len())
+			for i := range values {
+				v, err := field.NullableFloatAt(i)
+				if err != nil {
+					return nil, err
+				}
+				if v != nil && !math.IsNaN(*v) {
+					values[i] = v
+				}
+			}
+			var executed string
+			var custom any
+			if frame.Meta != nil {
+				executed, custom = frame.Meta.ExecutedQueryString, frame.Meta.Custom
+			}
+			series = append(series, pipelineSeries{
+				Frame:    frame.Name,
+				Executed: executed,
+				Custom:   custom,
+				Name:     field.Name,
+				Labels:   field.Labels,
+				Config:   field.Config,
+				Times:    times,
+				Values:   values,
+			})
+		}
+	}
+	return series, nil
+}
+
+func (s pipelineSeries) frame() *data.Frame {
+	frame := data.NewFrame(s.Frame,
+		data.NewField("time", nil, s.Times),
+		data.NewField(s.Name, s.Labels, s.Values).SetConfig(s.Config),
+	)
+	frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti, ExecutedQueryString: s.Executed, Custom: s.Custom}
+	return frame
+}
+
+func filterSeries(series []pipelineSeries, labels map[string]string) ([]pipelineSeries, error) {
+	patterns := make(map[string]*regexp.Regexp, len(labels))
+	for name, expr := range labels {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for label %s: %w", name, err)
+		}
+		patterns[name] = re
+	}
+
+	var kept []pipelineSeries
+	for _, s := range series {
+		match := true
+		for name, re := range patterns {
+			if !re.MatchString(s.Labels[name]) {
+				match = false
+				break
+			}
+		}
+		if match {
+			kept = append(kept, s)
+		}
+	}
+	return kept, nil
+}
+
+// functionStages translates the function of a metric query into the
+// pipeline stages computing it.
+func functionStages(function string, by []string) ([]pipelineStage, error) {
+	switch function {
+	case "rate", "delta":
+		return []pipelineStage{{Type: function}}, nil
+	case "sum", "avg", "min", "max", "count":
+		return []pipelineStage{{Type: "aggregate", Op: function, By: by}}, nil
+	}
+	return nil, fmt.Errorf("unknown function %q", function)
+}
+
+// rateSeries turns counters into per-second rates. A decrease is taken as a
+// counter reset, so the rate counts from zero instead of going negative.
+// Rates take the unit of the rate of their counters' unit.
+func rateSeries(series []pipelineSeries) []pipelineSeries {
+	rates := diffSeries(series, func(prev, cur float64, dt time.Duration) float64 {
+		delta := cur - prev
+		if delta < 0 {
+			delta = cur
+		}
+		return delta / dt.Seconds()
+	})
+	for i := range rates {
+		rates[i].Config = rateConfig(rates[i].Config)
+	}
+	return rates
+}
+
+// deltaSeries replaces each point with its change since the previous one.
+func deltaSeries(series []pipelineSeries) []pipelineSeries {
+	return diffSeries(series, func(prev, cur float64, _ time.Duration) float64 {
+		return cur - prev
+	})
+}
+
+// diffSeries computes each point but the first from it and the previous one.
+// Points next to a gap become gaps.
+func diffSeries(series []pipelineSeries, diff func(prev, cur float64, dt time.Duration) float64) []pipelineSeries {
+	out := make([]pipelineSeries, 0, len(series))
+	for _, s := range series {
+		r := s
+		r.Times, r.Values = nil, nil
+		for i := 1; i < len(s.Times); i++ {
+			prev, cur := s.Values[i-1], s.Values[i]
+			dt := s.Times[i].Sub(s.Times[i-1])
+			r.Times = append(r.Times, s.Times[i])
+			if prev == nil || cur == nil || dt <= 0 {
+				r.Values = append(r.Values, nil)
+				continue
+			}
+			v := diff(*prev, *cur, dt)
+			r.Values = append(r.Values, &v)
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// aggregateSeries combines the series sharing the by labels into one.
+// Timestamps are truncated to interval first, since series are scraped at
+// slightly different times.
+func aggregateSeries(series []pipelineSeries, op string, by []string, interval time.Duration) ([]pipelineSeries, error) {
+	var reduce func([]float64) float64
+	switch op {
+	case "", "sum":
+		reduce = func(vs []float64) float64 {
+			var sum float64
+			for _, v := range vs {
+				sum += v
+			}
+			return sum
+		}
+	case "avg":
+		reduce = func(vs []float64) float64 {
+			var sum float64
+			for _, v := range vs {
+				sum += v
+			}
+			return sum / float64(len(vs))
+		}
+	case "min":
+		reduce = func(vs []float64) float64 { return sortedCopy(vs)[0] }
+	case "max":
+		reduce = func(vs []float64) float64 { return sortedCopy(vs)[len(vs)-1] }
+	case "count":
+		reduce = func(vs []float64) float64 { return float64(len(vs)) }
+	default:
+		return nil, fmt.Errorf("unknown aggregation %q", op)
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	type group struct {
+		series pipelineSeries
+		points map[time.Time][]float64
+	}
+	var keys []string
+	groups := map[string]*group{}
+	for _, s := range series {
+		labels := data.Labels{}
+		for _, name := range by {
+			if v, ok := s.Labels[name]; ok {
+				labels[name] = v
+			}
+		}
+		key := labels.String()
+		g, ok := groups[key]
+		if !ok {
+			config := s.Config
+			// Counts of series have no unit
+			if op == "count" && config != nil {
+				unitless := *config
+				unitless.Unit = ""
+				config = &unitless
+			}
+			g = &group{
+				series: pipelineSeries{Frame: s.Frame, Executed: s.Executed, Name: s.Name, Labels: labels, Config: config},
+				points: map[time.Time][]float64{},
+			}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.series.Custom = mergeProvenance(g.series.Custom, s.Custom)
+		for i, t := range s.Times {
+			if s.Values[i] == nil {
+				continue
+			}
+			t = t.Truncate(interval)
+			g.points[t] = append(g.points[t], *s.Values[i])
+		}
+	}
+
+	out := make([]pipelineSeries, 0, len(keys))
+	for _, key := range keys {
+		g := groups[key]
+		times := make([]time.Time, 0, len(g.points))
+		for t := range g.points {
+			times = append(times, t)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+		s := g.series
+		s.Times = times
+		for _, t := range times {
+			v := reduce(g.points[t])
+			s.Values = append(s.Values, &v)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func sortedCopy(vs []float64) []float64 {
+	sorted := append([]float64{}, vs...)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+// smoothSeries replaces each point with the mean of the last window points,
+// ignoring gaps.
+func smoothSeries(series []pipelineSeries, window int) ([]pipelineSeries, error) {
+	if window < 1 {
+		return nil, fmt.Errorf("smooth needs a window of at least 1, got %d", window)
+	}
+
+	out := make([]pipelineSeries, 0, len(series))
+	for _, s := range series {
+		r := s
+		r.Values = make([]*float64, len(s.Values))
+		for i := range s.Values {
+			var sum float64
+			var n int
+			for _, v := range s.Values[max(0, i-window+1) : i+1] {
+				if v != nil {
+					sum += *v
+					n++
+				}
+			}
+			if n > 0 {
+				mean := sum / float64(n)
+				r.Values[i] = &mean
+			}
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// topKSeries keeps the k series ranking highest by reducer. Series without
+// values rank last.
+func topKSeries(series []pipelineSeries, k int, reducer string) ([]pipelineSeries, error) {
+	if k < 1 {
+		return nil, fmt.Errorf("topk needs k of at least 1, got %d", k)
+	}
+
+	var reduce func([]*float64) float64
+	switch reducer {
+	case "", "last":
+		reduce = func(vs []*float64) float64 {
+			for i := len(vs) - 1; i >= 0; i-- {
+				if vs[i] != nil {
+					return *vs[i]
+				}
+			}
+			return math.Inf(-1)
+		}
+	case "avg":
+		reduce = func(vs []*float64) float64 {
+			var sum float64
+			var n int
+			for _, v := range vs {
+				if v != nil {
+					sum += *v
+					n++
+				}
+			}
+			if n == 0 {
+				return math.Inf(-1)
+			}
+			return sum / float64(n)
+		}
+	case "max":
+		reduce = func(vs []*float64) float64 {
+			m := math.Inf(-1)
+			for _, v := range vs {
+				if v != nil {
+					m = math.Max(m, *v)
+				}
+			}
+			return m
+		}
+	default:
+		return nil, fmt.Errorf("unknown topk reducer %q", reducer)
+	}
+
+	ranks := make([]float64, len(series))
+	order := make([]int, len(series))
+	for i, s := range series {
+		ranks[i] = reduce(s.Values)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return ranks[order[a]] > ranks[order[b]] })
+
+	kept := make([]pipelineSeries, 0, min(k, len(series)))
+	for _, i := range order[:min(k, len(series))] {
+		kept = append(kept, series[i])
+	}
+	return kept, nil
+}
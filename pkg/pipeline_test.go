@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// testSeries returns a series of values 15 seconds apart from testStart,
+// NaN standing for a gap.
+func testSeries(labels data.Labels, values ...float64) pipelineSeries {
+	s := pipelineSeries{Frame: "metric", Name: "value", Labels: labels}
+	for i, v := range values {
+		s.Times = append(s.Times, testStart.Add(time.Duration(i)*15*time.Second))
+		if !math.IsNaN(v) {
+			s.Values = append(s.Values, &v)
+		} else {
+			s.Values = append(s.Values, nil)
+		}
+	}
+	return s
+}
+
+// gap stands for a gap in the values of seriesValues.
+const gap = -1
+
+// seriesValues returns the values of series.
+func seriesValues(series []pipelineSeries) [][]float64 {
+	out := make([][]float64, len(series))
+	for i, s := range series {
+		out[i] = []float64{}
+		for _, v := range s.Values {
+			if v == nil {
+				out[i] = append(out[i], gap)
+			} else {
+				out[i] = append(out[i], *v)
+			}
+		}
+	}
+	return out
+}
+
+func TestPipelineStages(t *testing.T) {
+	nan := math.NaN()
+	input := func() []pipelineSeries {
+		return []pipelineSeries{
+			testSeries(data.Labels{"target": "nas", "device": "eth0"}, 0, 150, 300, 60, 210),
+			testSeries(data.Labels{"target": "nas", "device": "eth1"}, 10, 10, nan, 40, 40),
+			testSeries(data.Labels{"target": "router", "device": "eth0"}, 1, 2, 3, 4, 5),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		stages  string
+		want    [][]float64
+		wantErr string
+	}{
+		{name: "no stages", stages: `[]`, want: [][]float64{{0, 150, 300, 60, 210}, {10, 10, gap, 40, 40}, {1, 2, 3, 4, 5}}},
+		{name: "filter", stages: `[{"type": "filter", "labels": {"target": "nas", "device": "eth.*"}}]`, want: [][]float64{{0, 150, 300, 60, 210}, {10, 10, gap, 40, 40}}},
+		{name: "filter on a missing label", stages: `[{"type": "filter", "labels": {"room": ""}}]`, want: [][]float64{{0, 150, 300, 60, 210}, {10, 10, gap, 40, 40}, {1, 2, 3, 4, 5}}},
+		// The drop from 300 to 60 is a counter reset
+		{name: "rate", stages: `[{"type": "filter", "labels": {"device": "eth0", "target": "nas"}}, {"type": "rate"}]`, want: [][]float64{{10, 10, 4, 10}}},
+		{name: "rate around a gap", stages: `[{"type": "filter", "labels": {"device": "eth1"}}, {"type": "rate"}]`, want: [][]float64{{0, gap, gap, 0}}},
+		{name: "delta", stages: `[{"type": "filter", "labels": {"target": "router"}}, {"type": "delta"}]`, want: [][]float64{{1, 1, 1, 1}}},
+		{name: "sum", stages: `[{"type": "aggregate"}]`, want: [][]float64{{11, 162, 303, 104, 255}}},
+		{name: "avg by target", stages: `[{"type": "aggregate", "op": "avg", "by": ["target"]}]`, want: [][]float64{{5, 80, 300, 50, 125}, {1, 2, 3, 4, 5}}},
+		{name: "min", stages: `[{"type": "aggregate", "op": "min"}]`, want: [][]float64{{0, 2, 3, 4, 5}}},
+		{name: "max by device", stages: `[{"type": "aggregate", "op": "max", "by": ["device"]}]`, want: [][]float64{{1, 150, 300, 60, 210}, {10, 10, 40, 40}}},
+		{name: "count", stages: `[{"type": "aggregate", "op": "count"}]`, want: [][]float64{{3, 3, 2, 3, 3}}},
+		{name: "smooth", stages: `[{"type": "filter", "labels": {"device": "eth1"}}, {"type": "smooth", "window": 2}]`, want: [][]float64{{10, 10, 10, 40, 40}}},
+		{name: "topk last", stages: `[{"type": "topk", "k": 1}]`, want: [][]float64{{0, 150, 300, 60, 210}}},
+		{name: "topk avg", stages: `[{"type": "topk", "k": 2, "reducer": "avg"}]`, want: [][]float64{{0, 150, 300, 60, 210}, {10, 10, gap, 40, 40}}},
+		{name: "topk more than there are", stages: `[{"type": "topk", "k": 5, "reducer": "max"}]`, want: [][]float64{{0, 150, 300, 60, 210}, {10, 10, gap, 40, 40}, {1, 2, 3, 4, 5}}},
+		{name: "chained", stages: `[{"type": "rate"}, {"type": "aggregate", "op": "max", "by": ["target"]}, {"type": "topk", "k": 1}]`, want: [][]float64{{10, 10, 4, 10}}},
+
+		{name: "unknown stage", stages: `[{"type": "filter"}, {"type": "quantile"}]`, wantErr: `pipeline stage 2: unknown stage type "quantile"`},
+		{name: "invalid regex", stages: `[{"type": "filter", "labels": {"device": "eth("}}]`, wantErr: "invalid regex for label device"},
+		{name: "unknown aggregation", stages: `[{"type": "aggregate", "op": "median"}]`, wantErr: `unknown aggregation "median"`},
+		{name: "smooth without window", stages: `[{"type": "smooth"}]`, wantErr: "smooth needs a window of at least 1"},
+		{name: "topk without k", stages: `[{"type": "topk"}]`, wantErr: "topk needs k of at least 1"},
+		{name: "unknown reducer", stages: `[{"type": "topk", "k": 1, "reducer": "first"}]`, wantErr: `unknown topk reducer "first"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stages []pipelineStage
+			if err := json.Unmarshal([]byte(tt.stages), &stages); err != nil {
+				t.Fatal(err)
+			}
+			var frames data.Frames
+			for _, s := range input() {
+				frames = append(frames, s.frame())
+			}
+			out, err := runPipeline(frames, stages, 15*time.Second)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			series, err := pipelineSeriesFromFrames(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := seriesValues(series)
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipelineRateUnit(t *testing.T) {
+	s := testSeries(data.Labels{}, 0, 1500, 3000)
+	s.Config = &data.FieldConfig{Unit: "bytes"}
+	rates := rateSeries([]pipelineSeries{s})
+	if rates[0].Config == nil || rates[0].Config.Unit != "Bps" {
+		t.Errorf("rate of bytes has config %+v, want unit Bps", rates[0].Config)
+	}
+
+	counts, err := aggregateSeries([]pipelineSeries{s}, "count", nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[0].Config.Unit != "" || s.Config.Unit != "bytes" {
+		t.Errorf("count has unit %q and its input %q, want none and bytes", counts[0].Config.Unit, s.Config.Unit)
+	}
+}
+
+func TestPipelineNeedsTimeSeries(t *testing.T) {
+	frame := data.NewFrame("table", data.NewField("value", nil, []float64{1}))
+	if _, err := runPipeline(data.Frames{frame}, []pipelineStage{{Type: "delta"}}, time.Minute); err == nil {
+		t.Error("pipeline ran on a frame without time field")
+	}
+}
+
+func TestPipelinePresets(t *testing.T) {
+	presets, err := parsePipelinePresets(map[string]json.RawMessage{
+		"traffic": json.RawMessage(`[{"type": "rate"}, {"type": "topk", "k": 3}]`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := &testDataSource{pipelines: presets}
+
+	stages, err := ds.expandPresets([]pipelineStage{{Type: "filter"}, {Type: "preset", Name: "traffic"}, {Type: "smooth", Window: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, s := range stages {
+		types = append(types, s.Type)
+	}
+	if want := []string{"filter", "rate", "topk", "smooth"}; !slices.Equal(types, want) {
+		t.Errorf("expanded to %v, want %v", types, want)
+	}
+
+	if _, err := ds.expandPresets([]pipelineStage{{Type: "preset", Name: "storage"}}); err == nil {
+		t.Error("unknown preset expanded")
+	}
+	if _, err := parsePipelinePresets(map[string]json.RawMessage{"nested": json.RawMessage(`[{"type": "preset", "name": "traffic"}]`)}); err == nil {
+		t.Error("preset including a preset parsed")
+	}
+	if _, err := parsePipelinePresets(map[string]json.RawMessage{"broken": json.RawMessage(`{"type": "rate"}`)}); err == nil {
+		t.Error("preset that isn't an array parsed")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypePower = "power"
+
+// powerGapIntervals is how many scrape intervals without a scrape of any
+// target count as the lab going dark.
+const powerGapIntervals = 4
+
+// powerCorrelationWindow is how close power events must be to count as the
+// same outage.
+const powerCorrelationWindow = 5 * time.Minute
+
+// Kinds of power events.
+const (
+	powerOnBattery  = "on battery"
+	powerLowBattery = "low battery"
+	powerReboot     = "reboot"
+	powerSilence    = "silence"
+)
+
+func init() {
+	registerQueryType(queryTypePower, queryPower, powerQuery{})
+}
+
+type powerQuery struct {
+	// Target selects targets as in metric queries; empty means all of them.
+	Target string `json:"target"`
+	// Mode is "events" (default) for power event annotations, or "outages"
+	// for a table of outages, each grouping the events around it.
+	Mode string `json:"mode"`
+}
+
+// powerEvent is a period a UPS ran on battery or was low on it, a host was
+// down until it booted again, or no target was scraped.
+type powerEvent struct {
+	Start time.Time
+	End   time.Time
+	// Ongoing events end at the last scrape
+	Ongoing bool
+	Kind    string
+	Source  string
+}
+
+func (e powerEvent) text() string {
+	var text string
+	switch e.Kind {
+	case powerOnBattery:
+		text = e.Source + " ran on battery"
+	case powerLowBattery:
+		text = e.Source + " was low on battery"
+	case powerReboot:
+		text = e.Source + " rebooted"
+	case powerSilence:
+		text = "No target was scraped"
+	}
+	if e.Ongoing {
+		return text + " (ongoing)"
+	}
+	return text
+}
+
+// powerEvents replays the history of target for its power events: those of
+// the UPSes in nut_ups_status, as the nut format parses them, and reboots,
+// seen as node_boot_time_seconds moving forward. It also returns the times
+// of the scrapes.
+func (h *scrapeHistory) powerEvents(target string) ([]powerEvent, []time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// UPS flags by UPS, and boot time series
+	flags := map[string]map[string]int{}
+	var boots []int
+	for i, s := range h.series {
+		switch s.Name {
+		case "nut_ups_status":
+			ups := target
+			if name := s.Labels["ups"]; name != "" {
+				ups += "/" + name
+			}
+			if flags[ups] == nil {
+				flags[ups] = map[string]int{}
+			}
+			flags[ups][s.Labels["flag"]] = i
+		case "node_boot_time_seconds":
+			boots = append(boots, i)
+		}
+	}
+
+	var events []powerEvent
+	open := map[string]*powerEvent{}
+	toggle := func(key, kind, source string, on bool, t time.Time) {
+		switch e := open[key]; {
+		case on && e == nil:
+			open[key] = &powerEvent{Start: t, Kind: kind, Source: source}
+		case !on && e != nil:
+			e.End = t
+			events = append(events, *e)
+			delete(open, key)
+		}
+	}
+
+	current := append([]float64(nil), h.base...)
+	lastBoot := make([]float64, len(boots))
+	for j, i := range boots {
+		lastBoot[j] = current[i]
+	}
+	times := make([]time.Time, 0, len(h.scrapes))
+	var prev time.Time
+	for _, s := range h.scrapes {
+		for _, c := range s.Changes {
+			current[c.Series] = c.Value
+		}
+		for ups, byFlag := range flags {
+			set := func(flag string) bool {
+				i, ok := byFlag[flag]
+				return ok && !math.IsNaN(current[i])
+			}
+			toggle(ups+"\x00OB", powerOnBattery, ups, set("OB"), s.Time)
+			toggle(ups+"\x00LB", powerLowBattery, ups, set("LB"), s.Time)
+		}
+		for j, i := range boots {
+			boot := current[i]
+			if math.IsNaN(boot) {
+				continue
+			}
+			// Boot times drift by a second or so as clocks are adjusted
+			if !math.IsNaN(lastBoot[j]) && boot > lastBoot[j]+60 && !prev.IsZero() {
+				up := time.Unix(int64(boot), 0)
+				down := prev
+				if up.Before(down) {
+					down = up
+				}
+				events = append(events, powerEvent{Start: down, End: up, Kind: powerReboot, Source: target})
+			}
+			lastBoot[j] = boot
+		}
+		times = append(times, s.Time)
+		prev = s.Time
+	}
+	for _, e := range open {
+		e.End, e.Ongoing = prev, true
+		events = append(events, *e)
+	}
+	return events, times
+}
+
+// silences returns the periods longer than gap in which none of the scrapes
+// of all targets happened.
+func silences(scrapes []time.Time, gap time.Duration) []powerEvent {
+	sort.Slice(scrapes, func(i, j int) bool { return scrapes[i].Before(scrapes[j]) })
+	var events []powerEvent
+	for i := 1; i < len(scrapes); i++ {
+		if scrapes[i].Sub(scrapes[i-1]) > gap {
+			events = append(events, powerEvent{Start: scrapes[i-1], End: scrapes[i], Kind: powerSilence, Source: "all targets"})
+		}
+	}
+	return events
+}
+
+// powerOutage groups power events that overlap or are within
+// powerCorrelationWindow of each other.
+type powerOutage struct {
+	Start   time.Time
+	End     time.Time
+	Ongoing bool
+	Events  []powerEvent
+}
+
+func correlateOutages(events []powerEvent) []powerOutage {
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	var outages []powerOutage
+	for _, e := range events {
+		if n := len(outages); n > 0 && !e.Start.After(outages[n-1].End.Add(powerCorrelationWindow)) {
+			o := &outages[n-1]
+			if e.End.After(o.End) {
+				o.End = e.End
+			}
+			o.Ongoing = o.Ongoing || e.Ongoing
+			o.Events = append(o.Events, e)
+			continue
+		}
+		outages = append(outages, powerOutage{Start: e.Start, End: e.End, Ongoing: e.Ongoing, Events: []powerEvent{e}})
+	}
+	return outages
+}
+
+func queryPower(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q powerQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	name := q.Target
+	if name == "" {
+		name = allTargets
+	}
+	targets, err := ds.selectTargets(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []powerEvent
+	var scrapes []time.Time
+	for _, target := range targets {
+		targetEvents, times := target.history.powerEvents(target.Name)
+		events = append(events, targetEvents...)
+		scrapes = append(scrapes, times...)
+	}
+	events = append(events, silences(scrapes, powerGapIntervals*ds.scrapeInterval())...)
+
+	tr := query.TimeRange
+	within := func(start, end time.Time) bool { return !end.Before(tr.From) && !start.After(tr.To) }
+	if q.Mode == "outages" {
+		var outages []powerOutage
+		for _, o := range correlateOutages(events) {
+			if within(o.Start, o.End) {
+				outages = append(outages, o)
+			}
+		}
+		return data.Frames{powerOutageFrame(outages)}, nil
+	}
+
+	var selected []powerEvent
+	for _, e := range events {
+		if within(e.Start, e.End) {
+			selected = append(selected, e)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Start.Before(selected[j].Start) })
+	return data.Frames{powerEventFrame(selected)}, nil
+}
+
+// powerEventFrame returns power events in annotation shape, as regions.
+func powerEventFrame(events []powerEvent) *data.Frame {
+	frame := data.NewFrame("power events",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("timeEnd", nil, []time.Time{}),
+		data.NewField("text", nil, []string{}),
+		data.NewField("tags", nil, []string{}),
+		data.NewField("kind", nil, []string{}),
+		data.NewField("source", nil, []string{}),
+	)
+	for _, e := range events {
+		frame.AppendRow(e.Start, e.End, e.text(), "power,"+e.Kind, e.Kind, e.Source)
+	}
+	return frame
+}
+
+// powerOutageFrame returns a row per outage, with its duration and what
+// happened during it.
+func powerOutageFrame(outages []powerOutage) *data.Frame {
+	frame := data.NewFrame("outages",
+		data.NewField("start", nil, []time.Time{}),
+		data.NewField("end", nil, []time.Time{}),
+		data.NewField("duration", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("ongoing", nil, []bool{}),
+		data.NewField("events", nil, []int64{}),
+		data.NewField("description", nil, []string{}),
+	)
+	for _, o := range outages {
+		texts := make([]string, 0, len(o.Events))
+		for _, e := range o.Events {
+			texts = append(texts, e.text())
+		}
+		frame.AppendRow(o.Start, o.End, o.End.Sub(o.Start).Seconds(), o.Ongoing, int64(len(o.Events)), strings.Join(texts, "; "))
+	}
+	return frame
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypePowerSchedule = "powerschedule"
+
+const (
+	defaultWakeBroadcast = "255.255.255.255:9"
+	// powerGuardRetry is how often a suspend the guards held back is tried
+	// again, until the host is due to wake
+	powerGuardRetry = 5 * time.Minute
+	// powerSuspendDelay lets the SSH session that suspends a host end
+	// before the host suspends
+	powerSuspendDelay = 2
+	// powerEstimateDays is how far ahead schedules are played to estimate
+	// how long hosts sleep a day
+	powerEstimateDays = 7
+)
+
+// maxPowerActions bounds the actions kept per schedule.
+const maxPowerActions = 500
+
+// validGuardProcess keeps guard process names safe to quote for a remote
+// shell.
+var validGuardProcess = regexp.MustCompile(`^[A-Za-z0-9 ._-]+$`)
+
+// Kinds of power actions.
+const (
+	powerSuspended = "suspended"
+	powerWoken     = "woken"
+	powerHeld      = "held"
+	powerFailed    = "failed"
+)
+
+func init() {
+	registerQueryType(queryTypePowerSchedule, queryPowerSchedule, powerScheduleQuery{})
+	registerConfiguredCheck(queryTypePowerSchedule, func(ds *testDataSource) bool { return len(ds.powerSchedules) > 0 })
+}
+
+type powerScheduleQuery struct {
+	// Schedule selects a schedule by name; empty means all of them.
+	Schedule string `json:"schedule"`
+	// Mode is "schedule" (default) for a row per schedule with its next
+	// actions and estimated savings, or "annotations" for the periods hosts
+	// slept and the suspends the guards held back.
+	Mode string `json:"mode"`
+}
+
+// powerAction is a suspend or wake of a host, or a suspend that was held
+// back or failed.
+type powerAction struct {
+	Time   time.Time
+	Kind   string
+	Detail string
+}
+
+// powerSchedule is a configured power schedule, parsed, and what it did.
+type powerSchedule struct {
+	models.PowerSchedule
+	suspend cronSchedule
+	wake    cronSchedule
+	mac     net.HardwareAddr
+
+	mu      sync.Mutex
+	asleep  bool
+	actions []powerAction
+}
+
+func newPowerSchedules(configured []models.PowerSchedule, sshHosts []string) ([]*powerSchedule, error) {
+	var schedules []*powerSchedule
+	seen := map[string]bool{}
+	for _, c := range configured {
+		switch {
+		case c.Name == "":
+			return nil, fmt.Errorf("schedule of %q has no name", c.Host)
+		case seen[c.Name]:
+			return nil, fmt.Errorf("duplicate schedule name %q", c.Name)
+		case !slices.Contains(sshHosts, c.Host):
+			return nil, fmt.Errorf("schedule %s: SSH host %q is not configured", c.Name, c.Host)
+		}
+		seen[c.Name] = true
+		s := &powerSchedule{PowerSchedule: c}
+		var err error
+		if s.suspend, err = parseCron(c.Suspend); err != nil {
+			return nil, fmt.Errorf("schedule %s: suspend: %w", c.Name, err)
+		}
+		if s.wake, err = parseCron(c.Wake); err != nil {
+			return nil, fmt.Errorf("schedule %s: wake: %w", c.Name, err)
+		}
+		switch c.WakeMethod {
+		case "", "rtcwake":
+			s.WakeMethod = "rtcwake"
+		case "wol":
+			if s.mac, err = net.ParseMAC(c.MAC); err != nil {
+				return nil, fmt.Errorf("schedule %s: invalid MAC %q", c.Name, c.MAC)
+			}
+			if s.Broadcast == "" {
+				s.Broadcast = defaultWakeBroadcast
+			}
+			if _, _, err := net.SplitHostPort(s.Broadcast); err != nil {
+				return nil, fmt.Errorf("schedule %s: invalid broadcast %q, expected address:port", c.Name, s.Broadcast)
+			}
+		default:
+			return nil, fmt.Errorf("schedule %s: unknown wake method %q, expected rtcwake or wol", c.Name, c.WakeMethod)
+		}
+		for _, p := range c.GuardProcesses {
+			if !validGuardProcess.MatchString(p) {
+				return nil, fmt.Errorf("schedule %s: invalid guard process %q", c.Name, p)
+			}
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+func (s *powerSchedule) record(a powerAction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch a.Kind {
+	case powerSuspended:
+		s.asleep = true
+	case powerWoken:
+		s.asleep = false
+	}
+	s.actions = append(s.actions, a)
+	if len(s.actions) > maxPowerActions {
+		s.actions = s.actions[len(s.actions)-maxPowerActions:]
+	}
+}
+
+// sleepPerDay plays the schedule over the days after now, and returns how
+// long the host sleeps a day on average.
+func (s *powerSchedule) sleepPerDay(now time.Time) time.Duration {
+	end := now.AddDate(0, 0, powerEstimateDays)
+	var asleep time.Duration
+	for t := now; t.Before(end); {
+		suspend := s.suspend.next(t)
+		if suspend.IsZero() || !suspend.Before(end) {
+			break
+		}
+		wake := s.wake.next(suspend)
+		if wake.IsZero() || wake.After(end) {
+			wake = end
+		}
+		asleep += wake.Sub(suspend)
+		t = wake
+	}
+	return asleep / powerEstimateDays
+}
+
+// runningGuards returns the guard processes running on the host.
+func (ds *testDataSource) runningGuards(ctx context.Context, s *powerSchedule) ([]string, error) {
+	if len(s.GuardProcesses) == 0 {
+		return nil, nil
+	}
+	quoted := make([]string, len(s.GuardProcesses))
+	for i, p := range s.GuardProcesses {
+		quoted[i] = "'" + p + "'"
+	}
+	cmd := "for p in " + strings.Join(quoted, " ") + `; do pgrep -x "$p" >/dev/null && echo "$p"; done; true`
+	raw, err := ds.runRemoteCommand(ctx, s.Host, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var running []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			running = append(running, line)
+		}
+	}
+	return running, nil
+}
+
+// suspendHost suspends the host of s unless a guard process runs, setting
+// its RTC alarm to wake first when it wakes by it. It reports whether the
+// host was suspended.
+func (ds *testDataSource) suspendHost(ctx context.Context, s *powerSchedule, wake time.Time) (bool, error) {
+	guards, err := ds.runningGuards(ctx, s)
+	if err != nil {
+		s.record(powerAction{Time: time.Now(), Kind: powerFailed, Detail: "suspend failed: " + err.Error()})
+		return false, err
+	}
+	if len(guards) > 0 {
+		s.record(powerAction{Time: time.Now(), Kind: powerHeld, Detail: "suspend held back by " + strings.Join(guards, ", ")})
+		return false, nil
+	}
+	// systemd-run suspends the host once the session ended
+	cmd := "sudo -n systemd-run --on-active=" + strconv.Itoa(powerSuspendDelay) + " systemctl suspend"
+	if s.WakeMethod == "rtcwake" {
+		cmd = "sudo -n rtcwake -m no -t " + strconv.FormatInt(wake.Unix(), 10) + " && " + cmd
+	}
+	if _, err := ds.runRemoteCommand(ctx, s.Host, cmd); err != nil {
+		s.record(powerAction{Time: time.Now(), Kind: powerFailed, Detail: "suspend failed: " + err.Error()})
+		return false, err
+	}
+	s.record(powerAction{Time: time.Now(), Kind: powerSuspended, Detail: "until " + wake.Format(time.RFC3339)})
+	return true, nil
+}
+
+// magicPacket is the Wake-on-LAN packet of mac: six 0xff bytes and then
+// mac sixteen times.
+func magicPacket(mac net.HardwareAddr) []byte {
+	packet := bytes.Repeat([]byte{0xff}, 6)
+	for range 16 {
+		packet = append(packet, mac...)
+	}
+	return packet
+}
+
+// wakeHost wakes the host of s with a Wake-on-LAN packet, or records that
+// its RTC alarm wakes it.
+func (ds *testDataSource) wakeHost(ctx context.Context, s *powerSchedule) error {
+	if s.WakeMethod == "rtcwake" {
+		s.record(powerAction{Time: time.Now(), Kind: powerWoken, Detail: "RTC alarm"})
+		return nil
+	}
+	conn, err := ds.egress.dialContext(ctx, "udp", s.Broadcast)
+	if err == nil {
+		_, err = conn.Write(magicPacket(s.mac))
+		conn.Close()
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to send Wake-on-LAN packet to %s: %w", s.Broadcast, err)
+		s.record(powerAction{Time: time.Now(), Kind: powerFailed, Detail: err.Error()})
+		return err
+	}
+	s.record(powerAction{Time: time.Now(), Kind: powerWoken, Detail: "Wake-on-LAN to " + s.mac.String()})
+	return nil
+}
+
+// runPowerSchedule suspends and wakes the host of s on its schedule, until
+// the instance is disposed of. Suspends the guards hold back are tried
+// again until the host is due to wake.
+func (ds *testDataSource) runPowerSchedule(ctx context.Context, s *powerSchedule) {
+	now := time.Now()
+	suspendAt, wakeAt := s.suspend.next(now), s.wake.next(now)
+	if suspendAt.IsZero() || wakeAt.IsZero() {
+		backend.Logger.Warn("Power schedule never runs", "schedule", s.Name)
+		return
+	}
+	job := ds.schedule.add("power", s.Name, 0, suspendAt)
+	for {
+		at, waking := suspendAt, false
+		if wakeAt.Before(suspendAt) {
+			at, waking = wakeAt, true
+		}
+		job.plan(at)
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		if waking {
+			job.run(func() error { return ds.wakeHost(ctx, s) })
+			wakeAt = s.wake.next(now)
+			continue
+		}
+		var suspended bool
+		job.run(func() error {
+			var err error
+			suspended, err = ds.suspendHost(ctx, s, wakeAt)
+			return err
+		})
+		suspendAt = s.suspend.next(now)
+		if !suspended {
+			if retry := now.Add(powerGuardRetry); retry.Before(wakeAt) && retry.Before(suspendAt) {
+				suspendAt = retry
+			}
+		}
+	}
+}
+
+func queryPowerSchedule(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q powerScheduleQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	var schedules []*powerSchedule
+	for _, s := range ds.powerSchedules {
+		if q.Schedule == "" || s.Name == q.Schedule {
+			schedules = append(schedules, s)
+		}
+	}
+	if len(schedules) == 0 {
+		return nil, fmt.Errorf("no power schedule %q configured", q.Schedule)
+	}
+	switch q.Mode {
+	case "", "schedule":
+		return data.Frames{powerScheduleFrame(schedules, time.Now())}, nil
+	case "annotations":
+		return data.Frames{powerActionFrame(schedules, query.TimeRange, time.Now())}, nil
+	default:
+		return nil, fmt.Errorf("unknown powerschedule mode %q", q.Mode)
+	}
+}
+
+// powerScheduleFrame returns a row per schedule: its host's state, its
+// next actions, its last action and what sleeping saves.
+func powerScheduleFrame(schedules []*powerSchedule, now time.Time) *data.Frame {
+	frame := data.NewFrame("power schedules",
+		data.NewField("schedule", nil, []string{}),
+		data.NewField("host", nil, []string{}),
+		data.NewField("state", nil, []string{}),
+		data.NewField("next_suspend", nil, []*time.Time{}),
+		data.NewField("next_wake", nil, []*time.Time{}),
+		data.NewField("sleep_per_day", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "h"}),
+		data.NewField("saved_per_day", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "kwatth"}),
+		data.NewField("saved_per_month", nil, []*float64{}),
+		data.NewField("last_action", nil, []string{}),
+		data.NewField("last_action_time", nil, []*time.Time{}),
+	)
+	for _, s := range schedules {
+		s.mu.Lock()
+		state := "awake"
+		if s.asleep {
+			state = "asleep"
+		}
+		var lastAction string
+		var lastTime *time.Time
+		if n := len(s.actions); n > 0 {
+			a := s.actions[n-1]
+			lastAction, lastTime = a.Kind, &a.Time
+			if a.Detail != "" {
+				lastAction += ": " + a.Detail
+			}
+		}
+		s.mu.Unlock()
+
+		next := func(c cronSchedule) *time.Time {
+			if t := c.next(now); !t.IsZero() {
+				return &t
+			}
+			return nil
+		}
+		hours := s.sleepPerDay(now).Hours()
+		kWh := max(s.AwakeWatts-s.AsleepWatts, 0) * hours / 1000
+		var cost *float64
+		if s.PricePerKWh > 0 {
+			c := kWh * 30 * s.PricePerKWh
+			cost = &c
+		}
+		frame.AppendRow(s.Name, s.Host, state, next(s.suspend), next(s.wake), hours, kWh, cost, lastAction, lastTime)
+	}
+	// Schedules may be priced in different currencies
+	if len(schedules) == 1 {
+		frame.Fields[7].SetConfig(&data.FieldConfig{Unit: currencyUnit(schedules[0].Currency)})
+	}
+	return frame
+}
+
+// powerActionFrame returns, in annotation shape, the periods hosts slept
+// as regions, until now for hosts still asleep, and the suspends held back
+// or failed as points.
+func powerActionFrame(schedules []*powerSchedule, tr backend.TimeRange, now time.Time) *data.Frame {
+	frame := data.NewFrame("power actions",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("timeEnd", nil, []time.Time{}),
+		data.NewField("text", nil, []string{}),
+		data.NewField("tags", nil, []string{}),
+		data.NewField("schedule", nil, []string{}),
+	)
+	within := func(start, end time.Time) bool { return !end.Before(tr.From) && !start.After(tr.To) }
+	for _, s := range schedules {
+		s.mu.Lock()
+		var sleeping *powerAction
+		for _, a := range s.actions {
+			switch a.Kind {
+			case powerSuspended:
+				sleeping = &a
+			case powerWoken:
+				if sleeping != nil && within(sleeping.Time, a.Time) {
+					frame.AppendRow(sleeping.Time, a.Time, s.Host+" slept", "power,asleep", s.Name)
+				}
+				sleeping = nil
+			default:
+				if within(a.Time, a.Time) {
+					frame.AppendRow(a.Time, a.Time, s.Host+": "+a.Detail, "power,"+a.Kind, s.Name)
+				}
+			}
+		}
+		if sleeping != nil && within(sleeping.Time, now) {
+			frame.AppendRow(sleeping.Time, now, s.Host+" sleeps (ongoing)", "power,asleep", s.Name)
+		}
+		s.mu.Unlock()
+	}
+	return frame
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeProbe = "probe"
+
+const (
+	defaultProbeInterval = time.Minute
+	probeTimeout         = 10 * time.Second
+)
+
+// maxProbeResults bounds the results kept per target and vantage point, a
+// day at the default interval.
+const maxProbeResults = 1440
+
+// Vantage points probes are run from.
+const (
+	vantageInside  = "inside"
+	vantageOutside = "outside"
+)
+
+func init() {
+	registerQueryType(queryTypeProbe, queryProbe, probeQuery{})
+	registerConfiguredCheck(queryTypeProbe, func(ds *testDataSource) bool { return len(ds.settings.Probes.Targets) > 0 })
+}
+
+type probeQuery struct {
+	// Target selects a configured target by name; empty means all of them.
+	Target string `json:"target"`
+	// Mode is "availability" (default) for a summary over the time range,
+	// "timeline" for up/down time series, "heatmap" for latency buckets or
+	// "phases" for the phases of HTTP probes from inside as time series.
+	Mode string `json:"mode"`
+	// Buckets are the heatmap's latency bucket upper bounds in milliseconds.
+	Buckets []float64 `json:"buckets"`
+}
+
+// defaultLatencyBuckets are the heatmap bucket upper bounds in milliseconds.
+var defaultLatencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// frameTypeHeatmapRows is understood by Grafana's heatmap panel: a time field
+// followed by one count field per bucket, named by its upper bound.
+const frameTypeHeatmapRows data.FrameType = "heatmap-rows"
+
+type probeResult struct {
+	Time    time.Time
+	Target  string
+	Vantage string
+	// Family is the IP family the probe was restricted to, if any
+	Family  string
+	Up      bool
+	Latency time.Duration
+	Error   string
+	// Phases are set for HTTP probes from inside
+	Phases probePhases
+}
+
+// probePhases break the latency of an HTTP probe down: resolving the host,
+// connecting, the TLS handshake, waiting for the first byte of the response
+// once the request is sent, and reading the rest of it. Phases that didn't
+// happen, such as DNS for addresses, are zero.
+type probePhases struct {
+	DNS      time.Duration
+	Connect  time.Duration
+	TLS      time.Duration
+	TTFB     time.Duration
+	Transfer time.Duration
+}
+
+// probePhaseNames name the phases in frames, in the order they happen.
+var probePhaseNames = []string{"dns", "connect", "tls", "ttfb", "transfer"}
+
+func (p probePhases) durations() []time.Duration {
+	return []time.Duration{p.DNS, p.Connect, p.TLS, p.TTFB, p.Transfer}
+}
+
+// maxProbeBody bounds the response bodies probes read, to time the transfer.
+const maxProbeBody = 10 << 20
+
+// phaseTrace times the phases of a request. Connections may be dialed in
+// parallel, so its hooks lock.
+type phaseTrace struct {
+	mu                                      sync.Mutex
+	dnsStart, connectStart, tlsStart, wrote time.Time
+	firstByte                               time.Time
+	phases                                  probePhases
+}
+
+func (t *phaseTrace) clientTrace() *httptrace.ClientTrace {
+	at := func(f func(now time.Time)) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		f(time.Now())
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { at(func(now time.Time) { t.dnsStart = now }) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { at(func(now time.Time) { t.phases.DNS = now.Sub(t.dnsStart) }) },
+		ConnectStart: func(string, string) {
+			at(func(now time.Time) {
+				if t.connectStart.IsZero() {
+					t.connectStart = now
+				}
+			})
+		},
+		ConnectDone: func(_, _ string, err error) {
+			at(func(now time.Time) {
+				if err == nil && t.phases.Connect == 0 {
+					t.phases.Connect = now.Sub(t.connectStart)
+				}
+			})
+		},
+		TLSHandshakeStart: func() { at(func(now time.Time) { t.tlsStart = now }) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			at(func(now time.Time) { t.phases.TLS = now.Sub(t.tlsStart) })
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { at(func(now time.Time) { t.wrote = now }) },
+		GotFirstResponseByte: func() { at(func(now time.Time) { t.firstByte = now; t.phases.TTFB = now.Sub(t.wrote) }) },
+	}
+}
+
+// done returns the phases of a request whose response was read until end.
+func (t *phaseTrace) done(end time.Time) probePhases {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	phases := t.phases
+	if !t.firstByte.IsZero() {
+		phases.Transfer = end.Sub(t.firstByte)
+	}
+	return phases
+}
+
+type probeKey struct {
+	Target  string
+	Vantage string
+	Family  string
+}
+
+// labels are the labels of the series of key: its target, vantage point
+// and IP family, if any.
+func (key probeKey) labels() data.Labels {
+	labels := data.Labels{"target": key.Target, "vantage": key.Vantage}
+	if key.Family != "" {
+		labels["family"] = key.Family
+	}
+	return labels
+}
+
+// IP families of dual-stack probes, and the networks they dial.
+var probeFamilies = []struct{ name, network string }{
+	{"ipv4", "tcp4"},
+	{"ipv6", "tcp6"},
+}
+
+// newProbeFamilyClient returns the client of probes restricted to network,
+// tcp4 or tcp6, with the TLS settings of clients built from opts and the
+// egress policy. Probes go direct, as proxies would pick the family.
+func newProbeFamilyClient(opts httpclient.Options, egress *egressPolicy, network string) (*http.Client, error) {
+	tlsConfig, err := clientTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: probeTimeout}
+	egress.guard(dialer, "")
+	dial := egress.guardDial(dialer.DialContext)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		},
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// probeTracker keeps recent probe results per target and vantage point.
+type probeTracker struct {
+	mu      sync.Mutex
+	results map[probeKey][]probeResult
+}
+
+func newProbeTracker() *probeTracker {
+	return &probeTracker{results: map[probeKey][]probeResult{}}
+}
+
+func (t *probeTracker) record(results []probeResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, r := range results {
+		key := probeKey{Target: r.Target, Vantage: r.Vantage, Family: r.Family}
+		history := append(t.results[key], r)
+		if len(history) > maxProbeResults {
+			history = history[len(history)-maxProbeResults:]
+		}
+		t.results[key] = history
+	}
+}
+
+// latest returns the last result for target, preferring the inside vantage
+// point, of probes over either IP family.
+func (t *probeTracker) latest(target string) (probeResult, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, vantage := range []string{vantageInside, vantageOutside} {
+		if history := t.results[probeKey{Target: target, Vantage: vantage}]; len(history) > 0 {
+			return history[len(history)-1], true
+		}
+	}
+	return probeResult{}, false
+}
+
+// window returns the results of target (or all targets if empty) within tr,
+// with keys sorted by target, vantage point and IP family.
+func (t *probeTracker) window(target string, tr backend.TimeRange) ([]probeKey, map[probeKey][]probeResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var keys []probeKey
+	results := map[probeKey][]probeResult{}
+	for key, history := range t.results {
+		if target != "" && key.Target != target {
+			continue
+		}
+		var inRange []probeResult
+		for _, r := range history {
+			if !r.Time.Before(tr.From) && !r.Time.After(tr.To) {
+				inRange = append(inRange, r)
+			}
+		}
+		keys = append(keys, key)
+		results[key] = inRange
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Target != keys[j].Target {
+			return keys[i].Target < keys[j].Target
+		}
+		if keys[i].Vantage != keys[j].Vantage {
+			return keys[i].Vantage < keys[j].Vantage
+		}
+		return keys[i].Family < keys[j].Family
+	})
+	return keys, results
+}
+
+// probeTarget checks a target from the plugin's own network, over the IP
+// family of dual-stack probes if set. HTTP targets are up unless the request
+// fails or returns a 5xx status.
+func (ds *testDataSource) probeTarget(ctx context.Context, target models.ProbeTarget, family string) probeResult {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	result := probeResult{Time: time.Now(), Target: target.Name, Vantage: vantageInside, Family: family}
+	fail := func(err error) probeResult {
+		result.Latency = time.Since(result.Time)
+		result.Error = err.Error()
+		return result
+	}
+
+	u, err := url.Parse(target.URL)
+	if err != nil {
+		return fail(fmt.Errorf("invalid URL: %w", err))
+	}
+
+	network, client := "tcp", ds.httpClient
+	for _, f := range probeFamilies {
+		if f.name == family {
+			network, client = f.network, ds.probeClients[family]
+		}
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		conn, err := ds.egress.dialContext(ctx, network, u.Host)
+		if err != nil {
+			return fail(err)
+		}
+		conn.Close()
+	case "http", "https":
+		trace := &phaseTrace{}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace.clientTrace()), http.MethodGet, target.URL, nil)
+		if err != nil {
+			return fail(err)
+		}
+		// Probes connect anew, so that every probe times connecting, rather
+		// than reusing connections left open by earlier ones
+		req.Close = true
+		resp, err := client.Do(req)
+		if err != nil {
+			// The phases that completed show where the probe failed
+			result.Phases = trace.done(time.Now())
+			return fail(err)
+		}
+		_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, maxProbeBody))
+		resp.Body.Close()
+		result.Phases = trace.done(time.Now())
+		if err != nil {
+			return fail(fmt.Errorf("failed to read response: %w", err))
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fail(fmt.Errorf("returned %s", resp.Status))
+		}
+	default:
+		return fail(fmt.Errorf("unsupported scheme %q", u.Scheme))
+	}
+
+	result.Up = true
+	result.Latency = time.Since(result.Time)
+	return result
+}
+
+// probeFromAgent asks the remote probe agent to check the targets. The agent
+// accepts a POST of {"targets":[{"name","url"}]} and answers with
+// {"results":[{"name","up","latencyMs","error"}]}.
+func (ds *testDataSource) probeFromAgent(ctx context.Context, targets []models.ProbeTarget) ([]probeResult, error) {
+	body, err := json.Marshal(map[string]any{"targets": targets})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ds.settings.Probes.AgentURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid probe agent URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ds.settings.Secrets != nil && ds.settings.Secrets.ProbeAgentToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ds.settings.Secrets.ProbeAgentToken)
+	}
+
+	now := time.Now()
+	resp, err := ds.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("probe agent request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("probe agent returned %s", resp.Status)
+	}
+
+	var answer struct {
+		Results []struct {
+			Name      string  `json:"name"`
+			Up        bool    `json:"up"`
+			LatencyMs float64 `json:"latencyMs"`
+			Error     string  `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("failed to decode probe agent response: %w", err)
+	}
+
+	results := make([]probeResult, 0, len(answer.Results))
+	for _, r := range answer.Results {
+		results = append(results, probeResult{
+			Time:    now,
+			Target:  r.Name,
+			Vantage: vantageOutside,
+			Up:      r.Up,
+			Latency: time.Duration(r.LatencyMs * float64(time.Millisecond)),
+			Error:   r.Error,
+		})
+	}
+	return results, nil
+}
+
+// runProbes probes every target once from each vantage point, and from
+// inside over each IP family for dual-stack probes.
+func (ds *testDataSource) runProbes(ctx context.Context) {
+	targets := ds.settings.Probes.Targets
+
+	results := make([]probeResult, len(targets))
+	var families [][]probeResult
+	if ds.probeClients != nil {
+		families = make([][]probeResult, len(probeFamilies))
+		for f := range families {
+			families[f] = make([]probeResult, len(targets))
+		}
+	}
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = ds.probeTarget(ctx, target, "")
+		}()
+		for f := range families {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				families[f][i] = ds.probeTarget(ctx, target, probeFamilies[f].name)
+			}()
+		}
+	}
+
+	if ds.settings.Probes.AgentURL != "" {
+		outside, err := ds.probeFromAgent(ctx, targets)
+		if err != nil {
+			backend.Logger.Warn("External probe failed", "error", err)
+		} else {
+			ds.probes.record(outside)
+			ds.health.recordProbes(outside)
+		}
+	}
+
+	wg.Wait()
+	ds.probes.record(results)
+	ds.health.recordProbes(results)
+	// Health is that of targets as clients reach them, over either family
+	for _, familyResults := range families {
+		ds.probes.record(familyResults)
+	}
+}
+
+func (ds *testDataSource) probeInterval() time.Duration {
+	if s := ds.settings.Probes.IntervalSeconds; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultProbeInterval
+}
+
+func (ds *testDataSource) runProber(ctx context.Context) {
+	interval := ds.probeInterval()
+
+	job := ds.schedule.add("probe", "", interval, time.Now())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job.run(func() error {
+			ds.runProbes(ctx)
+			return nil
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func queryProbe(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q probeQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if len(ds.settings.Probes.Targets) == 0 {
+		return nil, fmt.Errorf("no probe targets configured")
+	}
+
+	keys, results := ds.probes.window(q.Target, query.TimeRange)
+
+	switch q.Mode {
+	case "", "availability":
+		return data.Frames{probeAvailabilityFrame(keys, results)}, nil
+	case "timeline":
+		return probeTimelineFrames(keys, results), nil
+	case "phases":
+		return probePhaseFrames(keys, results), nil
+	case "heatmap":
+		buckets := q.Buckets
+		if len(buckets) == 0 {
+			buckets = defaultLatencyBuckets
+		}
+		sort.Float64s(buckets)
+		step := query.Interval
+		if minStep := ds.probeInterval(); step < minStep {
+			step = minStep
+		}
+		return probeHeatmapFrames(keys, results, query.TimeRange, step, buckets), nil
+	}
+	return nil, fmt.Errorf("unknown probe mode %q", q.Mode)
+}
+
+// probeAvailabilityFrame summarizes each target and vantage point: the last
+// state, the share of successful probes and the mean latency of those.
+func probeAvailabilityFrame(keys []probeKey, results map[probeKey][]probeResult) *data.Frame {
+	frame := data.NewFrame("probe_availability",
+		data.NewField("target", nil, []string{}),
+		data.NewField("vantage", nil, []string{}),
+		data.NewField("family", nil, []string{}),
+		data.NewField("up", nil, []*bool{}).SetConfig(upConfig()),
+		data.NewField("availability", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("latency", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("last_error", nil, []string{}),
+	)
+
+	for _, key := range keys {
+		rs := results[key]
+		var up *bool
+		var availability, latency *float64
+		lastError := ""
+		if len(rs) > 0 {
+			last := rs[len(rs)-1]
+			up, lastError = &last.Up, last.Error
+
+			var ok int
+			var total time.Duration
+			for _, r := range rs {
+				if r.Up {
+					ok++
+					total += r.Latency
+				}
+			}
+			a := float64(ok) / float64(len(rs)) * 100
+			availability = &a
+			if ok > 0 {
+				l := float64(total.Milliseconds()) / float64(ok)
+				latency = &l
+			}
+		}
+		frame.AppendRow(key.Target, key.Vantage, key.Family, up, availability, latency, lastError)
+	}
+	return frame
+}
+
+// probeTimelineFrames returns one up (1) / down (0) time series per target
+// and vantage point.
+func probeTimelineFrames(keys []probeKey, results map[probeKey][]probeResult) data.Frames {
+	frames := make(data.Frames, 0, len(keys))
+	for _, key := range keys {
+		rs := results[key]
+		times := make([]time.Time, len(rs))
+		values := make([]float64, len(rs))
+		for i, r := range rs {
+			times[i] = r.Time
+			if r.Up {
+				values[i] = 1
+			}
+		}
+		frame := data.NewFrame("probe",
+			data.NewField("time", nil, times),
+			data.NewField("up", key.labels(), values).SetConfig(upConfig()),
+		)
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// probeHeatmapFrames counts successful probe latencies per time step and
+// latency bucket, one heatmap frame per target and vantage point. Latencies
+// above the last bound land in a "+Inf" bucket.
+func probeHeatmapFrames(keys []probeKey, results map[probeKey][]probeResult, tr backend.TimeRange, step time.Duration, buckets []float64) data.Frames {
+	start := tr.From.Truncate(step)
+	steps := int(tr.To.Sub(start)/step) + 1
+
+	frames := make(data.Frames, 0, len(keys))
+	for _, key := range keys {
+		counts := make([][]float64, len(buckets)+1)
+		for i := range counts {
+			counts[i] = make([]float64, steps)
+		}
+		for _, r := range results[key] {
+			if !r.Up {
+				continue
+			}
+			row := int(r.Time.Sub(start) / step)
+			if row < 0 || row >= steps {
+				continue
+			}
+			ms := float64(r.Latency) / float64(time.Millisecond)
+			counts[sort.SearchFloat64s(buckets, ms)][row]++
+		}
+
+		times := make([]time.Time, steps)
+		for i := range times {
+			times[i] = start.Add(time.Duration(i) * step)
+		}
+
+		fields := []*data.Field{data.NewField("time", nil, times)}
+		for i, c := range counts {
+			name := "+Inf"
+			if i < len(buckets) {
+				name = formatBound(buckets[i])
+			}
+			fields = append(fields, data.NewField(name, nil, c))
+		}
+		name := key.Target + " (" + key.Vantage + ")"
+		if key.Family != "" {
+			name = key.Target + " (" + key.Vantage + ", " + key.Family + ")"
+		}
+		frame := data.NewFrame(name, fields...)
+		frame.Meta = &data.FrameMeta{Type: frameTypeHeatmapRows}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// probePhaseFrames returns the phases of the HTTP probes from inside, one
+// time series per phase and target, so that a slow service shows which
+// phase regressed.
+func probePhaseFrames(keys []probeKey, results map[probeKey][]probeResult) data.Frames {
+	var frames data.Frames
+	for _, key := range keys {
+		if key.Vantage != vantageInside {
+			continue
+		}
+		var rs []probeResult
+		for _, r := range results[key] {
+			if r.Up && r.Phases != (probePhases{}) {
+				rs = append(rs, r)
+			}
+		}
+		times := make([]time.Time, len(rs))
+		values := make([][]float64, len(probePhaseNames))
+		for i := range values {
+			values[i] = make([]float64, len(rs))
+		}
+		for j, r := range rs {
+			times[j] = r.Time
+			for i, d := range r.Phases.durations() {
+				values[i][j] = float64(d) / float64(time.Millisecond)
+			}
+		}
+		fields := []*data.Field{data.NewField("time", nil, times)}
+		for i, name := range probePhaseNames {
+			labels := key.labels()
+			delete(labels, "vantage")
+			fields = append(fields, data.NewField(name, labels, values[i]).SetConfig(&data.FieldConfig{Unit: "ms"}))
+		}
+		frame := data.NewFrame("probe_phases", fields...)
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+		frames = append(frames, frame)
+	}
+	return frames
+}
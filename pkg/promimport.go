@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+	"gopkg.in/yaml.v3"
+)
+
+// maxImportBytes bounds the Prometheus configuration accepted for import.
+const maxImportBytes = 4 << 20
+
+// prometheusConfig is the part of a prometheus.yml that targets are
+// imported from.
+type prometheusConfig struct {
+	ScrapeConfigs []prometheusScrapeConfig `yaml:"scrape_configs"`
+}
+
+type prometheusScrapeConfig struct {
+	JobName        string                    `yaml:"job_name"`
+	Scheme         string                    `yaml:"scheme"`
+	MetricsPath    string                    `yaml:"metrics_path"`
+	Params         map[string][]string       `yaml:"params"`
+	StaticConfigs  []prometheusStaticConfig  `yaml:"static_configs"`
+	RelabelConfigs []prometheusRelabelConfig `yaml:"relabel_configs"`
+	// Everything else, such as credentials and service discovery, is
+	// reported rather than imported
+	Other map[string]yaml.Node `yaml:",inline"`
+}
+
+type prometheusStaticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+type prometheusRelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	TargetLabel  string   `yaml:"target_label"`
+	Regex        *string  `yaml:"regex"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+}
+
+// prometheusImport is the result of an import: the targets to add to the
+// settings, and what could not be carried over.
+type prometheusImport struct {
+	Targets  []models.Target `json:"targets"`
+	Warnings []string        `json:"warnings"`
+}
+
+// parsePrometheusConfig parses a prometheus.yml, or only its scrape_configs
+// list.
+func parsePrometheusConfig(body []byte) (prometheusConfig, error) {
+	var config prometheusConfig
+	var root yaml.Node
+	if err := yaml.Unmarshal(body, &root); err != nil {
+		return config, fmt.Errorf("invalid YAML: %w", err)
+	}
+	if len(root.Content) == 1 && root.Content[0].Kind == yaml.SequenceNode {
+		err := root.Content[0].Decode(&config.ScrapeConfigs)
+		return config, err
+	}
+	err := root.Decode(&config)
+	return config, err
+}
+
+// importPrometheusTargets converts the static targets of scrape configs into
+// plugin targets. Relabeling is approximated by applying the rules Prometheus
+// would apply to the target labels; targets already configured, by URL, are
+// left out.
+func importPrometheusTargets(config prometheusConfig, existing []*scrapeTarget) prometheusImport {
+	result := prometheusImport{Targets: []models.Target{}, Warnings: []string{}}
+	warn := func(format string, args ...any) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf(format, args...))
+	}
+	configured := map[string]string{}
+	names := map[string]bool{}
+	for _, t := range existing {
+		configured[t.URL] = t.Name
+		names[t.Name] = true
+	}
+
+	for _, job := range config.ScrapeConfigs {
+		others := make([]string, 0, len(job.Other))
+		for key := range job.Other {
+			others = append(others, key)
+		}
+		sort.Strings(others)
+		for _, key := range others {
+			switch {
+			case strings.HasSuffix(key, "_sd_configs"):
+				warn("job %s: %s are not imported, only static_configs", job.JobName, key)
+			case key == "basic_auth" || key == "authorization" || key == "bearer_token" || key == "bearer_token_file" || key == "oauth2":
+				warn("job %s: %s is not imported, set the credentials of its targets in the secure settings", job.JobName, key)
+			case key == "tls_config":
+				warn("job %s: tls_config is not imported, the plugin's TLS settings apply", job.JobName)
+			}
+		}
+		rules, err := compileRelabelConfigs(job.RelabelConfigs)
+		if err != nil {
+			warn("job %s: relabeling is ignored: %v", job.JobName, err)
+		}
+
+		for _, static := range job.StaticConfigs {
+			for _, address := range static.Targets {
+				labels := map[string]string{
+					"__address__":      address,
+					"__scheme__":       firstNonEmpty(job.Scheme, "http"),
+					"__metrics_path__": firstNonEmpty(job.MetricsPath, models.DefaultMetricsPath),
+					"job":              job.JobName,
+				}
+				for name, values := range job.Params {
+					if len(values) > 0 {
+						labels["__param_"+name] = values[0]
+					}
+				}
+				for name, value := range static.Labels {
+					labels[name] = value
+				}
+				if !relabel(labels, rules) {
+					continue
+				}
+
+				target, err := prometheusTarget(labels, names)
+				if err != nil {
+					warn("job %s: target %s: %v", job.JobName, address, err)
+					continue
+				}
+				if name, ok := configured[target.URL]; ok {
+					warn("job %s: target %s is already configured as %s", job.JobName, address, name)
+					continue
+				}
+				if _, ok := target.Labels["target"]; ok {
+					warn("job %s: target %s: the target label is reserved for the target name, so it is dropped", job.JobName, address)
+					delete(target.Labels, "target")
+				}
+				configured[target.URL] = target.Name
+				names[target.Name] = true
+				result.Targets = append(result.Targets, target)
+			}
+		}
+	}
+	return result
+}
+
+// prometheusTarget builds a target from the labels of a Prometheus target
+// after relabeling, named after its host, or its job and host when the host
+// is taken.
+func prometheusTarget(labels map[string]string, names map[string]bool) (models.Target, error) {
+	address := labels["__address__"]
+	if address == "" {
+		return models.Target{}, fmt.Errorf("no address after relabeling")
+	}
+	u := &url.URL{Scheme: labels["__scheme__"], Host: address, Path: labels["__metrics_path__"]}
+	query := url.Values{}
+	for name, value := range labels {
+		if param, ok := strings.CutPrefix(name, "__param_"); ok {
+			query.Set(param, value)
+		}
+	}
+	u.RawQuery = query.Encode()
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return models.Target{}, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	host, _, _ = strings.Cut(host, ".")
+	name := host
+	for i := 2; names[name]; i++ {
+		name = labels["job"] + "-" + host
+		if i > 2 {
+			name += "-" + strconv.Itoa(i-1)
+		}
+	}
+
+	target := models.Target{Name: name, URL: u.String(), Labels: map[string]string{}}
+	for label, value := range labels {
+		if !strings.HasPrefix(label, "__") && value != "" {
+			target.Labels[label] = value
+		}
+	}
+	return target, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// relabelRule is a compiled relabel config.
+type relabelRule struct {
+	prometheusRelabelConfig
+	regex       *regexp.Regexp
+	separator   string
+	replacement string
+}
+
+// compileRelabelConfigs compiles the relabel configs with Prometheus'
+// defaults. Only the actions that don't depend on scraped data or hashing
+// are supported.
+func compileRelabelConfigs(configs []prometheusRelabelConfig) ([]relabelRule, error) {
+	rules := make([]relabelRule, 0, len(configs))
+	for _, c := range configs {
+		rule := relabelRule{prometheusRelabelConfig: c, separator: ";", replacement: "$1"}
+		if c.Action == "" {
+			rule.Action = "replace"
+		}
+		switch rule.Action {
+		case "replace", "keep", "drop", "labelmap", "labeldrop", "labelkeep", "lowercase", "uppercase":
+		default:
+			return nil, fmt.Errorf("unsupported action %q", rule.Action)
+		}
+		if c.Separator != nil {
+			rule.separator = *c.Separator
+		}
+		if c.Replacement != nil {
+			rule.replacement = *c.Replacement
+		}
+		expr := "(.*)"
+		if c.Regex != nil {
+			expr = *c.Regex
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", expr, err)
+		}
+		rule.regex = re
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// relabel applies rules to labels, as Prometheus relabels targets before
+// scraping them. It reports whether the target is kept.
+func relabel(labels map[string]string, rules []relabelRule) bool {
+	for _, rule := range rules {
+		values := make([]string, len(rule.SourceLabels))
+		for i, name := range rule.SourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, rule.separator)
+
+		switch rule.Action {
+		case "replace":
+			match := rule.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := string(rule.regex.ExpandString(nil, rule.TargetLabel, value, match))
+			replaced := string(rule.regex.ExpandString(nil, rule.replacement, value, match))
+			if replaced == "" {
+				delete(labels, target)
+			} else {
+				labels[target] = replaced
+			}
+		case "keep":
+			if !rule.regex.MatchString(value) {
+				return false
+			}
+		case "drop":
+			if rule.regex.MatchString(value) {
+				return false
+			}
+		case "lowercase":
+			labels[rule.TargetLabel] = strings.ToLower(value)
+		case "uppercase":
+			labels[rule.TargetLabel] = strings.ToUpper(value)
+		case "labelmap":
+			for name, v := range labels {
+				if match := rule.regex.FindStringSubmatchIndex(name); match != nil {
+					labels[string(rule.regex.ExpandString(nil, rule.replacement, name, match))] = v
+				}
+			}
+		case "labeldrop", "labelkeep":
+			for name := range labels {
+				if rule.regex.MatchString(name) == (rule.Action == "labeldrop") {
+					delete(labels, name)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// handleImportPrometheus converts the scrape_configs of a prometheus.yml in
+// the request body into targets, for the user to add to the settings. It
+// changes nothing itself.
+func (ds *testDataSource) handleImportPrometheus(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxImportBytes+1))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("failed to read the configuration: %w", err))
+		return
+	}
+	if len(body) > maxImportBytes {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, withCode(codeLimitExceeded, fmt.Errorf("the configuration is larger than %d bytes", maxImportBytes)))
+		return
+	}
+	config, err := parsePrometheusConfig(body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, withCode(codeParseError, fmt.Errorf("failed to parse the Prometheus configuration: %w", err)))
+		return
+	}
+	if len(config.ScrapeConfigs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("the configuration has no scrape_configs"))
+		return
+	}
+	writeJSON(w, http.StatusOK, importPrometheusTargets(config, ds.targets))
+}
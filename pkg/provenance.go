@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Collectors of frameProvenance, besides query types.
+const (
+	collectorMetrics    = "metrics"
+	collectorKubernetes = sourceKubernetes
+)
+
+// Cache statuses of frameProvenance.
+const (
+	// cacheHistory is data replayed from the scrape history
+	cacheHistory = "history"
+	// cacheLive is data of a target scraped for the query, having no
+	// history yet
+	cacheLive = "live"
+	// cachePush is data pushed by the target rather than scraped
+	cachePush = "push"
+	// cacheStream is data of streaming queries, sent as it is scraped
+	cacheStream = "stream"
+	// cacheHighResolution is data replayed from the buffer of series
+	// sampled at sub-second resolution
+	cacheHighResolution = "highres"
+)
+
+// frameProvenance says where the numbers of a frame came from, for
+// consumers of exported data and support requests. It is the frame's
+// Meta.Custom, which shows in the query inspector.
+type frameProvenance struct {
+	// Targets are those the data came from, several once series of
+	// several targets are aggregated or merged
+	Targets []string `json:"targets,omitempty"`
+	// ScrapedAt is when the newest of the data was scraped, or collected by
+	// collector queries
+	ScrapedAt *time.Time `json:"scrapedAt,omitempty"`
+	// Collector is "metrics", "kubernetes" or the query type of queries with
+	// their own collector
+	Collector string `json:"collector"`
+	// Cache is "history", "live", "push", "stream" or "highres" for metric
+	// data, and empty for collectors, which keep their own caches
+	Cache string `json:"cache,omitempty"`
+	// Transforms are what ran on the data, in order
+	Transforms []string `json:"transforms"`
+	// Scrape is the last scrape of the target, while there is a single one
+	Scrape *scrapeStats `json:"scrape,omitempty"`
+}
+
+// provenanceOf returns the provenance of frame, nil when it has none.
+func provenanceOf(frame *data.Frame) *frameProvenance {
+	if frame.Meta == nil {
+		return nil
+	}
+	p, _ := frame.Meta.Custom.(*frameProvenance)
+	return p
+}
+
+// setProvenance attaches a copy of p to each frame that has none yet.
+func setProvenance(frames data.Frames, p frameProvenance) {
+	for _, frame := range frames {
+		if provenanceOf(frame) != nil {
+			continue
+		}
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		copied := p
+		copied.Targets = slices.Clone(p.Targets)
+		copied.Transforms = []string{}
+		frame.Meta.Custom = &copied
+	}
+}
+
+// addTransforms records that transforms ran on frames. Frames share no
+// provenance, but each gets its own copy before it is changed.
+func addTransforms(frames data.Frames, transforms ...string) {
+	if len(transforms) == 0 {
+		return
+	}
+	for _, frame := range frames {
+		p := provenanceOf(frame)
+		if p == nil {
+			continue
+		}
+		copied := *p
+		copied.Transforms = append(slices.Clip(p.Transforms), transforms...)
+		frame.Meta.Custom = &copied
+	}
+}
+
+// mergeProvenance returns the provenance of data combined from a and b,
+// either of which may be nil.
+func mergeProvenance(a, b any) any {
+	pa, _ := a.(*frameProvenance)
+	pb, _ := b.(*frameProvenance)
+	if pa == nil || pb == nil {
+		if pa != nil {
+			return pa
+		}
+		return b
+	}
+	merged := *pa
+	merged.Targets = slices.Clone(pa.Targets)
+	for _, name := range pb.Targets {
+		if !slices.Contains(merged.Targets, name) {
+			merged.Targets = append(merged.Targets, name)
+		}
+	}
+	sort.Strings(merged.Targets)
+	if pb.ScrapedAt != nil && (merged.ScrapedAt == nil || pb.ScrapedAt.After(*merged.ScrapedAt)) {
+		merged.ScrapedAt = pb.ScrapedAt
+	}
+	if merged.Cache != pb.Cache {
+		// Live scrapes are recorded in history, which is what counts
+		merged.Cache = cacheHistory
+	}
+	if len(merged.Targets) > 1 {
+		merged.Scrape = nil
+	}
+	return &merged
+}
+
+// optionTransforms describes the transforms of a query's options, in the
+// order they run after its collector; stages are its expanded pipeline.
+func optionTransforms(opts queryOptions, stages []pipelineStage) []string {
+	var transforms []string
+	for _, stage := range stages {
+		transforms = append(transforms, "pipeline "+stage.Type)
+	}
+	if opts.LegendFormat != "" {
+		transforms = append(transforms, fmt.Sprintf("legend format %q", opts.LegendFormat))
+	}
+	if opts.OrderBy != "" {
+		transforms = append(transforms, "order by "+opts.OrderBy)
+	}
+	if len(opts.Columns) > 0 {
+		transforms = append(transforms, fmt.Sprintf("columns %v", opts.Columns))
+	}
+	if opts.Export != nil {
+		transforms = append(transforms, "export")
+	}
+	return transforms
+}
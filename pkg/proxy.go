@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeProxy = "proxy"
+
+// Supported reverse proxy kinds.
+const (
+	proxyKindTraefik = "traefik"
+	proxyKindCaddy   = "caddy"
+	proxyKindNginx   = "nginx"
+)
+
+func init() {
+	registerQueryType(queryTypeProxy, queryProxy, proxyQuery{})
+	registerConfiguredCheck(queryTypeProxy, func(ds *testDataSource) bool { return len(ds.settings.ReverseProxies) > 0 })
+}
+
+type proxyQuery struct {
+	// Proxy selects a configured proxy by name; empty means all of them.
+	Proxy string `json:"proxy"`
+}
+
+// proxyPreset maps a proxy's native Prometheus metrics onto the normalized model.
+type proxyPreset struct {
+	// requests is a counter or histogram carrying a "code" label
+	requests     string
+	duration     string
+	serviceLabel string
+	connections  []string
+}
+
+var proxyPresets = map[string]proxyPreset{
+	proxyKindTraefik: {
+		requests:     "traefik_service_requests_total",
+		duration:     "traefik_service_request_duration_seconds",
+		serviceLabel: "service",
+		connections:  []string{"traefik_open_connections", "traefik_entrypoint_open_connections"},
+	},
+	proxyKindCaddy: {
+		requests:     "caddy_http_request_duration_seconds",
+		duration:     "caddy_http_request_duration_seconds",
+		serviceLabel: "server",
+		connections:  []string{"caddy_http_requests_in_flight"},
+	},
+}
+
+// proxyServiceStats is the normalized, cumulative view of one routed service.
+type proxyServiceStats struct {
+	Proxy             string
+	Kind              string
+	Service           string
+	Requests          float64
+	StatusClasses     map[string]float64
+	DurationSum       float64
+	DurationCount     float64
+	Buckets           map[float64]float64
+	ActiveConnections float64
+}
+
+// statusClass turns an HTTP status code into its class, e.g. "404" -> "4xx".
+func statusClass(code string) string {
+	if len(code) == 3 && code[0] >= '1' && code[0] <= '5' {
+		return code[:1] + "xx"
+	}
+	return "other"
+}
+
+// normalizeProxyMetrics converts Traefik/Caddy metric families into
+// per-service stats.
+func normalizeProxyMetrics(proxy, kind string, preset proxyPreset, families map[string]*dto.MetricFamily) []proxyServiceStats {
+	byService := map[string]*proxyServiceStats{}
+	get := func(service string) *proxyServiceStats {
+		s, ok := byService[service]
+		if !ok {
+			s = &proxyServiceStats{
+				Proxy:         proxy,
+				Kind:          kind,
+				Service:       service,
+				StatusClasses: map[string]float64{},
+				Buckets:       map[float64]float64{},
+			}
+			byService[service] = s
+		}
+		return s
+	}
+
+	if mf := families[preset.requests]; mf != nil {
+		for _, m := range mf.GetMetric() {
+			s := get(labelValue(m, preset.serviceLabel))
+			v := sampleValue(m)
+			s.Requests += v
+			s.StatusClasses[statusClass(labelValue(m, "code"))] += v
+		}
+	}
+
+	if mf := families[preset.duration]; mf != nil {
+		for _, m := range mf.GetMetric() {
+			h := m.GetHistogram()
+			if h == nil {
+				continue
+			}
+			s := get(labelValue(m, preset.serviceLabel))
+			s.DurationSum += h.GetSampleSum()
+			s.DurationCount += float64(h.GetSampleCount())
+			for _, b := range h.GetBucket() {
+				s.Buckets[b.GetUpperBound()] += float64(b.GetCumulativeCount())
+			}
+		}
+	}
+
+	var connections float64
+	for _, name := range preset.connections {
+		if mf := families[name]; mf != nil {
+			for _, m := range mf.GetMetric() {
+				connections += sampleValue(m)
+			}
+		}
+	}
+
+	stats := make([]proxyServiceStats, 0, len(byService))
+	for _, s := range byService {
+		s.ActiveConnections = connections
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Service < stats[j].Service })
+
+	return stats
+}
+
+// parseNginxStubStatus parses the stub_status page:
+//
+//	Active connections: 2
+//	server accepts handled requests
+//	 16 16 31
+//	Reading: 0 Writing: 1 Waiting: 1
+func parseNginxStubStatus(proxy string, body []byte) (proxyServiceStats, error) {
+	stats := proxyServiceStats{
+		Proxy:         proxy,
+		Kind:          proxyKindNginx,
+		StatusClasses: map[string]float64{},
+		Buckets:       map[float64]float64{},
+	}
+
+	var foundRequests bool
+	var expectCounters bool
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "Active connections:"):
+			v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(line, "Active connections:")), 64)
+			if err != nil {
+				return stats, fmt.Errorf("invalid active connections in stub_status: %w", err)
+			}
+			stats.ActiveConnections = v
+		case strings.HasPrefix(line, "server accepts handled requests"):
+			expectCounters = true
+		case expectCounters:
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				return stats, fmt.Errorf("malformed stub_status counters %q", line)
+			}
+			v, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return stats, fmt.Errorf("invalid request count in stub_status: %w", err)
+			}
+			stats.Requests = v
+			foundRequests = true
+			expectCounters = false
+		}
+	}
+	if !foundRequests {
+		return stats, fmt.Errorf("no request counters found in stub_status")
+	}
+
+	return stats, nil
+}
+
+func (ds *testDataSource) collectProxyStats(ctx context.Context, proxy models.ReverseProxySettings) ([]proxyServiceStats, error) {
+	body, err := ds.httpGet(ctx, proxy.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxy.Kind == proxyKindNginx {
+		stats, err := parseNginxStubStatus(proxy.Name, body)
+		if err != nil {
+			return nil, err
+		}
+		return []proxyServiceStats{stats}, nil
+	}
+
+	preset, ok := proxyPresets[proxy.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown reverse proxy kind %q", proxy.Kind)
+	}
+	families, err := parseExposition(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return normalizeProxyMetrics(proxy.Name, proxy.Kind, preset, families), nil
+}
+
+// selectProxies returns the configured proxies matching name, or all of them.
+func (ds *testDataSource) selectProxies(name string) ([]models.ReverseProxySettings, error) {
+	if len(ds.settings.ReverseProxies) == 0 {
+		return nil, fmt.Errorf("no reverse proxies configured")
+	}
+	if name == "" {
+		return ds.settings.ReverseProxies, nil
+	}
+	for _, p := range ds.settings.ReverseProxies {
+		if p.Name == name {
+			return []models.ReverseProxySettings{p}, nil
+		}
+	}
+	return nil, fmt.Errorf("reverse proxy %q is not configured", name)
+}
+
+type proxySnapshot struct {
+	Time          time.Time
+	Requests      float64
+	DurationSum   float64
+	DurationCount float64
+}
+
+// proxyTracker remembers the previous scrape of every service so request
+// rate and latency can be computed over the interval between scrapes.
+type proxyTracker struct {
+	mu   sync.Mutex
+	prev map[string]proxySnapshot
+}
+
+func newProxyTracker() *proxyTracker {
+	return &proxyTracker{prev: map[string]proxySnapshot{}}
+}
+
+// observe stores s and returns the request rate and mean latency since the
+// previous observation. Without a usable previous observation the rate is nil
+// and latency falls back to the lifetime average.
+func (t *proxyTracker) observe(now time.Time, s proxyServiceStats) (*float64, *float64) {
+	key := s.Proxy + "\x00" + s.Service
+	cur := proxySnapshot{Time: now, Requests: s.Requests, DurationSum: s.DurationSum, DurationCount: s.DurationCount}
+
+	t.mu.Lock()
+	prev, ok := t.prev[key]
+	t.prev[key] = cur
+	t.mu.Unlock()
+
+	var rate, latency *float64
+	if s.DurationCount > 0 {
+		avg := s.DurationSum / s.DurationCount
+		latency = &avg
+	}
+
+	// Counter resets (proxy restarts) make the delta meaningless
+	if !ok || cur.Requests < prev.Requests {
+		return rate, latency
+	}
+	if dt := cur.Time.Sub(prev.Time).Seconds(); dt > 0 {
+		r := (cur.Requests - prev.Requests) / dt
+		rate = &r
+	}
+	if dc := cur.DurationCount - prev.DurationCount; dc > 0 {
+		avg := (cur.DurationSum - prev.DurationSum) / dc
+		latency = &avg
+	}
+
+	return rate, latency
+}
+
+func queryProxy(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q proxyQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	proxies, err := ds.selectProxies(q.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := data.NewFrame("proxy",
+		data.NewField("proxy", nil, []string{}),
+		data.NewField("kind", nil, []string{}),
+		data.NewField("service", nil, []string{}),
+		data.NewField("requests_total", nil, []float64{}),
+		data.NewField("request_rate", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "reqps"}),
+		data.NewField("status_2xx", nil, []float64{}),
+		data.NewField("status_3xx", nil, []float64{}),
+		data.NewField("status_4xx", nil, []float64{}),
+		data.NewField("status_5xx", nil, []float64{}),
+		data.NewField("latency_avg", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("active_connections", nil, []float64{}),
+	)
+
+	now := time.Now()
+	for _, p := range proxies {
+		stats, err := ds.collectProxyStats(ctx, p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name, err)
+		}
+		for _, s := range stats {
+			rate, latency := ds.proxies.observe(now, s)
+			frame.AppendRow(s.Proxy, s.Kind, s.Service, s.Requests, rate,
+				s.StatusClasses["2xx"], s.StatusClasses["3xx"], s.StatusClasses["4xx"], s.StatusClasses["5xx"],
+				latency, s.ActiveConnections)
+		}
+	}
+
+	return data.Frames{frame}, nil
+}
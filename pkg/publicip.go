@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypePublicIP = "publicip"
+
+const defaultPublicIPInterval = 5 * time.Minute
+
+// maxIPChanges bounds the number of IP changes kept in memory.
+const maxIPChanges = 200
+
+var defaultEchoURLs = []string{
+	"https://api.ipify.org",
+	"https://icanhazip.com",
+	"https://ifconfig.me/ip",
+}
+
+func init() {
+	registerQueryType(queryTypePublicIP, queryPublicIP, publicIPQuery{})
+	registerConfiguredCheck(queryTypePublicIP, func(ds *testDataSource) bool { return ds.settings.PublicIP.Enabled })
+}
+
+type publicIPQuery struct {
+	// Mode is "current" (default) for the current IP and DDNS status, or
+	// "changes" for change annotations.
+	Mode string `json:"mode"`
+}
+
+type ipChange struct {
+	Time time.Time
+	Old  string
+	New  string
+}
+
+// publicIPTracker remembers the last seen public IP and every change to it.
+type publicIPTracker struct {
+	mu        sync.Mutex
+	current   string
+	source    string
+	checkedAt time.Time
+	changes   []ipChange
+}
+
+func (t *publicIPTracker) record(now time.Time, ip, source string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.current != "" && t.current != ip {
+		t.changes = append(t.changes, ipChange{Time: now, Old: t.current, New: ip})
+		if len(t.changes) > maxIPChanges {
+			t.changes = t.changes[len(t.changes)-maxIPChanges:]
+		}
+		backend.Logger.Info("Public IP changed", "old", t.current, "new", ip)
+	}
+	t.current, t.source, t.checkedAt = ip, source, now
+}
+
+// fetchPublicIP asks the configured echo services for our public IP, returning
+// the first valid answer.
+func (ds *testDataSource) fetchPublicIP(ctx context.Context) (string, string, error) {
+	urls := ds.settings.PublicIP.EchoURLs
+	if len(urls) == 0 {
+		urls = defaultEchoURLs
+	}
+
+	var lastErr error
+	for _, u := range urls {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp, err := ds.httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("%s returned %s", u, resp.Status)
+			continue
+		}
+
+		ip := net.ParseIP(strings.TrimSpace(string(body)))
+		if ip == nil {
+			lastErr = fmt.Errorf("%s returned an invalid IP %q", u, strings.TrimSpace(string(body)))
+			continue
+		}
+		return ip.String(), u, nil
+	}
+
+	return "", "", fmt.Errorf("all IP echo services failed: %w", lastErr)
+}
+
+// checkPublicIP refreshes the tracked public IP.
+func (ds *testDataSource) checkPublicIP(ctx context.Context) error {
+	ip, source, err := ds.fetchPublicIP(ctx)
+	if err != nil {
+		return err
+	}
+	ds.publicIP.record(time.Now(), ip, source)
+	return nil
+}
+
+// runPublicIPChecker periodically refreshes the public IP until ctx is done,
+// so changes are caught even when no dashboard is open.
+func (ds *testDataSource) runPublicIPChecker(ctx context.Context) {
+	interval := defaultPublicIPInterval
+	if s := ds.settings.PublicIP.IntervalSeconds; s > 0 {
+		interval = time.Duration(s) * time.Second
+	}
+
+	job := ds.schedule.add("publicip", "", interval, time.Now())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := job.run(func() error { return ds.checkPublicIP(ctx) }); err != nil {
+			backend.Logger.Warn("Public IP check failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ddnsResolver returns a resolver using the configured DNS server, so split
+// horizon setups can verify what the outside world sees.
+func (ds *testDataSource) ddnsResolver() *net.Resolver {
+	server := ds.settings.PublicIP.DNSServer
+	if server == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return ds.egress.dialContext(ctx, network, server)
+		},
+	}
+}
+
+func queryPublicIP(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q publicIPQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	if q.Mode == "changes" {
+		return data.Frames{ds.publicIP.changesFrame(query.TimeRange)}, nil
+	}
+
+	if err := ds.checkPublicIP(ctx); err != nil {
+		return nil, err
+	}
+
+	ds.publicIP.mu.Lock()
+	ip, source, checkedAt := ds.publicIP.current, ds.publicIP.source, ds.publicIP.checkedAt
+	ds.publicIP.mu.Unlock()
+
+	frame := data.NewFrame("publicip",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("public_ip", nil, []string{}),
+		data.NewField("source", nil, []string{}),
+		data.NewField("ddns_hostname", nil, []string{}),
+		data.NewField("ddns_addresses", nil, []string{}),
+		data.NewField("ddns_match", nil, []int64{}),
+	)
+
+	if len(ds.settings.PublicIP.DDNSHostnames) == 0 {
+		frame.AppendRow(checkedAt, ip, source, "", "", int64(0))
+		return data.Frames{frame}, nil
+	}
+
+	resolver := ds.ddnsResolver()
+	for _, hostname := range ds.settings.PublicIP.DDNSHostnames {
+		addrs, err := resolver.LookupHost(ctx, hostname)
+		if err != nil {
+			backend.Logger.Warn("DDNS lookup failed", "hostname", hostname, "error", err)
+		}
+
+		var match int64
+		for _, addr := range addrs {
+			if addr == ip {
+				match = 1
+			}
+		}
+		frame.AppendRow(checkedAt, ip, source, hostname, strings.Join(addrs, ", "), match)
+	}
+
+	return data.Frames{frame}, nil
+}
+
+// changesFrame returns IP changes within tr in annotation shape.
+func (t *publicIPTracker) changesFrame(tr backend.TimeRange) *data.Frame {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	frame := data.NewFrame("publicip_changes",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("text", nil, []string{}),
+		data.NewField("old_ip", nil, []string{}),
+		data.NewField("new_ip", nil, []string{}),
+	)
+	for _, c := range t.changes {
+		if c.Time.Before(tr.From) || c.Time.After(tr.To) {
+			continue
+		}
+		frame.AppendRow(c.Time, fmt.Sprintf("Public IP changed from %s to %s", c.Old, c.New), c.Old, c.New)
+	}
+
+	return frame
+}
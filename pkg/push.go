@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// Push sources reconnect after pushMinBackoff, doubling up to
+// pushMaxBackoff while connections keep failing.
+const (
+	pushMinBackoff = time.Second
+	pushMaxBackoff = time.Minute
+)
+
+// pushRecordInterval is how often the samples of a push source are recorded
+// in its history, however often messages come.
+const pushRecordInterval = time.Second
+
+// pushSource is the state of a target that pushes its samples, rather than
+// being scraped: the last value of each series it sent and its connection.
+type pushSource struct {
+	mapper fieldMapper
+	// schema, when set, checks messages before mapper maps them; target
+	// names the target for its metrics
+	schema *pushSchema
+	target string
+	// highRes samples series as they are pushed, when set
+	highRes *highResolution
+
+	mu      sync.Mutex
+	samples sampleSet
+	dirty   bool
+	// updatedAt is when the samples last changed
+	updatedAt time.Time
+	// err is why the source last disconnected, until it connects again
+	err error
+}
+
+func newPushSource(mappings []models.FieldMapping) (*pushSource, error) {
+	mapper, err := newFieldMapper(mappings)
+	if err != nil {
+		return nil, err
+	}
+	return &pushSource{mapper: mapper}, nil
+}
+
+// decode maps a JSON message to samples, once its schema accepts it.
+func (p *pushSource) decode(msg []byte) ([]metricSample, error) {
+	if p.schema != nil {
+		v, err := p.schema.decode(p.target, msg)
+		if err != nil {
+			return nil, err
+		}
+		return p.mapper.apply(v), nil
+	}
+	var v any
+	if err := json.Unmarshal(msg, &v); err != nil {
+		return nil, withCode(codeParseError, fmt.Errorf("invalid JSON message: %w", err))
+	}
+	return p.mapper.apply(v), nil
+}
+
+// ingest maps a JSON message to samples, updating their series.
+func (p *pushSource) ingest(msg []byte) error {
+	samples, err := p.decode(msg)
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range samples {
+		p.samples.add(s.Name, s.Labels, s.Value)
+	}
+	p.dirty = true
+	p.updatedAt = time.Now()
+	p.highRes.record(p.samples.samples, p.updatedAt)
+	return nil
+}
+
+// update applies fn to the samples, for sources that set them directly
+// rather than by mapping JSON messages.
+func (p *pushSource) update(fn func(*sampleSet)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(&p.samples)
+	p.dirty = true
+	p.updatedAt = time.Now()
+	p.highRes.record(p.samples.samples, p.updatedAt)
+}
+
+// expire drops the samples if they haven't changed for maxAge at now, as
+// sources that only push, without a connection, can go away silently.
+func (p *pushSource) expire(now time.Time, maxAge time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.samples.samples) > 0 && now.Sub(p.updatedAt) > maxAge {
+		p.samples = sampleSet{}
+		p.err = fmt.Errorf("no push for %s", maxAge)
+	}
+}
+
+// latest returns the last value of each series, or why there are none.
+func (p *pushSource) latest(name string) ([]metricSample, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.samples.samples) == 0 {
+		if p.err != nil {
+			return nil, withCode(codeTargetUnreachable, fmt.Errorf("no samples from %s: %w", name, p.err))
+		}
+		return nil, withCode(codeMetricNotFound, fmt.Errorf("no samples received from %s yet", name))
+	}
+	return append([]metricSample(nil), p.samples.samples...), nil
+}
+
+// connected clears the error of the last connection.
+func (p *pushSource) connected() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = nil
+}
+
+func (p *pushSource) disconnected(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// flush records the samples of target in its history and cache, if new
+// ones came since the last flush.
+func (p *pushSource) flush(target *scrapeTarget, now time.Time) {
+	p.mu.Lock()
+	if !p.dirty {
+		p.mu.Unlock()
+		return
+	}
+	p.dirty = false
+	samples := append([]metricSample(nil), p.samples.samples...)
+	p.mu.Unlock()
+	samples = calibrate(target.calibrations, samples)
+
+	target.history.record(now, samples)
+	target.cache(now, samples, scrapeStats{
+		Target:    target.Name,
+		URL:       redactURL(target.URL),
+		ScrapedAt: now,
+		Series:    len(samples),
+	})
+}
+
+// runPush keeps target, a push source of the given kind, connected until
+// the instance is disposed of, reconnecting with backoff. stream connects
+// and ingests samples until the connection fails, returning why, or the
+// instance is disposed of.
+func (ds *testDataSource) runPush(ctx context.Context, target *scrapeTarget, kind string, stream func(context.Context, *scrapeTarget) error) {
+	backoff := pushMinBackoff
+	for {
+		start := time.Now()
+		err := stream(ctx, target)
+		if err == nil {
+			return
+		}
+		target.push.disconnected(err)
+		// A connection that lasted starts the backoff over
+		if time.Since(start) > pushMaxBackoff {
+			backoff = pushMinBackoff
+		}
+		var wait time.Duration
+		wait, backoff = nextBackoff(backoff)
+		if target.sse != nil {
+			wait = max(wait, target.sse.retry)
+		}
+		backend.Logger.Warn(kind+" source disconnected", "target", target.Name, "error", err, "retryIn", wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-ds.drain:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// nextBackoff returns how long to wait before reconnecting, with jitter so
+// that sources dropped together don't reconnect together, and the backoff
+// after that.
+func nextBackoff(backoff time.Duration) (time.Duration, time.Duration) {
+	wait := backoff/2 + rand.N(backoff/2+1)
+	return wait, min(2*backoff, pushMaxBackoff)
+}
+
+// fieldMapper maps JSON messages to samples.
+type fieldMapper []fieldMapping
+
+type fieldMapping struct {
+	metric    string
+	path      []string
+	keyLabels []string
+	labels    map[string][]string
+	match     []pathMatch
+}
+
+type pathMatch struct {
+	path  []string
+	value string
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+func newFieldMapper(mappings []models.FieldMapping) (fieldMapper, error) {
+	mapper := make(fieldMapper, 0, len(mappings))
+	for _, m := range mappings {
+		if !metricNameRe.MatchString(m.Metric) {
+			return nil, fmt.Errorf("invalid metric name %q", m.Metric)
+		}
+		path := splitPath(m.Path)
+		wildcards := 0
+		for _, key := range path {
+			if key == "*" {
+				wildcards++
+			}
+		}
+		if wildcards != len(m.KeyLabels) {
+			return nil, fmt.Errorf("%s: path %s has %d wildcards, but %d key labels", m.Metric, m.Path, wildcards, len(m.KeyLabels))
+		}
+		mapping := fieldMapping{metric: m.Metric, path: path, keyLabels: m.KeyLabels, labels: map[string][]string{}}
+		for label, labelPath := range m.Labels {
+			mapping.labels[label] = splitPath(labelPath)
+		}
+		for matchPath, value := range m.Match {
+			mapping.match = append(mapping.match, pathMatch{path: splitPath(matchPath), value: value})
+		}
+		mapper = append(mapper, mapping)
+	}
+	return mapper, nil
+}
+
+// apply returns the samples of msg, a decoded JSON message.
+func (f fieldMapper) apply(msg any) []metricSample {
+	var samples []metricSample
+	for _, m := range f {
+		if !m.matches(msg) {
+			continue
+		}
+		labels := data.Labels{}
+		for label, path := range m.labels {
+			if v, ok := lookupPath(msg, path); ok {
+				if s, ok := scalarString(v); ok {
+					labels[label] = s
+				}
+			}
+		}
+		walkPath(msg, m.path, nil, func(keys []string, v any) {
+			value, ok := numericValue(v)
+			if !ok {
+				return
+			}
+			sampleLabels := labels.Copy()
+			for i, key := range keys {
+				sampleLabels[m.keyLabels[i]] = key
+			}
+			samples = append(samples, metricSample{
+				seriesInfo: seriesInfo{Family: m.metric, Name: m.metric, Labels: sampleLabels},
+				Value:      value,
+			})
+		})
+	}
+	return samples
+}
+
+func (m fieldMapping) matches(msg any) bool {
+	for _, match := range m.match {
+		v, ok := lookupPath(msg, match.path)
+		if !ok {
+			return false
+		}
+		if s, ok := scalarString(v); !ok || s != match.value {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupPath returns the value at path, which has no wildcards, in v.
+func lookupPath(v any, path []string) (any, bool) {
+	for _, key := range path {
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// walkPath calls fn with each value at path in v, and the keys or indexes
+// the wildcards of path matched.
+func walkPath(v any, path []string, keys []string, fn func(keys []string, v any)) {
+	if len(path) == 0 {
+		fn(keys, v)
+		return
+	}
+	key, rest := path[0], path[1:]
+	switch node := v.(type) {
+	case map[string]any:
+		if key != "*" {
+			if child, ok := node[key]; ok {
+				walkPath(child, rest, keys, fn)
+			}
+			return
+		}
+		names := make([]string, 0, len(node))
+		for name := range node {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			walkPath(node[name], rest, append(keys[:len(keys):len(keys)], name), fn)
+		}
+	case []any:
+		if key != "*" {
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node) {
+				walkPath(node[i], rest, keys, fn)
+			}
+			return
+		}
+		for i, child := range node {
+			walkPath(child, rest, append(keys[:len(keys):len(keys)], strconv.Itoa(i)), fn)
+		}
+	}
+}
+
+// numericValue returns the value of a number, a numeric string or a boolean.
+func numericValue(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// scalarString formats a string, number or boolean as a label value.
+func scalarString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeQuality = "quality"
+
+func init() {
+	registerQueryType(queryTypeQuality, queryQuality, qualityQuery{})
+}
+
+type qualityQuery struct {
+	// Target, Metric, MetricRegex and Labels select series as in metric
+	// queries; without a metric or regex, all series are scored.
+	Target      string            `json:"target"`
+	Metric      string            `json:"metric"`
+	MetricRegex string            `json:"metricRegex"`
+	Labels      map[string]string `json:"labels"`
+	// Min and Max bound the plausible values, e.g. 0 and 100 for a
+	// humidity; infinite values are always out of range.
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+// seriesQuality is how trustworthy a series was within a time range.
+type seriesQuality struct {
+	Series seriesInfo
+	// Samples is how many scrapes the series was in, out of Expected since
+	// it first was, at the scrape interval
+	Samples  int
+	Expected int
+	// Jitter is the standard deviation of the time between consecutive
+	// scrapes the series was in
+	Jitter     time.Duration
+	OutOfRange int
+}
+
+// gapRatio is the share of the expected samples that are missing.
+func (q seriesQuality) gapRatio() float64 {
+	if q.Expected == 0 {
+		return 0
+	}
+	return 1 - float64(q.Samples)/float64(q.Expected)
+}
+
+// score rates the series from 0 to 100, losing the share of samples missing
+// or out of range, and more as jitter approaches the scrape interval.
+func (q seriesQuality) score(interval time.Duration) float64 {
+	if q.Samples == 0 {
+		return 0
+	}
+	inRange := 1 - float64(q.OutOfRange)/float64(q.Samples)
+	steadiness := 1 / (1 + q.Jitter.Seconds()/interval.Seconds())
+	return 100 * (1 - q.gapRatio()) * inRange * steadiness
+}
+
+// quality replays the scrapes within tr for the quality of the series
+// matching sel, expecting one scrape per interval. Values outside lo and
+// hi, when set, are out of range.
+func (h *scrapeHistory) quality(sel seriesSelector, tr backend.TimeRange, interval time.Duration, lo, hi *float64) []seriesQuality {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var matches []int
+	pos := map[int]int{}
+	for i, s := range h.series {
+		if sel.matches(s) {
+			pos[i] = len(matches)
+			matches = append(matches, i)
+		}
+	}
+	current := make([]float64, len(matches))
+	for j, i := range matches {
+		current[j] = h.base[i]
+	}
+
+	type tracked struct {
+		first, previous time.Time
+		// intervals between consecutive scrapes, for the jitter
+		n          int
+		sum, sumSq float64
+		samples    int
+		outOfRange int
+		wasPresent bool
+	}
+	stats := make([]tracked, len(matches))
+	var last time.Time
+	for _, s := range h.scrapes {
+		for _, c := range s.Changes {
+			if j, ok := pos[c.Series]; ok {
+				current[j] = c.Value
+			}
+		}
+		if s.Time.Before(tr.From) || s.Time.After(tr.To) {
+			continue
+		}
+		for j, v := range current {
+			st := &stats[j]
+			if math.IsNaN(v) {
+				st.wasPresent = false
+				continue
+			}
+			if st.samples == 0 {
+				st.first = s.Time
+			}
+			if st.wasPresent {
+				d := s.Time.Sub(st.previous).Seconds()
+				st.n++
+				st.sum += d
+				st.sumSq += d * d
+			}
+			st.samples++
+			st.previous, st.wasPresent = s.Time, true
+			if math.IsInf(v, 0) || lo != nil && v < *lo || hi != nil && v > *hi {
+				st.outOfRange++
+			}
+		}
+		last = s.Time
+	}
+
+	var result []seriesQuality
+	for j, i := range matches {
+		st := stats[j]
+		if st.samples == 0 {
+			continue
+		}
+		q := seriesQuality{Series: h.series[i], Samples: st.samples, OutOfRange: st.outOfRange}
+		q.Expected = max(int(last.Sub(st.first)/interval)+1, st.samples)
+		if st.n > 1 {
+			mean := st.sum / float64(st.n)
+			variance := math.Max(0, st.sumSq/float64(st.n)-mean*mean)
+			q.Jitter = time.Duration(math.Sqrt(variance) * float64(time.Second))
+		}
+		result = append(result, q)
+	}
+	return result
+}
+
+func queryQuality(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q qualityQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	sel, err := newSeriesSelector(Query{Metric: q.Metric, MetricRegex: q.MetricRegex, Labels: q.Labels})
+	if err != nil {
+		return nil, err
+	}
+	targets, err := ds.selectTargets(q.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := ds.scrapeInterval()
+	type row struct {
+		target string
+		seriesQuality
+	}
+	var rows []row
+	for _, target := range targets {
+		for _, sq := range target.history.quality(sel, query.TimeRange, interval, q.Min, q.Max) {
+			rows = append(rows, row{target.Name, sq})
+		}
+	}
+	if len(rows) == 0 {
+		return nil, withCode(codeMetricNotFound, fmt.Errorf("no series match %s within the time range", sel))
+	}
+	// The least trustworthy series first
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].score(interval) < rows[j].score(interval) })
+
+	frame := data.NewFrame("quality",
+		data.NewField("target", nil, []string{}),
+		data.NewField("series", nil, []string{}),
+		data.NewField("samples", nil, []int64{}),
+		data.NewField("expected", nil, []int64{}),
+		data.NewField("gap_ratio", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "percentunit"}),
+		data.NewField("jitter", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("out_of_range", nil, []int64{}),
+		data.NewField("score", nil, []float64{}).SetConfig(&data.FieldConfig{
+			Min: ptrConfFloat64(0),
+			Max: ptrConfFloat64(100),
+		}),
+	)
+	for _, r := range rows {
+		frame.AppendRow(r.target, displaySeries(r.Series.Name, r.Series.Labels), int64(r.Samples), int64(r.Expected),
+			r.gapRatio(), r.Jitter.Seconds(), int64(r.OutOfRange), r.score(interval))
+	}
+	return data.Frames{frame}, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/experimental/concurrent"
+)
+
+// defaultDiffMaxDataPoints is the maxDataPoints of diffed queries that don't
+// say, as of a wide panel.
+const defaultDiffMaxDataPoints = 1000
+
+// diffSide is a query and the time range it runs over.
+type diffSide struct {
+	// Query is the query model, as in a panel, with its queryType
+	Query json.RawMessage `json:"query"`
+	// From and To are RFC 3339 times
+	From          string `json:"from"`
+	To            string `json:"to"`
+	MaxDataPoints int64  `json:"maxDataPoints"`
+}
+
+// diffRequest runs a query twice: the compared run takes what Compare sets
+// and the rest from the first run, so either the time range or the query
+// differs, or both.
+type diffRequest struct {
+	diffSide
+	Compare diffSide `json:"compare"`
+}
+
+// dataQuery builds the DataQuery of s, run with refID.
+func (s diffSide) dataQuery(refID string) (backend.DataQuery, error) {
+	var model struct {
+		QueryType string `json:"queryType"`
+	}
+	if err := json.Unmarshal(s.Query, &model); err != nil {
+		return backend.DataQuery{}, withCode(codeParseError, fmt.Errorf("invalid query JSON: %w", err))
+	}
+	from, err := time.Parse(time.RFC3339, s.From)
+	if err != nil {
+		return backend.DataQuery{}, fmt.Errorf("invalid from: %w", err)
+	}
+	to, err := time.Parse(time.RFC3339, s.To)
+	if err != nil {
+		return backend.DataQuery{}, fmt.Errorf("invalid to: %w", err)
+	}
+	if !from.Before(to) {
+		return backend.DataQuery{}, fmt.Errorf("from %s is not before to %s", s.From, s.To)
+	}
+	maxDataPoints := s.MaxDataPoints
+	if maxDataPoints <= 0 {
+		maxDataPoints = defaultDiffMaxDataPoints
+	}
+	return backend.DataQuery{
+		RefID:         refID,
+		QueryType:     model.QueryType,
+		JSON:          s.Query,
+		TimeRange:     backend.TimeRange{From: from, To: to},
+		MaxDataPoints: maxDataPoints,
+		Interval:      max(to.Sub(from)/time.Duration(maxDataPoints), time.Second),
+	}, nil
+}
+
+// withDefaults fills what s doesn't set from base.
+func (s diffSide) withDefaults(base diffSide) diffSide {
+	if len(s.Query) == 0 {
+		s.Query = base.Query
+	}
+	if s.From == "" {
+		s.From = base.From
+	}
+	if s.To == "" {
+		s.To = base.To
+	}
+	if s.MaxDataPoints == 0 {
+		s.MaxDataPoints = base.MaxDataPoints
+	}
+	return s
+}
+
+// queryDiff is the structural diff of the frames of two runs of a query.
+// Values are only compared when both runs cover the same time range, as
+// otherwise they are expected to differ.
+type queryDiff struct {
+	Equal bool `json:"equal"`
+	// Errors are the errors of the runs that failed, as "a" and "b"
+	Errors map[string]string `json:"errors,omitempty"`
+	Frames []frameDiff       `json:"frames"`
+}
+
+// frameDiff is a frame that is only in one run, or differs between them.
+// Frames are matched by name and the labels of their value fields.
+type frameDiff struct {
+	Frame string `json:"frame"`
+	// Change is "added", in the compared run only, "removed" or "changed"
+	Change string      `json:"change"`
+	Rows   *[2]int     `json:"rows,omitempty"`
+	Fields []fieldDiff `json:"fields,omitempty"`
+}
+
+// fieldDiff is a field that is only in one of the frames, or whose type or
+// values differ.
+type fieldDiff struct {
+	Field  string     `json:"field"`
+	Change string     `json:"change"`
+	Types  *[2]string `json:"types,omitempty"`
+	// ValuesChanged counts the rows whose values differ
+	ValuesChanged int `json:"valuesChanged,omitempty"`
+}
+
+// handleQueryDiff runs a query over two time ranges or in two versions, e.g.
+// before and after a migration, and returns how the results differ.
+func (ds *testDataSource) handleQueryDiff(w http.ResponseWriter, r *http.Request) {
+	var req diffRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, withCode(codeParseError, fmt.Errorf("invalid diff request: %w", err)))
+		return
+	}
+	a, err := req.diffSide.dataQuery("A")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	b, err := req.Compare.withDefaults(req.diffSide).dataQuery("B")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("compare: %w", err))
+		return
+	}
+
+	respA := ds.query(r.Context(), concurrent.Query{DataQuery: a, Headers: r.Header})
+	respB := ds.query(r.Context(), concurrent.Query{DataQuery: b, Headers: r.Header})
+	diff := queryDiff{Errors: map[string]string{}}
+	if respA.Error != nil {
+		diff.Errors["a"] = respA.Error.Error()
+	}
+	if respB.Error != nil {
+		diff.Errors["b"] = respB.Error.Error()
+	}
+	sameRange := a.TimeRange.From.Equal(b.TimeRange.From) && a.TimeRange.To.Equal(b.TimeRange.To)
+	diff.Frames = diffFrames(respA.Frames, respB.Frames, sameRange)
+	diff.Equal = len(diff.Frames) == 0 && len(diff.Errors) == 0
+	writeJSON(w, http.StatusOK, diff)
+}
+
+// frameKey identifies a frame across runs.
+func frameKey(frame *data.Frame) string {
+	key := frame.Name
+	for _, field := range frame.Fields {
+		if !field.Type().Time() && len(field.Labels) > 0 {
+			key += "{" + field.Labels.String() + "}"
+			break
+		}
+	}
+	return key
+}
+
+func fieldKey(field *data.Field) string {
+	if len(field.Labels) == 0 {
+		return field.Name
+	}
+	return field.Name + "{" + field.Labels.String() + "}"
+}
+
+// diffFrames returns the differences between frames a and b, sorted by
+// frame.
+func diffFrames(a, b data.Frames, compareValues bool) []frameDiff {
+	byKey := func(frames data.Frames) map[string]*data.Frame {
+		m := make(map[string]*data.Frame, len(frames))
+		for _, frame := range frames {
+			m[frameKey(frame)] = frame
+		}
+		return m
+	}
+	framesA, framesB := byKey(a), byKey(b)
+
+	diffs := []frameDiff{}
+	for key, frameA := range framesA {
+		frameB, ok := framesB[key]
+		if !ok {
+			diffs = append(diffs, frameDiff{Frame: key, Change: "removed"})
+			continue
+		}
+		if diff, changed := diffFrame(frameA, frameB, compareValues); changed {
+			diff.Frame = key
+			diffs = append(diffs, diff)
+		}
+	}
+	for key := range framesB {
+		if _, ok := framesA[key]; !ok {
+			diffs = append(diffs, frameDiff{Frame: key, Change: "added"})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Frame < diffs[j].Frame })
+	return diffs
+}
+
+func diffFrame(a, b *data.Frame, compareValues bool) (frameDiff, bool) {
+	diff := frameDiff{Change: "changed"}
+	rowsA, rowsB := a.Rows(), b.Rows()
+	if rowsA != rowsB {
+		diff.Rows = &[2]int{rowsA, rowsB}
+	}
+
+	fieldsB := make(map[string]*data.Field, len(b.Fields))
+	for _, field := range b.Fields {
+		fieldsB[fieldKey(field)] = field
+	}
+	seen := map[string]bool{}
+	for _, fieldA := range a.Fields {
+		key := fieldKey(fieldA)
+		seen[key] = true
+		fieldB, ok := fieldsB[key]
+		switch {
+		case !ok:
+			diff.Fields = append(diff.Fields, fieldDiff{Field: key, Change: "removed"})
+		case fieldA.Type() != fieldB.Type():
+			diff.Fields = append(diff.Fields, fieldDiff{Field: key, Change: "changed", Types: &[2]string{fieldA.Type().ItemTypeString(), fieldB.Type().ItemTypeString()}})
+		case compareValues:
+			if n := changedValues(fieldA, fieldB); n > 0 {
+				diff.Fields = append(diff.Fields, fieldDiff{Field: key, Change: "changed", ValuesChanged: n})
+			}
+		}
+	}
+	for _, fieldB := range b.Fields {
+		if key := fieldKey(fieldB); !seen[key] {
+			diff.Fields = append(diff.Fields, fieldDiff{Field: key, Change: "added"})
+		}
+	}
+	return diff, diff.Rows != nil || len(diff.Fields) > 0
+}
+
+// changedValues counts the rows of a and b, of the same type, whose values
+// differ; rows only one of them has count as changed.
+func changedValues(a, b *data.Field) int {
+	n := max(a.Len(), b.Len())
+	changed := 0
+	for i := 0; i < n; i++ {
+		if i >= a.Len() || i >= b.Len() || !sameValue(a.At(i), b.At(i)) {
+			changed++
+		}
+	}
+	return changed
+}
+
+// sameValue compares field values, which may be pointers, treating NaNs as
+// equal.
+func sameValue(a, b any) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Kind() == reflect.Pointer {
+		if va.IsNil() || vb.IsNil() {
+			return va.IsNil() == vb.IsNil()
+		}
+		va, vb = va.Elem(), vb.Elem()
+	}
+	if va.CanFloat() {
+		fa, fb := va.Float(), vb.Float()
+		return fa == fb || (math.IsNaN(fa) && math.IsNaN(fb))
+	}
+	return reflect.DeepEqual(va.Interface(), vb.Interface())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// queryHandler executes a single query of a specific query type.
+type queryHandler func(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error)
+
+// queryHandlers maps backend.DataQuery.QueryType values to their handlers.
+// Queries without a registered query type fall through to the metric lookup.
+var queryHandlers = map[string]queryHandler{}
+
+// queryModels maps query types to the struct their JSON is unmarshalled
+// into, which tells the linter the fields each type accepts.
+var queryModels = map[string]any{}
+
+func registerQueryType(name string, handler queryHandler, model any) {
+	queryHandlers[name] = handler
+	queryModels[name] = model
+}
+
+// queryOptions holds fields any query may set, whatever its type.
+type queryOptions struct {
+	// Timeout, e.g. "5s", bounds how long the query's collectors may run. It
+	// can only shorten the deadline of the request, never extend it.
+	Timeout string `json:"timeout"`
+	// Pipeline post-processes the query's time series, stage by stage.
+	Pipeline []pipelineStage `json:"pipeline"`
+	// LegendFormat, e.g. "{{instance}} {{mode}}", names the series by their
+	// labels, after the pipeline.
+	LegendFormat string `json:"legendFormat"`
+	// OrderBy, e.g. "score desc", sorts the rows of the query's tables, and
+	// Columns, e.g. ["target", "status"], picks their fields and order.
+	OrderBy string   `json:"orderBy"`
+	Columns []string `json:"columns"`
+	// SavedQuery runs the saved query of that name instead, with the other
+	// fields of the query overriding its own.
+	SavedQuery string `json:"savedQuery"`
+	// Export coarsens the results last, for sharing them publicly.
+	Export *exportOptions `json:"export"`
+}
+
+func parseQueryOptions(query backend.DataQuery) (queryOptions, error) {
+	var opts queryOptions
+	if err := json.Unmarshal(query.JSON, &opts); err != nil {
+		return opts, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	return opts, nil
+}
+
+// timeout parses Timeout, which is zero when unset.
+func (opts queryOptions) timeout() (time.Duration, error) {
+	if opts.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(opts.Timeout)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid query timeout %q", opts.Timeout)
+	}
+	return timeout, nil
+}
+
+// withTimeout derives the context a query's collectors run with.
+func (opts queryOptions) withTimeout(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	timeout, err := opts.timeout()
+	if err != nil {
+		return nil, nil, err
+	}
+	if timeout == 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	// WithTimeout keeps the parent's deadline when it is earlier
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
+
+// runInnerQuery runs inner, a query model with its queryType, over the time
+// range of query, for query types deriving their results from those of
+// another query. Inner queries cannot be of the type of query, which would
+// let them recurse.
+func (ds *testDataSource) runInnerQuery(ctx context.Context, query backend.DataQuery, inner json.RawMessage) (data.Frames, error) {
+	var model struct {
+		QueryType string `json:"queryType"`
+	}
+	if err := json.Unmarshal(inner, &model); err != nil {
+		return nil, withCode(codeParseError, fmt.Errorf("invalid query JSON: %w", err))
+	}
+	if model.QueryType == query.QueryType && model.QueryType != "" {
+		return nil, fmt.Errorf("cannot be a %s query itself", model.QueryType)
+	}
+	query.QueryType = model.QueryType
+	query.JSON = inner
+	return ds.queryFrames(ctx, query)
+}
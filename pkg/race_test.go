@@ -0,0 +1,7 @@
+//go:build race
+
+package main
+
+func init() {
+	raceEnabled = true
+}
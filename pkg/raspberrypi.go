@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeRaspberryPi = "raspberrypi"
+
+// raspberryPiCmd reads the firmware's throttling flags, core voltage, SoC
+// temperature and ARM clock with vcgencmd, and the wear and writes of the
+// SD card or eMMC as key=value lines. Wear is only reported by eMMC and
+// industrial cards.
+const raspberryPiCmd = `vcgencmd get_throttled; vcgencmd measure_volts core; vcgencmd measure_temp; vcgencmd measure_clock arm; ` +
+	`for f in life_time pre_eol_info; do [ -r /sys/block/mmcblk0/device/$f ] && echo "$f=$(cat /sys/block/mmcblk0/device/$f)"; done; ` +
+	`[ -r /sys/block/mmcblk0/stat ] && echo "stat=$(cat /sys/block/mmcblk0/stat)"; true`
+
+// Bits of vcgencmd get_throttled: the low ones are set while the condition
+// holds, the high ones once it has happened since boot.
+const (
+	piUnderVoltage    = 1 << 0
+	piFrequencyCapped = 1 << 1
+	piThrottled       = 1 << 2
+	piSoftTempLimit   = 1 << 3
+	piConditionsMask  = piUnderVoltage | piFrequencyCapped | piThrottled | piSoftTempLimit
+	piOccurredShift   = 16
+)
+
+const (
+	// piWearWarning is the share of its life used, in percent, and
+	// piPreEOLWarning the pre-end-of-life state from which a card is
+	// wearing out
+	piWearWarning   = 80
+	piPreEOLWarning = 2
+	// piStatSectorsField is the field of sectors written of a block stat
+	piStatSectorsField = 6
+)
+
+var raspberryPiStates = stateScale{
+	"ok":            severityOK,
+	"throttled":     severityWarning,
+	"wearing out":   severityWarning,
+	"under-voltage": severityCritical,
+}
+
+func init() {
+	registerQueryType(queryTypeRaspberryPi, queryRaspberryPi, hostQuery{})
+	registerConfiguredCheck(queryTypeRaspberryPi, func(ds *testDataSource) bool { return len(ds.settings.SSH.AllHosts()) > 0 })
+}
+
+// raspberryPi is what a Pi reports of its power, temperature and storage.
+// Values it doesn't report are nil.
+type raspberryPi struct {
+	Throttled   int64
+	CoreVoltage *float64
+	SoCTemp     *float64
+	ARMClock    *float64
+	// Wear is the share of the estimated life of the card used, in percent,
+	// and PreEOL its pre-end-of-life state: 1 normal, 2 warning, 3 urgent
+	Wear         *float64
+	PreEOL       *int64
+	BytesWritten *float64
+}
+
+// flags names the conditions of the throttled bits, shifted by shift.
+func (p raspberryPi) flags(shift int) string {
+	var names []string
+	for _, flag := range []struct {
+		bit  int64
+		name string
+	}{
+		{piUnderVoltage, "under-voltage"},
+		{piFrequencyCapped, "frequency capped"},
+		{piThrottled, "throttled"},
+		{piSoftTempLimit, "soft temperature limit"},
+	} {
+		if p.Throttled>>shift&flag.bit != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func (p raspberryPi) status() string {
+	switch {
+	case p.Throttled&piUnderVoltage != 0:
+		return "under-voltage"
+	case p.Throttled&piConditionsMask != 0:
+		return "throttled"
+	case (p.Wear != nil && *p.Wear >= piWearWarning) || (p.PreEOL != nil && *p.PreEOL >= piPreEOLWarning):
+		return "wearing out"
+	}
+	return "ok"
+}
+
+// parseRaspberryPi parses the output of raspberryPiCmd, and reports whether
+// it came from a Pi, which vcgencmd tells.
+func parseRaspberryPi(raw []byte) (raspberryPi, bool, error) {
+	var pi raspberryPi
+	var found bool
+	// number parses the number of a value such as 0.8500V or 48.3'C
+	number := func(s string) (*float64, error) {
+		s = strings.TrimRight(s, "V'C")
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &v, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		var err error
+		switch {
+		case key == "throttled":
+			found = true
+			pi.Throttled, err = strconv.ParseInt(strings.TrimPrefix(value, "0x"), 16, 64)
+		case key == "volt":
+			pi.CoreVoltage, err = number(value)
+		case key == "temp":
+			pi.SoCTemp, err = number(value)
+		case strings.HasPrefix(key, "frequency("):
+			pi.ARMClock, err = number(value)
+		case key == "life_time":
+			// Estimates of the life used of both types of memory, in tenths
+			// from 0x01 (up to 10%) to 0x0B (beyond its life)
+			for _, estimate := range strings.Fields(value) {
+				n, perr := strconv.ParseInt(strings.TrimPrefix(estimate, "0x"), 16, 64)
+				if perr != nil {
+					err = perr
+					break
+				}
+				if n == 0 {
+					continue
+				}
+				wear := float64(min(n, 11)) * 10
+				if pi.Wear == nil || wear > *pi.Wear {
+					pi.Wear = &wear
+				}
+			}
+		case key == "pre_eol_info":
+			var n int64
+			if n, err = strconv.ParseInt(strings.TrimPrefix(value, "0x"), 16, 64); err == nil && n > 0 {
+				pi.PreEOL = &n
+			}
+		case key == "stat":
+			fields := strings.Fields(value)
+			if len(fields) > piStatSectorsField {
+				var sectors float64
+				if sectors, err = strconv.ParseFloat(fields[piStatSectorsField], 64); err == nil {
+					written := sectors * 512
+					pi.BytesWritten = &written
+				}
+			}
+		}
+		if err != nil {
+			return pi, found, fmt.Errorf("invalid %s %q", key, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return pi, found, err
+	}
+	return pi, found, nil
+}
+
+func queryRaspberryPi(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q hostQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	hosts, err := ds.sshHosts(q.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	var piHosts []string
+	pis := map[string]raspberryPi{}
+	for _, host := range hosts {
+		raw, err := ds.runRemoteCommand(ctx, host, raspberryPiCmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vcgencmd on %s: %w", host, err)
+		}
+		pi, found, err := parseRaspberryPi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		// Of all hosts, those without vcgencmd aren't Pis
+		if !found {
+			if q.Host != "" {
+				return nil, fmt.Errorf("%s has no vcgencmd", host)
+			}
+			continue
+		}
+		piHosts = append(piHosts, host)
+		pis[host] = pi
+	}
+
+	return data.Frames{raspberryPiFrame(piHosts, pis)}, nil
+}
+
+func raspberryPiFrame(hosts []string, pis map[string]raspberryPi) *data.Frame {
+	statusField, severityField := newStateFields(raspberryPiStates)
+	frame := data.NewFrame("raspberrypi",
+		data.NewField("host", nil, []string{}),
+		data.NewField("soc_temp", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "celsius"}),
+		data.NewField("core_voltage", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "volt"}),
+		data.NewField("arm_clock", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "hertz"}),
+		data.NewField("throttled", nil, []string{}),
+		data.NewField("throttled_since_boot", nil, []string{}),
+		data.NewField("under_voltage_since_boot", nil, []bool{}),
+		data.NewField("sd_wear", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("sd_pre_eol", nil, []*int64{}),
+		data.NewField("sd_written", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+		statusField,
+		severityField,
+	)
+	for _, host := range hosts {
+		pi := pis[host]
+		status := pi.status()
+		frame.AppendRow(host, pi.SoCTemp, pi.CoreVoltage, pi.ARMClock, pi.flags(0), pi.flags(piOccurredShift),
+			pi.Throttled>>piOccurredShift&piUnderVoltage != 0, pi.Wear, pi.PreEOL, pi.BytesWritten, status, raspberryPiStates.severity(status))
+	}
+	return frame
+}
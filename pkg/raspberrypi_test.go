@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRaspberryPi(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		notPi      bool
+		throttled  int64
+		temp       float64
+		wear       float64
+		written    float64
+		flags      string
+		sinceBoot  string
+		wantStatus string
+		wantErr    string
+	}{
+		{
+			name:       "healthy",
+			raw:        "throttled=0x0\nvolt=0.8500V\ntemp=48.3'C\nfrequency(48)=1500000000\nstat=123 0 456 0 789 0 2048 0 0 0 0\n",
+			temp:       48.3,
+			written:    2048 * 512,
+			wantStatus: "ok",
+		},
+		{
+			name:       "under-voltage now",
+			raw:        "throttled=0x50005\nvolt=0.8000V\ntemp=61.0'C\n",
+			throttled:  0x50005,
+			temp:       61,
+			flags:      "under-voltage, throttled",
+			sinceBoot:  "under-voltage, throttled",
+			wantStatus: "under-voltage",
+		},
+		{
+			name:       "throttled since boot only",
+			raw:        "throttled=0x80000\ntemp=52.1'C\n",
+			throttled:  0x80000,
+			temp:       52.1,
+			sinceBoot:  "soft temperature limit",
+			wantStatus: "ok",
+		},
+		{
+			name:       "frequency capped",
+			raw:        "throttled=0x2\ntemp=80.2'C\n",
+			throttled:  0x2,
+			temp:       80.2,
+			flags:      "frequency capped",
+			wantStatus: "throttled",
+		},
+		{
+			name:       "worn eMMC",
+			raw:        "throttled=0x0\ntemp=45.0'C\nlife_time=0x09 0x02\npre_eol_info=0x01\n",
+			temp:       45,
+			wear:       90,
+			wantStatus: "wearing out",
+		},
+		{
+			name:       "eMMC past pre-EOL warning",
+			raw:        "throttled=0x0\ntemp=45.0'C\nlife_time=0x00 0x03\npre_eol_info=0x02\n",
+			temp:       45,
+			wear:       30,
+			wantStatus: "wearing out",
+		},
+		{name: "not a Pi", raw: "stat=1 0 2 0 3 0 4 0 0 0 0\n", notPi: true, written: 4 * 512, wantStatus: "ok"},
+		{name: "invalid throttled", raw: "throttled=0xzz\n", wantErr: `invalid throttled "0xzz"`},
+		{name: "invalid temperature", raw: "throttled=0x0\ntemp=hot\n", wantErr: `invalid temp "hot"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pi, found, err := parseRaspberryPi([]byte(tt.raw))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found == tt.notPi {
+				t.Errorf("found a Pi %v, want %v", found, !tt.notPi)
+			}
+			if pi.Throttled != tt.throttled {
+				t.Errorf("throttled %#x, want %#x", pi.Throttled, tt.throttled)
+			}
+			if got := valueOr(pi.SoCTemp); got != tt.temp {
+				t.Errorf("SoC temperature %v, want %v", got, tt.temp)
+			}
+			if got := valueOr(pi.Wear); got != tt.wear {
+				t.Errorf("wear %v, want %v", got, tt.wear)
+			}
+			if got := valueOr(pi.BytesWritten); got != tt.written {
+				t.Errorf("bytes written %v, want %v", got, tt.written)
+			}
+			if got := pi.flags(0); got != tt.flags {
+				t.Errorf("flags %q, want %q", got, tt.flags)
+			}
+			if got := pi.flags(piOccurredShift); got != tt.sinceBoot {
+				t.Errorf("flags since boot %q, want %q", got, tt.sinceBoot)
+			}
+			if got := pi.status(); got != tt.wantStatus {
+				t.Errorf("status %q, want %q", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// valueOr returns *v, or 0 if v is nil.
+func valueOr(v *float64) float64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
@@ -0,0 +1,122 @@
+//go:build !nodatabase
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisConn is a minimal RESP client, enough to run INFO and SLOWLOG LEN
+// without pulling in a full Redis library.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialRedis connects to a redis://[:password@]host[:port][/db] URL, if egress
+// allows it.
+func dialRedis(ctx context.Context, dsn string, egress *egressPolicy) (*redisConn, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	conn, err := egress.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis at %s: %w", addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if user := u.User.Username(); user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if _, err := c.do(args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("redis AUTH failed: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and returns its reply as a string. Integer replies are
+// returned in decimal form.
+func (c *redisConn) do(args ...string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return "", err
+	}
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("empty Redis reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("invalid bulk length %q", line)
+		}
+		if n < 0 {
+			return "", nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return "", err
+		}
+		return string(buf[:n]), nil
+	}
+
+	return "", fmt.Errorf("unsupported Redis reply type %q", line[0])
+}
+
+// parseRedisInfo parses INFO output into a flat key/value map.
+func parseRedisInfo(info string) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			values[k] = v
+		}
+	}
+	return values
+}
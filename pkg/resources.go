@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// resourceAPIPrefix versions the resource API. Breaking changes to routes
+// go under a new prefix, so external tooling keeps working across releases.
+const resourceAPIPrefix = "/api/v1"
+
+// resourceRoute is a resource API route. Routes are described in the
+// OpenAPI document served at /api/openapi.json.
+type resourceRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	// Query lists the optional query parameters of the route, and Body is
+	// set when it takes a JSON body
+	Query   []string
+	Body    bool
+	Handler http.HandlerFunc
+	// Admin restricts the route to Grafana admins: Grafana lets anyone who
+	// may query the data source call its resources
+	Admin bool
+}
+
+// resourceRoutes are the resource calls used by the query editor for metric
+// name and label completion, query linting and capability discovery. Metric
+// routes take an optional "target" query parameter, with the same meaning as
+// in queries.
+func (ds *testDataSource) resourceRoutes() []resourceRoute {
+	return []resourceRoute{
+		{Method: http.MethodGet, Path: "/metrics/names", Summary: "List metric names", Query: []string{"target"}, Handler: ds.handleMetricNames},
+		{Method: http.MethodGet, Path: "/metrics/{name}/labels", Summary: "List the label values of a metric", Query: []string{"target"}, Handler: ds.handleMetricLabels},
+		{Method: http.MethodGet, Path: "/targets", Summary: "List targets and their labels", Handler: ds.handleTargets},
+		{Method: http.MethodDelete, Path: "/targets/{target}/history", Summary: "Delete series, or their values within a time range, from the history of a target; dry run first for a confirm token", Query: []string{"metric", "label", "from", "to", "dryRun", "confirm"}, Handler: ds.handlePurgeHistory, Admin: true},
+		{Method: http.MethodGet, Path: "/targets/groups", Summary: "Group targets by labels, nested in the order given", Query: []string{"by"}, Handler: ds.handleTargetGroups},
+		{Method: http.MethodGet, Path: "/targets/groups/{label}/{value}/dashboard", Summary: "Generate the dashboard of the targets with a label value", Handler: ds.handleGroupDashboard},
+		{Method: http.MethodGet, Path: "/health", Summary: "Check the health of all targets", Handler: ds.handleHealth},
+		{Method: http.MethodGet, Path: "/grpc/services", Summary: "List the services and methods of gRPC targets", Query: []string{"target"}, Handler: ds.handleGRPCServices},
+		{Method: http.MethodPost, Path: "/lint/query", Summary: "Lint a query", Body: true, Handler: ds.handleLintQuery},
+		{Method: http.MethodPost, Path: "/query/diff", Summary: "Run a query over two time ranges or in two versions and diff the results", Body: true, Handler: ds.handleQueryDiff},
+		{Method: http.MethodPost, Path: "/query/explain", Summary: "Explain how a query resolves, without running it", Body: true, Handler: ds.handleExplainQuery},
+		{Method: http.MethodGet, Path: "/baseline", Summary: "Describe the metrics baseline", Handler: ds.handleGetBaseline},
+		{Method: http.MethodPost, Path: "/baseline", Summary: "Capture the metrics baseline now", Handler: ds.handleCaptureBaseline, Admin: true},
+		{Method: http.MethodGet, Path: "/operations", Summary: "List the long-running operations, running and finished, newest first", Handler: ds.handleListOperations},
+		{Method: http.MethodGet, Path: "/operations/{id}", Summary: "Get the progress of an operation, and the Grafana Live channel streaming it", Handler: ds.handleGetOperation},
+		{Method: http.MethodDelete, Path: "/operations/{id}", Summary: "Cancel a running operation", Handler: ds.handleCancelOperation, Admin: true},
+		{Method: http.MethodPost, Path: "/operations/compact", Summary: "Compact the histories of targets as an operation", Query: []string{"target"}, Handler: ds.handleCompactOperation, Admin: true},
+		{Method: http.MethodPost, Path: "/operations/fio", Summary: "Run the fio benchmarks now as an operation", Handler: ds.handleFioOperation, Admin: true},
+		{Method: http.MethodPost, Path: "/operations/iperf", Summary: "Run the iperf3 tests now as an operation", Handler: ds.handleIperfOperation, Admin: true},
+		{Method: http.MethodGet, Path: "/kiosk/summary", Summary: "Summarize the alerts firing and key stats compactly, for e-ink displays and kiosk scripts", Query: []string{"format"}, Handler: ds.handleKioskSummary},
+		{Method: http.MethodGet, Path: "/digest", Summary: "Compile the digest of the last period without sending it", Handler: ds.handleDigest},
+		{Method: http.MethodGet, Path: "/audit", Summary: "List configuration changes, newest first", Query: []string{"kind", "user", "since", "limit"}, Handler: ds.handleAudit, Admin: true},
+		{Method: http.MethodGet, Path: "/features", Summary: "List experimental features", Handler: ds.handleFeatures},
+		{Method: http.MethodPost, Path: "/admin/import/prometheus", Summary: "Convert the scrape_configs of a prometheus.yml into targets", Body: true, Handler: ds.handleImportPrometheus, Admin: true},
+		{Method: http.MethodGet, Path: "/admin/state", Summary: "Check the files of the state directory for damage left by crashes", Handler: ds.handleStateCheck, Admin: true},
+		{Method: http.MethodPost, Path: "/admin/repair", Summary: "Repair the damage found in the files of the state directory as an operation", Handler: ds.handleRepair, Admin: true},
+		{Method: http.MethodPost, Path: "/admin/rotate-check", Summary: "Verify candidate credentials against the targets they apply to", Body: true, Handler: ds.handleRotateCheck, Admin: true},
+		{Method: http.MethodGet, Path: "/debug/faults", Summary: "List injected scrape faults", Handler: ds.handleListFaults, Admin: true},
+		{Method: http.MethodPost, Path: "/debug/faults", Summary: "Inject a scrape fault", Body: true, Handler: ds.handleInjectFault, Admin: true},
+		{Method: http.MethodDelete, Path: "/debug/faults", Summary: "Clear injected scrape faults; dry run first for a confirm token", Query: []string{"target", "dryRun", "confirm"}, Handler: ds.handleClearFaults, Admin: true},
+		{Method: http.MethodGet, Path: "/usage", Summary: "List the queries and scrapes of each dashboard panel", Handler: ds.handleUsage, Admin: true},
+		{Method: http.MethodGet, Path: "/debug/slowqueries", Summary: "List the last slow queries, newest first", Handler: ds.handleSlowQueries},
+		{Method: http.MethodGet, Path: "/about", Summary: "Describe the running plugin version and the releases since", Handler: ds.handleAbout},
+		{Method: http.MethodGet, Path: "/help", Summary: "Describe the metrics of the targets and example queries on them", Handler: ds.handleHelp},
+		{Method: http.MethodGet, Path: "/queries", Summary: "List the saved queries of the user and those shared", Handler: ds.handleListSavedQueries},
+		{Method: http.MethodGet, Path: "/queries/{name}", Summary: "Get a saved query", Handler: ds.handleGetSavedQuery},
+		{Method: http.MethodPut, Path: "/queries/{name}", Summary: "Save a query, owned by the user", Body: true, Handler: ds.handleSaveQuery},
+		{Method: http.MethodPost, Path: "/queries/{name}/share", Summary: "Share a saved query with all users, or stop sharing it", Body: true, Handler: ds.handleShareSavedQuery},
+		{Method: http.MethodDelete, Path: "/queries/{name}", Summary: "Delete a saved query; dry run first for a confirm token", Query: []string{"dryRun", "confirm"}, Handler: ds.handleDeleteSavedQuery},
+		{Method: http.MethodGet, Path: "/personal", Summary: "List the people series are tagged as about, and the tags of their series", Handler: ds.handleListPersonal},
+		{Method: http.MethodGet, Path: "/personal/{person}/export", Summary: "Export the values kept of the series of a person, as that person or an admin", Handler: ds.handleExportPersonal},
+		{Method: http.MethodDelete, Path: "/personal/{person}", Summary: "Delete the series of a person, as that person or an admin; dry run first for a confirm token", Query: []string{"dryRun", "confirm"}, Handler: ds.handleDeletePersonal},
+		{Method: http.MethodGet, Path: "/schemas", Summary: "List the push schemas, the targets using them and their last rejected message", Handler: ds.handleListSchemas},
+		{Method: http.MethodPost, Path: "/schemas/{name}/validate", Summary: "Check a JSON message against a push schema and map it to samples", Body: true, Handler: ds.handleValidateSchema},
+		{Method: http.MethodGet, Path: "/agent-updates/fleet", Summary: "List the agents checking for updates and their versions", Handler: ds.handleAgentFleet},
+		{Method: http.MethodGet, Path: "/browser/{check}/screenshot", Summary: "Get the screenshot of the last run of a browser check", Handler: ds.handleBrowserScreenshot},
+		{Method: http.MethodGet, Path: "/capabilities", Summary: "List query types and whether they can run", Handler: ds.handleCapabilities},
+	}
+}
+
+func (ds *testDataSource) resourceMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	routes := ds.resourceRoutes()
+	for _, route := range routes {
+		handler := route.Handler
+		if route.Admin {
+			handler = adminOnly(handler)
+		}
+		mux.HandleFunc(route.Method+" "+resourceAPIPrefix+route.Path, handler)
+	}
+	mux.HandleFunc("GET /api/openapi.json", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, openAPIDocument(routes))
+	})
+	return mux
+}
+
+// adminOnly answers 403 to callers other than Grafana admins.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := backend.PluginConfigFromContext(r.Context()).User
+		if user == nil || user.Role != grafanaAdminRole {
+			writeJSONError(w, http.StatusForbidden, fmt.Errorf("%s %s is for Grafana admins only", r.Method, r.URL.Path))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		backend.Logger.Warn("Failed to write resource response", "error", err)
+	}
+}
+
+// writeJSONError writes err, with its code when it has one.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	body := map[string]string{"error": err.Error()}
+	if code := codeOf(err); code != "" {
+		body["code"] = string(code)
+	}
+	writeJSON(w, status, body)
+}
+
+// discoverForResource scrapes the targets selected by the "target" query
+// parameter, through the scrape cache, and returns their discovery index.
+// Targets not scraped yet since a restart use their stored index, if any,
+// rather than holding up completion. It writes an error response and
+// returns false on failure.
+func (ds *testDataSource) discoverForResource(w http.ResponseWriter, r *http.Request) (*discoveryIndex, bool) {
+	targets, err := ds.selectTargets(r.URL.Query().Get("target"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	indexes := make([]*discoveryIndex, 0, len(targets))
+	for _, target := range targets {
+		if target.discovery() == nil {
+			if stored := ds.discoveryStore.get(target.Name); stored != nil {
+				indexes = append(indexes, stored)
+				continue
+			}
+		}
+		if _, err := ds.scrapeMetrics(r.Context(), target); err != nil {
+			writeJSONError(w, http.StatusBadGateway, fmt.Errorf("target %s: %w", target.Name, err))
+			return nil, false
+		}
+		if index := target.discovery(); index != nil {
+			indexes = append(indexes, index)
+		}
+	}
+	return mergeDiscovery(indexes), true
+}
+
+// handleMetricNames returns the sorted names usable as a query's metric:
+// metric families and their _bucket, _sum and _count series.
+func (ds *testDataSource) handleMetricNames(w http.ResponseWriter, r *http.Request) {
+	index, ok := ds.discoverForResource(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, index.Names)
+}
+
+// handleMetricLabels returns the label names of a metric, each with its
+// sorted values.
+func (ds *testDataSource) handleMetricLabels(w http.ResponseWriter, r *http.Request) {
+	index, ok := ds.discoverForResource(w, r)
+	if !ok {
+		return
+	}
+
+	name := r.PathValue("name")
+	labels, found := index.Labels[name]
+	if !found {
+		writeJSONError(w, http.StatusNotFound, withCode(codeMetricNotFound, fmt.Errorf("metric %s not found", name)))
+		return
+	}
+	writeJSON(w, http.StatusOK, labels)
+}
+
+func (ds *testDataSource) handleHealth(w http.ResponseWriter, r *http.Request) {
+	result, err := ds.CheckHealth(r.Context(), &backend.CheckHealthRequest{})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status := http.StatusOK
+	if result.Status != backend.HealthStatusOk {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]any{
+		"status":  result.Status.String(),
+		"message": result.Message,
+		"details": json.RawMessage(result.JSONDetails),
+	})
+}
+
+type targetInfo struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	// ClockSkewSeconds is how far the target's clock is ahead of the
+	// plugin's, for targets timestamping their samples
+	ClockSkewSeconds *float64 `json:"clockSkewSeconds,omitempty"`
+}
+
+// handleTargets lists the scrape targets, with their labels and clock skew.
+func (ds *testDataSource) handleTargets(w http.ResponseWriter, _ *http.Request) {
+	if ds.configErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid configuration: %w", ds.configErr))
+		return
+	}
+	targets := make([]targetInfo, 0, len(ds.targets))
+	for _, t := range ds.targets {
+		labels := t.Labels
+		if labels == nil {
+			labels = data.Labels{}
+		}
+		info := targetInfo{Name: t.Name, Labels: labels}
+		if skew, ok := t.clock.get(); ok {
+			seconds := skew.Seconds()
+			info.ClockSkewSeconds = &seconds
+		}
+		targets = append(targets, info)
+	}
+	writeJSON(w, http.StatusOK, targets)
+}
+
+// handlePurgeHistory deletes series from the history of a target, such as
+// the junk of a test device: those whose name or family is the metric
+// parameter and that have the label=value of each label parameter, or all
+// of them without either. With from or to, RFC 3339 times, only their
+// values within the range are deleted. The high-resolution buffer is
+// purged alike, and both are compacted by an operation after.
+func (ds *testDataSource) handlePurgeHistory(w http.ResponseWriter, r *http.Request) {
+	if ds.configErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid configuration: %w", ds.configErr))
+		return
+	}
+	name := r.PathValue("target")
+	i := slices.IndexFunc(ds.targets, func(t *scrapeTarget) bool { return t.Name == name })
+	if i < 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no target %q", name))
+		return
+	}
+	target := ds.targets[i]
+	query := r.URL.Query()
+	sel := seriesSelector{Metric: query.Get("metric")}
+	for _, pair := range query["label"] {
+		label, value, ok := strings.Cut(pair, "=")
+		if !ok || label == "" {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid label %q, expected name=value", pair))
+			return
+		}
+		if sel.Labels == nil {
+			sel.Labels = map[string]string{}
+		}
+		sel.Labels[label] = value
+	}
+	from, err := parseBound(query, "from")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseBound(query, "to")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("to is before from"))
+		return
+	}
+
+	histories := []*scrapeHistory{target.history}
+	if target.highRes != nil {
+		histories = append(histories, target.highRes.history)
+	}
+	plan := func() ([]string, int, error) {
+		removes := target.history.matching(sel, from, to)
+		if target.highRes != nil {
+			for _, s := range target.highRes.history.matching(sel, from, to) {
+				removes = append(removes, "high-resolution "+s)
+			}
+		}
+		return removes, 0, nil
+	}
+	ds.destructive(w, r, plan, func() error {
+		for _, h := range histories {
+			h.purge(sel, from, to)
+		}
+		ds.audit.record(r.Context(), auditKindHistory, purgeSummary(name, sel, from, to))
+		ds.compactAfterPurge(r.Context(), []*scrapeTarget{target})
+		return nil
+	})
+}
+
+// parseBound parses the RFC 3339 time of the query parameter name, zero
+// when it is not set.
+func parseBound(query url.Values, name string) (time.Time, error) {
+	s := query.Get(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return t, nil
+}
+
+// purgeSummary describes a purge for the audit log.
+func purgeSummary(target string, sel seriesSelector, from, to time.Time) string {
+	what := "the history of " + target
+	if sel.Metric != "" || len(sel.Labels) > 0 {
+		what = fmt.Sprintf("the %s series of %s", sel, target)
+	}
+	switch {
+	case !from.IsZero() && !to.IsZero():
+		return fmt.Sprintf("Purged %s from %s to %s", what, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	case !from.IsZero():
+		return fmt.Sprintf("Purged %s from %s on", what, from.Format(time.RFC3339))
+	case !to.IsZero():
+		return fmt.Sprintf("Purged %s up to %s", what, to.Format(time.RFC3339))
+	}
+	return "Purged " + what
+}
+
+// targetGroup is the targets with one value of a label, split further by the
+// next label asked for.
+type targetGroup struct {
+	Label   string        `json:"label"`
+	Value   string        `json:"value"`
+	Targets []string      `json:"targets"`
+	Groups  []targetGroup `json:"groups,omitempty"`
+}
+
+// handleTargetGroups groups the targets by the comma separated labels of the
+// "by" query parameter, e.g. by=tier,room for the rooms within each tier.
+// Targets without a label are grouped under the empty value.
+func (ds *testDataSource) handleTargetGroups(w http.ResponseWriter, r *http.Request) {
+	if ds.configErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid configuration: %w", ds.configErr))
+		return
+	}
+	by := strings.Split(r.URL.Query().Get("by"), ",")
+	if len(by) == 1 && by[0] == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("no labels to group by"))
+		return
+	}
+	writeJSON(w, http.StatusOK, groupTargets(ds.targets, by))
+}
+
+func groupTargets(targets []*scrapeTarget, by []string) []targetGroup {
+	if len(by) == 0 {
+		return nil
+	}
+	label := strings.TrimSpace(by[0])
+	members := map[string][]*scrapeTarget{}
+	for _, t := range targets {
+		members[t.Labels[label]] = append(members[t.Labels[label]], t)
+	}
+	values := make([]string, 0, len(members))
+	for v := range members {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	groups := make([]targetGroup, 0, len(values))
+	for _, v := range values {
+		names := make([]string, len(members[v]))
+		for i, t := range members[v] {
+			names[i] = t.Name
+		}
+		groups = append(groups, targetGroup{
+			Label:   label,
+			Value:   v,
+			Targets: names,
+			Groups:  groupTargets(members[v], by[1:]),
+		})
+	}
+	return groups
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// adminRoutes are the routes changing or deleting data, running work on
+// hosts, or revealing what other users do.
+var adminRoutes = []string{
+	"DELETE /targets/{target}/history",
+	"POST /baseline",
+	"DELETE /operations/{id}",
+	"POST /operations/compact",
+	"GET /audit",
+	"POST /admin/import/prometheus",
+	"GET /admin/state",
+	"POST /admin/repair",
+	"POST /admin/rotate-check",
+	"GET /usage",
+	"GET /debug/faults",
+	"POST /debug/faults",
+	"DELETE /debug/faults",
+	"POST /operations/fio",
+	"POST /operations/iperf",
+}
+
+// resourceRequest returns a request of route as user, nil for none, with
+// its path parameters set to "x".
+func resourceRequest(route resourceRoute, user *backend.User) *http.Request {
+	path := resourceAPIPrefix + pathParamPattern.ReplaceAllString(route.Path, "x")
+	r := httptest.NewRequest(route.Method, path, nil)
+	ctx := backend.WithPluginContext(context.Background(), backend.PluginContext{User: user})
+	return r.WithContext(ctx)
+}
+
+func TestAdminRoutes(t *testing.T) {
+	ds := newTestDataSource()
+	ds.usage = newUsageTracker()
+	routes := ds.resourceRoutes()
+	mux := ds.resourceMux()
+
+	for _, want := range adminRoutes {
+		if !slices.ContainsFunc(routes, func(r resourceRoute) bool { return r.Method+" "+r.Path == want && r.Admin }) {
+			t.Errorf("%s is not restricted to admins", want)
+		}
+	}
+	for _, route := range routes {
+		if !route.Admin {
+			continue
+		}
+		for _, user := range []*backend.User{nil, {Login: "kid", Role: "Viewer"}, {Login: "partner", Role: "Editor"}} {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, resourceRequest(route, user))
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s %s as %v: got %d, want 403", route.Method, route.Path, user, w.Code)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	usage := routes[slices.IndexFunc(routes, func(r resourceRoute) bool { return r.Path == "/usage" })]
+	mux.ServeHTTP(w, resourceRequest(usage, &backend.User{Login: "admin", Role: grafanaAdminRole}))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /usage as admin: got %d, want 200", w.Code)
+	}
+}
+
+// TestPurgeHistoryRoute purges a series from the history of a target with
+// a dry run, then its confirm token.
+func TestPurgeHistoryRoute(t *testing.T) {
+	ds := newTestDataSource()
+	ds.uid = "homelab"
+	ds.confirms = newConfirmTokens()
+	ds.operations = newOperationTracker(context.Background(), ds.uid)
+	ds.audit = auditLogFor(t.TempDir(), ds.uid)
+	mux := ds.resourceMux()
+	admin := &backend.User{Login: "admin", Role: grafanaAdminRole}
+	purge := func(target string, query url.Values, user *backend.User) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, resourceAPIPrefix+"/targets/"+target+"/history?"+query.Encode(), nil)
+		r = r.WithContext(backend.WithPluginContext(context.Background(), backend.PluginContext{User: user}))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	invalid := []struct {
+		name   string
+		target string
+		query  url.Values
+		status int
+	}{
+		{name: "unknown target", target: "printer", query: url.Values{"dryRun": {"true"}}, status: http.StatusNotFound},
+		{name: "invalid label", target: "nas", query: url.Values{"label": {"device"}, "dryRun": {"true"}}, status: http.StatusBadRequest},
+		{name: "invalid time", target: "nas", query: url.Values{"from": {"yesterday"}, "dryRun": {"true"}}, status: http.StatusBadRequest},
+		{name: "range backwards", target: "nas", query: url.Values{"from": {"2024-01-01T01:00:00Z"}, "to": {"2024-01-01T00:00:00Z"}, "dryRun": {"true"}}, status: http.StatusBadRequest},
+		{name: "without confirm token", target: "nas", query: url.Values{"metric": {"node_load1"}}, status: http.StatusPreconditionRequired},
+	}
+	for _, tt := range invalid {
+		if w := purge(tt.target, tt.query, admin); w.Code != tt.status {
+			t.Errorf("%s: got %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	query := url.Values{"metric": {"node_load1"}, "dryRun": {"true"}}
+	w := purge("nas", query, admin)
+	var plan removal
+	if err := json.Unmarshal(w.Body.Bytes(), &plan); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("dry run: got %d: %s", w.Code, w.Body)
+	}
+	if !slices.Equal(plan.Removes, []string{"node_load1"}) || plan.ConfirmToken == "" {
+		t.Fatalf("dry run: got %+v, want node_load1 removed and a confirm token", plan)
+	}
+	if got := historyPoints(t, ds.targets[0].history, "node_load1"); len(got) == 0 {
+		t.Fatal("dry run purged the series")
+	}
+
+	query.Del("dryRun")
+	query.Set("confirm", plan.ConfirmToken)
+	if w := purge("nas", query, admin); w.Code != http.StatusOK {
+		t.Fatalf("purge: got %d: %s", w.Code, w.Body)
+	}
+	if got := historyPoints(t, ds.targets[0].history, "node_load1"); len(got) != 0 {
+		t.Errorf("node_load1 of nas has %d points left after purge", len(got))
+	}
+	if got := historyPoints(t, ds.targets[1].history, "node_load1"); len(got) == 0 {
+		t.Error("node_load1 of router purged along")
+	}
+	entries, _ := ds.audit.list(auditKindHistory, "", time.Time{}, 10)
+	if len(entries) != 1 || !strings.Contains(entries[0].Summary, "node_load1") || entries[0].User != "admin" {
+		t.Errorf("audit entries %+v, want the purge by admin", entries)
+	}
+	// The token is spent
+	if w := purge("nas", query, admin); w.Code == http.StatusOK {
+		t.Error("confirm token redeemed twice")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+// Credentials rotate by saving new secure settings: the instance manager
+// then creates a new instance with them and disposes of the old one, which
+// lets its scrapes in flight finish. The rotate check verifies new
+// credentials against the targets before they are saved, while the old ones
+// still work.
+
+// secretHashes fingerprints secure settings, to tell which of them changed
+// between instances.
+func secretHashes(secure map[string]string) map[string][sha256.Size]byte {
+	hashes := make(map[string][sha256.Size]byte, len(secure))
+	for key, value := range secure {
+		hashes[key] = sha256.Sum256([]byte(value))
+	}
+	return hashes
+}
+
+// changedSecrets returns the sorted keys of secure settings that were added,
+// changed or removed.
+func changedSecrets(old, current map[string][sha256.Size]byte) []string {
+	var changed []string
+	for key, hash := range current {
+		if oldHash, ok := old[key]; !ok || oldHash != hash {
+			changed = append(changed, key)
+		}
+	}
+	for key := range old {
+		if _, ok := current[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// withUID returns a live instance of the data source uid other than ds, or
+// nil.
+func (s *instanceSet) withUID(uid string, ds *testDataSource) *testDataSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for other := range s.instances {
+		if other != ds && other.uid == uid {
+			return other
+		}
+	}
+	return nil
+}
+
+// rotateCheckRequest holds candidate credentials, by the secure settings
+// they would replace.
+type rotateCheckRequest struct {
+	BasicAuthPassword   string            `json:"basicAuthPassword"`
+	TargetTokens        map[string]string `json:"targetTokens"`
+	OAuth2ClientSecrets map[string]string `json:"oauth2ClientSecrets"`
+	SessionPasswords    map[string]string `json:"sessionPasswords"`
+}
+
+type rotateCheckResult struct {
+	Target string `json:"target"`
+	// Credentials are the candidate credentials the target was scraped with
+	Credentials []string `json:"credentials"`
+	OK          bool     `json:"ok"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// candidateTarget returns a copy of target using the candidate credentials
+// of req, and which of them it uses, or nil if none apply to it. Push
+// sources are not checked, as they are not scraped, nor are gRPC services.
+func (ds *testDataSource) candidateTarget(target *scrapeTarget, req rotateCheckRequest) (*scrapeTarget, []string) {
+	if target.push != nil || target.grpc != nil {
+		return nil, nil
+	}
+	candidate := &scrapeTarget{Name: target.Name, URL: target.URL, Token: target.Token, oauth2: target.oauth2, session: target.session, parser: target.parser}
+	var credentials []string
+	if token, ok := req.TargetTokens[target.Name]; ok {
+		candidate.Token = token
+		credentials = append(credentials, "targetToken_"+target.Name)
+	}
+	if secret, ok := req.OAuth2ClientSecrets[target.Name]; ok && target.oauth2 != nil {
+		candidate.oauth2 = newOAuth2Source(target.oauth2.settings, secret)
+		credentials = append(credentials, "oauth2ClientSecret_"+target.Name)
+	}
+	if password, ok := req.SessionPasswords[target.Name]; ok && target.session != nil {
+		candidate.session = newWebSession(target.session.settings, password)
+		credentials = append(credentials, "sessionPassword_"+target.Name)
+	}
+	if req.BasicAuthPassword != "" {
+		credentials = append(credentials, "basicAuthPassword")
+	}
+	if len(credentials) == 0 {
+		return nil, nil
+	}
+	return candidate, credentials
+}
+
+// handleRotateCheck scrapes the targets that candidate credentials apply to
+// with them, so they can be verified before they replace the current ones.
+// Nothing is kept: the credentials take effect once saved in the data
+// source settings.
+func (ds *testDataSource) handleRotateCheck(w http.ResponseWriter, r *http.Request) {
+	if ds.configErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid configuration: %w", ds.configErr))
+		return
+	}
+	var req rotateCheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("failed to decode credentials: %w", err))
+		return
+	}
+
+	checker := &testDataSource{httpClient: ds.httpClient}
+	if req.BasicAuthPassword != "" {
+		if ds.settings.BasicAuthUser == "" {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("basic auth is not configured"))
+			return
+		}
+		opts := ds.clientOpts
+		opts.BasicAuth = &httpclient.BasicAuthOptions{User: ds.settings.BasicAuthUser, Password: req.BasicAuthPassword}
+		client, err := httpclient.New(opts)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("failed to create HTTP client: %w", err))
+			return
+		}
+		checker.httpClient = client
+	}
+
+	var candidates []*scrapeTarget
+	var results []rotateCheckResult
+	for _, target := range ds.targets {
+		if candidate, credentials := ds.candidateTarget(target, req); candidate != nil {
+			candidates = append(candidates, candidate)
+			results = append(results, rotateCheckResult{Target: target.Name, Credentials: credentials})
+		}
+	}
+	if len(candidates) == 0 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("no candidate credentials apply to the configured targets"))
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i, candidate := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := checker.httpGetTarget(r.Context(), candidate); err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].OK = true
+		}()
+	}
+	wg.Wait()
+
+	ok := true
+	for _, result := range results {
+		ok = ok && result.OK
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": ok, "targets": results})
+}
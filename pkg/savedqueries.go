@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// auditKindSavedQueries is the kind of audited changes to saved queries.
+const auditKindSavedQueries = "savedQueries"
+
+// savedQueryNamePattern restricts the names of saved queries to ones fit
+// for paths and dashboards alike.
+var savedQueryNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// savedQuery is a named query kept by the plugin for reuse across
+// dashboards. Queries are only visible to their owner until shared.
+type savedQuery struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Owner       string          `json:"owner,omitempty"`
+	Shared      bool            `json:"shared"`
+	Query       json.RawMessage `json:"query"`
+	Updated     time.Time       `json:"updated"`
+}
+
+// visibleTo reports whether user may see and run q.
+func (q *savedQuery) visibleTo(user string) bool {
+	return q.Shared || q.Owner == user
+}
+
+// savedQueryLibrary keeps the saved queries of a data source, in a file of
+// the state directory or in memory without one. Instances of a data source
+// share its library.
+type savedQueryLibrary struct {
+	// path is empty when the library is kept in memory
+	path string
+
+	mu      sync.Mutex
+	queries map[string]*savedQuery
+}
+
+var savedQueryLibraries = struct {
+	mu        sync.Mutex
+	libraries map[string]*savedQueryLibrary
+}{libraries: map[string]*savedQueryLibrary{}}
+
+// savedQueriesFor returns the library of data source uid, reading it from
+// stateDir on first use.
+func savedQueriesFor(stateDir, uid string) *savedQueryLibrary {
+	path := ""
+	if stateDir != "" {
+		path = filepath.Join(stateDir, url.PathEscape(uid), "queries.json")
+	}
+	key := path + "\x00" + uid
+
+	savedQueryLibraries.mu.Lock()
+	defer savedQueryLibraries.mu.Unlock()
+	if l, ok := savedQueryLibraries.libraries[key]; ok {
+		return l
+	}
+	l := &savedQueryLibrary{path: path, queries: map[string]*savedQuery{}}
+	if path != "" {
+		l.load()
+	}
+	savedQueryLibraries.libraries[key] = l
+	return l
+}
+
+func (l *savedQueryLibrary) load() {
+	body, err := os.ReadFile(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		backend.Logger.Warn("Failed to read saved queries", "error", err)
+		return
+	}
+	var queries []*savedQuery
+	if err := json.Unmarshal(body, &queries); err != nil {
+		backend.Logger.Warn("Ignoring corrupt saved queries", "error", err)
+		return
+	}
+	for _, q := range queries {
+		l.queries[q.Name] = q
+	}
+}
+
+// save writes the queries aside and renames them, so a crash never leaves
+// a partial file. l.mu must be held.
+func (l *savedQueryLibrary) save() error {
+	if l.path == "" {
+		return nil
+	}
+	body, err := json.Marshal(l.sorted(func(*savedQuery) bool { return true }))
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(l.path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, ".queries-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
+
+// sorted returns the queries keep keeps, by name. l.mu must be held.
+func (l *savedQueryLibrary) sorted(keep func(*savedQuery) bool) []*savedQuery {
+	queries := make([]*savedQuery, 0, len(l.queries))
+	for _, q := range l.queries {
+		if keep(q) {
+			queries = append(queries, q)
+		}
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i].Name < queries[j].Name })
+	return queries
+}
+
+// errSavedQueryNotFound is returned for queries that don't exist or that
+// the user may not see, which are not told apart.
+var errSavedQueryNotFound = errors.New("saved query not found")
+
+// errNotSavedQueryOwner is returned when changing a query of another user.
+var errNotSavedQueryOwner = errors.New("only the owner of a saved query can change it")
+
+// get returns the query name if user may see it.
+func (l *savedQueryLibrary) get(name, user string) (savedQuery, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q, ok := l.queries[name]
+	if !ok || !q.visibleTo(user) {
+		return savedQuery{}, fmt.Errorf("%w: %s", errSavedQueryNotFound, name)
+	}
+	return *q, nil
+}
+
+// list returns the queries user may see, by name.
+func (l *savedQueryLibrary) list(user string) []*savedQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queries := l.sorted(func(q *savedQuery) bool { return q.visibleTo(user) })
+	copied := make([]*savedQuery, len(queries))
+	for i, q := range queries {
+		c := *q
+		copied[i] = &c
+	}
+	return copied
+}
+
+// update applies change to the query name, which must be owned by user,
+// or creates it for user when create is set.
+func (l *savedQueryLibrary) update(name, user string, create bool, change func(*savedQuery)) (savedQuery, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q, ok := l.queries[name]
+	switch {
+	case !ok && !create, ok && !q.visibleTo(user):
+		return savedQuery{}, fmt.Errorf("%w: %s", errSavedQueryNotFound, name)
+	case ok && q.Owner != user:
+		return savedQuery{}, errNotSavedQueryOwner
+	}
+	updated := savedQuery{Name: name, Owner: user}
+	if ok {
+		updated = *q
+	}
+	change(&updated)
+	updated.Updated = time.Now().UTC()
+	l.queries[name] = &updated
+	if err := l.save(); err != nil {
+		if ok {
+			l.queries[name] = q
+		} else {
+			delete(l.queries, name)
+		}
+		return savedQuery{}, fmt.Errorf("failed to save queries: %w", err)
+	}
+	return updated, nil
+}
+
+// remove deletes the query name, which must be owned by user.
+func (l *savedQueryLibrary) remove(name, user string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.removable(name, user); err != nil {
+		return err
+	}
+	q := l.queries[name]
+	delete(l.queries, name)
+	if err := l.save(); err != nil {
+		l.queries[name] = q
+		return fmt.Errorf("failed to save queries: %w", err)
+	}
+	return nil
+}
+
+// removable returns why user can't remove the query name, or nil. l.mu
+// must be held.
+func (l *savedQueryLibrary) removable(name, user string) error {
+	q, ok := l.queries[name]
+	switch {
+	case !ok || !q.visibleTo(user):
+		return fmt.Errorf("%w: %s", errSavedQueryNotFound, name)
+	case q.Owner != user:
+		return errNotSavedQueryOwner
+	}
+	return nil
+}
+
+// savedQueryFields are set by Grafana for the panel a query is in, and not
+// saved with it.
+var savedQueryFields = []string{
+	"refId", "datasource", "datasourceId", "hide", "key", "intervalMs", "maxDataPoints", "scopedVars",
+}
+
+// normalizeSavedQuery returns the JSON of query as saved, without the
+// fields Grafana sets for the panel it came from.
+func normalizeSavedQuery(query json.RawMessage) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(query))
+	decoder.UseNumber() // keep large integers intact
+	var raw map[string]any
+	if err := decoder.Decode(&raw); err != nil || raw == nil {
+		return nil, fmt.Errorf("query must be a JSON object")
+	}
+	if _, ok := raw["savedQuery"]; ok {
+		return nil, fmt.Errorf("saved queries cannot refer to other saved queries")
+	}
+	for _, name := range savedQueryFields {
+		delete(raw, name)
+	}
+	return json.Marshal(raw)
+}
+
+// resolveSavedQuery replaces a query setting savedQuery by the saved query
+// of that name, which the fields it sets itself, such as a legend format,
+// override. Other queries are returned as they are.
+func (ds *testDataSource) resolveSavedQuery(ctx context.Context, query backend.DataQuery) (backend.DataQuery, error) {
+	var ref struct {
+		SavedQuery string `json:"savedQuery"`
+	}
+	if err := json.Unmarshal(query.JSON, &ref); err != nil {
+		return query, withCode(codeParseError, fmt.Errorf("failed to unmarshal query JSON: %w", err))
+	}
+	if ref.SavedQuery == "" {
+		return query, nil
+	}
+	saved, err := ds.savedQueries.get(ref.SavedQuery, auditUser(ctx))
+	if err != nil {
+		return query, err
+	}
+
+	var merged, own map[string]json.RawMessage
+	if err := json.Unmarshal(saved.Query, &merged); err != nil {
+		return query, fmt.Errorf("saved query %s is corrupt: %w", saved.Name, err)
+	}
+	if err := json.Unmarshal(query.JSON, &own); err != nil {
+		return query, withCode(codeParseError, fmt.Errorf("failed to unmarshal query JSON: %w", err))
+	}
+	delete(own, "savedQuery")
+	// Grafana sends an empty query type for queries only naming a saved one
+	if string(own["queryType"]) == `""` {
+		delete(own, "queryType")
+	}
+	for name, value := range own {
+		merged[name] = value
+	}
+	body, err := json.Marshal(merged)
+	if err != nil {
+		return query, err
+	}
+	query.JSON = body
+	if queryType, ok := merged["queryType"]; ok {
+		if err := json.Unmarshal(queryType, &query.QueryType); err != nil {
+			return query, fmt.Errorf("saved query %s has an invalid query type: %w", saved.Name, err)
+		}
+	}
+	return query, nil
+}
+
+// savedQueryStatus is the response status of a saved query error.
+func savedQueryStatus(err error) int {
+	switch {
+	case errors.Is(err, errSavedQueryNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errNotSavedQueryOwner):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// handleListSavedQueries lists the saved queries of the user and the ones
+// shared with them, by name.
+func (ds *testDataSource) handleListSavedQueries(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ds.savedQueries.list(auditUser(r.Context())))
+}
+
+func (ds *testDataSource) handleGetSavedQuery(w http.ResponseWriter, r *http.Request) {
+	q, err := ds.savedQueries.get(r.PathValue("name"), auditUser(r.Context()))
+	if err != nil {
+		writeJSONError(w, savedQueryStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, q)
+}
+
+// handleSaveQuery saves a query under a name, owned by the user, or
+// replaces one they own.
+func (ds *testDataSource) handleSaveQuery(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !savedQueryNamePattern.MatchString(name) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid query name %q", name))
+		return
+	}
+	var req struct {
+		Description string          `json:"description"`
+		Shared      bool            `json:"shared"`
+		Query       json.RawMessage `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	query, err := normalizeSavedQuery(req.Query)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user := auditUser(r.Context())
+	q, err := ds.savedQueries.update(name, user, true, func(q *savedQuery) {
+		q.Description, q.Shared, q.Query = req.Description, req.Shared, query
+	})
+	if err != nil {
+		writeJSONError(w, savedQueryStatus(err), err)
+		return
+	}
+	ds.audit.record(r.Context(), auditKindSavedQueries, fmt.Sprintf("Saved query %s", name))
+	writeJSON(w, http.StatusOK, q)
+}
+
+// handleShareSavedQuery shares a query of the user with all users of the
+// data source, or stops sharing it.
+func (ds *testDataSource) handleShareSavedQuery(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req struct {
+		Shared bool `json:"shared"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	q, err := ds.savedQueries.update(name, auditUser(r.Context()), false, func(q *savedQuery) { q.Shared = req.Shared })
+	if err != nil {
+		writeJSONError(w, savedQueryStatus(err), err)
+		return
+	}
+	summary := fmt.Sprintf("Shared query %s", name)
+	if !req.Shared {
+		summary = fmt.Sprintf("Stopped sharing query %s", name)
+	}
+	ds.audit.record(r.Context(), auditKindSavedQueries, summary)
+	writeJSON(w, http.StatusOK, q)
+}
+
+func (ds *testDataSource) handleDeleteSavedQuery(w http.ResponseWriter, r *http.Request) {
+	name, user := r.PathValue("name"), auditUser(r.Context())
+	plan := func() ([]string, int, error) {
+		ds.savedQueries.mu.Lock()
+		defer ds.savedQueries.mu.Unlock()
+		if err := ds.savedQueries.removable(name, user); err != nil {
+			return nil, savedQueryStatus(err), err
+		}
+		return []string{"saved query " + name}, 0, nil
+	}
+	ds.destructive(w, r, plan, func() error {
+		if err := ds.savedQueries.remove(name, user); err != nil {
+			return err
+		}
+		ds.audit.record(r.Context(), auditKindSavedQueries, fmt.Sprintf("Deleted query %s", name))
+		return nil
+	})
+}
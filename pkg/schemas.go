@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// Types of push schema fields.
+const (
+	schemaTypeNumeric = "numeric"
+	schemaTypeNumber  = "number"
+	schemaTypeInteger = "integer"
+	schemaTypeBoolean = "boolean"
+)
+
+// Results of push schema checks, as counted by pushSchemaMessages.
+const (
+	schemaAccepted     = "accepted"
+	schemaInvalidJSON  = "invalid_json"
+	schemaMissingField = "missing_field"
+	schemaWrongType    = "wrong_type"
+)
+
+var pushSchemaMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "grafana_plugin",
+		Name:      "push_schema_messages_total",
+		Help:      "Messages of push sources checked against their schema, by whether they were accepted or rejected as invalid JSON, missing a required field or having a field of the wrong type.",
+	},
+	[]string{"target", "schema", "result"},
+)
+
+// pushSchema is a schema of the registry, which push sources naming it
+// check their messages against before mapping them with its fields.
+type pushSchema struct {
+	name   string
+	mapper fieldMapper
+	// fields are the types and requirements of the fields of mapper, in
+	// the same order
+	fields []schemaField
+
+	mu            sync.Mutex
+	lastRejection *schemaRejection
+}
+
+type schemaField struct {
+	kind     string
+	required bool
+}
+
+// schemaRejection is the last message a schema rejected.
+type schemaRejection struct {
+	Target string    `json:"target"`
+	At     time.Time `json:"at"`
+	Result string    `json:"result"`
+	Error  string    `json:"error"`
+}
+
+// newPushSchemas builds the schema registry, by name.
+func newPushSchemas(schemas []models.PushSchema) (map[string]*pushSchema, error) {
+	registry := make(map[string]*pushSchema, len(schemas))
+	for _, s := range schemas {
+		if s.Name == "" {
+			return nil, fmt.Errorf("schema has no name")
+		}
+		if registry[s.Name] != nil {
+			return nil, fmt.Errorf("duplicate schema %q", s.Name)
+		}
+		if len(s.Fields) == 0 {
+			return nil, fmt.Errorf("schema %s has no fields", s.Name)
+		}
+		mappings := make([]models.FieldMapping, len(s.Fields))
+		schema := &pushSchema{name: s.Name, fields: make([]schemaField, len(s.Fields))}
+		for i, f := range s.Fields {
+			if f.Metric == "" || f.Path == "" {
+				return nil, fmt.Errorf("schema %s: field %d: set metric and path", s.Name, i)
+			}
+			kind := f.Type
+			switch kind {
+			case "":
+				kind = schemaTypeNumeric
+			case schemaTypeNumeric, schemaTypeNumber, schemaTypeInteger, schemaTypeBoolean:
+			default:
+				return nil, fmt.Errorf("schema %s: field %s: unknown type %q", s.Name, f.Path, f.Type)
+			}
+			mappings[i] = f.FieldMapping
+			schema.fields[i] = schemaField{kind: kind, required: f.Required}
+		}
+		var err error
+		if schema.mapper, err = newFieldMapper(mappings); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", s.Name, err)
+		}
+		registry[s.Name] = schema
+	}
+	return registry, nil
+}
+
+// pushSourceFor returns the push source of target, mapping its messages
+// with mappings, or with the schema named when set.
+func pushSourceFor(target string, mappings []models.FieldMapping, schema string, registry map[string]*pushSchema) (*pushSource, error) {
+	if schema == "" {
+		return newPushSource(mappings)
+	}
+	s, ok := registry[schema]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %q", schema)
+	}
+	return &pushSource{mapper: s.mapper, schema: s, target: target}, nil
+}
+
+// check returns why msg, a decoded JSON message, doesn't conform to s,
+// with the result it counts as, or nil.
+func (s *pushSchema) check(msg any) (string, error) {
+	for i, m := range s.mapper {
+		if !m.matches(msg) {
+			continue
+		}
+		f := s.fields[i]
+		path := strings.Join(m.path, ".")
+		found := 0
+		var wrong error
+		walkPath(msg, m.path, nil, func(_ []string, v any) {
+			found++
+			if wrong == nil && !f.accepts(v) {
+				wrong = fmt.Errorf("field %s: expected %s, got %s", path, f.kind, jsonType(v))
+			}
+		})
+		if wrong != nil {
+			return schemaWrongType, wrong
+		}
+		if found == 0 && f.required {
+			return schemaMissingField, fmt.Errorf("field %s is missing", path)
+		}
+	}
+	return schemaAccepted, nil
+}
+
+// accepts reports whether v is of the field's type.
+func (f schemaField) accepts(v any) bool {
+	switch f.kind {
+	case schemaTypeNumber:
+		_, ok := v.(float64)
+		return ok
+	case schemaTypeInteger:
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n)
+	case schemaTypeBoolean:
+		_, ok := v.(bool)
+		return ok
+	}
+	_, ok := numericValue(v)
+	return ok
+}
+
+// jsonType names the JSON type of v, as decoded.
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "an integer"
+		}
+		return "a number"
+	case string:
+		return fmt.Sprintf("the string %q", v)
+	case []any:
+		return "an array"
+	}
+	return "an object"
+}
+
+// decode decodes msg and checks it against s, counting the result for
+// target and keeping the rejection for the registry.
+func (s *pushSchema) decode(target string, msg []byte) (any, error) {
+	var v any
+	result, err := schemaInvalidJSON, json.Unmarshal(msg, &v)
+	if err != nil {
+		err = fmt.Errorf("invalid JSON message: %w", err)
+	} else {
+		result, err = s.check(v)
+	}
+	pushSchemaMessages.WithLabelValues(target, s.name, result).Inc()
+	if err != nil {
+		s.mu.Lock()
+		s.lastRejection = &schemaRejection{Target: target, At: time.Now(), Result: result, Error: err.Error()}
+		s.mu.Unlock()
+		return nil, withCode(codeParseError, fmt.Errorf("message rejected by schema %s: %w", s.name, err))
+	}
+	return v, nil
+}
+
+func (s *pushSchema) rejection() *schemaRejection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastRejection
+}
+
+// schemaInfo describes a schema of the registry.
+type schemaInfo struct {
+	models.PushSchema
+	// Targets are those whose messages are checked against it
+	Targets       []string         `json:"targets"`
+	LastRejection *schemaRejection `json:"lastRejection,omitempty"`
+}
+
+// handleListSchemas lists the push schemas, the targets using them and the
+// last message each rejected.
+func (ds *testDataSource) handleListSchemas(w http.ResponseWriter, _ *http.Request) {
+	if ds.configErr != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid configuration: %w", ds.configErr))
+		return
+	}
+	schemas := make([]schemaInfo, 0, len(ds.settings.Schemas))
+	for _, s := range ds.settings.Schemas {
+		info := schemaInfo{PushSchema: s, Targets: []string{}}
+		for _, t := range ds.targets {
+			if t.push == nil || t.push.schema == nil || t.push.schema.name != s.Name {
+				continue
+			}
+			info.Targets = append(info.Targets, t.Name)
+			if info.LastRejection == nil {
+				info.LastRejection = t.push.schema.rejection()
+			}
+		}
+		schemas = append(schemas, info)
+	}
+	writeJSON(w, http.StatusOK, schemas)
+}
+
+// schemaCheck is the outcome of checking a message against a schema.
+type schemaCheck struct {
+	Valid   bool           `json:"valid"`
+	Result  string         `json:"result"`
+	Error   string         `json:"error,omitempty"`
+	Samples []schemaSample `json:"samples"`
+}
+
+type schemaSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// handleValidateSchema checks the message of the body against the schema of
+// the path, and returns the samples it maps to, for trying a publisher out
+// before pointing it at a target.
+func (ds *testDataSource) handleValidateSchema(w http.ResponseWriter, r *http.Request) {
+	registry, err := newPushSchemas(ds.settings.Schemas)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("invalid schemas: %w", err))
+		return
+	}
+	schema, ok := registry[r.PathValue("name")]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no schema %q", r.PathValue("name")))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAgentPush))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("failed to read message: %w", err))
+		return
+	}
+	check := schemaCheck{Result: schemaInvalidJSON}
+	var msg any
+	if err := json.Unmarshal(body, &msg); err != nil {
+		check.Error = fmt.Sprintf("invalid JSON message: %v", err)
+	} else if check.Result, err = schema.check(msg); err != nil {
+		check.Error = err.Error()
+	} else {
+		check.Valid = true
+		for _, s := range schema.mapper.apply(msg) {
+			check.Samples = append(check.Samples, schemaSample{Name: s.Name, Labels: s.Labels, Value: s.Value})
+		}
+	}
+	writeJSON(w, http.StatusOK, check)
+}
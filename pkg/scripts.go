@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"runtime/metrics"
+	"sort"
+	"time"
+
+	starlarkjson "go.starlark.net/lib/json"
+	starlarkmath "go.starlark.net/lib/math"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeScript = "script"
+
+// Default limits of a script run.
+const (
+	defaultScriptMaxSteps    = 1_000_000
+	defaultScriptMaxMemoryMB = 64
+	defaultScriptTimeout     = 10 * time.Second
+)
+
+// maxScriptSamples bounds the samples a run may emit.
+const maxScriptSamples = 10000
+
+// scriptWatchInterval is how often the memory allocated by a running script
+// is checked.
+const scriptWatchInterval = 5 * time.Millisecond
+
+func init() {
+	registerQueryType(queryTypeScript, queryScript, scriptQuery{})
+	registerConfiguredCheck(queryTypeScript, func(ds *testDataSource) bool { return len(ds.scripts) > 0 })
+}
+
+type scriptQuery struct {
+	// Script selects a configured script by name; empty means all of them.
+	Script string `json:"script"`
+}
+
+// scriptFileOptions are the Starlark dialect of scripts: statements may be
+// at the top level, but there are no while loops or recursion, so that the
+// step limit bounds every run.
+var scriptFileOptions = &syntax.FileOptions{Set: true, TopLevelControl: true, GlobalReassign: true}
+
+// scriptPredeclared are the names scripts can use besides Starlark's
+// builtins. fetch and emit are bound to each run.
+var scriptPredeclared = map[string]bool{"fetch": true, "emit": true, "json": true, "math": true}
+
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// scriptCollector is a compiled script and its limits.
+type scriptCollector struct {
+	name     string
+	program  *starlark.Program
+	maxSteps uint64
+	maxBytes uint64
+	timeout  time.Duration
+}
+
+// compileScripts compiles the scripts of an instance, by name.
+func compileScripts(settings []models.ScriptSettings) (map[string]*scriptCollector, error) {
+	scripts := make(map[string]*scriptCollector, len(settings))
+	for _, s := range settings {
+		if s.Name == "" {
+			return nil, fmt.Errorf("script has no name")
+		}
+		if _, ok := scripts[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate script name %q", s.Name)
+		}
+		_, program, err := starlark.SourceProgramOptions(scriptFileOptions, s.Name, s.Source, func(name string) bool { return scriptPredeclared[name] })
+		if err != nil {
+			return nil, fmt.Errorf("script %s: %w", s.Name, err)
+		}
+		c := &scriptCollector{
+			name:     s.Name,
+			program:  program,
+			maxSteps: defaultScriptMaxSteps,
+			maxBytes: defaultScriptMaxMemoryMB << 20,
+			timeout:  defaultScriptTimeout,
+		}
+		if s.MaxSteps > 0 {
+			c.maxSteps = s.MaxSteps
+		}
+		if s.MaxMemoryMB > 0 {
+			c.maxBytes = uint64(s.MaxMemoryMB) << 20
+		}
+		if s.TimeoutSeconds > 0 {
+			c.timeout = time.Duration(s.TimeoutSeconds * float64(time.Second))
+		}
+		scripts[s.Name] = c
+	}
+	return scripts, nil
+}
+
+// run runs the script once and returns the samples it emitted. Scripts
+// can call:
+//
+//	fetch(url, headers={}) returning the body of a GET request as a string
+//	emit(name, value, **labels) adding a sample
+//	json.decode and json.encode, and the math module
+//
+// The run is cancelled when it exceeds its steps, the memory allocated by
+// the plugin while it runs exceeds its memory limit, or it times out.
+func (c *scriptCollector) run(ctx context.Context, ds *testDataSource) ([]metricSample, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	thread := &starlark.Thread{
+		Name: "script " + c.name,
+		Print: func(_ *starlark.Thread, msg string) {
+			backend.Logger.Debug("Script output", "script", c.name, "message", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(c.maxSteps)
+
+	// Allocations are counted for the whole process, which overestimates
+	// those of the script when other work runs alongside it
+	done := make(chan struct{})
+	exceeded := make(chan error, 1)
+	start := allocatedBytes()
+	go func() {
+		ticker := time.NewTicker(scriptWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				exceeded <- nil
+				return
+			case <-ctx.Done():
+				thread.Cancel("timed out")
+				exceeded <- fmt.Errorf("script %s timed out after %s", c.name, c.timeout)
+				return
+			case <-ticker.C:
+				if allocatedBytes()-start > c.maxBytes {
+					thread.Cancel("out of memory")
+					exceeded <- fmt.Errorf("script %s allocated more than %d MB", c.name, c.maxBytes>>20)
+					return
+				}
+			}
+		}
+	}()
+
+	var samples sampleSet
+	predeclared := starlark.StringDict{
+		"fetch": starlark.NewBuiltin("fetch", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var url string
+			var headers *starlark.Dict
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "url", &url, "headers?", &headers); err != nil {
+				return nil, err
+			}
+			body, err := c.fetch(ctx, ds, url, headers)
+			if err != nil {
+				return nil, err
+			}
+			return starlark.String(body), nil
+		}),
+		"emit": starlark.NewBuiltin("emit", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			var value starlark.Value
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, nil, 2, &name, &value); err != nil {
+				return nil, err
+			}
+			if !metricNameRe.MatchString(name) {
+				return nil, fmt.Errorf("%s: invalid metric name %q", fn.Name(), name)
+			}
+			v, ok := starlark.AsFloat(value)
+			if !ok {
+				return nil, fmt.Errorf("%s: value of %s is a %s, not a number", fn.Name(), name, value.Type())
+			}
+			labels := data.Labels{}
+			for _, kv := range kwargs {
+				s, ok := starlark.AsString(kv[1])
+				if !ok {
+					return nil, fmt.Errorf("%s: label %s of %s is a %s, not a string", fn.Name(), kv[0], name, kv[1].Type())
+				}
+				labels[string(kv[0].(starlark.String))] = s
+			}
+			if len(samples.samples) >= maxScriptSamples {
+				return nil, fmt.Errorf("%s: more than %d samples", fn.Name(), maxScriptSamples)
+			}
+			samples.add(name, labels, v)
+			return starlark.None, nil
+		}),
+		"json": starlarkjson.Module,
+		"math": starlarkmath.Module,
+	}
+
+	_, err := c.program.Init(thread, predeclared)
+	close(done)
+	if limitErr := <-exceeded; limitErr != nil {
+		return nil, withCode(codeLimitExceeded, limitErr)
+	}
+	if err != nil {
+		if thread.ExecutionSteps() >= c.maxSteps {
+			return nil, withCode(codeLimitExceeded, fmt.Errorf("script %s took more than %d steps", c.name, c.maxSteps))
+		}
+		var evalErr *starlark.EvalError
+		if errors.As(err, &evalErr) {
+			return nil, fmt.Errorf("script %s failed: %s", c.name, evalErr.Backtrace())
+		}
+		return nil, fmt.Errorf("script %s failed: %w", c.name, err)
+	}
+	return samples.list(), nil
+}
+
+// fetch GETs url for a script, with its HTTP client and so its TLS and
+// egress settings. Bodies larger than the memory limit are rejected.
+func (c *scriptCollector) fetch(ctx context.Context, ds *testDataSource, url string, headers *starlark.Dict) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request for %s: %w", url, err)
+	}
+	if headers != nil {
+		for _, item := range headers.Items() {
+			k, kok := starlark.AsString(item[0])
+			v, vok := starlark.AsString(item[1])
+			if !kok || !vok {
+				return "", fmt.Errorf("headers must be strings")
+			}
+			req.Header.Set(k, v)
+		}
+	}
+	resp, err := send(ds.httpClient, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(c.maxBytes)+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response from %s: %w", url, err)
+	}
+	if uint64(len(body)) > c.maxBytes {
+		return "", withCode(codeLimitExceeded, fmt.Errorf("response from %s is larger than %d MB", url, c.maxBytes>>20))
+	}
+	return string(body), nil
+}
+
+// allocatedBytes returns the bytes allocated on the heap since the process
+// started.
+func allocatedBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+func queryScript(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q scriptQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if len(ds.scripts) == 0 {
+		return nil, fmt.Errorf("no scripts configured")
+	}
+
+	var names []string
+	if q.Script != "" {
+		if _, ok := ds.scripts[q.Script]; !ok {
+			return nil, fmt.Errorf("script %q is not configured", q.Script)
+		}
+		names = []string{q.Script}
+	} else {
+		for name := range ds.scripts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var frames data.Frames
+	for _, name := range names {
+		samples, err := ds.scripts[name].run(ctx, ds)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for _, s := range samples {
+			labels := s.Labels.Copy()
+			if _, ok := labels["script"]; !ok {
+				labels["script"] = name
+			}
+			frame := data.NewFrame(s.Name,
+				data.NewField("time", nil, []time.Time{now}),
+				data.NewField(s.Name, labels, []float64{s.Value}),
+			)
+			frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti}
+			frames = append(frames, frame)
+		}
+	}
+	return frames, nil
+}
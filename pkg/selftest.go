@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeSelftest = "selftest"
+
+// defaultSelftestMetric is a series the plugin always exposes.
+const defaultSelftestMetric = "go_goroutines"
+
+// selftestTimeout bounds the scrape of the plugin's own metrics server.
+const selftestTimeout = 5 * time.Second
+
+func init() {
+	registerQueryType(queryTypeSelftest, querySelftest, selftestQuery{})
+}
+
+type selftestQuery struct {
+	// Metric is the series framed in the last stage; go_goroutines by
+	// default.
+	Metric string `json:"metric"`
+}
+
+// selftestStates are the states of self-test stages. Stages after a failed
+// one are skipped, and of unknown severity.
+var selftestStates = stateScale{
+	"ok":     severityOK,
+	"failed": severityCritical,
+}
+
+// selftestStage is a stage of the self-test, which returns a description of
+// its result.
+type selftestStage struct {
+	name string
+	run  func() (string, error)
+}
+
+// querySelftest runs the plugin's own metrics through the pipeline of a
+// metrics query, scraping them from its metrics server, parsing, buffering
+// and framing them, and returns the latency of each stage.
+func querySelftest(ctx context.Context, _ *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	q := selftestQuery{Metric: defaultSelftestMetric}
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	var (
+		body    []byte
+		samples []metricSample
+		at      time.Time
+		history = newScrapeHistory(time.Minute)
+	)
+	stages := []selftestStage{
+		{"scrape", func() (string, error) {
+			var source string
+			var err error
+			body, source, err = scrapeSelf(ctx)
+			return fmt.Sprintf("%d bytes from %s", len(body), source), err
+		}},
+		{"parse", func() (string, error) {
+			families, err := parseExposition(body)
+			if err != nil {
+				return "", err
+			}
+			samples = metricSamples(families)
+			return fmt.Sprintf("%d series", len(samples)), nil
+		}},
+		{"buffer", func() (string, error) {
+			at = time.Now()
+			history.record(at, samples)
+			return fmt.Sprintf("%d series in history", len(samples)), nil
+		}},
+		{"frame", func() (string, error) {
+			sel, err := newSeriesSelector(Query{Metric: q.Metric})
+			if err != nil {
+				return "", err
+			}
+			frames, err := history.seriesFrames(sel, backend.DataQuery{
+				TimeRange:     backend.TimeRange{From: at.Add(-time.Minute), To: at.Add(time.Minute)},
+				MaxDataPoints: 1,
+				Interval:      time.Second,
+			})
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d frames of %s", len(frames), q.Metric), nil
+		}},
+	}
+
+	statusField, severityField := newStateFields(selftestStates)
+	frame := data.NewFrame("selftest",
+		data.NewField("stage", nil, []string{}),
+		statusField,
+		severityField,
+		data.NewField("durationMs", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("detail", nil, []string{}),
+	)
+	failed := false
+	for _, stage := range stages {
+		if failed {
+			frame.AppendRow(stage.name, "skipped", selftestStates.severity("skipped"), (*float64)(nil), "")
+			continue
+		}
+		start := time.Now()
+		detail, err := stage.run()
+		took := milliseconds(time.Since(start))
+		status := "ok"
+		if err != nil {
+			failed = true
+			status, detail = "failed", err.Error()
+		}
+		frame.AppendRow(stage.name, status, selftestStates.severity(status), &took, detail)
+	}
+	return data.Frames{frame}, nil
+}
+
+// scrapeSelf scrapes the plugin's metrics server, or gathers the metrics in
+// process when it is not running, and returns where they came from.
+func scrapeSelf(ctx context.Context) ([]byte, string, error) {
+	metricsURL, cert, ok := pluginMetricsServer.self()
+	if !ok {
+		families, err := metricsRegistry.Gather()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to gather metrics: %w", err)
+		}
+		var buf bytes.Buffer
+		encoder := expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeTextPlain))
+		for _, family := range families {
+			if err := encoder.Encode(family); err != nil {
+				return nil, "", fmt.Errorf("failed to encode metrics: %w", err)
+			}
+		}
+		return buf.Bytes(), "the process, as the metrics server is not running", nil
+	}
+
+	client := &http.Client{Timeout: selftestTimeout}
+	if cert != nil {
+		// The certificate is the server's own, which need not be valid for
+		// the loopback address: trust exactly it
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], cert) {
+					return fmt.Errorf("the metrics server presented another certificate than its own")
+				}
+				return nil
+			},
+		}}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metricsURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request for %s: %w", metricsURL, err)
+	}
+	resp, err := send(client, req)
+	body, err := readBody(resp, metricsURL, err, defaultMaxResponseMB<<20)
+	return body, metricsURL, err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// maxLoginPageBytes bounds the CSRF pages and login responses read.
+const maxLoginPageBytes = 1 << 20
+
+// webSession logs in to an appliance's web UI and keeps the session cookies,
+// for appliances whose APIs are only reachable once logged in.
+type webSession struct {
+	settings  models.SessionSettings
+	password  string
+	csrfRegex *regexp.Regexp
+	loginPath string
+
+	// mu is held while logging in, so concurrent scrapes wait for the same
+	// session rather than each logging in
+	mu       sync.Mutex
+	client   *http.Client
+	csrf     string
+	loggedIn bool
+}
+
+func newWebSession(settings models.SessionSettings, password string) *webSession {
+	s := &webSession{settings: settings, password: password}
+	if settings.CSRFRegex != "" {
+		// Validated with the settings
+		s.csrfRegex = regexp.MustCompile(settings.CSRFRegex)
+	}
+	if u, err := url.Parse(settings.LoginURL); err == nil {
+		s.loginPath = u.Path
+	}
+	return s
+}
+
+// session returns the client holding the session cookies and the CSRF
+// token, logging in first if there is no session. The client shares the
+// transport of base.
+func (s *webSession) session(ctx context.Context, base *http.Client) (*http.Client, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loggedIn {
+		return s.client, s.csrf, nil
+	}
+	if err := s.login(ctx, base); err != nil {
+		return nil, "", withCode(codeAuthFailed, err)
+	}
+	return s.client, s.csrf, nil
+}
+
+// expire drops the session, which the appliance no longer accepts, unless
+// it was already renewed.
+func (s *webSession) expire(client *http.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == client {
+		s.loggedIn = false
+	}
+}
+
+func (s *webSession) login(ctx context.Context, base *http.Client) error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: base.Transport, Timeout: base.Timeout, Jar: jar}
+
+	csrf := ""
+	if s.settings.CSRFPage != "" {
+		if csrf, err = s.fetchCSRF(ctx, client); err != nil {
+			return err
+		}
+	}
+
+	fields := map[string]string{}
+	for k, v := range s.settings.Fields {
+		fields[k] = v
+	}
+	passwordField := s.settings.PasswordField
+	if passwordField == "" {
+		passwordField = "password"
+	}
+	fields[passwordField] = s.password
+	if csrf != "" && s.settings.CSRFField != "" {
+		fields[s.settings.CSRFField] = csrf
+	}
+
+	var body io.Reader
+	contentType := "application/x-www-form-urlencoded"
+	if s.settings.JSON {
+		encoded, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(encoded), "application/json"
+	} else {
+		form := url.Values{}
+		for k, v := range fields {
+			form.Set(k, v)
+		}
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.settings.LoginURL, body)
+	if err != nil {
+		return fmt.Errorf("failed to create login request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if csrf != "" && s.settings.CSRFHeader != "" {
+		req.Header.Set(s.settings.CSRFHeader, csrf)
+	}
+
+	// Login forms usually redirect on success, which the client follows
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to log in at %s: %w", s.settings.LoginURL, err)
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxLoginPageBytes))
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("login at %s returned %s", s.settings.LoginURL, resp.Status)
+	}
+	if len(jar.Cookies(req.URL)) == 0 {
+		return fmt.Errorf("login at %s set no session cookie", s.settings.LoginURL)
+	}
+
+	s.client, s.csrf, s.loggedIn = client, csrf, true
+	return nil
+}
+
+// fetchCSRF gets the CSRF page, with client so that the cookies it sets go
+// along with the login, and takes the token from it.
+func (s *webSession) fetchCSRF(ctx context.Context, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.settings.CSRFPage, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create CSRF page request: %w", err)
+	}
+	resp, err := send(client, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if s.settings.CSRFCookie != "" {
+		for _, c := range client.Jar.Cookies(req.URL) {
+			if c.Name == s.settings.CSRFCookie {
+				return c.Value, nil
+			}
+		}
+		return "", fmt.Errorf("%s set no %s cookie", s.settings.CSRFPage, s.settings.CSRFCookie)
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, maxLoginPageBytes))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response from %s: %w", s.settings.CSRFPage, err)
+	}
+	m := s.csrfRegex.FindSubmatch(page)
+	if m == nil {
+		return "", fmt.Errorf("no CSRF token in %s", s.settings.CSRFPage)
+	}
+	return string(m[1]), nil
+}
+
+// get sends a request to url within the session. Appliances redirecting to
+// their login page count as rejecting the session, and a rejected session
+// is renewed and the request retried once.
+func (s *webSession) get(ctx context.Context, base *http.Client, url string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		client, csrf, err := s.session(ctx, base)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request for %s: %w", url, err)
+		}
+		if csrf != "" && s.settings.CSRFHeader != "" {
+			req.Header.Set(s.settings.CSRFHeader, csrf)
+		}
+		resp, err := send(client, req)
+		if err == nil && s.loginPath != "" && resp.Request.URL.Path == s.loginPath && req.URL.Path != s.loginPath {
+			resp.Body.Close()
+			err = withCode(codeAuthFailed, fmt.Errorf("%s redirected to the login page", url))
+		}
+		if codeOf(err) != codeAuthFailed || attempt > 0 {
+			return resp, err
+		}
+		s.expire(client)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// disposeTimeout bounds how long Dispose waits for background jobs, e.g. a
+// traceroute or an SSH command, to return after being cancelled.
+const disposeTimeout = 10 * time.Second
+
+// instanceSet tracks the live instances. The instance manager only disposes
+// of instances it replaces, so the others are disposed of on shutdown.
+type instanceSet struct {
+	mu        sync.Mutex
+	instances map[*testDataSource]bool
+}
+
+var liveInstances = &instanceSet{instances: map[*testDataSource]bool{}}
+
+func (s *instanceSet) add(ds *testDataSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances[ds] = true
+}
+
+func (s *instanceSet) remove(ds *testDataSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.instances, ds)
+}
+
+// disposeAll disposes of every live instance, concurrently so that slow
+// jobs of one don't hold up the others.
+func (s *instanceSet) disposeAll() {
+	s.mu.Lock()
+	instances := make([]*testDataSource, 0, len(s.instances))
+	for ds := range s.instances {
+		instances = append(instances, ds)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ds := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ds.Dispose()
+		}()
+	}
+	wg.Wait()
+}
+
+// disposeOnTermination disposes of all instances when Grafana terminates the
+// plugin with SIGTERM, e.g. on restarts and upgrades, and then exits.
+func disposeOnTermination() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	sig := <-signals
+
+	backend.Logger.Info("Shutting down", "signal", sig.String())
+	liveInstances.disposeAll()
+	os.Exit(0)
+}
+
+// startJob runs job in the background, tracked until it returns.
+func (ds *testDataSource) startJob(job func()) {
+	ds.jobs.Add(1)
+	go func() {
+		defer ds.jobs.Done()
+		job()
+	}()
+}
+
+// waitForJobs waits for the background jobs to return, for at most timeout.
+func (ds *testDataSource) waitForJobs(timeout time.Duration) {
+	if !waitTimeout(&ds.jobs, timeout) {
+		backend.Logger.Warn("Background jobs did not stop in time", "timeout", timeout)
+	}
+}
+
+// waitTimeout waits for wg for at most timeout, and reports whether it is
+// done.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeSLO = "slo"
+
+var (
+	sloBurnRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "grafana_plugin",
+			Name:      "slo_burn_rate",
+			Help:      "Error budget burn rate per SLO.",
+		},
+		[]string{"slo"},
+	)
+
+	sloViolationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "grafana_plugin",
+			Name:      "slo_violations_total",
+			Help:      "Number of SLO evaluations that found the objective violated.",
+		},
+		[]string{"slo"},
+	)
+)
+
+func init() {
+	registerQueryType(queryTypeSLO, querySLO, sloQuery{})
+	registerConfiguredCheck(queryTypeSLO, func(ds *testDataSource) bool { return len(ds.settings.SLOs) > 0 })
+}
+
+type sloQuery struct {
+	// SLO selects a configured SLO by name; empty means all of them.
+	SLO string `json:"slo"`
+}
+
+// sloCounts are the cumulative request counts an SLO is evaluated against.
+type sloCounts struct {
+	Time     time.Time
+	Requests float64
+	Errors   float64
+	// Fast is the number of requests within the latency threshold
+	Fast float64
+	// Timed is the number of requests with a recorded duration
+	Timed float64
+}
+
+// sloResult is the outcome of evaluating one SLO.
+type sloResult struct {
+	SLO               models.SLOSettings
+	Availability      float64
+	LatencyCompliance *float64
+	BudgetRemaining   float64
+	BurnRate          float64
+	Violated          bool
+}
+
+// sloTracker remembers the previous counts per SLO so the burn rate reflects
+// the interval since the last evaluation rather than the proxy's lifetime.
+type sloTracker struct {
+	mu   sync.Mutex
+	prev map[string]sloCounts
+}
+
+func newSLOTracker() *sloTracker {
+	return &sloTracker{prev: map[string]sloCounts{}}
+}
+
+func (t *sloTracker) last(name string) (sloCounts, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, ok := t.prev[name]
+	return prev, ok
+}
+
+func (t *sloTracker) store(name string, cur sloCounts) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prev[name] = cur
+}
+
+// fastRequests counts requests at or below threshold seconds using the largest
+// histogram bucket that doesn't exceed it, which errs on the side of caution.
+func fastRequests(buckets map[float64]float64, threshold float64) (float64, bool) {
+	best, found := math.Inf(-1), false
+	for le := range buckets {
+		if le <= threshold && le > best {
+			best, found = le, true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	return buckets[best], true
+}
+
+func evaluateSLO(slo models.SLOSettings, stats proxyServiceStats, prev *sloCounts, now time.Time) (sloResult, sloCounts) {
+	cur := sloCounts{Time: now, Requests: stats.Requests, Errors: stats.StatusClasses["5xx"], Timed: stats.DurationCount}
+	if fast, ok := fastRequests(stats.Buckets, slo.LatencyThresholdSeconds); ok {
+		cur.Fast = fast
+	}
+
+	res := sloResult{SLO: slo, Availability: 100}
+	if cur.Requests > 0 {
+		res.Availability = (1 - cur.Errors/cur.Requests) * 100
+	}
+	if slo.LatencyThresholdSeconds > 0 && cur.Timed > 0 {
+		compliance := cur.Fast / cur.Timed * 100
+		res.LatencyCompliance = &compliance
+	}
+
+	allowed := 1 - slo.AvailabilityTarget/100
+	if allowed > 0 {
+		res.BudgetRemaining = (1 - (1-res.Availability/100)/allowed) * 100
+
+		// Prefer the error ratio since the previous evaluation; fall back to
+		// the lifetime ratio on first use or after a counter reset.
+		errorRatio := 1 - res.Availability/100
+		if prev != nil && cur.Requests > prev.Requests && cur.Errors >= prev.Errors {
+			errorRatio = (cur.Errors - prev.Errors) / (cur.Requests - prev.Requests)
+		}
+		res.BurnRate = errorRatio / allowed
+	}
+
+	res.Violated = res.Availability < slo.AvailabilityTarget ||
+		(res.LatencyCompliance != nil && slo.LatencyTarget > 0 && *res.LatencyCompliance < slo.LatencyTarget)
+
+	return res, cur
+}
+
+func (ds *testDataSource) evaluateSLOs(ctx context.Context, name string) ([]sloResult, error) {
+	if len(ds.settings.SLOs) == 0 {
+		return nil, fmt.Errorf("no SLOs configured")
+	}
+
+	// Each proxy is scraped once even if several SLOs reference it
+	statsByProxy := map[string][]proxyServiceStats{}
+	now := time.Now()
+
+	var results []sloResult
+	for _, slo := range ds.settings.SLOs {
+		if name != "" && slo.Name != name {
+			continue
+		}
+
+		stats, ok := statsByProxy[slo.Proxy]
+		if !ok {
+			proxies, err := ds.selectProxies(slo.Proxy)
+			if err != nil {
+				return nil, fmt.Errorf("SLO %s: %w", slo.Name, err)
+			}
+			stats, err = ds.collectProxyStats(ctx, proxies[0])
+			if err != nil {
+				return nil, fmt.Errorf("SLO %s: %w", slo.Name, err)
+			}
+			statsByProxy[slo.Proxy] = stats
+		}
+
+		var service *proxyServiceStats
+		for i := range stats {
+			if stats[i].Service == slo.Service {
+				service = &stats[i]
+				break
+			}
+		}
+		if service == nil {
+			return nil, fmt.Errorf("SLO %s: service %q not found on proxy %s", slo.Name, slo.Service, slo.Proxy)
+		}
+
+		var prevPtr *sloCounts
+		if prev, ok := ds.slos.last(slo.Name); ok {
+			prevPtr = &prev
+		}
+		res, cur := evaluateSLO(slo, *service, prevPtr, now)
+		ds.slos.store(slo.Name, cur)
+
+		sloBurnRate.WithLabelValues(slo.Name).Set(res.BurnRate)
+		if res.Violated {
+			sloViolationsTotal.WithLabelValues(slo.Name).Inc()
+			backend.Logger.Warn("SLO violated", "slo", slo.Name, "availability", res.Availability, "burnRate", res.BurnRate)
+		}
+		results = append(results, res)
+	}
+	if name != "" && len(results) == 0 {
+		return nil, fmt.Errorf("SLO %q is not configured", name)
+	}
+
+	return results, nil
+}
+
+// sloStates are the severities of SLO statuses.
+var sloStates = stateScale{"ok": severityOK, "violated": severityCritical}
+
+func querySLO(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q sloQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	results, err := ds.evaluateSLOs(ctx, q.SLO)
+	if err != nil {
+		return nil, err
+	}
+
+	percent := &data.FieldConfig{Unit: "percent"}
+	statusField, severityField := newStateFields(sloStates)
+	frame := data.NewFrame("slo",
+		data.NewField("slo", nil, []string{}),
+		data.NewField("proxy", nil, []string{}),
+		data.NewField("service", nil, []string{}),
+		data.NewField("availability", nil, []float64{}).SetConfig(percent),
+		data.NewField("availability_target", nil, []float64{}).SetConfig(percent),
+		data.NewField("latency_compliance", nil, []*float64{}).SetConfig(percent),
+		data.NewField("latency_target", nil, []float64{}).SetConfig(percent),
+		data.NewField("error_budget_remaining", nil, []float64{}).SetConfig(percent),
+		data.NewField("burn_rate", nil, []float64{}),
+		statusField,
+		severityField,
+	)
+	frame.Meta = &data.FrameMeta{}
+
+	for _, r := range results {
+		status := "ok"
+		if r.Violated {
+			status = "violated"
+			frame.Meta.Notices = append(frame.Meta.Notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     ds.tr.text(msgSLOViolated, r.SLO.Name, r.BurnRate),
+			})
+		}
+		frame.AppendRow(r.SLO.Name, r.SLO.Proxy, r.SLO.Service, r.Availability, r.SLO.AvailabilityTarget,
+			r.LatencyCompliance, r.SLO.LatencyTarget, r.BudgetRemaining, r.BurnRate, status, sloStates.severity(status))
+	}
+
+	return data.Frames{frame}, nil
+}
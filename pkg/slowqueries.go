@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeSlowQueries = "slowqueries"
+
+const (
+	defaultSlowQueryThreshold = 2 * time.Second
+	// maxSlowQueries bounds the slow queries kept; the oldest go first
+	maxSlowQueries = 500
+	// defaultSlowQueryLimit is how many queries the report lists by default
+	defaultSlowQueryLimit = 10
+)
+
+func init() {
+	registerQueryType(queryTypeSlowQueries, querySlowQueries, slowQueryReport{})
+}
+
+type slowQueryReport struct {
+	// Limit is how many of the most expensive queries to list.
+	Limit int `json:"limit"`
+}
+
+// slowQuery is a query that ran for longer than the slow query threshold,
+// with what it asked for and the load it caused.
+type slowQuery struct {
+	Time       time.Time       `json:"time"`
+	RefID      string          `json:"refId"`
+	QueryType  string          `json:"queryType"`
+	Query      json.RawMessage `json:"query"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	DurationMs float64         `json:"durationMs"`
+	Scrapes    int64           `json:"scrapes"`
+	CacheHits  int64           `json:"cacheHits"`
+	Bytes      int64           `json:"bytes"`
+	Series     int             `json:"series"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// slowQueryLog keeps the last slow queries. A zero threshold disables it.
+type slowQueryLog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	queries []slowQuery
+}
+
+func newSlowQueryLog(threshold time.Duration) *slowQueryLog {
+	return &slowQueryLog{threshold: threshold}
+}
+
+// slowQueryThreshold turns the SlowQueryMs setting into a threshold: unset
+// means the default, and a negative value disables the log.
+func slowQueryThreshold(ms int) time.Duration {
+	switch {
+	case ms < 0:
+		return 0
+	case ms == 0:
+		return defaultSlowQueryThreshold
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// observe logs query if it took at least the threshold. A nil log logs
+// nothing.
+func (l *slowQueryLog) observe(query backend.DataQuery, took time.Duration, usage *queryUsage, frames data.Frames, err error) {
+	if l == nil || l.threshold <= 0 || took < l.threshold {
+		return
+	}
+	q := slowQuery{
+		Time:       time.Now(),
+		RefID:      query.RefID,
+		QueryType:  query.QueryType,
+		Query:      query.JSON,
+		From:       query.TimeRange.From,
+		To:         query.TimeRange.To,
+		DurationMs: milliseconds(took),
+		Scrapes:    usage.scrapes.Load(),
+		CacheHits:  usage.cacheHits.Load(),
+		Bytes:      usage.bytes.Load(),
+		Series:     countSeries(frames),
+	}
+	if err != nil {
+		q.Error = err.Error()
+	}
+	backend.Logger.Warn("Slow query", "refId", q.RefID, "queryType", q.QueryType, "durationMs", q.DurationMs,
+		"scrapes", q.Scrapes, "bytes", q.Bytes, "series", q.Series)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queries = append(l.queries, q)
+	if len(l.queries) > maxSlowQueries {
+		l.queries = append([]slowQuery(nil), l.queries[len(l.queries)-maxSlowQueries:]...)
+	}
+}
+
+// list returns the slow queries, newest first.
+func (l *slowQueryLog) list() []slowQuery {
+	if l == nil {
+		return []slowQuery{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queries := make([]slowQuery, len(l.queries))
+	for i, q := range l.queries {
+		queries[len(queries)-1-i] = q
+	}
+	return queries
+}
+
+func countSeries(frames data.Frames) int {
+	series := 0
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			if !field.Type().Time() {
+				series++
+			}
+		}
+	}
+	return series
+}
+
+// slowQueryKey identifies the same query run again, whichever panel and
+// time range it ran for.
+func slowQueryKey(q slowQuery) string {
+	var fields map[string]any
+	if err := json.Unmarshal(q.Query, &fields); err != nil {
+		return q.QueryType + string(q.Query)
+	}
+	for _, name := range []string{"refId", "datasource", "intervalMs", "maxDataPoints", "hide", "key"} {
+		delete(fields, name)
+	}
+	// Maps marshal with sorted keys
+	key, _ := json.Marshal(fields)
+	return q.QueryType + string(key)
+}
+
+type slowQuerySummary struct {
+	queryType string
+	query     string
+	count     float64
+	total     float64
+	max       float64
+	scrapes   float64
+	bytes     float64
+	lastSeen  time.Time
+}
+
+// querySlowQueries returns the most expensive of the slow queries logged in
+// the time range, by total duration, with how often they ran slow and the
+// scrapes they caused.
+func querySlowQueries(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q slowQueryReport
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSlowQueryLimit
+	}
+
+	summaries := map[string]*slowQuerySummary{}
+	for _, sq := range ds.slowQueries.list() {
+		if sq.Time.Before(query.TimeRange.From) || sq.Time.After(query.TimeRange.To) {
+			continue
+		}
+		key := slowQueryKey(sq)
+		s, ok := summaries[key]
+		if !ok {
+			s = &slowQuerySummary{queryType: sq.QueryType, query: key[len(sq.QueryType):], lastSeen: sq.Time}
+			if s.queryType == "" {
+				s.queryType = "metric"
+			}
+			summaries[key] = s
+		}
+		s.count++
+		s.total += sq.DurationMs
+		s.max = max(s.max, sq.DurationMs)
+		s.scrapes += float64(sq.Scrapes)
+		s.bytes += float64(sq.Bytes)
+	}
+
+	ranked := make([]*slowQuerySummary, 0, len(summaries))
+	for _, s := range summaries {
+		ranked = append(ranked, s)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].total != ranked[j].total {
+			return ranked[i].total > ranked[j].total
+		}
+		return ranked[i].query < ranked[j].query
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	frame := data.NewFrame("slow_queries",
+		data.NewField("query_type", nil, []string{}),
+		data.NewField("query", nil, []string{}),
+		data.NewField("count", nil, []float64{}),
+		data.NewField("total_ms", nil, []float64{}),
+		data.NewField("avg_ms", nil, []float64{}),
+		data.NewField("max_ms", nil, []float64{}),
+		data.NewField("scrapes", nil, []float64{}),
+		data.NewField("bytes", nil, []float64{}),
+		data.NewField("last_seen", nil, []time.Time{}),
+	)
+	for _, s := range ranked {
+		frame.AppendRow(s.queryType, s.query, s.count, s.total, s.total/s.count, s.max, s.scrapes, s.bytes, s.lastSeen)
+	}
+	return data.Frames{frame}, nil
+}
+
+func (ds *testDataSource) handleSlowQueries(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, ds.slowQueries.list())
+}
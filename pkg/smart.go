@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeSMART = "smart"
+
+const (
+	defaultSMARTInterval = time.Hour
+	defaultSMARTWindow   = 14 * 24 * time.Hour
+)
+
+// Trends of an attribute need readings spanning smartMinSpan. A disk is
+// flagged when the attribute grew by at least smartMinGrowth in the recent
+// half of the window, smartAcceleration times as fast as in the earlier half.
+const (
+	smartMinSpan      = 2 * 24 * time.Hour
+	smartMinGrowth    = 2
+	smartAcceleration = 2.0
+)
+
+// S.M.A.R.T. attributes whose growth predicts failures.
+const (
+	smartReallocated = "reallocated"
+	smartPending     = "pending"
+)
+
+var smartPredictedFailure = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "grafana_plugin",
+		Name:      "smart_predicted_failure",
+		Help:      "1 for disks whose reallocated or pending sectors grow faster and faster, predicting a failure.",
+	},
+	[]string{"target", "device"},
+)
+
+func init() {
+	registerQueryType(queryTypeSMART, querySMART, smartQuery{})
+	registerConfiguredCheck(queryTypeSMART, func(ds *testDataSource) bool { return ds.settings.SMART.Enabled })
+}
+
+type smartQuery struct {
+	Target string `json:"target"`
+	// Mode is "prediction" (default) for one predicted failure series per
+	// disk, the shape alert rules expect, or "table" for the trends of each
+	// disk.
+	Mode string `json:"mode"`
+}
+
+// smartReading is a sample of the attributes of a disk. Attributes a disk
+// doesn't report are nil.
+type smartReading struct {
+	Time        time.Time `json:"time"`
+	Reallocated *float64  `json:"reallocated,omitempty"`
+	Pending     *float64  `json:"pending,omitempty"`
+}
+
+func (r smartReading) attribute(name string) *float64 {
+	if name == smartReallocated {
+		return r.Reallocated
+	}
+	return r.Pending
+}
+
+// readSMART returns the attributes of the disks in samples, by device. It
+// reads smartctl_exporter's smartctl_device_attribute and the smartmon
+// textfile collector's smartmon_<attribute>_raw_value.
+func readSMART(now time.Time, samples []metricSample) map[string]*smartReading {
+	readings := map[string]*smartReading{}
+	set := func(device, attribute string, value float64) {
+		if device == "" {
+			return
+		}
+		r, ok := readings[device]
+		if !ok {
+			r = &smartReading{Time: now}
+			readings[device] = r
+		}
+		if attribute == smartReallocated {
+			r.Reallocated = &value
+		} else {
+			r.Pending = &value
+		}
+	}
+	for _, s := range samples {
+		switch s.Name {
+		case "smartctl_device_attribute":
+			if s.Labels["attribute_value_type"] != "raw" {
+				continue
+			}
+			switch s.Labels["attribute_name"] {
+			case "Reallocated_Sector_Ct":
+				set(s.Labels["device"], smartReallocated, s.Value)
+			case "Current_Pending_Sector":
+				set(s.Labels["device"], smartPending, s.Value)
+			}
+		case "smartmon_reallocated_sector_ct_raw_value":
+			set(s.Labels["disk"], smartReallocated, s.Value)
+		case "smartmon_current_pending_sector_raw_value":
+			set(s.Labels["disk"], smartPending, s.Value)
+		}
+	}
+	return readings
+}
+
+// smartDisk is the history of a disk's attributes within the window.
+type smartDisk struct {
+	Target   string         `json:"target"`
+	Device   string         `json:"device"`
+	Readings []smartReading `json:"readings"`
+}
+
+// smartTrend is how an attribute of a disk grew over the window, per day.
+type smartTrend struct {
+	Current      float64
+	EarlierRate  float64
+	RecentRate   float64
+	RecentGrowth float64
+	Accelerating bool
+}
+
+// trend returns the trend of attribute, or false when the readings don't
+// span smartMinSpan. Readings before the attribute last went down, as when
+// a disk is replaced, are left out.
+func (d *smartDisk) trend(attribute string) (smartTrend, bool) {
+	var points []smartReading
+	for _, r := range d.Readings {
+		v := r.attribute(attribute)
+		if v == nil {
+			continue
+		}
+		if len(points) > 0 && *v < *points[len(points)-1].attribute(attribute) {
+			points = points[:0]
+		}
+		points = append(points, r)
+	}
+	if len(points) < 3 {
+		return smartTrend{}, false
+	}
+	first, last := points[0], points[len(points)-1]
+	span := last.Time.Sub(first.Time)
+	if span < smartMinSpan {
+		return smartTrend{}, false
+	}
+
+	// The middle reading is the last of the earlier half
+	mid := first
+	for _, r := range points {
+		if r.Time.Sub(first.Time) > span/2 {
+			break
+		}
+		mid = r
+	}
+	value := func(r smartReading) float64 { return *r.attribute(attribute) }
+	days := func(from, to time.Time) float64 { return to.Sub(from).Hours() / 24 }
+
+	t := smartTrend{Current: value(last), RecentGrowth: value(last) - value(mid)}
+	if n := days(first.Time, mid.Time); n > 0 {
+		t.EarlierRate = (value(mid) - value(first)) / n
+	}
+	if n := days(mid.Time, last.Time); n > 0 {
+		t.RecentRate = t.RecentGrowth / n
+	}
+	t.Accelerating = t.RecentGrowth >= smartMinGrowth && t.RecentRate > smartAcceleration*t.EarlierRate
+	return t, true
+}
+
+// smartTracker keeps the attribute histories of disks, in a file of the
+// state directory when there is one, so that trends survive restarts.
+type smartTracker struct {
+	window time.Duration
+	path   string
+
+	mu    sync.Mutex
+	disks map[string]*smartDisk
+	// flagged are the disks predicted to fail at the last analysis
+	flagged map[string]bool
+}
+
+func newSMARTTracker(window time.Duration, stateDir, uid string) *smartTracker {
+	t := &smartTracker{window: window, disks: map[string]*smartDisk{}, flagged: map[string]bool{}}
+	if stateDir != "" {
+		t.path = filepath.Join(stateDir, url.PathEscape(uid), "smart.json")
+	}
+	return t
+}
+
+func smartDiskKey(target, device string) string {
+	return target + "\x00" + device
+}
+
+// load reads the stored histories, if any.
+func (t *smartTracker) load() {
+	if t.path == "" {
+		return
+	}
+	body, err := os.ReadFile(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		backend.Logger.Warn("Failed to read stored S.M.A.R.T. history", "error", err)
+		return
+	}
+	var disks []*smartDisk
+	if err := json.Unmarshal(body, &disks); err != nil {
+		backend.Logger.Warn("Ignoring corrupt stored S.M.A.R.T. history", "error", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, d := range disks {
+		t.disks[smartDiskKey(d.Target, d.Device)] = d
+	}
+}
+
+// save writes the histories aside and renames them, so a crash never leaves
+// a partial file.
+func (t *smartTracker) save() error {
+	if t.path == "" {
+		return nil
+	}
+	t.mu.Lock()
+	body, err := json.Marshal(t.sortedDisks())
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(t.path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, ".smart-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
+
+// record adds the readings of target's disks, dropping those older than
+// the window.
+func (t *smartTracker) record(now time.Time, target string, readings map[string]*smartReading) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for device, r := range readings {
+		key := smartDiskKey(target, device)
+		d, ok := t.disks[key]
+		if !ok {
+			d = &smartDisk{Target: target, Device: device}
+			t.disks[key] = d
+		}
+		d.Readings = append(d.Readings, *r)
+	}
+	cutoff := now.Add(-t.window)
+	for key, d := range t.disks {
+		drop := 0
+		for drop < len(d.Readings) && d.Readings[drop].Time.Before(cutoff) {
+			drop++
+		}
+		d.Readings = d.Readings[drop:]
+		if len(d.Readings) == 0 {
+			delete(t.disks, key)
+		}
+	}
+}
+
+// sortedDisks returns the disks by target and device. t.mu must be held.
+func (t *smartTracker) sortedDisks() []*smartDisk {
+	disks := make([]*smartDisk, 0, len(t.disks))
+	for _, d := range t.disks {
+		disks = append(disks, d)
+	}
+	sort.Slice(disks, func(i, j int) bool {
+		if disks[i].Target != disks[j].Target {
+			return disks[i].Target < disks[j].Target
+		}
+		return disks[i].Device < disks[j].Device
+	})
+	return disks
+}
+
+// smartPrediction is the analysis of a disk.
+type smartPrediction struct {
+	Target string
+	Device string
+	// Trends are by attribute, for those with enough readings
+	Trends map[string]smartTrend
+}
+
+func (p smartPrediction) failing() bool {
+	for _, t := range p.Trends {
+		if t.Accelerating {
+			return true
+		}
+	}
+	return false
+}
+
+// analyze returns the predictions of the disks of target, or of all disks
+// when target is empty.
+func (t *smartTracker) analyze(target string) []smartPrediction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var predictions []smartPrediction
+	for _, d := range t.sortedDisks() {
+		if target != "" && d.Target != target {
+			continue
+		}
+		p := smartPrediction{Target: d.Target, Device: d.Device, Trends: map[string]smartTrend{}}
+		for _, attribute := range []string{smartReallocated, smartPending} {
+			if trend, ok := d.trend(attribute); ok {
+				p.Trends[attribute] = trend
+			}
+		}
+		predictions = append(predictions, p)
+	}
+	return predictions
+}
+
+// runSMARTAnalyzer samples the attributes of the targets' disks every
+// interval, through the scrape cache, and flags the disks predicted to fail:
+// their smart_predicted_failure metric goes to 1 and a warning is logged.
+func (ds *testDataSource) runSMARTAnalyzer(ctx context.Context) {
+	interval := defaultSMARTInterval
+	if m := ds.settings.SMART.IntervalMinutes; m > 0 {
+		interval = time.Duration(m) * time.Minute
+	}
+	ds.smart.load()
+
+	job := ds.schedule.add("smart", "", interval, time.Now())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job.run(func() error {
+			ds.analyzeSMART(ctx)
+			return nil
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ds *testDataSource) analyzeSMART(ctx context.Context) {
+	now := time.Now()
+	for _, target := range ds.targets {
+		samples, err := ds.scrapeMetrics(ctx, target)
+		if err != nil {
+			backend.Logger.Debug("Skipping S.M.A.R.T. sample", "target", target.Name, "error", err)
+			continue
+		}
+		if readings := readSMART(now, samples); len(readings) > 0 {
+			ds.smart.record(now, target.Name, readings)
+		}
+	}
+	if err := ds.smart.save(); err != nil {
+		backend.Logger.Warn("Failed to store S.M.A.R.T. history", "error", err)
+	}
+
+	predictions := ds.smart.analyze("")
+	ds.smart.mu.Lock()
+	defer ds.smart.mu.Unlock()
+	for _, p := range predictions {
+		key := smartDiskKey(p.Target, p.Device)
+		failing := p.failing()
+		value := 0.0
+		if failing {
+			value = 1
+		}
+		smartPredictedFailure.WithLabelValues(p.Target, p.Device).Set(value)
+		switch {
+		case failing && !ds.smart.flagged[key]:
+			backend.Logger.Warn("Disk predicted to fail", "target", p.Target, "device", p.Device,
+				"reallocatedPerDay", p.Trends[smartReallocated].RecentRate, "pendingPerDay", p.Trends[smartPending].RecentRate)
+		case !failing && ds.smart.flagged[key]:
+			backend.Logger.Info("Disk no longer predicted to fail", "target", p.Target, "device", p.Device)
+		}
+		ds.smart.flagged[key] = failing
+	}
+}
+
+var smartStates = stateScale{"ok": severityOK, "accelerating": severityCritical}
+
+func querySMART(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q smartQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if !ds.settings.SMART.Enabled {
+		return nil, fmt.Errorf("S.M.A.R.T. failure prediction is not enabled")
+	}
+
+	predictions := ds.smart.analyze(q.Target)
+	if q.Mode == "table" {
+		return data.Frames{smartTableFrame(predictions)}, nil
+	}
+
+	// One series per frame, the shape alert rules expect
+	now := time.Now()
+	frames := data.Frames{}
+	for _, p := range predictions {
+		value := 0.0
+		if p.failing() {
+			value = 1
+		}
+		labels := data.Labels{"target": p.Target, "device": p.Device}
+		frames = append(frames, data.NewFrame(p.Device,
+			data.NewField("time", nil, []time.Time{now}),
+			data.NewField("predicted_failure", labels, []float64{value}),
+		))
+	}
+	return frames, nil
+}
+
+// smartTableFrame returns the trends of each disk. Disks without enough
+// readings yet have an unknown status.
+func smartTableFrame(predictions []smartPrediction) *data.Frame {
+	statusField, severityField := newStateFields(smartStates)
+	perDay := &data.FieldConfig{Unit: "/day"}
+	frame := data.NewFrame("smart",
+		data.NewField("target", nil, []string{}),
+		data.NewField("device", nil, []string{}),
+		data.NewField("reallocated", nil, []*float64{}),
+		data.NewField("reallocated_rate", nil, []*float64{}).SetConfig(perDay),
+		data.NewField("pending", nil, []*float64{}),
+		data.NewField("pending_rate", nil, []*float64{}).SetConfig(perDay),
+		statusField,
+		severityField,
+	)
+	for _, p := range predictions {
+		status := "insufficient data"
+		if len(p.Trends) > 0 {
+			status = "ok"
+			if p.failing() {
+				status = "accelerating"
+			}
+		}
+		var values []any
+		for _, attribute := range []string{smartReallocated, smartPending} {
+			if t, ok := p.Trends[attribute]; ok {
+				values = append(values, &t.Current, &t.RecentRate)
+			} else {
+				values = append(values, (*float64)(nil), (*float64)(nil))
+			}
+		}
+		frame.AppendRow(append(append([]any{p.Target, p.Device}, values...), status, smartStates.severity(status))...)
+	}
+	return frame
+}
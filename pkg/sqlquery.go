@@ -0,0 +1,218 @@
+//go:build !nodatabase
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeSQL = "sql"
+
+const defaultSQLMaxRows = 1000
+
+// defaultAllowedStatements is used when a database has no allow-list.
+var defaultAllowedStatements = []string{`(?i)^\s*(SELECT|WITH|SHOW|EXPLAIN)\b`}
+
+func init() {
+	registerQueryType(queryTypeSQL, querySQL, sqlQuery{})
+	registerConfiguredCheck(queryTypeSQL, func(ds *testDataSource) bool { return len(ds.settings.Databases) > 0 })
+}
+
+type sqlQuery struct {
+	Database string `json:"database"`
+	RawSQL   string `json:"rawSql"`
+}
+
+// checkStatement rejects statements that don't match the database's
+// allow-list, and anything that looks like more than one statement.
+func checkStatement(cfg models.DatabaseSettings, statement string) error {
+	trimmed := strings.TrimRight(strings.TrimSpace(statement), ";")
+	if trimmed == "" {
+		return fmt.Errorf("empty SQL statement")
+	}
+	if hasMoreStatements(cfg.Kind, statement) {
+		return fmt.Errorf("only a single SQL statement is allowed")
+	}
+
+	patterns := cfg.AllowedStatements
+	if len(patterns) == 0 {
+		patterns = defaultAllowedStatements
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid statement pattern %q for database %s: %w", p, cfg.Name, err)
+		}
+		if re.MatchString(trimmed) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("statement is not allowed by the allow-list of database %s", cfg.Name)
+}
+
+// dollarQuoteRe matches the opening tag of a Postgres dollar-quoted string.
+var dollarQuoteRe = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// hasMoreStatements reports whether statement, in the SQL of a database of
+// kind, has a ";" followed by more SQL outside of literals, quoted
+// identifiers and comments. Whether backslashes escape quotes depends on
+// server settings, so statements are read both ways, and either reading
+// finding another statement counts.
+func hasMoreStatements(kind, statement string) bool {
+	return scanForStatements(kind, statement, false) || scanForStatements(kind, statement, true)
+}
+
+func scanForStatements(kind, s string, backslashEscapes bool) bool {
+	mysql := kind == databaseKindMySQL
+	// ended is set once a ";" ended the first statement
+	ended := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c <= ' ':
+			continue
+		case c == ';':
+			ended = true
+			continue
+		case c == '-' && strings.HasPrefix(s[i:], "--") && (!mysql || i+2 == len(s) || s[i+2] <= ' '):
+			// MySQL only takes "--" followed by a space for a comment;
+			// otherwise it's two minus signs
+			if end := strings.IndexByte(s[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(s)
+			}
+			continue
+		case c == '#' && mysql:
+			if end := strings.IndexByte(s[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(s)
+			}
+			continue
+		case strings.HasPrefix(s[i:], "/*") && !strings.HasPrefix(s[i:], "/*!"):
+			// MySQL runs what's in /*! */, so that is read as SQL
+			if end := strings.Index(s[i+2:], "*/"); end >= 0 {
+				i += 2 + end + 1
+			} else {
+				i = len(s)
+			}
+			continue
+		}
+		if ended {
+			return true
+		}
+		switch {
+		case c == '\'' || c == '"' || c == '`' && mysql:
+			// Doubled quotes escape quotes too
+			j := i + 1
+			for ; j < len(s); j++ {
+				if backslashEscapes && c != '`' && s[j] == '\\' {
+					j++
+					continue
+				}
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c {
+						j++
+						continue
+					}
+					break
+				}
+			}
+			i = j
+		case c == '$' && !mysql && (i == 0 || !isIdentifierByte(s[i-1])):
+			if tag := dollarQuoteRe.FindString(s[i:]); tag != "" {
+				if end := strings.Index(s[i+len(tag):], tag); end >= 0 {
+					i += len(tag) + end + len(tag) - 1
+				} else {
+					i = len(s)
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isIdentifierByte reports whether c may be part of an unquoted identifier.
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func querySQL(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q sqlQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	var cfg *models.DatabaseSettings
+	for i := range ds.settings.Databases {
+		if ds.settings.Databases[i].Name == q.Database {
+			cfg = &ds.settings.Databases[i]
+			break
+		}
+	}
+	if cfg == nil {
+		return nil, fmt.Errorf("database %q is not configured", q.Database)
+	}
+
+	var driver string
+	switch cfg.Kind {
+	case databaseKindPostgres:
+		driver = "postgres"
+	case databaseKindMySQL:
+		driver = "mysql"
+	default:
+		return nil, fmt.Errorf("database %s of kind %q does not support SQL queries", cfg.Name, cfg.Kind)
+	}
+
+	if err := checkStatement(*cfg, q.RawSQL); err != nil {
+		return nil, err
+	}
+
+	dsn, err := ds.databaseDSN(cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+	db, err := ds.sqlPools.get(cfg.Name, driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// A read-only transaction is the second line of defense after the
+	// allow-list, e.g. against writable CTEs
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start read-only transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, q.RawSQL)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+
+	maxRows := cfg.MaxRows
+	if maxRows <= 0 {
+		maxRows = defaultSQLMaxRows
+	}
+	frame, err := sqlutil.FrameFromRows(rows, maxRows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert rows: %w", err)
+	}
+	frame.Name = cfg.Name
+	frame.Meta = &data.FrameMeta{ExecutedQueryString: q.RawSQL}
+
+	return data.Frames{frame}, nil
+}
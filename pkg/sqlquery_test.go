@@ -0,0 +1,43 @@
+//go:build !nodatabase
+
+package main
+
+import (
+	"testing"
+
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+func TestCheckStatementSingleStatement(t *testing.T) {
+	tests := []struct {
+		kind      string
+		statement string
+		allowed   bool
+	}{
+		{databaseKindPostgres, `SELECT * FROM notes WHERE note = 'a;b'`, true},
+		{databaseKindMySQL, `SELECT * FROM notes WHERE note = 'a;b';`, true},
+		{databaseKindPostgres, `SELECT "odd;column" FROM notes; -- trailing comment`, true},
+		{databaseKindPostgres, "SELECT 1 /* a; b */ + 1", true},
+		{databaseKindPostgres, `SELECT $body$a;b$body$, 'it''s;'`, true},
+		{databaseKindMySQL, "SELECT `odd;column` FROM notes # why;\n", true},
+		{databaseKindPostgres, `SELECT 1; DELETE FROM notes`, false},
+		{databaseKindPostgres, `SELECT 'a;b'; DELETE FROM notes`, false},
+		{databaseKindPostgres, "SELECT 1; /* more */ DELETE FROM notes", false},
+		// The backslash ends the literal unless backslashes escape quotes
+		{databaseKindPostgres, `SELECT 'a\'; DELETE FROM notes; --'`, false},
+		// MySQL takes "--" without a space after for two minus signs
+		{databaseKindMySQL, `SELECT 1--1; DELETE FROM notes`, false},
+		{databaseKindMySQL, `SELECT 1 /*!; DELETE FROM notes */`, false},
+		// # is an operator in Postgres
+		{databaseKindPostgres, `SELECT 1 # 2; DELETE FROM notes`, false},
+	}
+	for _, tt := range tests {
+		cfg := models.DatabaseSettings{Name: "notes", Kind: tt.kind}
+		err := checkStatement(cfg, tt.statement)
+		if tt.allowed && err != nil {
+			t.Errorf("%s: %q was rejected: %v", tt.kind, tt.statement, err)
+		} else if !tt.allowed && err == nil {
+			t.Errorf("%s: %q was allowed", tt.kind, tt.statement)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// sseDefaultEvent is the type of events that don't set one.
+const sseDefaultEvent = "message"
+
+// maxSSELine bounds the lines of event streams, so that a stream without
+// line breaks can't grow a line without limit.
+const maxSSELine = 1 << 20
+
+// sseStream is where the event stream of an SSE source stands. It is only
+// used by the source's scraper.
+type sseStream struct {
+	events map[string]bool
+	// lastEventID resumes the stream after reconnecting, and retry is the
+	// reconnection time the source asked for
+	lastEventID string
+	retry       time.Duration
+}
+
+func newSSEStream(events []string) *sseStream {
+	if len(events) == 0 {
+		events = []string{sseDefaultEvent}
+	}
+	s := &sseStream{events: map[string]bool{}}
+	for _, event := range events {
+		s.events[event] = true
+	}
+	return s
+}
+
+// sseEvent is an event of a stream, or only a retry field, with no data.
+type sseEvent struct {
+	event string
+	data  string
+	id    string
+	// hasID tells an empty id field, which resets the last event ID, from
+	// none
+	hasID bool
+	retry time.Duration
+}
+
+// streamSSE subscribes to target and ingests its events until the stream
+// fails or ends, returning why, or the instance is disposed of.
+func (ds *testDataSource) streamSSE(ctx context.Context, target *scrapeTarget) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %w", redactURL(target.URL), err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if target.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+target.Token)
+	}
+	if target.sse.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", target.sse.lastEventID)
+	}
+
+	// Streams stay open, so the overall timeout of scrapes doesn't apply
+	client := *ds.httpClient
+	client.Timeout = 0
+	resp, err := send(&client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		return fmt.Errorf("%s is not an event stream: content type %q", redactURL(target.URL), resp.Header.Get("Content-Type"))
+	}
+	target.push.connected()
+	backend.Logger.Info("SSE source connected", "target", target.Name, "lastEventId", target.sse.lastEventID)
+
+	// Reads block, so they run apart, until the request is cancelled
+	events := make(chan sseEvent)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readSSE(resp.Body, func(e sseEvent) bool {
+			select {
+			case events <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	ticker := time.NewTicker(pushRecordInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ds.drain:
+			return nil
+		case err := <-readErr:
+			if err == nil {
+				err = fmt.Errorf("stream ended")
+			}
+			return err
+		case e := <-events:
+			if e.retry > 0 {
+				target.sse.retry = e.retry
+			}
+			if e.hasID {
+				target.sse.lastEventID = e.id
+			}
+			if e.data == "" || !target.sse.events[e.event] {
+				continue
+			}
+			if err := target.push.ingest([]byte(e.data)); err != nil {
+				backend.Logger.Debug("Ignoring SSE event", "target", target.Name, "event", e.event, "error", err)
+			}
+		case now := <-ticker.C:
+			target.push.flush(target, now)
+		}
+	}
+}
+
+// readSSE parses an event stream, calling dispatch with each event until it
+// returns false. Per the EventSource spec, lines starting with a colon are
+// comments, data lines are joined with newlines, and id fields containing
+// NUL are ignored.
+func readSSE(r io.Reader, dispatch func(sseEvent) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxSSELine)
+	scanner.Split(scanSSELines)
+
+	var e sseEvent
+	var data []string
+	pending := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if pending {
+				e.data = strings.Join(data, "\n")
+				if e.event == "" {
+					e.event = sseDefaultEvent
+				}
+				if !dispatch(e) {
+					return nil
+				}
+			}
+			e, data, pending = sseEvent{}, nil, false
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			e.event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				e.id, e.hasID = value, true
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 32); err == nil {
+				e.retry = time.Duration(ms) * time.Millisecond
+			}
+		default:
+			continue
+		}
+		pending = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read event stream: %w", err)
+	}
+	return nil
+}
+
+// scanSSELines splits lines ending with CRLF, LF or CR.
+func scanSSELines(data []byte, atEOF bool) (int, []byte, error) {
+	for i, b := range data {
+		switch b {
+		case '\n':
+			return i + 1, data[:i], nil
+		case '\r':
+			// A CR at the end of the buffer may start a CRLF
+			if i+1 == len(data) && !atEOF {
+				return 0, nil, nil
+			}
+			if i+1 < len(data) && data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
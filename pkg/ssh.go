@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// sshHandshakeTimeout bounds the SSH handshake with a host that accepted the
+// connection, when the query has no earlier deadline.
+const sshHandshakeTimeout = 15 * time.Second
+
+// hostQuery is the query model shared by collectors that run over SSH.
+type hostQuery struct {
+	Host string `json:"host"`
+}
+
+// sshHosts resolves the hosts a query should run against. An empty host means
+// every configured host; anything else must be one of the configured hosts so
+// a query can't point the stored credentials at an arbitrary machine.
+func (ds *testDataSource) sshHosts(host string) ([]string, error) {
+	configured := ds.settings.SSH.AllHosts()
+	if len(configured) == 0 {
+		return nil, fmt.Errorf("no SSH host configured")
+	}
+	if host == "" {
+		return configured, nil
+	}
+	for _, h := range configured {
+		if h == host {
+			return []string{host}, nil
+		}
+	}
+	return nil, fmt.Errorf("SSH host %q is not configured", host)
+}
+
+// sshAddr returns the address to dial for an SSH host, on port 22 unless
+// it has a port. IPv6 literals may be bare or in brackets.
+func sshAddr(host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return net.JoinHostPort(host, "22"), nil
+	}
+	_, _, err := net.SplitHostPort(host)
+	var addrErr *net.AddrError
+	switch {
+	case err == nil:
+		return host, nil
+	case errors.As(err, &addrErr) && addrErr.Err == "missing port in address":
+		return net.JoinHostPort(strings.Trim(host, "[]"), "22"), nil
+	}
+	return "", fmt.Errorf("invalid SSH host %q: %w", host, err)
+}
+
+// sshHostname returns an SSH host without its port, if any.
+func sshHostname(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// sshHostKeyCallback returns the callback verifying the key of host: its
+// key in HostKeys, by host as configured or without its port, or HostKey
+// for Host.
+func sshHostKeyCallback(cfg models.SSHSettings, host string) (ssh.HostKeyCallback, error) {
+	hostKey, ok := cfg.HostKeys[host]
+	if !ok {
+		hostKey, ok = cfg.HostKeys[sshHostname(host)]
+	}
+	if !ok && host == cfg.Host {
+		hostKey = cfg.HostKey
+	}
+	switch {
+	case hostKey != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH host key of %s: %w", host, err)
+		}
+		return ssh.FixedHostKey(key), nil
+	case cfg.InsecureSkipHostKeyVerification:
+		backend.Logger.Warn("SSH host key verification is turned off", "host", host)
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	return nil, fmt.Errorf("no SSH host key configured for %s: add it to hostKeys, or set insecureSkipHostKeyVerification to connect without verifying the host", host)
+}
+
+// shellQuote quotes s as a single word for the POSIX shell running remote
+// commands.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellCommand returns the command line running args, each quoted.
+func shellCommand(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// runRemoteCommand runs cmd on host over SSH and returns its stdout.
+func (ds *testDataSource) runRemoteCommand(ctx context.Context, host, cmd string) ([]byte, error) {
+	cfg := ds.settings.SSH
+
+	var auth []ssh.AuthMethod
+	if ds.settings.Secrets != nil && ds.settings.Secrets.SSHPrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(ds.settings.Secrets.SSHPrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if ds.settings.Secrets != nil && ds.settings.Secrets.SSHPassword != "" {
+		auth = append(auth, ssh.Password(ds.settings.Secrets.SSHPassword))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no SSH password or private key configured")
+	}
+
+	hostKeyCallback, err := sshHostKeyCallback(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := sshAddr(host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ds.egress.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	// Tear the connection down if the query is cancelled, be it during the
+	// handshake or mid-command
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// A host that accepts the connection but never answers would otherwise
+	// hold the handshake forever
+	deadline := time.Now().Add(sshHandshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshHandshakeTimeout,
+	})
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("SSH handshake with %s failed: %w", addr, err)
+	}
+	// Commands run as long as the query lets them
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(cmd); err != nil {
+		return nil, fmt.Errorf("remote command %q failed: %w: %s", cmd, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
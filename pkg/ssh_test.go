@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHAddr(t *testing.T) {
+	tests := map[string]string{
+		"nas":              "nas:22",
+		"nas:2222":         "nas:2222",
+		"192.168.1.10":     "192.168.1.10:22",
+		"fd00::10":         "[fd00::10]:22",
+		"[fd00::10]":       "[fd00::10]:22",
+		"[fd00::10]:2222":  "[fd00::10]:2222",
+		"nas.example.com.": "nas.example.com.:22",
+	}
+	for host, want := range tests {
+		if got, err := sshAddr(host); err != nil || got != want {
+			t.Errorf("sshAddr(%q) = %q, %v, want %q", host, got, err, want)
+		}
+	}
+	if _, err := sshAddr("[fd00::10"); err == nil {
+		t.Error("sshAddr accepted an unclosed bracket")
+	}
+}
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSSHHostKeyCallback(t *testing.T) {
+	nasKey, routerKey, piKey := newTestHostKey(t), newTestHostKey(t), newTestHostKey(t)
+	cfg := models.SSHSettings{
+		Host:    "nas",
+		Hosts:   []string{"router:2222", "fd00::10"},
+		HostKey: string(ssh.MarshalAuthorizedKey(nasKey)),
+		HostKeys: map[string]string{
+			"router":   string(ssh.MarshalAuthorizedKey(routerKey)),
+			"fd00::10": string(ssh.MarshalAuthorizedKey(piKey)),
+		},
+	}
+	remote := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 22}
+	hosts := []string{"nas", "router:2222", "fd00::10"}
+	keys := []ssh.PublicKey{nasKey, routerKey, piKey}
+	for i, host := range hosts {
+		callback, err := sshHostKeyCallback(cfg, host)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		for j, key := range keys {
+			err := callback(host, remote, key)
+			if i == j && err != nil {
+				t.Errorf("%s: its own key was refused: %v", host, err)
+			} else if i != j && err == nil {
+				t.Errorf("%s: the key of %s was accepted", host, hosts[j])
+			}
+		}
+	}
+
+	if _, err := sshHostKeyCallback(cfg, "backup"); err == nil {
+		t.Error("a host without a key was accepted")
+	}
+	cfg.InsecureSkipHostKeyVerification = true
+	if _, err := sshHostKeyCallback(cfg, "backup"); err != nil {
+		t.Errorf("a host without a key was refused despite insecureSkipHostKeyVerification: %v", err)
+	}
+}
+
+// TestRunRemoteCommandSilentHost checks that a host accepting the connection
+// but never answering the handshake doesn't outlive the query.
+func TestRunRemoteCommandSilentHost(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ds := newTestDataSource()
+	ds.settings = &models.PluginSettings{
+		SSH:     models.SSHSettings{User: "monitor", Host: l.Addr().String(), InsecureSkipHostKeyVerification: true},
+		Secrets: &models.SecretPluginSettings{SSHPassword: "secret"},
+	}
+	for name, ctx := range map[string]func() (context.Context, context.CancelFunc){
+		"deadline": func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 100*time.Millisecond)
+		},
+		"cancel": func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			return ctx, cancel
+		},
+	} {
+		ctx, cancel := ctx()
+		start := time.Now()
+		_, err := ds.runRemoteCommand(ctx, l.Addr().String(), "true")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: got %v, want the query's error", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: the handshake held the query %v", name, elapsed)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to run the quoted words")
+	}
+	for _, word := range []string{
+		"/srv/data",
+		"/mnt/Backup Disk",
+		"/tmp/it's",
+		"/tmp/$(reboot)",
+		"/tmp/`id`; rm -rf /",
+		`/tmp/"quoted" \ back`,
+		"",
+	} {
+		out, err := exec.Command(sh, "-c", "printf %s "+shellQuote(word)).Output()
+		if err != nil {
+			t.Fatalf("%q: %v", word, err)
+		}
+		if string(out) != word {
+			t.Errorf("shellQuote(%q) reached the shell as %q", word, out)
+		}
+	}
+}
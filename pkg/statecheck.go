@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Kinds of damage to the files of the state directory.
+const (
+	// stateLeftover is a temporary file of a write interrupted by a crash
+	stateLeftover = "leftover"
+	// stateCorrupt is a file, or a line of the audit log, that doesn't parse
+	stateCorrupt = "corrupt"
+	// stateBroken is an audit log whose hash chain is broken
+	stateBroken = "broken"
+)
+
+// corruptSuffix is added to the name of the corrupt files the repair moves
+// aside, and to that of the file keeping the corrupt lines of the audit log.
+const corruptSuffix = ".corrupt"
+
+// stateFiles are the files an instance keeps in the state directory: its
+// pings, saved queries, audit log, discovery indexes and the histories of
+// its trackers. The stores skip what they can't read, so the damage a crash
+// leaves goes unnoticed and is overwritten; the files are checked when the
+// instance starts and repaired on request instead.
+type stateFiles struct {
+	dir string
+}
+
+// newStateFiles returns the files of instance uid under stateDir, or nil
+// when stateDir is not set.
+func newStateFiles(stateDir, uid string) *stateFiles {
+	if stateDir == "" {
+		return nil
+	}
+	return &stateFiles{dir: filepath.Join(stateDir, url.PathEscape(uid))}
+}
+
+// stateProblem is damage found in a file of the state directory. Repair says
+// what the repair does about it, and is empty for damage left for an admin
+// to look into, such as a broken audit chain.
+type stateProblem struct {
+	File   string `json:"file"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	Repair string `json:"repair,omitempty"`
+}
+
+type stateReport struct {
+	CheckedAt time.Time      `json:"checkedAt"`
+	Files     int            `json:"files"`
+	Problems  []stateProblem `json:"problems"`
+}
+
+// check checks every file of the state directory.
+func (s *stateFiles) check() (stateReport, error) {
+	report := stateReport{CheckedAt: time.Now().UTC(), Problems: []stateProblem{}}
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == s.dir {
+			// Nothing stored yet
+			return fs.SkipAll
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		report.Files++
+		report.Problems = append(report.Problems, checkStateFile(path, filepath.ToSlash(rel))...)
+		return nil
+	})
+	return report, err
+}
+
+// checkStateFile checks the file at path, rel to the state directory.
+func checkStateFile(path, rel string) []stateProblem {
+	name := filepath.Base(path)
+	switch {
+	case strings.HasSuffix(name, corruptSuffix):
+		// Moved aside by an earlier repair
+		return nil
+	case strings.HasPrefix(name, "."):
+		return []stateProblem{{File: rel, Kind: stateLeftover, Detail: "temporary file of a write interrupted by a crash", Repair: "remove it"}}
+	case name == "audit.jsonl":
+		return checkAuditFile(path, rel)
+	case filepath.Ext(name) != ".json":
+		return nil
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return []stateProblem{{File: rel, Kind: stateCorrupt, Detail: err.Error()}}
+	}
+	if json.Valid(body) {
+		return nil
+	}
+	problem := stateProblem{File: rel, Kind: stateCorrupt, Detail: "not valid JSON", Repair: "move it aside as " + name + corruptSuffix + " for the store to start over"}
+	if strings.HasPrefix(rel, "discovery/") {
+		problem.Repair = "remove it and rebuild it from the target's last scrape"
+	}
+	return []stateProblem{problem}
+}
+
+// checkAuditFile checks that every line of the audit log is an entry, and
+// that the hash chain of the entries is intact.
+func checkAuditFile(path, rel string) []stateProblem {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return []stateProblem{{File: rel, Kind: stateCorrupt, Detail: err.Error()}}
+	}
+	var problems []stateProblem
+	var entries []auditEntry
+	for i, line := range bytes.Split(bytes.TrimSuffix(body, []byte("\n")), []byte("\n")) {
+		var entry auditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			problems = append(problems, stateProblem{
+				File:   rel,
+				Kind:   stateCorrupt,
+				Detail: fmt.Sprintf("line %d is not an entry: %v", i+1, err),
+				Repair: "move the line to audit.jsonl" + corruptSuffix + ", the log skips it",
+			})
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if i := auditChainBreak(entries); i >= 0 {
+		// The log is append-only: rewriting the chain would hide the edit
+		problems = append(problems, stateProblem{File: rel, Kind: stateBroken, Detail: fmt.Sprintf("the hash chain breaks at entry %d", entries[i].Seq)})
+	}
+	return problems
+}
+
+// checkAtStartup logs the damage found in the state directory.
+func (s *stateFiles) checkAtStartup() {
+	report, err := s.check()
+	if err != nil {
+		backend.Logger.Warn("Failed to check the state directory", "dir", s.dir, "error", err)
+		return
+	}
+	for _, p := range report.Problems {
+		backend.Logger.Warn("Damaged state file", "dir", s.dir, "file", p.File, "kind", p.Kind, "detail", p.Detail, "repair", p.Repair)
+	}
+	if len(report.Problems) > 0 {
+		backend.Logger.Warn("State directory damaged, see POST /admin/repair", "dir", s.dir, "problems", len(report.Problems))
+	}
+}
+
+// repairState repairs the problems of report that can be, reporting
+// progress by problem, and returns how many it repaired.
+func (ds *testDataSource) repairState(ctx context.Context, report stateReport, progress operationProgress) (int, error) {
+	var errs []error
+	repaired := 0
+	auditRepaired := false
+	for i, p := range report.Problems {
+		if ctx.Err() != nil {
+			break
+		}
+		if p.Repair == "" {
+			continue
+		}
+		progress(i, len(report.Problems), "repairing "+p.File)
+		path := filepath.Join(ds.stateFiles.dir, filepath.FromSlash(p.File))
+		var err error
+		switch {
+		case p.Kind == stateLeftover:
+			err = os.Remove(path)
+		case filepath.Base(path) == "audit.jsonl":
+			// The corrupt lines all go at once
+			if !auditRepaired {
+				err, auditRepaired = ds.audit.moveCorruptLines(), true
+			}
+		default:
+			err = ds.repairStateFile(path, p.File)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("%s: %w", p.File, err))
+			continue
+		}
+		repaired++
+	}
+	progress(len(report.Problems), len(report.Problems), fmt.Sprintf("%d of %d problems repaired", repaired, len(report.Problems)))
+	return repaired, errors.Join(errs...)
+}
+
+// repairStateFile moves the corrupt file at path aside, or removes a corrupt
+// discovery index and saves the target's current one in its place. Files
+// stores rewrote since they were checked are left alone.
+func (ds *testDataSource) repairStateFile(path, rel string) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if json.Valid(body) {
+		return nil
+	}
+	name, ok := strings.CutPrefix(rel, "discovery/")
+	if !ok {
+		return os.Rename(path, path+corruptSuffix)
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	target, err := url.PathUnescape(strings.TrimSuffix(name, ".json"))
+	if err != nil {
+		return nil
+	}
+	for _, t := range ds.targets {
+		if index := t.discovery(); t.Name == target && index != nil {
+			return ds.discoveryStore.save(t.Name, index)
+		}
+	}
+	return nil
+}
+
+// handleStateCheck checks the files of the state directory.
+func (ds *testDataSource) handleStateCheck(w http.ResponseWriter, _ *http.Request) {
+	if ds.stateFiles == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no state directory configured"))
+		return
+	}
+	report, err := ds.stateFiles.check()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleRepair repairs the damage found in the files of the state directory,
+// as an operation: leftovers of interrupted writes are removed, corrupt
+// files moved aside and corrupt discovery indexes rebuilt. A broken audit
+// chain is only reported.
+func (ds *testDataSource) handleRepair(w http.ResponseWriter, r *http.Request) {
+	if ds.stateFiles == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no state directory configured"))
+		return
+	}
+	report, err := ds.stateFiles.check()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	o, err := ds.startOperation(r.Context(), "repair", "", func(ctx context.Context, progress operationProgress) error {
+		repaired, err := ds.repairState(ctx, report, progress)
+		if repaired > 0 {
+			ds.audit.record(r.Context(), auditKindRepair, fmt.Sprintf("State directory repaired (%d problems)", repaired))
+		}
+		return err
+	})
+	writeOperation(w, o, err)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// TestRepairState checks the state directory a crash left behind, and
+// repairs it.
+func TestRepairState(t *testing.T) {
+	stateDir := t.TempDir()
+	ds := newTestDataSource()
+	ds.uid = "homelab-state"
+	ds.operations = newOperationTracker(context.Background(), ds.uid)
+	ds.stateFiles = newStateFiles(stateDir, ds.uid)
+	ds.discoveryStore = newDiscoveryStore(stateDir, ds.uid)
+	ds.targets[0].cache(testStart, []metricSample{{seriesInfo: seriesInfo{Family: "node_load1", Name: "node_load1", Labels: data.Labels{}}, Value: 1}}, scrapeStats{})
+
+	if report, err := ds.stateFiles.check(); err != nil || report.Files != 0 || len(report.Problems) != 0 {
+		t.Fatalf("empty state directory: %+v, %v", report, err)
+	}
+
+	dir := ds.stateFiles.dir
+	ds.audit = auditLogFor(stateDir, ds.uid)
+	ds.audit.record(context.Background(), auditKindSettings, "Settings recorded")
+	ds.audit.record(context.Background(), auditKindFaults, "Injected faults")
+	files := map[string]string{
+		"pings.json":          `{"backup": []}`,
+		"queries.json":        `{"load": {"name": "lo`,
+		".pings-1234":         `{}`,
+		"discovery/nas.json":  `{"scrapedAt": `,
+		"discovery/.disc-999": ``,
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An append cut short
+	audit, err := os.OpenFile(filepath.Join(dir, "audit.jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.WriteString(`{"seq": 3, "kind": "hist`)
+	audit.Close()
+
+	report, err := ds.stateFiles.check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, p := range report.Problems {
+		found = append(found, p.Kind+" "+p.File)
+		if p.Repair == "" {
+			t.Errorf("%s %s: no repair", p.Kind, p.File)
+		}
+	}
+	slices.Sort(found)
+	want := []string{
+		"corrupt audit.jsonl",
+		"corrupt discovery/nas.json",
+		"corrupt queries.json",
+		"leftover .pings-1234",
+		"leftover discovery/.disc-999",
+	}
+	if !slices.Equal(found, want) {
+		t.Errorf("problems %q, want %q", found, want)
+	}
+
+	repaired, err := ds.repairState(context.Background(), report, func(int, int, string) {})
+	if err != nil || repaired != len(want) {
+		t.Errorf("repaired %d problems, %v, want %d", repaired, err, len(want))
+	}
+	if report, err := ds.stateFiles.check(); err != nil || len(report.Problems) != 0 {
+		t.Errorf("problems after repair: %+v, %v", report.Problems, err)
+	}
+	if body, _ := os.ReadFile(filepath.Join(dir, "queries.json.corrupt")); string(body) != files["queries.json"] {
+		t.Errorf("corrupt saved queries kept aside as %q", body)
+	}
+	if body, _ := os.ReadFile(filepath.Join(dir, "audit.jsonl.corrupt")); !strings.HasPrefix(string(body), `{"seq": 3`) {
+		t.Errorf("corrupt audit line kept aside as %q", body)
+	}
+	var index discoveryIndex
+	if body, err := os.ReadFile(filepath.Join(dir, "discovery", "nas.json")); err != nil || json.Unmarshal(body, &index) != nil || !index.ScrapedAt.Equal(testStart) {
+		t.Errorf("discovery index of nas not rebuilt from its scrape: %s, %v", body, err)
+	}
+	if entries, intact := ds.audit.list("", "", time.Time{}, 10); !intact || len(entries) != 2 {
+		t.Errorf("audit log has %d entries, intact %v, want the 2 recorded", len(entries), intact)
+	}
+
+	// An edited entry is reported, and left alone
+	body, _ := os.ReadFile(filepath.Join(dir, "audit.jsonl"))
+	edited := strings.Replace(string(body), "Injected faults", "Nothing happened", 1)
+	if err := os.WriteFile(filepath.Join(dir, "audit.jsonl"), []byte(edited), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	report, err = ds.stateFiles.check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != stateBroken || report.Problems[0].Repair != "" {
+		t.Errorf("edited audit log: %+v, want a broken chain left alone", report.Problems)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Severities of states, in the numeric severity field that goes along with
+// the textual status field of state tables.
+const (
+	severityOK       int64 = 0
+	severityWarning  int64 = 1
+	severityCritical int64 = 2
+)
+
+// Colors of severities, from the Okabe-Ito palette, which stays
+// distinguishable with the common kinds of color blindness. Mapped texts
+// carry a symbol as well, so states don't rely on color alone.
+const (
+	colorOK       = "#0072B2"
+	colorWarning  = "#E69F00"
+	colorCritical = "#D55E00"
+	colorUnknown  = "#999999"
+)
+
+// severityStyles are how severities are displayed.
+var severityStyles = map[int64]struct{ symbol, name, color string }{
+	severityOK:       {"✓", "OK", colorOK},
+	severityWarning:  {"⚠", "Warning", colorWarning},
+	severityCritical: {"✖", "Critical", colorCritical},
+}
+
+// severityDisplay maps a value of the given severity to text, after the
+// symbol of the severity.
+func severityDisplay(severity int64, text string) data.ValueMappingResult {
+	style := severityStyles[severity]
+	return data.ValueMappingResult{Text: style.symbol + " " + text, Color: style.color, Index: int(severity)}
+}
+
+var unknownDisplay = data.ValueMappingResult{Text: "? Unknown", Color: colorUnknown, Index: 3}
+
+// stateScale maps the textual states of a table to severities. States not
+// in it are unknown.
+type stateScale map[string]int64
+
+// severity returns the severity of state, or nil if it is unknown.
+func (s stateScale) severity(state string) *int64 {
+	if severity, ok := s[state]; ok {
+		return &severity
+	}
+	return nil
+}
+
+// statusConfig maps the states to texts and colors of their severity.
+func (s stateScale) statusConfig() *data.FieldConfig {
+	mapper := data.ValueMapper{}
+	for state, severity := range s {
+		mapper[state] = severityDisplay(severity, state)
+	}
+	return &data.FieldConfig{Mappings: data.ValueMappings{mapper}}
+}
+
+// severityConfig maps severities to texts and colors, with a mapping for
+// unknown states.
+func severityConfig() *data.FieldConfig {
+	mapper := data.ValueMapper{}
+	for severity, style := range severityStyles {
+		mapper[strconv.FormatInt(severity, 10)] = severityDisplay(severity, style.name)
+	}
+	return &data.FieldConfig{
+		Min: ptrConfFloat64(float64(severityOK)),
+		Max: ptrConfFloat64(float64(severityCritical)),
+		Mappings: data.ValueMappings{
+			mapper,
+			data.SpecialValueMapper{Match: data.SpecialValueNull, Result: unknownDisplay},
+		},
+	}
+}
+
+// upConfig maps the values of up fields, 1 or true and 0 or false, to texts
+// and colors.
+func upConfig() *data.FieldConfig {
+	up, down := severityDisplay(severityOK, "Up"), severityDisplay(severityCritical, "Down")
+	return &data.FieldConfig{Mappings: data.ValueMappings{
+		data.ValueMapper{"1": up, "true": up, "0": down, "false": down},
+		data.SpecialValueMapper{Match: data.SpecialValueNull, Result: unknownDisplay},
+	}}
+}
+
+// newStateFields returns the textual status field and the numeric severity
+// field of a state table.
+func newStateFields(scale stateScale) (*data.Field, *data.Field) {
+	return data.NewField("status", nil, []string{}).SetConfig(scale.statusConfig()),
+		data.NewField("severity", nil, []*int64{}).SetConfig(severityConfig())
+}
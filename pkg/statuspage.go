@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// Statuses of status page checks, from best to worst.
+const (
+	statusUp       = "up"
+	statusDegraded = "degraded"
+	statusDown     = "down"
+	statusUnknown  = "unknown"
+)
+
+var statusRank = map[string]int{statusUp: 0, statusUnknown: 1, statusDegraded: 2, statusDown: 3}
+
+const (
+	defaultStatusTitle = "Homelab status"
+	defaultStatusRange = 5 * time.Minute
+	// statusPageTTL is how long a report is served before the checks run
+	// again, however often the page is loaded
+	statusPageTTL = 30 * time.Second
+	// statusCheckTimeout bounds the query of each check
+	statusCheckTimeout = 10 * time.Second
+)
+
+// statusPage is the status page of an instance.
+type statusPage struct {
+	title  string
+	checks []models.StatusCheck
+	token  string
+
+	mu     sync.Mutex
+	report *statusReport
+}
+
+// statusReport is what the status page shows. It says nothing about why a
+// check is down, as the page is public to whoever has the token.
+type statusReport struct {
+	Title     string              `json:"title"`
+	Status    string              `json:"status"`
+	CheckedAt time.Time           `json:"checkedAt"`
+	Checks    []statusCheckResult `json:"checks"`
+}
+
+type statusCheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// newStatusPage validates the status page settings. There is no page, and
+// it returns nil, without a token.
+func newStatusPage(settings models.StatusPageSettings, token string) (*statusPage, error) {
+	if token == "" {
+		return nil, nil
+	}
+	if len(settings.Checks) == 0 {
+		return nil, fmt.Errorf("the status page has no checks")
+	}
+	seen := map[string]bool{}
+	for _, c := range settings.Checks {
+		switch {
+		case c.Name == "":
+			return nil, fmt.Errorf("status check has no name")
+		case seen[c.Name]:
+			return nil, fmt.Errorf("duplicate status check name %q", c.Name)
+		case len(c.Query) == 0:
+			return nil, fmt.Errorf("status check %s has no query", c.Name)
+		case c.RangeSeconds < 0:
+			return nil, fmt.Errorf("status check %s has a negative rangeSeconds", c.Name)
+		case c.Min != nil && c.Max != nil && *c.Min > *c.Max:
+			return nil, fmt.Errorf("status check %s has min above max", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	title := settings.Title
+	if title == "" {
+		title = defaultStatusTitle
+	}
+	return &statusPage{title: title, checks: settings.Checks, token: token}, nil
+}
+
+// current returns the report of the last statusPageTTL, running the checks
+// for a new one when it is older.
+func (p *statusPage) current(ctx context.Context, ds *testDataSource) statusReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.report != nil && now.Sub(p.report.CheckedAt) < statusPageTTL {
+		return *p.report
+	}
+	report := statusReport{Title: p.title, Status: statusUp, CheckedAt: now.UTC()}
+	for _, c := range p.checks {
+		status := ds.statusCheck(ctx, c, now)
+		if statusRank[status] > statusRank[report.Status] {
+			report.Status = status
+		}
+		report.Checks = append(report.Checks, statusCheckResult{Name: c.Name, Status: status})
+	}
+	p.report = &report
+	return report
+}
+
+// statusCheck runs the query of c over the range ending at now, and judges
+// its result.
+func (ds *testDataSource) statusCheck(ctx context.Context, c models.StatusCheck, now time.Time) string {
+	ctx, cancel := context.WithTimeout(ctx, statusCheckTimeout)
+	defer cancel()
+	span := defaultStatusRange
+	if c.RangeSeconds > 0 {
+		span = time.Duration(c.RangeSeconds) * time.Second
+	}
+	query := backend.DataQuery{
+		RefID:         "A",
+		TimeRange:     backend.TimeRange{From: now.Add(-span), To: now},
+		Interval:      max(span/100, time.Second),
+		MaxDataPoints: 100,
+	}
+	frames, err := ds.runInnerQuery(ctx, query, c.Query)
+	if err != nil {
+		backend.Logger.Warn("Status check failed", "check", c.Name, "error", err)
+		return statusDown
+	}
+	status, err := frameStatus(frames, c.Min, c.Max)
+	if err != nil {
+		backend.Logger.Warn("Status check failed", "check", c.Name, "error", err)
+		return statusUnknown
+	}
+	return status
+}
+
+// frameStatus judges the result of a status check: by the worst severity of
+// its state tables, or else by the last value of each of its series, which
+// must be within min and max. A result without values is unknown.
+func frameStatus(frames data.Frames, minValue, maxValue *float64) (string, error) {
+	var severity *int64
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			if field.Name != "severity" || field.Type() != data.FieldTypeNullableInt64 {
+				continue
+			}
+			for row := 0; row < field.Len(); row++ {
+				if v, ok := field.ConcreteAt(row); ok && (severity == nil || v.(int64) > *severity) {
+					s := v.(int64)
+					severity = &s
+				}
+			}
+		}
+	}
+	if severity != nil {
+		switch *severity {
+		case severityOK:
+			return statusUp, nil
+		case severityWarning:
+			return statusDegraded, nil
+		default:
+			return statusDown, nil
+		}
+	}
+
+	series, err := lastValues(frames)
+	if err != nil {
+		return "", err
+	}
+	status := statusUnknown
+	for _, s := range series {
+		if s.Value == nil {
+			continue
+		}
+		if (minValue != nil && *s.Value < *minValue) || (maxValue != nil && *s.Value > *maxValue) {
+			return statusDown, nil
+		}
+		status = statusUp
+	}
+	return status, nil
+}
+
+// statusColors are the colors of statuses on the page, those of severities.
+var statusColors = map[string]string{
+	statusUp:       colorOK,
+	statusDegraded: colorWarning,
+	statusDown:     colorCritical,
+	statusUnknown:  colorUnknown,
+}
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"color": func(status string) string { return statusColors[status] },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="60">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 32rem; margin: 2rem auto; padding: 0 1rem; }
+li { display: flex; justify-content: space-between; padding: .5rem 0; border-bottom: 1px solid #ddd; }
+.status { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="status" style="color: {{color .Status}}">{{.Status}}</p>
+<ul style="list-style: none; padding: 0">
+{{range .Checks}}<li><span>{{.Name}}</span><span class="status" style="color: {{color .Status}}">{{.Status}}</span></li>
+{{end}}</ul>
+<p><small>Checked at {{.CheckedAt.Format "2006-01-02 15:04:05 MST"}}</small></p>
+</body>
+</html>
+`))
+
+// serveStatusPage serves the status page of the instance of the path, as
+// HTML, or as JSON when asked for with the format parameter or the Accept
+// header. Only requests with the instance's status page token get it.
+func serveStatusPage(w http.ResponseWriter, r *http.Request) {
+	ds := liveInstances.withUID(r.PathValue("uid"), nil)
+	if ds == nil || ds.statusPage == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !hasToken(r, ds.statusPage.token) {
+		http.Error(w, "invalid status page token", http.StatusUnauthorized)
+		return
+	}
+
+	report := ds.statusPage.current(r.Context(), ds)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPageTemplate.Execute(w, report); err != nil {
+		backend.Logger.Warn("Failed to render the status page", "error", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+)
+
+// defaultStreamInterval is used when a streaming query sets no interval.
+const defaultStreamInterval = 5 * time.Second
+
+// defaultStreamKeyframe is how often delta streams push all values when
+// the query sets no keyframe interval.
+const defaultStreamKeyframe = time.Minute
+
+const streamPathPrefix = "metric/"
+
+// streamQuery is what a stream needs to know about the query that opened it.
+type streamQuery struct {
+	Target   string
+	Selector seriesSelector
+	Interval time.Duration
+	// Deltas streams push keyframes every Keyframe, and deltas in between
+	Deltas   bool
+	Keyframe time.Duration
+}
+
+// streamRegistry remembers streaming queries by channel path, since Grafana
+// only hands the path back when subscribing. Streams of a restarted plugin
+// are re-registered by the next QueryData.
+type streamRegistry struct {
+	mu      sync.Mutex
+	queries map[string]streamQuery
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{queries: map[string]streamQuery{}}
+}
+
+// register returns the channel path of q, which is stable for equal queries
+// so that panels showing the same series share a stream.
+func (r *streamRegistry) register(q Query, selector seriesSelector) string {
+	key, _ := json.Marshal(q)
+	sum := sha256.Sum256(key)
+	path := streamPathPrefix + hex.EncodeToString(sum[:8])
+
+	interval := defaultStreamInterval
+	if q.StreamIntervalSeconds > 0 {
+		interval = time.Duration(q.StreamIntervalSeconds) * time.Second
+	}
+	keyframe := defaultStreamKeyframe
+	if q.StreamKeyframeSeconds > 0 {
+		keyframe = time.Duration(q.StreamKeyframeSeconds) * time.Second
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries[path] = streamQuery{Target: q.Target, Selector: selector, Interval: interval, Deltas: q.StreamDeltas, Keyframe: keyframe}
+	return path
+}
+
+func (r *streamRegistry) get(path string) (streamQuery, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	q, ok := r.queries[path]
+	return q, ok
+}
+
+// streamChannelFrame returns the frame telling Grafana to subscribe to the
+// stream of q instead of polling.
+func (ds *testDataSource) streamChannelFrame(q Query, selector seriesSelector) *data.Frame {
+	channel := live.Channel{
+		Scope:     live.ScopeDatasource,
+		Namespace: ds.uid,
+		Path:      ds.streams.register(q, selector),
+	}
+	frame := data.NewFrame("stream")
+	frame.Meta = &data.FrameMeta{Channel: channel.String()}
+	return frame
+}
+
+func (ds *testDataSource) SubscribeStream(_ context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	if id, ok := strings.CutPrefix(req.Path, operationPathPrefix); ok {
+		if _, _, ok := ds.operations.get(id); !ok {
+			return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+		}
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+	}
+	if _, ok := ds.streams.get(req.Path); !ok {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+}
+
+// PublishStream rejects publications; streams only carry scraped samples.
+func (ds *testDataSource) PublishStream(_ context.Context, _ *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+// RunStream scrapes the stream's targets every interval and pushes the
+// matching samples as one wide frame, or its delta for delta streams.
+// Streams of operations push their progress instead.
+func (ds *testDataSource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	if strings.HasPrefix(req.Path, operationPathPrefix) {
+		return ds.runOperationStream(ctx, req.Path, sender)
+	}
+	sq, ok := ds.streams.get(req.Path)
+	if !ok {
+		return fmt.Errorf("unknown stream %s", req.Path)
+	}
+	targets, err := ds.selectTargets(sq.Target)
+	if err != nil {
+		return err
+	}
+
+	var diff *streamDiff
+	if sq.Deltas {
+		diff = &streamDiff{keyframe: sq.Keyframe}
+	}
+	ticker := time.NewTicker(sq.Interval)
+	defer ticker.Stop()
+	for {
+		frame, err := ds.streamFrame(ctx, targets, sq.Selector)
+		include := data.IncludeAll
+		if err == nil && diff != nil {
+			frame, include = diff.next(frame, time.Now())
+		}
+		if err != nil {
+			backend.Logger.Warn("Stream scrape failed", "path", req.Path, "error", err)
+		} else if frame != nil {
+			if err := sender.SendFrame(frame, include); err != nil {
+				return fmt.Errorf("failed to send stream frame: %w", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ds *testDataSource) streamFrame(ctx context.Context, targets []*scrapeTarget, selector seriesSelector) (*data.Frame, error) {
+	now := time.Now()
+	frame := data.NewFrame("stream", data.NewField("time", nil, []time.Time{now}))
+
+	for _, target := range targets {
+		samples, err := ds.scrapeMetrics(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target.Name, err)
+		}
+		for _, s := range samples {
+			// Stream frames go to all subscribers of the channel, so
+			// redacted personal series are never streamed
+			if !selector.matches(s.seriesInfo) || ds.personal.redact && ds.personal.isPersonal(target.Name, s.seriesInfo) {
+				continue
+			}
+			labels := s.Labels.Copy()
+			labels["target"] = target.Name
+			frame.Fields = append(frame.Fields, data.NewField(s.Name, labels, []float64{s.Value}))
+		}
+		ds.units.apply(data.Frames{frame}, target.declaredUnits())
+	}
+	return frame, nil
+}
+
+// streamDiff turns the frames of a delta stream into keyframes and deltas.
+// Keyframes carry the schema and all values, first, every keyframe
+// interval and whenever the series change. Deltas carry data only, with
+// the values that changed since the last push and nulls for the others,
+// which clients fill in from before; when nothing changed, nothing is
+// pushed.
+type streamDiff struct {
+	keyframe time.Duration
+	last     time.Time
+	// series are the keys of the fields of the last keyframe, and values
+	// their last values pushed
+	series []string
+	values []float64
+}
+
+// next returns what to push of frame, a frame of streamFrame taken at now,
+// and what of it to include, or nil when nothing changed.
+func (d *streamDiff) next(frame *data.Frame, now time.Time) (*data.Frame, data.FrameInclude) {
+	fields := frame.Fields[1:]
+	series := make([]string, len(fields))
+	values := make([]float64, len(fields))
+	for i, f := range fields {
+		series[i], values[i] = seriesKey(f), f.At(0).(float64)
+	}
+	out := data.NewFrame(frame.Name, frame.Fields[0])
+
+	if d.last.IsZero() || now.Sub(d.last) >= d.keyframe || !slices.Equal(series, d.series) {
+		d.last, d.series, d.values = now, series, values
+		for i, f := range fields {
+			v := values[i]
+			field := data.NewField(f.Name, f.Labels, []*float64{&v})
+			field.Config = f.Config
+			out.Fields = append(out.Fields, field)
+		}
+		return out, data.IncludeAll
+	}
+
+	changed := false
+	for i, f := range fields {
+		field := data.NewField(f.Name, f.Labels, []*float64{nil})
+		if v := values[i]; v != d.values[i] && !(math.IsNaN(v) && math.IsNaN(d.values[i])) {
+			field.Set(0, &v)
+			d.values[i] = v
+			changed = true
+		}
+		out.Fields = append(out.Fields, field)
+	}
+	if !changed {
+		return nil, 0
+	}
+	return out, data.IncludeDataOnly
+}
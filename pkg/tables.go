@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// order parses OrderBy, a field name optionally followed by "asc" or
+// "desc". The name is empty when OrderBy is unset.
+func (opts queryOptions) order() (string, bool, error) {
+	parts := strings.Fields(opts.OrderBy)
+	switch {
+	case len(parts) == 0:
+		return "", false, nil
+	case len(parts) == 1:
+		return parts[0], false, nil
+	case len(parts) == 2 && strings.EqualFold(parts[1], "asc"):
+		return parts[0], false, nil
+	case len(parts) == 2 && strings.EqualFold(parts[1], "desc"):
+		return parts[0], true, nil
+	}
+	return "", false, fmt.Errorf("invalid orderBy %q, expected a field optionally followed by asc or desc", opts.OrderBy)
+}
+
+// isTable reports whether frame is a table rather than time series, which
+// columns and orderBy leave alone.
+func isTable(frame *data.Frame) bool {
+	return frame.Meta == nil || !frame.Meta.Type.IsTimeSeries()
+}
+
+// arrangeTables sorts the rows of the tables in frames as opts.OrderBy
+// says, then keeps their fields in opts.Columns, in that order. A column
+// or order field no table has is an error, most likely a typo.
+func arrangeTables(frames data.Frames, opts queryOptions) error {
+	name, desc, err := opts.order()
+	if err != nil {
+		return err
+	}
+	if name == "" && len(opts.Columns) == 0 {
+		return nil
+	}
+
+	var tables []*data.Frame
+	has := map[string]bool{}
+	for _, frame := range frames {
+		if !isTable(frame) {
+			continue
+		}
+		tables = append(tables, frame)
+		for _, field := range frame.Fields {
+			has[field.Name] = true
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	for _, column := range append([]string{name}, opts.Columns...) {
+		if column != "" && !has[column] {
+			return fmt.Errorf("no table has a field %q", column)
+		}
+	}
+
+	for _, frame := range tables {
+		if name != "" {
+			if err := sortRows(frame, name, desc); err != nil {
+				return err
+			}
+		}
+		if len(opts.Columns) > 0 {
+			selectColumns(frame, opts.Columns)
+		}
+	}
+	return nil
+}
+
+// selectColumns keeps the fields of frame named by columns, in their order.
+func selectColumns(frame *data.Frame, columns []string) {
+	fields := make([]*data.Field, 0, len(columns))
+	for _, column := range columns {
+		for _, field := range frame.Fields {
+			if field.Name == column {
+				fields = append(fields, field)
+			}
+		}
+	}
+	frame.Fields = fields
+}
+
+// sortRows sorts the rows of frame by the named field, if it has one.
+// Empty values sort last either way.
+func sortRows(frame *data.Frame, name string, desc bool) error {
+	key, _ := frame.FieldByName(name)
+	if key == nil {
+		return nil
+	}
+	rows := make([]int, key.Len())
+	for i := range rows {
+		rows[i] = i
+	}
+	var sortErr error
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, aok := key.ConcreteAt(rows[i])
+		b, bok := key.ConcreteAt(rows[j])
+		if !aok || !bok {
+			return aok && !bok
+		}
+		c, err := compareValues(a, b)
+		if err != nil {
+			sortErr = fmt.Errorf("cannot order by field %q: %w", name, err)
+		}
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	if sortErr != nil {
+		return sortErr
+	}
+
+	for i, field := range frame.Fields {
+		sorted := data.NewFieldFromFieldType(field.Type(), len(rows))
+		sorted.Name, sorted.Labels, sorted.Config = field.Name, field.Labels, field.Config
+		for to, from := range rows {
+			sorted.Set(to, field.At(from))
+		}
+		frame.Fields[i] = sorted
+	}
+	return nil
+}
+
+// compareValues compares two concrete values of a field, returning -1, 0
+// or 1.
+func compareValues(a, b any) (int, error) {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string)), nil
+	case time.Time:
+		return a.Compare(b.(time.Time)), nil
+	case bool:
+		switch b := b.(bool); {
+		case a == b:
+			return 0, nil
+		case b:
+			return -1, nil
+		}
+		return 1, nil
+	}
+	x, err := toFloat(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := toFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case x < y:
+		return -1, nil
+	case x > y:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// toFloat converts a numeric value of a field.
+func toFloat(v any) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int8:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("values of type %T cannot be ordered", v)
+}
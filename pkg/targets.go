@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// allTargets selects every scrape target in a query.
+const allTargets = "*"
+
+// scrapeTarget is one metrics endpoint and the history of its scrapes.
+type scrapeTarget struct {
+	Name    string
+	URL     string
+	Token   string
+	Labels  data.Labels
+	history *scrapeHistory
+	// adminURL is the device's web UI, linked from the target's series
+	adminURL string
+	// parser parses responses of targets not in the Prometheus format
+	parser sampleParser
+	// push is set for targets pushing their samples, which are not
+	// scraped; subscribe are the messages sent to WebSocket sources after
+	// connecting, and sse is set for server-sent events sources
+	push      *pushSource
+	subscribe []string
+	sse       *sseStream
+	// listener is set for StatsD and Graphite listeners, which push
+	// their samples too
+	listener *metricListener
+	// agent is set for lightweight agents pushing to /agent/{uid}/{name}
+	agent *agentTarget
+	// grpc is set for gRPC services, which its parser parses the scrapes of
+	grpc *grpcSource
+	// oauth2 is set for targets getting their tokens from an OAuth2
+	// provider, instead of Token
+	oauth2 *oauth2Source
+	// session is set for targets scraped within a web UI session
+	session *webSession
+	// calibrations correct the target's samples as they are scraped
+	calibrations []calibration
+	// timeout bounds a scrape, defaultScrapeTimeout when zero
+	timeout time.Duration
+
+	// flight coalesces concurrent scrapes; the last scrape is cached
+	flight   singleflight.Group
+	mu       sync.Mutex
+	samples  []metricSample
+	cachedAt time.Time
+	stats    *scrapeStats
+	// index is built from samples when discovery first needs it
+	index *discoveryIndex
+	// units are the units of families declared by the last scrape
+	units map[string]string
+
+	// scratch is set in high-frequency mode
+	scratch *scrapeScratch
+	// clock is how far the target's clock is off
+	clock clockSkew
+	// highRes is set for targets sampling series at sub-second resolution
+	highRes *highResolution
+}
+
+func (t *scrapeTarget) setDeclaredUnits(units map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.units = units
+}
+
+// declaredUnits returns the units of families the target declares, which
+// must not be modified.
+func (t *scrapeTarget) declaredUnits() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.units
+}
+
+func (t *scrapeTarget) cache(now time.Time, samples []metricSample, stats scrapeStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples, t.cachedAt, t.stats = samples, now, &stats
+}
+
+// lastScrape returns the stats of the last successful scrape, or nil.
+func (t *scrapeTarget) lastScrape() *scrapeStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// scrapeTimeout bounds a scrape of the target, shared by the queries waiting
+// for it.
+func (t *scrapeTarget) scrapeTimeout() time.Duration {
+	if t.timeout > 0 {
+		return t.timeout
+	}
+	return defaultScrapeTimeout
+}
+
+// cachedSamples returns the last scrape if it is younger than ttl.
+func (t *scrapeTarget) cachedSamples(ttl time.Duration) ([]metricSample, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.samples == nil || time.Since(t.cachedAt) >= ttl {
+		return nil, false
+	}
+	return t.samples, true
+}
+
+// newScrapeTargets builds the scrape targets of an instance.
+func newScrapeTargets(settings *models.PluginSettings, retention time.Duration) ([]*scrapeTarget, error) {
+	configured, err := settings.ScrapeTargets()
+	if err != nil {
+		return nil, err
+	}
+	schemas, err := newPushSchemas(settings.Schemas)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]*scrapeTarget, 0, len(configured))
+	for _, t := range configured {
+		var token string
+		if settings.Secrets != nil {
+			token = settings.Secrets.TargetTokens[t.Name]
+		}
+		target := &scrapeTarget{
+			Name:    t.Name,
+			URL:     t.URL,
+			Token:   token,
+			Labels:  t.Labels,
+			history: newScrapeHistory(retention),
+
+			adminURL:     t.AdminURL,
+			calibrations: newCalibrations(t.Calibrations),
+			timeout:      time.Duration(t.ScrapeTimeoutSeconds * float64(time.Second)),
+		}
+		if target.parser, err = parserFor(t.Format); err != nil {
+			return nil, fmt.Errorf("target %s: %w", t.Name, err)
+		}
+		if t.WebSocket != nil {
+			if target.push, err = pushSourceFor(t.Name, t.WebSocket.Samples, t.WebSocket.Schema, schemas); err != nil {
+				return nil, fmt.Errorf("target %s: websocket: %w", t.Name, err)
+			}
+			target.subscribe = t.WebSocket.Subscribe
+		}
+		if t.SSE != nil {
+			if target.push, err = pushSourceFor(t.Name, t.SSE.Samples, t.SSE.Schema, schemas); err != nil {
+				return nil, fmt.Errorf("target %s: sse: %w", t.Name, err)
+			}
+			target.sse = newSSEStream(t.SSE.Events)
+		}
+		if t.StatsD != nil || t.Graphite != nil || t.Collectd != nil || t.Telegraf != nil {
+			if target.listener, err = newMetricListener(t); err != nil {
+				return nil, fmt.Errorf("target %s: %w", t.Name, err)
+			}
+			target.push = &pushSource{}
+		}
+		if t.Agent != nil {
+			var pushToken string
+			if settings.Secrets != nil {
+				pushToken = settings.Secrets.PushTokens[t.Name]
+			}
+			if target.agent, err = newAgentTarget(*t.Agent, pushToken); err != nil {
+				return nil, fmt.Errorf("target %s: agent: %w", t.Name, err)
+			}
+			if target.push, err = pushSourceFor(t.Name, nil, t.Agent.Schema, schemas); err != nil {
+				return nil, fmt.Errorf("target %s: agent: %w", t.Name, err)
+			}
+		}
+		if t.GRPC != nil {
+			if target.grpc, err = newGRPCSource(*t.GRPC); err != nil {
+				return nil, fmt.Errorf("target %s: grpc: %w", t.Name, err)
+			}
+			target.parser = target.grpc.parse
+		}
+		if t.OAuth2 != nil {
+			var secret string
+			if settings.Secrets != nil {
+				secret = settings.Secrets.OAuth2ClientSecrets[t.Name]
+			}
+			target.oauth2 = newOAuth2Source(*t.OAuth2, secret)
+		}
+		if t.Session != nil {
+			var password string
+			if settings.Secrets != nil {
+				password = settings.Secrets.SessionPasswords[t.Name]
+			}
+			target.session = newWebSession(*t.Session, password)
+		}
+		if settings.HighFrequency {
+			target.scratch = &scrapeScratch{}
+		}
+		if t.HighResolution != nil {
+			if target.highRes, err = newHighResolution(*t.HighResolution, target.calibrations); err != nil {
+				return nil, fmt.Errorf("target %s: highResolution: %w", t.Name, err)
+			}
+			if target.push != nil {
+				target.push.highRes = target.highRes
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// selectTargets resolves a query's target: empty means the first configured
+// target and "*" all of them. A name matching no target is tried as a regex
+// over target names, as multi-value template variables become "(a|b)".
+func (ds *testDataSource) selectTargets(name string) ([]*scrapeTarget, error) {
+	if ds.configErr != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", ds.configErr)
+	}
+
+	switch name {
+	case "":
+		return ds.targets[:1], nil
+	case allTargets:
+		return ds.targets, nil
+	}
+	for _, t := range ds.targets {
+		if t.Name == name {
+			return []*scrapeTarget{t}, nil
+		}
+	}
+	if re, err := regexp.Compile("^(?:" + name + ")$"); err == nil {
+		var matched []*scrapeTarget
+		for _, t := range ds.targets {
+			if re.MatchString(t.Name) {
+				matched = append(matched, t)
+			}
+		}
+		if len(matched) > 0 {
+			return matched, nil
+		}
+	}
+	return nil, fmt.Errorf("target %q is not configured", name)
+}
+
+// queryTargets resolves the targets of a metric query: those selected by
+// Target, or all of them when only TargetLabels is set, that have the
+// TargetLabels.
+func (ds *testDataSource) queryTargets(q Query) ([]*scrapeTarget, error) {
+	name := q.Target
+	if name == "" && len(q.TargetLabels) > 0 {
+		name = allTargets
+	}
+	targets, err := ds.selectTargets(name)
+	if err != nil || len(q.TargetLabels) == 0 {
+		return targets, err
+	}
+
+	var matched []*scrapeTarget
+	for _, t := range targets {
+		if hasLabels(t.Labels, q.TargetLabels) {
+			matched = append(matched, t)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no target has labels %s", data.Labels(q.TargetLabels))
+	}
+	return matched, nil
+}
+
+// hasLabels reports whether labels have the wanted values. Like target
+// names, a wanted value matching no value exactly is tried as a regex.
+func hasLabels(labels data.Labels, want map[string]string) bool {
+	for k, v := range want {
+		if labels[k] == v {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + v + ")$")
+		if err != nil || !re.MatchString(labels[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// labelTarget adds a "target" label and the target's labels to the value
+// fields of frames, and a link to the target's admin UI when it has one.
+// Labels of the series win over those of the target.
+func labelTarget(frames data.Frames, target *scrapeTarget) {
+	var link *data.DataLink
+	if target.adminURL != "" {
+		link = &data.DataLink{Title: "Open " + target.Name + " admin UI", URL: target.adminURL, TargetBlank: true}
+	}
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			if field.Type().Time() {
+				continue
+			}
+			// Labels may be shared between series, so never modify them in place
+			labels := field.Labels.Copy()
+			for k, v := range target.Labels {
+				if _, ok := labels[k]; !ok {
+					labels[k] = v
+				}
+			}
+			labels["target"] = target.Name
+			field.Labels = labels
+			if link != nil {
+				// Configs may be shared too
+				config := data.FieldConfig{}
+				if field.Config != nil {
+					config = *field.Config
+				}
+				config.Links = append(append([]data.DataLink(nil), config.Links...), *link)
+				field.Config = &config
+			}
+		}
+	}
+}
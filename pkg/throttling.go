@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeThrottling = "throttling"
+
+const (
+	defaultThrottleTemperature = 70
+	defaultThrottleSustain     = 2 * time.Minute
+	// throttleFrequencyRatio is the share of its maximum frequency below
+	// which a busy CPU counts as held back
+	throttleFrequencyRatio = 0.9
+	// throttleBusyLoad is the load per CPU above which a low frequency isn't
+	// the governor saving power on an idle CPU
+	throttleBusyLoad = 0.5
+)
+
+func init() {
+	registerQueryType(queryTypeThrottling, queryThrottling, throttlingQuery{})
+}
+
+type throttlingQuery struct {
+	// Target selects targets as in metric queries; empty means all of them.
+	Target string `json:"target"`
+	// Temperature is the temperature in °C from which a busy CPU running
+	// slow counts as thermally throttled, 70 by default.
+	Temperature float64 `json:"temperature"`
+	// SustainSeconds is how long throttling must last to be annotated, two
+	// minutes by default.
+	SustainSeconds int `json:"sustainSeconds"`
+	// Mode is "series" (default) for the frequency, temperature, load and
+	// throttling series of each target, or "annotations" for regions of
+	// sustained throttling.
+	Mode string `json:"mode"`
+}
+
+// throttleSample is what a scrape of a target tells of its CPUs: their mean
+// frequency as a share of their maximum, the hottest temperature of its
+// sensors, and its one-minute load per CPU. Values a target doesn't expose
+// are NaN.
+type throttleSample struct {
+	Time           time.Time
+	FrequencyRatio float64
+	Temperature    float64
+	Load           float64
+}
+
+// throttling returns how throttled the CPUs were at s: how far below their
+// maximum they ran while busy and hot, or zero. It is NaN when the target
+// doesn't expose frequencies.
+func (s throttleSample) throttling(temperature float64) float64 {
+	if math.IsNaN(s.FrequencyRatio) {
+		return math.NaN()
+	}
+	if s.FrequencyRatio < throttleFrequencyRatio && s.Load >= throttleBusyLoad && s.Temperature >= temperature {
+		return 1 - s.FrequencyRatio
+	}
+	return 0
+}
+
+// throttleSamples replays the history of a target for its CPU frequencies,
+// from node_cpu_scaling_frequency_hertz and its _max_hertz, its
+// temperatures, from node_hwmon_temp_celsius and node_thermal_zone_temp,
+// and its load, from node_load1.
+func (h *scrapeHistory) throttleSamples(tr backend.TimeRange) []throttleSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var frequencies, maxFrequencies, temperatures []int
+	load := -1
+	for i, s := range h.series {
+		switch s.Name {
+		case "node_cpu_scaling_frequency_hertz":
+			frequencies = append(frequencies, i)
+		case "node_cpu_scaling_frequency_max_hertz":
+			maxFrequencies = append(maxFrequencies, i)
+		case "node_hwmon_temp_celsius", "node_thermal_zone_temp":
+			temperatures = append(temperatures, i)
+		case "node_load1":
+			load = i
+		}
+	}
+	if len(frequencies) == 0 {
+		return nil
+	}
+	// sum adds the values of series, and counts those present
+	sum := func(current []float64, series []int) (float64, int) {
+		var total float64
+		var n int
+		for _, i := range series {
+			if v := current[i]; !math.IsNaN(v) {
+				total += v
+				n++
+			}
+		}
+		return total, n
+	}
+
+	var samples []throttleSample
+	current := append([]float64(nil), h.base...)
+	for _, s := range h.scrapes {
+		for _, c := range s.Changes {
+			current[c.Series] = c.Value
+		}
+		if s.Time.Before(tr.From) || s.Time.After(tr.To) {
+			continue
+		}
+		sample := throttleSample{Time: s.Time, FrequencyRatio: math.NaN(), Temperature: math.NaN(), Load: math.NaN()}
+		frequency, cpus := sum(current, frequencies)
+		if maxFrequency, n := sum(current, maxFrequencies); cpus > 0 && n == cpus && maxFrequency > 0 {
+			sample.FrequencyRatio = frequency / maxFrequency
+		}
+		for _, i := range temperatures {
+			if v := current[i]; !math.IsNaN(v) && (math.IsNaN(sample.Temperature) || v > sample.Temperature) {
+				sample.Temperature = v
+			}
+		}
+		if load >= 0 && cpus > 0 {
+			sample.Load = current[load] / float64(cpus)
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// throttleEvent is a period a target's CPUs were throttled throughout, with
+// the lowest frequency ratio and highest temperature during it.
+type throttleEvent struct {
+	Start          time.Time
+	End            time.Time
+	Target         string
+	FrequencyRatio float64
+	Temperature    float64
+}
+
+func (e throttleEvent) text() string {
+	return fmt.Sprintf("%s throttled to %.0f%% of its maximum frequency at %.0f°C", e.Target, e.FrequencyRatio*100, e.Temperature)
+}
+
+// throttleEvents returns the runs of throttled samples lasting at least
+// sustain.
+func throttleEvents(target string, samples []throttleSample, temperature float64, sustain time.Duration) []throttleEvent {
+	var events []throttleEvent
+	var open *throttleEvent
+	closeEvent := func() {
+		if open != nil && open.End.Sub(open.Start) >= sustain {
+			events = append(events, *open)
+		}
+		open = nil
+	}
+	for _, s := range samples {
+		if !(s.throttling(temperature) > 0) {
+			closeEvent()
+			continue
+		}
+		if open == nil {
+			open = &throttleEvent{Start: s.Time, Target: target, FrequencyRatio: s.FrequencyRatio, Temperature: s.Temperature}
+		}
+		open.End = s.Time
+		open.FrequencyRatio = min(open.FrequencyRatio, s.FrequencyRatio)
+		open.Temperature = max(open.Temperature, s.Temperature)
+	}
+	closeEvent()
+	return events
+}
+
+func queryThrottling(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q throttlingQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	name := q.Target
+	if name == "" {
+		name = allTargets
+	}
+	targets, err := ds.selectTargets(name)
+	if err != nil {
+		return nil, err
+	}
+	temperature := q.Temperature
+	if temperature <= 0 {
+		temperature = defaultThrottleTemperature
+	}
+	sustain := defaultThrottleSustain
+	if q.SustainSeconds > 0 {
+		sustain = time.Duration(q.SustainSeconds) * time.Second
+	}
+
+	switch q.Mode {
+	case "", "series":
+		var frames data.Frames
+		for _, target := range targets {
+			if samples := target.history.throttleSamples(query.TimeRange); len(samples) > 0 {
+				frames = append(frames, throttlingFrame(target.Name, samples, temperature))
+			}
+		}
+		return frames, nil
+	case "annotations":
+		var events []throttleEvent
+		for _, target := range targets {
+			events = append(events, throttleEvents(target.Name, target.history.throttleSamples(query.TimeRange), temperature, sustain)...)
+		}
+		sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+		return data.Frames{throttleEventFrame(events)}, nil
+	default:
+		return nil, fmt.Errorf("unknown throttling mode %q", q.Mode)
+	}
+}
+
+// throttlingFrame returns the samples of a target with how throttled its
+// CPUs were, null where the target doesn't expose a value.
+func throttlingFrame(target string, samples []throttleSample, temperature float64) *data.Frame {
+	labels := data.Labels{"target": target}
+	frame := data.NewFrame("throttling",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("frequency", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percentunit"}),
+		data.NewField("temperature", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "celsius"}),
+		data.NewField("load", labels, []*float64{}),
+		data.NewField("throttling", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percentunit", Min: ptrConfFloat64(0), Max: ptrConfFloat64(1)}),
+	)
+	value := func(v float64) *float64 {
+		if math.IsNaN(v) {
+			return nil
+		}
+		return &v
+	}
+	for _, s := range samples {
+		frame.AppendRow(s.Time, value(s.FrequencyRatio), value(s.Temperature), value(s.Load), value(s.throttling(temperature)))
+	}
+	frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+	return frame
+}
+
+// throttleEventFrame returns throttling in annotation shape, as regions.
+func throttleEventFrame(events []throttleEvent) *data.Frame {
+	frame := data.NewFrame("throttling events",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("timeEnd", nil, []time.Time{}),
+		data.NewField("text", nil, []string{}),
+		data.NewField("tags", nil, []string{}),
+		data.NewField("target", nil, []string{}),
+	)
+	for _, e := range events {
+		frame.AppendRow(e.Start, e.End, e.text(), "throttling", e.Target)
+	}
+	return frame
+}
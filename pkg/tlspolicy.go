@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+// defaultTLSMinVersion is the minimum TLS version when none is configured.
+const defaultTLSMinVersion = tls.VersionTLS12
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsPolicy is the minimum TLS version and the cipher suites that outbound
+// clients and the metrics server accept. The plugin built with the fips tag
+// only accepts TLS 1.2 with the FIPS 140 approved cipher suites and curves.
+type tlsPolicy struct {
+	minVersion uint16
+	// cipherSuites are the TLS 1.2 cipher suites, or nil for Go's defaults;
+	// TLS 1.3 suites are not configurable
+	cipherSuites []uint16
+}
+
+// newTLSPolicy parses a minimum TLS version, such as "1.2", and cipher suite
+// names as in crypto/tls, such as "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+// Both are optional.
+func newTLSPolicy(minVersion string, cipherSuites []string) (tlsPolicy, error) {
+	policy := tlsPolicy{minVersion: defaultTLSMinVersion}
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return tlsPolicy{}, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", minVersion)
+		}
+		policy.minVersion = version
+	}
+
+	suites := map[string]*tls.CipherSuite{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites[suite.Name] = suite
+	}
+	for _, name := range cipherSuites {
+		suite, ok := suites[name]
+		if !ok {
+			return tlsPolicy{}, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		policy.cipherSuites = append(policy.cipherSuites, suite.ID)
+	}
+
+	if fipsMode {
+		if err := policy.restrictToFIPS(); err != nil {
+			return tlsPolicy{}, err
+		}
+	}
+	return policy, nil
+}
+
+// restrictToFIPS rejects what FIPS 140 does not approve of, and defaults to
+// the approved cipher suites. TLS 1.3 is off, as its cipher suites can't be
+// restricted.
+func (p *tlsPolicy) restrictToFIPS() error {
+	if p.minVersion != tls.VersionTLS12 {
+		return fmt.Errorf("the FIPS build only supports TLS 1.2")
+	}
+	if len(p.cipherSuites) == 0 {
+		p.cipherSuites = fipsCipherSuites
+		return nil
+	}
+	for _, id := range p.cipherSuites {
+		if !isFIPSCipherSuite(id) {
+			return fmt.Errorf("cipher suite %s is not FIPS approved", tls.CipherSuiteName(id))
+		}
+	}
+	return nil
+}
+
+// fipsCipherSuites are the FIPS 140 approved TLS 1.2 cipher suites.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+func isFIPSCipherSuite(id uint16) bool {
+	for _, suite := range fipsCipherSuites {
+		if suite == id {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the policy on cfg.
+func (p tlsPolicy) apply(cfg *tls.Config) {
+	cfg.MinVersion = p.minVersion
+	cfg.CipherSuites = p.cipherSuites
+	if fipsMode {
+		cfg.MaxVersion = tls.VersionTLS12
+		cfg.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	}
+}
+
+// configureTLS makes clients built from opts use the policy.
+func (p tlsPolicy) configureTLS(opts *httpclient.Options) {
+	opts.ConfigureTLSConfig = func(_ httpclient.Options, cfg *tls.Config) {
+		p.apply(cfg)
+	}
+}
+
+// clientTLSConfig returns the TLS settings of clients built from opts, for
+// clients that don't speak HTTP.
+func clientTLSConfig(opts httpclient.Options) (*tls.Config, error) {
+	cfg, err := httpclient.GetTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ConfigureTLSConfig != nil {
+		opts.ConfigureTLSConfig(opts, cfg)
+	}
+	return cfg, nil
+}
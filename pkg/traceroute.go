@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeTraceroute = "traceroute"
+
+const defaultTracerouteInterval = 10 * time.Minute
+
+// maxTraces and maxPathChanges bound what is kept per destination.
+const (
+	maxTraces      = 288
+	maxPathChanges = 200
+)
+
+// tracerouteArgs probe each hop three times with a short wait, numerically.
+var tracerouteArgs = []string{"-n", "-q", "3", "-w", "2"}
+
+// validDestination keeps destinations safe to pass through a remote shell.
+var validDestination = regexp.MustCompile(`^[A-Za-z0-9.:-]+$`)
+
+func init() {
+	registerQueryType(queryTypeTraceroute, queryTraceroute, tracerouteQuery{})
+	registerConfiguredCheck(queryTypeTraceroute, func(ds *testDataSource) bool { return len(ds.settings.Traceroute.Destinations) > 0 })
+}
+
+type tracerouteQuery struct {
+	// Destination selects a configured destination; empty means all of them.
+	Destination string `json:"destination"`
+	// Mode is "latency" (default) for per-hop RTT series, "path" for the
+	// current path or "changes" for path change annotations.
+	Mode string `json:"mode"`
+}
+
+// traceHop is one hop of a traceroute. Addr is "*" when no probe answered.
+type traceHop struct {
+	Addr string
+	RTT  *float64
+}
+
+type trace struct {
+	Time time.Time
+	Hops []traceHop
+}
+
+type pathChange struct {
+	Time        time.Time
+	Destination string
+	Old         string
+	New         string
+}
+
+// tracerouteTracker keeps recent traces per destination and records a change
+// whenever the path differs from the previous one.
+type tracerouteTracker struct {
+	mu      sync.Mutex
+	traces  map[string][]trace
+	changes []pathChange
+}
+
+func newTracerouteTracker() *tracerouteTracker {
+	return &tracerouteTracker{traces: map[string][]trace{}}
+}
+
+// pathString renders hop addresses, e.g. "192.168.1.1 > * > 10.0.0.1".
+func pathString(hops []traceHop) string {
+	addrs := make([]string, len(hops))
+	for i, h := range hops {
+		addrs[i] = h.Addr
+	}
+	return strings.Join(addrs, " > ")
+}
+
+// pathChanged compares two paths hop by hop. Unanswered hops match anything,
+// so a router that drops a probe now and then doesn't count as a change.
+func pathChanged(old, new []traceHop) bool {
+	if len(old) != len(new) {
+		return true
+	}
+	for i := range old {
+		if old[i].Addr != "*" && new[i].Addr != "*" && old[i].Addr != new[i].Addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tracerouteTracker) record(destination string, tr trace) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history := t.traces[destination]
+	if len(history) > 0 {
+		prev := history[len(history)-1]
+		if pathChanged(prev.Hops, tr.Hops) {
+			t.changes = append(t.changes, pathChange{
+				Time:        tr.Time,
+				Destination: destination,
+				Old:         pathString(prev.Hops),
+				New:         pathString(tr.Hops),
+			})
+			if len(t.changes) > maxPathChanges {
+				t.changes = t.changes[len(t.changes)-maxPathChanges:]
+			}
+			backend.Logger.Info("Traceroute path changed", "destination", destination)
+		}
+	}
+
+	history = append(history, tr)
+	if len(history) > maxTraces {
+		history = history[len(history)-maxTraces:]
+	}
+	t.traces[destination] = history
+}
+
+// parseTraceroute parses `traceroute -n` output. A hop's address is the first
+// one that answered and its RTT the mean of the answered probes.
+func parseTraceroute(raw []byte) ([]traceHop, error) {
+	var hops []traceHop
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue // header line
+		}
+
+		hop := traceHop{Addr: "*"}
+		var sum float64
+		var n int
+		for i := 1; i < len(fields); i++ {
+			f := fields[i]
+			if ip := net.ParseIP(f); ip != nil {
+				if hop.Addr == "*" {
+					hop.Addr = ip.String()
+				}
+				continue
+			}
+			if i+1 < len(fields) && fields[i+1] == "ms" {
+				if v, err := strconv.ParseFloat(f, 64); err == nil {
+					sum += v
+					n++
+				}
+			}
+		}
+		if n > 0 {
+			mean := sum / float64(n)
+			hop.RTT = &mean
+		}
+		hops = append(hops, hop)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("no hops in traceroute output")
+	}
+	return hops, nil
+}
+
+// runTraceroute traces destination from the configured host, or locally.
+func (ds *testDataSource) runTraceroute(ctx context.Context, destination string) ([]traceHop, error) {
+	if !validDestination.MatchString(destination) {
+		return nil, fmt.Errorf("invalid traceroute destination %q", destination)
+	}
+
+	var raw []byte
+	var err error
+	if host := ds.settings.Traceroute.Host; host != "" {
+		if _, err := ds.sshHosts(host); err != nil {
+			return nil, err
+		}
+		cmd := "traceroute " + strings.Join(tracerouteArgs, " ") + " " + destination
+		raw, err = ds.runRemoteCommand(ctx, host, cmd)
+	} else {
+		if err := ds.egress.checkResolved(ctx, destination); err != nil {
+			return nil, err
+		}
+		args := append(append([]string{}, tracerouteArgs...), destination)
+		raw, err = exec.CommandContext(ctx, "traceroute", args...).Output()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("traceroute to %s failed: %w", destination, err)
+	}
+
+	return parseTraceroute(raw)
+}
+
+func (ds *testDataSource) runTracerouteScheduler(ctx context.Context) {
+	interval := defaultTracerouteInterval
+	if s := ds.settings.Traceroute.IntervalSeconds; s > 0 {
+		interval = time.Duration(s) * time.Second
+	}
+
+	job := ds.schedule.add("traceroute", "", interval, time.Now())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job.run(func() error {
+			var failed error
+			for _, destination := range ds.settings.Traceroute.Destinations {
+				hops, err := ds.runTraceroute(ctx, destination)
+				if err != nil {
+					backend.Logger.Warn("Traceroute failed", "destination", destination, "error", err)
+					failed = err
+					continue
+				}
+				ds.traceroutes.record(destination, trace{Time: time.Now(), Hops: hops})
+			}
+			return failed
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func queryTraceroute(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q tracerouteQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if len(ds.settings.Traceroute.Destinations) == 0 {
+		return nil, fmt.Errorf("no traceroute destinations configured")
+	}
+
+	switch q.Mode {
+	case "", "latency":
+		return ds.traceroutes.latencyFrames(q.Destination, query.TimeRange), nil
+	case "path":
+		return data.Frames{ds.traceroutes.pathFrame(q.Destination)}, nil
+	case "changes":
+		return data.Frames{ds.traceroutes.changesFrame(q.Destination, query.TimeRange)}, nil
+	}
+	return nil, fmt.Errorf("unknown traceroute mode %q", q.Mode)
+}
+
+func (t *tracerouteTracker) destinations(destination string) []string {
+	var names []string
+	for name := range t.traces {
+		if destination == "" || name == destination {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// latencyFrames returns one RTT time series per destination and hop number.
+func (t *tracerouteTracker) latencyFrames(destination string, tr backend.TimeRange) data.Frames {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var frames data.Frames
+	for _, name := range t.destinations(destination) {
+		type series struct {
+			times []time.Time
+			rtts  []*float64
+		}
+		byHop := map[int]*series{}
+		maxHop := 0
+		for _, trc := range t.traces[name] {
+			if trc.Time.Before(tr.From) || trc.Time.After(tr.To) {
+				continue
+			}
+			for i, hop := range trc.Hops {
+				s, ok := byHop[i+1]
+				if !ok {
+					s = &series{}
+					byHop[i+1] = s
+				}
+				s.times = append(s.times, trc.Time)
+				s.rtts = append(s.rtts, hop.RTT)
+				maxHop = max(maxHop, i+1)
+			}
+		}
+
+		for hop := 1; hop <= maxHop; hop++ {
+			s, ok := byHop[hop]
+			if !ok {
+				continue
+			}
+			labels := data.Labels{"destination": name, "hop": strconv.Itoa(hop)}
+			frame := data.NewFrame("traceroute",
+				data.NewField("time", nil, s.times),
+				data.NewField("rtt", labels, s.rtts).SetConfig(&data.FieldConfig{Unit: "ms"}),
+			)
+			frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// pathFrame returns the hops of the latest trace of each destination.
+func (t *tracerouteTracker) pathFrame(destination string) *data.Frame {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	frame := data.NewFrame("traceroute_path",
+		data.NewField("destination", nil, []string{}),
+		data.NewField("hop", nil, []int64{}),
+		data.NewField("address", nil, []string{}),
+		data.NewField("rtt", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+	)
+	for _, name := range t.destinations(destination) {
+		history := t.traces[name]
+		last := history[len(history)-1]
+		for i, hop := range last.Hops {
+			frame.AppendRow(name, int64(i+1), hop.Addr, hop.RTT)
+		}
+	}
+	return frame
+}
+
+// changesFrame returns path changes within tr in annotation shape.
+func (t *tracerouteTracker) changesFrame(destination string, tr backend.TimeRange) *data.Frame {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	frame := data.NewFrame("traceroute_changes",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("text", nil, []string{}),
+		data.NewField("destination", nil, []string{}),
+		data.NewField("old_path", nil, []string{}),
+		data.NewField("new_path", nil, []string{}),
+	)
+	for _, c := range t.changes {
+		if destination != "" && c.Destination != destination {
+			continue
+		}
+		if c.Time.Before(tr.From) || c.Time.After(tr.To) {
+			continue
+		}
+		frame.AppendRow(c.Time, fmt.Sprintf("Path to %s changed", c.Destination), c.Destination, c.Old, c.New)
+	}
+	return frame
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const queryTypeTransaction = "transaction"
+
+const (
+	defaultTransactionInterval = 5 * time.Minute
+	transactionTimeout         = 30 * time.Second
+)
+
+// maxTransactionResults bounds the results kept per transaction and step.
+const maxTransactionResults = 1440
+
+// maxTransactionBody bounds the response bodies steps match and extract from.
+const maxTransactionBody = 1 << 20
+
+// transactionTotal is the step name of the results of whole transactions.
+const transactionTotal = "total"
+
+func init() {
+	registerQueryType(queryTypeTransaction, queryTransaction, transactionQuery{})
+	registerConfiguredCheck(queryTypeTransaction, func(ds *testDataSource) bool { return len(ds.transactions) > 0 })
+}
+
+type transactionQuery struct {
+	// Transaction selects a transaction by name; empty means all of them.
+	Transaction string `json:"transaction"`
+	// Mode is "timeline" (default) for latency and success series per
+	// step, or "summary" for a row per step over the time range.
+	Mode string `json:"mode"`
+}
+
+// transaction is a configured synthetic transaction, parsed.
+type transaction struct {
+	name     string
+	interval time.Duration
+	steps    []transactionStep
+	password string
+}
+
+type transactionStep struct {
+	models.TransactionStep
+	expectBody *regexp.Regexp
+	extract    map[string]*regexp.Regexp
+}
+
+// newTransactions validates the configured transactions, with their
+// passwords.
+func newTransactions(configured []models.TransactionSettings, passwords map[string]string) ([]*transaction, error) {
+	transactions := make([]*transaction, 0, len(configured))
+	seen := map[string]bool{}
+	for _, c := range configured {
+		switch {
+		case c.Name == "":
+			return nil, fmt.Errorf("transaction has no name")
+		case seen[c.Name]:
+			return nil, fmt.Errorf("duplicate transaction name %q", c.Name)
+		case len(c.Steps) == 0:
+			return nil, fmt.Errorf("transaction %s has no steps", c.Name)
+		}
+		seen[c.Name] = true
+		t := &transaction{name: c.Name, interval: defaultTransactionInterval, password: passwords[c.Name]}
+		if c.IntervalSeconds > 0 {
+			t.interval = time.Duration(c.IntervalSeconds) * time.Second
+		}
+		stepNames := map[string]bool{}
+		for i, s := range c.Steps {
+			if s.Name == "" {
+				s.Name = fmt.Sprintf("step %d", i+1)
+			}
+			if stepNames[s.Name] || s.Name == transactionTotal {
+				return nil, fmt.Errorf("transaction %s: duplicate step name %q", c.Name, s.Name)
+			}
+			stepNames[s.Name] = true
+			if s.URL == "" {
+				return nil, fmt.Errorf("transaction %s: step %s has no URL", c.Name, s.Name)
+			}
+			if s.Method == "" {
+				s.Method = http.MethodGet
+			}
+			step := transactionStep{TransactionStep: s, extract: map[string]*regexp.Regexp{}}
+			var err error
+			if s.ExpectBody != "" {
+				if step.expectBody, err = regexp.Compile(s.ExpectBody); err != nil {
+					return nil, fmt.Errorf("transaction %s: step %s: invalid expectBody: %w", c.Name, s.Name, err)
+				}
+			}
+			for name, expr := range s.Extract {
+				re, err := regexp.Compile(expr)
+				if err != nil {
+					return nil, fmt.Errorf("transaction %s: step %s: invalid extract %s: %w", c.Name, s.Name, name, err)
+				}
+				if re.NumSubexp() < 1 {
+					return nil, fmt.Errorf("transaction %s: step %s: extract %s has no group", c.Name, s.Name, name)
+				}
+				step.extract[name] = re
+			}
+			t.steps = append(t.steps, step)
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, nil
+}
+
+// transactionResult is the outcome of a step of a run, or of the whole run
+// under the step transactionTotal.
+type transactionResult struct {
+	Time        time.Time
+	Transaction string
+	Step        string
+	OK          bool
+	Latency     time.Duration
+	Status      int
+	Error       string
+}
+
+type transactionKey struct {
+	Transaction string
+	Step        string
+}
+
+// transactionTracker keeps recent results per transaction and step.
+type transactionTracker struct {
+	mu      sync.Mutex
+	results map[transactionKey][]transactionResult
+}
+
+func newTransactionTracker() *transactionTracker {
+	return &transactionTracker{results: map[transactionKey][]transactionResult{}}
+}
+
+func (t *transactionTracker) record(results []transactionResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, r := range results {
+		key := transactionKey{Transaction: r.Transaction, Step: r.Step}
+		history := append(t.results[key], r)
+		if len(history) > maxTransactionResults {
+			history = history[len(history)-maxTransactionResults:]
+		}
+		t.results[key] = history
+	}
+}
+
+// window returns the results of the steps of transactions within tr.
+func (t *transactionTracker) window(tr backend.TimeRange) map[transactionKey][]transactionResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	results := map[transactionKey][]transactionResult{}
+	for key, history := range t.results {
+		for _, r := range history {
+			if !r.Time.Before(tr.From) && !r.Time.After(tr.To) {
+				results[key] = append(results[key], r)
+			}
+		}
+	}
+	return results
+}
+
+// runTransaction runs the steps of t in order with a fresh cookie jar, and
+// returns the result of each step run and of the whole run.
+func (ds *testDataSource) runTransaction(ctx context.Context, t *transaction) []transactionResult {
+	ctx, cancel := context.WithTimeout(ctx, transactionTimeout)
+	defer cancel()
+
+	start := time.Now()
+	total := transactionResult{Time: start, Transaction: t.name, Step: transactionTotal}
+	var results []transactionResult
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		total.Error = err.Error()
+		return []transactionResult{total}
+	}
+	client := &http.Client{Transport: ds.httpClient.Transport, Jar: jar}
+
+	vars := map[string]string{"password": t.password}
+	for _, step := range t.steps {
+		result := ds.runTransactionStep(ctx, client, t.name, step, vars)
+		results = append(results, result)
+		if !result.OK {
+			total.Status, total.Error = result.Status, step.Name+": "+result.Error
+			break
+		}
+	}
+	total.OK = total.Error == ""
+	total.Latency = time.Since(start)
+	return append(results, total)
+}
+
+// runTransactionStep sends the request of step, checks its response and
+// extracts values from it into vars.
+func (ds *testDataSource) runTransactionStep(ctx context.Context, client *http.Client, name string, step transactionStep, vars map[string]string) transactionResult {
+	result := transactionResult{Time: time.Now(), Transaction: name, Step: step.Name}
+	fail := func(err error) transactionResult {
+		result.Latency = time.Since(result.Time)
+		result.Error = err.Error()
+		return result
+	}
+
+	pairs := make([]string, 0, 2*len(vars))
+	for k, v := range vars {
+		pairs = append(pairs, "${"+k+"}", v)
+	}
+	expand := strings.NewReplacer(pairs...).Replace
+
+	var body io.Reader
+	if step.Body != "" {
+		body = strings.NewReader(expand(step.Body))
+	}
+	req, err := http.NewRequestWithContext(ctx, step.Method, expand(step.URL), body)
+	if err != nil {
+		return fail(fmt.Errorf("failed to create request: %w", err))
+	}
+	for k, v := range step.Headers {
+		req.Header.Set(k, expand(v))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// Errors of the client name the URL, which may hold the password
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	result.Status = resp.StatusCode
+	page, err := io.ReadAll(io.LimitReader(resp.Body, maxTransactionBody))
+	// Latency is to the last byte, as a user waits for the page
+	result.Latency = time.Since(result.Time)
+	if err != nil {
+		return fail(fmt.Errorf("failed to read response: %w", err))
+	}
+
+	switch {
+	case step.ExpectStatus != 0 && resp.StatusCode != step.ExpectStatus:
+		return fail(fmt.Errorf("returned %s, expected %d", resp.Status, step.ExpectStatus))
+	case step.ExpectStatus == 0 && resp.StatusCode >= http.StatusBadRequest:
+		return fail(fmt.Errorf("returned %s", resp.Status))
+	case step.expectBody != nil && !step.expectBody.Match(page):
+		return fail(fmt.Errorf("body does not match %q", step.ExpectBody))
+	}
+	for k, re := range step.extract {
+		m := re.FindSubmatch(page)
+		if m == nil {
+			return fail(fmt.Errorf("nothing to extract as %s", k))
+		}
+		vars[k] = string(m[1])
+	}
+	result.OK = true
+	return result
+}
+
+// runTransactionChecker runs t every interval, until the instance is
+// disposed of.
+func (ds *testDataSource) runTransactionChecker(ctx context.Context, t *transaction) {
+	job := ds.schedule.add("transaction", t.name, t.interval, time.Now())
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		job.run(func() error {
+			results := ds.runTransaction(ctx, t)
+			ds.transactionResults.record(results)
+			if total := results[len(results)-1]; !total.OK {
+				return errors.New(total.Error)
+			}
+			return nil
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func queryTransaction(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q transactionQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if len(ds.transactions) == 0 {
+		return nil, fmt.Errorf("no transactions configured")
+	}
+
+	// Keys in the order of the configured steps, each transaction's total
+	// last
+	var keys []transactionKey
+	for _, t := range ds.transactions {
+		if q.Transaction != "" && t.name != q.Transaction {
+			continue
+		}
+		for _, s := range t.steps {
+			keys = append(keys, transactionKey{Transaction: t.name, Step: s.Name})
+		}
+		keys = append(keys, transactionKey{Transaction: t.name, Step: transactionTotal})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no transaction %q", q.Transaction)
+	}
+	results := ds.transactionResults.window(query.TimeRange)
+
+	switch q.Mode {
+	case "", "timeline":
+		return transactionTimelineFrames(keys, results), nil
+	case "summary":
+		return data.Frames{transactionSummaryFrame(keys, results)}, nil
+	}
+	return nil, fmt.Errorf("unknown transaction mode %q", q.Mode)
+}
+
+// transactionTimelineFrames returns the latency and success of each step
+// run, a frame per step.
+func transactionTimelineFrames(keys []transactionKey, results map[transactionKey][]transactionResult) data.Frames {
+	frames := make(data.Frames, 0, len(keys))
+	for _, key := range keys {
+		rs := results[key]
+		times := make([]time.Time, len(rs))
+		latencies := make([]float64, len(rs))
+		successes := make([]float64, len(rs))
+		for i, r := range rs {
+			times[i] = r.Time
+			latencies[i] = float64(r.Latency) / float64(time.Millisecond)
+			if r.OK {
+				successes[i] = 1
+			}
+		}
+		labels := data.Labels{"transaction": key.Transaction, "step": key.Step}
+		frame := data.NewFrame("transaction",
+			data.NewField("time", nil, times),
+			data.NewField("latency", labels, latencies).SetConfig(&data.FieldConfig{Unit: "ms"}),
+			data.NewField("success", labels, successes).SetConfig(upConfig()),
+		)
+		frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesWide}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// transactionSummaryFrame summarizes each step: the share of runs it passed,
+// its mean and worst latency, and its last error.
+func transactionSummaryFrame(keys []transactionKey, results map[transactionKey][]transactionResult) *data.Frame {
+	frame := data.NewFrame("transaction_summary",
+		data.NewField("transaction", nil, []string{}),
+		data.NewField("step", nil, []string{}),
+		data.NewField("runs", nil, []int64{}),
+		data.NewField("success", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percent"}),
+		data.NewField("latency", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("max_latency", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "ms"}),
+		data.NewField("last_error", nil, []string{}),
+	)
+	for _, key := range keys {
+		rs := results[key]
+		var success, latency, maxLatency *float64
+		lastError := ""
+		if len(rs) > 0 {
+			var ok int
+			var sum, worst time.Duration
+			for _, r := range rs {
+				if r.OK {
+					ok++
+				}
+				sum += r.Latency
+				worst = max(worst, r.Latency)
+			}
+			s := float64(ok) / float64(len(rs)) * 100
+			l := float64(sum) / float64(len(rs)) / float64(time.Millisecond)
+			w := float64(worst) / float64(time.Millisecond)
+			success, latency, maxLatency = &s, &l, &w
+			lastError = rs[len(rs)-1].Error
+		}
+		frame.AppendRow(key.Transaction, key.Step, int64(len(rs)), success, latency, maxLatency, lastError)
+	}
+	return frame
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// openMetricsUnits are the Grafana units of the base units OpenMetrics
+// declares in UNIT lines and Prometheus names end in.
+var openMetricsUnits = map[string]string{
+	"seconds":      "s",
+	"milliseconds": "ms",
+	"bytes":        "bytes",
+	"bits":         "bits",
+	"celsius":      "celsius",
+	"fahrenheit":   "fahrenheit",
+	"ratio":        "percentunit",
+	"percent":      "percent",
+	"volts":        "volt",
+	"amperes":      "amp",
+	"watts":        "watt",
+	"joules":       "joule",
+	"hertz":        "hertz",
+	"meters":       "lengthm",
+	"pascals":      "pressurepa",
+	"dbm":          "dBm",
+}
+
+// rateUnits are the units of the per-second rates of series in a unit;
+// rates of series in other units have none.
+var rateUnits = map[string]string{
+	"bytes":    "Bps",
+	"decbytes": "Bps",
+	"bits":     "bps",
+	"s":        "percentunit",
+	"joule":    "watt",
+}
+
+// sampleSuffixes are appended to the names of families by the series of
+// counters, histograms and summaries.
+var sampleSuffixes = []string{"_total", "_sum", "_created"}
+
+// parseUnitLines returns the units of families declared by the UNIT lines
+// of an OpenMetrics body, which the Prometheus text parser skips.
+func parseUnitLines(body []byte) map[string]string {
+	if !bytes.Contains(body, []byte("# UNIT ")) {
+		return nil
+	}
+	units := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 4 && fields[0] == "#" && fields[1] == "UNIT" {
+			units[fields[2]] = fields[3]
+		}
+	}
+	return units
+}
+
+// unitInference sets the units of series fields: overridden in the
+// settings, declared by their target, or told by the suffix of their name.
+type unitInference struct {
+	overrides map[string]string
+}
+
+// unit returns the Grafana unit of the named series, "" if unknown.
+// declared are the units the series' target declares, by family.
+func (u unitInference) unit(name string, declared map[string]string) string {
+	if unit, ok := u.overrides[name]; ok {
+		return unit
+	}
+	family := name
+	for _, suffix := range sampleSuffixes {
+		if trimmed, ok := strings.CutSuffix(name, suffix); ok {
+			family = trimmed
+			break
+		}
+	}
+	if unit, ok := u.overrides[family]; ok {
+		return unit
+	}
+	if unit, ok := declared[family]; ok {
+		if grafana, ok := openMetricsUnits[unit]; ok {
+			return grafana
+		}
+		return unit
+	}
+	if i := strings.LastIndexByte(family, '_'); i >= 0 {
+		return openMetricsUnits[family[i+1:]]
+	}
+	return ""
+}
+
+// apply sets the units of the value fields of frames without one.
+func (u unitInference) apply(frames data.Frames, declared map[string]string) {
+	for _, frame := range frames {
+		for _, field := range frame.Fields {
+			if field.Type().Time() || field.Config != nil && field.Config.Unit != "" {
+				continue
+			}
+			if unit := u.unit(field.Name, declared); unit != "" {
+				setFieldUnit(field, unit)
+			}
+		}
+	}
+}
+
+// setFieldUnit sets the unit of field, copying its config, which may be
+// shared.
+func setFieldUnit(field *data.Field, unit string) {
+	config := data.FieldConfig{}
+	if field.Config != nil {
+		config = *field.Config
+	}
+	config.Unit = unit
+	field.Config = &config
+}
+
+// rateConfig returns the config of the per-second rate of a series with
+// config, with the unit of the rate.
+func rateConfig(config *data.FieldConfig) *data.FieldConfig {
+	if config == nil || config.Unit == "" {
+		return config
+	}
+	rate := *config
+	rate.Unit = rateUnits[config.Unit]
+	return &rate
+}
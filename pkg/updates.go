@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/build"
+)
+
+const defaultReleaseFeedURL = "https://api.github.com/repos/kirillyesikov/homelab-plugin/releases"
+
+const defaultUpdateCheckInterval = 24 * time.Hour
+
+// maxReleaseNotesBytes bounds the notes of each release served, which are
+// an excerpt for the full notes behind the release URL.
+const maxReleaseNotesBytes = 4 << 10
+
+// release is a published release of the plugin.
+type release struct {
+	Version     string    `json:"version"`
+	Name        string    `json:"name,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	PublishedAt time.Time `json:"publishedAt"`
+	Notes       string    `json:"notes,omitempty"`
+}
+
+// githubRelease is a release in the GitHub releases API.
+type githubRelease struct {
+	TagName     string    `json:"tag_name"`
+	Name        string    `json:"name"`
+	Body        string    `json:"body"`
+	HTMLURL     string    `json:"html_url"`
+	PublishedAt time.Time `json:"published_at"`
+	Draft       bool      `json:"draft"`
+	Prerelease  bool      `json:"prerelease"`
+}
+
+// updateStatus is what the last check of the release feed found.
+type updateStatus struct {
+	Current   string     `json:"current"`
+	Latest    string     `json:"latest,omitempty"`
+	Available bool       `json:"available"`
+	CheckedAt *time.Time `json:"checkedAt,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	// Releases are the releases newer than the current version, newest
+	// first
+	Releases []release `json:"releases,omitempty"`
+}
+
+// updateChecker remembers the last check of the release feed.
+type updateChecker struct {
+	mu      sync.Mutex
+	current string
+	status  updateStatus
+	// installed is the release of the current version, once seen in the
+	// feed
+	installed *release
+}
+
+func newUpdateChecker(current string) *updateChecker {
+	return &updateChecker{current: current, status: updateStatus{Current: current}}
+}
+
+// get returns the last status, and the release of the current version.
+func (c *updateChecker) get() (updateStatus, *release) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status, c.installed
+}
+
+// record stores the outcome of a check at now.
+func (c *updateChecker) record(now time.Time, releases []release, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.CheckedAt = &now
+	if err != nil {
+		// The releases found last are kept until the feed answers again
+		c.status.Error = err.Error()
+		return
+	}
+	c.status.Error = ""
+	c.status.Releases = nil
+	c.status.Latest = ""
+	c.installed = nil
+	for i, r := range releases {
+		cmp, ok := compareVersions(r.Version, c.current)
+		if ok && c.status.Latest == "" {
+			c.status.Latest = r.Version
+		}
+		switch {
+		case !ok:
+		case cmp > 0:
+			c.status.Releases = append(c.status.Releases, r)
+		case cmp == 0:
+			c.installed = &releases[i]
+		}
+	}
+	c.status.Available = len(c.status.Releases) > 0
+}
+
+// parseVersion parses a semantic version such as v1.2.3 or 1.2.3-beta.1
+// into its numbers and prerelease.
+func parseVersion(v string) ([3]int, string, bool) {
+	var parts [3]int
+	v = strings.TrimPrefix(v, "v")
+	v, _, _ = strings.Cut(v, "+")
+	v, pre, _ := strings.Cut(v, "-")
+	fields := strings.Split(v, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return parts, "", false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return parts, "", false
+		}
+		parts[i] = n
+	}
+	return parts, pre, true
+}
+
+// compareVersions compares two semantic versions, returning -1, 0 or 1, and
+// false when either doesn't parse. Prereleases are ordered before their
+// release, and by their text among themselves.
+func compareVersions(a, b string) (int, bool) {
+	pa, prea, ok := parseVersion(a)
+	if !ok {
+		return 0, false
+	}
+	pb, preb, ok := parseVersion(b)
+	if !ok {
+		return 0, false
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	switch {
+	case prea == preb:
+		return 0, true
+	case prea == "":
+		return 1, true
+	case preb == "":
+		return -1, true
+	}
+	return strings.Compare(prea, preb), true
+}
+
+// fetchReleases reads the published releases from the feed, newest first.
+// Drafts and prereleases are left out.
+func (ds *testDataSource) fetchReleases(ctx context.Context) ([]release, error) {
+	feed := ds.settings.UpdateCheck.FeedURL
+	if feed == "" {
+		feed = defaultReleaseFeedURL
+	}
+	body, err := ds.httpGet(ctx, feed)
+	if err != nil {
+		return nil, err
+	}
+	var published []githubRelease
+	if err := json.Unmarshal(body, &published); err != nil {
+		return nil, withCode(codeParseError, fmt.Errorf("invalid release feed %s: %w", feed, err))
+	}
+
+	var releases []release
+	for _, r := range published {
+		if r.Draft || r.Prerelease {
+			continue
+		}
+		notes := r.Body
+		if len(notes) > maxReleaseNotesBytes {
+			notes = strings.ToValidUTF8(notes[:maxReleaseNotesBytes], "") + "…"
+		}
+		releases = append(releases, release{
+			Version:     strings.TrimPrefix(r.TagName, "v"),
+			Name:        r.Name,
+			URL:         r.HTMLURL,
+			PublishedAt: r.PublishedAt,
+			Notes:       notes,
+		})
+	}
+	sort.SliceStable(releases, func(i, j int) bool {
+		cmp, ok := compareVersions(releases[i].Version, releases[j].Version)
+		if !ok {
+			return releases[i].PublishedAt.After(releases[j].PublishedAt)
+		}
+		return cmp > 0
+	})
+	return releases, nil
+}
+
+// runUpdateChecker checks the release feed right away and then every
+// interval, logging newly available versions.
+func (ds *testDataSource) runUpdateChecker(ctx context.Context) {
+	interval := defaultUpdateCheckInterval
+	if h := ds.settings.UpdateCheck.IntervalHours; h > 0 {
+		interval = time.Duration(h) * time.Hour
+	}
+
+	job := ds.schedule.add("update", "", interval, time.Now())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var announced string
+	for {
+		err := job.run(func() error {
+			releases, err := ds.fetchReleases(ctx)
+			ds.updates.record(time.Now(), releases, err)
+			return err
+		})
+		if err != nil {
+			backend.Logger.Warn("Update check failed", "error", err)
+		} else if status, _ := ds.updates.get(); status.Available && status.Latest != announced {
+			backend.Logger.Info("Plugin update available", "current", status.Current, "latest", status.Latest)
+			announced = status.Latest
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pluginVersion is the version of the running plugin: that compiled into
+// it, or that Grafana reports for development builds.
+func pluginVersion(ctx context.Context) string {
+	if info, err := build.GetBuildInfo(); err == nil && info.Version != "" {
+		return info.Version
+	}
+	return backend.PluginConfigFromContext(ctx).PluginVersion
+}
+
+// aboutInfo is the /about resource.
+type aboutInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+	// BuiltAt is unset for development builds
+	BuiltAt *time.Time `json:"builtAt,omitempty"`
+	// Update is set when update checks are enabled
+	Update *updateStatus `json:"update,omitempty"`
+	// Changelog holds the notes of the current release and the newer ones,
+	// newest first, as the release feed has them
+	Changelog []release `json:"changelog"`
+}
+
+// handleAbout describes the running plugin and the releases since.
+func (ds *testDataSource) handleAbout(w http.ResponseWriter, _ *http.Request) {
+	about := aboutInfo{
+		Version:   ds.version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Changelog: []release{},
+	}
+	if info, err := build.GetBuildInfo(); err == nil && info.Time > 0 {
+		builtAt := time.UnixMilli(info.Time).UTC()
+		about.BuiltAt = &builtAt
+	}
+	if ds.updates != nil {
+		status, installed := ds.updates.get()
+		about.Update = &status
+		about.Changelog = append(about.Changelog, status.Releases...)
+		if installed != nil {
+			about.Changelog = append(about.Changelog, *installed)
+		}
+	}
+	writeJSON(w, http.StatusOK, about)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeUsage = "usage"
+
+// Headers Grafana sets on query requests, naming where the queries come from.
+const (
+	headerDashboardUID = "X-Dashboard-Uid"
+	headerPanelID      = "X-Panel-Id"
+	headerFromAlert    = "FromAlert"
+)
+
+// usageAlerting attributes the queries of alert rules, which have no
+// dashboard.
+const usageAlerting = "alerting"
+
+func init() {
+	registerQueryType(queryTypeUsage, queryUsageTable, usageQuery{})
+}
+
+type usageQuery struct {
+	// Dashboard keeps only the usage of one dashboard, by UID.
+	Dashboard string `json:"dashboard"`
+}
+
+// usageKey is what queries are attributed to. Dashboard is empty for queries
+// from Explore or the API, which do not say where they come from.
+type usageKey struct {
+	Dashboard string `json:"dashboard"`
+	Panel     string `json:"panel"`
+}
+
+func usageKeyFromHeaders(headers http.Header) usageKey {
+	key := usageKey{Dashboard: headers.Get(headerDashboardUID), Panel: headers.Get(headerPanelID)}
+	if key.Dashboard == "" && headers.Get(headerFromAlert) == "true" {
+		key.Dashboard = usageAlerting
+	}
+	return key
+}
+
+type usageTotals struct {
+	usageKey
+	Queries    int64            `json:"queries"`
+	Errors     int64            `json:"errors"`
+	DurationMs float64          `json:"durationMs"`
+	Scrapes    int64            `json:"scrapes"`
+	CacheHits  int64            `json:"cacheHits"`
+	Bytes      int64            `json:"bytes"`
+	Targets    map[string]int64 `json:"targetScrapes"`
+	LastSeen   time.Time        `json:"lastSeen"`
+}
+
+// usageTracker totals the queries and scrapes of each dashboard panel since
+// the instance started, so the ones loading targets the most can be found.
+type usageTracker struct {
+	mu     sync.Mutex
+	totals map[usageKey]*usageTotals
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{totals: map[usageKey]*usageTotals{}}
+}
+
+// record adds a query to the totals of key. A nil tracker records nothing.
+func (t *usageTracker) record(key usageKey, took time.Duration, usage *queryUsage, err error) {
+	if t == nil {
+		return
+	}
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	totals, ok := t.totals[key]
+	if !ok {
+		totals = &usageTotals{usageKey: key, Targets: map[string]int64{}}
+		t.totals[key] = totals
+	}
+	totals.Queries++
+	if err != nil {
+		totals.Errors++
+	}
+	totals.DurationMs += milliseconds(took)
+	totals.Scrapes += usage.scrapes.Load()
+	totals.CacheHits += usage.cacheHits.Load()
+	totals.Bytes += usage.bytes.Load()
+	for target, n := range usage.targetScrapes {
+		totals.Targets[target] += n
+	}
+	totals.LastSeen = time.Now()
+}
+
+// list returns a copy of the totals, the most scrapes first.
+func (t *usageTracker) list() []usageTotals {
+	if t == nil {
+		return []usageTotals{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]usageTotals, 0, len(t.totals))
+	for _, totals := range t.totals {
+		c := *totals
+		c.Targets = make(map[string]int64, len(totals.Targets))
+		for target, n := range totals.Targets {
+			c.Targets[target] = n
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Scrapes != list[j].Scrapes {
+			return list[i].Scrapes > list[j].Scrapes
+		}
+		if list[i].Dashboard != list[j].Dashboard {
+			return list[i].Dashboard < list[j].Dashboard
+		}
+		return list[i].Panel < list[j].Panel
+	})
+	return list
+}
+
+// formatTargetScrapes lists scrape counts by target, the most scraped first,
+// e.g. "nas: 12, router: 3".
+func formatTargetScrapes(scrapes map[string]int64) string {
+	targets := make([]string, 0, len(scrapes))
+	for target := range scrapes {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if scrapes[targets[i]] != scrapes[targets[j]] {
+			return scrapes[targets[i]] > scrapes[targets[j]]
+		}
+		return targets[i] < targets[j]
+	})
+	parts := make([]string, len(targets))
+	for i, target := range targets {
+		parts[i] = fmt.Sprintf("%s: %d", target, scrapes[target])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// queryUsageTable returns a row per dashboard panel with the queries it ran
+// and the scrapes they caused, the panels scraping the most first.
+func queryUsageTable(_ context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q usageQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	frame := data.NewFrame("usage",
+		data.NewField("dashboard", nil, []string{}),
+		data.NewField("panel", nil, []string{}),
+		data.NewField("queries", nil, []float64{}),
+		data.NewField("errors", nil, []float64{}),
+		data.NewField("query_ms", nil, []float64{}),
+		data.NewField("scrapes", nil, []float64{}),
+		data.NewField("cache_hits", nil, []float64{}),
+		data.NewField("bytes", nil, []float64{}),
+		data.NewField("target_scrapes", nil, []string{}),
+		data.NewField("last_seen", nil, []time.Time{}),
+	)
+	for _, t := range ds.usage.list() {
+		if q.Dashboard != "" && t.Dashboard != q.Dashboard {
+			continue
+		}
+		frame.AppendRow(t.Dashboard, t.Panel, float64(t.Queries), float64(t.Errors), t.DurationMs,
+			float64(t.Scrapes), float64(t.CacheHits), float64(t.Bytes), formatTargetScrapes(t.Targets), t.LastSeen)
+	}
+	return data.Frames{frame}, nil
+}
+
+func (ds *testDataSource) handleUsage(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, ds.usage.list())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeVariable = "variable"
+
+// variableFunction matches variable queries such as label_values(up, job).
+var variableFunction = regexp.MustCompile(`^\s*(\w+)\s*\((.*)\)\s*$`)
+
+func init() {
+	registerQueryType(queryTypeVariable, queryVariable, variableQuery{})
+}
+
+type variableQuery struct {
+	// Query is one of:
+	//   metrics(regex)             metric names matching regex
+	//   label_names(metric)        label names of metric
+	//   label_values(label)        values of label on any metric
+	//   label_values(metric, label) values of label on metric
+	//   targets()                  names of the targets
+	//   target_labels()            label names of the targets
+	//   target_label_values(label) values of a label of the targets
+	Query string `json:"query"`
+	// Target and TargetLabels have the same meaning as in metric queries, so
+	// e.g. a room variable can list the rooms of the tier picked in another
+	Target       string            `json:"target"`
+	TargetLabels map[string]string `json:"targetLabels"`
+}
+
+// queryVariable answers dashboard variable queries with a single frame of
+// sorted, distinct values.
+func queryVariable(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q variableQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	m := variableFunction.FindStringSubmatch(q.Query)
+	if m == nil {
+		return nil, fmt.Errorf("invalid variable query %q", q.Query)
+	}
+	function := m[1]
+	args := strings.Split(m[2], ",")
+	for i := range args {
+		args[i] = strings.TrimSpace(args[i])
+	}
+
+	target := q.Target
+	if target == "" && strings.HasPrefix(function, "target") {
+		target = allTargets
+	}
+	targets, err := ds.queryTargets(Query{Target: target, TargetLabels: q.TargetLabels})
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]bool{}
+	switch {
+	case function == "targets" && m[2] == "":
+		for _, t := range targets {
+			values[t.Name] = true
+		}
+		return variableFrame(values), nil
+	case function == "target_labels" && m[2] == "":
+		for _, t := range targets {
+			for name := range t.Labels {
+				values[name] = true
+			}
+		}
+		return variableFrame(values), nil
+	case function == "target_label_values" && len(args) == 1:
+		for _, t := range targets {
+			if v, ok := t.Labels[args[0]]; ok {
+				values[v] = true
+			}
+		}
+		return variableFrame(values), nil
+	}
+
+	samples, err := ds.scrapeAll(ctx, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case function == "metrics":
+		// The regex may itself contain commas
+		re, err := regexp.Compile(strings.TrimSpace(m[2]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid metrics regex: %w", err)
+		}
+		for _, s := range samples {
+			for _, name := range []string{s.Family, s.Name} {
+				if re.MatchString(name) {
+					values[name] = true
+				}
+			}
+		}
+	case function == "label_names" && len(args) == 1:
+		sel := seriesSelector{Metric: args[0]}
+		for _, s := range samples {
+			if sel.matches(s.seriesInfo) {
+				for name := range s.Labels {
+					values[name] = true
+				}
+			}
+		}
+	case function == "label_values" && (len(args) == 1 || len(args) == 2):
+		label := args[len(args)-1]
+		var sel seriesSelector
+		if len(args) == 2 {
+			sel.Metric = args[0]
+		}
+		for _, s := range samples {
+			if !sel.matches(s.seriesInfo) {
+				continue
+			}
+			if v, ok := s.Labels[label]; ok {
+				values[v] = true
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported variable query %q", q.Query)
+	}
+	return variableFrame(values), nil
+}
+
+// variableFrame returns values sorted, as the single text field of a frame.
+func variableFrame(values map[string]bool) data.Frames {
+	texts := make([]string, 0, len(values))
+	for v := range values {
+		texts = append(texts, v)
+	}
+	sort.Strings(texts)
+
+	return data.Frames{data.NewFrame("variable", data.NewField("text", nil, texts))}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// variablePattern matches $var, ${var} and the deprecated [[var]] syntax.
+var variablePattern = regexp.MustCompile(`\$(\w+)|\$\{(\w+)\}|\[\[(\w+)\]\]`)
+
+// variableNamePattern matches the names variables may have.
+var variableNamePattern = regexp.MustCompile(`^\w+$`)
+
+// scopedVar is a template variable as the frontend passes it in a query's
+// scopedVars. Value is a string, or a list for multi-value variables.
+type scopedVar struct {
+	Value any `json:"value"`
+}
+
+type scopedVarsQuery struct {
+	ScopedVars map[string]scopedVar `json:"scopedVars"`
+}
+
+// checkMacros checks the names of user macros, which must be variable
+// names not starting with __, as built-in macros do.
+func checkMacros(macros map[string]string) error {
+	for name := range macros {
+		if !variableNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid macro name %q", name)
+		}
+		if strings.HasPrefix(name, "__") {
+			return fmt.Errorf("macro %s: names starting with __ are reserved for built-in macros", name)
+		}
+	}
+	return nil
+}
+
+// interpolateQuery replaces template variables in every string of the query
+// JSON, map keys included, with the query's scoped vars, the user macros
+// and the built-in __interval, __interval_ms, __range, __range_s,
+// __range_ms, __from and __to. Unknown variables are kept.
+func interpolateQuery(query backend.DataQuery, macros map[string]string) (backend.DataQuery, error) {
+	var sv scopedVarsQuery
+	if err := json.Unmarshal(query.JSON, &sv); err != nil {
+		return query, withCode(codeParseError, fmt.Errorf("failed to unmarshal query JSON: %w", err))
+	}
+
+	rangeSeconds := int64(query.TimeRange.Duration().Round(time.Second).Seconds())
+	builtins := map[string]string{
+		"__interval":    query.Interval.String(),
+		"__interval_ms": strconv.FormatInt(query.Interval.Milliseconds(), 10),
+		"__range":       strconv.FormatInt(rangeSeconds, 10) + "s",
+		"__range_s":     strconv.FormatInt(rangeSeconds, 10),
+		"__range_ms":    strconv.FormatInt(query.TimeRange.Duration().Milliseconds(), 10),
+		"__from":        strconv.FormatInt(query.TimeRange.From.UnixMilli(), 10),
+		"__to":          strconv.FormatInt(query.TimeRange.To.UnixMilli(), 10),
+	}
+	vars := make(map[string]string, len(builtins)+len(macros)+len(sv.ScopedVars))
+	for name, value := range macros {
+		vars[name] = interpolateString(value, builtins)
+	}
+	for name, value := range builtins {
+		vars[name] = value
+	}
+	for name, v := range sv.ScopedVars {
+		vars[name] = formatVariable(v.Value)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(query.JSON))
+	decoder.UseNumber() // keep large integers intact
+	var raw map[string]any
+	if err := decoder.Decode(&raw); err != nil {
+		return query, withCode(codeParseError, fmt.Errorf("failed to unmarshal query JSON: %w", err))
+	}
+	for key, value := range raw {
+		if key != "scopedVars" {
+			raw[key] = interpolateValue(value, vars)
+		}
+	}
+
+	interpolated, err := json.Marshal(raw)
+	if err != nil {
+		return query, fmt.Errorf("failed to marshal interpolated query: %w", err)
+	}
+	query.JSON = interpolated
+	return query, nil
+}
+
+// formatVariable renders a variable value. Several values become a regex
+// alternation, as most fields taking them are regexes.
+func formatVariable(value any) string {
+	values, ok := value.([]any)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	if len(values) == 1 {
+		return fmt.Sprint(values[0])
+	}
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	return "(" + strings.Join(parts, "|") + ")"
+}
+
+func interpolateValue(value any, vars map[string]string) any {
+	switch v := value.(type) {
+	case string:
+		return interpolateString(v, vars)
+	case []any:
+		for i := range v {
+			v[i] = interpolateValue(v[i], vars)
+		}
+		return v
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, elem := range v {
+			out[interpolateString(key, vars)] = interpolateValue(elem, vars)
+		}
+		return out
+	}
+	return value
+}
+
+func interpolateString(s string, vars map[string]string) string {
+	return variablePattern.ReplaceAllStringFunc(s, func(match string) string {
+		groups := variablePattern.FindStringSubmatch(match)
+		name := groups[1] + groups[2] + groups[3]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return match
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+const defaultWebhookRange = time.Hour
+
+// queryWebhook is a configured query webhook, parsed.
+type queryWebhook struct {
+	models.QueryWebhook
+	schedule cronSchedule
+	template *template.Template
+	token    string
+}
+
+// webhookFuncs are the functions of webhook templates besides the builtin
+// ones: json formats a value as JSON.
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// newQueryWebhooks validates the configured webhooks, with their tokens.
+func newQueryWebhooks(configured []models.QueryWebhook, tokens map[string]string) ([]*queryWebhook, error) {
+	webhooks := make([]*queryWebhook, 0, len(configured))
+	seen := map[string]bool{}
+	for _, w := range configured {
+		switch {
+		case w.Name == "":
+			return nil, fmt.Errorf("webhook to %q has no name", w.URL)
+		case seen[w.Name]:
+			return nil, fmt.Errorf("duplicate webhook name %q", w.Name)
+		case len(w.Query) == 0:
+			return nil, fmt.Errorf("webhook %s has no query", w.Name)
+		}
+		seen[w.Name] = true
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhook %s has invalid URL %q", w.Name, w.URL)
+		}
+		webhook := &queryWebhook{QueryWebhook: w, token: tokens[w.Name]}
+		var err error
+		if webhook.schedule, err = parseCron(w.Schedule); err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", w.Name, err)
+		}
+		if w.Template != "" {
+			if webhook.template, err = template.New(w.Name).Funcs(webhookFuncs).Parse(w.Template); err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", w.Name, err)
+			}
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// webhookResult is what webhooks post, and their templates are executed on:
+// the last value of each series of the query's result.
+type webhookResult struct {
+	Webhook string          `json:"webhook"`
+	Time    time.Time       `json:"time"`
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+	Series  []webhookSeries `json:"series"`
+}
+
+type webhookSeries struct {
+	Name   string      `json:"name"`
+	Labels data.Labels `json:"labels,omitempty"`
+	Unit   string      `json:"unit,omitempty"`
+	// Value is the last value of the series, at Time for time series
+	Value *float64   `json:"value"`
+	Time  *time.Time `json:"time,omitempty"`
+}
+
+// lastValues returns the last non-null value of each numeric field of
+// frames.
+func lastValues(frames data.Frames) ([]webhookSeries, error) {
+	series := []webhookSeries{}
+	for _, frame := range frames {
+		var times *data.Field
+		for _, field := range frame.Fields {
+			if field.Type().Time() {
+				times = field
+				break
+			}
+		}
+		for _, field := range frame.Fields {
+			if !field.Type().Numeric() {
+				continue
+			}
+			s := webhookSeries{Name: field.Name, Labels: field.Labels}
+			if field.Config != nil {
+				s.Unit = field.Config.Unit
+				if field.Config.DisplayNameFromDS != "" {
+					s.Name = field.Config.DisplayNameFromDS
+				}
+			}
+			for row := field.Len() - 1; row >= 0; row-- {
+				v, err := field.NullableFloatAt(row)
+				if err != nil {
+					return nil, err
+				}
+				if v == nil {
+					continue
+				}
+				s.Value = v
+				if times != nil {
+					if t, ok := times.ConcreteAt(row); ok {
+						at := t.(time.Time)
+						s.Time = &at
+					}
+				}
+				break
+			}
+			series = append(series, s)
+		}
+	}
+	return series, nil
+}
+
+// runWebhook runs the query of w over the range ending at now, and posts
+// its result.
+func (ds *testDataSource) runWebhook(ctx context.Context, w *queryWebhook, now time.Time) error {
+	span := defaultWebhookRange
+	if w.RangeSeconds > 0 {
+		span = time.Duration(w.RangeSeconds) * time.Second
+	}
+	query := backend.DataQuery{
+		RefID:         "A",
+		TimeRange:     backend.TimeRange{From: now.Add(-span), To: now},
+		Interval:      max(span/100, time.Second),
+		MaxDataPoints: 100,
+	}
+	frames, err := ds.runInnerQuery(ctx, query, w.Query)
+	if err != nil {
+		return fmt.Errorf("query failed: %w", err)
+	}
+	result := webhookResult{Webhook: w.Name, Time: now.UTC(), From: query.TimeRange.From.UTC(), To: now.UTC()}
+	if result.Series, err = lastValues(frames); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	contentType := w.ContentType
+	if w.template != nil {
+		if err := w.template.Execute(&body, result); err != nil {
+			return fmt.Errorf("template failed: %w", err)
+		}
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+	} else {
+		if err := json.NewEncoder(&body).Encode(result); err != nil {
+			return err
+		}
+		if contentType == "" {
+			contentType = "application/json"
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, &body)
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %w", redactURL(w.URL), err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	resp, err := send(ds.httpClient, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// runWebhooks posts the result of each webhook on its schedule, until the
+// instance is disposed of.
+func (ds *testDataSource) runWebhooks(ctx context.Context) {
+	type planned struct {
+		webhook *queryWebhook
+		job     *scheduledJob
+		next    time.Time
+	}
+	now := time.Now()
+	var plans []*planned
+	for _, w := range ds.webhooks {
+		next := w.schedule.next(now)
+		if next.IsZero() {
+			backend.Logger.Warn("Webhook schedule never runs", "webhook", w.Name, "schedule", w.Schedule)
+			continue
+		}
+		plans = append(plans, &planned{webhook: w, job: ds.schedule.add("webhook", w.Name, 0, next), next: next})
+	}
+	if len(plans) == 0 {
+		return
+	}
+
+	for {
+		soonest := plans[0].next
+		for _, p := range plans[1:] {
+			if p.next.Before(soonest) {
+				soonest = p.next
+			}
+		}
+		timer := time.NewTimer(time.Until(soonest))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		now := time.Now()
+		for _, p := range plans {
+			if p.next.After(now) {
+				continue
+			}
+			err := p.job.run(func() error { return ds.runWebhook(ctx, p.webhook, now) })
+			if err != nil {
+				backend.Logger.Warn("Webhook failed", "webhook", p.webhook.Name, "error", err)
+			}
+			p.next = p.webhook.schedule.next(time.Now())
+			p.job.plan(p.next)
+		}
+	}
+}
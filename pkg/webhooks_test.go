@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/kirillyesikov/homelab-plugin/pkg/models"
+)
+
+// TestWebhookRedactsPersonalSeries checks that webhooks, which run without
+// a user, leave out personal series, which alert rules still see.
+func TestWebhookRedactsPersonalSeries(t *testing.T) {
+	ds := newTestDataSource()
+	ds.settings = &models.PluginSettings{}
+	var err error
+	ds.personal, err = newPersonalData(models.PersonalDataSettings{
+		Redact: true,
+		Series: []models.PersonalSeries{{Person: "alice", Target: "nas", Metric: "node_load1"}},
+	}, ds.targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var posted []byte
+	ds.httpClient = &http.Client{Transport: httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		posted, _ = io.ReadAll(req.Body)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})}
+	webhooks, err := newQueryWebhooks([]models.QueryWebhook{{
+		Name:         "load",
+		Schedule:     "*/5 * * * *",
+		Query:        json.RawMessage(`{"metric": "node_load1", "target": "*"}`),
+		RangeSeconds: 600,
+		URL:          "https://hooks.example.com/load",
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.runWebhook(context.Background(), webhooks[0], testStart.Add(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	var result webhookResult
+	if err := json.Unmarshal(posted, &result); err != nil {
+		t.Fatalf("invalid payload %s: %v", posted, err)
+	}
+	var targets []string
+	for _, s := range result.Series {
+		targets = append(targets, s.Labels["target"])
+	}
+	if len(targets) != 1 || targets[0] != "router" {
+		t.Errorf("webhook posted the series of targets %v, want only router", targets)
+	}
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Headers: map[string]string{headerFromAlert: "true"},
+		Queries: []backend.DataQuery{{
+			RefID:         "A",
+			JSON:          []byte(`{"metric": "node_load1", "target": "*"}`),
+			Interval:      15 * time.Second,
+			MaxDataPoints: 1000,
+			TimeRange:     backend.TimeRange{From: testStart, To: testStart.Add(10 * time.Minute)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dr := resp.Responses["A"]; dr.Error != nil {
+		t.Fatal(dr.Error)
+	} else if len(dr.Frames) != 2 {
+		t.Errorf("alert rule query got %d series, want 2", len(dr.Frames))
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+// webSocketHandshakeTimeout bounds connecting to a WebSocket source.
+const webSocketHandshakeTimeout = 10 * time.Second
+
+// newWebSocketDialer returns the dialer of WebSocket sources, with the TLS
+// settings of clients built from opts and the egress policy.
+func newWebSocketDialer(opts httpclient.Options, egress *egressPolicy) (*websocket.Dialer, error) {
+	tlsConfig, err := clientTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	egress.guardProxy(proxy)
+	return &websocket.Dialer{
+		NetDialContext:   egress.dialContext,
+		Proxy:            proxy.Proxy,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: webSocketHandshakeTimeout,
+	}, nil
+}
+
+// streamWebSocket connects to target and ingests its messages until the
+// connection fails, returning why, or the instance is disposed of.
+func (ds *testDataSource) streamWebSocket(ctx context.Context, target *scrapeTarget) error {
+	header := http.Header{}
+	if target.Token != "" {
+		header.Set("Authorization", "Bearer "+target.Token)
+	}
+	conn, _, err := ds.wsDialer.DialContext(ctx, target.URL, header)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", redactURL(target.URL), err)
+	}
+	defer conn.Close()
+	target.push.connected()
+	backend.Logger.Info("WebSocket source connected", "target", target.Name)
+
+	for _, msg := range target.subscribe {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			return fmt.Errorf("failed to subscribe: %w", err)
+		}
+	}
+
+	// Reads block, so they run apart, until the connection is closed
+	messages := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			kind, msg, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if kind != websocket.TextMessage {
+				continue
+			}
+			select {
+			case messages <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pushRecordInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ds.drain:
+			closing := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+			_ = conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(time.Second))
+			return nil
+		case err := <-readErr:
+			return err
+		case msg := <-messages:
+			if err := target.push.ingest(msg); err != nil {
+				backend.Logger.Debug("Ignoring WebSocket message", "target", target.Name, "error", err)
+			}
+		case now := <-ticker.C:
+			target.push.flush(target, now)
+		}
+	}
+}
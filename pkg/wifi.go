@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeWifi = "wifi"
+
+// wifiStationsCmd dumps associated stations and channel noise for every
+// wireless interface on the access point.
+const wifiStationsCmd = `for dev in $(iw dev | awk '$1=="Interface"{print $2}'); do echo "Interface $dev"; iw dev "$dev" station dump; iw dev "$dev" survey dump; done`
+
+// maxWifiSamples bounds the per-client signal history kept in memory.
+const maxWifiSamples = 1440
+
+// maxRoamingEvents bounds the number of roaming events kept in memory.
+const maxRoamingEvents = 500
+
+func init() {
+	registerQueryType(queryTypeWifi, queryWifi, wifiQuery{})
+	registerConfiguredCheck(queryTypeWifi, func(ds *testDataSource) bool { return len(ds.settings.SSH.AllHosts()) > 0 })
+}
+
+type wifiQuery struct {
+	Host string `json:"host"`
+	// Mode is "signal" (default) for per-client time series or "roaming"
+	// for roaming event annotations.
+	Mode string `json:"mode"`
+}
+
+// wifiStation is a single associated client as seen by one access point.
+type wifiStation struct {
+	MAC       string
+	AP        string
+	Interface string
+	Signal    float64
+	Noise     float64
+	HasNoise  bool
+}
+
+func (s wifiStation) snr() (float64, bool) {
+	if !s.HasNoise {
+		return 0, false
+	}
+	return s.Signal - s.Noise, true
+}
+
+type wifiSample struct {
+	Time   time.Time
+	AP     string
+	Signal float64
+	SNR    *float64
+}
+
+type roamingEvent struct {
+	Time time.Time
+	MAC  string
+	From string
+	To   string
+}
+
+// wifiTracker keeps a bounded history of client signal samples and detects
+// roaming when a client shows up on a different access point.
+type wifiTracker struct {
+	mu      sync.Mutex
+	samples map[string][]wifiSample
+	lastAP  map[string]string
+	roams   []roamingEvent
+}
+
+func newWifiTracker() *wifiTracker {
+	return &wifiTracker{
+		samples: map[string][]wifiSample{},
+		lastAP:  map[string]string{},
+	}
+}
+
+func (t *wifiTracker) record(now time.Time, stations []wifiStation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range stations {
+		sample := wifiSample{Time: now, AP: s.AP, Signal: s.Signal}
+		if snr, ok := s.snr(); ok {
+			sample.SNR = &snr
+		}
+		history := append(t.samples[s.MAC], sample)
+		if len(history) > maxWifiSamples {
+			history = history[len(history)-maxWifiSamples:]
+		}
+		t.samples[s.MAC] = history
+
+		if prev, ok := t.lastAP[s.MAC]; ok && prev != s.AP {
+			t.roams = append(t.roams, roamingEvent{Time: now, MAC: s.MAC, From: prev, To: s.AP})
+			if len(t.roams) > maxRoamingEvents {
+				t.roams = t.roams[len(t.roams)-maxRoamingEvents:]
+			}
+		}
+		t.lastAP[s.MAC] = s.AP
+	}
+}
+
+// parseIwStations parses the output of wifiStationsCmd collected from ap.
+func parseIwStations(ap string, raw []byte) []wifiStation {
+	var stations []wifiStation
+	noise := map[string]float64{}
+
+	var iface string
+	var inSurvey, inUse bool
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "Interface "):
+			iface = strings.TrimPrefix(line, "Interface ")
+			inSurvey = false
+		case strings.HasPrefix(line, "Station "):
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				stations = append(stations, wifiStation{MAC: strings.ToLower(fields[1]), AP: ap, Interface: iface})
+			}
+			inSurvey = false
+		case strings.HasPrefix(line, "Survey data from"):
+			inSurvey, inUse = true, false
+		case inSurvey && strings.HasPrefix(line, "frequency:"):
+			inUse = strings.Contains(line, "[in use]")
+		case inSurvey && inUse && strings.HasPrefix(line, "noise:"):
+			if v, ok := parseDBm(strings.TrimPrefix(line, "noise:")); ok {
+				noise[iface] = v
+			}
+		case !inSurvey && strings.HasPrefix(line, "signal:") && len(stations) > 0:
+			if v, ok := parseDBm(strings.TrimPrefix(line, "signal:")); ok {
+				stations[len(stations)-1].Signal = v
+			}
+		}
+	}
+
+	for i := range stations {
+		if n, ok := noise[stations[i].Interface]; ok {
+			stations[i].Noise, stations[i].HasNoise = n, true
+		}
+	}
+
+	return stations
+}
+
+// parseDBm parses the leading number of values like "-52 [-55, -54] dBm".
+func parseDBm(s string) (float64, bool) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	return v, err == nil
+}
+
+func queryWifi(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q wifiQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+
+	hosts, err := ds.sshHosts(q.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, host := range hosts {
+		raw, err := ds.runRemoteCommand(ctx, host, wifiStationsCmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list wireless clients on %s: %w", host, err)
+		}
+		ds.wifi.record(now, parseIwStations(host, raw))
+	}
+
+	if q.Mode == "roaming" {
+		return data.Frames{ds.wifi.roamingFrame(query.TimeRange)}, nil
+	}
+	return ds.wifi.signalFrames(query.TimeRange), nil
+}
+
+// signalFrames returns one time series frame per client within tr.
+func (t *wifiTracker) signalFrames(tr backend.TimeRange) data.Frames {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	frames := data.Frames{}
+	for mac, history := range t.samples {
+		labels := data.Labels{"client": mac, "ap": t.lastAP[mac]}
+		frame := data.NewFrame(mac,
+			data.NewField("time", nil, []time.Time{}),
+			data.NewField("rssi", labels, []float64{}).SetConfig(&data.FieldConfig{Unit: "dBm"}),
+			data.NewField("snr", labels, []*float64{}).SetConfig(&data.FieldConfig{Unit: "dB"}),
+		)
+		for _, s := range history {
+			if s.Time.Before(tr.From) || s.Time.After(tr.To) {
+				continue
+			}
+			frame.AppendRow(s.Time, s.Signal, s.SNR)
+		}
+		if frame.Rows() > 0 {
+			frames = append(frames, frame)
+		}
+	}
+
+	return frames
+}
+
+// roamingFrame returns roaming events within tr in annotation shape.
+func (t *wifiTracker) roamingFrame(tr backend.TimeRange) *data.Frame {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	frame := data.NewFrame("roaming",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("text", nil, []string{}),
+		data.NewField("client", nil, []string{}),
+		data.NewField("from", nil, []string{}),
+		data.NewField("to", nil, []string{}),
+	)
+	for _, r := range t.roams {
+		if r.Time.Before(tr.From) || r.Time.After(tr.To) {
+			continue
+		}
+		frame.AppendRow(r.Time, fmt.Sprintf("%s roamed from %s to %s", r.MAC, r.From, r.To), r.MAC, r.From, r.To)
+	}
+
+	return frame
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const queryTypeWindows = "windows"
+
+func init() {
+	registerQueryType(queryTypeWindows, queryWindows, windowsQuery{})
+	registerConfiguredCheck(queryTypeWindows, func(ds *testDataSource) bool { return len(ds.settings.SSH.Windows) > 0 })
+}
+
+type windowsQuery struct {
+	Host string `json:"host"`
+	// Kind is "cpu", "memory", "disk" or "services".
+	Kind string `json:"kind"`
+	// Services are the names of the services to list; empty means those
+	// starting automatically.
+	Services []string `json:"services"`
+}
+
+// windowsScripts read the WMI classes of each kind with PowerShell, as JSON
+// arrays.
+var windowsScripts = map[string]string{
+	"cpu":      `Get-CimInstance Win32_PerfFormattedData_PerfOS_Processor | Select-Object Name,PercentProcessorTime,PercentUserTime,PercentPrivilegedTime`,
+	"memory":   `Get-CimInstance Win32_OperatingSystem | Select-Object TotalVisibleMemorySize,FreePhysicalMemory,TotalVirtualMemorySize,FreeVirtualMemory`,
+	"disk":     `Get-CimInstance Win32_LogicalDisk -Filter 'DriveType=3' | Select-Object DeviceID,VolumeName,FileSystem,Size,FreeSpace`,
+	"services": `Get-CimInstance Win32_Service | Select-Object Name,DisplayName,State,StartMode`,
+}
+
+// windowsServiceStates are the severities of service states. Services
+// starting automatically are critical when stopped; others are "inactive".
+var windowsServiceStates = stateScale{
+	"running":       severityOK,
+	"inactive":      severityOK,
+	"start pending": severityWarning,
+	"stop pending":  severityWarning,
+	"paused":        severityWarning,
+	"stopped":       severityCritical,
+}
+
+// listedHosts resolves the hosts of a system, such as the Windows ones, a
+// query should run against, as sshHosts does for Linux hosts.
+func listedHosts(system string, configured []string, host string) ([]string, error) {
+	if len(configured) == 0 {
+		return nil, fmt.Errorf("no %s host configured", system)
+	}
+	if host == "" {
+		return configured, nil
+	}
+	if !slices.Contains(configured, host) {
+		return nil, fmt.Errorf("%s host %q is not configured", system, host)
+	}
+	return []string{host}, nil
+}
+
+// powerShellCommand runs script with PowerShell, encoded so that neither
+// cmd.exe, the default shell of Windows' OpenSSH, nor PowerShell itself
+// interprets its quotes.
+func powerShellCommand(script string) string {
+	units := utf16.Encode([]rune(script))
+	raw := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(raw[2*i:], u)
+	}
+	return "powershell -NoProfile -NonInteractive -EncodedCommand " + base64.StdEncoding.EncodeToString(raw)
+}
+
+// readWMI runs the script of kind on host and decodes its objects.
+func (ds *testDataSource) readWMI(ctx context.Context, host, kind string) ([]map[string]any, error) {
+	// -InputObject keeps single objects in an array
+	script := "ConvertTo-Json -Compress -InputObject @(" + windowsScripts[kind] + ")"
+	raw, err := ds.runRemoteCommand(ctx, host, powerShellCommand(script))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s on %s: %w", kind, host, err)
+	}
+	var objects []map[string]any
+	if err := json.Unmarshal(raw, &objects); err != nil {
+		return nil, withCode(codeParseError, fmt.Errorf("invalid WMI output from %s: %w", host, err))
+	}
+	return objects, nil
+}
+
+// wmiNumber returns a numeric property, or nil when it's missing.
+func wmiNumber(object map[string]any, key string) *float64 {
+	if v, ok := numericValue(object[key]); ok {
+		return &v
+	}
+	return nil
+}
+
+func wmiString(object map[string]any, key string) string {
+	s, _ := scalarString(object[key])
+	return s
+}
+
+func queryWindows(ctx context.Context, ds *testDataSource, query backend.DataQuery) (data.Frames, error) {
+	var q windowsQuery
+	if err := json.Unmarshal(query.JSON, &q); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal query JSON: %w", err)
+	}
+	if q.Kind == "" {
+		q.Kind = "cpu"
+	}
+	if _, ok := windowsScripts[q.Kind]; !ok {
+		return nil, fmt.Errorf("unknown Windows kind %q", q.Kind)
+	}
+	hosts, err := listedHosts("Windows", ds.settings.SSH.Windows, q.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	objectsByHost := map[string][]map[string]any{}
+	for _, host := range hosts {
+		if objectsByHost[host], err = ds.readWMI(ctx, host, q.Kind); err != nil {
+			return nil, err
+		}
+	}
+	return data.Frames{windowsFrame(q, hosts, objectsByHost)}, nil
+}
+
+// windowsFrame tabulates the objects of each host.
+func windowsFrame(q windowsQuery, hosts []string, objectsByHost map[string][]map[string]any) *data.Frame {
+	percent := &data.FieldConfig{Unit: "percent"}
+	bytes := &data.FieldConfig{Unit: "bytes"}
+	frame := data.NewFrame("windows_" + q.Kind)
+	switch q.Kind {
+	case "cpu":
+		frame.Fields = data.Fields{
+			data.NewField("host", nil, []string{}),
+			data.NewField("cpu", nil, []string{}),
+			data.NewField("usage", nil, []*float64{}).SetConfig(percent),
+			data.NewField("user", nil, []*float64{}).SetConfig(percent),
+			data.NewField("privileged", nil, []*float64{}).SetConfig(percent),
+		}
+	case "memory":
+		frame.Fields = data.Fields{
+			data.NewField("host", nil, []string{}),
+			data.NewField("total", nil, []*float64{}).SetConfig(bytes),
+			data.NewField("free", nil, []*float64{}).SetConfig(bytes),
+			data.NewField("used", nil, []*float64{}).SetConfig(percent),
+			data.NewField("commit_limit", nil, []*float64{}).SetConfig(bytes),
+			data.NewField("commit_free", nil, []*float64{}).SetConfig(bytes),
+		}
+	case "disk":
+		frame.Fields = data.Fields{
+			data.NewField("host", nil, []string{}),
+			data.NewField("drive", nil, []string{}),
+			data.NewField("label", nil, []string{}),
+			data.NewField("filesystem", nil, []string{}),
+			data.NewField("size", nil, []*float64{}).SetConfig(bytes),
+			data.NewField("free", nil, []*float64{}).SetConfig(bytes),
+			data.NewField("used", nil, []*float64{}).SetConfig(percent),
+		}
+	case "services":
+		statusField, severityField := newStateFields(windowsServiceStates)
+		frame.Fields = data.Fields{
+			data.NewField("host", nil, []string{}),
+			data.NewField("service", nil, []string{}),
+			data.NewField("display_name", nil, []string{}),
+			data.NewField("start_mode", nil, []string{}),
+			statusField,
+			severityField,
+		}
+	}
+
+	for _, host := range hosts {
+		for _, o := range objectsByHost[host] {
+			switch q.Kind {
+			case "cpu":
+				frame.AppendRow(host, wmiString(o, "Name"), wmiNumber(o, "PercentProcessorTime"),
+					wmiNumber(o, "PercentUserTime"), wmiNumber(o, "PercentPrivilegedTime"))
+			case "memory":
+				// Win32_OperatingSystem counts kilobytes
+				kb := func(key string) *float64 {
+					v := wmiNumber(o, key)
+					if v != nil {
+						*v *= 1024
+					}
+					return v
+				}
+				total, free := kb("TotalVisibleMemorySize"), kb("FreePhysicalMemory")
+				frame.AppendRow(host, total, free, usedPercent(total, free), kb("TotalVirtualMemorySize"), kb("FreeVirtualMemory"))
+			case "disk":
+				size, free := wmiNumber(o, "Size"), wmiNumber(o, "FreeSpace")
+				frame.AppendRow(host, wmiString(o, "DeviceID"), wmiString(o, "VolumeName"), wmiString(o, "FileSystem"),
+					size, free, usedPercent(size, free))
+			case "services":
+				name, mode := wmiString(o, "Name"), wmiString(o, "StartMode")
+				if len(q.Services) > 0 && !slices.ContainsFunc(q.Services, func(s string) bool { return strings.EqualFold(s, name) }) {
+					continue
+				}
+				if len(q.Services) == 0 && mode != "Auto" {
+					continue
+				}
+				status := strings.ToLower(wmiString(o, "State"))
+				if status == "stopped" && mode != "Auto" {
+					status = "inactive"
+				}
+				frame.AppendRow(host, name, wmiString(o, "DisplayName"), mode, status, windowsServiceStates.severity(status))
+			}
+		}
+	}
+	return frame
+}
+
+// usedPercent is the share of total that isn't free.
+func usedPercent(total, free *float64) *float64 {
+	if total == nil || free == nil || *total <= 0 {
+		return nil
+	}
+	used := (*total - *free) / *total * 100
+	return &used
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// zfsPool is the state of a ZFS pool from zpool status, and of its scan.
+type zfsPool struct {
+	Name  string
+	State string
+	// ScanAction is "scrub" or "resilver" while one runs, and empty
+	// otherwise, paused scrubs included
+	ScanAction   string
+	ScanProgress float64
+}
+
+var (
+	zpoolScanRe     = regexp.MustCompile(`^(scrub|resilver) in progress`)
+	zpoolProgressRe = regexp.MustCompile(`([0-9.]+)% done`)
+)
+
+// parseZpoolStatus parses the output of zpool status. A host without pools
+// has none.
+func parseZpoolStatus(raw []byte) ([]zfsPool, error) {
+	var pools []zfsPool
+	var current *zfsPool
+	scanning := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		key, value, found := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+
+		switch {
+		case found && key == "pool":
+			if value == "" {
+				return nil, fmt.Errorf("malformed zpool status line %q", line)
+			}
+			pools = append(pools, zfsPool{Name: value})
+			current, scanning = &pools[len(pools)-1], false
+		case current == nil:
+			continue
+		case found && key == "state":
+			current.State = value
+		case found && key == "scan":
+			if m := zpoolScanRe.FindStringSubmatch(value); m != nil {
+				current.ScanAction, scanning = m[1], true
+			}
+		case found && (key == "config" || key == "errors"):
+			scanning = false
+		case scanning:
+			// The scan's progress is on the lines after it
+			if m := zpoolProgressRe.FindStringSubmatch(line); m != nil {
+				current.ScanProgress, _ = strconv.ParseFloat(m[1], 64)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read zpool status: %w", err)
+	}
+
+	return pools, nil
+}
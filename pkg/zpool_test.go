@@ -0,0 +1,119 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+const zpoolScrubbed = `  pool: tank
+ state: ONLINE
+  scan: scrub repaired 0B in 02:11:10 with 0 errors on Sun Oct 11 02:35:12 2026
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	tank        ONLINE       0     0     0
+	  mirror-0  ONLINE       0     0     0
+	    sda     ONLINE       0     0     0
+	    sdb     ONLINE       0     0     0
+
+errors: No known data errors
+`
+
+const zpoolResilvering = `  pool: tank
+ state: DEGRADED
+status: One or more devices is currently being resilvered.  The pool will
+	continue to function, possibly in a degraded state.
+action: Wait for the resilver to complete.
+  scan: resilver in progress since Sun Oct 11 04:02:17 2026
+	812G scanned at 1.02G/s, 356G issued at 447M/s, 3.51T total
+	178G resilvered, 9.91% done, 02:03:41 to go
+config:
+
+	NAME             STATE     READ WRITE CKSUM
+	tank             DEGRADED     0     0     0
+	  mirror-0       DEGRADED     0     0     0
+	    replacing-0  DEGRADED     0     0     0
+	      sda        OFFLINE      0     0     0
+	      sdc        ONLINE       0     0     0  (resilvering)
+	    sdb          ONLINE       0     0     0
+
+errors: No known data errors
+`
+
+func TestParseZpoolStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []zfsPool
+	}{
+		{name: "no pools", raw: "no pools available\n", want: nil},
+		{name: "scrubbed", raw: zpoolScrubbed, want: []zfsPool{{Name: "tank", State: "ONLINE"}}},
+		{name: "resilvering", raw: zpoolResilvering, want: []zfsPool{{Name: "tank", State: "DEGRADED", ScanAction: "resilver", ScanProgress: 9.91}}},
+		{
+			name: "scrubbing and paused",
+			raw: `  pool: backup
+ state: ONLINE
+  scan: scrub in progress since Sun Oct 11 00:24:01 2026
+	1.23T scanned at 512M/s, 800G issued at 300M/s, 3.5T total
+	0B repaired, 22.31% done, 02:33:12 to go
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	backup      ONLINE       0     0     0
+
+errors: No known data errors
+
+  pool: rpool
+ state: ONLINE
+  scan: scrub paused since Sun Oct 11 01:00:00 2026
+	scrub started on Sun Oct 11 00:00:00 2026
+	0B scanned, 0B issued, 120G total
+	0B repaired, 41.00% done
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	rpool       ONLINE       0     0     0
+
+errors: No known data errors
+`,
+			want: []zfsPool{
+				{Name: "backup", State: "ONLINE", ScanAction: "scrub", ScanProgress: 22.31},
+				{Name: "rpool", State: "ONLINE"},
+			},
+		},
+		{name: "never scanned", raw: "  pool: tank\n state: ONLINE\n  scan: none requested\nconfig:\n", want: []zfsPool{{Name: "tank", State: "ONLINE"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseZpoolStatus([]byte(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseZpoolStatus([]byte("  pool:\n state: ONLINE\n")); err == nil {
+		t.Error("pool without a name parsed")
+	}
+}
+
+func TestParseScrubStatus(t *testing.T) {
+	arrays, pools, err := parseScrubStatus([]byte(mdstatChecking + zpoolStatusMarker + "\n" + zpoolResilvering))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arrays) != 1 || arrays[0].SyncAction != "check" || len(pools) != 1 || pools[0].ScanAction != "resilver" {
+		t.Errorf("got arrays %+v and pools %+v, want md0 checked and tank resilvered", arrays, pools)
+	}
+
+	// Hosts with neither
+	if arrays, pools, err := parseScrubStatus([]byte(zpoolStatusMarker + "\n")); err != nil || len(arrays) != 0 || len(pools) != 0 {
+		t.Errorf("empty output: %+v, %+v, %v", arrays, pools, err)
+	}
+	if _, _, err := parseScrubStatus([]byte("cut short")); err == nil {
+		t.Error("output without the marker parsed")
+	}
+}